@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type accessUserKey struct{}
+
+// setAccessUser records who authenticated the request for its access log
+// line; requireAuth calls it further down the chain than withAccessLog.
+func setAccessUser(ctx context.Context, who string) {
+	if p, ok := ctx.Value(accessUserKey{}).(*string); ok {
+		*p = who
+	}
+}
+
+// withAccessLog logs one line per HTTP request once it has been served.
+// It runs inside withRequestIDs, so the line carries the request ID that
+// was also sent back in the X-Request-ID header.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		var user string
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), accessUserKey{}, &user)))
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", sw.code),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("client", r.RemoteAddr),
+		}
+		if user != "" {
+			attrs = append(attrs, slog.String("user", user))
+		}
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "http request", attrs...)
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(requestIDHandler{slog.NewTextHandler(&buf, nil)}))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	ws, _ := testWebServer(t)
+	ws.tokens = newStaticTokenSet("api-token")
+	ws.accessLog = true
+	for _, bearer := range []string{"api-token", "wrong"} {
+		req := httptest.NewRequest("GET", "/api/records", nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		req.Header.Set(requestIDHeader, "client-"+bearer)
+		ws.Handler().ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("log = %q", buf.String())
+	}
+	for _, want := range []string{`msg="http request"`, "method=GET", "path=/api/records", "status=200", "user=default", "request_id=client-api-token"} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("%q is missing %s", lines[0], want)
+		}
+	}
+	if !strings.Contains(lines[1], "status=401") || strings.Contains(lines[1], "user=") {
+		t.Errorf("rejected request logged as %q", lines[1])
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal ACME client (RFC 8555) that gets the HTTPS certificate from a
+// certificate authority such as Let's Encrypt and renews it. Control of the
+// names is proven with dns-01 challenges answered from our own records, so
+// the names (or their _acme-challenge labels) must be delegated to this
+// server, but nothing has to listen on port 80.
+
+const (
+	defaultACMEDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+	acmeSchedule         = "@every 12h"
+	acmeRenewBefore      = 30 * 24 * time.Hour
+	acmeTimeout          = 5 * time.Minute
+	acmeSource           = "acme"
+)
+
+// acmePollInterval is how often pending authorizations and orders are
+// checked; tests shorten it.
+var acmePollInterval = 3 * time.Second
+
+// ACME keeps a certificate for Domains in dir, issuing a new one when it is
+// missing or within acmeRenewBefore of expiry. The account key, certificate
+// and key are kept there across restarts.
+type ACME struct {
+	Directory string
+	Domains   []string
+	Email     string
+	certs     *CertReloader
+	store     *Store
+	client    *http.Client
+
+	mu    sync.Mutex // one issuance at a time
+	key   *ecdsa.PrivateKey
+	urls  acmeDirectory
+	kid   string // account URL, once registered
+	nonce string
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+// acmeProblem is an RFC 7807 problem document, as ACME servers report errors.
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *acmeProblem) Error() string {
+	return strings.TrimPrefix(p.Type, "urn:ietf:params:acme:error:") + ": " + p.Detail
+}
+
+// NewACME loads the account key from dir, creating one on first use, and
+// any certificate issued before.
+func NewACME(directory, email string, domains []string, dir string, store *Store) (*ACME, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	key, err := loadOrCreateKey(filepath.Join(dir, "account.key"))
+	if err != nil {
+		return nil, fmt.Errorf("acme account key: %w", err)
+	}
+	a := &ACME{
+		Directory: directory,
+		Domains:   domains,
+		Email:     email,
+		certs:     &CertReloader{certPath: filepath.Join(dir, "cert.pem"), keyPath: filepath.Join(dir, "key.pem")},
+		store:     store,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		key:       key,
+	}
+	if err := a.certs.Reload(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("ignoring unusable acme certificate", "dir", dir, "error", err)
+	}
+	return a, nil
+}
+
+func loadOrCreateKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), true)
+}
+
+// Run is the scheduled job: it gets a certificate if there is none or the
+// current one expires soon.
+func (a *ACME) Run(ctx context.Context) error {
+	if time.Until(a.certs.NotAfter()) > acmeRenewBefore {
+		return nil
+	}
+	if err := a.Obtain(ctx); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "acme certificate issued", "domains", a.Domains, "expires", a.certs.NotAfter())
+	return nil
+}
+
+// Obtain orders a certificate for the domains, answers the challenges,
+// stores the result in the directory and starts serving it.
+func (a *ACME) Obtain(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, acmeTimeout)
+	defer cancel()
+
+	if a.urls.NewOrder == "" {
+		if err := a.get(ctx, a.Directory, &a.urls); err != nil {
+			return fmt.Errorf("acme directory: %w", err)
+		}
+	}
+	if a.kid == "" {
+		account := map[string]any{"termsOfServiceAgreed": true}
+		if a.Email != "" {
+			account["contact"] = []string{"mailto:" + a.Email}
+		}
+		h, err := a.post(ctx, a.urls.NewAccount, account, nil)
+		if err != nil {
+			return fmt.Errorf("acme account: %w", err)
+		}
+		a.kid = h.Get("Location")
+	}
+
+	identifiers := make([]map[string]string, len(a.Domains))
+	for i, d := range a.Domains {
+		identifiers[i] = map[string]string{"type": "dns", "value": d}
+	}
+	var order acmeOrder
+	h, err := a.post(ctx, a.urls.NewOrder, map[string]any{"identifiers": identifiers}, &order)
+	if err != nil {
+		return fmt.Errorf("acme order: %w", err)
+	}
+	orderURL := h.Get("Location")
+
+	if err := a.authorize(ctx, order.Authorizations); err != nil {
+		return err
+	}
+	if err := a.poll(ctx, orderURL, &order, &order.Status); err != nil {
+		return fmt.Errorf("acme order: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: a.Domains}, key)
+	if err != nil {
+		return err
+	}
+	if _, err := a.post(ctx, order.Finalize, map[string]string{"csr": b64(csr)}, &order); err != nil {
+		return fmt.Errorf("acme finalize: %w", err)
+	}
+	if err := a.poll(ctx, orderURL, &order, &order.Status); err != nil {
+		return fmt.Errorf("acme order: %w", err)
+	}
+	if order.Status != "valid" {
+		return fmt.Errorf("acme order is %s", order.Status)
+	}
+	var chain []byte
+	if _, err := a.post(ctx, order.Certificate, nil, &chain); err != nil {
+		return fmt.Errorf("acme certificate: %w", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(a.certs.keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), true); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(a.certs.certPath, chain, true); err != nil {
+		return err
+	}
+	return a.certs.Reload()
+}
+
+// authorize publishes the dns-01 answers for every pending authorization,
+// asks the server to check them, and waits for the verdicts. The answers
+// are withdrawn afterwards either way.
+func (a *ACME) authorize(ctx context.Context, urls []string) error {
+	var records []Record
+	var pending []string
+	var challenges []string
+	for _, u := range urls {
+		var authz acmeAuthorization
+		if _, err := a.post(ctx, u, nil, &authz); err != nil {
+			return fmt.Errorf("acme authorization: %w", err)
+		}
+		if authz.Status == "valid" {
+			continue
+		}
+		i := slices.IndexFunc(authz.Challenges, func(c acmeChallenge) bool { return c.Type == "dns-01" })
+		if i < 0 {
+			return fmt.Errorf("acme: no dns-01 challenge offered for %s", authz.Identifier.Value)
+		}
+		ch := authz.Challenges[i]
+		digest := sha256.Sum256([]byte(ch.Token + "." + a.thumbprint()))
+		records = append(records, Record{
+			Domain: "_acme-challenge." + authz.Identifier.Value,
+			Type:   "TXT",
+			Value:  b64(digest[:]),
+		})
+		pending = append(pending, u)
+		challenges = append(challenges, ch.URL)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	a.store.SetSource(acmeSource, records)
+	defer a.store.SetSource(acmeSource, nil)
+	for _, u := range challenges {
+		if _, err := a.post(ctx, u, struct{}{}, nil); err != nil {
+			return fmt.Errorf("acme challenge: %w", err)
+		}
+	}
+	for _, u := range pending {
+		var authz acmeAuthorization
+		if err := a.poll(ctx, u, &authz, &authz.Status); err != nil {
+			return fmt.Errorf("acme authorization: %w", err)
+		}
+		if authz.Status != "valid" {
+			for _, c := range authz.Challenges {
+				if c.Error != nil {
+					return fmt.Errorf("acme challenge for %s: %w", authz.Identifier.Value, c.Error)
+				}
+			}
+			return fmt.Errorf("acme authorization for %s is %s", authz.Identifier.Value, authz.Status)
+		}
+	}
+	return nil
+}
+
+// poll re-fetches url into out until *status is no longer pending or
+// processing.
+func (a *ACME) poll(ctx context.Context, url string, out any, status *string) error {
+	for {
+		if _, err := a.post(ctx, url, nil, out); err != nil {
+			return err
+		}
+		if *status != "pending" && *status != "processing" {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(acmePollInterval):
+		}
+	}
+}
+
+func (a *ACME) get(ctx context.Context, url string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// post sends a signed request. A nil payload is a POST-as-GET, which is how
+// ACME reads resources. The response is decoded into out, or kept raw when
+// out is a *[]byte. A rejected nonce is retried with the fresh one the
+// error carries.
+func (a *ACME) post(ctx context.Context, url string, payload, out any) (http.Header, error) {
+	for attempt := 0; ; attempt++ {
+		body, err := a.sign(ctx, url, payload)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		resp, err := a.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		a.nonce = resp.Header.Get("Replay-Nonce")
+		if resp.StatusCode >= 400 {
+			problem := &acmeProblem{Type: resp.Status}
+			json.Unmarshal(data, problem)
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt < 2 {
+				continue
+			}
+			return nil, problem
+		}
+		switch out := out.(type) {
+		case nil:
+		case *[]byte:
+			*out = data
+		default:
+			if err := json.Unmarshal(data, out); err != nil {
+				return nil, fmt.Errorf("%s: %w", url, err)
+			}
+		}
+		return resp.Header, nil
+	}
+}
+
+// sign wraps payload in a flattened JWS signed with the account key, using
+// the key itself until the account is registered and its URL after.
+func (a *ACME) sign(ctx context.Context, url string, payload any) ([]byte, error) {
+	if a.nonce == "" {
+		req, err := http.NewRequestWithContext(ctx, "HEAD", a.urls.NewNonce, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := a.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("acme nonce: %w", err)
+		}
+		resp.Body.Close()
+		if a.nonce = resp.Header.Get("Replay-Nonce"); a.nonce == "" {
+			return nil, errors.New("acme nonce: none in response")
+		}
+	}
+	protected := map[string]any{"alg": "ES256", "nonce": a.nonce, "url": url}
+	if a.kid != "" {
+		protected["kid"] = a.kid
+	} else {
+		protected["jwk"] = a.jwk()
+	}
+	a.nonce = ""
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	var body string
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = b64(data)
+	}
+	signingInput := b64(header) + "." + body
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	// JWS wants the fixed-size r || s, not the ASN.1 form
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return json.Marshal(map[string]string{"protected": b64(header), "payload": body, "signature": b64(sig)})
+}
+
+// jwk is the account's public key as a JSON Web Key (RFC 7517).
+func (a *ACME) jwk() map[string]string {
+	pub, err := a.key.PublicKey.ECDH()
+	if err != nil {
+		panic(err) // P-256 keys always convert
+	}
+	point := pub.Bytes() // 0x04 || x || y
+	return map[string]string{"crv": "P-256", "kty": "EC", "x": b64(point[1:33]), "y": b64(point[33:])}
+}
+
+// thumbprint is the RFC 7638 thumbprint of the account key, which key
+// authorizations tie challenge tokens to. Marshalling a map sorts the
+// members, which is the canonical form the RFC asks for.
+func (a *ACME) thumbprint() string {
+	data, _ := json.Marshal(a.jwk())
+	sum := sha256.Sum256(data)
+	return b64(sum[:])
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
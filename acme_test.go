@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeACME is just enough of an ACME server for one dns-01 order. It checks
+// every request's signature and nonce, and validates the challenge by
+// looking the TXT record up in the store.
+type fakeACME struct {
+	t     *testing.T
+	store *Store
+	srv   *httptest.Server
+
+	mu      sync.Mutex
+	nonces  map[string]bool
+	issued  int // nonces handed out
+	account *ecdsa.PublicKey
+	jwk     map[string]string
+	status  string // of the authorization
+	csr     *x509.CertificateRequest
+	orders  int
+}
+
+func newFakeACME(t *testing.T, store *Store) *fakeACME {
+	f := &fakeACME{t: t, store: store, nonces: map[string]bool{}, status: "pending"}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeACME) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u := f.srv.URL
+	f.issued++
+	nonce := fmt.Sprint(f.issued)
+	f.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+
+	switch r.URL.Path {
+	case "/directory":
+		json.NewEncoder(w).Encode(map[string]string{"newNonce": u + "/nonce", "newAccount": u + "/account", "newOrder": u + "/order"})
+		return
+	case "/nonce":
+		return
+	}
+
+	var jws struct{ Protected, Payload, Signature string }
+	json.NewDecoder(r.Body).Decode(&jws)
+	var header struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  map[string]string
+	}
+	jwsDecode(f.t, jws.Protected, &header)
+	if !f.nonces[header.Nonce] || header.URL != u+r.URL.Path {
+		f.t.Errorf("%s: bad nonce %q or url %q", r.URL.Path, header.Nonce, header.URL)
+	}
+	delete(f.nonces, header.Nonce)
+
+	key := f.account
+	if r.URL.Path == "/account" {
+		x, y := b64decode(f.t, header.JWK["x"]), b64decode(f.t, header.JWK["y"])
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		f.account, f.jwk = key, header.JWK
+		w.Header().Set("Location", u+"/acct/1")
+	} else if header.Kid != u+"/acct/1" {
+		f.t.Errorf("%s: kid %q", r.URL.Path, header.Kid)
+	}
+	sig := b64decode(f.t, jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if key == nil || len(sig) != 64 || !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		f.t.Errorf("%s: bad signature", r.URL.Path)
+	}
+
+	order := func() map[string]any {
+		o := map[string]any{"status": "pending", "authorizations": []string{u + "/authz"}, "finalize": u + "/finalize"}
+		if f.status == "valid" {
+			o["status"] = "ready"
+		}
+		if f.csr != nil {
+			o["status"], o["certificate"] = "valid", u+"/cert"
+		}
+		return o
+	}
+	switch r.URL.Path {
+	case "/account":
+		w.WriteHeader(201)
+	case "/order":
+		f.orders++
+		w.Header().Set("Location", u+"/order/1")
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(order())
+	case "/order/1":
+		json.NewEncoder(w).Encode(order())
+	case "/authz":
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":     f.status,
+			"identifier": map[string]string{"type": "dns", "value": "dns.example.com"},
+			"challenges": []map[string]string{
+				{"type": "http-01", "url": u + "/chall/http", "token": "tok-http"},
+				{"type": "dns-01", "url": u + "/chall/dns", "token": "tok-dns"},
+			},
+		})
+	case "/chall/dns":
+		data, _ := json.Marshal(f.jwk)
+		thumb := sha256.Sum256(data)
+		want := sha256.Sum256([]byte("tok-dns." + b64(thumb[:])))
+		records, _ := f.store.Resolve("_acme-challenge.dns.example.com", 16)
+		if len(records) == 1 && records[0].Value == b64(want[:]) {
+			f.status = "valid"
+		} else {
+			f.status = "invalid"
+		}
+		json.NewEncoder(w).Encode(map[string]string{"type": "dns-01", "status": "processing"})
+	case "/finalize":
+		var req struct{ CSR string }
+		jwsDecode(f.t, jws.Payload, &req)
+		csr, err := x509.ParseCertificateRequest(b64decode(f.t, req.CSR))
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		f.csr = csr
+		json.NewEncoder(w).Encode(order())
+	case "/cert":
+		caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(f.orders)),
+			Subject:      pkix.Name{CommonName: f.csr.DNSNames[0]},
+			DNSNames:     f.csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, f.csr.PublicKey, caKey)
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func jwsDecode(t *testing.T, s string, v any) {
+	t.Helper()
+	if err := json.Unmarshal(b64decode(t, s), v); err != nil {
+		t.Errorf("decoding %q: %v", s, err)
+	}
+}
+
+func b64decode(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Errorf("decoding %q: %v", s, err)
+	}
+	return data
+}
+
+func TestACME(t *testing.T) {
+	acmePollInterval = time.Millisecond
+	dir := t.TempDir()
+	store, err := NewStore(filepath.Join(dir, "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := newFakeACME(t, store)
+	a, err := NewACME(ca.srv.URL+"/directory", "ops@example.com", []string{"dns.example.com"}, filepath.Join(dir, "acme"), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.certs.GetCertificate(nil); err == nil {
+		t.Error("certificate before issuance")
+	}
+
+	ctx := context.Background()
+	if err := a.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := a.certs.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if strings.Join(leaf.DNSNames, ",") != "dns.example.com" {
+		t.Errorf("certificate names = %v", leaf.DNSNames)
+	}
+	if records, _ := store.Resolve("_acme-challenge.dns.example.com", 16); len(records) != 0 {
+		t.Errorf("challenge record left behind: %+v", records)
+	}
+
+	// A fresh certificate isn't renewed, and a restart picks it up from disk
+	if err := a.Run(ctx); err != nil || ca.orders != 1 {
+		t.Errorf("second run: %v, %d orders", err, ca.orders)
+	}
+	again, err := NewACME(ca.srv.URL+"/directory", "", []string{"dns.example.com"}, filepath.Join(dir, "acme"), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.certs.NotAfter().Equal(a.certs.NotAfter()) || !again.key.Equal(a.key) {
+		t.Error("restart lost the certificate or account key")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// Activated holds the sockets systemd bound for us (socket activation, see
+// sd_listen_fds(3)). Listeners take the socket matching their address
+// instead of binding one, so the process needs no privilege for port 53
+// and the sockets, owned by systemd, stay open across restarts.
+type Activated struct {
+	mu        sync.Mutex
+	packet    []net.PacketConn
+	listeners []net.Listener
+}
+
+// UDP takes the activated UDP socket bound to addr. It is safe to call on
+// a nil Activated.
+func (a *Activated) UDP(addr string) (*net.UDPConn, bool) {
+	if a == nil {
+		return nil, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, pc := range a.packet {
+		if conn, ok := pc.(*net.UDPConn); ok && boundTo(conn.LocalAddr(), addr) {
+			a.packet = append(a.packet[:i], a.packet[i+1:]...)
+			return conn, true
+		}
+	}
+	return nil, false
+}
+
+// Listener takes the activated stream socket bound to addr, a TCP address
+// or "unix:" and a path. It is safe to call on a nil Activated.
+func (a *Activated) Listener(addr string) (net.Listener, bool) {
+	if a == nil {
+		return nil, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, ln := range a.listeners {
+		if boundTo(ln.Addr(), addr) {
+			a.listeners = append(a.listeners[:i], a.listeners[i+1:]...)
+			return ln, true
+		}
+	}
+	return nil, false
+}
+
+// boundTo reports whether a socket bound to bound serves the listen address
+// addr. An address without a host matches a socket bound to all addresses
+// on the same port, which is what binding it would have given.
+func boundTo(bound net.Addr, addr string) bool {
+	if path, ok := cutUnix(addr); ok {
+		u, isUnix := bound.(*net.UnixAddr)
+		return isUnix && u.Name == path
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	var ip net.IP
+	var bport int
+	switch b := bound.(type) {
+	case *net.UDPAddr:
+		ip, bport = b.IP, b.Port
+	case *net.TCPAddr:
+		ip, bport = b.IP, b.Port
+	default:
+		return false
+	}
+	if p, err := net.LookupPort(bound.Network(), port); err != nil || p != bport {
+		return false
+	}
+	if host == "" {
+		return ip.IsUnspecified()
+	}
+	want := net.ParseIP(host)
+	return want != nil && want.Equal(ip)
+}
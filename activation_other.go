@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// ActivatedSockets returns nil: socket activation is a systemd feature, and
+// there are no inherited descriptors to take on this platform.
+func ActivatedSockets() (*Activated, error) {
+	return nil, nil
+}
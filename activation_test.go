@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestBoundTo(t *testing.T) {
+	any53 := &net.UDPAddr{IP: net.IPv6unspecified, Port: 53}
+	lo53 := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	for _, tt := range []struct {
+		bound net.Addr
+		addr  string
+		want  bool
+	}{
+		{any53, ":53", true},
+		{any53, ":domain", true},
+		{any53, ":5353", false},
+		{any53, "127.0.0.1:53", false},
+		{lo53, "127.0.0.1:53", true},
+		{lo53, ":53", false},
+		{&net.UnixAddr{Name: "/run/api.sock", Net: "unix"}, "unix:/run/api.sock", true},
+		{&net.UnixAddr{Name: "/run/api.sock", Net: "unix"}, ":13860", false},
+	} {
+		if got := boundTo(tt.bound, tt.addr); got != tt.want {
+			t.Errorf("boundTo(%v, %q) = %v, want %v", tt.bound, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestActivatedSockets(t *testing.T) {
+	// Sockets meant for another process are left alone
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "2")
+	if a, err := ActivatedSockets(); a != nil || err != nil {
+		t.Errorf("got %v, %v for another process's sockets", a, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS left for children")
+	}
+}
+
+func TestDNSActivated(t *testing.T) {
+	// Bind the sockets ourselves, as systemd would
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		t.Skipf("TCP port for %s is taken: %v", addr, err)
+	}
+
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Record{Domain: "app.test", Type: "A", Value: "10.0.0.1"})
+	dns := NewDNSServer(store, nil)
+	dns.activated = &Activated{packet: []net.PacketConn{pc}, listeners: []net.Listener{ln}}
+	errc := make(chan error, 1)
+	go func() { errc <- dns.ListenAndServe(addr) }()
+	select {
+	case <-dns.ready:
+		t.Cleanup(dns.Close)
+	case err := <-errc:
+		t.Fatalf("listen: %v", err)
+	}
+
+	if len(dns.activated.packet) != 0 || len(dns.activated.listeners) != 0 {
+		t.Error("activated sockets not taken")
+	}
+	if resp := exchange(t, addr, buildTestQuery("app.test", 1, 1)); resp[7] != 1 {
+		t.Errorf("answers = %d, want 1", resp[7])
+	}
+}
@@ -0,0 +1,57 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// listenFDsStart is the first descriptor systemd passes (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+// ActivatedSockets collects the sockets passed in LISTEN_FDS, if they are
+// meant for this process. The variables are cleared so children don't
+// inherit them. It returns nil when there are none.
+func ActivatedSockets() (*Activated, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	a := &Activated{}
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+		if err != nil {
+			return nil, fmt.Errorf("activated descriptor %d: %w", fd, err)
+		}
+		if typ == syscall.SOCK_DGRAM {
+			pc, err := net.FilePacketConn(f)
+			if err != nil {
+				return nil, fmt.Errorf("activated descriptor %d: %w", fd, err)
+			}
+			a.packet = append(a.packet, pc)
+			slog.Info("using activated socket", "network", pc.LocalAddr().Network(), "addr", pc.LocalAddr())
+		} else {
+			ln, err := net.FileListener(f)
+			if err != nil {
+				return nil, fmt.Errorf("activated descriptor %d: %w", fd, err)
+			}
+			a.listeners = append(a.listeners, ln)
+			slog.Info("using activated socket", "network", ln.Addr().Network(), "addr", ln.Addr())
+		}
+		f.Close() // the conns hold their own duplicates
+	}
+	return a, nil
+}
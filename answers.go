@@ -0,0 +1,137 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultAnswerCacheSize = 1000
+
+type answerKey struct {
+	view  string
+	name  string // lowercased
+	qtype uint16
+}
+
+// compiledAnswer is the answer section for one key, encoded once. The
+// records stay in store order and are rotated as they are copied out, so
+// round-robin works as it does uncached.
+type compiledAnswer struct {
+	key        answerKey
+	generation uint64    // the store's, when compiled
+	expires    time.Time // the earliest expiry among the records, if any
+	rrs        []byte
+	offsets    []int // where each RR starts in rrs, then len(rrs)
+	runs       []int // the first RR of each rotation run, then the RR count
+}
+
+// AnswerCache keeps the wire form of answers from local records for the
+// most asked names, so a hit skips the record lookup and encoding. An entry
+// is dropped when the store changes or one of its records expires. Only
+// answers with records are kept: whether an empty answer still stands can
+// depend on records it doesn't include. The client's EDNS buffer size is
+// not part of the key since answers carry no OPT record and are truncated,
+// if at all, after they are built. It is bounded with least-recently-used
+// eviction.
+type AnswerCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[answerKey]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+func NewAnswerCache(max int) *AnswerCache {
+	return &AnswerCache{
+		max:     max,
+		entries: make(map[answerKey]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// Get returns the compiled answer for key if it was built from the store
+// at generation and none of its records has expired since.
+func (c *AnswerCache) Get(key answerKey, generation uint64) (*compiledAnswer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	a := el.Value.(*compiledAnswer)
+	if a.generation != generation || !a.expires.IsZero() && !c.now().Before(a.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return a, true
+}
+
+// Put compiles the answer to query from records, as resolved from the store
+// at generation, and keeps it. It reports false, keeping nothing, when there
+// are no records or one can't be encoded.
+func (c *AnswerCache) Put(key answerKey, generation uint64, query []byte, records []Record) (*compiledAnswer, bool) {
+	if len(records) == 0 {
+		return nil, false
+	}
+	a := &compiledAnswer{key: key, generation: generation}
+	for i, r := range records {
+		if i == 0 || r.Type != records[i-1].Type || !strings.EqualFold(r.Domain, records[i-1].Domain) {
+			a.runs = append(a.runs, i)
+		}
+		if !r.Expires.IsZero() && (a.expires.IsZero() || r.Expires.Before(a.expires)) {
+			a.expires = r.Expires
+		}
+		a.offsets = append(a.offsets, len(a.rrs))
+		var ok bool
+		if a.rrs, ok = appendAnswerRR(a.rrs, query, r); !ok {
+			return nil, false
+		}
+	}
+	a.offsets = append(a.offsets, len(a.rrs))
+	a.runs = append(a.runs, len(records))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value = a
+		c.lru.MoveToFront(el)
+		return a, true
+	}
+	c.entries[key] = c.lru.PushFront(a)
+	for c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*compiledAnswer).key)
+	}
+	return a, true
+}
+
+// Len returns the number of compiled answers.
+func (c *AnswerCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// appendResponse appends the response to query to b, each run of records
+// rotated by rotation as rotateAnswers would.
+func (a *compiledAnswer) appendResponse(b, query []byte, questionEnd, rotation int) []byte {
+	start := len(b)
+	b = append(b, query[0], query[1], 0x84|(query[2]&0x01), 0x80, 0, 1, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(b[start+6:], uint16(len(a.offsets)-1))
+	b = append(b, query[12:questionEnd]...)
+	for i := range len(a.runs) - 1 {
+		first, n := a.runs[i], a.runs[i+1]-a.runs[i]
+		for j := range n {
+			rr := first + (j+rotation%n)%n
+			b = append(b, a.rrs[a.offsets[rr]:a.offsets[rr+1]]...)
+		}
+	}
+	return b
+}
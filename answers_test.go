@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAnswerCacheMatchesUncached(t *testing.T) {
+	query := buildTestQuery("www.example.com", 1, 1)
+	records := []Record{
+		{Domain: "www.example.com", Type: "CNAME", Value: "lb.example.com"},
+		{Domain: "lb.example.com", Type: "A", Value: "10.0.0.1"},
+		{Domain: "lb.example.com", Type: "A", Value: "10.0.0.2"},
+		{Domain: "lb.example.com", Type: "A", Value: "10.0.0.3"},
+	}
+	c := NewAnswerCache(10)
+	key := answerKey{"", "www.example.com", 1}
+	a, ok := c.Put(key, 1, query, records)
+	if !ok {
+		t.Fatal("Put refused the answer")
+	}
+	for rotation := range 5 {
+		want := slices.Clone(records)
+		rotateAnswers(want, rotation)
+		got := a.appendResponse(nil, query, len(query), rotation)
+		if !bytes.Equal(got, buildDNSResponse(query, len(query), want)) {
+			t.Errorf("rotation %d: compiled response differs from the uncached one", rotation)
+		}
+	}
+}
+
+func TestAnswerCacheInvalidation(t *testing.T) {
+	query := buildTestQuery("temp.example.com", 1, 1)
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewAnswerCache(10)
+	c.now = func() time.Time { return now }
+	key := answerKey{"", "temp.example.com", 1}
+
+	if _, ok := c.Put(key, 1, query, nil); ok {
+		t.Error("empty answer was cached")
+	}
+	records := []Record{
+		{Domain: "temp.example.com", Type: "A", Value: "10.0.0.1"},
+		{Domain: "temp.example.com", Type: "A", Value: "10.0.0.2", Expires: now.Add(time.Minute)},
+	}
+	if _, ok := c.Put(key, 1, query, records); !ok {
+		t.Fatal("Put refused the answer")
+	}
+	if _, ok := c.Get(key, 1); !ok {
+		t.Fatal("expected hit")
+	}
+	if _, ok := c.Get(answerKey{"lan", "temp.example.com", 1}, 1); ok {
+		t.Error("hit for another view")
+	}
+	if _, ok := c.Get(key, 2); ok {
+		t.Error("hit after the store changed")
+	}
+	if c.Len() != 0 {
+		t.Errorf("Len = %d, want the stale entry dropped", c.Len())
+	}
+
+	c.Put(key, 2, query, records)
+	now = now.Add(time.Minute)
+	if _, ok := c.Get(key, 2); ok {
+		t.Error("hit after a record expired")
+	}
+}
+
+func TestAnswerCacheEviction(t *testing.T) {
+	c := NewAnswerCache(2)
+	put := func(name string) {
+		query := buildTestQuery(name, 1, 1)
+		c.Put(answerKey{"", name, 1}, 1, query, []Record{{Domain: name, Type: "A", Value: "10.0.0.1"}})
+	}
+	put("a.example.com")
+	put("b.example.com")
+	c.Get(answerKey{"", "a.example.com", 1}, 1)
+	put("c.example.com")
+
+	if c.Len() != 2 {
+		t.Errorf("Len = %d, want 2", c.Len())
+	}
+	if _, ok := c.Get(answerKey{"", "b.example.com", 1}, 1); ok {
+		t.Error("least recently used entry was kept")
+	}
+	if _, ok := c.Get(answerKey{"", "a.example.com", 1}, 1); !ok {
+		t.Error("recently used entry was evicted")
+	}
+}
+
+func TestDNSAnswerCache(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := store.Add(Record{Domain: "app.example.com", Type: "A", Value: "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dns := NewDNSServer(store, nil)
+	dns.answers = NewAnswerCache(10)
+	addr := startDNSServer(t, dns)
+
+	answer := func() netip.Addr {
+		resp := exchange(t, addr, buildTestQuery("App.Example.com", 1, 1))
+		if resp[3]&0x0F != 0 || resp[7] != 1 {
+			t.Fatalf("rcode=%d ancount=%d", resp[3]&0x0F, resp[7])
+		}
+		ip, _ := netip.AddrFromSlice(resp[len(resp)-4:])
+		return ip
+	}
+	for range 3 {
+		if got := answer(); got.String() != "10.0.0.1" {
+			t.Fatalf("answer = %s, want 10.0.0.1", got)
+		}
+	}
+	if dns.answers.Len() != 1 {
+		t.Errorf("answers cached = %d, want 1", dns.answers.Len())
+	}
+
+	rec.Value = "10.0.0.2"
+	if _, err := store.Update(rec.ID, rec); err != nil {
+		t.Fatal(err)
+	}
+	if got := answer(); got.String() != "10.0.0.2" {
+		t.Errorf("answer after update = %s, want 10.0.0.2", got)
+	}
+}
+
+func BenchmarkResolveAnswerCache(b *testing.B) {
+	store, err := NewStore(filepath.Join(b.TempDir(), "records.tsv"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := range 4 {
+		if _, err := store.Add(Record{Domain: "app.example.com", Type: "A", Value: fmt.Sprintf("10.0.0.%d", i+1)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	query := buildTestQuery("app.example.com", 1, 1)
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cached=%t", cached), func(b *testing.B) {
+			dns := NewDNSServer(store, nil)
+			if cached {
+				dns.answers = NewAnswerCache(10)
+			}
+			out := make([]byte, 0, udpBufSize)
+			b.ReportAllocs()
+			for b.Loop() {
+				out, _ = dns.resolve(b.Context(), query, "", out[:0])
+			}
+		})
+	}
+}
@@ -1,64 +1,666 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 )
 
-func loadOrCreateToken(path string) (string, error) {
+const (
+	defaultRotateBefore = 7 * 24 * time.Hour
+	defaultTokenName    = "default"
+	tokenScopeRead      = "read"
+	tokenScopeWrite     = "write"
+	tokenHashPrefix     = "sha256:"
+)
+
+// Token is an API credential. A zero Expires means it never expires. Tokens
+// are known by name; several share one while a successor overlaps the token
+// it replaces. Read-scoped tokens can only make GET and HEAD requests.
+//
+// Only a SHA-256 hash of the token is kept; Value is set just when the token
+// is issued, which is the one time it can be shown.
+type Token struct {
+	Value   string    `json:"token,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Scope   string    `json:"scope,omitempty"`
+	Expires time.Time `json:"expires,omitzero"`
+	hash    [sha256.Size]byte
+}
+
+func (t Token) expired(now time.Time) bool {
+	return !t.Expires.IsZero() && !now.Before(t.Expires)
+}
+
+func hashToken(value string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(value))
+}
+
+// successorValue derives the token that replaces value, keyed with the
+// server's rotation key. Deriving it rather than drawing it at random means
+// it never has to be stored: any holder of the old token gets the same
+// successor, before and after a restart. The key means that an old token,
+// even one long expired, is not enough to work out the tokens after it.
+func successorValue(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// loadRotationKey reads the rotation key kept beside the token file as
+// hex, creating it if there is none yet and create is set.
+func loadRotationKey(path string, create bool) ([]byte, error) {
 	data, err := os.ReadFile(path)
 	if err == nil {
-		token := strings.TrimSpace(string(data))
-		if len(token) > 0 {
-			return token, nil
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) < sha256.Size {
+			return nil, fmt.Errorf("%s: not a hex rotation key", path)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) || !create {
+		return nil, err
+	}
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generating rotation key: %w", err)
+	}
+	if err := writeFileAtomic(path, []byte(hex.EncodeToString(key)+"\n"), false); err != nil {
+		return nil, fmt.Errorf("writing rotation key: %w", err)
+	}
+	return key, nil
+}
+
+// TokenSet holds the tokens accepted by the API. With a TTL configured, a
+// client whose token is within rotateBefore of expiry can fetch its
+// successor from /api/token, and both are honored until the old one runs
+// out, so automation can switch over without downtime.
+//
+// The token file holds one token per line: "sha256:" and the hex hash of the
+// token, then optionally a tab and an RFC 3339 expiry (which may be empty),
+// the name and the scope. A line holding a token in plaintext (the original
+// format) is the default read-write token; such files are rewritten hashed
+// when loaded.
+type TokenSet struct {
+	mu           sync.RWMutex
+	path         string
+	stamp        fileStamp
+	tokens       []Token
+	rotationKey  []byte // keys successorValue; kept in path+".key", read on first use
+	ttl          time.Duration
+	rotateBefore time.Duration
+	now          func() time.Time
+}
+
+// LoadTokenSet reads the token file. A missing file is an empty set.
+func LoadTokenSet(path string, ttl, rotateBefore time.Duration) (*TokenSet, error) {
+	ts := &TokenSet{path: path, ttl: ttl, rotateBefore: rotateBefore, now: time.Now}
+	plaintext, err := ts.load()
+	if err != nil {
+		return nil, err
+	}
+	if ts.applyTTL() || plaintext {
+		if err := ts.save(); err != nil {
+			return nil, err
+		}
+	}
+	return ts, nil
+}
+
+// applyTTL starts the clock on tokens created before a TTL was configured,
+// or created without one by the access-token command. It reports whether
+// any changed.
+func (ts *TokenSet) applyTTL() bool {
+	if ts.ttl <= 0 {
+		return false
+	}
+	dirty := false
+	for i := range ts.tokens {
+		if ts.tokens[i].Expires.IsZero() {
+			ts.tokens[i].Expires = ts.now().Add(ts.ttl)
+			dirty = true
+		}
+	}
+	return dirty
+}
+
+// newStaticTokenSet builds an in-memory set that never rotates.
+func newStaticTokenSet(values ...string) *TokenSet {
+	ts := &TokenSet{now: time.Now}
+	for _, v := range values {
+		ts.tokens = append(ts.tokens, Token{Name: defaultTokenName, Scope: tokenScopeWrite, hash: hashToken(v)})
+	}
+	return ts
+}
+
+// load reads the token file, reporting whether it held any plaintext
+// tokens, which the caller should write back hashed.
+func (ts *TokenSet) load() (plaintext bool, err error) {
+	stamp, _ := statFile(ts.path)
+	data, err := os.ReadFile(ts.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("reading token file: %w", err)
+	}
+	var tokens []Token
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		fields = append(fields, "", "", "")
+		tok := Token{Name: strings.TrimSpace(fields[2]), Scope: strings.TrimSpace(fields[3])}
+		cred := strings.TrimSpace(fields[0])
+		if hexHash, ok := strings.CutPrefix(cred, tokenHashPrefix); ok {
+			h, err := hex.DecodeString(hexHash)
+			if err != nil || len(h) != sha256.Size {
+				return false, fmt.Errorf("token file line %d: invalid hash", i+1)
+			}
+			copy(tok.hash[:], h)
+		} else {
+			// Kept in memory so the access-token command can show it this
+			// one last time
+			tok.Value, tok.hash = cred, hashToken(cred)
+			plaintext = true
+		}
+		if expires := strings.TrimSpace(fields[1]); expires != "" {
+			t, err := time.Parse(time.RFC3339, expires)
+			if err != nil {
+				return false, fmt.Errorf("token file line %d: invalid expiry: %w", i+1, err)
+			}
+			tok.Expires = t
+		}
+		if tok.Name == "" {
+			tok.Name = defaultTokenName
+		}
+		if tok.Scope == "" {
+			tok.Scope = tokenScopeWrite
+		}
+		if tok.Scope != tokenScopeRead && tok.Scope != tokenScopeWrite {
+			return false, fmt.Errorf("token file line %d: unknown scope %q", i+1, tok.Scope)
 		}
+		tokens = append(tokens, tok)
 	}
+	ts.tokens, ts.stamp = tokens, stamp
+	return plaintext, nil
+}
 
+func (ts *TokenSet) save() error {
+	if ts.path == "" {
+		return nil
+	}
+	var buf strings.Builder
+	for _, t := range ts.tokens {
+		buf.WriteString(tokenHashPrefix + hex.EncodeToString(t.hash[:]))
+		named := t.Name != defaultTokenName || t.Scope != tokenScopeWrite
+		if !t.Expires.IsZero() || named {
+			buf.WriteByte('\t')
+		}
+		if !t.Expires.IsZero() {
+			buf.WriteString(t.Expires.UTC().Format(time.RFC3339))
+		}
+		if named {
+			buf.WriteString("\t" + t.Name + "\t" + t.Scope)
+		}
+		buf.WriteByte('\n')
+	}
+	if err := writeFileAtomic(ts.path, []byte(buf.String()), false); err != nil {
+		return fmt.Errorf("writing token file: %w", err)
+	}
+	ts.stamp, _ = statFile(ts.path)
+	return nil
+}
+
+func (ts *TokenSet) generate(name, scope string, ttl time.Duration) (Token, error) {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
-		return "", fmt.Errorf("generating token: %w", err)
+		return Token{}, fmt.Errorf("generating token: %w", err)
+	}
+	value := hex.EncodeToString(b)
+	tok := Token{Value: value, Name: name, Scope: scope, hash: hashToken(value)}
+	if ttl > 0 {
+		tok.Expires = ts.now().Add(ttl)
+	}
+	return tok, nil
+}
+
+// Reload picks up changes the access-token command made to the token file,
+// so created tokens work and revoked ones stop working without a restart.
+// A token file that fails to parse leaves the current tokens in place.
+func (ts *TokenSet) Reload(ctx context.Context) error {
+	stamp, err := statFile(ts.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if stamp == ts.stamp {
+		return nil
+	}
+	prev := ts.tokens
+	plaintext, err := ts.load()
+	if err != nil {
+		ts.tokens = prev
+		ts.stamp = stamp // don't report the same broken file every time
+		return err
+	}
+	if ts.applyTTL() || plaintext {
+		if err := ts.save(); err != nil {
+			return err
+		}
+	}
+	slog.InfoContext(ctx, "token file changed on disk, tokens reloaded", "path", ts.path, "tokens", len(ts.tokens))
+	return nil
+}
+
+// Valid reports whether presented matches any unexpired token. Hashes are
+// compared in constant time, and all of them, so the time taken says
+// nothing about the tokens held.
+func (ts *TokenSet) Valid(presented string) (Token, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.valid(presented)
+}
+
+func (ts *TokenSet) valid(presented string) (Token, bool) {
+	h := hashToken(presented)
+	now := ts.now()
+	var match Token
+	found := false
+	for _, t := range ts.tokens {
+		if subtle.ConstantTimeCompare(t.hash[:], h[:]) == 1 && !t.expired(now) {
+			match, found = t, true
+		}
+	}
+	return match, found
+}
+
+// Current returns the longest-lived unexpired default token, i.e. the
+// successor once one has been issued.
+func (ts *TokenSet) Current() (Token, bool) {
+	return ts.CurrentNamed(defaultTokenName)
+}
+
+// CurrentNamed is Current for the tokens with the given name.
+func (ts *TokenSet) CurrentNamed(name string) (Token, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.newest(name)
+}
+
+func (ts *TokenSet) newest(name string) (Token, bool) {
+	now := ts.now()
+	var best Token
+	found := false
+	for _, t := range ts.tokens {
+		if t.Name != name || t.expired(now) {
+			continue
+		}
+		if !found || t.Expires.IsZero() || (!best.Expires.IsZero() && t.Expires.After(best.Expires)) {
+			best = t
+			found = true
+		}
+	}
+	return best, found
+}
+
+// successorKey returns the rotation key, reading it on first use and
+// creating it once successors can be issued. An in-memory set gets a key
+// of its own. Caller must hold ts.mu.
+func (ts *TokenSet) successorKey() ([]byte, error) {
+	if ts.rotationKey != nil {
+		return ts.rotationKey, nil
+	}
+	if ts.path == "" {
+		ts.rotationKey = make([]byte, sha256.Size)
+		rand.Read(ts.rotationKey)
+		return ts.rotationKey, nil
+	}
+	key, err := loadRotationKey(ts.path+".key", ts.ttl > 0)
+	if err != nil {
+		return nil, err
+	}
+	ts.rotationKey = key
+	return key, nil
+}
+
+// Successor returns the token that replaces presented, issuing it if
+// presented is the newest of its name and within rotateBefore of expiry.
+// It reports false when there is none (yet).
+func (ts *TokenSet) Successor(presented string) (Token, bool, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	cur, ok := ts.valid(presented)
+	if !ok {
+		return Token{}, false, nil
+	}
+	key, err := ts.successorKey()
+	if errors.Is(err, os.ErrNotExist) {
+		return Token{}, false, nil // no successor was ever issued
+	}
+	if err != nil {
+		return Token{}, false, err
+	}
+	value := successorValue(key, presented)
+	h := hashToken(value)
+	if i := slices.IndexFunc(ts.tokens, func(t Token) bool { return t.hash == h }); i >= 0 {
+		next := ts.tokens[i]
+		next.Value = value
+		return next, !next.expired(ts.now()), nil
+	}
+
+	now := ts.now()
+	if newest, _ := ts.newest(cur.Name); newest.hash != cur.hash {
+		return Token{}, false, nil
+	}
+	if ts.ttl <= 0 || cur.Expires.IsZero() || cur.Expires.Sub(now) > ts.rotateBefore {
+		return Token{}, false, nil
+	}
+	next := Token{Value: value, Name: cur.Name, Scope: cur.Scope, Expires: now.Add(ts.ttl), hash: h}
+	ts.tokens = append(ts.tokens, next)
+	if err := ts.save(); err != nil {
+		ts.tokens = ts.tokens[:len(ts.tokens)-1]
+		return Token{}, false, err
+	}
+	slog.Info("api token successor issued", "name", next.Name, "expires", next.Expires)
+	return next, true, nil
+}
+
+// List returns every token without its value, ordered by name.
+func (ts *TokenSet) List() []Token {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	list := make([]Token, len(ts.tokens))
+	for i, t := range ts.tokens {
+		t.Value = ""
+		list[i] = t
+	}
+	slices.SortStableFunc(list, func(a, b Token) int { return strings.Compare(a.Name, b.Name) })
+	return list
+}
+
+// validTokenName checks a name for Create; it returns "" if it is fine.
+func validTokenName(name string) string {
+	if name == "" || len(name) > 64 {
+		return "name must be 1 to 64 characters"
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return "name may only contain letters, digits, '-', '_' and '.'"
+		}
+	}
+	return ""
+}
+
+// errTokenExists is returned by Create for a name that is taken.
+var errTokenExists = errors.New("a token with that name already exists")
+
+// Create issues a new token. A zero ttl falls back to the configured one.
+func (ts *TokenSet) Create(name, scope string, ttl time.Duration) (Token, error) {
+	return ts.issue(name, scope, ttl, false)
+}
+
+// Reset replaces every token with the given name by a new one, for when the
+// token has been lost or leaked; being hashed, it can't be shown again.
+func (ts *TokenSet) Reset(name, scope string, ttl time.Duration) (Token, error) {
+	return ts.issue(name, scope, ttl, true)
+}
+
+func (ts *TokenSet) issue(name, scope string, ttl time.Duration, replace bool) (Token, error) {
+	if msg := validTokenName(name); msg != "" {
+		return Token{}, errors.New(msg)
+	}
+	if scope != tokenScopeRead && scope != tokenScopeWrite {
+		return Token{}, fmt.Errorf("scope must be %q or %q", tokenScopeRead, tokenScopeWrite)
+	}
+	if ttl <= 0 {
+		ttl = ts.ttl
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	named := func(t Token) bool { return t.Name == name }
+	if !replace && slices.ContainsFunc(ts.tokens, named) {
+		return Token{}, errTokenExists
+	}
+	tok, err := ts.generate(name, scope, ttl)
+	if err != nil {
+		return Token{}, err
+	}
+	prev := ts.tokens
+	ts.tokens = append(slices.DeleteFunc(slices.Clone(prev), named), tok)
+	if err := ts.save(); err != nil {
+		ts.tokens = prev
+		return Token{}, err
+	}
+	return tok, nil
+}
+
+// Revoke removes every token with the given name, the successor included.
+func (ts *TokenSet) Revoke(name string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	prev := ts.tokens
+	kept := slices.DeleteFunc(slices.Clone(prev), func(t Token) bool { return t.Name == name })
+	if len(kept) == len(prev) {
+		return fmt.Errorf("token %q: %w", name, os.ErrNotExist)
+	}
+	ts.tokens = kept
+	if err := ts.save(); err != nil {
+		ts.tokens = prev
+		return err
+	}
+	return nil
+}
+
+// Prune drops expired tokens from the file.
+func (ts *TokenSet) Prune() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	now := ts.now()
+	n := len(ts.tokens)
+	ts.tokens = slices.DeleteFunc(ts.tokens, func(t Token) bool { return t.expired(now) })
+	if len(ts.tokens) == n {
+		return nil
+	}
+	if _, ok := ts.newest(defaultTokenName); !ok && n > 0 {
+		slog.Warn("the default api token has expired; issue a new one with regieleki access-token reset")
+	}
+	return ts.save()
+}
+
+// errTokenHashed is returned by loadOrCreateToken once the token can no
+// longer be shown.
+var errTokenHashed = errors.New("the token is stored hashed and can't be shown again; run regieleki access-token reset for a new one")
+
+// loadOrCreateToken returns the default token from path, creating one if
+// there is none. An existing token can only be returned while it is still
+// in the old plaintext format, i.e. once.
+func loadOrCreateToken(path string) (string, error) {
+	ts, err := LoadTokenSet(path, 0, 0)
+	if err != nil {
+		return "", err
+	}
+	tok, ok := ts.Current()
+	if !ok {
+		if tok, err = ts.Create(defaultTokenName, tokenScopeWrite, 0); err != nil {
+			return "", err
+		}
 	}
-	token := hex.EncodeToString(b)
-	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
-		return "", fmt.Errorf("writing token file: %w", err)
+	if tok.Value == "" {
+		return "", errTokenHashed
 	}
-	return token, nil
+	return tok.Value, nil
 }
 
+// handleAccessToken creates and prints the default token if there is none,
+// or with a subcommand lists, creates, resets or revokes tokens. A running
+// server picks up the changes from the token file within seconds.
 func handleAccessToken(args []string) {
-	fs := flag.NewFlagSet("access-token", flag.ExitOnError)
+	cmd := "show"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet("access-token "+cmd, flag.ExitOnError)
 	tokenPath := fs.String("token", "/var/lib/regieleki/token", "Path to API token file")
+	name := fs.String("name", "", "Token name (create, revoke; reset defaults to the default token)")
+	scope := fs.String("scope", tokenScopeWrite, "Token scope for create and reset: read or write")
+	ttl := fs.Duration("ttl", 0, "Token lifetime for create and reset (0 never expires, or -token-ttl of the server)")
 	fs.Parse(args)
 
-	token, err := loadOrCreateToken(*tokenPath)
-	if err != nil {
+	fail := func(err error) {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Println(token)
+	if cmd == "show" {
+		token, err := loadOrCreateToken(*tokenPath)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(token)
+		return
+	}
+	ts, err := LoadTokenSet(*tokenPath, 0, 0)
+	if err != nil {
+		fail(err)
+	}
+	switch cmd {
+	case "list":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSCOPE\tEXPIRES")
+		for _, t := range ts.List() {
+			expires := "never"
+			if !t.Expires.IsZero() {
+				expires = t.Expires.Local().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", t.Name, t.Scope, expires)
+		}
+		w.Flush()
+	case "create":
+		tok, err := ts.Create(*name, *scope, *ttl)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(tok.Value)
+	case "reset":
+		if *name == "" {
+			*name = defaultTokenName
+		}
+		tok, err := ts.Reset(*name, *scope, *ttl)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(tok.Value)
+	case "revoke":
+		if err := ts.Revoke(*name); err != nil {
+			fail(err)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown access-token command %q (want list, create, reset or revoke)\n", cmd)
+		os.Exit(2)
+	}
+}
+
+// publicPaths are API endpoints readable without a token: UI branding, the
+// kiosk summary, which is only routed when kiosk mode is on, and the API
+// description.
+var publicPaths = map[string]bool{
+	"/api/ui":           true,
+	"/api/kiosk":        true,
+	"/api/openapi.json": true,
+}
+
+// needsToken reports whether path is guarded by the API token: the API
+// apart from publicPaths, the metrics and the profiler.
+func needsToken(path string) bool {
+	if publicPaths[path] {
+		return false
+	}
+	return strings.HasPrefix(path, "/api/") || path == "/metrics" || strings.HasPrefix(path, "/debug/")
+}
+
+// An authenticator checks a bearer credential and returns who presented it,
+// for the access log, and the scope it grants; "" means it is genuine but
+// grants nothing.
+type authenticator interface {
+	Authenticate(bearer string) (who, scope string, ok bool)
+}
+
+// authenticators accepts what any of its members accepts.
+type authenticators []authenticator
+
+func (as authenticators) Authenticate(bearer string) (string, string, bool) {
+	for _, a := range as {
+		if who, scope, ok := a.Authenticate(bearer); ok {
+			return who, scope, true
+		}
+	}
+	return "", "", false
+}
+
+// Authenticate makes the token set an authenticator. Tokens are known by
+// their names.
+func (ts *TokenSet) Authenticate(bearer string) (string, string, bool) {
+	tok, ok := ts.Valid(bearer)
+	return tok.Name, tok.Scope, ok
 }
 
-func requireAuth(token string, next http.Handler) http.Handler {
+func requireAuth(auth authenticator, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !strings.HasPrefix(r.URL.Path, "/api/") {
+		if !needsToken(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if fromUnixSocket(r.Context()) {
+			setAccessUser(r.Context(), "unix")
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		auth := r.Header.Get("Authorization")
-		if !strings.HasPrefix(auth, "Bearer ") || strings.TrimPrefix(auth, "Bearer ") != token {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found {
+			unauthorized(w)
+			return
+		}
+		who, scope, ok := auth.Authenticate(bearer)
+		if ok {
+			setAccessUser(r.Context(), who)
+		}
+		switch {
+		case !ok:
+			unauthorized(w)
+			return
+		case scope == "":
+			jsonProblem(w, http.StatusForbidden, &problem{"no_access", "no access granted"})
+			return
+		case scope == tokenScopeRead && r.Method != "GET" && r.Method != "HEAD":
+			jsonProblem(w, http.StatusForbidden, &problem{"read_only_token", "token is read-only"})
 			return
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
+
+func unauthorized(w http.ResponseWriter) {
+	jsonError(w, "unauthorized", http.StatusUnauthorized)
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoadOrCreateToken(t *testing.T) {
@@ -24,13 +29,17 @@ func TestLoadOrCreateToken(t *testing.T) {
 		t.Errorf("token is not valid hex: %v", err)
 	}
 
-	// Second call returns the same token
-	token2, err := loadOrCreateToken(path)
-	if err != nil {
-		t.Fatal(err)
+	// Only its hash is stored, so it can't be shown again
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), token1) || !strings.HasPrefix(string(data), tokenHashPrefix) {
+		t.Errorf("token file: %q", data)
 	}
-	if token2 != token1 {
-		t.Errorf("token changed: %q != %q", token2, token1)
+	if _, err := loadOrCreateToken(path); !errors.Is(err, errTokenHashed) {
+		t.Errorf("second call: %v, want errTokenHashed", err)
+	}
+	ts, _ := LoadTokenSet(path, 0, 0)
+	if _, ok := ts.Valid(token1); !ok {
+		t.Error("created token not accepted")
 	}
 
 	// File permissions should be 0600
@@ -47,7 +56,7 @@ func TestRequireAuth_ValidToken(t *testing.T) {
 	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
-	handler := requireAuth("test-token", inner)
+	handler := requireAuth(newStaticTokenSet("test-token"), inner)
 
 	req := httptest.NewRequest("GET", "/api/records", nil)
 	req.Header.Set("Authorization", "Bearer test-token")
@@ -63,7 +72,7 @@ func TestRequireAuth_MissingToken(t *testing.T) {
 	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
-	handler := requireAuth("test-token", inner)
+	handler := requireAuth(newStaticTokenSet("test-token"), inner)
 
 	req := httptest.NewRequest("GET", "/api/records", nil)
 	w := httptest.NewRecorder()
@@ -78,7 +87,7 @@ func TestRequireAuth_WrongToken(t *testing.T) {
 	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
-	handler := requireAuth("test-token", inner)
+	handler := requireAuth(newStaticTokenSet("test-token"), inner)
 
 	req := httptest.NewRequest("GET", "/api/records", nil)
 	req.Header.Set("Authorization", "Bearer wrong-token")
@@ -94,7 +103,7 @@ func TestRequireAuth_StaticNoAuth(t *testing.T) {
 	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
-	handler := requireAuth("test-token", inner)
+	handler := requireAuth(newStaticTokenSet("test-token"), inner)
 
 	// Static files should not require auth
 	req := httptest.NewRequest("GET", "/", nil)
@@ -105,3 +114,266 @@ func TestRequireAuth_StaticNoAuth(t *testing.T) {
 		t.Errorf("status = %d, want 200", w.Code)
 	}
 }
+
+func TestLoadOrCreateToken_LegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(path, []byte("legacy-token\n"), 0600)
+
+	// A plaintext token is shown one last time and rewritten hashed
+	token, err := loadOrCreateToken(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "legacy-token" {
+		t.Errorf("token = %q, want legacy-token", token)
+	}
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), "legacy-token") {
+		t.Errorf("plaintext token left in file: %q", data)
+	}
+	ts, _ := LoadTokenSet(path, 0, 0)
+	if _, ok := ts.Valid("legacy-token"); !ok {
+		t.Error("migrated token not accepted")
+	}
+	if _, err := loadOrCreateToken(path); !errors.Is(err, errTokenHashed) {
+		t.Errorf("second call: %v, want errTokenHashed", err)
+	}
+}
+
+func TestTokenSetExpiryAndRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	ts, err := LoadTokenSet(path, 30*24*time.Hour, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.now = func() time.Time { return now }
+	first, err := ts.Create(defaultTokenName, tokenScopeWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Far from expiry: no successor
+	if _, ok, err := ts.Successor(first.Value); err != nil || ok {
+		t.Fatalf("Successor = %v, %v; want none", ok, err)
+	}
+
+	// Inside the rotation window a successor appears and both are valid
+	now = first.Expires.Add(-24 * time.Hour)
+	second, ok, err := ts.Successor(first.Value)
+	if err != nil || !ok {
+		t.Fatalf("Successor = %v, %v; want one", ok, err)
+	}
+	if second.Value == first.Value {
+		t.Fatal("expected a new token")
+	}
+	if cur, _ := ts.Current(); cur.Expires != second.Expires {
+		t.Error("successor is not the current token")
+	}
+	if _, ok := ts.Valid(first.Value); !ok {
+		t.Error("old token should be valid during overlap")
+	}
+	if _, ok := ts.Valid(second.Value); !ok {
+		t.Error("successor should be valid immediately")
+	}
+	// The successor is not a successor of its own
+	if _, ok, _ := ts.Successor(second.Value); ok {
+		t.Error("successor got a successor")
+	}
+
+	// Successor is persisted alongside the old token, and asking again
+	// after a restart hands out the same one
+	reloaded, err := LoadTokenSet(path, 30*24*time.Hour, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded.now = ts.now
+	if _, ok := reloaded.Valid(second.Value); !ok {
+		t.Error("successor not persisted")
+	}
+	if again, ok, _ := reloaded.Successor(first.Value); !ok || again.Value != second.Value {
+		t.Errorf("successor after restart = %q, want %q", again.Value, second.Value)
+	}
+	if n := len(reloaded.List()); n != 2 {
+		t.Errorf("%d tokens after asking twice, want 2", n)
+	}
+	// The successor is keyed with a secret kept beside the token file, so
+	// the old token alone does not give it away
+	key, err := loadRotationKey(path+".key", false)
+	if err != nil {
+		t.Fatalf("rotation key: %v", err)
+	}
+	if fi, _ := os.Stat(path + ".key"); fi.Mode().Perm() != 0o600 {
+		t.Errorf("rotation key mode %v", fi.Mode().Perm())
+	}
+	if successorValue(key, first.Value) != second.Value || successorValue(make([]byte, len(key)), first.Value) == second.Value {
+		t.Error("successor not keyed with the rotation key")
+	}
+
+	// After expiry the old token is rejected and pruned
+	now = first.Expires.Add(time.Second)
+	if _, ok := ts.Valid(first.Value); ok {
+		t.Error("expired token still valid")
+	}
+	ts.Prune()
+	if len(ts.tokens) != 1 {
+		t.Errorf("expected expired token pruned, have %d tokens", len(ts.tokens))
+	}
+}
+
+func TestWebTokenSuccessor(t *testing.T) {
+	ws, _ := testWebServer(t)
+	ws.tokens = &TokenSet{now: time.Now, ttl: 48 * time.Hour, rotateBefore: 24 * time.Hour}
+	old, _ := ws.tokens.Create(defaultTokenName, tokenScopeWrite, time.Hour)
+
+	get := func(token string) *Token {
+		req := httptest.NewRequest("GET", "/api/token", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", w.Code)
+		}
+		var resp struct {
+			Successor *Token `json:"successor"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Successor
+	}
+	succ := get(old.Value)
+	if succ == nil || succ.Value == "" || succ.Value == old.Value {
+		t.Fatalf("successor = %+v", succ)
+	}
+	if again := get(old.Value); again == nil || again.Value != succ.Value {
+		t.Errorf("second request got %+v, want the same successor", again)
+	}
+	if next := get(succ.Value); next != nil {
+		t.Errorf("successor has a successor: %+v", next)
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	ts, err := LoadTokenSet(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := ts.Create(defaultTokenName, tokenScopeWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro, err := ts.Create("dashboard", tokenScopeRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Create("dashboard", tokenScopeWrite, 0); !errors.Is(err, errTokenExists) {
+		t.Errorf("duplicate name: %v", err)
+	}
+	if _, err := ts.Create("a b", tokenScopeRead, 0); err == nil {
+		t.Error("created a token with a space in its name")
+	}
+
+	handler := requireAuth(ts, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(method, token string) int {
+		req := httptest.NewRequest(method, "/api/records", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := do("GET", ro.Value); code != 200 {
+		t.Errorf("read token GET: %d", code)
+	}
+	if code := do("POST", ro.Value); code != 403 {
+		t.Errorf("read token POST: %d, want 403", code)
+	}
+	if code := do("POST", def.Value); code != 200 {
+		t.Errorf("default token POST: %d", code)
+	}
+
+	data, _ := os.ReadFile(path)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 || !strings.HasSuffix(lines[1], "\t\tdashboard\tread") {
+		t.Errorf("token file:\n%s", data)
+	}
+
+	// Revoking through another TokenSet, as the access-token command does,
+	// reaches the running one on its next reload
+	other, _ := LoadTokenSet(path, 0, 0)
+	if err := other.Revoke("dashboard"); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Revoke("dashboard"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("revoking twice: %v", err)
+	}
+	ts.stamp = fileStamp{} // the rewrite may land within the mtime granularity
+	if err := ts.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if code := do("GET", ro.Value); code != 401 {
+		t.Errorf("revoked token GET: %d, want 401", code)
+	}
+
+	// A lost token is replaced with reset
+	fresh, err := ts.Reset(defaultTokenName, tokenScopeWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := do("GET", def.Value); code != 401 {
+		t.Errorf("reset token GET: %d, want 401", code)
+	}
+	if code := do("GET", fresh.Value); code != 200 {
+		t.Errorf("new token GET: %d", code)
+	}
+}
+
+func TestTokenRotationByName(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	ts := &TokenSet{ttl: 30 * 24 * time.Hour, rotateBefore: 7 * 24 * time.Hour, now: func() time.Time { return now }}
+	def, _ := ts.Create(defaultTokenName, tokenScopeWrite, 20*24*time.Hour)
+	ci, _ := ts.Create("ci", tokenScopeRead, 24*time.Hour)
+
+	if _, ok, _ := ts.Successor(def.Value); ok {
+		t.Error("default token rotated early")
+	}
+	succ, ok, err := ts.Successor(ci.Value)
+	if err != nil || !ok || succ.Name != "ci" || succ.Scope != tokenScopeRead {
+		t.Errorf("ci successor = %+v, %v, %v", succ, ok, err)
+	}
+}
+
+func TestWebTokens(t *testing.T) {
+	ws, _ := testWebServer(t)
+	ws.tokens = newStaticTokenSet("admin")
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/api/tokens", `{"name":"ci","scope":"read","ttl":"24h"}`)
+	var created Token
+	json.NewDecoder(w.Body).Decode(&created)
+	if w.Code != 201 || created.Value == "" || created.Scope != "read" || created.Expires.IsZero() {
+		t.Fatalf("create: %d %+v", w.Code, created)
+	}
+	if w := do("POST", "/api/tokens", `{"name":"ci"}`); w.Code != 409 {
+		t.Errorf("duplicate: %d", w.Code)
+	}
+	if w := do("POST", "/api/tokens", `{"name":"x","scope":"admin"}`); w.Code != 400 {
+		t.Errorf("bad scope: %d", w.Code)
+	}
+
+	w = do("GET", "/api/tokens", "")
+	if w.Code != 200 || strings.Contains(w.Body.String(), created.Value) || !strings.Contains(w.Body.String(), `"name":"ci"`) {
+		t.Errorf("list: %d %s", w.Code, w.Body)
+	}
+
+	if w := do("DELETE", "/api/tokens/ci", ""); w.Code != 204 {
+		t.Errorf("revoke: %d", w.Code)
+	}
+	if w := do("DELETE", "/api/tokens/ci", ""); w.Code != 404 {
+		t.Errorf("revoke again: %d", w.Code)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SOA timers offered to secondaries. NOTIFY usually triggers transfers long
+// before refresh is due.
+const (
+	soaRefresh = 3600
+	soaRetry   = 600
+	soaExpire  = 14 * 24 * 3600
+	soaMinimum = 60 // negative caching, same as the TTL of every answer
+	soaTTL     = 60
+)
+
+// axfrMessageSize is where a transfer starts a new message, well under the
+// 64KB TCP limit.
+const axfrMessageSize = 16 << 10
+
+// Transfers serves outbound zone transfers (AXFR, RFC 5936) of the configured
+// zones so standard secondaries can mirror our records, and answers the SOA
+// and NS queries they make before transferring. The SOA serial is the Store's.
+// Clients must be in an allowed network or sign with a known TSIG key.
+type Transfers struct {
+	store *Store
+	zones Zones
+	allow []netip.Prefix
+	keys  *TSIGKeyring
+	mname string // primary nameserver named in the SOA and the apex NS
+	now   func() time.Time
+}
+
+// NewTransfers names mname as the primary nameserver, or the host name if
+// it is empty.
+func NewTransfers(store *Store, zones Zones, allow []netip.Prefix, keys *TSIGKeyring, mname string) *Transfers {
+	if mname == "" {
+		mname, _ = os.Hostname()
+	}
+	return &Transfers{store: store, zones: zones, allow: allow, keys: keys, mname: mname, now: time.Now}
+}
+
+func (t *Transfers) soa(zone string, serial uint32) []byte {
+	rdata := encodeDNSName(t.mname)
+	rdata = append(rdata, encodeDNSName("hostmaster."+zone)...)
+	for _, v := range []uint32{serial, soaRefresh, soaRetry, soaExpire, soaMinimum} {
+		rdata = binary.BigEndian.AppendUint32(rdata, v)
+	}
+	return appendRR(nil, zone, 6, soaTTL, rdata)
+}
+
+func (t *Transfers) ns(zone string) []byte {
+	return appendRR(nil, zone, 2, soaTTL, encodeDNSName(t.mname))
+}
+
+// Apex answers SOA and NS queries for the apex of a configured zone.
+func (t *Transfers) Apex(query []byte, questionEnd int, qname string, qtype uint16) ([]byte, bool) {
+	zone := strings.ToLower(strings.TrimSuffix(qname, "."))
+	if qtype != 6 && qtype != 2 || !slices.Contains(t.zones, zone) {
+		return nil, false
+	}
+	rr := t.ns(zone)
+	if qtype == 6 {
+		rr = t.soa(zone, t.store.Serial())
+	}
+	resp := make([]byte, 0, questionEnd+len(rr))
+	resp = append(resp, query[0], query[1])
+	resp = append(resp, 0x84|(query[2]&0x01), 0x80) // QR=1 AA=1 RD=copy RA=1
+	resp = append(resp, 0, 1, 0, 1, 0, 0, 0, 0)     // QDCOUNT=1 ANCOUNT=1
+	resp = append(resp, query[12:questionEnd]...)
+	resp = append(resp, rr...)
+	echoQName(resp, query, questionEnd)
+	return resp, true
+}
+
+// Serve answers an AXFR query on a TCP connection, writing the whole zone
+// framed as one or more messages.
+func (t *Transfers) Serve(w io.Writer, query []byte, client netip.Addr) error {
+	qname, off := parseDNSName(query, 12)
+	questionEnd := off + 4
+	zone := strings.ToLower(strings.TrimSuffix(qname, "."))
+
+	unsigned, sig, err := splitTSIG(query)
+	if err != nil {
+		return writeTCPMessage(w, xfrError(query, questionEnd, rcodeFormErr))
+	}
+	now := t.now()
+	var secret []byte
+	if sig != nil {
+		keys := t.keys.Keys()
+		secret = keys[tsigKeyName(sig.key)]
+		if code := keys.verify(unsigned, sig, now); code != 0 {
+			slog.Warn("zone transfer rejected", "zone", zone, "client", client, "key", sig.key, "tsig_error", code)
+			return writeTCPMessage(w, signResponse(xfrError(query, questionEnd, rcodeNotAuth), sig, secret, code, now))
+		}
+	}
+	refuse := func(rcode int) error {
+		resp := xfrError(query, questionEnd, rcode)
+		if sig != nil {
+			resp = signResponse(resp, sig, secret, 0, now)
+		}
+		return writeTCPMessage(w, resp)
+	}
+	if !slices.Contains(t.zones, zone) {
+		return refuse(rcodeNotAuth)
+	}
+	if sig == nil && !slices.ContainsFunc(t.allow, func(p netip.Prefix) bool { return p.Contains(client.Unmap()) }) {
+		slog.Warn("zone transfer refused", "zone", zone, "client", client)
+		return refuse(rcodeRefused)
+	}
+
+	// Reading the serial first means the records are never older than it
+	serial := t.store.Serial()
+	var records []Record
+	for _, r := range t.store.List() {
+		if r.View == "" && !r.Disabled && !r.expired(now) && t.zones.ZoneOf(r.Domain) == zone {
+			records = append(records, r)
+		}
+	}
+	slices.SortFunc(records, func(a, b Record) int {
+		return cmp.Or(strings.Compare(a.Domain, b.Domain), strings.Compare(a.Type, b.Type), strings.Compare(a.Value, b.Value))
+	})
+	soa := t.soa(zone, serial)
+	rrs := [][]byte{soa, t.ns(zone)}
+	for _, r := range records {
+		if rtype, rdata, ok := recordRData(r); ok {
+			rrs = append(rrs, appendRR(nil, r.Domain, rtype, 60, rdata))
+		}
+	}
+	rrs = append(rrs, soa)
+
+	// Every message is signed; later ones chain the previous MAC
+	var prevMAC []byte
+	first := true
+	send := func(msg []byte) error {
+		if sig != nil {
+			ts := &tsig{key: sig.key, algorithm: sig.algorithm, signed: uint64(now.Unix()), fudge: tsigFudge, origID: binary.BigEndian.Uint16(query[0:2])}
+			if first {
+				ts.mac = ts.sign(secret, sig.mac, msg)
+			} else {
+				ts.mac = ts.signNext(secret, prevMAC, msg)
+			}
+			prevMAC = ts.mac
+			msg = ts.appendTo(msg)
+		}
+		first = false
+		return writeTCPMessage(w, msg)
+	}
+	msg := xfrHeader(query, questionEnd, true)
+	count := 0
+	for _, rr := range rrs {
+		if count > 0 && len(msg)+len(rr) > axfrMessageSize {
+			binary.BigEndian.PutUint16(msg[6:8], uint16(count))
+			if err := send(msg); err != nil {
+				return err
+			}
+			msg, count = xfrHeader(query, questionEnd, false), 0
+		}
+		msg = append(msg, rr...)
+		count++
+	}
+	binary.BigEndian.PutUint16(msg[6:8], uint16(count))
+	if err := send(msg); err != nil {
+		return err
+	}
+	slog.Info("zone transferred", "zone", zone, "client", client, "serial", serial, "records", len(rrs)-2)
+	return nil
+}
+
+// xfrHeader starts a transfer message; only the first repeats the question.
+func xfrHeader(query []byte, questionEnd int, question bool) []byte {
+	msg := []byte{query[0], query[1], 0x84, 0, 0, 0, 0, 0, 0, 0, 0, 0} // QR=1 AA=1
+	if question {
+		msg[5] = 1
+		msg = append(msg, query[12:questionEnd]...)
+	}
+	return msg
+}
+
+func xfrError(query []byte, questionEnd, rcode int) []byte {
+	msg := xfrHeader(query, questionEnd, questionEnd > 12)
+	msg[2] = 0x80 // QR=1
+	msg[3] = byte(rcode)
+	return msg
+}
+
+// isAXFR reports whether query asks for a zone transfer.
+func isAXFR(query []byte) bool {
+	if len(query) < 12 || query[2]&0x80 != 0 || query[2]>>3&0x0F != 0 || binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return false
+	}
+	_, off := parseDNSName(query, 12)
+	return off >= 0 && off+4 <= len(query) && binary.BigEndian.Uint16(query[off:]) == 252
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTransfers(t *testing.T) (*Transfers, *Store) {
+	t.Helper()
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []Record{
+		{Domain: "app.my.lan", Type: "A", Value: "10.0.0.2"},
+		{Domain: "www.my.lan", Type: "CNAME", Value: "app.my.lan"},
+		{Domain: "app.my.lan", Type: "A", Value: "192.168.1.2", View: "lan"},
+		{Domain: "app.other.lan", Type: "A", Value: "10.0.0.3"},
+	} {
+		if _, err := store.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	allow := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	keys := newStaticTSIGKeyring(TSIGKeys{"xfr": []byte("0123456789abcdef0123456789abcdef")})
+	return NewTransfers(store, NewZones([]string{"my.lan"}), allow, keys, "ns1.my.lan"), store
+}
+
+// readTransfer reads framed messages until the closing SOA.
+func readTransfer(t *testing.T, r *bytes.Reader) [][]byte {
+	t.Helper()
+	var msgs [][]byte
+	soas := 0
+	for soas < 2 {
+		msg, err := readTCPMessage(r)
+		if err != nil {
+			t.Fatalf("after %d messages: %v", len(msgs), err)
+		}
+		msgs = append(msgs, msg)
+		m, err := parseMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.RCode != 0 {
+			t.Fatalf("rcode %s", rcodeString(m.RCode))
+		}
+		for _, rr := range m.Answers {
+			if rr.Type == 6 {
+				soas++
+			}
+		}
+	}
+	return msgs
+}
+
+func TestTransfer(t *testing.T) {
+	x, store := newTestTransfers(t)
+	var buf bytes.Buffer
+	if err := x.Serve(&buf, buildTestQuery("my.lan", 252, 1), netip.MustParseAddr("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	msgs := readTransfer(t, bytes.NewReader(buf.Bytes()))
+	m, _ := parseMessage(msgs[0])
+	var got []string
+	for _, rr := range m.Answers {
+		got = append(got, typeString(rr.Type)+" "+rr.Name+" "+rr.Data)
+	}
+	serial := store.Serial()
+	soa := "SOA my.lan ns1.my.lan. hostmaster.my.lan. " + strconv.FormatUint(uint64(serial), 10) + " 3600 600 1209600 60"
+	want := []string{soa, "NS my.lan ns1.my.lan.", "A app.my.lan 10.0.0.2", "CNAME www.my.lan app.my.lan.", soa}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("transfer:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	tests := []struct {
+		name   string
+		zone   string
+		client string
+		want   int
+	}{
+		{"client not allowed", "my.lan", "192.0.2.1", rcodeRefused},
+		{"zone not ours", "other.lan", "127.0.0.1", rcodeNotAuth},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		x.Serve(&buf, buildTestQuery(tt.zone, 252, 1), netip.MustParseAddr(tt.client))
+		resp, err := readTCPMessage(&buf)
+		if err != nil || int(resp[3]&0x0F) != tt.want {
+			t.Errorf("%s: response % x, want rcode %s", tt.name, resp, rcodeString(tt.want))
+		}
+	}
+}
+
+func TestTransferTSIG(t *testing.T) {
+	x, store := newTestTransfers(t)
+	now := time.Unix(1_700_000_000, 0)
+	x.now = func() time.Time { return now }
+	secret := x.keys.Keys()["xfr"]
+	// Big enough records to need several messages
+	for i := range 10 {
+		store.Add(Record{Domain: "txt" + string(rune('a'+i)) + ".my.lan", Type: "TXT", Value: strings.Repeat("x", 3000)})
+	}
+
+	req := signTSIG(buildTestQuery("my.lan", 252, 1), "xfr", secret, now)
+	var buf bytes.Buffer
+	if err := x.Serve(&buf, req, netip.MustParseAddr("192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+	msgs := readTransfer(t, bytes.NewReader(buf.Bytes()))
+	if len(msgs) < 2 {
+		t.Fatalf("got %d messages, want several", len(msgs))
+	}
+	_, reqSig, _ := splitTSIG(req)
+	prev := reqSig.mac
+	for i, msg := range msgs {
+		unsigned, sig, err := splitTSIG(msg)
+		if err != nil || sig == nil {
+			t.Fatalf("message %d not signed: %v", i, err)
+		}
+		want := sig.signNext(secret, prev, unsigned)
+		if i == 0 {
+			want = sig.sign(secret, prev, unsigned)
+		}
+		if !bytes.Equal(sig.mac, want) {
+			t.Errorf("message %d: MAC does not verify", i)
+		}
+		prev = sig.mac
+	}
+}
+
+func TestDNSTransferAndSOA(t *testing.T) {
+	x, store := newTestTransfers(t)
+	dns := NewDNSServer(store, nil)
+	dns.transfers = x
+	addr := startDNSServer(t, dns)
+
+	m, err := parseMessage(exchange(t, addr, buildTestQuery("My.LAN", 6, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answers) != 1 || !m.AA || m.Answers[0].Name != "My.LAN" || !strings.Contains(m.Answers[0].Data, " "+strconv.FormatUint(uint64(store.Serial()), 10)+" ") {
+		t.Errorf("SOA answer = %+v", m)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if err := writeTCPMessage(conn, buildTestQuery("my.lan", 252, 1)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := readTCPMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := parseMessage(resp); len(m.Answers) != 5 {
+		t.Errorf("AXFR over TCP returned %d records, want 5", len(m.Answers))
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBackupSchedule = "@hourly"
+	defaultBackupKeep     = 48
+	backupPrefix          = "records-"
+	backupTimeFormat      = "20060102-150405.000"
+)
+
+// Backups keeps timestamped copies of the record set in a directory, so a
+// bad edit or bulk delete can be rolled back. A copy is only taken when the
+// records changed since the last one, and the oldest are removed beyond the
+// retention count.
+type Backups struct {
+	dir   string
+	keep  int
+	store *Store
+
+	mu         sync.Mutex
+	lastSerial uint32
+}
+
+// BackupInfo describes one backup file.
+type BackupInfo struct {
+	Name    string    `json:"name"`
+	Time    time.Time `json:"time"`
+	Size    int64     `json:"size"`
+	Records int       `json:"records"`
+}
+
+func NewBackups(dir string, keep int, store *Store) *Backups {
+	return &Backups{dir: dir, keep: max(keep, 1), store: store}
+}
+
+// Run is the scheduled job: it takes a backup if anything changed.
+func (b *Backups) Run(ctx context.Context) error {
+	info, err := b.Take(false)
+	if err == nil && info != nil {
+		slog.InfoContext(ctx, "records backed up", "backup", info.Name, "records", info.Records)
+	}
+	return err
+}
+
+// Take writes a backup of the current records and prunes old ones. Unless
+// force is set, nothing is written when the records are unchanged since the
+// last backup, and the returned info is nil.
+func (b *Backups) Take(force bool) (*BackupInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	serial, records := b.store.Snapshot()
+	if !force && serial == b.lastSerial {
+		return nil, nil
+	}
+	if err := os.MkdirAll(b.dir, 0o700); err != nil {
+		return nil, err
+	}
+	// Names must stay unique and in order, or a quick second backup would
+	// replace the first, or sort before it and be the one pruned
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if backups, err := b.list(); err == nil && len(backups) > 0 && !now.After(backups[0].Time) {
+		now = backups[0].Time.Add(time.Millisecond)
+	}
+	name := backupPrefix + now.Format(backupTimeFormat) + ".tsv"
+	data := formatRecords(records)
+	if err := writeFileAtomic(filepath.Join(b.dir, name), data, false); err != nil {
+		return nil, err
+	}
+	b.lastSerial = serial
+	if err := b.prune(); err != nil {
+		slog.Warn("failed to prune backups", "dir", b.dir, "error", err)
+	}
+	return &BackupInfo{Name: name, Time: now, Size: int64(len(data)), Records: len(records)}, nil
+}
+
+// prune removes the oldest backups beyond the retention count. Caller must
+// hold b.mu.
+func (b *Backups) prune() error {
+	backups, err := b.list()
+	if err != nil || len(backups) <= b.keep {
+		return err
+	}
+	var errs []error
+	for _, old := range backups[b.keep:] {
+		errs = append(errs, os.Remove(filepath.Join(b.dir, old.Name)))
+	}
+	return errors.Join(errs...)
+}
+
+// List returns the backups, newest first.
+func (b *Backups) List() ([]BackupInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.list()
+}
+
+func (b *Backups) list() ([]BackupInfo, error) {
+	entries, err := os.ReadDir(b.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []BackupInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	backups := []BackupInfo{}
+	for _, e := range entries {
+		stamp, ok := strings.CutPrefix(e.Name(), backupPrefix)
+		stamp, ok2 := strings.CutSuffix(stamp, ".tsv")
+		t, err := time.Parse(backupTimeFormat, stamp)
+		if !ok || !ok2 || err != nil || !e.Type().IsRegular() {
+			continue
+		}
+		info := BackupInfo{Name: e.Name(), Time: t}
+		if fi, err := e.Info(); err == nil {
+			info.Size = fi.Size()
+		}
+		if data, err := os.ReadFile(filepath.Join(b.dir, e.Name())); err == nil {
+			records, _ := parseRecords(data, e.Name())
+			info.Records = len(records)
+		}
+		backups = append(backups, info)
+	}
+	slices.SortFunc(backups, func(a, b BackupInfo) int { return b.Time.Compare(a.Time) })
+	return backups, nil
+}
+
+// ErrShared is returned by Restore when the records live in shared storage,
+// which a local restore would only diverge from.
+var ErrShared = errors.New("records are shared; restore them at the shared storage")
+
+// Restore replaces the records with those in the named backup, after taking
+// a backup of the current ones so the restore itself can be undone. It
+// returns that backup.
+func (b *Backups) Restore(name string) (*BackupInfo, error) {
+	if b.store.Shared() {
+		return nil, ErrShared
+	}
+	backups, err := b.List()
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(backups, func(i BackupInfo) bool { return i.Name == name }) {
+		return nil, fmt.Errorf("backup %q: %w", name, os.ErrNotExist)
+	}
+	data, err := os.ReadFile(filepath.Join(b.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	records, _ := parseRecords(data, name)
+
+	undo, err := b.Take(true)
+	if err != nil {
+		return nil, fmt.Errorf("backing up current records: %w", err)
+	}
+	if err := b.store.Replace(records); err != nil {
+		return nil, err
+	}
+	return undo, nil
+}
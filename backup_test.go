@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackups(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStore(filepath.Join(dir, "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBackups(filepath.Join(dir, "backups"), 2, s)
+	ctx := context.Background()
+
+	s.Add(Record{Domain: "app.local", Type: "A", Value: "10.0.0.1"})
+	if err := b.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Unchanged records aren't backed up again
+	if err := b.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := b.List(); len(list) != 1 || list[0].Records != 1 {
+		t.Fatalf("backups after two runs: %+v", list)
+	}
+	first, _ := b.List()
+
+	s.Add(Record{Domain: "db.local", Type: "A", Value: "10.0.0.2"})
+	b.Run(ctx)
+	s.Add(Record{Domain: "web.local", Type: "A", Value: "10.0.0.3"})
+	b.Run(ctx)
+	list, _ := b.List()
+	if len(list) != 2 || list[0].Records != 3 || list[1].Records != 2 {
+		t.Fatalf("backups after pruning to 2: %+v", list)
+	}
+
+	if _, err := b.Restore(first[0].Name); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("restoring a pruned backup: %v", err)
+	}
+	if _, err := b.Restore("../records.tsv"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("restoring a path outside the backups: %v", err)
+	}
+
+	undo, err := b.Restore(list[1].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Resolve("web.local", 1); ok || len(s.List()) != 2 {
+		t.Errorf("records after restore: %+v", s.List())
+	}
+	if _, err := b.Restore(undo.Name); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Resolve("web.local", 1); !ok {
+		t.Error("undoing the restore lost web.local")
+	}
+	if r, _ := s.Add(Record{Domain: "next.local", Type: "A", Value: "10.0.0.4"}); r.ID != 4 {
+		t.Errorf("next ID = %d, want 4", r.ID)
+	}
+}
+
+func TestWebRestore(t *testing.T) {
+	ws, store := testWebServer(t)
+	post := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return w
+	}
+	if w := post("/api/backups", ""); w.Code != 503 {
+		t.Errorf("backup without a backup dir: status %d", w.Code)
+	}
+	ws.backups = NewBackups(t.TempDir(), 10, store)
+
+	store.Add(Record{Domain: "app.local", Type: "A", Value: "10.0.0.1"})
+	w := post("/api/backups", "")
+	var info BackupInfo
+	json.NewDecoder(w.Body).Decode(&info)
+	if w.Code != 201 || info.Records != 1 {
+		t.Fatalf("backup: %d %+v", w.Code, info)
+	}
+	store.Delete(1)
+
+	if w := post("/api/restore", `{"backup":"records-nope.tsv"}`); w.Code != 404 {
+		t.Errorf("unknown backup: status %d", w.Code)
+	}
+	w = post("/api/restore", `{"backup":"`+info.Name+`"}`)
+	var result RestoreResult
+	json.NewDecoder(w.Body).Decode(&result)
+	if w.Code != 200 || result.Records != 1 || result.Undo == "" {
+		t.Fatalf("restore: %d %s", w.Code, w.Body.String())
+	}
+	if _, ok := store.Resolve("app.local", 1); !ok {
+		t.Error("app.local not restored")
+	}
+
+	store.SetRemote(func([]Change) error { return nil })
+	if w := post("/api/restore", `{"backup":"`+info.Name+`"}`); w.Code != 409 {
+		t.Errorf("restore of shared records: status %d", w.Code)
+	}
+}
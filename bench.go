@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// BenchConfig describes a load test: Questions are sent round-robin to
+// Server at QPS for Duration, by Concurrency workers that each wait up to
+// Timeout for their answer.
+type BenchConfig struct {
+	Server      string
+	QPS         int
+	Duration    time.Duration
+	Timeout     time.Duration
+	Concurrency int
+	TCP         bool
+	Questions   []BenchQuestion
+}
+
+// BenchQuestion is one name and type to ask.
+type BenchQuestion struct {
+	Name  string
+	QType uint16
+}
+
+// BenchResult counts what came of the queries sent. Latencies holds one
+// entry per answered query.
+type BenchResult struct {
+	Sent      int
+	Timeouts  int
+	Errors    int
+	RCodes    map[string]int
+	Latencies []time.Duration
+	Elapsed   time.Duration
+}
+
+// readBenchQuestions reads a names file in dnsperf's format: a name and
+// optionally a type per line, blank lines and # comments skipped.
+func readBenchQuestions(r io.Reader) ([]BenchQuestion, error) {
+	var qs []BenchQuestion
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		q, err := benchQuestion(f)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		qs = append(qs, q)
+	}
+	return qs, sc.Err()
+}
+
+func benchQuestion(f []string) (BenchQuestion, error) {
+	if len(f) > 2 {
+		return BenchQuestion{}, fmt.Errorf("want a name and a type, got %q", strings.Join(f, " "))
+	}
+	name, err := toASCII(strings.TrimSuffix(f[0], "."))
+	if err != nil {
+		return BenchQuestion{}, fmt.Errorf("invalid name %q: %w", f[0], err)
+	}
+	q := BenchQuestion{Name: name, QType: 1}
+	if len(f) == 2 {
+		t, ok := parseType(f[1])
+		if !ok {
+			return BenchQuestion{}, fmt.Errorf("unknown type %q", f[1])
+		}
+		q.QType = t
+	}
+	return q, nil
+}
+
+// runBench sends queries at a steady rate until the duration is up or ctx
+// is done. When every worker is waiting on an answer the rate drops, which
+// the report shows as achieved QPS below the target.
+func runBench(ctx context.Context, cfg BenchConfig) BenchResult {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	// Each tick is a query to send; a worker picks up the next question
+	ticks := make(chan int, cfg.Concurrency)
+	go func() {
+		defer close(ticks)
+		interval := time.Second / time.Duration(cfg.QPS)
+		start := time.Now()
+		for i := 0; ; i++ {
+			if d := time.Until(start.Add(time.Duration(i) * interval)); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case ticks <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	res := BenchResult{RCodes: map[string]int{}}
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range cfg.Concurrency {
+		wg.Go(func() {
+			w := benchWorker{cfg: cfg}
+			defer w.close()
+			for i := range ticks {
+				q := cfg.Questions[i%len(cfg.Questions)]
+				rtt, rcode, err := w.exchange(buildQuery(q.Name, q.QType))
+				mu.Lock()
+				res.Sent++
+				var ne net.Error
+				switch {
+				case errors.As(err, &ne) && ne.Timeout():
+					res.Timeouts++
+				case err != nil:
+					res.Errors++
+				default:
+					res.RCodes[rcodeString(rcode)]++
+					res.Latencies = append(res.Latencies, rtt)
+				}
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	return res
+}
+
+// benchWorker keeps one UDP socket for all its queries, as a client
+// resolver would; over TCP each query gets a connection of its own.
+type benchWorker struct {
+	cfg  BenchConfig
+	conn net.Conn
+}
+
+func (w *benchWorker) exchange(query []byte) (time.Duration, int, error) {
+	binary.BigEndian.PutUint16(query, uint16(rand.Uint32()))
+	start := time.Now()
+	var resp []byte
+	var err error
+	if w.cfg.TCP {
+		resp, err = forwardTCP(query, w.cfg.Server)
+	} else {
+		resp, err = w.exchangeUDP(query)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return time.Since(start), int(resp[3] & 0x0F), nil
+}
+
+func (w *benchWorker) exchangeUDP(query []byte) ([]byte, error) {
+	if w.conn == nil {
+		conn, err := net.Dial("udp", w.cfg.Server)
+		if err != nil {
+			return nil, err
+		}
+		w.conn = conn
+	}
+	w.conn.SetDeadline(time.Now().Add(w.cfg.Timeout))
+	if _, err := w.conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, udpBufSize)
+	for {
+		n, err := w.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// A late answer to a query that already timed out is skipped
+		if matchesQuery(query, buf[:n]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+func (w *benchWorker) close() {
+	if w.conn != nil {
+		w.conn.Close()
+	}
+}
+
+// percentile returns the latency below which fraction q of the answers
+// came in.
+func (r BenchResult) percentile(q float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(r.Latencies)
+	slices.Sort(sorted)
+	i := int(q*float64(len(sorted))+0.5) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+func writeBenchReport(w io.Writer, cfg BenchConfig, r BenchResult) {
+	answered := len(r.Latencies)
+	pct := func(n int) float64 {
+		if r.Sent == 0 {
+			return 0
+		}
+		return 100 * float64(n) / float64(r.Sent)
+	}
+	fmt.Fprintf(w, "Queries sent:      %d in %s\n", r.Sent, r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "QPS:               %.1f achieved, %d target\n", float64(r.Sent)/r.Elapsed.Seconds(), cfg.QPS)
+	fmt.Fprintf(w, "Answered:          %d (%.2f%%)\n", answered, pct(answered))
+	fmt.Fprintf(w, "Timeouts:          %d (%.2f%%)\n", r.Timeouts, pct(r.Timeouts))
+	fmt.Fprintf(w, "Errors:            %d (%.2f%%)\n", r.Errors, pct(r.Errors))
+	if answered == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "\nResponse codes:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	codes := make([]string, 0, len(r.RCodes))
+	for code := range r.RCodes {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	for _, code := range codes {
+		fmt.Fprintf(tw, "  %s\t%d\t(%.2f%%)\n", code, r.RCodes[code], pct(r.RCodes[code]))
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w, "\nLatency:")
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, p := range []struct {
+		label string
+		q     float64
+	}{{"min", 0}, {"p50", 0.5}, {"p90", 0.9}, {"p99", 0.99}, {"p99.9", 0.999}, {"max", 1}} {
+		fmt.Fprintf(tw, "  %s\t%.3f ms\n", p.label, float64(r.percentile(p.q).Microseconds())/1000)
+	}
+	tw.Flush()
+}
+
+func handleBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	server := fs.String("server", "127.0.0.1:53", "Address of the DNS server to load")
+	qps := fs.Int("qps", 1000, "Queries per second to send")
+	duration := fs.Duration("duration", 10*time.Second, "How long to send queries for")
+	timeout := fs.Duration("timeout", forwardTimeout, "How long to wait for each answer")
+	concurrency := fs.Int("concurrency", 100, "Queries in flight at most")
+	tcp := fs.Bool("tcp", false, "Query over TCP, one connection per query")
+	namesPath := fs.String("names", "", "File of questions, a name and an optional type per line")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: regieleki bench [flags] [name [type]]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg := BenchConfig{
+		Server:      *server,
+		QPS:         *qps,
+		Duration:    *duration,
+		Timeout:     *timeout,
+		Concurrency: *concurrency,
+		TCP:         *tcp,
+	}
+	if cfg.QPS <= 0 || cfg.Concurrency <= 0 || cfg.Duration <= 0 {
+		fmt.Fprintln(os.Stderr, "error: -qps, -concurrency and -duration must be positive")
+		os.Exit(2)
+	}
+	switch {
+	case *namesPath != "" && fs.NArg() > 0:
+		fs.Usage()
+		os.Exit(2)
+	case *namesPath != "":
+		f, err := os.Open(*namesPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.Questions, err = readBenchQuestions(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: %v\n", *namesPath, err)
+			os.Exit(1)
+		}
+	case fs.NArg() > 0:
+		q, err := benchQuestion(fs.Args())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(2)
+		}
+		cfg.Questions = []BenchQuestion{q}
+	}
+	if len(cfg.Questions) == 0 {
+		fmt.Fprintln(os.Stderr, "error: give a name or -names")
+		os.Exit(2)
+	}
+
+	// Ctrl-C ends the run early, still with a report
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	fmt.Fprintf(os.Stderr, "sending %d queries/s to %s for %s\n", cfg.QPS, cfg.Server, cfg.Duration)
+	res := runBench(ctx, cfg)
+	writeBenchReport(os.Stdout, cfg, res)
+	if len(res.Latencies) < res.Sent {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadBenchQuestions(t *testing.T) {
+	qs, err := readBenchQuestions(strings.NewReader("# warm names\nexample.com\n\nwww.example.com. AAAA\nbücher.test MX # idn\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BenchQuestion{{"example.com", 1}, {"www.example.com", 28}, {"xn--bcher-kva.test", 15}}
+	if len(qs) != len(want) {
+		t.Fatalf("got %v, want %v", qs, want)
+	}
+	for i := range want {
+		if qs[i] != want[i] {
+			t.Errorf("question %d = %v, want %v", i, qs[i], want[i])
+		}
+	}
+
+	if _, err := readBenchQuestions(strings.NewReader("ok.test\nbad.test BOGUS\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("unknown type: err = %v", err)
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	fake := startFakeUpstream(t, `
+app.test A answer 10.0.0.1
+gone.test A nxdomain
+`)
+	cfg := BenchConfig{
+		Server:      fake.Addr(),
+		QPS:         200,
+		Duration:    300 * time.Millisecond,
+		Timeout:     time.Second,
+		Concurrency: 4,
+		Questions:   []BenchQuestion{{"app.test", 1}, {"gone.test", 1}},
+	}
+	res := runBench(context.Background(), cfg)
+	if res.Sent < 30 || res.Sent > 70 {
+		t.Errorf("sent %d queries at 200/s for 300ms", res.Sent)
+	}
+	if res.Timeouts != 0 || res.Errors != 0 || len(res.Latencies) != res.Sent {
+		t.Errorf("sent %d, answered %d, %d timeouts, %d errors", res.Sent, len(res.Latencies), res.Timeouts, res.Errors)
+	}
+	if res.RCodes["NOERROR"] == 0 || res.RCodes["NXDOMAIN"] == 0 || res.RCodes["NOERROR"]+res.RCodes["NXDOMAIN"] != res.Sent {
+		t.Errorf("rcodes = %v", res.RCodes)
+	}
+
+	var out strings.Builder
+	writeBenchReport(&out, cfg, res)
+	for _, want := range []string{"Timeouts:          0 (0.00%)", "NXDOMAIN", "p99.9"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestBenchPercentile(t *testing.T) {
+	var r BenchResult
+	for i := 1; i <= 100; i++ {
+		r.Latencies = append(r.Latencies, time.Duration(i)*time.Millisecond)
+	}
+	for q, want := range map[float64]time.Duration{0: time.Millisecond, 0.5: 50 * time.Millisecond, 0.99: 99 * time.Millisecond, 1: 100 * time.Millisecond} {
+		if got := r.percentile(q); got != want {
+			t.Errorf("percentile(%v) = %v, want %v", q, got, want)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBlocklistSchedule = "@daily"
+	blocklistFetchTimeout    = time.Minute
+	maxBlocklistSize         = 64 << 20
+)
+
+// Names that hosts files map for the local machine rather than to block.
+var blocklistIgnored = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true,
+	"broadcasthost": true, "ip6-localhost": true, "ip6-loopback": true,
+	"ip6-localnet": true, "ip6-mcastprefix": true, "ip6-allnodes": true,
+	"ip6-allrouters": true, "ip6-allhosts": true, "0.0.0.0": true,
+}
+
+type blocklistSource struct {
+	source      string // http(s) URL or file path
+	domains     []string
+	blocked     atomic.Uint64
+	lastRefresh time.Time
+	lastError   string
+}
+
+// BlocklistStatus is the externally visible state of one list.
+type BlocklistStatus struct {
+	Source      string    `json:"source"`
+	Domains     int       `json:"domains"`
+	Blocked     uint64    `json:"blocked"`
+	LastRefresh time.Time `json:"last_refresh,omitzero"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Blocklist answers queries for listed names, and their subdomains, without
+// forwarding them. Lists are hosts files or plain domain lists, fetched from
+// URLs or read from files, and refreshed by a scheduled job. A list that
+// fails to refresh keeps its previous contents.
+type Blocklist struct {
+	mu      sync.RWMutex
+	sources []*blocklistSource
+	domains map[string]*blocklistSource // first list naming each domain
+	path    string                      // where runtime changes are persisted ("" keeps them in memory)
+	zero    bool                        // answer 0.0.0.0 / :: instead of NXDOMAIN
+	client  *http.Client
+	blocked atomic.Uint64
+}
+
+// NewBlocklist uses the sources saved at path by an earlier Set, or fallback
+// if nothing has been saved. Nothing is blocked until the first Refresh.
+func NewBlocklist(path string, fallback []string, zero bool) (*Blocklist, error) {
+	b := &Blocklist{
+		domains: map[string]*blocklistSource{},
+		path:    path,
+		zero:    zero,
+		client:  &http.Client{Timeout: blocklistFetchTimeout},
+	}
+	sources := fallback
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			sources = nil
+			for _, line := range strings.Split(string(data), "\n") {
+				if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+					sources = append(sources, line)
+				}
+			}
+		}
+	}
+	b.replace(sources)
+	return b, nil
+}
+
+// Set replaces the list of sources and persists it. Sources that stay keep
+// their contents until the next Refresh.
+func (b *Blocklist) Set(sources []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.path != "" {
+		data := strings.Join(sources, "\n")
+		if len(sources) > 0 {
+			data += "\n"
+		}
+		if err := writeFileAtomic(b.path, []byte(data), false); err != nil {
+			return err
+		}
+	}
+	b.replace(sources)
+	b.rebuild()
+	return nil
+}
+
+// replace swaps in sources, reusing existing state. Caller must hold b.mu
+// unless b is not yet shared.
+func (b *Blocklist) replace(sources []string) {
+	next := make([]*blocklistSource, 0, len(sources))
+	for _, src := range sources {
+		var found *blocklistSource
+		for _, old := range b.sources {
+			if old.source == src {
+				found = old
+			}
+		}
+		if found == nil {
+			found = &blocklistSource{source: src}
+		}
+		next = append(next, found)
+	}
+	b.sources = next
+}
+
+// rebuild merges every list into the lookup table. Caller must hold b.mu.
+func (b *Blocklist) rebuild() {
+	n := 0
+	for _, src := range b.sources {
+		n += len(src.domains)
+	}
+	domains := make(map[string]*blocklistSource, n)
+	for _, src := range b.sources {
+		for _, d := range src.domains {
+			if _, ok := domains[d]; !ok {
+				domains[d] = src
+			}
+		}
+	}
+	b.domains = domains
+}
+
+// Refresh fetches every list. It is the scheduled job's entry point, so it
+// only returns an error when every list failed.
+func (b *Blocklist) Refresh(ctx context.Context) error {
+	b.mu.RLock()
+	sources := append([]*blocklistSource(nil), b.sources...)
+	b.mu.RUnlock()
+
+	type result struct {
+		domains []string
+		err     error
+	}
+	results := make([]result, len(sources))
+	var wg sync.WaitGroup
+	for i, src := range sources {
+		wg.Go(func() {
+			results[i].domains, results[i].err = b.fetch(ctx, src.source)
+		})
+	}
+	wg.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	failed := 0
+	for i, src := range sources {
+		if err := results[i].err; err != nil {
+			failed++
+			src.lastError = err.Error()
+			slog.WarnContext(ctx, "blocklist refresh failed", "source", src.source, "error", err)
+			continue
+		}
+		src.domains = results[i].domains
+		src.lastRefresh = time.Now()
+		src.lastError = ""
+	}
+	b.rebuild()
+	slog.InfoContext(ctx, "blocklists refreshed", "lists", len(sources), "failed", failed, "domains", len(b.domains))
+	if failed > 0 && failed == len(sources) {
+		return fmt.Errorf("all %d blocklists failed to refresh", failed)
+	}
+	return nil
+}
+
+func (b *Blocklist) fetch(ctx context.Context, source string) ([]string, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return parseBlocklist(f)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return parseBlocklist(io.LimitReader(resp.Body, maxBlocklistSize))
+}
+
+// parseBlocklist reads hosts-format ("0.0.0.0 ads.example.com") or plain
+// one-domain-per-line lists. Comments and entries for the local machine are
+// skipped.
+func parseBlocklist(r io.Reader) ([]string, error) {
+	var domains []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		} else {
+			fields = fields[:1]
+		}
+		for _, f := range fields {
+			d := strings.ToLower(strings.TrimSuffix(f, "."))
+			if d == "" || blocklistIgnored[d] || strings.ContainsAny(d, "/*^|") {
+				continue
+			}
+			domains = append(domains, d)
+		}
+	}
+	return domains, sc.Err()
+}
+
+// Match reports whether name or one of its parent domains is listed, and
+// counts the hit.
+func (b *Blocklist) Match(name string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, src := b.lookup(name)
+	if src == nil {
+		return false
+	}
+	src.blocked.Add(1)
+	b.blocked.Add(1)
+	return true
+}
+
+// Explain returns the listed domain covering name and the list naming it,
+// without counting a block; ok is false if name isn't blocked.
+func (b *Blocklist) Explain(name string) (domain, source string, ok bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	domain, src := b.lookup(name)
+	if src == nil {
+		return "", "", false
+	}
+	return domain, src.source, true
+}
+
+// lookup finds the listed domain equal to name or a parent of it, and the
+// list naming it. Caller must hold b.mu.
+func (b *Blocklist) lookup(name string) (string, *blocklistSource) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if len(b.domains) == 0 {
+		return "", nil
+	}
+	for {
+		if src, ok := b.domains[name]; ok {
+			return name, src
+		}
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			return "", nil
+		}
+		name = parent
+	}
+}
+
+// Response builds the answer for a blocked query.
+func (b *Blocklist) Response(query []byte, questionEnd int, qname string, qtype uint16) []byte {
+	if !b.zero {
+		return buildNXDomain(query, questionEnd)
+	}
+	var records []Record
+	switch qtype {
+	case 1:
+		records = []Record{{Domain: qname, Type: "A", Value: "0.0.0.0"}}
+	case 28:
+		records = []Record{{Domain: qname, Type: "AAAA", Value: "::"}}
+	}
+	return buildDNSResponse(query, questionEnd, records)
+}
+
+// Sources returns the configured lists in order.
+func (b *Blocklist) Sources() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	sources := make([]string, len(b.sources))
+	for i, src := range b.sources {
+		sources[i] = src.source
+	}
+	return sources
+}
+
+func (b *Blocklist) Status() []BlocklistStatus {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	result := make([]BlocklistStatus, len(b.sources))
+	for i, src := range b.sources {
+		result[i] = BlocklistStatus{
+			Source:      src.source,
+			Domains:     len(src.domains),
+			Blocked:     src.blocked.Load(),
+			LastRefresh: src.lastRefresh,
+			LastError:   src.lastError,
+		}
+	}
+	return result
+}
+
+// Counts returns how many distinct domains are blocked and how many queries
+// have been blocked since startup.
+func (b *Blocklist) Counts() (domains int, blocked uint64) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.domains), b.blocked.Load()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	got, err := parseBlocklist(strings.NewReader(`# hosts format
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com # trailing comment
+::1 ip6-localhost
+Doubleclick.NET.
+||adblock.example^
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ads.example.com", "tracker.example.com", "doubleclick.net"}
+	if !slices.Equal(got, want) {
+		t.Errorf("domains = %q, want %q", got, want)
+	}
+}
+
+func TestBlocklistRefreshAndMatch(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "local.txt")
+	os.WriteFile(file, []byte("ads.example.com\n"), 0o644)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/hosts" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("0.0.0.0 tracker.test\n"))
+	}))
+	defer srv.Close()
+
+	b, err := NewBlocklist("", []string{file, srv.URL + "/hosts"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Match("ads.example.com") {
+		t.Error("names must not be blocked before the first refresh")
+	}
+	if err := b.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"ads.example.com":     true,
+		"x.ads.example.com.":  true,
+		"TRACKER.test":        true,
+		"example.com":         false,
+		"notads.example.com":  false,
+		"tracker.test.evil.x": false,
+	} {
+		if got := b.Match(name); got != want {
+			t.Errorf("Match(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	// A list that fails to refresh keeps what it had
+	os.Remove(file)
+	if err := b.Refresh(context.Background()); err != nil {
+		t.Fatalf("one failed list must not fail the job: %v", err)
+	}
+	st := b.Status()
+	if st[0].Domains != 1 || st[0].LastError == "" || st[0].Blocked != 2 {
+		t.Errorf("status = %+v", st[0])
+	}
+	if domains, blocked := b.Counts(); domains != 2 || blocked != 3 {
+		t.Errorf("counts = %d domains, %d blocked", domains, blocked)
+	}
+}
+
+func TestDNSBlocklist(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Record{Domain: "ads.my.local", Type: "A", Value: "10.0.0.1"})
+	list := filepath.Join(t.TempDir(), "list.txt")
+	os.WriteFile(list, []byte("ads.test\nads.my.local\n"), 0o644)
+
+	fake := startFakeUpstream(t, "example.com A answer 93.184.216.34")
+	dns := NewDNSServer(store, []string{fake.Addr()})
+	dns.blocklist, _ = NewBlocklist("", []string{list}, false)
+	dns.blocklist.Refresh(context.Background())
+	addr := startDNSServer(t, dns)
+
+	if resp := exchange(t, addr, buildTestQuery("ads.test", 1, 1)); resp[3]&0x0F != 3 {
+		t.Errorf("blocked rcode = %d, want NXDOMAIN", resp[3]&0x0F)
+	}
+	if resp := exchange(t, addr, buildTestQuery("ads.my.local", 1, 1)); resp[7] != 1 {
+		t.Error("local records must win over blocklists")
+	}
+	if fake.Queries() != 0 {
+		t.Errorf("upstream queries = %d, want 0", fake.Queries())
+	}
+
+	zero := NewDNSServer(store, []string{fake.Addr()})
+	zero.blocklist, _ = NewBlocklist("", []string{list}, true)
+	zero.blocklist.Refresh(context.Background())
+	msg, err := parseMessage(exchange(t, startDNSServer(t, zero), buildTestQuery("www.ads.test", 28, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.RCode != 0 || len(msg.Answers) != 1 || msg.Answers[0].Data != "::" {
+		t.Errorf("zero mode answer = %+v", msg)
+	}
+}
+
+func TestWebBlocklists(t *testing.T) {
+	ws, _ := testWebServer(t)
+	path := filepath.Join(t.TempDir(), "blocklists.txt")
+	ws.blocklist, _ = NewBlocklist(path, nil, false)
+
+	req := httptest.NewRequest("PUT", "/api/blocklists", strings.NewReader(`{"lists":["https://example.com/hosts"," /etc/block.txt ","https://example.com/hosts"]}`))
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var report BlocklistReport
+	json.NewDecoder(w.Body).Decode(&report)
+	if report.Mode != "nxdomain" || len(report.Lists) != 2 || report.Lists[1].Source != "/etc/block.txt" {
+		t.Errorf("report = %+v", report)
+	}
+
+	reloaded, err := NewBlocklist(path, []string{"ignored"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Sources(); len(got) != 2 {
+		t.Errorf("persisted sources = %q", got)
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bulkColumns are the CSV columns exports write, in order. Imports need a
+// header naming at least domain, type and value, in any order.
+var bulkColumns = []string{"id", "domain", "type", "value", "view", "comment", "enabled", "expires", "tags"}
+
+// RowError is an imported record that failed validation. Rows count the
+// records in the upload from 1, not counting a CSV header.
+type RowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// ImportResult is the response of the import endpoints. For dry runs the
+// counts say what would happen and Records lists what was read.
+type ImportResult struct {
+	Added    int        `json:"added"`
+	Existing int        `json:"existing"`
+	Removed  int        `json:"removed,omitempty"`
+	Skipped  []string   `json:"skipped,omitempty"`
+	Errors   []RowError `json:"errors,omitempty"`
+	Records  []Record   `json:"records,omitempty"`
+}
+
+// writeBulk writes records as a JSON array in the records API's form, as
+// CSV with a header row, or for other tooling as a BIND zone file or a
+// hosts file. The last two hold only what every client is served: enabled
+// records outside views, and for hosts just the addresses.
+func writeBulk(w io.Writer, format string, records []Record) error {
+	switch format {
+	case "json":
+		result := make([]apiRecord, len(records))
+		for i, r := range records {
+			result[i] = displayRecord(r)
+		}
+		return json.NewEncoder(w).Encode(result)
+	case "zone":
+		return writeZone(w, records)
+	case "hosts":
+		return writeHosts(w, records)
+	}
+	cw := csv.NewWriter(w)
+	cw.Write(bulkColumns)
+	for _, r := range records {
+		expires := ""
+		if !r.Expires.IsZero() {
+			expires = r.Expires.UTC().Format(time.RFC3339)
+		}
+		cw.Write([]string{strconv.Itoa(r.ID), r.Domain, r.Type, r.Value, r.View, r.Comment, strconv.FormatBool(!r.Disabled), expires, r.Tags})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportTTL is the TTL zone file exports give records, the one they are
+// served with.
+const exportTTL = 60
+
+// writeZone writes records in zone file syntax that parseZoneFile reads
+// back, with absolute names so no $ORIGIN is needed.
+func writeZone(w io.Writer, records []Record) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "$TTL %d\n", exportTTL)
+	for _, r := range records {
+		if r.Disabled || r.View != "" {
+			continue
+		}
+		value := r.Value
+		switch r.Type {
+		case "CNAME":
+			value = fqdn(value)
+		case "TXT":
+			// Character-strings hold at most 255 bytes each
+			var parts []string
+			for s := value; ; s = s[min(255, len(s)):] {
+				parts = append(parts, `"`+zoneEscaper.Replace(s[:min(255, len(s))])+`"`)
+				if len(s) <= 255 {
+					break
+				}
+			}
+			value = strings.Join(parts, " ")
+		case "SVCB", "HTTPS":
+			if fields := strings.Fields(value); len(fields) >= 2 && fields[1] != "." {
+				fields[1] = fqdn(fields[1])
+				value = strings.Join(fields, " ")
+			}
+		}
+		if r.Comment != "" {
+			value += " ; " + r.Comment
+		}
+		fmt.Fprintf(bw, "%s\tIN\t%s\t%s\n", fqdn(r.Domain), r.Type, value)
+	}
+	return bw.Flush()
+}
+
+var zoneEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// writeHosts writes the A and AAAA records as hosts file lines.
+func writeHosts(w io.Writer, records []Record) error {
+	bw := bufio.NewWriter(w)
+	for _, r := range records {
+		if r.Disabled || r.View != "" || (r.Type != "A" && r.Type != "AAAA") {
+			continue
+		}
+		fmt.Fprintf(bw, "%s\t%s\n", r.Value, r.Domain)
+	}
+	return bw.Flush()
+}
+
+// parseBulk reads records written by writeBulk, or by hand. IDs and sources
+// in the upload are ignored; the store assigns its own. Every record is
+// validated, and the ones that fail are returned as row errors alongside
+// the valid ones. An error means the upload couldn't be read at all.
+func parseBulk(r io.Reader, format string) ([]Record, []RowError, error) {
+	var records []Record
+	var rowErrs []RowError
+	check := func(row int, rec Record) {
+		rec.ID, rec.Source = 0, ""
+		if p := validateRecord(&rec); p != nil {
+			rowErrs = append(rowErrs, RowError{row, p.Detail})
+			return
+		}
+		records = append(records, rec)
+	}
+
+	if format == "json" {
+		var rows []json.RawMessage
+		if err := json.NewDecoder(r).Decode(&rows); err != nil {
+			return nil, nil, errors.New("expected a JSON array of records")
+		}
+		for i, row := range rows {
+			rec, err := decodeRecord(bytes.NewReader(row))
+			if err != nil {
+				rowErrs = append(rowErrs, RowError{i + 1, "invalid JSON"})
+				continue
+			}
+			check(i+1, rec)
+		}
+		return records, rowErrs, nil
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	cols := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !slices.Contains(bulkColumns, name) {
+			return nil, nil, fmt.Errorf("unknown column %q", name)
+		}
+		cols[name] = i
+	}
+	for _, name := range []string{"domain", "type", "value"} {
+		if _, ok := cols[name]; !ok {
+			return nil, nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+	for row := 1; ; row++ {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(fields) != len(header) {
+			rowErrs = append(rowErrs, RowError{row, fmt.Sprintf("expected %d fields, got %d", len(header), len(fields))})
+			continue
+		}
+		get := func(name string) string {
+			if i, ok := cols[name]; ok {
+				return fields[i]
+			}
+			return ""
+		}
+		enabled := true
+		if v := strings.TrimSpace(get("enabled")); v != "" {
+			if enabled, err = strconv.ParseBool(v); err != nil {
+				rowErrs = append(rowErrs, RowError{row, "enabled must be true or false"})
+				continue
+			}
+		}
+		var expires time.Time
+		if v := strings.TrimSpace(get("expires")); v != "" {
+			if expires, err = time.Parse(time.RFC3339, v); err != nil {
+				rowErrs = append(rowErrs, RowError{row, "expires must be an RFC 3339 time"})
+				continue
+			}
+		}
+		check(row, Record{Domain: get("domain"), Type: get("type"), Value: get("value"), View: get("view"),
+			Comment: get("comment"), Disabled: !enabled, Expires: expires, Tags: get("tags")})
+	}
+	return records, rowErrs, nil
+}
+
+// importPlan is what importing a set of records changes in the store.
+type importPlan struct {
+	add      []Record
+	existing int
+	remove   []Record
+}
+
+// planImport compares records with the store's own. Records already present,
+// with the same name, type, value and view, are left alone, so importing the
+// same set twice changes nothing. With replace, every local record missing
+// from records is removed as well.
+func planImport(store *Store, records []Record, replace bool) importPlan {
+	key := func(r Record) string {
+		return strings.ToLower(r.Domain) + "\t" + strings.ToUpper(r.Type) + "\t" + r.Value + "\t" + r.View
+	}
+	_, have := store.Snapshot()
+	present := make(map[string]bool, len(have))
+	for _, r := range have {
+		present[key(r)] = true
+	}
+
+	var plan importPlan
+	wanted := make(map[string]bool, len(records))
+	for _, r := range records {
+		k := key(r)
+		if wanted[k] {
+			continue
+		}
+		wanted[k] = true
+		if present[k] {
+			plan.existing++
+		} else {
+			plan.add = append(plan.add, r)
+		}
+	}
+	if replace {
+		for _, r := range have {
+			if !wanted[key(r)] {
+				plan.remove = append(plan.remove, r)
+			}
+		}
+	}
+	return plan
+}
+
+// apply makes the planned changes as one batch, so the store never holds a
+// half-imported set.
+func (p importPlan) apply(store *Store) error {
+	ops := make([]BatchOp, 0, len(p.add)+len(p.remove))
+	for _, r := range p.remove {
+		ops = append(ops, BatchOp{Op: "delete", ID: r.ID})
+	}
+	for _, r := range p.add {
+		ops = append(ops, BatchOp{Op: "create", Record: r})
+	}
+	_, err := store.Batch(ops)
+	return err
+}
+
+// result fills in the counts of an ImportResult.
+func (p importPlan) result() ImportResult {
+	return ImportResult{Added: len(p.add), Existing: p.existing, Removed: len(p.remove)}
+}
+
+// importFormats are what the import subcommand reads; bulk uploads to the
+// API take only json and csv.
+var importFormats = []string{"json", "csv", "zone", "hosts"}
+
+// handleImport adds the records in a file to the data file, or with
+// -mode replace makes the data file hold exactly those records. The data
+// file is written directly, so the server should be stopped or the file
+// posted to its API instead.
+func handleImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dataPath := fs.String("data", "records.tsv", "Path to records file")
+	format := fs.String("format", "", "Format of the file: json, csv, zone or hosts (default from the file extension, else zone)")
+	zonePath := fs.String("zone", "", "BIND zone file to import (the same as giving it as the argument with -format zone)")
+	origin := fs.String("origin", "", "Origin for relative names in a zone file until $ORIGIN (default: the file name without a db. prefix)")
+	mode := fs.String("mode", "merge", "merge adds what isn't there yet; replace also deletes every record missing from the file")
+	dryRun := fs.Bool("dry-run", false, "Only show what would be imported")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: regieleki import [flags] <file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	path := fs.Arg(0)
+	if *zonePath != "" {
+		path, *format = *zonePath, "zone"
+	}
+	if path == "" || fs.NArg() > 1 || (*zonePath != "" && fs.NArg() > 0) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *format == "" {
+		*format = "zone"
+		if ext := strings.TrimPrefix(filepath.Ext(path), "."); slices.Contains(importFormats, ext) {
+			*format = ext
+		}
+	}
+	if !slices.Contains(importFormats, *format) {
+		fmt.Fprintln(os.Stderr, "error: -format must be json, csv, zone or hosts")
+		os.Exit(2)
+	}
+	if *mode != "merge" && *mode != "replace" {
+		fmt.Fprintln(os.Stderr, "error: -mode must be merge or replace")
+		os.Exit(2)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	var records []Record
+	var skipped []string
+	var rowErrs []RowError
+	switch *format {
+	case "zone":
+		if *origin == "" {
+			*origin = strings.TrimPrefix(filepath.Base(path), "db.")
+		}
+		var zone ZoneImport
+		zone, err = parseZoneFile(f, *origin)
+		records, skipped = zone.Records, zone.Skipped
+	case "hosts":
+		if records, err = parseHosts(f); err == nil {
+			for i := range records {
+				if p := validateRecord(&records[i]); p != nil {
+					rowErrs = append(rowErrs, RowError{i + 1, records[i].Domain + ": " + p.Detail})
+				}
+			}
+		}
+	default:
+		records, rowErrs, err = parseBulk(f, *format)
+	}
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s: %v\n", path, err)
+		os.Exit(1)
+	}
+	for _, s := range skipped {
+		fmt.Fprintf(os.Stderr, "skipped %s\n", s)
+	}
+	for _, e := range rowErrs {
+		fmt.Fprintf(os.Stderr, "%s: record %d: %s\n", path, e.Row, e.Error)
+	}
+	if len(rowErrs) > 0 {
+		if !*dryRun {
+			fmt.Fprintln(os.Stderr, "nothing imported")
+		}
+		os.Exit(1)
+	}
+
+	store, err := loadStore(*dataPath, !*dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	plan := planImport(store, records, *mode == "replace")
+	if *dryRun {
+		for _, r := range plan.add {
+			fmt.Printf("add\t%s\t%s\t%s\n", r.Domain, r.Type, r.Value)
+		}
+		for _, r := range plan.remove {
+			fmt.Printf("remove\t%s\t%s\t%s\n", r.Domain, r.Type, r.Value)
+		}
+		return
+	}
+	if err := plan.apply(store); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := store.Compact(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("imported %d records (%d already present, %d removed, %d skipped)\n", len(plan.add), plan.existing, len(plan.remove), len(skipped))
+}
+
+// loadStore reads the data file for import and export with the journal a
+// -journal server keeps beside it replayed on top, so they see the records
+// being served rather than the last compaction. With write, an existing
+// journal is also opened, so changes are appended after its entries and a
+// restart replays them in order until Compact folds everything into the
+// data file.
+func loadStore(dataPath string, write bool) (*Store, error) {
+	store, err := NewStore(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	journalPath := dataPath + ".journal"
+	if _, err := os.Stat(journalPath); write && err == nil {
+		return store, store.OpenJournal(journalPath)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, err := store.replayJournal(journalPath); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// handleExport writes the data file's records to standard output, or to
+// -output, which is replaced atomically so a failed run never leaves half
+// a backup.
+func handleExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dataPath := fs.String("data", "records.tsv", "Path to records file")
+	format := fs.String("format", "json", "json, csv, zone or hosts; zone and hosts leave out disabled records and views")
+	output := fs.String("output", "", "File to write instead of standard output")
+	fs.Parse(args)
+	if !slices.Contains(importFormats, *format) {
+		fmt.Fprintln(os.Stderr, "error: -format must be json, csv, zone or hosts")
+		os.Exit(2)
+	}
+	if _, err := os.Stat(*dataPath); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	store, err := loadStore(*dataPath, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	_, records := store.Snapshot()
+	if *output == "" {
+		if err := writeBulk(os.Stdout, *format, records); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeBulk(&buf, *format, records); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := writeFileAtomic(*output, buf.Bytes(), true); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBulkExportImport(t *testing.T) {
+	ws, store := testWebServer(t)
+	store.Add(Record{Domain: "app.my.local", Type: "A", Value: "10.0.0.1"})
+	store.Add(Record{Domain: "txt.my.local", Type: "TXT", Value: `say "hi", twice`, View: "lan", Comment: "greeting", Disabled: true, Tags: "public,web"})
+	store.SetSource("hosts:/etc/hosts", []Record{{Domain: "nas.my.local", Type: "A", Value: "10.0.0.9"}})
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+
+	csvExport := do("GET", "/api/records/export?format=csv", "")
+	want := "id,domain,type,value,view,comment,enabled,expires,tags\n1,app.my.local,A,10.0.0.1,,,true,,\n2,txt.my.local,TXT,\"say \"\"hi\"\", twice\",lan,greeting,false,,\"public,web\"\n"
+	if csvExport.Code != 200 || csvExport.Body.String() != want {
+		t.Fatalf("csv export: %d\n%s", csvExport.Code, csvExport.Body.String())
+	}
+	jsonExport := do("GET", "/api/records/export", "").Body.String()
+
+	// Re-importing an export changes nothing, in either format
+	for _, body := range []string{csvExport.Body.String(), jsonExport} {
+		format := "csv"
+		if strings.HasPrefix(body, "[") {
+			format = "json"
+		}
+		w := do("POST", "/api/records/import?format="+format, body)
+		if w.Code != 200 || !strings.Contains(w.Body.String(), `"added":0,"existing":2`) {
+			t.Errorf("%s re-import: %d %s", format, w.Code, w.Body.String())
+		}
+	}
+
+	// A dry run reports invalid rows; without it they reject the whole upload
+	upload := "domain,type,value\nnew.my.local,AAAA,fd00::1\nbad.my.local,A,fd00::2\napp.my.local,a,10.0.0.1\n"
+	w := do("POST", "/api/records/import?format=csv&mode=replace&dry_run=1", upload)
+	var result ImportResult
+	json.NewDecoder(w.Body).Decode(&result)
+	if w.Code != 200 || result.Added != 1 || result.Existing != 1 || result.Removed != 1 ||
+		len(result.Errors) != 1 || result.Errors[0].Row != 2 {
+		t.Fatalf("dry run: %d %+v", w.Code, result)
+	}
+	if w := do("POST", "/api/records/import?format=csv&mode=replace", upload); w.Code != 400 {
+		t.Fatalf("import with a bad row: %d %s", w.Code, w.Body.String())
+	}
+	if len(store.List()) != 3 {
+		t.Fatalf("rejected import changed the store: %+v", store.List())
+	}
+
+	upload = strings.Replace(upload, "bad.my.local,A,fd00::2\n", "", 1)
+	if w := do("POST", "/api/records/import?mode=replace", upload); w.Code != 400 {
+		t.Errorf("csv parsed as json: %d", w.Code)
+	}
+	w = do("POST", "/api/records/import?format=csv&mode=replace", upload)
+	if w.Code != 200 {
+		t.Fatalf("replace: %d %s", w.Code, w.Body.String())
+	}
+	_, local := store.Snapshot()
+	if len(local) != 2 || local[0].Domain != "app.my.local" || local[1].Domain != "new.my.local" {
+		t.Errorf("records after replace: %+v", local)
+	}
+	if len(store.List()) != 3 {
+		t.Error("replace removed records from a sync source")
+	}
+}
+
+func TestLoadStoreJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.tsv")
+	server, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.OpenJournal(path + ".journal"); err != nil {
+		t.Fatal(err)
+	}
+	added, _ := server.Add(Record{Domain: "app.my.local", Type: "A", Value: "10.0.0.1"})
+
+	// Export sees the journaled record and leaves the journal alone
+	store, err := loadStore(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := store.List(); len(got) != 1 || got[0].Domain != "app.my.local" {
+		t.Errorf("records read for export: %+v", got)
+	}
+	if data, _ := os.ReadFile(path + ".journal"); len(data) == 0 {
+		t.Error("export emptied the journal")
+	}
+
+	// An import that deletes the record folds the journal in, so a
+	// restart does not bring the record back
+	if store, err = loadStore(path, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(added.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.OpenJournal(path + ".journal"); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.List(); len(got) != 0 {
+		t.Errorf("records after restart: %+v", got)
+	}
+}
+
+func TestWriteZoneAndHosts(t *testing.T) {
+	records := []Record{
+		{ID: 1, Domain: "app.test", Type: "A", Value: "10.0.0.1", Comment: "web; front"},
+		{ID: 2, Domain: "v6.test", Type: "AAAA", Value: "fd00::1"},
+		{ID: 3, Domain: "www.test", Type: "CNAME", Value: "app.test"},
+		{ID: 4, Domain: "app.test", Type: "TXT", Value: `say "hi" ` + strings.Repeat("x", 300)},
+		{ID: 5, Domain: "svc.test", Type: "HTTPS", Value: "1 app.test alpn=h2"},
+		{ID: 6, Domain: "off.test", Type: "A", Value: "10.0.0.2", Disabled: true},
+		{ID: 7, Domain: "lan.test", Type: "A", Value: "10.0.0.3", View: "lan"},
+	}
+
+	// A zone export reads back as the same records, less those it can't hold
+	var zone strings.Builder
+	if err := writeBulk(&zone, "zone", records); err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseZoneFile(strings.NewReader(zone.String()), "")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, zone.String())
+	}
+	if len(got.Records) != 5 || len(got.Skipped) != 0 {
+		t.Fatalf("read back %+v from\n%s", got, zone.String())
+	}
+	for i, r := range got.Records {
+		if want := records[i]; r.Domain != want.Domain || r.Type != want.Type || r.Value != want.Value {
+			t.Errorf("record %d = %+v, want %+v", i, r, want)
+		}
+	}
+
+	var hosts strings.Builder
+	writeBulk(&hosts, "hosts", records)
+	if want := "10.0.0.1\tapp.test\nfd00::1\tv6.test\n"; hosts.String() != want {
+		t.Errorf("hosts = %q, want %q", hosts.String(), want)
+	}
+}
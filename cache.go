@@ -0,0 +1,326 @@
+package main
+
+import (
+	"cmp"
+	"container/list"
+	"encoding/binary"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheSize = 10000
+	maxCacheTTL      = 24 * time.Hour
+	negativeCacheTTL = 60 * time.Second
+
+	// staleAnswerTTL is the TTL handed out with stale answers (RFC 8767 §4).
+	staleAnswerTTL = 30
+)
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	key        cacheKey
+	resp       []byte
+	ttlOffsets []int
+	ownerNames []int // record owner names spelling out the qname
+	stored     time.Time
+	expires    time.Time
+}
+
+// Cache holds forwarded upstream responses keyed by (qname, qtype) until the
+// smallest TTL in the response runs out. It is bounded to a fixed number of
+// entries with least-recently-used eviction.
+type Cache struct {
+	mu      sync.Mutex
+	max     int
+	stale   time.Duration // how long expired entries remain usable as a fallback
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+func NewCache(max int) *Cache {
+	return &Cache{
+		max:     max,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// Get returns a cached response adapted to the given query: the transaction
+// ID and question bytes are copied from the query (preserving the client's
+// name case) and every TTL is reduced by the time spent in the cache.
+func (c *Cache) Get(query []byte, questionEnd int, qname string, qtype uint16) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[cacheKey{strings.ToLower(qname), qtype}]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	now := c.now()
+	if !now.Before(e.expires) {
+		if !now.Before(e.expires.Add(c.stale)) {
+			c.lru.Remove(el)
+			delete(c.entries, e.key)
+		}
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.render(query, questionEnd, uint32(now.Sub(e.stored)/time.Second), false), true
+}
+
+// GetStale returns an expired entry that is still inside the serve-stale
+// window, with every TTL set to staleAnswerTTL. It is meant for when no
+// upstream could be reached (RFC 8767).
+func (c *Cache) GetStale(query []byte, questionEnd int, qname string, qtype uint16) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stale <= 0 {
+		return nil, false
+	}
+	el, ok := c.entries[cacheKey{strings.ToLower(qname), qtype}]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	now := c.now()
+	if !now.Before(e.expires.Add(c.stale)) {
+		c.lru.Remove(el)
+		delete(c.entries, e.key)
+		return nil, false
+	}
+	return e.render(query, questionEnd, 0, true), true
+}
+
+func (e *cacheEntry) render(query []byte, questionEnd int, age uint32, stale bool) []byte {
+	resp := make([]byte, len(e.resp))
+	copy(resp, e.resp)
+	resp[0], resp[1] = query[0], query[1]
+	resp[2] = resp[2]&^0x01 | query[2]&0x01 // RD mirrors the query
+	if questionEnd <= len(resp) {
+		copy(resp[12:questionEnd], query[12:questionEnd])
+		for _, off := range e.ownerNames {
+			copy(resp[off:], query[12:questionEnd-4])
+		}
+	}
+	for _, off := range e.ttlOffsets {
+		if stale {
+			binary.BigEndian.PutUint32(resp[off:], staleAnswerTTL)
+			continue
+		}
+		ttl := binary.BigEndian.Uint32(resp[off:])
+		if ttl > age {
+			ttl -= age
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(resp[off:], ttl)
+	}
+	return resp
+}
+
+// Put stores an upstream response if it is cacheable: NOERROR or NXDOMAIN,
+// not truncated, and parseable.
+func (c *Cache) Put(qname string, qtype uint16, resp []byte) {
+	if c.max <= 0 || len(resp) < 12 {
+		return
+	}
+	rcode := resp[3] & 0x0F
+	if resp[2]&0x02 != 0 || (rcode != 0 && rcode != 3) {
+		return
+	}
+	offsets, minTTL, ok := rrTTLOffsets(resp)
+	if !ok {
+		return
+	}
+	ttl := time.Duration(minTTL) * time.Second
+	if len(offsets) == 0 {
+		ttl = negativeCacheTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	ttl = min(ttl, maxCacheTTL)
+
+	now := c.now()
+	e := &cacheEntry{
+		key:        cacheKey{strings.ToLower(qname), qtype},
+		resp:       append([]byte(nil), resp...),
+		ttlOffsets: offsets,
+		ownerNames: qnameOwners(resp),
+		stored:     now,
+		expires:    now.Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *Cache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries)
+	c.entries = make(map[cacheKey]*list.Element)
+	c.lru.Init()
+	return n
+}
+
+// FlushDomain drops the entries for domain and the names under it, and
+// returns how many there were.
+func (c *Cache) FlushDomain(domain string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, el := range c.entries {
+		if inZone(strings.TrimSuffix(key.name, "."), domain) {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+			n++
+		}
+	}
+	return n
+}
+
+// CacheEntryInfo describes a cached response for /api/cache.
+type CacheEntryInfo struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	RCode   string    `json:"rcode"`
+	Answers []string  `json:"answers"`
+	TTL     int       `json:"ttl"`             // seconds until it expires
+	Stale   bool      `json:"stale,omitempty"` // expired, but kept for when upstreams fail
+	Expires time.Time `json:"expires"`
+}
+
+// Entries lists the usable entries for domain and the names under it, or
+// every entry for "", ordered by name and type.
+func (c *Cache) Entries(domain string) []CacheEntryInfo {
+	var entries []*cacheEntry
+	c.mu.Lock()
+	now := c.now()
+	for key, el := range c.entries {
+		e := el.Value.(*cacheEntry)
+		if domain != "" && !inZone(strings.TrimSuffix(key.name, "."), domain) {
+			continue
+		}
+		if now.Before(e.expires) || now.Before(e.expires.Add(c.stale)) {
+			entries = append(entries, e)
+		}
+	}
+	c.mu.Unlock()
+
+	out := make([]CacheEntryInfo, 0, len(entries))
+	for _, e := range entries {
+		info := CacheEntryInfo{
+			Name:    strings.TrimSuffix(e.key.name, "."),
+			Type:    typeString(e.key.qtype),
+			Answers: []string{},
+			Stale:   !now.Before(e.expires),
+			Expires: e.expires,
+		}
+		if !info.Stale {
+			info.TTL = int(e.expires.Sub(now).Seconds())
+		}
+		if msg, err := parseMessage(e.resp); err == nil {
+			info.RCode = rcodeString(msg.RCode)
+			for _, rr := range msg.Answers {
+				info.Answers = append(info.Answers, strings.ToLower(rr.Name)+" "+typeString(rr.Type)+" "+rr.Data)
+			}
+		}
+		out = append(out, info)
+	}
+	slices.SortFunc(out, func(a, b CacheEntryInfo) int {
+		return cmp.Or(strings.Compare(a.Name, b.Name), strings.Compare(a.Type, b.Type))
+	})
+	return out
+}
+
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// skipDNSName returns the offset just past the name starting at offset, or -1
+// if the name runs off the end of the message.
+func skipDNSName(buf []byte, offset int) int {
+	for offset < len(buf) {
+		length := int(buf[offset])
+		switch {
+		case length == 0:
+			return offset + 1
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(buf) {
+				return -1
+			}
+			return offset + 2
+		default:
+			offset += 1 + length
+		}
+	}
+	return -1
+}
+
+// rrTTLOffsets walks every resource record in a message and returns the byte
+// offsets of their TTL fields along with the smallest TTL seen. EDNS OPT
+// pseudo-records are skipped since their TTL field holds flags.
+func rrTTLOffsets(msg []byte) ([]int, uint32, bool) {
+	if len(msg) < 12 {
+		return nil, 0, false
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:6]))
+	rrcount := int(binary.BigEndian.Uint16(msg[6:8])) +
+		int(binary.BigEndian.Uint16(msg[8:10])) +
+		int(binary.BigEndian.Uint16(msg[10:12]))
+
+	off := 12
+	for range qdcount {
+		off = skipDNSName(msg, off)
+		if off < 0 || off+4 > len(msg) {
+			return nil, 0, false
+		}
+		off += 4
+	}
+
+	var offsets []int
+	minTTL := uint32(0xFFFFFFFF)
+	for range rrcount {
+		off = skipDNSName(msg, off)
+		if off < 0 || off+10 > len(msg) {
+			return nil, 0, false
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		if rtype != 41 {
+			offsets = append(offsets, off+4)
+			minTTL = min(minTTL, binary.BigEndian.Uint32(msg[off+4:]))
+		}
+		off += 10 + rdlen
+		if off > len(msg) {
+			return nil, 0, false
+		}
+	}
+	if len(offsets) == 0 {
+		minTTL = 0
+	}
+	return offsets, minTTL, true
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testUpstreamResponse(domain string, ip string) []byte {
+	query := buildTestQuery(domain, 1, 1)
+	return buildDNSResponse(query, len(query), []Record{{Domain: domain, Type: "A", Value: ip}})
+}
+
+func TestCacheGetPut(t *testing.T) {
+	c := NewCache(10)
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	resp := testUpstreamResponse("example.com", "93.184.216.34")
+	c.Put("example.com", 1, resp)
+	if c.Len() != 1 {
+		t.Fatalf("Len = %d, want 1", c.Len())
+	}
+
+	// A different client asks with a new ID and mixed case
+	query := buildTestQuery("Example.COM", 1, 1)
+	query[0], query[1] = 0x12, 0x34
+	now = now.Add(10 * time.Second)
+
+	got, ok := c.Get(query, len(query), "Example.COM", 1)
+	if !ok {
+		t.Fatal("expected cache hit")
+	}
+	if got[0] != 0x12 || got[1] != 0x34 {
+		t.Errorf("ID = %x%x, want 1234", got[0], got[1])
+	}
+	name, _ := parseDNSName(got, 12)
+	if name != "Example.COM" {
+		t.Errorf("question name = %q, want client's case", name)
+	}
+	ttl := binary.BigEndian.Uint32(got[len(query)+6:])
+	if ttl != 50 {
+		t.Errorf("TTL = %d, want 50 after 10s in cache", ttl)
+	}
+
+	// Cached bytes must not be modified by the render
+	if _, ok := c.Get(query, len(query), "example.com", 1); !ok {
+		t.Fatal("expected second cache hit")
+	}
+
+	now = now.Add(51 * time.Second)
+	if _, ok := c.Get(query, len(query), "example.com", 1); ok {
+		t.Error("expected miss after TTL expiry")
+	}
+}
+
+func TestCacheOwnerNameCase(t *testing.T) {
+	c := NewCache(10)
+	// An upstream that spells out owner names instead of compressing them
+	query := buildTestQuery("www.example.com", 1, 1)
+	resp := append([]byte(nil), query...)
+	resp[2], resp[3], resp[7] = 0x81, 0x80, 2
+	resp = appendRR(resp, "www.example.com", 5, 300, encodeDNSName("web.example.com"))
+	resp = appendRR(resp, "web.example.com", 1, 300, []byte{10, 0, 0, 1})
+	c.Put("www.example.com", 1, resp)
+
+	query = buildTestQuery("wWw.ExAmPlE.cOm", 1, 1)
+	got, ok := c.Get(query, len(query), "wWw.ExAmPlE.cOm", 1)
+	if !ok {
+		t.Fatal("expected cache hit")
+	}
+	m, err := parseMessage(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Questions[0].Name != "wWw.ExAmPlE.cOm" || m.Answers[0].Name != "wWw.ExAmPlE.cOm" || m.Answers[1].Name != "web.example.com" {
+		t.Errorf("names = %q %q %q, want the query's case for the qname only", m.Questions[0].Name, m.Answers[0].Name, m.Answers[1].Name)
+	}
+}
+
+func TestCacheSkipsUncacheable(t *testing.T) {
+	c := NewCache(10)
+
+	query := buildTestQuery("fail.com", 1, 1)
+	c.Put("fail.com", 1, buildServFail(query, len(query)))
+
+	truncated := testUpstreamResponse("big.com", "10.0.0.1")
+	truncated[2] |= 0x02
+	c.Put("big.com", 1, truncated)
+
+	c.Put("short.com", 1, []byte{1, 2, 3})
+
+	if c.Len() != 0 {
+		t.Errorf("Len = %d, want 0", c.Len())
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := NewCache(2)
+	c.Put("a.com", 1, testUpstreamResponse("a.com", "10.0.0.1"))
+	c.Put("b.com", 1, testUpstreamResponse("b.com", "10.0.0.2"))
+
+	// Touch a.com so b.com becomes least recently used
+	q := buildTestQuery("a.com", 1, 1)
+	c.Get(q, len(q), "a.com", 1)
+
+	c.Put("c.com", 1, testUpstreamResponse("c.com", "10.0.0.3"))
+	if c.Len() != 2 {
+		t.Fatalf("Len = %d, want 2", c.Len())
+	}
+	q = buildTestQuery("b.com", 1, 1)
+	if _, ok := c.Get(q, len(q), "b.com", 1); ok {
+		t.Error("expected b.com to be evicted")
+	}
+	q = buildTestQuery("a.com", 1, 1)
+	if _, ok := c.Get(q, len(q), "a.com", 1); !ok {
+		t.Error("expected a.com to survive eviction")
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	c := NewCache(10)
+	query := buildTestQuery("missing.com", 1, 1)
+	c.Put("missing.com", 1, buildNXDomain(query, len(query)))
+	if _, ok := c.Get(query, len(query), "missing.com", 1); !ok {
+		t.Error("expected NXDOMAIN to be cached")
+	}
+}
+
+func TestWebCacheFlush(t *testing.T) {
+	ws, _ := testWebServer(t)
+	ws.cache = NewCache(10)
+	ws.cache.Put("a.com", 1, testUpstreamResponse("a.com", "10.0.0.1"))
+
+	req := httptest.NewRequest("POST", "/api/cache/flush", nil)
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if ws.cache.Len() != 0 {
+		t.Errorf("Len = %d after flush, want 0", ws.cache.Len())
+	}
+}
+
+func TestWebCacheByDomain(t *testing.T) {
+	ws, _ := testWebServer(t)
+	ws.cache = NewCache(10)
+	for _, name := range []string{"example.com", "www.example.com", "notexample.com"} {
+		ws.cache.Put(name, 1, testUpstreamResponse(name, "10.0.0.1"))
+	}
+	do := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	w := do("GET", "/api/cache?domain=Example.com.")
+	var entries []CacheEntryInfo
+	json.NewDecoder(w.Body).Decode(&entries)
+	if w.Code != 200 || len(entries) != 2 || entries[0].Name != "example.com" || entries[1].Name != "www.example.com" {
+		t.Fatalf("entries = %d %+v", w.Code, entries)
+	}
+	if e := entries[0]; e.Type != "A" || e.RCode != "NOERROR" || e.TTL <= 0 || len(e.Answers) != 1 || e.Answers[0] != "example.com A 10.0.0.1" {
+		t.Errorf("entry = %+v", e)
+	}
+	if w := do("GET", "/api/cache?limit=1&offset=1"); w.Header().Get("X-Total-Count") != "3" || !strings.Contains(w.Body.String(), "notexample.com") {
+		t.Errorf("paged = %s %s", w.Header().Get("X-Total-Count"), w.Body)
+	}
+
+	// Flushing a domain takes its subdomains but not names that only end alike
+	if w := do("POST", "/api/cache/flush?domain=example.com"); !strings.Contains(w.Body.String(), `"flushed":2`) {
+		t.Errorf("flush = %s", w.Body)
+	}
+	if ws.cache.Len() != 1 {
+		t.Errorf("Len = %d after flushing example.com, want 1", ws.cache.Len())
+	}
+}
+
+func TestCacheServeStale(t *testing.T) {
+	c := NewCache(10)
+	c.stale = time.Hour
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	c.Put("example.com", 1, testUpstreamResponse("example.com", "93.184.216.34"))
+	query := buildTestQuery("example.com", 1, 1)
+
+	// Fresh entries are not handed out as stale data
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.Get(query, len(query), "example.com", 1); ok {
+		t.Fatal("expected normal lookup to miss after expiry")
+	}
+	got, ok := c.GetStale(query, len(query), "example.com", 1)
+	if !ok {
+		t.Fatal("expected stale hit inside window")
+	}
+	if ttl := binary.BigEndian.Uint32(got[len(query)+6:]); ttl != staleAnswerTTL {
+		t.Errorf("stale TTL = %d, want %d", ttl, staleAnswerTTL)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, ok := c.GetStale(query, len(query), "example.com", 1); ok {
+		t.Error("expected stale miss outside window")
+	}
+	if c.Len() != 0 {
+		t.Errorf("Len = %d, want entry dropped after stale window", c.Len())
+	}
+}
+
+func TestCacheServeStaleDisabled(t *testing.T) {
+	c := NewCache(10)
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	c.Put("example.com", 1, testUpstreamResponse("example.com", "93.184.216.34"))
+	query := buildTestQuery("example.com", 1, 1)
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.GetStale(query, len(query), "example.com", 1); ok {
+		t.Error("expected no stale answers when disabled")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ChaosRule makes queries for a domain (and its subdomains) misbehave for a
+// percentage of requests, so applications can exercise their DNS failure
+// handling against a realistic resolver.
+type ChaosRule struct {
+	Domain  string `json:"domain"`
+	DelayMS int    `json:"delay_ms,omitempty"`
+	Fault   string `json:"fault,omitempty"` // "servfail", "nxdomain", or empty for delay only
+	Percent int    `json:"percent"`
+}
+
+type Chaos struct {
+	mu    sync.RWMutex
+	rules map[string]ChaosRule
+}
+
+func NewChaos() *Chaos {
+	return &Chaos{rules: make(map[string]ChaosRule)}
+}
+
+func validateChaosRule(r *ChaosRule) string {
+	r.Domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(r.Domain), "."))
+	r.Fault = strings.ToLower(strings.TrimSpace(r.Fault))
+	if r.Domain == "" {
+		return "domain is required"
+	}
+	if r.Percent < 0 || r.Percent > 100 {
+		return "percent must be between 0 and 100"
+	}
+	if r.DelayMS < 0 || r.DelayMS > 30000 {
+		return "delay_ms must be between 0 and 30000"
+	}
+	switch r.Fault {
+	case "", "servfail", "nxdomain":
+	default:
+		return "fault must be servfail, nxdomain, or empty"
+	}
+	if r.Fault == "" && r.DelayMS == 0 {
+		return "rule needs a fault or a delay"
+	}
+	return ""
+}
+
+func (c *Chaos) Set(r ChaosRule) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules[r.Domain] = r
+}
+
+func (c *Chaos) Delete(domain string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if _, ok := c.rules[domain]; !ok {
+		return false
+	}
+	delete(c.rules, domain)
+	return true
+}
+
+func (c *Chaos) List() []ChaosRule {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	result := make([]ChaosRule, 0, len(c.rules))
+	for _, r := range c.rules {
+		result = append(result, r)
+	}
+	slices.SortFunc(result, func(a, b ChaosRule) int { return strings.Compare(a.Domain, b.Domain) })
+	return result
+}
+
+// Roll finds the most specific rule covering domain and decides whether this
+// query is one of the affected percentage.
+func (c *Chaos) Roll(domain string) (ChaosRule, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.rules) == 0 {
+		return ChaosRule{}, false
+	}
+	name := strings.ToLower(domain)
+	for {
+		if r, ok := c.rules[name]; ok {
+			return r, rand.IntN(100) < r.Percent
+		}
+		_, parent, found := strings.Cut(name, ".")
+		if !found {
+			return ChaosRule{}, false
+		}
+		name = parent
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChaosRoll(t *testing.T) {
+	c := NewChaos()
+	c.Set(ChaosRule{Domain: "flaky.local", Fault: "servfail", Percent: 100})
+	c.Set(ChaosRule{Domain: "never.local", Fault: "nxdomain", Percent: 0})
+
+	rule, hit := c.Roll("FLAKY.local")
+	if !hit || rule.Fault != "servfail" {
+		t.Errorf("Roll(flaky.local) = %+v, %v; want servfail hit", rule, hit)
+	}
+
+	// Subdomains inherit the parent's rule
+	if _, hit := c.Roll("api.flaky.local"); !hit {
+		t.Error("expected subdomain to match parent rule")
+	}
+
+	if _, hit := c.Roll("never.local"); hit {
+		t.Error("0% rule should never fire")
+	}
+	if _, hit := c.Roll("other.local"); hit {
+		t.Error("unrelated domain should not match")
+	}
+
+	if !c.Delete("flaky.local.") {
+		t.Error("Delete should find rule with trailing dot")
+	}
+	if _, hit := c.Roll("flaky.local"); hit {
+		t.Error("deleted rule still fires")
+	}
+}
+
+func TestValidateChaosRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    ChaosRule
+		wantErr bool
+	}{
+		{"servfail", ChaosRule{Domain: "a.local", Fault: "servfail", Percent: 50}, false},
+		{"delay only", ChaosRule{Domain: "a.local", DelayMS: 200, Percent: 100}, false},
+		{"no domain", ChaosRule{Fault: "servfail", Percent: 50}, true},
+		{"bad fault", ChaosRule{Domain: "a.local", Fault: "refused", Percent: 50}, true},
+		{"bad percent", ChaosRule{Domain: "a.local", Fault: "nxdomain", Percent: 150}, true},
+		{"no effect", ChaosRule{Domain: "a.local", Percent: 50}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateChaosRule(&tt.rule)
+			if tt.wantErr != (err != "") {
+				t.Errorf("validateChaosRule = %q, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildNXDomain(t *testing.T) {
+	query := buildTestQuery("gone.local", 1, 1)
+	resp := buildNXDomain(query, len(query))
+	if resp[3]&0x0F != 3 {
+		t.Errorf("RCODE = %d, want 3", resp[3]&0x0F)
+	}
+	if resp[2]&0x04 == 0 {
+		t.Error("AA bit not set")
+	}
+}
+
+func TestWebChaos(t *testing.T) {
+	ws, _ := testWebServer(t)
+
+	req := httptest.NewRequest("GET", "/api/chaos", nil)
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Fatalf("disabled: status = %d, want 404", w.Code)
+	}
+
+	ws.chaos = NewChaos()
+	body := `{"domain":"flaky.local","fault":"servfail","percent":25}`
+	req = httptest.NewRequest("PUT", "/api/chaos", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("set: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if len(ws.chaos.List()) != 1 {
+		t.Fatalf("expected 1 rule, got %d", len(ws.chaos.List()))
+	}
+
+	req = httptest.NewRequest("DELETE", "/api/chaos/flaky.local", nil)
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	if w.Code != 204 {
+		t.Fatalf("delete: status = %d, want 204", w.Code)
+	}
+}
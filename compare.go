@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// CompareResult is one source's answer to the same question.
+type CompareResult struct {
+	Source    string   `json:"source"`
+	RCode     string   `json:"rcode,omitempty"`
+	Answers   []string `json:"answers"`
+	LatencyMS float64  `json:"latency_ms"`
+	Error     string   `json:"error,omitempty"`
+	Differs   bool     `json:"differs"`
+}
+
+type compareSource struct {
+	Name     string
+	Exchange func(query []byte) ([]byte, error)
+}
+
+// compareQuery asks every source the same question in parallel and flags the
+// results whose RCODE or answer set differs from the first source that
+// answered. TTLs are ignored since they differ between caches by design.
+func compareQuery(name string, qtype uint16, sources []compareSource) []CompareResult {
+	results := make([]CompareResult, len(sources))
+	var wg sync.WaitGroup
+	for i, src := range sources {
+		wg.Go(func() {
+			res := CompareResult{Source: src.Name, Answers: []string{}}
+			query := buildQuery(name, qtype)
+			start := time.Now()
+			resp, err := src.Exchange(query)
+			res.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+			if err == nil {
+				var msg *Message
+				if msg, err = parseMessage(resp); err == nil {
+					res.RCode = rcodeString(msg.RCode)
+					for _, rr := range msg.Answers {
+						res.Answers = append(res.Answers, fmt.Sprintf("%s %s %s", strings.ToLower(rr.Name), typeString(rr.Type), rr.Data))
+					}
+					slices.Sort(res.Answers)
+				}
+			}
+			if err != nil {
+				res.Error = err.Error()
+			}
+			results[i] = res
+		})
+	}
+	wg.Wait()
+
+	ref := -1
+	for i, r := range results {
+		if r.Error == "" {
+			ref = i
+			break
+		}
+	}
+	for i := range results {
+		r := &results[i]
+		if ref < 0 || i == ref {
+			continue
+		}
+		r.Differs = r.Error != "" || r.RCode != results[ref].RCode || !slices.Equal(r.Answers, results[ref].Answers)
+	}
+	return results
+}
+
+// compareSources returns the local pipeline followed by every upstream.
+func (s *DNSServer) compareSources() []compareSource {
+	sources := []compareSource{{
+		Name: "local",
+		Exchange: func(query []byte) ([]byte, error) {
+			ctx := withRequestID(context.Background(), newRequestID())
+			if resp, _ := s.resolve(ctx, query, "", nil); resp != nil {
+				return resp, nil
+			}
+			return nil, errors.New("query dropped")
+		},
+	}}
+	for _, upstream := range s.upstreams.Addrs() {
+		sources = append(sources, compareSource{
+			Name:     upstream,
+			Exchange: func(query []byte) ([]byte, error) { return s.forwardTo(query, upstream) },
+		})
+	}
+	return sources
+}
+
+func handleCompare(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	server := fs.String("server", "127.0.0.1:53", "Address of the running regieleki server (empty to skip)")
+	var upstreams listFlag
+	fs.Var(&upstreams, "upstream", "Upstream to compare (repeatable; default from resolv.conf)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: regieleki compare [flags] <name> [type]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	qtype := uint16(1)
+	if fs.NArg() == 2 {
+		t, ok := parseType(fs.Arg(1))
+		if !ok {
+			fmt.Fprintf(os.Stderr, "error: unknown type %q\n", fs.Arg(1))
+			os.Exit(2)
+		}
+		qtype = t
+	}
+	for i, u := range upstreams {
+		u, err := normalizeUpstream(u)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(2)
+		}
+		upstreams[i] = u
+	}
+	if len(upstreams) == 0 {
+		upstreams = parseResolvConf()
+	}
+
+	dns := &DNSServer{upstreams: NewUpstreams(upstreams)}
+	var sources []compareSource
+	if *server != "" {
+		sources = append(sources, compareSource{
+			Name:     "server " + *server,
+			Exchange: func(query []byte) ([]byte, error) { return dns.forwardTo(query, *server) },
+		})
+	}
+	for _, upstream := range upstreams {
+		sources = append(sources, compareSource{
+			Name:     upstream,
+			Exchange: func(query []byte) ([]byte, error) { return dns.forwardTo(query, upstream) },
+		})
+	}
+
+	results := compareQuery(fs.Arg(0), qtype, sources)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tRCODE\tLATENCY\tDIFF\tANSWERS")
+	differs := false
+	for _, r := range results {
+		status := r.RCode
+		if r.Error != "" {
+			status = "error: " + r.Error
+		}
+		mark := ""
+		if r.Differs {
+			mark = "*"
+			differs = true
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.1fms\t%s\t%s\n", r.Source, status, r.LatencyMS, mark, strings.Join(r.Answers, ", "))
+	}
+	tw.Flush()
+	if differs {
+		os.Exit(1)
+	}
+}
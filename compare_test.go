@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompareQuery(t *testing.T) {
+	good := startFakeUpstream(t, `
+example.com A answer 93.184.216.34
+example.com A answer 93.184.216.35
+`)
+	// Same answers in a different order must not count as a difference
+	reordered := startFakeUpstream(t, `
+example.com A answer 93.184.216.35
+example.com A answer 93.184.216.34
+`)
+	bad := startFakeUpstream(t, `example.com A servfail`)
+
+	dns := &DNSServer{}
+	var sources []compareSource
+	for _, f := range []*FakeUpstream{good, reordered, bad} {
+		sources = append(sources, compareSource{
+			Name:     f.Addr(),
+			Exchange: func(q []byte) ([]byte, error) { return dns.forwardTo(q, f.Addr()) },
+		})
+	}
+
+	results := compareQuery("example.com", 1, sources)
+	if len(results) != 3 {
+		t.Fatalf("results = %+v", results)
+	}
+	if results[0].RCode != "NOERROR" || len(results[0].Answers) != 2 || results[0].Differs {
+		t.Errorf("reference = %+v", results[0])
+	}
+	if results[1].Differs {
+		t.Errorf("reordered answers flagged as different: %+v", results[1])
+	}
+	if results[2].RCode != "SERVFAIL" || !results[2].Differs {
+		t.Errorf("servfail = %+v", results[2])
+	}
+}
+
+func TestWebCompare(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Record{Domain: "app.test", Type: "A", Value: "10.0.0.1"})
+	fake := startFakeUpstream(t, `app.test A answer 10.0.0.2`)
+
+	ws := NewWebServer(store, nil)
+	ws.dns = NewDNSServer(store, []string{fake.Addr()})
+
+	req := httptest.NewRequest("GET", "/api/compare?name=app.test&type=A", nil)
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	var results []CompareResult
+	json.NewDecoder(w.Body).Decode(&results)
+	if len(results) != 2 {
+		t.Fatalf("results = %+v", results)
+	}
+	if results[0].Source != "local" || len(results[0].Answers) != 1 || results[0].Answers[0] != "app.test A 10.0.0.1" {
+		t.Errorf("local = %+v", results[0])
+	}
+	if !results[1].Differs {
+		t.Errorf("upstream should differ: %+v", results[1])
+	}
+
+	req = httptest.NewRequest("GET", "/api/compare?name=app.test&type=BOGUS", nil)
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Errorf("bad type status = %d", w.Code)
+	}
+}
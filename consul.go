@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	defaultConsulDomain   = "consul"
+	defaultConsulSchedule = "@every 30s"
+	consulTimeout         = 10 * time.Second
+)
+
+// ConsulSync publishes the healthy instances of Consul services as
+// read-only records, read from Consul's HTTP API, so clients that only do
+// plain DNS find them under the names Consul's own DNS interface would use:
+// web.service.consul, web.service.dc1.consul and, for an instance tagged
+// with one of Tags, primary.web.service.consul.
+type ConsulSync struct {
+	URL         string
+	Token       string   // sent as X-Consul-Token, if set
+	Datacenters []string // empty syncs the agent's own datacenter
+	Tags        []string // if set, only instances with one of these tags
+	Domain      string
+	store       *Store
+	client      *http.Client
+}
+
+func NewConsulSync(store *Store, rawURL, domain string, datacenters, tags []string) *ConsulSync {
+	if domain == "" {
+		domain = defaultConsulDomain
+	}
+	return &ConsulSync{
+		URL:         strings.TrimRight(rawURL, "/"),
+		Datacenters: datacenters,
+		Tags:        tags,
+		Domain:      strings.ToLower(strings.Trim(domain, ".")),
+		store:       store,
+		client:      &http.Client{Timeout: consulTimeout},
+	}
+}
+
+// get decodes the JSON reply to a GET of path in datacenter dc.
+func (c *ConsulSync) get(ctx context.Context, path, dc string, query url.Values, out any) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	if dc != "" {
+		query.Set("dc", dc)
+	}
+	u := c.URL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("consul %s: %s: %s", path, res.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// consulInstance is the part of a /v1/health/service entry we use.
+type consulInstance struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Service string
+		Address string // empty means the node's address
+		Tags    []string
+	}
+}
+
+// Run replaces the published instances with the current healthy ones. If
+// any datacenter can't be read, the previous set is kept.
+func (c *ConsulSync) Run(ctx context.Context) error {
+	dcs := c.Datacenters
+	if len(dcs) == 0 {
+		dcs = []string{""}
+	}
+	var records []Record
+	instances := 0
+	for i, dc := range dcs {
+		var services map[string][]string
+		if err := c.get(ctx, "/v1/catalog/services", dc, nil, &services); err != nil {
+			return err
+		}
+		for name := range services {
+			var entries []consulInstance
+			query := url.Values{"passing": {"1"}}
+			if err := c.get(ctx, "/v1/health/service/"+url.PathEscape(name), dc, query, &entries); err != nil {
+				return err
+			}
+			instances += len(entries)
+			// The first datacenter is also served under the short names,
+			// as Consul does for its own
+			records = append(records, consulRecords(entries, c.Tags, dc, c.Domain, i == 0)...)
+		}
+	}
+	c.store.SetSource("consul", records)
+	slog.InfoContext(ctx, "consul sync finished", "datacenters", len(dcs), "instances", instances, "records", len(records))
+	return nil
+}
+
+// consulRecords names each instance's address after its service, and
+// after every tag in tags it carries. An instance is left out if tags is
+// set and it has none of them, or if its address is not an IP.
+func consulRecords(entries []consulInstance, tags []string, dc, domain string, short bool) []Record {
+	var suffixes []string
+	if short || dc == "" {
+		suffixes = append(suffixes, ".service."+domain)
+	}
+	if dc != "" {
+		suffixes = append(suffixes, ".service."+strings.ToLower(dc)+"."+domain)
+	}
+	var records []Record
+	for _, e := range entries {
+		addr, err := netip.ParseAddr(e.Service.Address)
+		if e.Service.Address == "" {
+			addr, err = netip.ParseAddr(e.Node.Address)
+		}
+		if err != nil {
+			continue
+		}
+		addr = addr.Unmap()
+		service := strings.ToLower(e.Service.Service)
+		var labels []string
+		if len(tags) == 0 {
+			labels = append(labels, service)
+		}
+		for _, tag := range tags {
+			if slices.Contains(e.Service.Tags, tag) {
+				labels = append(labels, service, strings.ToLower(tag)+"."+service)
+			}
+		}
+		rtype := "A"
+		if addr.Is6() {
+			rtype = "AAAA"
+		}
+		for _, label := range labels {
+			for _, suffix := range suffixes {
+				records = append(records, Record{Domain: label + suffix, Type: rtype, Value: addr.String()})
+			}
+		}
+	}
+	return records
+}
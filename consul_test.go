@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestConsulSync(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Consul-Token") != "secret" {
+			http.Error(w, "ACL not found", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/catalog/services":
+			w.Write([]byte(`{"consul": [], "web": ["primary", "v2"]}`))
+		case "/v1/health/service/web":
+			if r.URL.Query().Get("passing") == "" || r.URL.Query().Get("dc") != "dc1" {
+				t.Errorf("health query %s", r.URL.RawQuery)
+			}
+			w.Write([]byte(`[
+				{"Node": {"Address": "10.0.0.5"}, "Service": {"Service": "web", "Address": "", "Tags": ["primary"]}},
+				{"Node": {"Address": "10.0.0.6"}, "Service": {"Service": "web", "Address": "fd00::6", "Tags": ["v2"]}},
+				{"Node": {"Address": "10.0.0.7"}, "Service": {"Service": "web", "Address": "web.example.com"}}
+			]`))
+		case "/v1/health/service/consul":
+			w.Write([]byte(`[{"Node": {"Address": "10.0.0.1"}, "Service": {"Service": "consul"}}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync := NewConsulSync(store, srv.URL, "", []string{"dc1"}, nil)
+	sync.Token = "secret"
+	if err := sync.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"web.service.consul", "web.service.dc1.consul"} {
+		recs, ok := store.Resolve(name, 1)
+		if !ok || len(recs) != 1 || recs[0].Value != "10.0.0.5" || recs[0].Source != "consul" {
+			t.Errorf("%s A: %+v", name, recs)
+		}
+		if recs, _ := store.Resolve(name, 28); len(recs) != 1 || recs[0].Value != "fd00::6" {
+			t.Errorf("%s AAAA: %+v", name, recs)
+		}
+	}
+	if recs, _ := store.Resolve("consul.service.consul", 1); len(recs) != 1 {
+		t.Errorf("consul.service.consul: %+v", recs)
+	}
+
+	// A failed sync keeps the previous set
+	sync.Token = "wrong"
+	if err := sync.Run(context.Background()); err == nil {
+		t.Fatal("sync with a bad token succeeded")
+	}
+	if recs, _ := store.Resolve("web.service.consul", 1); len(recs) != 1 {
+		t.Errorf("after failed sync: %+v", recs)
+	}
+}
+
+func TestConsulRecordsTags(t *testing.T) {
+	var entries []consulInstance
+	for _, tc := range []struct {
+		addr string
+		tags []string
+	}{{"10.0.0.5", []string{"primary"}}, {"10.0.0.6", []string{"replica"}}, {"10.0.0.7", nil}} {
+		var e consulInstance
+		e.Service.Service = "DB"
+		e.Service.Address = tc.addr
+		e.Service.Tags = tc.tags
+		entries = append(entries, e)
+	}
+	got := map[string][]string{}
+	for _, r := range consulRecords(entries, []string{"primary", "replica"}, "dc2", "consul", false) {
+		got[r.Domain] = append(got[r.Domain], r.Value)
+	}
+	want := map[string][]string{
+		"db.service.dc2.consul":         {"10.0.0.5", "10.0.0.6"},
+		"primary.db.service.dc2.consul": {"10.0.0.5"},
+		"replica.db.service.dc2.consul": {"10.0.0.6"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("records = %v, want %v", got, want)
+	}
+	for name, values := range want {
+		if len(got[name]) != len(values) || got[name][0] != values[0] || got[name][len(values)-1] != values[len(values)-1] {
+			t.Errorf("%s = %v, want %v", name, got[name], values)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// ddnsPath is where DynDNS2 clients send updates. Routers and other
+// devices with a built-in DDNS client only let you pick the server, so the
+// path and replies follow the protocol rather than the rest of the API.
+const ddnsPath = "/nic/update"
+
+// DDNSHosts maps the lowercase host names DynDNS clients may update to the
+// SHA-256 hash of the token that may update each.
+type DDNSHosts map[string][sha256.Size]byte
+
+// LoadDDNSHosts reads one "hostname token" pair per line, the token either
+// in plaintext or as "sha256:" and the hex hash of it, as in the token
+// file. Blank lines and # comments are skipped.
+func LoadDDNSHosts(path string) (DDNSHosts, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hosts := DDNSHosts{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"hostname token\"", path, i+1)
+		}
+		host, err := toASCII(strings.TrimSuffix(fields[0], "."))
+		if err != nil || host == "" {
+			return nil, fmt.Errorf("%s:%d: invalid hostname %q", path, i+1, fields[0])
+		}
+		hash := hashToken(fields[1])
+		if hexHash, ok := strings.CutPrefix(fields[1], tokenHashPrefix); ok {
+			h, err := hex.DecodeString(hexHash)
+			if err != nil || len(h) != sha256.Size {
+				return nil, fmt.Errorf("%s:%d: invalid hash", path, i+1)
+			}
+			copy(hash[:], h)
+		}
+		hosts[strings.ToLower(host)] = hash
+	}
+	return hosts, nil
+}
+
+func (h DDNSHosts) known(host string) bool {
+	_, ok := h[host]
+	return ok
+}
+
+// allowed reports whether token may update host.
+func (h DDNSHosts) allowed(host, token string) bool {
+	want := h[host]
+	got := hashToken(token)
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+}
+
+// handleDynDNS applies a DynDNS2 update: every host in the comma-separated
+// hostname parameter gets an A and/or AAAA record set holding the addresses
+// in myip, or the client's address if myip is missing. The token is the
+// basic auth password; the user name is ignored, since clients insist on
+// sending one. Replies are plain text, one line per host, as clients
+// expect.
+func (s *WebServer) handleDynDNS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, token, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="regieleki"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, "badauth")
+		return
+	}
+
+	addrs, err := ddnsAddrs(r)
+	if err != nil {
+		fmt.Fprintln(w, "911")
+		return
+	}
+	for _, host := range strings.Split(r.URL.Query().Get("hostname"), ",") {
+		host, err := toASCII(strings.TrimSuffix(strings.TrimSpace(host), "."))
+		host = strings.ToLower(host)
+		switch {
+		case err != nil || !strings.Contains(host, "."):
+			fmt.Fprintln(w, "notfqdn")
+			continue
+		case !s.ddns.known(host):
+			fmt.Fprintln(w, "nohost")
+			continue
+		case !s.ddns.allowed(host, token):
+			fmt.Fprintln(w, "badauth")
+			continue
+		}
+		changed := false
+		for _, addr := range addrs {
+			rtype := "A"
+			if addr.Is6() {
+				rtype = "AAAA"
+			}
+			_, changes, err := s.store.SetRRSet(host, rtype, "", []Record{{Value: addr.String()}})
+			if err != nil {
+				slog.ErrorContext(r.Context(), "dyndns update failed", "host", host, "error", err)
+				fmt.Fprintln(w, "911")
+				return
+			}
+			changed = changed || len(changes) > 0
+		}
+		reply := "nochg"
+		if changed {
+			reply = "good"
+			slog.InfoContext(r.Context(), "dyndns update", "host", host, "addresses", addrs)
+		}
+		fmt.Fprintln(w, reply, ddnsJoin(addrs))
+	}
+}
+
+// ddnsAddrs returns the addresses in the myip parameter, at most one of
+// each family, or the client's own address.
+func ddnsAddrs(r *http.Request) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	myip := r.URL.Query().Get("myip")
+	if myip == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		myip = host
+	}
+	var have4, have6 bool
+	for _, s := range strings.Split(myip, ",") {
+		addr, err := netip.ParseAddr(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		if addr.Is4() && !have4 || addr.Is6() && !have6 {
+			addrs = append(addrs, addr)
+			have4, have6 = have4 || addr.Is4(), have6 || addr.Is6()
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no address")
+	}
+	return addrs, nil
+}
+
+func ddnsJoin(addrs []netip.Addr) string {
+	s := make([]string, len(addrs))
+	for i, a := range addrs {
+		s[i] = a.String()
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadDDNSHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ddns")
+	os.WriteFile(path, []byte("# routers\nhome.example.com s3cret\nNAS.example.com. sha256:"+
+		strings.Repeat("ab", 32)+"\n"), 0o600)
+	hosts, err := LoadDDNSHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hosts.allowed("home.example.com", "s3cret") || hosts.allowed("home.example.com", "guess") {
+		t.Error("plaintext token not checked")
+	}
+	if !hosts.known("nas.example.com") || hosts.allowed("nas.example.com", "") {
+		t.Errorf("hashed entry: %v", hosts)
+	}
+
+	os.WriteFile(path, []byte("home.example.com\n"), 0o600)
+	if _, err := LoadDDNSHosts(path); err == nil || !strings.Contains(err.Error(), ":1:") {
+		t.Errorf("err = %v, want a line error", err)
+	}
+}
+
+func TestWebDynDNS(t *testing.T) {
+	ws, store := testWebServer(t)
+	ws.ddns = DDNSHosts{"home.example.com": hashToken("s3cret"), "cam.example.com": hashToken("other")}
+	update := func(query, token string) string {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/nic/update?"+query, nil)
+		req.RemoteAddr = "198.51.100.7:40000"
+		if token != "" {
+			req.SetBasicAuth("router", token)
+		}
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, req)
+		return strings.TrimSpace(w.Body.String())
+	}
+
+	if got := update("hostname=home.example.com&myip=203.0.113.9", "s3cret"); got != "good 203.0.113.9" {
+		t.Errorf("first update = %q", got)
+	}
+	if got := update("hostname=home.example.com&myip=203.0.113.9", "s3cret"); got != "nochg 203.0.113.9" {
+		t.Errorf("repeated update = %q", got)
+	}
+	recs, ok := store.Resolve("home.example.com", 1)
+	if !ok || len(recs) != 1 || recs[0].Value != "203.0.113.9" {
+		t.Fatalf("records = %+v", recs)
+	}
+
+	// Without myip the client's address is used, and both families at once
+	if got := update("hostname=home.example.com", "s3cret"); got != "good 198.51.100.7" {
+		t.Errorf("update from client address = %q", got)
+	}
+	if got := update("hostname=home.example.com&myip=203.0.113.9,2001:db8::9", "s3cret"); got != "good 203.0.113.9,2001:db8::9" {
+		t.Errorf("dual-stack update = %q", got)
+	}
+	if recs, _ := store.Resolve("home.example.com", 28); len(recs) != 1 || recs[0].Value != "2001:db8::9" {
+		t.Errorf("AAAA records = %+v", recs)
+	}
+
+	for _, tt := range []struct{ query, token, want string }{
+		{"hostname=home.example.com", "", "badauth"},
+		{"hostname=cam.example.com&myip=203.0.113.1", "s3cret", "badauth"},
+		{"hostname=other.example.com&myip=203.0.113.1", "s3cret", "nohost"},
+		{"hostname=home&myip=203.0.113.1", "s3cret", "notfqdn"},
+		{"hostname=home.example.com&myip=bogus", "s3cret", "911"},
+	} {
+		if got := update(tt.query, tt.token); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+	if recs, _ := store.Resolve("cam.example.com", 1); len(recs) != 0 {
+		t.Errorf("unauthorized update applied: %+v", recs)
+	}
+}
@@ -1,135 +1,677 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
 	"encoding/binary"
+	"errors"
+	"io"
 	"log/slog"
 	"net"
+	"net/netip"
 	"os"
+	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
 	udpBufSize     = 4096
 	forwardTimeout = 2 * time.Second
+	tcpIdleTimeout = 10 * time.Second
 )
 
-const maxConcurrentQueries = 1000
+const (
+	maxConcurrentQueries = 1000
+	maxQueuedQueries     = 1000
+)
+
+// Bounds of the pause after an unexpected UDP read error.
+const (
+	readBackoffMin = 5 * time.Millisecond
+	readBackoffMax = time.Second
+)
 
 type DNSServer struct {
-	conn      *net.UDPConn
+	conn      *net.UDPConn // the first listener to come up
+	mu        sync.Mutex
+	conns     []*net.UDPConn
+	tcp       []net.Listener
+	readyOnce sync.Once
 	store     *Store
-	upstreams []string
+	upstreams *Upstreams
 	pool      sync.Pool
 	ready     chan struct{}
-	sem       chan struct{}
+	queue     chan udpQuery
+	workers   int
+	startPool sync.Once
+	rotation  atomic.Uint32
+	chaos     *Chaos
+	cache     *Cache
+	dot       sync.Map // tls:// upstream -> *dotUpstream
+	pools     sync.Map // "udp addr" or "tcp addr" -> *upstreamPool
+	flights   flights
+	standby   *Standby
+	latency   *Latency
+	stats     *Stats
+	limiter   *RateLimiter
+	rrl       *RRL
+	blocklist *Blocklist
+	updater   *Updater
+	transfers *Transfers
+	secondary *Secondary
+	metrics   *Metrics
+	querylog  *QueryLog
+	answers   *AnswerCache
+	// anonymize truncates client addresses before they reach the query
+	// log, statistics and log lines.
+	anonymize bool
+	// authoritativeOnly disables recursion: names outside our records and
+	// zones are refused instead of forwarded, and RA is never set.
+	authoritativeOnly bool
+	zones             Zones
+	peers             *Peers // other instances asked for names in zones; nil disables
+	// maxUDPResponse caps UDP answers, which may go to a spoofed source; larger
+	// ones are sent truncated so the client retries over TCP. 0 is no cap.
+	maxUDPResponse int
+	// onListen, if set, is called once each listener is bound.
+	onListen func()
+	// activated holds sockets from systemd to use instead of binding.
+	activated *Activated
+	// udpSockets is how many UDP sockets each listener opens on its
+	// address with SO_REUSEPORT, each with its own read loop; 0 means
+	// GOMAXPROCS.
+	udpSockets int
 }
 
 func NewDNSServer(store *Store, upstreams []string) *DNSServer {
-	return &DNSServer{
+	s := &DNSServer{
 		store:     store,
-		upstreams: upstreams,
-		pool: sync.Pool{
-			New: func() any {
-				b := make([]byte, udpBufSize)
-				return &b
-			},
+		upstreams: NewUpstreams(upstreams),
+		ready:     make(chan struct{}),
+		latency:   NewLatency(),
+		stats:     NewStats(),
+	}
+	s.applyProfile(profiles["default"])
+	return s
+}
+
+// applyProfile sizes the receive buffers and concurrency limit. It must be
+// called before ListenAndServe.
+func (s *DNSServer) applyProfile(p Profile) {
+	bufSize := p.UDPBufSize
+	s.pool = sync.Pool{
+		New: func() any {
+			b := make([]byte, bufSize)
+			return &b
 		},
-		ready: make(chan struct{}),
-		sem:   make(chan struct{}, maxConcurrentQueries),
 	}
+	s.queue = make(chan udpQuery, p.QueueSize)
+	s.workers = p.MaxQueries
+	s.udpSockets = p.UDPSockets
 }
 
 func (s *DNSServer) ListenAndServe(addr string) error {
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	return s.ListenAndServeView(addr, "")
+}
+
+// ListenAndServeView serves queries arriving on addr from the named view, so
+// each interface can answer the same names with its own addresses. It may be
+// called once per listener.
+func (s *DNSServer) ListenAndServeView(addr, view string) error {
+	conns, ln, err := s.listen(addr)
 	if err != nil {
 		return err
 	}
-	conn, err := net.ListenUDP("udp", udpAddr)
+	if s.onListen != nil {
+		s.onListen()
+	}
+	return s.serve(conns, ln, view)
+}
+
+// listen binds UDP and TCP on addr, or takes the sockets systemd bound there,
+// and registers them to be closed by Close. Unless the UDP socket came from
+// systemd, it opens udpSockets of them sharing the address.
+func (s *DNSServer) listen(addr string) ([]*net.UDPConn, net.Listener, error) {
+	var conns []*net.UDPConn
+	if conn, ok := s.activated.UDP(addr); ok {
+		conns = append(conns, conn)
+	} else {
+		var err error
+		if conns, err = listenUDPGroup(addr, s.udpSockets); err != nil {
+			return nil, nil, err
+		}
+	}
+	// TCP shares the UDP port so clients can retry truncated answers
+	bound := conns[0].LocalAddr().String()
+	ln, ok := s.activated.Listener(bound)
+	if !ok {
+		var err error
+		if ln, err = net.Listen("tcp", bound); err != nil {
+			closeAll(conns)
+			return nil, nil, err
+		}
+	}
+	s.mu.Lock()
+	s.conns = append(s.conns, conns...)
+	s.tcp = append(s.tcp, ln)
+	s.mu.Unlock()
+	return conns, ln, nil
+}
+
+// listenUDPGroup binds n UDP sockets to addr with SO_REUSEPORT, so the
+// kernel spreads datagrams across them by source and one read loop per
+// socket keeps up where a single one couldn't. The first socket fixes the
+// port if addr leaves it to the system. A single socket is bound without
+// SO_REUSEPORT, so another process can't share its port, and so is every
+// listener on platforms without SO_REUSEPORT.
+func listenUDPGroup(addr string, n int) ([]*net.UDPConn, error) {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	if !canReusePort {
+		n = 1
+	}
+	lc := net.ListenConfig{}
+	if n > 1 {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = setReusePort(fd)
+			})
+			return cmp.Or(err, serr)
+		}
+	}
+	var conns []*net.UDPConn
+	for range n {
+		pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			closeAll(conns)
+			return nil, err
+		}
+		conns = append(conns, pc.(*net.UDPConn))
+		addr = pc.LocalAddr().String()
+	}
+	return conns, nil
+}
+
+func closeAll(conns []*net.UDPConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// unlisten closes the sockets of a listener from listen; serve then returns.
+func (s *DNSServer) unlisten(conns []*net.UDPConn, ln net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns = slices.DeleteFunc(s.conns, func(c *net.UDPConn) bool { return slices.Contains(conns, c) })
+	s.tcp = slices.DeleteFunc(s.tcp, func(l net.Listener) bool { return l == ln })
+	closeAll(conns)
+	ln.Close()
+}
+
+// serve answers queries from view on conns and ln until they are closed,
+// with one read loop per UDP socket.
+func (s *DNSServer) serve(conns []*net.UDPConn, ln net.Listener, view string) error {
+	go s.serveTCP(ln, view)
+	s.startPool.Do(func() {
+		for range s.workers {
+			go s.worker()
+		}
+	})
+	s.readyOnce.Do(func() {
+		s.conn = conns[0]
+		close(s.ready)
+	})
+	slog.Info("dns server listening", "addr", conns[0].LocalAddr().String(), "view", view, "udp_sockets", len(conns), "upstreams", s.upstreams.Addrs())
+
+	errs := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func() { errs <- s.readUDP(conn, view) }()
+	}
+	var err error
+	for range conns {
+		err = cmp.Or(err, <-errs)
+	}
+	return err
+}
+
+// readUDP reads queries from conn until it is closed, as many per system
+// call as have arrived where the platform allows.
+func (s *DNSServer) readUDP(conn *net.UDPConn, view string) error {
+	b, err := newUDPBatch(conn, &s.pool)
 	if err != nil {
 		return err
 	}
-	s.conn = conn
-	close(s.ready)
-	slog.Info("dns server listening", "addr", addr, "upstreams", s.upstreams)
+	defer b.close()
+	var (
+		bufs  = make([]*[]byte, udpBatchSize)
+		sizes = make([]int, udpBatchSize)
+		addrs = make([]*net.UDPAddr, udpBatchSize)
+	)
+	for i := range bufs {
+		bufs[i] = s.pool.Get().(*[]byte)
+	}
+	defer func() {
+		for _, buf := range bufs {
+			s.pool.Put(buf)
+		}
+	}()
 
+	var backoff time.Duration
 	for {
-		bufPtr := s.pool.Get().(*[]byte)
-		n, remoteAddr, err := conn.ReadFromUDP(*bufPtr)
+		count, err := b.read(bufs, sizes, addrs)
 		if err != nil {
-			s.pool.Put(bufPtr)
-			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			if s.metrics != nil {
+				s.metrics.readErrors.Add(1)
+			}
+			// One bad packet or ICMP bounce must not stop the listener;
+			// anything unexpected is retried with a growing pause so a
+			// persistent failure doesn't spin
+			if transientReadError(err) {
+				slog.Debug("dns read error", "addr", conn.LocalAddr().String(), "error", err)
 				continue
 			}
-			return err
+			backoff = min(max(2*backoff, readBackoffMin), readBackoffMax)
+			slog.Warn("dns read failed, retrying", "addr", conn.LocalAddr().String(), "error", err, "retry_in", backoff)
+			time.Sleep(backoff)
+			continue
 		}
+		backoff = 0
+		for i := range count {
+			s.enqueue(udpQuery{b, view, bufs[i], sizes[i], addrs[i]})
+			bufs[i] = s.pool.Get().(*[]byte)
+		}
+	}
+}
 
-		query := make([]byte, n)
-		copy(query, (*bufPtr)[:n])
-		s.pool.Put(bufPtr)
+// enqueue hands q to the workers, taking its read buffer, which the worker
+// returns to the pool.
+func (s *DNSServer) enqueue(q udpQuery) {
+	// Over-limit clients are turned away before they can take a slot
+	if s.limiter != nil && !s.limiter.Allow(q.addr.AddrPort().Addr()) {
+		if s.metrics != nil {
+			s.metrics.droppedRateLimit.Add(1)
+		}
+		if s.limiter.truncate {
+			if resp := buildTruncated((*q.buf)[:q.n]); resp != nil {
+				q.batch.send(udpReply{resp: resp, addr: q.addr})
+			}
+		}
+		s.pool.Put(q.buf)
+		return
+	}
+
+	// A full queue means the workers are behind by more than they can
+	// catch up on before clients retry, so the query is dropped
+	select {
+	case s.queue <- q:
+	default:
+		s.pool.Put(q.buf)
+		slog.Warn("dropping query, at capacity", "remote", s.logRemote(q.addr))
+		if s.metrics != nil {
+			s.metrics.droppedCapacity.Add(1)
+		}
+	}
+}
+
+// udpQuery is a UDP query waiting in the queue for a worker.
+type udpQuery struct {
+	batch *udpBatch // the socket it came in on
+	view  string
+	buf   *[]byte // from s.pool, the query in its first n bytes
+	n     int
+	addr  *net.UDPAddr
+}
 
-		select {
-		case s.sem <- struct{}{}:
-			go func() {
-				defer func() { <-s.sem }()
-				s.handleQuery(query, remoteAddr)
-			}()
-		default:
-			slog.Warn("dropping query, at capacity", "remote", remoteAddr)
+// udpReply is a response on its way to a client. out, when set, is the
+// pooled buffer it may have been built in, returned to the pool once the
+// response is sent.
+type udpReply struct {
+	resp []byte
+	addr *net.UDPAddr
+	out  *[]byte
+}
+
+// worker answers queued UDP queries. A fixed pool of them, started with the
+// first listener and kept for the life of the server, replaces a goroutine
+// per query, so overload fills the queue instead of the scheduler.
+func (s *DNSServer) worker() {
+	for q := range s.queue {
+		s.handleQuery(q.batch, q.view, (*q.buf)[:q.n], q.addr)
+		s.pool.Put(q.buf)
+	}
+}
+
+// transientReadError reports whether a UDP read error concerns a single
+// packet or a passing condition, so reading can go straight on: timeouts,
+// ICMP errors from earlier replies that some platforms surface on the next
+// read, oversized datagrams and short-lived buffer shortages.
+func transientReadError(err error) bool {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{
+		syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EHOSTUNREACH, syscall.ENETUNREACH,
+		syscall.EMSGSIZE, syscall.ENOBUFS, syscall.ENOMEM, syscall.EINTR, syscall.EAGAIN,
+	} {
+		if errors.Is(err, errno) {
+			return true
 		}
 	}
+	return false
 }
 
 func (s *DNSServer) Close() {
-	if s.conn != nil {
-		s.conn.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
 	}
+	for _, ln := range s.tcp {
+		ln.Close()
+	}
+	s.pools.Range(func(_, v any) bool {
+		v.(*upstreamPool).close()
+		return true
+	})
+	s.dot.Range(func(_, v any) bool {
+		v.(*dotUpstream).pool.close()
+		return true
+	})
 }
 
-func (s *DNSServer) handleQuery(buf []byte, addr *net.UDPAddr) {
+// serveTCP answers queries on TCP connections, which are not rate limited
+// since the handshake proves the client's address.
+func (s *DNSServer) serveTCP(ln net.Listener, view string) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			client := c.RemoteAddr().(*net.TCPAddr).AddrPort().Addr()
+			for {
+				c.SetDeadline(time.Now().Add(tcpIdleTimeout))
+				query, err := readTCPMessage(c)
+				if err != nil {
+					return
+				}
+				if s.transfers != nil && isAXFR(query) {
+					if s.standby != nil && !s.standby.Active() {
+						return
+					}
+					if err := s.transfers.Serve(c, query, client); err != nil {
+						return
+					}
+					continue
+				}
+				resp := s.answer(view, query, client, nil)
+				if resp == nil {
+					return
+				}
+				if err := writeTCPMessage(c, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (s *DNSServer) handleQuery(b *udpBatch, view string, buf []byte, addr *net.UDPAddr) {
+	// Answers from our own records are built into a pooled buffer, which
+	// is only safe because nothing keeps the response once it is sent; it
+	// goes back to the pool after that
+	out := s.pool.Get().(*[]byte)
+	resp := s.answer(view, buf, addr.AddrPort().Addr(), (*out)[:0])
+	if resp == nil {
+		s.pool.Put(out)
+		return
+	}
+	if s.rrl != nil {
+		switch s.rrl.Check(addr.AddrPort().Addr(), resp) {
+		case rrlDrop:
+			s.pool.Put(out)
+			return
+		case rrlSlip:
+			resp = buildTruncated(buf)
+		}
+	}
+	if s.maxUDPResponse > 0 && len(resp) > s.maxUDPResponse {
+		resp = buildTruncated(buf)
+	}
+	b.send(udpReply{resp, addr, out})
+}
+
+// answer resolves one query from a client, or returns nil if it should go
+// unanswered. A response from local records is appended to out when it is
+// not nil, which must stay unused until the response is sent.
+func (s *DNSServer) answer(view string, buf []byte, client netip.Addr, out []byte) []byte {
+	// A passive standby stays silent so clients fail over to the primary
+	if s.standby != nil && !s.standby.Active() {
+		return nil
+	}
+	if s.updater != nil && len(buf) >= 12 && buf[2]&0x80 == 0 && buf[2]>>3&0x0F == opcodeUpdate {
+		return s.updater.Handle(buf, client)
+	}
+	if s.secondary != nil && len(buf) >= 12 && buf[2]&0x80 == 0 && buf[2]>>3&0x0F == opcodeNotify {
+		return s.secondary.HandleNotify(buf, client)
+	}
+	start := time.Now()
+	ctx := withRequestID(context.Background(), newRequestID())
+	resp, o := s.resolve(ctx, buf, view, out)
+	if resp != nil && s.authoritativeOnly {
+		resp[3] &^= 0x80 // RA=0
+	}
+	if resp != nil && s.latency != nil {
+		s.latency.Record(o, time.Since(start))
+	}
+	if resp != nil && s.metrics != nil {
+		s.metrics.Query(buf, resp, o, time.Since(start))
+	}
+	if s.anonymize {
+		client = anonymizeAddr(client)
+	}
+	if resp != nil && s.stats != nil {
+		s.stats.Record(buf, client, o)
+	}
+	if resp != nil && s.querylog != nil {
+		s.querylog.Record(buf, resp, client, view, o, time.Since(start))
+	}
+	return resp
+}
+
+// resolve runs a raw query through the full pipeline (chaos rules, local
+// records in view, cache, upstreams) and returns the response to send, or nil
+// if the message should be dropped, along with how it was answered. Answers
+// from local records are appended to out, as in answer.
+func (s *DNSServer) resolve(ctx context.Context, buf []byte, view string, out []byte) ([]byte, outcome) {
 	n := len(buf)
 	if n < 12 {
-		return
+		return nil, 0
 	}
 
 	// Must be a query (QR bit = 0)
 	if buf[2]&0x80 != 0 {
-		return
+		return nil, 0
 	}
 
-	qdcount := binary.BigEndian.Uint16(buf[4:6])
-	if qdcount == 0 {
-		return
+	// Parse the question; the error responses below echo it when it parses
+	qname, offset := parseDNSName(buf, 12)
+	questionEnd := offset + 4
+	if binary.BigEndian.Uint16(buf[4:6]) == 0 || offset < 0 || questionEnd > n {
+		questionEnd = 12
+	}
+	if opcode := buf[2] >> 3 & 0x0F; opcode != 0 {
+		slog.DebugContext(ctx, "unsupported opcode", "opcode", opcode)
+		return buildError(buf[:n], questionEnd, rcodeNotImp), outcomeRejected
+	}
+	if questionEnd == 12 || binary.BigEndian.Uint16(buf[4:6]) != 1 {
+		return buildError(buf[:n], questionEnd, rcodeFormErr), outcomeRejected
+	}
+	qtype := binary.BigEndian.Uint16(buf[offset : offset+2])
+	if qclass := binary.BigEndian.Uint16(buf[offset+2 : questionEnd]); qclass != 1 {
+		slog.DebugContext(ctx, "unsupported class", "domain", qname, "class", qclass)
+		return buildError(buf[:n], questionEnd, rcodeRefused), outcomeRejected
 	}
 
-	// Parse first question
-	qname, offset := parseDNSName(buf, 12)
-	if offset < 0 || offset+4 > n {
-		return
+	tr := traceFrom(ctx)
+	if s.chaos != nil {
+		if rule, ok := s.chaos.Roll(qname); ok {
+			tr.step("chaos", rule.Fault, "rule %s, delay %dms", rule.Domain, rule.DelayMS)
+			if rule.DelayMS > 0 {
+				time.Sleep(time.Duration(rule.DelayMS) * time.Millisecond)
+			}
+			slog.DebugContext(ctx, "chaos rule applied", "domain", qname, "rule", rule.Domain, "fault", rule.Fault)
+			switch rule.Fault {
+			case "servfail":
+				return buildServFail(buf[:n], questionEnd), outcomeChaos
+			case "nxdomain":
+				return buildNXDomain(buf[:n], questionEnd), outcomeChaos
+			}
+		}
 	}
 
-	qtype := binary.BigEndian.Uint16(buf[offset : offset+2])
-	questionEnd := offset + 4
+	if s.transfers != nil {
+		if resp, ok := s.transfers.Apex(buf[:n], questionEnd, qname, qtype); ok {
+			tr.step("zone", "apex", "answered from the zone's SOA and NS")
+			return resp, outcomeLocal
+		}
+	}
+
+	// Hot names are answered from their compiled form; a trace needs the
+	// records themselves
+	key := answerKey{view, strings.ToLower(qname), qtype}
+	generation := s.store.Generation()
+	if s.answers != nil && tr == nil {
+		if a, ok := s.answers.Get(key, generation); ok {
+			return a.appendResponse(out, buf[:n], questionEnd, int(s.rotation.Add(1))), outcomeLocal
+		}
+	}
 
 	// Resolve against custom records
-	records, authoritative := s.store.Resolve(qname, qtype)
+	records, authoritative := s.store.ResolveView(qname, qtype, view)
 
+	if authoritative && s.answers != nil && tr == nil {
+		if a, ok := s.answers.Put(key, generation, buf[:n], records); ok {
+			return a.appendResponse(out, buf[:n], questionEnd, int(s.rotation.Add(1))), outcomeLocal
+		}
+	}
 	if authoritative {
-		resp := buildDNSResponse(buf[:n], questionEnd, records)
-		s.conn.WriteToUDP(resp, addr)
+		rotateAnswers(records, int(s.rotation.Add(1)))
+		if tr != nil {
+			tr.step("records", recordsResult(records), "%s", describeRecords(records, view))
+		}
 		if len(records) > 0 {
-			slog.Debug("resolved", "domain", qname, "type", qtype, "answers", len(records))
+			slog.DebugContext(ctx, "resolved", "domain", qname, "type", qtype, "answers", len(records))
 		}
-		return
+		return appendDNSResponse(out, buf[:n], questionEnd, records), outcomeLocal
+	}
+
+	if tr != nil {
+		tr.step("records", "miss", "no records for %s", qname)
+	}
+
+	// Peers may have the name; a query without RD is a peer asking us, so
+	// it is not passed on
+	if s.peers != nil && buf[2]&0x01 != 0 && s.peers.Covers(strings.ToLower(strings.TrimSuffix(qname, "."))) {
+		if resp := s.askPeers(ctx, buf[:n]); resp != nil {
+			echoQName(resp, buf[:n], questionEnd)
+			return resp, outcomePeer
+		}
+	}
+
+	if s.authoritativeOnly {
+		name := strings.ToLower(strings.TrimSuffix(qname, "."))
+		if slices.ContainsFunc(s.zones, func(zone string) bool { return inZone(name, zone) }) {
+			tr.step("zone", "nxdomain", "the name is in a served zone")
+			return buildNXDomain(buf[:n], questionEnd), outcomeLocal
+		}
+		tr.step("zone", "refused", "recursion is disabled")
+		slog.DebugContext(ctx, "refused, recursion disabled", "domain", qname, "type", qtype)
+		return buildError(buf[:n], questionEnd, rcodeRefused), outcomeRejected
+	}
+
+	// Our own records win over blocklists
+	if s.blocklist != nil && s.blocklist.Match(qname) {
+		slog.DebugContext(ctx, "blocked", "domain", qname, "type", qtype)
+		if tr != nil {
+			domain, list, _ := s.blocklist.Explain(qname)
+			tr.step("blocklist", "blocked", "%s is listed by %s", domain, list)
+		}
+		return s.blocklist.Response(buf[:n], questionEnd, qname, qtype), outcomeBlocked
 	}
 
-	// Forward to upstream
-	resp := s.forwardQuery(buf)
+	if s.blocklist != nil {
+		tr.step("blocklist", "pass", "not listed")
+	}
+
+	if s.cache != nil {
+		if resp, ok := s.cache.Get(buf[:n], questionEnd, qname, qtype); ok {
+			slog.DebugContext(ctx, "cache hit", "domain", qname, "type", qtype)
+			tr.step("cache", "hit", "")
+			return resp, outcomeCached
+		}
+		tr.step("cache", "miss", "")
+	}
+
+	// Forward to upstream, once for every client asking the same meanwhile
+	resp, shared := s.flights.do(cacheKey{strings.ToLower(qname), qtype}, func() []byte {
+		return s.forwardQuery(ctx, buf)
+	})
+	if shared {
+		tr.step("upstream", "shared", "answered with the reply to an identical query already in flight")
+		if s.metrics != nil {
+			s.metrics.coalesced.Add(1)
+		}
+		if resp != nil {
+			copy(resp, buf[:2])
+		}
+	}
 	if resp != nil {
-		s.conn.WriteToUDP(resp, addr)
-	} else {
-		s.conn.WriteToUDP(buildServFail(buf[:n], questionEnd), addr)
+		echoQName(resp, buf[:n], questionEnd)
+		if s.cache != nil && !shared {
+			s.cache.Put(qname, qtype, resp)
+		}
+		return resp, outcomeForwarded
+	}
+	if stale, ok := s.cachedStale(buf[:n], questionEnd, qname, qtype); ok {
+		slog.DebugContext(ctx, "upstreams failed, serving stale", "domain", qname, "type", qtype)
+		tr.step("stale", "hit", "upstreams failed, serving an expired cache entry")
+		return stale, outcomeStale
+	}
+	tr.step("stale", "miss", "upstreams failed and nothing is cached")
+	return buildServFail(buf[:n], questionEnd), outcomeServFail
+}
+
+// rotateAnswers rotates every run of records sharing a name and type by n
+// positions, so successive responses spread clients across all addresses.
+// CNAME chain ordering is preserved since only same-owner runs move.
+func rotateAnswers(records []Record, n int) {
+	for start := 0; start < len(records); {
+		end := start + 1
+		for end < len(records) && records[end].Type == records[start].Type &&
+			strings.EqualFold(records[end].Domain, records[start].Domain) {
+			end++
+		}
+		if run := records[start:end]; len(run) > 1 {
+			k := n % len(run)
+			slices.Reverse(run[:k])
+			slices.Reverse(run[k:])
+			slices.Reverse(run)
+		}
+		start = end
 	}
 }
 
@@ -186,83 +728,224 @@ func parseDNSName(buf []byte, offset int) (string, int) {
 }
 
 func encodeDNSName(name string) []byte {
-	var buf []byte
-	for _, part := range strings.Split(name, ".") {
-		if len(part) == 0 {
-			continue
+	return appendDNSName(nil, name)
+}
+
+// appendDNSName appends name in uncompressed wire format.
+func appendDNSName(b []byte, name string) []byte {
+	for name != "" {
+		var label string
+		label, name, _ = strings.Cut(name, ".")
+		if label != "" {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
 		}
-		buf = append(buf, byte(len(part)))
-		buf = append(buf, part...)
 	}
-	buf = append(buf, 0)
-	return buf
+	return append(b, 0)
+}
+
+// recordRData encodes the RDATA of r, or reports false if its value doesn't
+// suit its type.
+func recordRData(r Record) (uint16, []byte, bool) {
+	return appendRData(nil, r)
+}
+
+// appendRData appends the RDATA of r to b. If the value doesn't suit its
+// type it reports false, and b is not to be used.
+func appendRData(b []byte, r Record) (uint16, []byte, bool) {
+	switch r.Type {
+	case "A":
+		if ip, err := netip.ParseAddr(r.Value); err == nil && ip.Zone() == "" && ip.Unmap().Is4() {
+			a := ip.Unmap().As4()
+			return 1, append(b, a[:]...), true
+		}
+	case "AAAA":
+		if ip, err := netip.ParseAddr(r.Value); err == nil && ip.Zone() == "" && ip.Is6() && !ip.Is4In6() {
+			a := ip.As16()
+			return 28, append(b, a[:]...), true
+		}
+	case "CNAME":
+		return 5, appendDNSName(b, r.Value), true
+	case "TXT":
+		return 16, appendTXT(b, r.Value), true
+	case "SVCB", "HTTPS":
+		if rdata, err := parseSVCB(r.Value); err == nil {
+			return typeByName[r.Type], append(b, rdata...), true
+		}
+	}
+	return 0, b, false
+}
+
+// appendRR appends a class IN resource record with an uncompressed owner name.
+func appendRR(b []byte, name string, rtype uint16, ttl uint32, rdata []byte) []byte {
+	b = append(b, encodeDNSName(name)...)
+	b = binary.BigEndian.AppendUint16(b, rtype)
+	b = binary.BigEndian.AppendUint16(b, 1)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+	return append(b, rdata...)
+}
+
+// encodeTXT splits a TXT value into the 255-byte character-strings its RDATA
+// is made of.
+func encodeTXT(value string) []byte {
+	return appendTXT(nil, value)
+}
+
+func appendTXT(b []byte, value string) []byte {
+	for len(value) > 255 {
+		b = append(b, 255)
+		b = append(b, value[:255]...)
+		value = value[255:]
+	}
+	b = append(b, byte(len(value)))
+	return append(b, value...)
+}
+
+func (s *DNSServer) cachedStale(query []byte, questionEnd int, qname string, qtype uint16) ([]byte, bool) {
+	if s.cache == nil {
+		return nil, false
+	}
+	return s.cache.GetStale(query, questionEnd, qname, qtype)
 }
 
 func buildDNSResponse(query []byte, questionEnd int, records []Record) []byte {
-	// Build answers first to get accurate count
-	var answers []byte
-	var ancount uint16
-	namePtr := []byte{0xC0, 0x0C} // pointer to name at offset 12
+	return appendDNSResponse(nil, query, questionEnd, records)
+}
 
-	for _, r := range records {
-		var rdata []byte
-		var rtype uint16
+// appendDNSResponse appends the authoritative answer to query made of
+// records to b. Everything is written in place, the counts patched in
+// last, so with enough room in b it allocates nothing.
+func appendDNSResponse(b, query []byte, questionEnd int, records []Record) []byte {
+	b = slices.Grow(b, responseSize(questionEnd, records))
+	start := len(b)
+	b = append(b, query[0], query[1], // ID
+		0x84|(query[2]&0x01), 0x80, // QR=1 AA=1 RD=copy RA=1 RCODE=0
+		0, 1, // QDCOUNT
+		0, 0, // ANCOUNT, set below
+		0, 0, 0, 0) // NSCOUNT, ARCOUNT
+	b = append(b, query[12:questionEnd]...)
 
-		switch r.Type {
-		case "A":
-			ip := net.ParseIP(r.Value).To4()
-			if ip == nil {
-				continue
-			}
-			rtype = 1
-			rdata = ip
-		case "AAAA":
-			ip := net.ParseIP(r.Value)
-			if ip == nil || ip.To4() != nil {
-				continue
-			}
-			rtype = 28
-			rdata = ip.To16()
-		case "CNAME":
-			rtype = 5
-			rdata = encodeDNSName(r.Value)
-		default:
-			continue
+	var ancount uint16
+	for _, r := range records {
+		var ok bool
+		if b, ok = appendAnswerRR(b, query, r); ok {
+			ancount++
 		}
+	}
+	binary.BigEndian.PutUint16(b[start+6:], ancount)
+	return b
+}
 
-		answers = append(answers, namePtr...)
-		answers = append(answers, byte(rtype>>8), byte(rtype))
-		answers = append(answers, 0, 1)    // Class IN
-		answers = append(answers, 0, 0, 0, 60) // TTL = 60s
-		answers = append(answers, byte(len(rdata)>>8), byte(len(rdata)))
-		answers = append(answers, rdata...)
-		ancount++
+// appendAnswerRR appends r as an answer record to query, or reports false,
+// leaving b as it was, if its value doesn't suit its type.
+func appendAnswerRR(b, query []byte, r Record) ([]byte, bool) {
+	mark := len(b)
+	// Records reached through a CNAME chain carry their own owner name
+	if questionNameIs(query, r.Domain) {
+		b = append(b, 0xC0, 0x0C) // pointer to the question name
+	} else {
+		b = appendDNSName(b, r.Domain)
 	}
+	b = append(b, 0, 0, 0, 1, 0, 0, 0, 60, 0, 0) // type, class IN, TTL 60s, RDLENGTH
+	rdata := len(b)
+	rtype, out, ok := appendRData(b, r)
+	if !ok {
+		return b[:mark], false
+	}
+	b = out
+	binary.BigEndian.PutUint16(b[rdata-10:], rtype)
+	binary.BigEndian.PutUint16(b[rdata-2:], uint16(len(b)-rdata))
+	return b, true
+}
 
-	// Assemble response
-	resp := make([]byte, 0, 12+(questionEnd-12)+len(answers))
+// responseSize bounds the size of the response appendDNSResponse builds,
+// except for SVCB and HTTPS records, whose RDATA may outgrow their text.
+func responseSize(questionEnd int, records []Record) int {
+	n := questionEnd
+	for _, r := range records {
+		n += len(r.Domain) + 2 + 10 + max(len(r.Value)+len(r.Value)/255+2, 16)
+	}
+	return n
+}
 
-	// Header
-	resp = append(resp, query[0], query[1])                // ID
-	resp = append(resp, 0x84|(query[2]&0x01), 0x80)        // QR=1 AA=1 RD=copy RA=1 RCODE=0
-	resp = append(resp, 0, 1)                              // QDCOUNT
-	resp = append(resp, byte(ancount>>8), byte(ancount))   // ANCOUNT
-	resp = append(resp, 0, 0)                              // NSCOUNT
-	resp = append(resp, 0, 0)                              // ARCOUNT
+// questionNameIs reports whether the question of query asks for name,
+// ignoring case, without decoding the question.
+func questionNameIs(query []byte, name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	off := 12
+	for off < len(query) {
+		n := int(query[off])
+		if n == 0 {
+			return name == ""
+		}
+		if n&0xC0 != 0 || off+1+n > len(query) || len(name) < n || (len(name) > n && name[n] != '.') {
+			return false
+		}
+		for i := range n {
+			if toLowerASCII(query[off+1+i]) != toLowerASCII(name[i]) {
+				return false
+			}
+		}
+		off += 1 + n
+		name = strings.TrimPrefix(name[n:], ".")
+	}
+	return false
+}
 
-	// Question section (copied from query)
+func buildServFail(query []byte, questionEnd int) []byte {
+	resp := make([]byte, 0, questionEnd)
+	resp = append(resp, query[0], query[1])
+	resp = append(resp, 0x80|(query[2]&0x01), 0x82) // QR=1 RD=copy RA=1 RCODE=2
+	resp = append(resp, 0, 1)                        // QDCOUNT
+	resp = append(resp, 0, 0)                        // ANCOUNT
+	resp = append(resp, 0, 0)                        // NSCOUNT
+	resp = append(resp, 0, 0)                        // ARCOUNT
 	resp = append(resp, query[12:questionEnd]...)
+	return resp
+}
 
-	// Answers
-	resp = append(resp, answers...)
+// buildError answers with only an RCODE, echoing the question if
+// questionEnd is past the header.
+func buildError(query []byte, questionEnd, rcode int) []byte {
+	resp := make([]byte, 12, questionEnd)
+	copy(resp, query[:3])
+	resp[2] = 0x80 | query[2]&0x79 // QR=1, opcode and RD copied
+	resp[3] = 0x80 | byte(rcode)   // RA=1
+	if questionEnd > 12 {
+		resp[5] = 1 // QDCOUNT
+		resp = append(resp, query[12:questionEnd]...)
+	}
+	return resp
+}
 
+// buildTruncated answers with only the question and the TC bit set, telling
+// the client to retry over TCP. It returns nil for messages without a
+// parseable question.
+func buildTruncated(query []byte) []byte {
+	if len(query) < 12 || query[2]&0x80 != 0 {
+		return nil
+	}
+	_, offset := parseDNSName(query, 12)
+	if offset < 0 || offset+4 > len(query) {
+		return nil
+	}
+	questionEnd := offset + 4
+	resp := make([]byte, 0, questionEnd)
+	resp = append(resp, query[0], query[1])
+	resp = append(resp, 0x82|(query[2]&0x01), 0x80) // QR=1 TC=1 RD=copy RA=1
+	resp = append(resp, 0, 1)                        // QDCOUNT
+	resp = append(resp, 0, 0)                        // ANCOUNT
+	resp = append(resp, 0, 0)                        // NSCOUNT
+	resp = append(resp, 0, 0)                        // ARCOUNT
+	resp = append(resp, query[12:questionEnd]...)
 	return resp
 }
 
-func buildServFail(query []byte, questionEnd int) []byte {
+func buildNXDomain(query []byte, questionEnd int) []byte {
 	resp := make([]byte, 0, questionEnd)
 	resp = append(resp, query[0], query[1])
-	resp = append(resp, 0x80|(query[2]&0x01), 0x82) // QR=1 RD=copy RA=1 RCODE=2
+	resp = append(resp, 0x84|(query[2]&0x01), 0x83) // QR=1 AA=1 RD=copy RA=1 RCODE=3
 	resp = append(resp, 0, 1)                        // QDCOUNT
 	resp = append(resp, 0, 0)                        // ANCOUNT
 	resp = append(resp, 0, 0)                        // NSCOUNT
@@ -271,35 +954,184 @@ func buildServFail(query []byte, questionEnd int) []byte {
 	return resp
 }
 
-func (s *DNSServer) forwardQuery(query []byte) []byte {
-	for _, upstream := range s.upstreams {
-		if resp := s.forwardTo(query, upstream); resp != nil {
+func (s *DNSServer) forwardQuery(ctx context.Context, query []byte) []byte {
+	for _, upstream := range s.upstreams.Ordered() {
+		start := time.Now()
+		resp, err := s.forwardTo(query, upstream)
+		s.upstreams.Report(upstream, time.Since(start), err)
+		if s.metrics != nil {
+			s.metrics.Upstream(upstream, time.Since(start), err)
+		}
+		if err == nil {
+			traceFrom(ctx).step("upstream", "ok", "%s answered %s in %s", upstream, rcodeString(int(resp[3]&0x0F)), time.Since(start).Round(time.Microsecond))
 			return resp
 		}
+		slog.DebugContext(ctx, "upstream failed", "upstream", upstream, "error", err)
+		traceFrom(ctx).step("upstream", "error", "%s: %v", upstream, err)
 	}
 	return nil
 }
 
-func (s *DNSServer) forwardTo(query []byte, upstream string) []byte {
-	conn, err := net.DialTimeout("udp", upstream, forwardTimeout)
+// forwardTo sends query to upstream over the connection queries to it
+// share, retrying over TCP if the answer doesn't fit in UDP.
+func (s *DNSServer) forwardTo(query []byte, upstream string) ([]byte, error) {
+	if isDoTUpstream(upstream) {
+		return s.forwardDoT(query, upstream)
+	}
+
+	resp, err := s.upstreamPool("udp", upstream).exchange(query)
 	if err != nil {
+		return nil, err
+	}
+	// A truncated reply means the answer didn't fit; retry over TCP to get it whole
+	if resp[2]&0x02 != 0 {
+		return s.upstreamPool("tcp", upstream).exchange(query)
+	}
+	return resp, nil
+}
+
+var errMismatch = errors.New("upstream reply does not match query")
+
+// matchesQuery reports whether resp is a response carrying the transaction ID
+// and question of query. Names compare case-insensitively.
+func matchesQuery(query, resp []byte) bool {
+	if len(resp) < 12 || resp[0] != query[0] || resp[1] != query[1] || resp[2]&0x80 == 0 {
+		return false
+	}
+	if !bytes.Equal(resp[4:6], query[4:6]) {
+		return false
+	}
+	end := skipDNSName(query, 12)
+	if end < 0 || end+4 > len(query) || end+4 > len(resp) {
+		return false
+	}
+	for i := 12; i < end+4; i++ {
+		a, b := query[i], resp[i]
+		if a != b && !(i < end && toLowerASCII(a) == toLowerASCII(b)) {
+			return false
+		}
+	}
+	return true
+}
+
+// qnameOwners returns the offsets of record owner names in msg that spell out
+// the question name rather than pointing at it.
+func qnameOwners(msg []byte) []int {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:6]) != 1 {
 		return nil
 	}
+	end := skipDNSName(msg, 12)
+	if end < 0 || end+4 > len(msg) {
+		return nil
+	}
+	qname := msg[12:end]
+	rrcount := int(binary.BigEndian.Uint16(msg[6:8])) +
+		int(binary.BigEndian.Uint16(msg[8:10])) +
+		int(binary.BigEndian.Uint16(msg[10:12]))
+	var owners []int
+	off := end + 4
+	for range rrcount {
+		if off+len(qname) <= len(msg) && equalFoldASCII(msg[off:off+len(qname)], qname) {
+			owners = append(owners, off)
+		}
+		if off = skipDNSName(msg, off); off < 0 || off+10 > len(msg) {
+			return owners
+		}
+		off += 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+	}
+	return owners
+}
+
+// echoQName gives resp the exact spelling of the query's name, in the
+// question and in owner names, for clients checking the case they randomized
+// (DNS 0x20). Upstreams and our cache may have seen another spelling.
+func echoQName(resp, query []byte, questionEnd int) {
+	if questionEnd > len(resp) || skipDNSName(resp, 12) != questionEnd-4 {
+		return
+	}
+	for _, off := range qnameOwners(resp) {
+		copy(resp[off:], query[12:questionEnd-4])
+	}
+	copy(resp[12:questionEnd-4], query[12:questionEnd-4])
+}
+
+func equalFoldASCII(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if toLowerASCII(a[i]) != toLowerASCII(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func toLowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// forwardTCP exchanges a query over TCP using the two-byte length framing of
+// RFC 1035 §4.2.2.
+func forwardTCP(query []byte, upstream string) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", upstream, forwardTimeout)
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 
 	conn.SetDeadline(time.Now().Add(forwardTimeout))
 
-	if _, err := conn.Write(query); err != nil {
-		return nil
+	if err := writeTCPMessage(conn, query); err != nil {
+		return nil, err
 	}
+	return readReply(conn, query)
+}
 
-	buf := make([]byte, udpBufSize)
-	n, err := conn.Read(buf)
+// readReply reads one framed reply from a stream and checks it belongs to query.
+func readReply(r io.Reader, query []byte) ([]byte, error) {
+	resp, err := readTCPMessage(r)
 	if err != nil {
-		return nil
+		return nil, err
 	}
+	if !matchesQuery(query, resp) {
+		return nil, errMismatch
+	}
+	return resp, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
 
-	return buf[:n]
+// buildQuery builds a recursive query for name with a random transaction ID.
+func buildQuery(name string, qtype uint16) []byte {
+	msg := make([]byte, 12, 12+len(name)+6)
+	rand.Read(msg[0:2])
+	msg[2] = 0x01 // RD=1
+	msg[5] = 1    // QDCOUNT
+	msg = append(msg, encodeDNSName(name)...)
+	msg = append(msg, byte(qtype>>8), byte(qtype), 0, 1)
+	return msg
 }
 
 // getLocalIPs returns all IP addresses assigned to local interfaces.
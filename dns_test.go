@@ -2,8 +2,15 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestParseDNSName(t *testing.T) {
@@ -207,6 +214,35 @@ func TestBuildDNSResponse_CNAME(t *testing.T) {
 	}
 }
 
+func TestBuildDNSResponse_CNAMEChain(t *testing.T) {
+	query := buildTestQuery("www.local", 1, 1)
+	questionEnd := len(query)
+
+	records := []Record{
+		{ID: 1, Domain: "www.local", Type: "CNAME", Value: "target.local"},
+		{ID: 2, Domain: "target.local", Type: "A", Value: "10.0.0.1"},
+	}
+	resp := buildDNSResponse(query, questionEnd, records)
+
+	ancount := binary.BigEndian.Uint16(resp[6:8])
+	if ancount != 2 {
+		t.Fatalf("ANCOUNT = %d, want 2", ancount)
+	}
+
+	// First answer uses a pointer to the question name
+	if resp[questionEnd] != 0xC0 || resp[questionEnd+1] != 0x0C {
+		t.Errorf("first answer owner = %x, want compression pointer", resp[questionEnd:questionEnd+2])
+	}
+
+	// Second answer carries the CNAME target as its owner name
+	rdlen := int(binary.BigEndian.Uint16(resp[questionEnd+10 : questionEnd+12]))
+	second := questionEnd + 12 + rdlen
+	name, _ := parseDNSName(resp, second)
+	if name != "target.local" {
+		t.Errorf("second answer owner = %q, want %q", name, "target.local")
+	}
+}
+
 func TestBuildDNSResponse_InvalidIP(t *testing.T) {
 	query := buildTestQuery("bad.local", 1, 1)
 	questionEnd := len(query)
@@ -220,6 +256,40 @@ func TestBuildDNSResponse_InvalidIP(t *testing.T) {
 	}
 }
 
+func TestRotateAnswers(t *testing.T) {
+	records := []Record{
+		{ID: 1, Domain: "www.local", Type: "CNAME", Value: "app.local"},
+		{ID: 2, Domain: "app.local", Type: "A", Value: "10.0.0.1"},
+		{ID: 3, Domain: "app.local", Type: "A", Value: "10.0.0.2"},
+		{ID: 4, Domain: "app.local", Type: "A", Value: "10.0.0.3"},
+	}
+
+	rotateAnswers(records, 1)
+	want := []int{1, 3, 4, 2}
+	for i, id := range want {
+		if records[i].ID != id {
+			t.Fatalf("after rotation IDs = %v, want %v", ids(records), want)
+		}
+	}
+
+	// Rotating by the run length again restores the original order
+	rotateAnswers(records, 2)
+	want = []int{1, 2, 3, 4}
+	for i, id := range want {
+		if records[i].ID != id {
+			t.Fatalf("after second rotation IDs = %v, want %v", ids(records), want)
+		}
+	}
+}
+
+func ids(records []Record) []int {
+	var out []int
+	for _, r := range records {
+		out = append(out, r.ID)
+	}
+	return out
+}
+
 func TestBuildServFail(t *testing.T) {
 	query := buildTestQuery("fail.local", 1, 1)
 	questionEnd := len(query)
@@ -260,3 +330,472 @@ func buildTestQuery(domain string, qtype, qclass uint16) []byte {
 	buf = append(buf, byte(qclass>>8), byte(qclass))
 	return buf
 }
+
+// startDNSServer runs a DNS server on a random local port and returns its address.
+func startDNSServer(t *testing.T, dns *DNSServer) string {
+	t.Helper()
+	// The TCP port matching a random UDP port may be taken; try another
+	for range 5 {
+		failed := make(chan error, 1)
+		go func() { failed <- dns.ListenAndServe("127.0.0.1:0") }()
+		select {
+		case <-dns.ready:
+			t.Cleanup(dns.Close)
+			return dns.conn.LocalAddr().String()
+		case err := <-failed:
+			t.Logf("listen: %v", err)
+		}
+	}
+	t.Fatal("no free port for the DNS server")
+	return ""
+}
+
+func TestDNSForwardingCacheAndFailover(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := startFakeUpstream(t, `
+example.com A answer 93.184.216.34 300
+broken.com A servfail
+`)
+
+	// A closed port makes the first upstream fail fast
+	dead, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.LocalAddr().String()
+	dead.Close()
+
+	dns := NewDNSServer(store, []string{deadAddr, fake.Addr()})
+	dns.cache = NewCache(100)
+	addr := startDNSServer(t, dns)
+
+	for range 3 {
+		resp := exchange(t, addr, buildTestQuery("example.com", 1, 1))
+		if resp[3]&0x0F != 0 || resp[7] != 1 {
+			t.Fatalf("rcode=%d ancount=%d", resp[3]&0x0F, resp[7])
+		}
+	}
+	if fake.Queries() != 1 {
+		t.Errorf("upstream queries = %d, want 1 (rest from cache)", fake.Queries())
+	}
+
+	// Upstream SERVFAIL is relayed but not cached
+	for range 2 {
+		resp := exchange(t, addr, buildTestQuery("broken.com", 1, 1))
+		if resp[3]&0x0F != 2 {
+			t.Errorf("rcode = %d, want SERVFAIL", resp[3]&0x0F)
+		}
+	}
+	if fake.Queries() != 3 {
+		t.Errorf("upstream queries = %d, want 3", fake.Queries())
+	}
+}
+
+func TestForwardTCPFallback(t *testing.T) {
+	fake := startFakeUpstream(t, `
+big.com A truncate
+big.com A answer 10.0.0.1
+big.com A answer 10.0.0.2
+`)
+	dns := &DNSServer{}
+	resp, err := dns.forwardTo(buildTestQuery("big.com", 1, 1), fake.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp[2]&0x02 != 0 {
+		t.Error("TC still set after TCP retry")
+	}
+	if resp[7] != 2 {
+		t.Errorf("ancount = %d, want 2", resp[7])
+	}
+	if fake.Queries() != 2 {
+		t.Errorf("upstream queries = %d, want 2 (UDP then TCP)", fake.Queries())
+	}
+}
+
+func TestMatchesQuery(t *testing.T) {
+	query := buildTestQuery("Example.COM", 1, 1)
+	good := buildDNSResponse(query, len(query), nil)
+
+	wrongID := append([]byte(nil), good...)
+	wrongID[1] ^= 0xFF
+	notResponse := append([]byte(nil), good...)
+	notResponse[2] &^= 0x80
+	wrongName := buildDNSResponse(buildTestQuery("example.net", 1, 1), len(query), nil)
+	wrongType := buildDNSResponse(buildTestQuery("example.com", 28, 1), len(query), nil)
+	otherCase := buildDNSResponse(buildTestQuery("EXAMPLE.com", 1, 1), len(query), nil)
+
+	tests := []struct {
+		name string
+		resp []byte
+		want bool
+	}{
+		{"match", good, true},
+		{"case differs", otherCase, true},
+		{"wrong id", wrongID, false},
+		{"not a response", notResponse, false},
+		{"wrong name", wrongName, false},
+		{"wrong type", wrongType, false},
+		{"short", good[:14], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesQuery(query, tt.resp); got != tt.want {
+				t.Errorf("matchesQuery = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardDropsForgedReplies(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, udpBufSize)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		query := buf[:n]
+		forged := buildDNSResponse(query, n, []Record{{Domain: "example.com", Type: "A", Value: "6.6.6.6"}})
+		forged[0] ^= 0xFF
+		conn.WriteToUDP(forged, addr)
+		conn.WriteToUDP(buildDNSResponse(query, n, []Record{{Domain: "example.com", Type: "A", Value: "93.184.216.34"}}), addr)
+	}()
+
+	dns := &DNSServer{}
+	resp, err := dns.forwardTo(buildTestQuery("example.com", 1, 1), conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := parseMessage(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answers) != 1 || msg.Answers[0].Data != "93.184.216.34" {
+		t.Errorf("answers = %+v, want the genuine reply", msg.Answers)
+	}
+}
+
+func TestDNSViewsPerListener(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Record{Domain: "nas.my.local", Type: "A", Value: "100.64.0.5", View: "tailnet"})
+	store.Add(Record{Domain: "nas.my.local", Type: "A", Value: "192.168.1.5", View: "lan"})
+	store.Add(Record{Domain: "printer.my.local", Type: "A", Value: "192.168.1.9"})
+
+	dns := NewDNSServer(store, nil)
+	plain := startDNSServer(t, dns)
+	go dns.ListenAndServeView("127.0.0.1:0", "lan")
+	var lan string
+	for range 100 {
+		dns.mu.Lock()
+		if len(dns.tcp) == 2 {
+			lan = dns.tcp[1].Addr().String()
+		}
+		dns.mu.Unlock()
+		if lan != "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if lan == "" {
+		t.Fatal("second listener did not come up")
+	}
+	answers := func(addr, name string) []string {
+		msg, err := parseMessage(exchange(t, addr, buildTestQuery(name, 1, 1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data []string
+		for _, rr := range msg.Answers {
+			data = append(data, rr.Data)
+		}
+		return data
+	}
+
+	if got := answers(lan, "nas.my.local"); len(got) != 1 || got[0] != "192.168.1.5" {
+		t.Errorf("lan view answers = %v, want [192.168.1.5]", got)
+	}
+	// Names without a view-specific record fall back to shared records
+	if got := answers(lan, "printer.my.local"); len(got) != 1 || got[0] != "192.168.1.9" {
+		t.Errorf("lan view answers = %v, want [192.168.1.9]", got)
+	}
+	// A listener without a view sees neither view's records, but the name is
+	// still ours and is not forwarded
+	if got := answers(plain, "nas.my.local"); len(got) != 0 {
+		t.Errorf("default view answers = %v, want none", got)
+	}
+}
+
+func TestDNSRejectsUnsupportedQueries(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Record{Domain: "app.my.local", Type: "A", Value: "10.0.0.1"})
+	fake := startFakeUpstream(t, "example.com A answer 93.184.216.34")
+	addr := startDNSServer(t, NewDNSServer(store, []string{fake.Addr()}))
+
+	status := buildTestQuery("app.my.local", 1, 1)
+	status[2] |= 2 << 3 // opcode STATUS
+	twoQuestions := buildTestQuery("app.my.local", 1, 1)
+	twoQuestions[5] = 2
+	truncated := buildTestQuery("app.my.local", 1, 1)
+	truncated = truncated[:len(truncated)-3]
+
+	tests := []struct {
+		name      string
+		query     []byte
+		rcode     int
+		questions int
+	}{
+		{"opcode STATUS", status, rcodeNotImp, 1},
+		{"class CH", buildTestQuery("version.bind", 16, 3), rcodeRefused, 1},
+		{"class ANY", buildTestQuery("example.com", 1, 255), rcodeRefused, 1},
+		{"no question", buildTestQuery("app.my.local", 1, 1)[:12:12], rcodeFormErr, 0},
+		{"two questions", twoQuestions, rcodeFormErr, 1},
+		{"truncated question", truncated, rcodeFormErr, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := exchange(t, addr, tt.query)
+			if len(resp) < 12 || resp[0] != 0xAB || resp[1] != 0xCD || resp[2]&0x80 == 0 {
+				t.Fatalf("bad response header % x", resp)
+			}
+			if got := int(resp[3] & 0x0F); got != tt.rcode {
+				t.Errorf("rcode = %s, want %s", rcodeString(got), rcodeString(tt.rcode))
+			}
+			if resp[2]&0x78 != tt.query[2]&0x78 {
+				t.Error("opcode not echoed")
+			}
+			if got := int(binary.BigEndian.Uint16(resp[4:6])); got != tt.questions {
+				t.Errorf("QDCOUNT = %d, want %d", got, tt.questions)
+			}
+		})
+	}
+	if fake.Queries() != 0 {
+		t.Errorf("%d queries reached the upstream", fake.Queries())
+	}
+}
+
+func TestDNSAuthoritativeOnly(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Record{Domain: "app.my.lan", Type: "A", Value: "10.0.0.1"})
+	fake := startFakeUpstream(t, "example.com A answer 93.184.216.34")
+	dns := NewDNSServer(store, []string{fake.Addr()})
+	dns.authoritativeOnly = true
+	dns.zones = NewZones([]string{"my.lan"})
+	addr := startDNSServer(t, dns)
+
+	tests := []struct {
+		domain  string
+		rcode   int
+		answers int
+	}{
+		{"app.my.lan", 0, 1},
+		{"missing.my.lan", 3, 0},
+		{"example.com", rcodeRefused, 0},
+	}
+	for _, tt := range tests {
+		m, err := parseMessage(exchange(t, addr, buildTestQuery(tt.domain, 1, 1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.RCode != tt.rcode || len(m.Answers) != tt.answers || m.RA {
+			t.Errorf("%s: rcode %s, %d answers, RA %v", tt.domain, rcodeString(m.RCode), len(m.Answers), m.RA)
+		}
+	}
+	if fake.Queries() != 0 {
+		t.Errorf("%d queries forwarded with recursion disabled", fake.Queries())
+	}
+}
+
+func TestTransientReadError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", syscall.ECONNREFUSED)}, true},
+		{&net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", syscall.EMSGSIZE)}, true},
+		{&net.OpError{Op: "read", Net: "udp", Err: os.ErrDeadlineExceeded}, true},
+		{&net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", syscall.EBADF)}, false},
+		{errors.New("something else"), false},
+	}
+	for _, tt := range tests {
+		if got := transientReadError(tt.err); got != tt.want {
+			t.Errorf("transientReadError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDNSReusePortSockets(t *testing.T) {
+	conns, err := listenUDPGroup("127.0.0.1:0", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAll(conns)
+	if len(conns) != 4 {
+		t.Fatalf("%d sockets, want 4", len(conns))
+	}
+	for _, c := range conns[1:] {
+		if c.LocalAddr().String() != conns[0].LocalAddr().String() {
+			t.Errorf("socket bound to %s, want %s", c.LocalAddr(), conns[0].LocalAddr())
+		}
+	}
+
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Record{Domain: "app.test", Type: "A", Value: "10.0.0.1"})
+	dns := NewDNSServer(store, nil)
+	dns.udpSockets = 4
+	addr := startDNSServer(t, dns)
+	dns.mu.Lock()
+	n := len(dns.conns)
+	dns.mu.Unlock()
+	if n != 4 {
+		t.Errorf("%d UDP sockets, want 4", n)
+	}
+	// Clients on different ports land on different sockets; all are served
+	for range 20 {
+		if resp := exchange(t, addr, buildTestQuery("app.test", 1, 1)); resp[7] != 1 {
+			t.Fatalf("answers = %d, want 1", resp[7])
+		}
+	}
+}
+
+func TestDNSQueueOverload(t *testing.T) {
+	fake := startFakeUpstream(t, `slow.test A delay 500ms answer 10.0.0.1`)
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dns := NewDNSServer(store, []string{fake.Addr()})
+	dns.applyProfile(Profile{UDPBufSize: 512, MaxQueries: 1, QueueSize: 1})
+	dns.udpSockets = 1
+	dns.metrics = NewMetrics()
+	addr := startDNSServer(t, dns)
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// One query is with the worker and one waits; the rest find the
+	// queue full
+	for range 6 {
+		conn.Write(buildTestQuery("slow.test", 1, 1))
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for dns.metrics.droppedCapacity.Load() < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := dns.metrics.droppedCapacity.Load(); got < 4 || got > 5 {
+		t.Errorf("dropped %d of 6 queries, want 4 or 5", got)
+	}
+
+	// Answers come back once the worker is free
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 512)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatalf("no answer to a queued query: %v", err)
+	}
+}
+
+func TestAppendDNSResponse(t *testing.T) {
+	query := buildTestQuery("App.Test", 1, 1)
+	records := []Record{
+		{Domain: "app.test", Type: "CNAME", Value: "web.test"},
+		{Domain: "web.test", Type: "A", Value: "::ffff:10.0.0.1"},
+		{Domain: "web.test", Type: "AAAA", Value: "fd00::1"},
+		{Domain: "web.test", Type: "TXT", Value: strings.Repeat("x", 300)},
+		{Domain: "web.test", Type: "AAAA", Value: "10.0.0.2"}, // not an IPv6 address
+	}
+	buf := make([]byte, 0, 4096)
+	resp := appendDNSResponse(buf, query, len(query), records)
+	if &resp[0] != &buf[:1][0] {
+		t.Error("response did not reuse the buffer")
+	}
+
+	msg, err := parseMessage(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, rr := range msg.Answers {
+		got = append(got, rr.String())
+	}
+	want := []string{
+		"App.Test\t60\tCNAME\tweb.test.",
+		"web.test\t60\tA\t10.0.0.1",
+		"web.test\t60\tAAAA\tfd00::1",
+	}
+	if len(got) != 4 || !slices.Equal(got[:3], want) || !strings.HasPrefix(got[3], "web.test\t60\tTXT\t") {
+		t.Errorf("answers:\n%s", strings.Join(got, "\n"))
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() {
+		appendDNSResponse(buf[:0], query, len(query), records[:4])
+	}); allocs != 0 {
+		t.Errorf("appendDNSResponse allocated %v times with room in the buffer", allocs)
+	}
+}
+
+func TestQuestionNameIs(t *testing.T) {
+	query := buildTestQuery("www.Example.com", 1, 1)
+	for name, want := range map[string]bool{
+		"www.example.com":  true,
+		"WWW.EXAMPLE.COM.": true,
+		"www.example.co":   false,
+		"www.example.com2": false,
+		"example.com":      false,
+		"ww.wexample.com":  false,
+		"":                 false,
+	} {
+		if got := questionNameIs(query, name); got != want {
+			t.Errorf("questionNameIs(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func benchmarkRecords() []Record {
+	return []Record{
+		{Domain: "app.test", Type: "A", Value: "10.0.0.1"},
+		{Domain: "app.test", Type: "A", Value: "10.0.0.2"},
+		{Domain: "app.test", Type: "AAAA", Value: "fd00::1"},
+	}
+}
+
+func BenchmarkBuildDNSResponse(b *testing.B) {
+	query := buildTestQuery("app.test", 1, 1)
+	records := benchmarkRecords()
+	b.ReportAllocs()
+	for b.Loop() {
+		buildDNSResponse(query, len(query), records)
+	}
+}
+
+// BenchmarkAppendDNSResponse builds into a reused buffer, as the UDP path
+// does with its pooled one.
+func BenchmarkAppendDNSResponse(b *testing.B) {
+	query := buildTestQuery("app.test", 1, 1)
+	records := benchmarkRecords()
+	buf := make([]byte, 0, udpBufSize)
+	b.ReportAllocs()
+	for b.Loop() {
+		buf = appendDNSResponse(buf[:0], query, len(query), records)
+	}
+}
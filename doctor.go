@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// doctorCheck is the outcome of one doctor check. Fix says what to do about
+// a warning or failure.
+type doctorCheck struct {
+	Name   string
+	Status string // "ok", "warn" or "fail"
+	Detail string
+	Fix    string
+}
+
+// portConflicts are resolvers that commonly hold port 53 already, by their
+// process name, with how to move them out of the way.
+var portConflicts = []struct{ proc, fix string }{
+	{"systemd-resolve", "set DNSStubListener=no in /etc/systemd/resolved.conf and run systemctl restart systemd-resolved, or serve on a single address with -dns"},
+	{"dnsmasq", "set port=0 in /etc/dnsmasq.conf if only its DHCP is wanted, or bind-interfaces with listen-address so it leaves our address free"},
+	{"named", "stop BIND (systemctl disable --now named) or give it listen-on clauses that exclude our address"},
+	{"unbound", "stop unbound or restrict its interface: lines to other addresses"},
+	{"pihole-FTL", "stop Pi-hole or move its DNS to another port"},
+	{"coredns", "stop CoreDNS or bind it to another address"},
+}
+
+// checkPort tries to bind addr the way the server would, over UDP and TCP.
+// procs are the names of the running processes, to tell who holds the port.
+func checkPort(addr string, procs []string) doctorCheck {
+	c := doctorCheck{Name: "port " + addr}
+	err := bindBoth(addr)
+	switch {
+	case err == nil:
+		c.Status, c.Detail = "ok", "free over UDP and TCP"
+	case errors.Is(err, syscall.EADDRINUSE):
+		if slices.Contains(procs, "regieleki") {
+			c.Status, c.Detail = "ok", "in use, by a running regieleki"
+			return c
+		}
+		c.Status, c.Detail = "fail", "already in use"
+		for _, pc := range portConflicts {
+			if slices.Contains(procs, pc.proc) {
+				c.Detail += "; " + pc.proc + " is running"
+				c.Fix = pc.fix
+				return c
+			}
+		}
+		_, port, _ := net.SplitHostPort(addr)
+		c.Fix = "find the owner with ss -lunp 'sport = " + port + "' and stop it, or serve on another address with -dns"
+	case errors.Is(err, syscall.EACCES):
+		c.Status, c.Detail = "fail", "permission denied"
+		c.Fix = "ports below 1024 need root or CAP_NET_BIND_SERVICE: run setcap cap_net_bind_service=+ep on the binary, set AmbientCapabilities=CAP_NET_BIND_SERVICE in the unit, or use systemd socket activation"
+	default:
+		c.Status, c.Detail = "fail", err.Error()
+		c.Fix = "check the -dns address is one this host has"
+	}
+	return c
+}
+
+func bindBoth(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
+
+// processNames lists the command names of the running processes.
+func processNames() []string {
+	paths, _ := filepath.Glob("/proc/[0-9]*/comm")
+	var names []string
+	for _, p := range paths {
+		if data, err := os.ReadFile(p); err == nil {
+			names = append(names, strings.TrimSpace(string(data)))
+		}
+	}
+	return names
+}
+
+// checkResolvConf looks at which nameservers this host's own lookups go
+// to. local holds the host's addresses, as from getLocalIPs.
+func checkResolvConf(path string, local map[string]bool) doctorCheck {
+	c := doctorCheck{Name: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		c.Status, c.Detail = "warn", err.Error()
+		c.Fix = "without it the upstreams default to 8.8.8.8 and 1.1.1.1; pass -upstream to choose them"
+		return c
+	}
+	var servers []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if f := strings.Fields(line); len(f) >= 2 && f[0] == "nameserver" {
+			servers = append(servers, f[1])
+		}
+	}
+	switch {
+	case len(servers) == 0:
+		c.Status, c.Detail = "warn", "no nameserver lines"
+		c.Fix = "add nameserver 127.0.0.1 to send this host's lookups through regieleki, and pass -upstream for where it forwards"
+	case slices.Contains(servers, "127.0.0.53"):
+		c.Status, c.Detail = "warn", "points at the systemd-resolved stub (127.0.0.53), which also holds port 53 on that address"
+		c.Fix = "set DNS=127.0.0.1 and DNSStubListener=no in /etc/systemd/resolved.conf, then link /etc/resolv.conf to /run/systemd/resolve/resolv.conf"
+	default:
+		c.Status, c.Detail = "ok", "nameservers "+strings.Join(servers, ", ")
+		if !slices.ContainsFunc(servers, func(s string) bool { return local[s] }) {
+			c.Detail += "; this host's own lookups bypass regieleki"
+		}
+	}
+	return c
+}
+
+// checkFileMode checks that the server can write path and, for secret
+// files, that nobody else can read it. A missing file is fine if its
+// directory is writable, since the server creates it.
+func checkFileMode(label, path string, secret bool) doctorCheck {
+	c := doctorCheck{Name: label + " " + path, Status: "ok"}
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		dir := filepath.Dir(path)
+		if err := writable(dir); err != nil {
+			c.Status, c.Detail = "fail", "missing, and "+dir+" is not writable"
+			c.Fix = "create " + dir + " and make it writable by the user regieleki runs as"
+			return c
+		}
+		c.Detail = "not created yet"
+		return c
+	}
+	if err != nil {
+		c.Status, c.Detail = "fail", err.Error()
+		return c
+	}
+	mode := info.Mode().Perm()
+	c.Detail = "mode " + fmt.Sprintf("%04o", mode)
+	switch {
+	case !info.Mode().IsRegular():
+		c.Status, c.Detail = "fail", "not a regular file"
+	case writable(path) != nil:
+		c.Status = "fail"
+		c.Detail += ", not writable by this user"
+		c.Fix = "chown it to the user regieleki runs as"
+	case secret && mode&0o077 != 0:
+		c.Status = "fail"
+		c.Detail += ", readable by other users"
+		c.Fix = "chmod 600 " + path
+	case mode&0o002 != 0:
+		c.Status = "warn"
+		c.Detail += ", writable by every user"
+		c.Fix = "chmod 600 " + path
+	}
+	return c
+}
+
+// checkUpstreams asks each upstream for the root NS records, as any
+// recursive resolver can answer.
+func checkUpstreams(upstreams []string) []doctorCheck {
+	dns := &DNSServer{upstreams: NewUpstreams(upstreams)}
+	var checks []doctorCheck
+	for _, u := range upstreams {
+		c := doctorCheck{Name: "upstream " + u}
+		start := time.Now()
+		resp, err := dns.forwardTo(buildQuery(".", 2), u)
+		elapsed := time.Since(start).Round(time.Millisecond)
+		switch {
+		case err != nil:
+			c.Status, c.Detail = "fail", err.Error()
+			c.Fix = "check a firewall allows outbound port 53 (853 for tls://) to it, or choose others with -upstream"
+			if isDoTUpstream(u) {
+				c.Fix += "; for tls:// also check the sni and pin"
+			}
+		case resp[3]&0x0F != 0:
+			c.Status, c.Detail = "warn", "answered "+rcodeString(int(resp[3]&0x0F))+" in "+elapsed.String()
+			c.Fix = "it may refuse recursion for this host; choose another with -upstream"
+		default:
+			c.Status, c.Detail = "ok", "answered in "+elapsed.String()
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+func handleDoctor(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	var dnsAddrs, upstreams listFlag
+	fs.Var(&dnsAddrs, "dns", "DNS listen address to check (repeatable; default :53)")
+	dataPath := fs.String("data", "records.tsv", "Path to records file")
+	tokenPath := fs.String("token", "", "Path to API token file (empty skips the check)")
+	tsigKeys := fs.String("tsig-keys", "", "Path to TSIG keys file (empty skips the check)")
+	fs.Var(&upstreams, "upstream", "Upstream to test (repeatable; default from resolv.conf)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: regieleki doctor [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if len(dnsAddrs) == 0 {
+		dnsAddrs = listFlag{":53"}
+	}
+	for i, u := range upstreams {
+		u, err := normalizeUpstream(u)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(2)
+		}
+		upstreams[i] = u
+	}
+	if len(upstreams) == 0 {
+		upstreams = parseResolvConf()
+	}
+
+	var checks []doctorCheck
+	procs := processNames()
+	for _, addr := range dnsAddrs {
+		addr, _, _ = strings.Cut(addr, "=")
+		checks = append(checks, checkPort(addr, procs))
+	}
+	checks = append(checks, checkResolvConf("/etc/resolv.conf", getLocalIPs()))
+	checks = append(checks, checkFileMode("records", *dataPath, false))
+	if *tokenPath != "" {
+		checks = append(checks, checkFileMode("token", *tokenPath, true))
+	}
+	if *tsigKeys != "" {
+		checks = append(checks, checkFileMode("tsig keys", *tsigKeys, true))
+	}
+	checks = append(checks, checkUpstreams(upstreams)...)
+
+	failed := false
+	for _, c := range checks {
+		fmt.Printf("%-4s  %s: %s\n", c.Status, c.Name, c.Detail)
+		if c.Fix != "" {
+			fmt.Printf("      fix: %s\n", c.Fix)
+		}
+		failed = failed || c.Status == "fail"
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
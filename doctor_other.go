@@ -0,0 +1,24 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// writable reports whether this user may write path, a file or directory.
+// Without access(2), a file is opened for writing and a directory gets a
+// temporary file, which is removed again.
+func writable(path string) error {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		f, err := os.CreateTemp(path, ".regieleki-doctor-*")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		return os.Remove(f.Name())
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
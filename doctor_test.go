@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckPort(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr := conn.LocalAddr().String()
+
+	c := checkPort(addr, []string{"sshd", "dnsmasq"})
+	if c.Status != "fail" || !strings.Contains(c.Detail, "dnsmasq") || !strings.Contains(c.Fix, "dnsmasq.conf") {
+		t.Errorf("port held by dnsmasq: %+v", c)
+	}
+	if c := checkPort(addr, []string{"regieleki"}); c.Status != "ok" {
+		t.Errorf("port held by regieleki: %+v", c)
+	}
+	if c := checkPort(addr, nil); c.Status != "fail" || !strings.Contains(c.Fix, "ss -lunp") {
+		t.Errorf("port held by an unknown process: %+v", c)
+	}
+	if c := checkPort("127.0.0.1:0", nil); c.Status != "ok" {
+		t.Errorf("free port: %+v", c)
+	}
+}
+
+func TestCheckResolvConf(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "resolv.conf")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	local := map[string]bool{"127.0.0.1": true}
+
+	tests := []struct {
+		content, status, detail string
+	}{
+		{"nameserver 127.0.0.53\noptions edns0\n", "warn", "systemd-resolved"},
+		{"search lan\n", "warn", "no nameserver"},
+		{"nameserver 127.0.0.1\n", "ok", "127.0.0.1"},
+		{"nameserver 9.9.9.9\n", "ok", "bypass"},
+	}
+	for _, tt := range tests {
+		c := checkResolvConf(write(tt.content), local)
+		if c.Status != tt.status || !strings.Contains(c.Detail, tt.detail) {
+			t.Errorf("%q: got %+v", tt.content, c)
+		}
+	}
+	if c := checkResolvConf(filepath.Join(dir, "missing"), local); c.Status != "warn" {
+		t.Errorf("missing file: %+v", c)
+	}
+}
+
+func TestCheckFileMode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	if c := checkFileMode("token", path, true); c.Status != "ok" || c.Detail != "not created yet" {
+		t.Errorf("missing file: %+v", c)
+	}
+	if err := os.WriteFile(path, []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if c := checkFileMode("token", path, true); c.Status != "ok" {
+		t.Errorf("0600 token: %+v", c)
+	}
+	os.Chmod(path, 0o644)
+	if c := checkFileMode("token", path, true); c.Status != "fail" || c.Fix != "chmod 600 "+path {
+		t.Errorf("0644 token: %+v", c)
+	}
+	if c := checkFileMode("records", path, false); c.Status != "ok" {
+		t.Errorf("0644 records: %+v", c)
+	}
+	os.Chmod(path, 0o666)
+	if c := checkFileMode("records", path, false); c.Status != "warn" {
+		t.Errorf("0666 records: %+v", c)
+	}
+}
+
+func TestCheckUpstreams(t *testing.T) {
+	good := startFakeUpstream(t, `. NS answer a.root-servers.net.`)
+	refusing := startFakeUpstream(t, `. NS refused`)
+	checks := checkUpstreams([]string{good.Addr(), refusing.Addr()})
+	if len(checks) != 2 {
+		t.Fatalf("got %d checks", len(checks))
+	}
+	if checks[0].Status != "ok" {
+		t.Errorf("good upstream: %+v", checks[0])
+	}
+	if checks[1].Status != "warn" || !strings.Contains(checks[1].Detail, "REFUSED") {
+		t.Errorf("refusing upstream: %+v", checks[1])
+	}
+}
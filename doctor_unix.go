@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// accessWrite is W_OK for access(2).
+const accessWrite = 2
+
+// writable reports whether this user may write path, a file or directory,
+// without touching it.
+func writable(path string) error {
+	return syscall.Access(path, accessWrite)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const dotPort = "853"
+
+// dotUpstream is a DNS-over-TLS resolver (RFC 7858) given as
+//
+//	tls://host[:port][?sni=name][&pin=base64-sha256]...
+//
+// The server certificate is verified against the system roots for sni,
+// which defaults to host. When one or more SPKI pins are given the pins
+// alone decide trust, so self-signed resolvers work too.
+type dotUpstream struct {
+	addr   string
+	config *tls.Config
+	pool   *upstreamPool
+}
+
+func isDoTUpstream(upstream string) bool {
+	return strings.HasPrefix(upstream, "tls://")
+}
+
+func parseDoTUpstream(upstream string) (*dotUpstream, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "tls" || u.Hostname() == "" || u.Path != "" {
+		return nil, fmt.Errorf("invalid DoT upstream %q (want tls://host[:port])", upstream)
+	}
+	port := u.Port()
+	if port == "" {
+		port = dotPort
+	}
+
+	q := u.Query()
+	cfg := &tls.Config{
+		ServerName:         u.Hostname(),
+		MinVersion:         tls.VersionTLS12,
+		ClientSessionCache: tls.NewLRUClientSessionCache(8),
+	}
+	if sni := q.Get("sni"); sni != "" {
+		cfg.ServerName = sni
+	}
+
+	var pins [][]byte
+	for _, p := range q["pin"] {
+		// Query decoding turns an unescaped '+' into a space; base64 has no spaces
+		p = strings.ReplaceAll(p, " ", "+")
+		pin, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(p, "sha256/"))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q (want base64 SHA-256)", p)
+		}
+		pins = append(pins, pin)
+	}
+	if len(pins) > 0 {
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifySPKIPins(cs.PeerCertificates, pins)
+		}
+	}
+
+	d := &dotUpstream{addr: net.JoinHostPort(u.Hostname(), port), config: cfg}
+	d.pool = &upstreamPool{stream: true, dial: d.dial}
+	return d, nil
+}
+
+func verifySPKIPins(certs []*x509.Certificate, pins [][]byte) error {
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+	}
+	return errors.New("no certificate matches the configured SPKI pins")
+}
+
+// spkiPin returns the pin for a certificate in the form tls:// upstreams accept.
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (d *dotUpstream) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: forwardTimeout}
+	return tls.DialWithDialer(dialer, "tcp", d.addr, d.config)
+}
+
+// forwardDoT looks up (or parses once) the TLS settings for upstream and
+// sends the query over it. Parsed upstreams are kept so their connection
+// carries later queries too, or its TLS session is resumed when it has
+// closed.
+func (s *DNSServer) forwardDoT(query []byte, upstream string) ([]byte, error) {
+	v, ok := s.dot.Load(upstream)
+	if !ok {
+		d, err := parseDoTUpstream(upstream)
+		if err != nil {
+			return nil, err
+		}
+		v, _ = s.dot.LoadOrStore(upstream, d)
+	}
+	return v.(*dotUpstream).pool.exchange(query)
+}
+
+// normalizeUpstream validates an upstream from the command line. Plain
+// addresses get port 53 when none is given; tls:// URLs are checked but
+// otherwise kept as written.
+func normalizeUpstream(upstream string) (string, error) {
+	if isDoTUpstream(upstream) {
+		_, err := parseDoTUpstream(upstream)
+		return upstream, err
+	}
+	if _, _, err := net.SplitHostPort(upstream); err == nil {
+		return upstream, nil
+	}
+	if net.ParseIP(upstream) == nil {
+		return "", fmt.Errorf("invalid upstream %q (want ip[:port] or tls://host[:port])", upstream)
+	}
+	return net.JoinHostPort(upstream, "53"), nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startDoTUpstream serves a scripted fake upstream over TLS with a fresh
+// self-signed certificate, returning its address and SPKI pin.
+func startDoTUpstream(t *testing.T, script string) (string, string) {
+	t.Helper()
+	rules, err := ParseFakeScript(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := NewFakeUpstream(rules)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		DNSNames:     []string{"dns.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				query, err := readTCPMessage(c)
+				if err != nil {
+					return
+				}
+				writeTCPMessage(c, fake.respond(query, true))
+			}()
+		}
+	}()
+	return ln.Addr().String(), spkiPin(cert)
+}
+
+func TestParseDoTUpstream(t *testing.T) {
+	d, err := parseDoTUpstream("tls://dns.example?sni=resolver.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.addr != "dns.example:853" || d.config.ServerName != "resolver.example" {
+		t.Errorf("addr=%s sni=%s", d.addr, d.config.ServerName)
+	}
+
+	for _, bad := range []string{
+		"tls://",
+		"tls://1.1.1.1/path",
+		"tls://1.1.1.1?pin=short",
+		"https://1.1.1.1",
+	} {
+		if _, err := parseDoTUpstream(bad); err == nil {
+			t.Errorf("parseDoTUpstream(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestNormalizeUpstream(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"1.1.1.1", "1.1.1.1:53", true},
+		{"1.1.1.1:5353", "1.1.1.1:5353", true},
+		{"2606:4700::1111", "[2606:4700::1111]:53", true},
+		{"tls://1.1.1.1", "tls://1.1.1.1", true},
+		{"resolver", "", false},
+	}
+	for _, tt := range tests {
+		got, err := normalizeUpstream(tt.in)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("normalizeUpstream(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestForwardDoT(t *testing.T) {
+	addr, pin := startDoTUpstream(t, `example.com A answer 93.184.216.34`)
+	dns := &DNSServer{}
+	query := buildTestQuery("example.com", 1, 1)
+
+	resp, err := dns.forwardTo(query, "tls://"+addr+"?pin="+pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp[0] != 0xAB || resp[1] != 0xCD || resp[7] != 1 {
+		t.Errorf("unexpected response % x", resp[:12])
+	}
+
+	// Self-signed and unpinned fails verification
+	if _, err := dns.forwardTo(query, "tls://"+addr+"?sni=dns.test"); err == nil {
+		t.Error("expected certificate verification failure")
+	}
+	wrong := strings.Repeat("A", 43) + "="
+	if _, err := dns.forwardTo(query, "tls://"+addr+"?pin="+wrong); err == nil {
+		t.Error("expected pin mismatch")
+	}
+}
+
+func TestUpstreamsPreferEncrypted(t *testing.T) {
+	u := NewUpstreams([]string{"10.0.0.1:53", "tls://10.0.0.2"})
+	u.Report("10.0.0.1:53", time.Millisecond, nil)
+	u.Report("tls://10.0.0.2", 50*time.Millisecond, nil)
+	if got := u.Ordered(); got[0] != "tls://10.0.0.2" {
+		t.Errorf("order = %v, want DoT first", got)
+	}
+
+	for range unhealthyAfter {
+		u.Report("tls://10.0.0.2", 0, net.ErrClosed)
+	}
+	if got := u.Ordered(); got[0] != "10.0.0.1:53" {
+		t.Errorf("order = %v, want plain fallback first", got)
+	}
+}
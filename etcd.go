@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultEtcdPrefix = "/regieleki/"
+	etcdTimeout       = 5 * time.Second
+	etcdRetry         = 5 * time.Second
+)
+
+// Etcd shares the record set between instances through etcd, using the v3
+// JSON gateway so no client library is needed. Every record is one key,
+// prefix+"records/"+ID, holding the Record as JSON. Changes made on this
+// instance are written to etcd before they are acknowledged, and a watch on
+// the prefix reloads the local copy whenever any instance changes it. The
+// local data file keeps the last copy seen, so an instance still starts and
+// answers while etcd is unreachable.
+type Etcd struct {
+	endpoint string
+	prefix   string
+	store    *Store
+	client   *http.Client // unary calls
+	watcher  *http.Client // the long-lived watch stream
+	resync   chan struct{}
+}
+
+func NewEtcd(endpoint, prefix string, store *Store) *Etcd {
+	if prefix == "" {
+		prefix = defaultEtcdPrefix
+	}
+	return &Etcd{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		prefix:   strings.TrimRight(prefix, "/") + "/records/",
+		store:    store,
+		client:   &http.Client{Timeout: etcdTimeout},
+		watcher:  &http.Client{},
+		resync:   make(chan struct{}, 1),
+	}
+}
+
+// prefixEnd is the range_end that selects every key starting with prefix.
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	end[len(end)-1]++
+	return end
+}
+
+func (e *Etcd) key(id int) []byte {
+	return []byte(e.prefix + strconv.Itoa(id))
+}
+
+// call posts a JSON request to a gateway endpoint and decodes the reply.
+func (e *Etcd) call(ctx context.Context, path string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, "POST", e.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	res, err := e.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("etcd %s: %s: %s", path, res.Status, bytes.TrimSpace(msg))
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+type etcdKV struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+// load reads every record under the prefix along with the revision they
+// were read at.
+func (e *Etcd) load(ctx context.Context) ([]Record, int64, error) {
+	var resp struct {
+		Header etcdHeader `json:"header"`
+		KVs    []etcdKV   `json:"kvs"`
+	}
+	req := map[string]any{"key": []byte(e.prefix), "range_end": prefixEnd(e.prefix)}
+	if err := e.call(ctx, "/v3/kv/range", req, &resp); err != nil {
+		return nil, 0, err
+	}
+	records := make([]Record, 0, len(resp.KVs))
+	for _, kv := range resp.KVs {
+		var r Record
+		if err := json.Unmarshal(kv.Value, &r); err != nil || string(e.key(r.ID)) != string(kv.Key) {
+			slog.Warn("skipping malformed etcd record", "key", string(kv.Key))
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, resp.Header.Revision, nil
+}
+
+// write stores a batch of changes in etcd. It is the Store's write-through
+// hook, so it runs with the store lock held. If it fails, the changes are
+// already in memory, so a reload is queued to bring the store back in line
+// with etcd.
+func (e *Etcd) write(changes []Change) error {
+	err := e.put(changes)
+	if err != nil {
+		select {
+		case e.resync <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+// put applies changes to etcd in a single transaction, so a batch lands
+// whole or not at all. New records are only created if their ID is still
+// free, which catches two instances adding at the same moment. etcd limits
+// a transaction to 128 operations by default (--max-txn-ops); larger
+// batches fail as a whole.
+func (e *Etcd) put(changes []Change) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	// etcd refuses a transaction touching a key twice, so only the last
+	// change to each record is sent
+	var keys []string
+	last := map[string]Change{}
+	var compare []any
+	for _, c := range changes {
+		id := c.Old
+		if c.New != nil {
+			id = c.New
+		}
+		key := string(e.key(id.ID))
+		if _, seen := last[key]; !seen {
+			keys = append(keys, key)
+			if c.Op == "add" {
+				compare = append(compare, map[string]any{"key": []byte(key), "target": "CREATE", "create_revision": "0"})
+			}
+		}
+		last[key] = c
+	}
+	success := make([]any, 0, len(keys))
+	for _, key := range keys {
+		c := last[key]
+		if c.Op == "delete" {
+			success = append(success, map[string]any{"request_delete_range": map[string]any{"key": []byte(key)}})
+			continue
+		}
+		value, _ := json.Marshal(c.New)
+		success = append(success, map[string]any{"request_put": map[string]any{"key": []byte(key), "value": value}})
+	}
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	txn := map[string]any{"compare": compare, "success": success}
+	if err := e.call(ctx, "/v3/kv/txn", txn, &resp); err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return errors.New("etcd: a new record's id is taken, try again")
+	}
+	return nil
+}
+
+// Start hooks the store up to write changes through and loads the shared
+// record set into it. If etcd holds no records yet, the local ones are
+// uploaded, so the first instance pointed at an empty etcd seeds it. When
+// etcd can't be reached the store keeps its local copy, and edits fail
+// until it is back.
+func (e *Etcd) Start(ctx context.Context) error {
+	e.store.SetRemote(e.write)
+	records, _, err := e.load(ctx)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		_, local := e.store.Snapshot()
+		for _, r := range local {
+			if err := e.put([]Change{{Op: "add", New: &r}}); err != nil {
+				return fmt.Errorf("seeding etcd: %w", err)
+			}
+		}
+		if len(local) > 0 {
+			slog.Info("seeded etcd with local records", "records", len(local))
+		}
+		return nil
+	}
+	return e.store.Replace(records)
+}
+
+// Run watches the prefix and reloads the store after every change until
+// ctx is done, reconnecting after failures.
+func (e *Etcd) Run(ctx context.Context) {
+	for {
+		err := e.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("etcd watch failed, retrying", "endpoint", e.endpoint, "error", err, "in", etcdRetry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(etcdRetry):
+		}
+	}
+}
+
+// reload replaces the store's records with etcd's and returns the revision
+// they were read at.
+func (e *Etcd) reload(ctx context.Context) (int64, error) {
+	records, rev, err := e.load(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return rev, e.store.Replace(records)
+}
+
+func (e *Etcd) watch(ctx context.Context) error {
+	rev, err := e.reload(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	body, _ := json.Marshal(map[string]any{"create_request": map[string]any{
+		"key":            []byte(e.prefix),
+		"range_end":      prefixEnd(e.prefix),
+		"start_revision": strconv.FormatInt(rev+1, 10),
+	}})
+	r, err := http.NewRequestWithContext(ctx, "POST", e.endpoint+"/v3/watch", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	res, err := e.watcher.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("etcd watch: %s", res.Status)
+	}
+
+	events := make(chan error, 1)
+	go func() {
+		send := func(err error) {
+			select {
+			case events <- err:
+			case <-ctx.Done():
+			}
+		}
+		dec := json.NewDecoder(res.Body)
+		for {
+			var msg struct {
+				Result struct {
+					Events   []json.RawMessage `json:"events"`
+					Canceled bool              `json:"canceled"`
+				} `json:"result"`
+				Error *struct {
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			if err := dec.Decode(&msg); err != nil {
+				send(err)
+				return
+			}
+			switch {
+			case msg.Error != nil:
+				send(errors.New(msg.Error.Message))
+				return
+			case msg.Result.Canceled:
+				send(errors.New("watch canceled"))
+				return
+			case len(msg.Result.Events) > 0:
+				send(nil)
+			}
+		}
+	}()
+	for {
+		select {
+		case err := <-events:
+			if err != nil {
+				return err
+			}
+		case <-e.resync:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if _, err := e.reload(ctx); err != nil {
+			return err
+		}
+	}
+}
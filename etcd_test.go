@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd implements the parts of the etcd v3 JSON gateway Etcd uses.
+type fakeEtcd struct {
+	mu       sync.Mutex
+	kvs      map[string][]byte
+	rev      int64
+	txns     int // transactions that succeeded
+	watchers []chan struct{}
+}
+
+func startFakeEtcd(t *testing.T) (*fakeEtcd, string) {
+	t.Helper()
+	f := &fakeEtcd{kvs: map[string][]byte{}}
+	mux := http.NewServeMux()
+	header := func() map[string]string {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return map[string]string{"revision": strconv.FormatInt(f.rev, 10)}
+	}
+	mux.HandleFunc("POST /v3/kv/range", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Key      []byte `json:"key"`
+			RangeEnd []byte `json:"range_end"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		h := header()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		var kvs []etcdKV
+		for k, v := range f.kvs {
+			if k >= string(req.Key) && k < string(req.RangeEnd) {
+				kvs = append(kvs, etcdKV{Key: []byte(k), Value: v})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"header": h, "kvs": kvs})
+	})
+	mux.HandleFunc("POST /v3/kv/put", func(w http.ResponseWriter, r *http.Request) {
+		var kv etcdKV
+		json.NewDecoder(r.Body).Decode(&kv)
+		f.set(string(kv.Key), kv.Value)
+		json.NewEncoder(w).Encode(map[string]any{"header": header()})
+	})
+	mux.HandleFunc("POST /v3/kv/deleterange", func(w http.ResponseWriter, r *http.Request) {
+		var kv etcdKV
+		json.NewDecoder(r.Body).Decode(&kv)
+		f.set(string(kv.Key), nil)
+		json.NewEncoder(w).Encode(map[string]any{"header": header()})
+	})
+	mux.HandleFunc("POST /v3/kv/txn", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Compare []etcdKV
+			Success []struct {
+				RequestPut         *etcdKV `json:"request_put"`
+				RequestDeleteRange *etcdKV `json:"request_delete_range"`
+			}
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.mu.Lock()
+		// Every compare Etcd sends is create_revision == 0: the key is free
+		succeeded := !slices.ContainsFunc(req.Compare, func(c etcdKV) bool { _, ok := f.kvs[string(c.Key)]; return ok })
+		f.mu.Unlock()
+		if succeeded {
+			f.txns++
+			for _, op := range req.Success {
+				if op.RequestPut != nil {
+					f.set(string(op.RequestPut.Key), op.RequestPut.Value)
+				} else {
+					f.set(string(op.RequestDeleteRange.Key), nil)
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"header": header(), "succeeded": succeeded})
+	})
+	mux.HandleFunc("POST /v3/watch", func(w http.ResponseWriter, r *http.Request) {
+		changed := make(chan struct{}, 16)
+		f.mu.Lock()
+		f.watchers = append(f.watchers, changed)
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"result": map[string]any{"created": true}})
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-changed:
+				json.NewEncoder(w).Encode(map[string]any{"result": map[string]any{"events": []any{map[string]any{}}}})
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return f, srv.URL
+}
+
+func (f *fakeEtcd) set(key string, value []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if value == nil {
+		delete(f.kvs, key)
+	} else {
+		f.kvs[key] = value
+	}
+	f.rev++
+	for _, c := range f.watchers {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func TestEtcdSharedRecords(t *testing.T) {
+	f, url := startFakeEtcd(t)
+	newStore := func() *Store {
+		s, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	// The first instance seeds the empty etcd with its records
+	a := newStore()
+	a.Add(Record{Domain: "app.my.lan", Type: "A", Value: "10.0.0.1"})
+	if err := NewEtcd(url, "", a).Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.kvs["/regieleki/records/1"]; !ok || len(f.kvs) != 1 {
+		t.Fatalf("etcd after seeding: %v", f.kvs)
+	}
+
+	// The second loads them and follows changes made on the first
+	b := newStore()
+	b.Add(Record{Domain: "stale.my.lan", Type: "A", Value: "10.0.0.9"})
+	eb := NewEtcd(url, "", b)
+	if err := eb.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if recs := b.List(); len(recs) != 1 || recs[0].Domain != "app.my.lan" {
+		t.Fatalf("second instance after start: %+v", recs)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go eb.Run(ctx)
+
+	added, err := a.Add(Record{Domain: "db.my.lan", Type: "AAAA", Value: "fd00::5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for !slices.ContainsFunc(b.List(), func(r Record) bool { return r.Domain == "db.my.lan" }) {
+		if time.Now().After(deadline) {
+			t.Fatalf("second instance never saw the new record: %+v", b.List())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Adding under an ID another instance took concurrently fails
+	f.set("/regieleki/records/"+strconv.Itoa(added.ID+1), []byte(`{"id":3,"domain":"x.my.lan","type":"A","value":"10.0.0.3"}`))
+	if _, err := a.Add(Record{Domain: "y.my.lan", Type: "A", Value: "10.0.0.4"}); err == nil {
+		t.Error("add with a taken ID succeeded")
+	}
+}
+
+func TestEtcdBatchIsOneTransaction(t *testing.T) {
+	f, url := startFakeEtcd(t)
+	s, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewEtcd(url, "", s).Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := s.Add(Record{Domain: "old.my.lan", Type: "A", Value: "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txns := f.txns
+	ops := []BatchOp{
+		{Op: "create", Record: Record{Domain: "a.my.lan", Type: "A", Value: "10.0.0.2"}},
+		{Op: "update", ID: rec.ID, Record: Record{Domain: "old.my.lan", Type: "A", Value: "10.0.0.3"}},
+		{Op: "delete", ID: rec.ID},
+	}
+	if _, err := s.Batch(ops); err != nil {
+		t.Fatal(err)
+	}
+	if f.txns != txns+1 || len(f.kvs) != 1 {
+		t.Errorf("batch took %d transactions, leaving %v", f.txns-txns, f.kvs)
+	}
+
+	// A batch whose new record's ID was taken meanwhile changes nothing
+	f.set("/regieleki/records/3", []byte(`{"id":3,"domain":"x.my.lan","type":"A","value":"10.0.0.9"}`))
+	before := len(f.kvs)
+	ops = []BatchOp{
+		{Op: "delete", ID: 2},
+		{Op: "create", Record: Record{Domain: "b.my.lan", Type: "A", Value: "10.0.0.4"}},
+	}
+	if _, err := s.Batch(ops); err == nil {
+		t.Error("batch with a taken ID succeeded")
+	}
+	if _, ok := f.kvs["/regieleki/records/2"]; !ok || len(f.kvs) != before {
+		t.Errorf("failed batch changed etcd: %v", f.kvs)
+	}
+}
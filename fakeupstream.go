@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// FakeRule scripts how the fake upstream answers one (name, type) pair.
+// Name "*" and Type 0 match anything.
+type FakeRule struct {
+	Name    string
+	Type    uint16
+	Action  string // "answer", "servfail", "nxdomain", "refused", "drop", "truncate"
+	Delay   time.Duration
+	TTL     uint32
+	Answers []Record
+}
+
+// FakeUpstream is a deterministic DNS server driven by a script, used to test
+// forwarding, caching, and failover hermetically.
+type FakeUpstream struct {
+	conn    *net.UDPConn
+	ln      net.Listener
+	rules   []FakeRule
+	queries atomic.Int64
+	ready   chan struct{}
+	mu      sync.Mutex
+	closed  bool
+}
+
+func NewFakeUpstream(rules []FakeRule) *FakeUpstream {
+	return &FakeUpstream{rules: rules, ready: make(chan struct{})}
+}
+
+// ParseFakeScript reads rules, one per line:
+//
+//	<name|*> <type|*> [delay <duration>] <action> [args...]
+//
+// where action is one of:
+//
+//	answer <value> [ttl]   repeated lines accumulate answers
+//	servfail | nxdomain | refused | drop | truncate
+//
+// truncate only applies over UDP; TCP queries skip it and use the next
+// matching rule, which is how an oversized answer is scripted.
+func ParseFakeScript(r io.Reader) ([]FakeRule, error) {
+	var rules []FakeRule
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		f := strings.Fields(text)
+		if len(f) < 3 {
+			return nil, fmt.Errorf("line %d: expected <name> <type> <action>", line)
+		}
+		rule := FakeRule{Name: strings.ToLower(strings.TrimSuffix(f[0], ".")), TTL: 60}
+		if f[1] != "*" {
+			qt, ok := parseType(f[1])
+			if !ok {
+				return nil, fmt.Errorf("line %d: unknown type %q", line, f[1])
+			}
+			rule.Type = qt
+		}
+		args := f[2:]
+		if args[0] == "delay" {
+			if len(args) < 3 {
+				return nil, fmt.Errorf("line %d: delay needs a duration and an action", line)
+			}
+			d, err := time.ParseDuration(args[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			rule.Delay = d
+			args = args[2:]
+		}
+		rule.Action = strings.ToLower(args[0])
+		switch rule.Action {
+		case "answer":
+			if len(args) < 2 || rule.Type == 0 || rule.Name == "*" {
+				return nil, fmt.Errorf("line %d: answer needs a concrete name, type, and value", line)
+			}
+			if len(args) > 2 {
+				ttl, err := strconv.ParseUint(args[2], 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid ttl %q", line, args[2])
+				}
+				rule.TTL = uint32(ttl)
+			}
+			rec := Record{Domain: rule.Name, Type: strings.ToUpper(f[1]), Value: args[1]}
+			// Merge with the previous line for the same name and type
+			if n := len(rules); n > 0 && rules[n-1].Action == "answer" &&
+				rules[n-1].Name == rule.Name && rules[n-1].Type == rule.Type {
+				rules[n-1].Answers = append(rules[n-1].Answers, rec)
+				continue
+			}
+			rule.Answers = []Record{rec}
+		case "servfail", "nxdomain", "refused", "drop", "truncate":
+		default:
+			return nil, fmt.Errorf("line %d: unknown action %q", line, rule.Action)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, sc.Err()
+}
+
+func (f *FakeUpstream) ListenAndServe(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	// TCP shares the UDP port so clients can retry truncated answers
+	ln, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	f.mu.Lock()
+	f.conn = conn
+	f.ln = ln
+	f.mu.Unlock()
+	close(f.ready)
+	go f.serveTCP(ln)
+
+	buf := make([]byte, udpBufSize)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			f.mu.Lock()
+			closed := f.closed
+			f.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := f.respond(query, false); resp != nil {
+				conn.WriteToUDP(resp, remote)
+			}
+		}()
+	}
+}
+
+func (f *FakeUpstream) serveTCP(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			for {
+				query, err := readTCPMessage(c)
+				if err != nil {
+					return
+				}
+				resp := f.respond(query, true)
+				if resp == nil {
+					return
+				}
+				if err := writeTCPMessage(c, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Addr returns the bound address once ListenAndServe is running.
+func (f *FakeUpstream) Addr() string {
+	<-f.ready
+	return f.conn.LocalAddr().String()
+}
+
+// Queries reports how many queries have been received.
+func (f *FakeUpstream) Queries() int {
+	return int(f.queries.Load())
+}
+
+func (f *FakeUpstream) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	if f.conn != nil {
+		f.conn.Close()
+		f.ln.Close()
+	}
+}
+
+func (f *FakeUpstream) match(qname string, qtype uint16, tcp bool) (FakeRule, bool) {
+	qname = strings.ToLower(qname)
+	for _, r := range f.rules {
+		if tcp && r.Action == "truncate" {
+			continue
+		}
+		if (r.Name == "*" || r.Name == qname) && (r.Type == 0 || r.Type == qtype) {
+			return r, true
+		}
+	}
+	return FakeRule{}, false
+}
+
+func (f *FakeUpstream) respond(query []byte, tcp bool) []byte {
+	f.queries.Add(1)
+	if len(query) < 12 {
+		return nil
+	}
+	qname, offset := parseDNSName(query, 12)
+	if offset < 0 || offset+4 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[offset:])
+	questionEnd := offset + 4
+
+	rule, ok := f.match(qname, qtype, tcp)
+	if !ok {
+		rule = FakeRule{Action: "nxdomain"}
+	}
+	if rule.Delay > 0 {
+		time.Sleep(rule.Delay)
+	}
+
+	var resp []byte
+	switch rule.Action {
+	case "answer":
+		resp = buildDNSResponse(query[:questionEnd], questionEnd, rule.Answers)
+		offsets, _, _ := rrTTLOffsets(resp)
+		for _, off := range offsets {
+			binary.BigEndian.PutUint32(resp[off:], rule.TTL)
+		}
+	case "servfail":
+		resp = buildServFail(query, questionEnd)
+	case "nxdomain":
+		resp = buildNXDomain(query, questionEnd)
+	case "refused":
+		resp = buildServFail(query, questionEnd)
+		resp[3] = resp[3]&0xF0 | 5
+	case "truncate":
+		resp = buildDNSResponse(query[:questionEnd], questionEnd, nil)
+		resp[2] |= 0x02
+	case "drop":
+		return nil
+	}
+	// Upstream resolvers are not authoritative for forwarded names
+	resp[2] &^= 0x04
+	return resp
+}
+
+func handleFakeUpstream(args []string) {
+	fs := flag.NewFlagSet("fake-upstream", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:5300", "UDP and TCP listen address")
+	script := fs.String("script", "", "Path to the answer script (empty answers NXDOMAIN to everything)")
+	fs.Parse(args)
+
+	var rules []FakeRule
+	if *script != "" {
+		file, err := os.Open(*script)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		rules, err = ParseFakeScript(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: %v\n", *script, err)
+			os.Exit(1)
+		}
+	}
+
+	fake := NewFakeUpstream(rules)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		fake.Close()
+	}()
+	slog.Info("fake upstream listening", "addr", *listen, "rules", len(rules))
+	if err := fake.ListenAndServe(*listen); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
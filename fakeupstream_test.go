@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startFakeUpstream runs a scripted upstream on a random local port.
+func startFakeUpstream(t *testing.T, script string) *FakeUpstream {
+	t.Helper()
+	rules, err := ParseFakeScript(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := NewFakeUpstream(rules)
+	// The TCP port matching a random UDP port may be taken; try another
+	for range 5 {
+		failed := make(chan error, 1)
+		go func() { failed <- fake.ListenAndServe("127.0.0.1:0") }()
+		select {
+		case <-fake.ready:
+			t.Cleanup(fake.Close)
+			return fake
+		case err := <-failed:
+			t.Logf("listen: %v", err)
+		}
+	}
+	t.Fatal("no free port for the fake upstream")
+	return nil
+}
+
+// exchange sends a query over UDP and returns the response.
+func exchange(t *testing.T, addr string, query []byte) []byte {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, udpBufSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestParseFakeScript(t *testing.T) {
+	script := `
+# comment
+example.com A answer 93.184.216.34 300
+example.com A answer 93.184.216.35
+slow.com * delay 50ms servfail
+* * nxdomain
+`
+	rules, err := ParseFakeScript(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("expected 3 rules, got %d", len(rules))
+	}
+	if len(rules[0].Answers) != 2 || rules[0].TTL != 300 {
+		t.Errorf("answer rule = %+v", rules[0])
+	}
+	if rules[1].Delay != 50*time.Millisecond || rules[1].Action != "servfail" || rules[1].Type != 0 {
+		t.Errorf("delay rule = %+v", rules[1])
+	}
+
+	for _, bad := range []string{"x.com A", "x.com BOGUS servfail", "x.com A explode", "* A answer 1.2.3.4", "x.com A delay soon servfail"} {
+		if _, err := ParseFakeScript(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseFakeScript(%q) expected error", bad)
+		}
+	}
+}
+
+func TestFakeUpstreamResponses(t *testing.T) {
+	fake := startFakeUpstream(t, `
+example.com A answer 93.184.216.34 300
+broken.com A servfail
+big.com A truncate
+`)
+
+	resp := exchange(t, fake.Addr(), buildTestQuery("example.com", 1, 1))
+	if resp[3]&0x0F != 0 || int(resp[7]) != 1 {
+		t.Errorf("answer: rcode=%d ancount=%d", resp[3]&0x0F, resp[7])
+	}
+	_, minTTL, _ := rrTTLOffsets(resp)
+	if minTTL != 300 {
+		t.Errorf("TTL = %d, want 300", minTTL)
+	}
+
+	resp = exchange(t, fake.Addr(), buildTestQuery("broken.com", 1, 1))
+	if resp[3]&0x0F != 2 {
+		t.Errorf("servfail: rcode = %d", resp[3]&0x0F)
+	}
+
+	resp = exchange(t, fake.Addr(), buildTestQuery("big.com", 1, 1))
+	if resp[2]&0x02 == 0 {
+		t.Error("truncate: TC bit not set")
+	}
+
+	resp = exchange(t, fake.Addr(), buildTestQuery("unscripted.com", 1, 1))
+	if resp[3]&0x0F != 3 {
+		t.Errorf("default: rcode = %d, want NXDOMAIN", resp[3]&0x0F)
+	}
+
+	if fake.Queries() != 4 {
+		t.Errorf("Queries = %d, want 4", fake.Queries())
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"slices"
+	"sync"
+)
+
+// flights coalesces identical upstream queries: while one for a name and
+// type is being forwarded, others for it wait for that answer instead of
+// sending their own. After a cache flush or a popular entry expiring, the
+// upstream then sees one query rather than one per client.
+type flights struct {
+	mu    sync.Mutex
+	calls map[cacheKey]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	resp []byte // nil if every upstream failed
+}
+
+// do calls forward for key unless a call for it is already in flight, in
+// which case it waits for that one's response. shared reports the latter.
+// The response is the caller's own to modify.
+func (f *flights) do(key cacheKey, forward func() []byte) (resp []byte, shared bool) {
+	f.mu.Lock()
+	if c, ok := f.calls[key]; ok {
+		f.mu.Unlock()
+		<-c.done
+		return slices.Clone(c.resp), true
+	}
+	if f.calls == nil {
+		f.calls = make(map[cacheKey]*flight)
+	}
+	c := &flight{done: make(chan struct{})}
+	f.calls[key] = c
+	f.mu.Unlock()
+
+	c.resp = forward()
+	f.mu.Lock()
+	delete(f.calls, key)
+	f.mu.Unlock()
+	close(c.done)
+	// Waiters are copying it, so the caller gets a copy too
+	return slices.Clone(c.resp), false
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestDNSCoalescesUpstreamQueries(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := startFakeUpstream(t, "popular.com A delay 200ms answer 93.184.216.34\n")
+	dns := NewDNSServer(store, []string{fake.Addr()})
+	dns.metrics = NewMetrics()
+	addr := startDNSServer(t, dns)
+
+	var wg sync.WaitGroup
+	for i := range 5 {
+		wg.Go(func() {
+			// Each client spells the name its own way and uses its own ID
+			name := "popular.com"
+			if i%2 == 1 {
+				name = "POPULAR.com"
+			}
+			query := buildTestQuery(name, 1, 1)
+			query[0], query[1] = byte(i), byte(i)
+			resp := exchange(t, addr, query)
+			if resp[0] != byte(i) || resp[1] != byte(i) {
+				t.Errorf("client %d: ID = %x%x", i, resp[0], resp[1])
+			}
+			if got, _ := parseDNSName(resp, 12); got != name {
+				t.Errorf("client %d: question name = %q, want %q", i, got, name)
+			}
+			if resp[3]&0x0F != 0 || resp[7] != 1 {
+				t.Errorf("client %d: rcode=%d ancount=%d", i, resp[3]&0x0F, resp[7])
+			}
+		})
+	}
+	wg.Wait()
+
+	if fake.Queries() != 1 {
+		t.Errorf("upstream queries = %d, want 1", fake.Queries())
+	}
+	if got := dns.metrics.coalesced.Load(); got != 4 {
+		t.Errorf("coalesced = %d, want 4", got)
+	}
+}
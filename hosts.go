@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultHostsSchedule = "@every 5s"
+
+// HostsSync mirrors hosts-format files as read-only records, so names that
+// other tooling already writes to /etc/hosts or similar files resolve for
+// the whole network. Each file is its own source, "hosts:<path>", and is
+// only re-read when its modification time or size changes.
+type HostsSync struct {
+	paths []string
+	store *Store
+
+	mu     sync.Mutex
+	stamps map[string]hostsStamp
+}
+
+type hostsStamp struct {
+	mtime time.Time
+	size  int64
+}
+
+func NewHostsSync(store *Store, paths []string) *HostsSync {
+	return &HostsSync{paths: paths, store: store, stamps: make(map[string]hostsStamp)}
+}
+
+// Run re-reads every file that changed since the last run. A file that
+// can't be read keeps its previous records; one that was removed drops them.
+func (h *HostsSync) Run(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var errs []error
+	for _, path := range h.paths {
+		if err := h.sync(ctx, path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h *HostsSync) sync(ctx context.Context, path string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if _, ok := h.stamps[path]; ok {
+			delete(h.stamps, path)
+			h.store.SetSource("hosts:"+path, nil)
+			slog.WarnContext(ctx, "hosts file removed", "path", path)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	stamp := hostsStamp{info.ModTime(), info.Size()}
+	if prev, ok := h.stamps[path]; ok && prev == stamp {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	records, err := parseHosts(f)
+	if err != nil {
+		return err
+	}
+	h.stamps[path] = stamp
+	h.store.SetSource("hosts:"+path, records)
+	slog.InfoContext(ctx, "hosts file loaded", "path", path, "records", len(records))
+	return nil
+}
+
+// parseHosts reads "address name [alias...]" lines into A and AAAA records
+// for each name. Entries for the local machine are skipped: loopback and
+// unspecified addresses (the latter is how hosts files block names), and
+// the usual localhost names.
+func parseHosts(r io.Reader) ([]Record, error) {
+	var records []Record
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil || addr.Zone() != "" || addr.IsLoopback() || addr.IsUnspecified() {
+			continue
+		}
+		addr = addr.Unmap()
+		rtype := "A"
+		if addr.Is6() {
+			rtype = "AAAA"
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if name == "" || blocklistIgnored[name] {
+				continue
+			}
+			records = append(records, Record{Domain: name, Type: rtype, Value: addr.String()})
+		}
+	}
+	return records, sc.Err()
+}
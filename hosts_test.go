@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHosts(t *testing.T) {
+	input := `
+# comment
+127.0.0.1   localhost
+127.0.1.1   workstation
+::1         localhost ip6-localhost
+0.0.0.0     ads.example.com
+192.168.1.5 nas.home.lan nas  # trailing comment
+fd00::5     NAS.home.lan.
+fe80::1%eth0 router.home.lan
+bogus       line
+`
+	records, err := parseHosts(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range records {
+		got = append(got, r.Domain+" "+r.Type+" "+r.Value)
+	}
+	want := []string{"nas.home.lan A 192.168.1.5", "nas A 192.168.1.5", "nas.home.lan AAAA fd00::5"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("records:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestHostsSync(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(filepath.Join(dir, "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "hosts")
+	os.WriteFile(path, []byte("10.0.0.1 app.my.lan\n"), 0o644)
+	h := NewHostsSync(store, []string{path})
+	ctx := context.Background()
+
+	if err := h.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	recs, ok := store.Resolve("app.my.lan", 1)
+	if !ok || len(recs) != 1 || recs[0].Source != "hosts:"+path {
+		t.Fatalf("after first sync: %+v", recs)
+	}
+
+	// A changed file is picked up on the next run
+	os.WriteFile(path, []byte("10.0.0.2 app.my.lan\n10.0.0.3 db.my.lan\n"), 0o644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	if err := h.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if recs, _ := store.Resolve("app.my.lan", 1); len(recs) != 1 || recs[0].Value != "10.0.0.2" {
+		t.Errorf("after change: %+v", recs)
+	}
+	if recs, _ := store.Resolve("db.my.lan", 1); len(recs) != 1 {
+		t.Errorf("new host missing: %+v", recs)
+	}
+
+	// Removing the file removes its records
+	os.Remove(path)
+	if err := h.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.List()) != 0 {
+		t.Errorf("records left after the file was removed: %+v", store.List())
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Punycode parameters (RFC 3492 §5).
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+const acePrefix = "xn--"
+
+// toASCII converts a domain name with Unicode labels to the xn-- form
+// queries carry, so "café.local" becomes "xn--caf-dma.local". Unicode
+// labels are lowercased first; ASCII labels are left alone. This covers
+// what people type into the UI, not full IDNA2008: names are not
+// NFC-normalized, which only matters for input in decomposed form.
+func toASCII(name string) (string, error) {
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '。', '．', '｡': // ideographic and fullwidth full stops
+			return '.'
+		}
+		return r
+	}, name)
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		if !utf8.ValidString(label) {
+			return "", errors.New("invalid UTF-8")
+		}
+		encoded, err := punyEncode(strings.ToLower(label))
+		if err != nil {
+			return "", err
+		}
+		if labels[i] = acePrefix + encoded; len(labels[i]) > 63 {
+			return "", errors.New("label too long")
+		}
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// toUnicode converts xn-- labels back to Unicode for display. Labels that
+// don't decode are kept as they are.
+func toUnicode(name string) string {
+	if !strings.Contains(strings.ToLower(name), acePrefix) {
+		return name
+	}
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if len(label) > len(acePrefix) && strings.EqualFold(label[:len(acePrefix)], acePrefix) {
+			if decoded, err := punyDecode(strings.ToLower(label[len(acePrefix):])); err == nil {
+				labels[i] = decoded
+			}
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+func isASCII(s string) bool {
+	for i := range len(s) {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > (punyBase-punyTMin)*punyTMax/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyThreshold(k, bias int) int {
+	return min(max(k-bias, punyTMin), punyTMax)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+var errPunycode = errors.New("invalid punycode")
+
+// punyEncode encodes a Unicode label without the xn-- prefix.
+func punyEncode(label string) (string, error) {
+	input := []rune(label)
+	var out []byte
+	for _, r := range input {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	if basic > 0 {
+		out = append(out, '-')
+	}
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for h := basic; h < len(input); {
+		m := rune(math.MaxInt32)
+		for _, r := range input {
+			if r >= rune(n) && r < m {
+				m = r
+			}
+		}
+		if int(m)-n > (math.MaxInt32-delta)/(h+1) {
+			return "", errPunycode
+		}
+		delta += (int(m) - n) * (h + 1)
+		n = int(m)
+		for _, r := range input {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == basic)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+// punyDecode decodes a label without the xn-- prefix.
+func punyDecode(s string) (string, error) {
+	var out []rune
+	if pos := strings.LastIndexByte(s, '-'); pos >= 0 {
+		for _, c := range []byte(s[:pos]) {
+			if c >= utf8.RuneSelf {
+				return "", errPunycode
+			}
+			out = append(out, rune(c))
+		}
+		s = s[pos+1:]
+	}
+	n, i, bias := punyInitialN, 0, punyInitialBias
+	for len(s) > 0 {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if len(s) == 0 {
+				return "", errPunycode
+			}
+			var d int
+			switch c := s[0]; {
+			case 'a' <= c && c <= 'z':
+				d = int(c - 'a')
+			case '0' <= c && c <= '9':
+				d = int(c-'0') + 26
+			default:
+				return "", errPunycode
+			}
+			s = s[1:]
+			if d > (math.MaxInt32-i)/w {
+				return "", errPunycode
+			}
+			i += d * w
+			t := punyThreshold(k, bias)
+			if d < t {
+				break
+			}
+			w *= punyBase - t
+		}
+		bias = punyAdapt(i-oldi, len(out)+1, oldi == 0)
+		n += i / (len(out) + 1)
+		if n > unicode.MaxRune {
+			return "", errPunycode
+		}
+		i %= len(out) + 1
+		out = append(out[:i], append([]rune{rune(n)}, out[i:]...)...)
+		i++
+	}
+	return string(out), nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestPunycode(t *testing.T) {
+	tests := []struct{ unicode, ascii string }{
+		{"café.local", "xn--caf-dma.local"},
+		{"bücher.my.lan", "xn--bcher-kva.my.lan"},
+		{"münchen", "xn--mnchen-3ya"},
+		{"правда.lan", "xn--80aafi6cg.lan"},
+		{"app.my.lan", "app.my.lan"},
+	}
+	for _, tt := range tests {
+		got, err := toASCII(tt.unicode)
+		if err != nil || got != tt.ascii {
+			t.Errorf("toASCII(%q) = %q, %v, want %q", tt.unicode, got, err, tt.ascii)
+		}
+		if back := toUnicode(tt.ascii); back != tt.unicode {
+			t.Errorf("toUnicode(%q) = %q, want %q", tt.ascii, back, tt.unicode)
+		}
+	}
+
+	if got, _ := toASCII("CAFÉ。Local"); got != "xn--caf-dma.Local" {
+		t.Errorf("toASCII folds case and full stops: got %q", got)
+	}
+	for _, s := range []string{"日本語", "ﬁ-é-✓", "ü-ü"} {
+		ascii, err := toASCII(s + ".lan")
+		if err != nil || toUnicode(ascii) != s+".lan" {
+			t.Errorf("round trip of %q: %q, %v", s, ascii, err)
+		}
+	}
+	if got := toUnicode("xn--!!.lan"); got != "xn--!!.lan" {
+		t.Errorf("invalid punycode should be left alone, got %q", got)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// qtypes maps the record types Resolve answers by type to their query type.
+// Other types are only returned for ANY.
+var qtypes = map[string]uint16{"A": 1, "CNAME": 5, "TXT": 16, "AAAA": 28, "SVCB": 64, "HTTPS": 65}
+
+// recordIndex is what lookups read: every name's records, split by view and
+// grouped by the query type they answer, so answering is a few map reads
+// whatever else the name has. It is built whole on every change and never
+// modified after.
+type recordIndex map[string]*indexedName
+
+type indexedName struct {
+	shared rrsets             // the records without a view
+	views  map[string]*rrsets // the records bound to each view, if any
+	count  int
+	until  time.Time // when the last record expires; zero if one never does
+}
+
+// rrsets are the records of one name as one view sees them.
+type rrsets struct {
+	all    []Record // in store order, for ANY
+	byType map[uint16][]Record
+	until  time.Time
+}
+
+func buildIndex(records []Record) recordIndex {
+	idx := make(recordIndex)
+	for _, r := range records {
+		if r.Disabled {
+			continue
+		}
+		key := strings.ToLower(r.Domain)
+		n := idx[key]
+		if n == nil {
+			n = &indexedName{}
+			idx[key] = n
+		}
+		set := &n.shared
+		if r.View != "" {
+			if n.views == nil {
+				n.views = make(map[string]*rrsets)
+			}
+			if set = n.views[r.View]; set == nil {
+				set = &rrsets{}
+				n.views[r.View] = set
+			}
+		}
+		set.all = append(set.all, r)
+		set.until = lastExpiry(set.until, len(set.all) == 1, r.Expires)
+		if qtype, ok := qtypes[r.Type]; ok {
+			if set.byType == nil {
+				set.byType = make(map[uint16][]Record)
+			}
+			set.byType[qtype] = append(set.byType[qtype], r)
+		}
+		n.count++
+		n.until = lastExpiry(n.until, n.count == 1, r.Expires)
+	}
+	return idx
+}
+
+// lastExpiry folds a record's expiry into until, the last among those
+// before it, where first says there were none.
+func lastExpiry(until time.Time, first bool, expires time.Time) time.Time {
+	if first {
+		return expires
+	}
+	if until.IsZero() || expires.IsZero() {
+		return time.Time{}
+	}
+	if expires.After(until) {
+		return expires
+	}
+	return until
+}
+
+func live(until, now time.Time) bool {
+	return until.IsZero() || now.Before(until)
+}
+
+// lookup returns the records of name that a listener bound to view sees:
+// those in the view if it has any left, else those without a view. It
+// reports false when the name has no records, or only expired ones. The
+// records may still include expired ones, for the caller to drop.
+func (idx recordIndex) lookup(name, view string, now time.Time) (*rrsets, bool) {
+	n := idx[name]
+	if n == nil || !live(n.until, now) {
+		return nil, false
+	}
+	if own := n.views[view]; own != nil && live(own.until, now) {
+		return own, true
+	}
+	return &n.shared, true
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIndexLookup(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	idx := buildIndex([]Record{
+		{Domain: "NAS.local", Type: "A", Value: "192.168.1.5"},
+		{Domain: "nas.local", Type: "A", Value: "100.64.0.5", View: "tailnet", Expires: now.Add(time.Hour)},
+		{Domain: "nas.local", Type: "TXT", Value: "hello"},
+		{Domain: "vpn.local", Type: "A", Value: "100.64.0.6", View: "tailnet"},
+		{Domain: "old.local", Type: "A", Value: "10.0.0.1", Expires: now},
+		{Domain: "off.local", Type: "A", Value: "10.0.0.2", Disabled: true},
+	})
+
+	for _, tt := range []struct {
+		name, view string
+		at         time.Time
+		ok         bool
+		want       []string // values of the A records seen
+	}{
+		{"nas.local", "", now, true, []string{"192.168.1.5"}},
+		{"nas.local", "tailnet", now, true, []string{"100.64.0.5"}},
+		// Once the view's own records expire, the shared ones show through
+		{"nas.local", "tailnet", now.Add(time.Hour), true, []string{"192.168.1.5"}},
+		// A name only in another view is still ours, with nothing to see
+		{"vpn.local", "lan", now, true, nil},
+		{"old.local", "", now, false, nil},
+		{"off.local", "", now, false, nil},
+		{"missing.local", "", now, false, nil},
+	} {
+		set, ok := idx.lookup(tt.name, tt.view, tt.at)
+		if ok != tt.ok {
+			t.Errorf("%s in %q: ok = %t, want %t", tt.name, tt.view, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		var got []string
+		for _, r := range set.byType[1] {
+			got = append(got, r.Value)
+		}
+		if len(got) != len(tt.want) || len(got) > 0 && got[0] != tt.want[0] {
+			t.Errorf("%s in %q: A = %v, want %v", tt.name, tt.view, got, tt.want)
+		}
+	}
+	if set, _ := idx.lookup("nas.local", "", now); len(set.all) != 2 || len(set.byType[16]) != 1 {
+		t.Errorf("nas.local: all = %d records, TXT = %d", len(set.all), len(set.byType[16]))
+	}
+}
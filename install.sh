@@ -132,9 +132,13 @@ handle_port53_conflict() {
   fi
 }
 
+# The token file only keeps a hash, so a new token is printed in the summary
+# and can't be shown again afterwards
+API_TOKEN=""
+
 generate_token() {
   if [ ! -f "${DATA_DIR}/token" ]; then
-    "${INSTALL_DIR}/${BINARY}" access-token -token "${DATA_DIR}/token" >/dev/null
+    API_TOKEN="$("${INSTALL_DIR}/${BINARY}" access-token -token "${DATA_DIR}/token")"
     ok "API token generated at ${DATA_DIR}/token"
   fi
 }
@@ -194,7 +198,11 @@ print_summary() {
   printf "  DNS:       %s:53\n" "$ip"
   printf "\n"
   printf "  Data file: %s/records.tsv\n" "$DATA_DIR"
-  printf "  API Token: regieleki access-token -token %s/token\n" "$DATA_DIR"
+  if [ -n "$API_TOKEN" ]; then
+    printf "  API Token: %s (shown only now; keep it safe)\n" "$API_TOKEN"
+  else
+    printf "  API Token: lost it? regieleki access-token reset -token %s/token\n" "$DATA_DIR"
+  fi
   printf "  Service:   systemctl {status|stop|restart} regieleki\n"
   printf "  Logs:      journalctl -u regieleki -f\n"
   printf "\n"
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultInterfaceSchedule = "@every 5s"
+
+// InterfaceListener serves DNS on every address of one network interface,
+// following the addresses as they come and go (a DHCP lease moving, an
+// IPv6 prefix changing). Unlike a wildcard listener it doesn't answer on
+// the host's other interfaces, and unlike a fixed address it survives a
+// renumbering. IPv4 and IPv6 link-local addresses are left out.
+type InterfaceListener struct {
+	dns      *DNSServer
+	name     string
+	port     int
+	view     string
+	onListen func() // called after the first sync, whatever it bound
+
+	mu     sync.Mutex
+	bound  map[netip.Addr]*ifaceSockets
+	synced bool
+	// addrs reads the interface's addresses; tests replace it
+	addrs func(name string) ([]netip.Addr, error)
+}
+
+type ifaceSockets struct {
+	conns []*net.UDPConn
+	ln    net.Listener
+}
+
+// ParseInterfaceListener reads a -dns-interface value, name[:port][=view].
+func ParseInterfaceListener(dns *DNSServer, spec string) (*InterfaceListener, error) {
+	spec, view, _ := strings.Cut(spec, "=")
+	name, port := spec, 53
+	if i := strings.LastIndexByte(spec, ':'); i >= 0 {
+		p, err := strconv.Atoi(spec[i+1:])
+		if err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("invalid port in -dns-interface %q", spec)
+		}
+		name, port = spec[:i], p
+	}
+	if name == "" {
+		return nil, errors.New("-dns-interface needs an interface name")
+	}
+	return &InterfaceListener{
+		dns:   dns,
+		name:  name,
+		port:  port,
+		view:  view,
+		bound: make(map[netip.Addr]*ifaceSockets),
+		addrs: interfaceAddrs,
+	}, nil
+}
+
+func interfaceAddrs(name string) ([]netip.Addr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var out []netip.Addr
+	for _, a := range addrs {
+		prefix, err := netip.ParsePrefix(a.String())
+		if err != nil {
+			continue
+		}
+		if addr := prefix.Addr().Unmap(); !addr.IsLinkLocalUnicast() {
+			out = append(out, addr)
+		}
+	}
+	return out, nil
+}
+
+// Run binds the interface's new addresses and closes the listeners of the
+// ones it no longer has. An address that can't be bound yet, such as an
+// IPv6 address still being checked for duplicates, is retried next run.
+func (l *InterfaceListener) Run(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer func() {
+		if !l.synced {
+			l.synced = true
+			if l.onListen != nil {
+				l.onListen()
+			}
+		}
+	}()
+
+	addrs, err := l.addrs(l.name)
+	if err != nil {
+		// A missing interface has no addresses to serve
+		addrs = nil
+		if len(l.bound) > 0 || !l.synced {
+			slog.WarnContext(ctx, "dns interface unavailable", "interface", l.name, "error", err)
+		}
+	}
+	for addr, socks := range l.bound {
+		if !slices.Contains(addrs, addr) {
+			slog.InfoContext(ctx, "dns interface address removed", "interface", l.name, "addr", addr)
+			l.dns.unlisten(socks.conns, socks.ln)
+			delete(l.bound, addr)
+		}
+	}
+	var failed []error
+	for _, addr := range addrs {
+		if l.bound[addr] != nil {
+			continue
+		}
+		conns, ln, err := l.dns.listen(netip.AddrPortFrom(addr, uint16(l.port)).String())
+		if err != nil {
+			failed = append(failed, err)
+			continue
+		}
+		l.bound[addr] = &ifaceSockets{conns, ln}
+		go func() {
+			if err := l.dns.serve(conns, ln, l.view); err != nil && !errors.Is(err, net.ErrClosed) {
+				slog.Error("dns interface listener stopped", "interface", l.name, "addr", addr, "error", err)
+			}
+		}()
+	}
+	return errors.Join(failed...)
+}
+
+// Addrs lists the addresses currently served.
+func (l *InterfaceListener) Addrs() []netip.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []netip.Addr
+	for addr := range l.bound {
+		out = append(out, addr)
+	}
+	slices.SortFunc(out, func(a, b netip.Addr) int { return a.Compare(b) })
+	return out
+}
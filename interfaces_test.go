@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseInterfaceListener(t *testing.T) {
+	l, err := ParseInterfaceListener(nil, "eth0:5353=lan")
+	if err != nil || l.name != "eth0" || l.port != 5353 || l.view != "lan" {
+		t.Errorf("got %+v, %v", l, err)
+	}
+	if l, err := ParseInterfaceListener(nil, "wlan0"); err != nil || l.port != 53 || l.view != "" {
+		t.Errorf("got %+v, %v", l, err)
+	}
+	for _, bad := range []string{"", ":53", "eth0:dns", "eth0:70000"} {
+		if _, err := ParseInterfaceListener(nil, bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestInterfaceListenerFollowsAddresses(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Record{Domain: "app.test", Type: "A", Value: "10.0.0.1"})
+	dns := NewDNSServer(store, nil)
+	t.Cleanup(dns.Close)
+
+	l, _ := ParseInterfaceListener(dns, "test0")
+	l.port = 0 // any free port
+	addrs := []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+	l.addrs = func(string) ([]netip.Addr, error) { return addrs, nil }
+	listened := 0
+	l.onListen = func() { listened++ }
+
+	serving := func(addr string) string {
+		t.Helper()
+		socks := l.bound[netip.MustParseAddr(addr)]
+		if socks == nil {
+			t.Fatalf("%s not bound; bound %v", addr, l.Addrs())
+		}
+		return socks.conns[0].LocalAddr().String()
+	}
+	if err := l.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	first := serving("127.0.0.1")
+	if resp := exchange(t, first, buildTestQuery("app.test", 1, 1)); resp[7] != 1 {
+		t.Errorf("answers = %d, want 1", resp[7])
+	}
+
+	// The interface is renumbered
+	addrs = []netip.Addr{netip.MustParseAddr("127.0.0.2")}
+	if err := l.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Addrs(); len(got) != 1 || got[0] != addrs[0] {
+		t.Errorf("bound = %v, want just 127.0.0.2", got)
+	}
+	if resp := exchange(t, serving("127.0.0.2"), buildTestQuery("app.test", 1, 1)); resp[7] != 1 {
+		t.Errorf("answers = %d, want 1", resp[7])
+	}
+	dns.mu.Lock()
+	if len(dns.tcp) != 1 {
+		t.Errorf("%d listeners, want the old one closed", len(dns.tcp))
+	}
+	dns.mu.Unlock()
+	if listened != 1 {
+		t.Errorf("onListen called %d times, want once", listened)
+	}
+}
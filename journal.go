@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCompactInterval = 30 * time.Second
+	// compactAfter journal entries triggers a compaction before the next tick.
+	compactAfter = 1000
+)
+
+// journal is a write-ahead log of store mutations. Each change is appended
+// and synced before the API call returns; the full data file is only
+// rewritten when the journal is compacted in the background. Entries are
+// keyed by record ID and replaying them is idempotent, so a crash between
+// rewriting the data file and truncating the journal loses nothing.
+type journal struct {
+	path     string
+	f        *os.File
+	entries  int
+	compactc chan struct{}
+
+	compactMu  sync.Mutex // serializes Compact
+	compacting bool       // a Compact is writing the data file without s.mu
+	pending    []byte     // entries appended since that Compact's snapshot
+	replaced   int        // bumped when the records are replaced wholesale
+}
+
+// OpenJournal replays the journal at path on top of the loaded data file and
+// keeps it open so later mutations are appended to it instead of rewriting
+// the data file.
+func (s *Store) OpenJournal(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := s.replayJournal(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if s.fsync {
+		// Entries are synced as they are appended; make the file itself durable too
+		if err := syncDir(filepath.Dir(path)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	s.journal = &journal{path: path, f: f, entries: n, compactc: make(chan struct{}, 1)}
+	if n > 0 {
+		// The serial comes from the data file's mtime, which predates the
+		// replayed changes
+		if info, err := f.Stat(); err == nil {
+			s.serial = max(s.serial, uint32(info.ModTime().Unix()))
+		}
+		slog.Info("replayed journal", "path", path, "entries", n)
+	}
+	return nil
+}
+
+// replayJournal applies every complete entry in path. A torn final line from
+// a crash mid-append is ignored. Caller must hold s.mu.
+func (s *Store) replayJournal(path string) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var c Change
+		if err := json.Unmarshal(sc.Bytes(), &c); err != nil {
+			slog.Warn("skipping malformed journal entry", "path", path, "entry", n+1, "error", err)
+			continue
+		}
+		s.apply(c)
+		n++
+	}
+	if err := sc.Err(); err != nil {
+		return n, fmt.Errorf("reading journal: %w", err)
+	}
+	s.rebuildIndex()
+	return n, nil
+}
+
+// apply replays one journaled change by record ID. Caller must hold s.mu.
+func (s *Store) apply(c Change) {
+	switch c.Op {
+	case "add", "update":
+		if c.New == nil {
+			return
+		}
+		i := slices.IndexFunc(s.records, func(r Record) bool { return r.ID == c.New.ID })
+		if i >= 0 {
+			s.records[i] = *c.New
+		} else {
+			s.records = append(s.records, *c.New)
+		}
+		s.nextID = max(s.nextID, c.New.ID+1)
+	case "delete":
+		if c.Old != nil {
+			s.records = slices.DeleteFunc(s.records, func(r Record) bool { return r.ID == c.Old.ID })
+		}
+	}
+}
+
+// persist makes changes durable: written through to the remote store if
+// there is one, as a single commit, then appended to the journal with a single write and sync
+// when one is open, otherwise by rewriting the data file once. Caller must
+// hold s.mu.
+func (s *Store) persist(changes ...Change) error {
+	if s.remote != nil {
+		if err := s.remote(changes); err != nil {
+			return err
+		}
+	}
+	j := s.journal
+	if j == nil {
+		return s.save()
+	}
+	var lines []byte
+	for _, c := range changes {
+		line, err := json.Marshal(Change{Op: c.Op, Old: c.Old, New: c.New})
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	if _, err := j.f.Write(lines); err != nil {
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	if j.compacting {
+		j.pending = append(j.pending, lines...)
+	}
+	if j.entries += len(changes); j.entries >= compactAfter {
+		select {
+		case j.compactc <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// compact rewrites the data file from memory and empties the journal. Caller
+// must hold s.mu.
+func (s *Store) compact() error {
+	if err := s.save(); err != nil {
+		return err
+	}
+	j := s.journal
+	if j == nil || j.entries == 0 {
+		return nil
+	}
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	j.entries = 0
+	j.replaced++
+	return nil
+}
+
+// RunCompaction folds the journal into the data file every interval, or
+// sooner once it grows past compactAfter entries, until ctx is done.
+func (s *Store) RunCompaction(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.journal.compactc:
+		}
+		if err := s.Compact(); err != nil {
+			slog.Error("journal compaction failed", "path", s.journal.path, "error", err)
+		}
+	}
+}
+
+// Compact folds any journaled changes into the data file now. Only taking
+// the snapshot and swapping in the shorter journal hold s.mu; the data file
+// is written without it, so lookups and writes carry on meanwhile. Entries
+// appended during the write are kept for the new journal. Until the swap
+// the old journal still holds every entry, so a crash at any point replays
+// to the same records.
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	j := s.journal
+	if j == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+	j.compactMu.Lock()
+	defer j.compactMu.Unlock()
+
+	s.mu.Lock()
+	if j.entries == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	data, n, replaced := formatRecords(s.records), j.entries, j.replaced
+	j.compacting = true
+	s.mu.Unlock()
+
+	err := writeFileAtomic(s.path, data, s.fsync)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := j.pending
+	j.compacting, j.pending = false, nil
+	if err != nil {
+		return err
+	}
+	if j.replaced != replaced {
+		// A reload or Replace swapped the records while the snapshot was
+		// written, so it is older than them; write them again here
+		return s.compact()
+	}
+	s.stamp, _ = statFile(s.path)
+	if err := j.rewrite(pending, s.fsync); err != nil {
+		return err
+	}
+	j.entries -= n
+	slog.Debug("journal compacted", "path", j.path, "entries", n)
+	return nil
+}
+
+// rewrite atomically replaces the journal with data and appends to the new
+// file from then on.
+func (j *journal) rewrite(data []byte, durable bool) error {
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), ".regieleki-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	// Reopened for appending, as OpenJournal opens the journal
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		return fail(err)
+	}
+	if durable {
+		if err := f.Sync(); err != nil {
+			return fail(err)
+		}
+	}
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return fail(err)
+	}
+	j.f.Close()
+	j.f = f
+	if durable {
+		return syncDir(filepath.Dir(j.path))
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openJournaled(t *testing.T, path string) *Store {
+	t.Helper()
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.OpenJournal(path + ".journal"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.journal.f.Close() })
+	return s
+}
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.tsv")
+	s := openJournaled(t, path)
+
+	a, _ := s.Add(Record{Domain: "a.local", Type: "A", Value: "10.0.0.1"})
+	b, _ := s.Add(Record{Domain: "b.local", Type: "A", Value: "10.0.0.2"})
+	s.Update(a.ID, Record{Domain: "a.local", Type: "A", Value: "10.0.0.9"})
+	s.Delete(b.ID)
+
+	// Mutations only touch the journal until it is compacted
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("data file written before compaction: %v", err)
+	}
+
+	s2 := openJournaled(t, path)
+	list := s2.List()
+	if len(list) != 1 || list[0].Value != "10.0.0.9" {
+		t.Fatalf("replayed records = %+v, want only the updated a.local", list)
+	}
+	if rec, _ := s2.Add(Record{Domain: "c.local", Type: "A", Value: "10.0.0.3"}); rec.ID != 3 {
+		t.Errorf("next ID after replay = %d, want 3", rec.ID)
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.tsv")
+	s := openJournaled(t, path)
+	s.Add(Record{Domain: "a.local", Type: "A", Value: "10.0.0.1"})
+
+	// Keep the journal as it was before compaction, as if we crashed right
+	// after rewriting the data file
+	stale, err := os.ReadFile(path + ".journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path + ".journal"); err != nil || info.Size() != 0 {
+		t.Errorf("journal not truncated: %v, %v", info, err)
+	}
+	if s2, err := NewStore(path); err != nil || len(s2.List()) != 1 {
+		t.Fatalf("data file after compaction: %v", err)
+	}
+
+	// Replaying entries already in the data file must not duplicate them,
+	// and a torn final line is skipped
+	stale = append(stale, `{"op":"add","new":{"id":`...)
+	if err := os.WriteFile(path+".journal", stale, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if list := openJournaled(t, path).List(); len(list) != 1 {
+		t.Errorf("records after replaying a stale journal = %+v, want 1", list)
+	}
+}
+
+func TestJournalCompactConcurrentWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.tsv")
+	s := openJournaled(t, path)
+
+	// Writes made while the data file is being written land in the new
+	// journal, so nothing is lost after a restart
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 200 {
+			s.Add(Record{Domain: fmt.Sprintf("h%d.local", i), Type: "A", Value: "10.0.0.1"})
+		}
+	}()
+	for compacting := true; compacting; {
+		select {
+		case <-done:
+			compacting = false
+		default:
+		}
+		if err := s.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Add(Record{Domain: "last.local", Type: "A", Value: "10.0.0.2"})
+
+	if list := openJournaled(t, path).List(); len(list) != 201 {
+		t.Errorf("%d records after restart, want 201", len(list))
+	}
+	if s.journal.entries != 1 {
+		t.Errorf("journal holds %d entries, want 1", s.journal.entries)
+	}
+}
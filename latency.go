@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// outcome is how a query was answered, for latency accounting.
+type outcome int
+
+const (
+	outcomeLocal     outcome = iota // answered from our records
+	outcomeCached                   // answered from the upstream cache
+	outcomeForwarded                // answered by an upstream
+	outcomeStale                    // upstreams failed, served an expired cache entry
+	outcomeServFail                 // upstreams failed, nothing to fall back on
+	outcomeBlocked                  // the name is on a blocklist
+	outcomeChaos                    // a chaos rule answered
+	outcomeRejected                 // answered NOTIMP, FORMERR, or REFUSED
+	outcomePeer                     // a peer instance answered from its records
+	numOutcomes
+)
+
+var outcomeNames = [numOutcomes]string{"local", "cached", "forwarded", "stale", "servfail", "blocked", "chaos", "rejected", "peer"}
+
+// latencyBounds are the histogram bucket upper bounds; one more bucket
+// collects everything slower.
+var latencyBounds = [...]time.Duration{
+	250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second,
+}
+
+// latencySlots is how many minutes of history are kept, which bounds the
+// longest report window.
+const latencySlots = 24 * 60
+
+type latencySlot struct {
+	minute int64
+	counts [numOutcomes][len(latencyBounds) + 1]uint32
+}
+
+// Latency keeps per-minute latency histograms for the last day, split by
+// outcome. Memory is fixed at about 400KB regardless of query volume.
+type Latency struct {
+	mu    sync.Mutex
+	slots [latencySlots]latencySlot
+	now   func() time.Time
+}
+
+func NewLatency() *Latency {
+	return &Latency{now: time.Now}
+}
+
+func (l *Latency) Record(o outcome, d time.Duration) {
+	b := len(latencyBounds)
+	for i, bound := range latencyBounds {
+		if d <= bound {
+			b = i
+			break
+		}
+	}
+	minute := l.now().Unix() / 60
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slot := &l.slots[minute%latencySlots]
+	if slot.minute != minute {
+		*slot = latencySlot{minute: minute}
+	}
+	slot.counts[o][b]++
+}
+
+// SLOStats summarizes latency for one outcome (or all of them) over a window.
+// Under maps each threshold to the percentage of queries answered within it.
+// Thresholds between bucket bounds count only the buckets entirely below
+// them, so the percentages never overstate.
+type SLOStats struct {
+	Queries uint64             `json:"queries"`
+	Under   map[string]float64 `json:"under,omitempty"`
+	P50MS   float64            `json:"p50_ms"`
+	P99MS   float64            `json:"p99_ms"`
+}
+
+type SLOWindow struct {
+	Window   string              `json:"window"`
+	All      SLOStats            `json:"all"`
+	Outcomes map[string]SLOStats `json:"outcomes"`
+}
+
+// Report aggregates the histograms of the last window.
+func (l *Latency) Report(window time.Duration, thresholds []time.Duration) SLOWindow {
+	now := l.now().Unix() / 60
+	oldest := now - int64(window/time.Minute) + 1
+
+	var hist [numOutcomes][len(latencyBounds) + 1]uint64
+	l.mu.Lock()
+	for i := range l.slots {
+		slot := &l.slots[i]
+		if slot.minute < oldest || slot.minute > now {
+			continue
+		}
+		for o := range hist {
+			for b, n := range slot.counts[o] {
+				hist[o][b] += uint64(n)
+			}
+		}
+	}
+	l.mu.Unlock()
+
+	result := SLOWindow{Window: window.String(), Outcomes: map[string]SLOStats{}}
+	var all [len(latencyBounds) + 1]uint64
+	for o := range hist {
+		for b, n := range hist[o] {
+			all[b] += n
+		}
+		if stats := sloStats(hist[o], thresholds); stats.Queries > 0 {
+			result.Outcomes[outcomeNames[o]] = stats
+		}
+	}
+	result.All = sloStats(all, thresholds)
+	return result
+}
+
+func sloStats(hist [len(latencyBounds) + 1]uint64, thresholds []time.Duration) SLOStats {
+	var stats SLOStats
+	for _, n := range hist {
+		stats.Queries += n
+	}
+	if stats.Queries == 0 {
+		return stats
+	}
+	stats.Under = make(map[string]float64, len(thresholds))
+	for _, t := range thresholds {
+		var within uint64
+		for b, bound := range latencyBounds {
+			if bound <= t {
+				within += hist[b]
+			}
+		}
+		stats.Under[t.String()] = math.Round(float64(within)/float64(stats.Queries)*10000) / 100
+	}
+	stats.P50MS = percentileMS(hist, stats.Queries, 0.50)
+	stats.P99MS = percentileMS(hist, stats.Queries, 0.99)
+	return stats
+}
+
+// percentileMS returns the upper bound of the bucket holding quantile q.
+// The overflow bucket reports the largest bound.
+func percentileMS(hist [len(latencyBounds) + 1]uint64, total uint64, q float64) float64 {
+	rank := uint64(math.Ceil(float64(total) * q))
+	var seen uint64
+	for b, n := range hist[:len(latencyBounds)] {
+		if seen += n; seen >= rank {
+			return float64(latencyBounds[b].Microseconds()) / 1000
+		}
+	}
+	return float64(latencyBounds[len(latencyBounds)-1].Microseconds()) / 1000
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLatencyReport(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	l := NewLatency()
+	l.now = func() time.Time { return now }
+
+	// Two hours ago: slow forwarded queries that only the day window sees
+	now = now.Add(-2 * time.Hour)
+	for range 10 {
+		l.Record(outcomeForwarded, 300*time.Millisecond)
+	}
+	now = now.Add(2 * time.Hour)
+
+	for range 98 {
+		l.Record(outcomeLocal, 100*time.Microsecond)
+	}
+	l.Record(outcomeCached, 3*time.Millisecond)
+	l.Record(outcomeForwarded, 40*time.Millisecond)
+
+	thresholds := []time.Duration{5 * time.Millisecond, 50 * time.Millisecond}
+	hour := l.Report(time.Hour, thresholds)
+	if hour.All.Queries != 100 {
+		t.Fatalf("hour queries = %d, want 100", hour.All.Queries)
+	}
+	if got := hour.All.Under["5ms"]; got != 99 {
+		t.Errorf("under 5ms = %v, want 99", got)
+	}
+	if got := hour.All.Under["50ms"]; got != 100 {
+		t.Errorf("under 50ms = %v, want 100", got)
+	}
+	if hour.All.P50MS != 0.25 || hour.All.P99MS != 5 {
+		t.Errorf("p50 = %v, p99 = %v; want 0.25, 5", hour.All.P50MS, hour.All.P99MS)
+	}
+	if hour.Outcomes["local"].Queries != 98 || hour.Outcomes["forwarded"].Queries != 1 {
+		t.Errorf("outcomes = %+v", hour.Outcomes)
+	}
+	if _, ok := hour.Outcomes["stale"]; ok {
+		t.Error("outcomes without queries should be omitted")
+	}
+
+	day := l.Report(24*time.Hour, thresholds)
+	if day.Outcomes["forwarded"].Queries != 11 || day.Outcomes["forwarded"].Under["50ms"] != 9.09 {
+		t.Errorf("day forwarded = %+v", day.Outcomes["forwarded"])
+	}
+}
+
+func TestWebSLO(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Record{Domain: "app.test", Type: "A", Value: "10.0.0.1"})
+	ws := NewWebServer(store, nil)
+	ws.dns = NewDNSServer(store, nil)
+	exchange(t, startDNSServer(t, ws.dns), buildTestQuery("app.test", 1, 1))
+
+	req := httptest.NewRequest("GET", "/api/slo?window=1h&under=1s", nil)
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var report []SLOWindow
+	json.NewDecoder(w.Body).Decode(&report)
+	if len(report) != 1 || report[0].Outcomes["local"].Queries != 1 || report[0].All.Under["1s"] != 100 {
+		t.Errorf("report = %+v", report)
+	}
+
+	for _, q := range []string{"window=48h", "under=fast", "window=0s"} {
+		req = httptest.NewRequest("GET", "/api/slo?"+q, nil)
+		w = httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, req)
+		if w.Code != 400 {
+			t.Errorf("%s: status = %d, want 400", q, w.Code)
+		}
+	}
+}
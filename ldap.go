@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A minimal LDAPv3 client (RFC 4511): simple bind, one subtree search, and
+// unbind. That is all the directory sync needs, and it keeps the binary free
+// of third-party dependencies.
+
+const (
+	ldapTimeout         = 10 * time.Second
+	ldapDefaultFilter   = "(&(objectClass=computer)(dNSHostName=*))"
+	ldapDefaultSchedule = "@every 15m"
+
+	berSequence  = 0x30
+	berSet       = 0x31
+	berInteger   = 0x02
+	berOctets    = 0x04
+	berEnum      = 0x0A
+	berBoolean   = 0x01
+	ldapBindReq  = 0x60 // [APPLICATION 0] constructed
+	ldapBindResp = 0x61
+	ldapUnbind   = 0x42 // [APPLICATION 2] primitive
+	ldapSearch   = 0x63
+	ldapEntry    = 0x64
+	ldapDone     = 0x65
+	ldapRef      = 0x73
+)
+
+// berTLV encodes one tag-length-value element around the concatenated content.
+func berTLV(tag byte, content ...[]byte) []byte {
+	n := 0
+	for _, c := range content {
+		n += len(c)
+	}
+	out := []byte{tag}
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n <= 0xFF:
+		out = append(out, 0x81, byte(n))
+	case n <= 0xFFFF:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	for _, c := range content {
+		out = append(out, c...)
+	}
+	return out
+}
+
+func berInt(tag byte, v int) []byte {
+	// Minimal two's complement; LDAP only needs small non-negative values
+	b := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
+
+type berElement struct {
+	tag     byte
+	content []byte
+}
+
+// berSplit decodes the elements laid end to end in buf.
+func berSplit(buf []byte) ([]berElement, error) {
+	var out []berElement
+	for len(buf) > 0 {
+		if len(buf) < 2 {
+			return nil, errMalformedBER
+		}
+		tag, n, hdr := buf[0], int(buf[1]), 2
+		if n&0x80 != 0 {
+			size := n & 0x7F
+			if size == 0 || size > 4 || len(buf) < 2+size {
+				return nil, errMalformedBER
+			}
+			n = 0
+			for _, b := range buf[2 : 2+size] {
+				n = n<<8 | int(b)
+			}
+			hdr += size
+		}
+		if n < 0 || hdr+n > len(buf) {
+			return nil, errMalformedBER
+		}
+		out = append(out, berElement{tag: tag, content: buf[hdr : hdr+n]})
+		buf = buf[hdr+n:]
+	}
+	return out, nil
+}
+
+var errMalformedBER = errors.New("ldap: malformed BER")
+
+func berIntValue(b []byte) int {
+	v := 0
+	for _, c := range b {
+		v = v<<8 | int(c)
+	}
+	return v
+}
+
+// readBERMessage reads one complete top-level element from r.
+func readBERMessage(r *bufio.Reader) ([]byte, error) {
+	hdr := make([]byte, 2, 6)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	n := int(hdr[1])
+	if n&0x80 != 0 {
+		size := n & 0x7F
+		if size == 0 || size > 4 {
+			return nil, errMalformedBER
+		}
+		ext := make([]byte, size)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		hdr = append(hdr, ext...)
+		n = berIntValue(ext)
+	}
+	if n > 16<<20 {
+		return nil, fmt.Errorf("ldap: message of %d bytes is too large", n)
+	}
+	msg := make([]byte, len(hdr)+n)
+	copy(msg, hdr)
+	if _, err := io.ReadFull(r, msg[len(hdr):]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// ldapFilter compiles an RFC 4515 string filter. Supported: &, |, !,
+// equality, presence (attr=*), substrings, >= and <=.
+func ldapFilter(s string) ([]byte, error) {
+	f, rest, err := parseLDAPFilter(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("ldap filter: trailing %q", rest)
+	}
+	return f, nil
+}
+
+func parseLDAPFilter(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", fmt.Errorf("ldap filter: expected ( at %q", s)
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, "", errors.New("ldap filter: unexpected end")
+	}
+	switch s[0] {
+	case '&', '|':
+		tag := byte(0xA0)
+		if s[0] == '|' {
+			tag = 0xA1
+		}
+		s = s[1:]
+		var parts [][]byte
+		for strings.HasPrefix(s, "(") {
+			f, rest, err := parseLDAPFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			parts = append(parts, f)
+			s = rest
+		}
+		if !strings.HasPrefix(s, ")") || len(parts) == 0 {
+			return nil, "", errors.New("ldap filter: bad set")
+		}
+		return berTLV(tag, parts...), s[1:], nil
+	case '!':
+		f, rest, err := parseLDAPFilter(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", errors.New("ldap filter: bad negation")
+		}
+		return berTLV(0xA2, f), rest[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", errors.New("ldap filter: missing )")
+	}
+	item, rest := s[:end], s[end+1:]
+	attr, value, ok := strings.Cut(item, "=")
+	if !ok || attr == "" {
+		return nil, "", fmt.Errorf("ldap filter: bad item %q", item)
+	}
+	switch {
+	case strings.HasSuffix(attr, ">"):
+		return berTLV(0xA5, berString(berOctets, attr[:len(attr)-1]), berString(berOctets, ldapUnescape(value))), rest, nil
+	case strings.HasSuffix(attr, "<"):
+		return berTLV(0xA6, berString(berOctets, attr[:len(attr)-1]), berString(berOctets, ldapUnescape(value))), rest, nil
+	case value == "*":
+		return berString(0x87, attr), rest, nil
+	case strings.Contains(value, "*"):
+		pieces := strings.Split(value, "*")
+		var subs [][]byte
+		for i, p := range pieces {
+			if p == "" {
+				continue
+			}
+			tag := byte(0x81) // any
+			switch i {
+			case 0:
+				tag = 0x80 // initial
+			case len(pieces) - 1:
+				tag = 0x82 // final
+			}
+			subs = append(subs, berString(tag, ldapUnescape(p)))
+		}
+		return berTLV(0xA4, berString(berOctets, attr), berTLV(berSequence, subs...)), rest, nil
+	}
+	return berTLV(0xA3, berString(berOctets, attr), berString(berOctets, ldapUnescape(value))), rest, nil
+}
+
+// ldapUnescape decodes the \XX hex escapes allowed in filter values.
+func ldapUnescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+2 < len(s) {
+			if v, err := hex.DecodeString(s[i+1 : i+3]); err == nil {
+				b.Write(v)
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// LDAPEntry is one search result: a DN and its requested attributes, with
+// attribute names lowercased.
+type LDAPEntry struct {
+	DN    string
+	Attrs map[string][]string
+}
+
+type ldapConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	msgID int
+}
+
+func dialLDAP(ctx context.Context, rawURL string) (*ldapConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{Timeout: ldapTimeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		conn, err = d.DialContext(ctx, "tcp", hostPortDefault(u.Host, "389"))
+	case "ldaps":
+		td := &tls.Dialer{NetDialer: d, Config: &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}}
+		conn, err = td.DialContext(ctx, "tcp", hostPortDefault(u.Host, "636"))
+	default:
+		return nil, fmt.Errorf("ldap: unsupported scheme %q (want ldap:// or ldaps://)", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+	return &ldapConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func hostPortDefault(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+func (c *ldapConn) Close() error {
+	c.msgID++
+	c.conn.Write(berTLV(berSequence, berInt(berInteger, c.msgID), []byte{ldapUnbind, 0}))
+	return c.conn.Close()
+}
+
+func (c *ldapConn) send(op []byte) (int, error) {
+	c.msgID++
+	_, err := c.conn.Write(berTLV(berSequence, berInt(berInteger, c.msgID), op))
+	return c.msgID, err
+}
+
+// recv reads the next message for id and returns its protocol op.
+func (c *ldapConn) recv(id int) (berElement, error) {
+	for {
+		raw, err := readBERMessage(c.r)
+		if err != nil {
+			return berElement{}, err
+		}
+		top, err := berSplit(raw)
+		if err != nil || len(top) != 1 || top[0].tag != berSequence {
+			return berElement{}, errMalformedBER
+		}
+		parts, err := berSplit(top[0].content)
+		if err != nil || len(parts) < 2 {
+			return berElement{}, errMalformedBER
+		}
+		if berIntValue(parts[0].content) != id {
+			continue // e.g. a notice of disconnection
+		}
+		return parts[1], nil
+	}
+}
+
+// ldapResult checks the LDAPResult carried by op.
+func ldapResult(op berElement) error {
+	parts, err := berSplit(op.content)
+	if err != nil || len(parts) < 3 {
+		return errMalformedBER
+	}
+	if code := berIntValue(parts[0].content); code != 0 {
+		msg := string(parts[2].content)
+		if msg == "" {
+			msg = "no diagnostic"
+		}
+		return fmt.Errorf("ldap: result code %d: %s", code, msg)
+	}
+	return nil
+}
+
+func (c *ldapConn) Bind(dn, password string) error {
+	id, err := c.send(berTLV(ldapBindReq,
+		berInt(berInteger, 3),
+		berString(berOctets, dn),
+		berString(0x80, password), // simple authentication
+	))
+	if err != nil {
+		return err
+	}
+	op, err := c.recv(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapBindResp {
+		return errMalformedBER
+	}
+	return ldapResult(op)
+}
+
+// Search runs a subtree search under base and collects every entry.
+func (c *ldapConn) Search(base, filter string, attrs []string) ([]LDAPEntry, error) {
+	f, err := ldapFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var attrList [][]byte
+	for _, a := range attrs {
+		attrList = append(attrList, berString(berOctets, a))
+	}
+	id, err := c.send(berTLV(ldapSearch,
+		berString(berOctets, base),
+		berInt(berEnum, 2), // wholeSubtree
+		berInt(berEnum, 0), // neverDerefAliases
+		berInt(berInteger, 0),
+		berInt(berInteger, 0),
+		berTLV(berBoolean, []byte{0}),
+		f,
+		berTLV(berSequence, attrList...),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []LDAPEntry
+	for {
+		op, err := c.recv(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapEntry:
+			e, err := parseLDAPEntry(op.content)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		case ldapRef:
+			// Referrals to other servers are not followed
+		case ldapDone:
+			return entries, ldapResult(op)
+		default:
+			return nil, errMalformedBER
+		}
+	}
+}
+
+func parseLDAPEntry(content []byte) (LDAPEntry, error) {
+	parts, err := berSplit(content)
+	if err != nil || len(parts) != 2 {
+		return LDAPEntry{}, errMalformedBER
+	}
+	e := LDAPEntry{DN: string(parts[0].content), Attrs: map[string][]string{}}
+	attrs, err := berSplit(parts[1].content)
+	if err != nil {
+		return LDAPEntry{}, err
+	}
+	for _, a := range attrs {
+		kv, err := berSplit(a.content)
+		if err != nil || len(kv) != 2 {
+			return LDAPEntry{}, errMalformedBER
+		}
+		vals, err := berSplit(kv[1].content)
+		if err != nil {
+			return LDAPEntry{}, err
+		}
+		name := strings.ToLower(string(kv[0].content))
+		for _, v := range vals {
+			e.Attrs[name] = append(e.Attrs[name], string(v.content))
+		}
+	}
+	return e, nil
+}
+
+// LDAPSync publishes A/AAAA records for directory computer objects. Each
+// entry's dNSHostName supplies the host label, which is placed under Zone,
+// and the address attributes supply the values.
+type LDAPSync struct {
+	URL          string
+	BindDN       string
+	Password     string
+	BaseDN       string
+	Filter       string
+	AddressAttrs []string
+	Zone         string
+	store        *Store
+}
+
+// Run performs one sync. Failures leave the previously published records
+// in place, so a directory outage doesn't take hosts out of DNS.
+func (l *LDAPSync) Run(ctx context.Context) error {
+	conn, err := dialLDAP(ctx, l.URL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if l.BindDN != "" {
+		if err := conn.Bind(l.BindDN, l.Password); err != nil {
+			return err
+		}
+	}
+	attrs := append([]string{"dNSHostName"}, l.AddressAttrs...)
+	entries, err := conn.Search(l.BaseDN, l.Filter, attrs)
+	if err != nil {
+		return err
+	}
+
+	records := ldapRecords(entries, l.AddressAttrs, l.Zone)
+	l.store.SetSource("ldap", records)
+	slog.InfoContext(ctx, "ldap sync finished", "entries", len(entries), "records", len(records))
+	return nil
+}
+
+func ldapRecords(entries []LDAPEntry, addressAttrs []string, zone string) []Record {
+	zone = strings.ToLower(strings.Trim(zone, "."))
+	var records []Record
+	for _, e := range entries {
+		hosts := e.Attrs["dnshostname"]
+		if len(hosts) == 0 {
+			continue
+		}
+		label, _, _ := strings.Cut(strings.ToLower(strings.TrimSuffix(hosts[0], ".")), ".")
+		if label == "" {
+			continue
+		}
+		name := label
+		if zone != "" {
+			name = label + "." + zone
+		}
+		for _, attr := range addressAttrs {
+			for _, v := range e.Attrs[strings.ToLower(attr)] {
+				ip := net.ParseIP(strings.TrimSpace(v))
+				switch {
+				case ip == nil:
+					slog.Debug("ldap: skipping non-IP address value", "dn", e.DN, "attr", attr, "value", v)
+				case ip.To4() != nil:
+					records = append(records, Record{Domain: name, Type: "A", Value: ip.String()})
+				default:
+					records = append(records, Record{Domain: name, Type: "AAAA", Value: ip.String()})
+				}
+			}
+		}
+	}
+	return records
+}
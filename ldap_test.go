@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLDAPFilterEncoding(t *testing.T) {
+	got, err := ldapFilter("(objectClass=computer)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{0xa3, 0x17, 0x04, 0x0b}, "objectClass"...)
+	want = append(want, 0x04, 0x08)
+	want = append(want, "computer"...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("filter = % x, want % x", got, want)
+	}
+
+	for _, f := range []string{
+		ldapDefaultFilter,
+		"(|(cn=web*)(!(cn=db)))",
+		"(cn=*a*b*)",
+		`(cn=a\2ab)`,
+	} {
+		if _, err := ldapFilter(f); err != nil {
+			t.Errorf("ldapFilter(%q): %v", f, err)
+		}
+	}
+	for _, f := range []string{"", "cn=x", "(cn=x", "(&(cn=x)", "(cn)"} {
+		if _, err := ldapFilter(f); err == nil {
+			t.Errorf("ldapFilter(%q) succeeded, want error", f)
+		}
+	}
+}
+
+func TestLDAPRecords(t *testing.T) {
+	entries := []LDAPEntry{
+		{DN: "CN=WEB1", Attrs: map[string][]string{
+			"dnshostname":  {"WEB1.corp.example.com"},
+			"iphostnumber": {"10.0.0.5", "fd00::5"},
+		}},
+		{DN: "CN=NOADDR", Attrs: map[string][]string{"dnshostname": {"noaddr.corp.example.com"}}},
+		{DN: "CN=BAD", Attrs: map[string][]string{
+			"dnshostname":  {"bad.corp.example.com"},
+			"iphostnumber": {"not-an-ip"},
+		}},
+		{DN: "CN=NOHOST", Attrs: map[string][]string{"iphostnumber": {"10.0.0.9"}}},
+	}
+	got := ldapRecords(entries, []string{"ipHostNumber"}, "hosts.lan.")
+	want := []Record{
+		{Domain: "web1.hosts.lan", Type: "A", Value: "10.0.0.5"},
+		{Domain: "web1.hosts.lan", Type: "AAAA", Value: "fd00::5"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("records = %+v, want %+v", got, want)
+	}
+}
+
+// startFakeLDAP serves one connection: it accepts a bind for dn/password and
+// answers a search with entries, each given as DN and attribute pairs.
+func startFakeLDAP(t *testing.T, dn, password string, entries map[string][][2]string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(id []byte, op []byte) {
+			conn.Write(berTLV(berSequence, berTLV(berInteger, id), op))
+		}
+		result := func(tag byte, code int) []byte {
+			return berTLV(tag, berInt(berEnum, code), berString(berOctets, ""), berString(berOctets, ""))
+		}
+		for {
+			raw, err := readBERMessage(r)
+			if err != nil {
+				return
+			}
+			top, _ := berSplit(raw)
+			parts, _ := berSplit(top[0].content)
+			id, op := parts[0].content, parts[1]
+			switch op.tag {
+			case ldapBindReq:
+				fields, _ := berSplit(op.content)
+				code := 0
+				if string(fields[1].content) != dn || string(fields[2].content) != password {
+					code = 49 // invalidCredentials
+				}
+				reply(id, result(ldapBindResp, code))
+			case ldapSearch:
+				for entryDN, attrs := range entries {
+					var list [][]byte
+					for _, kv := range attrs {
+						list = append(list, berTLV(berSequence,
+							berString(berOctets, kv[0]),
+							berTLV(berSet, berString(berOctets, kv[1]))))
+					}
+					reply(id, berTLV(ldapEntry, berString(berOctets, entryDN), berTLV(berSequence, list...)))
+				}
+				reply(id, result(ldapDone, 0))
+			case ldapUnbind:
+				return
+			}
+		}
+	}()
+	return "ldap://" + ln.Addr().String()
+}
+
+func TestLDAPSyncPublishesRecords(t *testing.T) {
+	store, err := NewStore(t.TempDir() + "/records.tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := startFakeLDAP(t, "cn=dns,dc=corp", "secret", map[string][][2]string{
+		"CN=WEB1,DC=corp": {{"dNSHostName", "web1.corp.example.com"}, {"ipHostNumber", "10.0.0.5"}},
+	})
+	sync := &LDAPSync{
+		URL:          url,
+		BindDN:       "cn=dns,dc=corp",
+		Password:     "secret",
+		BaseDN:       "dc=corp",
+		Filter:       ldapDefaultFilter,
+		AddressAttrs: []string{"ipHostNumber"},
+		Zone:         "hosts.lan",
+		store:        store,
+	}
+	if err := sync.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	records, ok := store.Resolve("web1.hosts.lan", 1)
+	if !ok || len(records) != 1 || records[0].Value != "10.0.0.5" || records[0].Source != "ldap" {
+		t.Errorf("Resolve = %+v, %v; want the synced A record", records, ok)
+	}
+}
+
+func TestLDAPSyncBadCredentials(t *testing.T) {
+	store, err := NewStore(t.TempDir() + "/records.tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := startFakeLDAP(t, "cn=dns,dc=corp", "secret", nil)
+	sync := &LDAPSync{URL: url, BindDN: "cn=dns,dc=corp", Password: "wrong", Filter: ldapDefaultFilter, store: store}
+	err = sync.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "49") {
+		t.Errorf("Run() error = %v, want invalid credentials", err)
+	}
+}
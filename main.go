@@ -2,60 +2,792 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// listFlag is a flag that may be repeated or given comma-separated values.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
 func main() {
-	if len(os.Args) > 1 && os.Args[1] == "access-token" {
-		handleAccessToken(os.Args[2:])
-		return
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "access-token":
+			handleAccessToken(os.Args[2:])
+			return
+		case "fake-upstream":
+			handleFakeUpstream(os.Args[2:])
+			return
+		case "compare":
+			handleCompare(os.Args[2:])
+			return
+		case "check-zones":
+			handleCheckZones(os.Args[2:])
+			return
+		case "import":
+			handleImport(os.Args[2:])
+			return
+		case "export":
+			handleExport(os.Args[2:])
+			return
+		case "query":
+			handleQuery(os.Args[2:])
+			return
+		case "validate":
+			handleValidate(os.Args[2:])
+			return
+		case "doctor":
+			handleDoctor(os.Args[2:])
+			return
+		case "setup":
+			handleSetup(os.Args[2:])
+			return
+		case "bench":
+			handleBench(os.Args[2:])
+			return
+		case "version", "-version", "--version":
+			handleVersion(os.Args[2:])
+			return
+		}
 	}
 
-	dnsAddr := flag.String("dns", ":53", "DNS listen address")
-	httpAddr := flag.String("http", ":13860", "HTTP listen address")
+	var dnsAddrs listFlag
+	flag.Var(&dnsAddrs, "dns", "DNS listen address, optionally addr=view to serve that view's records (repeatable; default :53)")
+	var dnsIfaces listFlag
+	flag.Var(&dnsIfaces, "dns-interface", "Interface to serve DNS on, name[:port][=view], following its addresses as they change (repeatable)")
+	httpAddr := flag.String("http", ":13860", "HTTP listen address, or unix:/path for a Unix domain socket")
+	httpCert := flag.String("http-cert", "", "TLS certificate (PEM, with any intermediates) to serve the API and UI over HTTPS; re-read on SIGHUP")
+	httpKey := flag.String("http-key", "", "Private key for -http-cert")
+	var acmeDomains listFlag
+	flag.Var(&acmeDomains, "acme-domain", "Public hostname to get and renew an HTTPS certificate for via ACME, proven with DNS-01 records served from here (repeatable)")
+	acmeEmail := flag.String("acme-email", "", "Contact address for the ACME account, for expiry notices")
+	acmeDirectory := flag.String("acme-directory", defaultACMEDirectory, "ACME directory URL of the certificate authority")
+	acmeDir := flag.String("acme-dir", "", "Directory for the ACME account key and certificate (default acme next to -data)")
 	dataPath := flag.String("data", "records.tsv", "Path to records file")
+	fsync := flag.Bool("fsync", false, "Sync the records file and its directory to disk on every save, so changes survive a power loss")
+	useJournal := flag.Bool("journal", false, "Append changes to a journal next to -data and rewrite the records file in the background")
+	compactInterval := flag.Duration("journal-compact", defaultCompactInterval, "How often the journal is folded into the records file")
+	reloadSchedule := flag.String("reload-schedule", defaultReloadSchedule, "How often the records file is checked for edits made outside the server (empty disables)")
+	backupDir := flag.String("backup-dir", "", "Directory for timestamped backups of the records (default backups next to -data)")
+	backupKeep := flag.Int("backup-keep", defaultBackupKeep, "How many backups are kept; older ones are removed")
+	backupSchedule := flag.String("backup-schedule", defaultBackupSchedule, "How often the records are backed up if they changed (empty disables)")
+	staleSchedule := flag.String("stale-schedule", defaultStaleSchedule, "How often expired, disabled, dangling and unqueried records are reported (empty disables)")
+	etcdURL := flag.String("etcd", "", "etcd endpoint to share records with other instances, e.g. http://etcd:2379 (empty disables)")
+	etcdPrefix := flag.String("etcd-prefix", defaultEtcdPrefix, "Key prefix for the records in -etcd")
+	raftURL := flag.String("raft", "", "URL the other cluster nodes reach this one's raft listener at, e.g. http://10.0.0.1:13870 (empty disables raft)")
+	raftListen := flag.String("raft-listen", "", "Address the raft listener binds (default every interface, on the port of -raft)")
+	var raftPeers listFlag
+	flag.Var(&raftPeers, "raft-peer", "Raft URL of another cluster node (repeatable)")
+	raftSecretFile := flag.String("raft-secret-file", "", "File holding the secret every cluster node shares")
 	tokenPath := flag.String("token", "", "Path to API token file (empty to disable auth)")
+	tokenTTL := flag.Duration("token-ttl", 0, "API token lifetime (0 never expires)")
+	oidcIssuer := flag.String("oidc-issuer", "", "OpenID Connect issuer URL whose JWTs are accepted by the API and used to sign in to the UI (empty disables)")
+	oidcClientID := flag.String("oidc-client-id", "", "Client ID registered with -oidc-issuer; JWTs must be issued for it")
+	oidcSecretFile := flag.String("oidc-client-secret-file", "", "File holding the client secret, for confidential clients")
+	oidcRedirect := flag.String("oidc-redirect-url", "", "Callback URL registered with the provider (default derived from the request, /auth/callback)")
+	oidcScopes := flag.String("oidc-scopes", defaultOIDCScopes, "Scopes requested when signing in to the UI")
+	oidcGroupsClaim := flag.String("oidc-groups-claim", defaultOIDCGroupsClaim, "JWT claim listing the user's groups")
+	var oidcRoles listFlag
+	flag.Var(&oidcRoles, "oidc-role", "Group granted a scope, group=read or group=write (repeatable; none lets every signed-in user make changes)")
+	tokenRotateBefore := flag.Duration("token-rotate-before", defaultRotateBefore, "How long before a token expires its successor can be fetched from /api/token")
 	debug := flag.Bool("debug", false, "Enable debug logging")
+	logOutputs := flag.String("log", "stderr", "Where logs go: stderr, syslog, or both comma-separated")
+	syslogAddr := flag.String("syslog-addr", "", "Remote syslog collector, udp://host[:port] or tcp://host[:port] (default: the local syslog socket)")
+	syslogTag := flag.String("syslog-tag", defaultSyslogTag, "App name in syslog messages")
+	ddnsHosts := flag.String("ddns-hosts", "", "File of \"hostname token\" pairs that DynDNS2 clients may update at /nic/update (empty disables)")
+	accessLog := flag.Bool("access-log", false, "Log every HTTP request with its status, duration, token name and request ID")
+	queryLogSize := flag.Int("query-log-size", defaultQueryLogSize, "Recent queries kept for /api/querylog (0 disables)")
+	queryLogSample := flag.Int("query-log-sample", 1, "Keep one query in every N in the query log (1 keeps all)")
+	queryLogSampleAbove := flag.Int("query-log-sample-above", 0, "Only sample the query log past this many queries per second (0 always samples)")
+	anonymizeClients := flag.Bool("anonymize-clients", false, "Truncate client IPs to /24 (IPv4) and /56 (IPv6) in the query log, statistics and query log lines")
+	httpRateLimit := flag.Float64("http-rate-limit", 0, "Max API requests per second from one client IP (0 disables)")
+	httpTokenRateLimit := flag.Float64("http-token-rate-limit", 0, "Max API requests per second with one bearer token (0 disables)")
+	httpRateBurst := flag.Float64("http-rate-limit-burst", 0, "API requests a client may send at once before the HTTP rate limits apply (default: the rate)")
+	pprofOn := flag.Bool("pprof", false, "Serve runtime profiles at /debug/pprof/, behind -token")
+	var zones, webhooks, notifyTargets listFlag
+	flag.Var(&zones, "zone", "Zone apex we are authoritative for (repeatable)")
+	flag.Var(&webhooks, "webhook", "URL to POST zone change events to (repeatable)")
+	flag.Var(&notifyTargets, "notify", "Secondary host:port to send DNS NOTIFY to on zone changes (repeatable)")
+	var peers listFlag
+	flag.Var(&peers, "peer", "DNS host[:port] of another regieleki instance asked for names in -zone we have no records for, before the upstreams (repeatable)")
+	authoritativeOnly := flag.Bool("authoritative-only", false, "Disable recursion: answer only from local records and -zone, refuse other names")
+	var updateAllow listFlag
+	flag.Var(&updateAllow, "allow-update", "Network allowed to send DNS UPDATEs for -zone without TSIG, CIDR or IP (repeatable)")
+	var transferAllow listFlag
+	flag.Var(&transferAllow, "allow-transfer", "Network allowed to transfer -zone (AXFR) without TSIG, CIDR or IP (repeatable)")
+	tsigKeysPath := flag.String("tsig-keys", "", "File of \"name secret\" TSIG keys (hmac-sha256) that may sign DNS UPDATEs and zone transfers, also managed at /api/tsig-keys")
+	var secondaries listFlag
+	flag.Var(&secondaries, "secondary", "Zone to mirror from a primary by AXFR, zone=host[:port] (repeatable)")
+	secondaryKey := flag.String("secondary-key", "", "TSIG key from -tsig-keys to sign -secondary transfers with")
+	secondarySchedule := flag.String("secondary-schedule", defaultSecondarySchedule, "How often -secondary primaries are polled for a new serial")
+	soaMName := flag.String("soa-mname", "", "Primary nameserver named in the SOA and NS of each -zone (default: host name)")
+	mqttURL := flag.String("mqtt-url", "", "MQTT broker to publish record changes and query statistics to, mqtt://[user:pass@]host[:port] or mqtts:// (empty disables)")
+	mqttTopic := flag.String("mqtt-topic", defaultMQTTTopic, "Topic prefix for MQTT events")
+	mqttStatsSchedule := flag.String("mqtt-stats-schedule", defaultMQTTStatsSchedule, "How often query statistics are published to MQTT")
+	notifyDebounce := flag.Duration("notify-debounce", defaultNotifyDebounce, "Quiet period before zone change notifications are sent")
+	cacheSize := flag.Int("cache-size", -1, "Max cached upstream responses (0 disables caching, -1 uses the profile default)")
+	answerCacheSize := flag.Int("answer-cache-size", defaultAnswerCacheSize, "Max answers from local records kept encoded for the most asked names (0 disables)")
+	serveStale := flag.Duration("serve-stale", 24*time.Hour, "How long expired cache entries may be served when upstreams fail (0 disables)")
+	healthInterval := flag.Duration("health-interval", defaultHealthInterval, "How often upstreams are probed (0 disables probing)")
+	profileName := flag.String("profile", "default", "Resource profile: small, default, or server")
+	var upstreamFlags listFlag
+	flag.Var(&upstreamFlags, "upstream", "Upstream resolver, ip[:port] or tls://host[:port][?sni=name&pin=spki] (repeatable; default from resolv.conf)")
+	upstreamFile := flag.String("upstream-file", "", "Where upstreams changed via the API are saved (default upstreams.txt next to -data)")
+	rateLimit := flag.Float64("rate-limit", 0, "Max UDP queries per second from one client IP (0 disables)")
+	rateBurst := flag.Float64("rate-limit-burst", 0, "Queries a client may send at once before -rate-limit applies (default: the rate)")
+	rateTruncate := flag.Bool("rate-limit-truncate", false, "Answer over-limit queries with TC set instead of dropping them")
+	rrlRate := flag.Float64("rrl", 0, "Max identical UDP responses per second to one client network (0 disables)")
+	rrlSlip := flag.Int("rrl-slip", 2, "Send every Nth response dropped by -rrl truncated instead (0 drops all)")
+	udpSockets := flag.Int("udp-sockets", -1, "UDP sockets per -dns address, sharing it with SO_REUSEPORT, each read by its own loop (0 is GOMAXPROCS, -1 uses the profile default)")
+	maxUDPResponse := flag.Int("max-udp-response", 0, "Largest UDP response in bytes; bigger ones are truncated (0 is no limit)")
+	var blocklists listFlag
+	flag.Var(&blocklists, "blocklist", "Blocklist URL or file, hosts format or one domain per line (repeatable)")
+	blocklistFile := flag.String("blocklist-file", "", "Where blocklists changed via the API are saved (default blocklists.txt next to -data)")
+	blocklistSchedule := flag.String("blocklist-schedule", defaultBlocklistSchedule, "How often blocklists are refreshed")
+	blocklistZero := flag.Bool("blocklist-zero", false, "Answer blocked names with 0.0.0.0 / :: instead of NXDOMAIN")
+	mdns := flag.Bool("mdns", false, "Answer multicast DNS queries for records under .local")
+	mdnsIface := flag.String("mdns-interface", "", "Interface to join the mDNS group on (default: system choice)")
+	chaos := flag.Bool("chaos", false, "Enable fault injection rules managed via /api/chaos")
+	uiTitle := flag.String("ui-title", defaultUITitle, "Title shown in the web UI")
+	uiLogo := flag.String("ui-logo", "", "Image file shown as the web UI logo")
+	kiosk := flag.Bool("kiosk", false, "Serve a token-less, read-only status page at /kiosk")
+	var hostsFiles listFlag
+	flag.Var(&hostsFiles, "hosts-file", "Hosts-format file to mirror as read-only records, e.g. /etc/hosts (repeatable)")
+	hostsSchedule := flag.String("hosts-schedule", defaultHostsSchedule, "How often -hosts-file files are checked for changes")
+	var ldapAddrAttrs listFlag
+	ldapURL := flag.String("ldap-url", "", "Directory to sync host records from, ldap://host or ldaps://host (empty disables)")
+	ldapBindDN := flag.String("ldap-bind-dn", "", "DN to bind as for the directory sync (empty binds anonymously)")
+	ldapPasswordFile := flag.String("ldap-password-file", "", "File holding the bind password")
+	ldapBaseDN := flag.String("ldap-base-dn", "", "Search base for computer objects")
+	ldapFilter := flag.String("ldap-filter", ldapDefaultFilter, "LDAP search filter for computer objects")
+	flag.Var(&ldapAddrAttrs, "ldap-address-attr", "Attribute holding a host's IP addresses (repeatable; default ipHostNumber)")
+	ldapZone := flag.String("ldap-zone", "", "Zone the synced host records are published under")
+	ldapSchedule := flag.String("ldap-schedule", ldapDefaultSchedule, "How often the directory is synced")
+	tailscale := flag.Bool("tailscale", false, "Publish the tailnet's nodes as records, read from the local tailscaled")
+	tailscaleSocket := flag.String("tailscale-socket", defaultTailscaleSocket, "tailscaled's LocalAPI socket")
+	tailscaleZone := flag.String("tailscale-zone", "", "Zone tailnet nodes are published under (default: their MagicDNS names)")
+	tailscaleView := flag.String("tailscale-view", "", "View the tailnet records are served to (empty serves them to every listener)")
+	tailscaleSchedule := flag.String("tailscale-schedule", defaultTailscaleSchedule, "How often the tailnet's nodes are read")
+	var consulDCs, consulTags listFlag
+	consulURL := flag.String("consul-url", "", "Consul HTTP API to sync service records from, e.g. http://127.0.0.1:8500 (empty disables)")
+	consulTokenFile := flag.String("consul-token-file", "", "File holding a Consul ACL token")
+	flag.Var(&consulDCs, "consul-datacenter", "Datacenter to sync services from (repeatable; default the agent's own)")
+	flag.Var(&consulTags, "consul-tag", "Only sync instances with this tag, also publishing them as tag.service.service.consul (repeatable)")
+	consulDomain := flag.String("consul-domain", defaultConsulDomain, "Domain the service records are published under")
+	consulSchedule := flag.String("consul-schedule", defaultConsulSchedule, "How often the Consul catalog is synced")
+	var publicSyncs listFlag
+	flag.Var(&publicSyncs, "public-sync", "Push tagged records to a public DNS zone, cloudflare:zone-id or route53:hosted-zone-id (repeatable)")
+	cloudflareTokenFile := flag.String("cloudflare-token-file", "", "File holding a Cloudflare API token with DNS edit rights (default $CLOUDFLARE_API_TOKEN)")
+	publicSyncTag := flag.String("public-sync-tag", defaultPublicSyncTag, "Tag marking the records pushed to public DNS")
+	publicSyncTTL := flag.Duration("public-sync-ttl", defaultPublicSyncTTL, "TTL of the records pushed to public DNS")
+	publicSyncSchedule := flag.String("public-sync-schedule", defaultPublicSyncSchedule, "How often public DNS is reconciled, besides after every change to a tagged record")
+	standbyOf := flag.String("standby-of", "", "Primary HTTP URL to mirror; stay passive while it is healthy (empty disables standby mode)")
+	standbyToken := flag.String("standby-token", "", "Path to a file holding an API token for the primary; read scope is enough")
+	standbyInterval := flag.Duration("standby-interval", defaultStandbyInterval, "How often the primary is polled; it is considered down after three missed polls")
 	flag.Parse()
+	if len(dnsAddrs) == 0 && len(dnsIfaces) == 0 {
+		dnsAddrs = listFlag{":53"}
+	}
 
 	level := slog.LevelInfo
 	if *debug {
 		level = slog.LevelDebug
 	}
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	handler, err := logHandler(*logOutputs, *syslogAddr, *syslogTag, level)
+	if err != nil {
+		slog.Error("invalid log output", "error", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(slog.New(requestIDHandler{handler}))
+
+	profile, err := lookupProfile(*profileName)
+	if err != nil {
+		slog.Error("invalid profile", "error", err)
+		os.Exit(1)
+	}
+	profile.applyRuntime()
+	if *cacheSize < 0 {
+		*cacheSize = profile.CacheSize
+	}
+	slog.Info("resource profile", "name", profile.Name, "max_queries", profile.MaxQueries, "queue_size", profile.QueueSize, "cache_size", *cacheSize)
 
 	store, err := NewStore(*dataPath)
 	if err != nil {
 		slog.Error("failed to load store", "error", err)
 		os.Exit(1)
 	}
+	store.SetFsync(*fsync)
+	if *useJournal {
+		if err := store.OpenJournal(*dataPath + ".journal"); err != nil {
+			slog.Error("failed to open journal", "error", err)
+			os.Exit(1)
+		}
+	}
 	slog.Info("store loaded", "records", len(store.List()), "path", *dataPath)
 
-	var token string
+	var cluster *Raft
+	if *raftURL != "" {
+		if *etcdURL != "" {
+			slog.Error("-raft and -etcd can't be used together")
+			os.Exit(1)
+		}
+		if *raftSecretFile == "" {
+			slog.Error("-raft needs -raft-secret-file")
+			os.Exit(1)
+		}
+		secret, err := readPeerToken(*raftSecretFile)
+		if err != nil || secret == "" {
+			slog.Error("failed to read raft secret", "path", *raftSecretFile, "error", err)
+			os.Exit(1)
+		}
+		if *raftListen == "" {
+			if *raftListen, err = raftListenAddr(*raftURL); err != nil {
+				slog.Error("invalid raft url", "error", err)
+				os.Exit(1)
+			}
+		}
+		cluster = NewRaft(*raftURL, raftPeers, secret, *dataPath+".raft", store)
+		if err := cluster.Start(); err != nil {
+			slog.Error("failed to load raft state", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	var shared *Etcd
+	if *etcdURL != "" {
+		shared = NewEtcd(*etcdURL, *etcdPrefix, store)
+		startCtx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+		if err := shared.Start(startCtx); err != nil {
+			slog.Warn("etcd unavailable, serving the local copy", "endpoint", *etcdURL, "error", err)
+		} else {
+			slog.Info("records shared via etcd", "endpoint", *etcdURL, "records", len(store.List()))
+		}
+		cancel()
+	}
+
+	if len(webhooks) > 0 || len(notifyTargets) > 0 {
+		notifier := NewNotifier(NewZones(zones), webhooks, notifyTargets, *notifyDebounce)
+		store.Subscribe(notifier.Record)
+	}
+
+	var tokens *TokenSet
 	if *tokenPath != "" {
-		token, err = loadOrCreateToken(*tokenPath)
+		tokens, err = LoadTokenSet(*tokenPath, *tokenTTL, *tokenRotateBefore)
 		if err != nil {
 			slog.Error("failed to load token", "error", err)
 			os.Exit(1)
 		}
-		slog.Info("api token loaded", "path", *tokenPath)
+		if len(tokens.List()) == 0 {
+			slog.Warn("no api tokens yet, create one with regieleki access-token", "path", *tokenPath)
+		} else {
+			slog.Info("api tokens loaded", "path", *tokenPath)
+		}
+	}
+
+	var upstreams []string
+	for _, u := range upstreamFlags {
+		u, err := normalizeUpstream(u)
+		if err != nil {
+			slog.Error("invalid upstream", "error", err)
+			os.Exit(1)
+		}
+		upstreams = append(upstreams, u)
+	}
+	if len(upstreams) == 0 {
+		upstreams = parseResolvConf()
+	}
+	if *upstreamFile == "" {
+		*upstreamFile = filepath.Join(filepath.Dir(*dataPath), "upstreams.txt")
+	}
+	upstreamSet, err := LoadUpstreams(*upstreamFile, upstreams)
+	if err != nil {
+		slog.Error("failed to load upstreams", "path", *upstreamFile, "error", err)
+		os.Exit(1)
+	}
+	if !slices.Equal(upstreamSet.Addrs(), upstreams) {
+		slog.Info("using upstreams saved via the API", "path", *upstreamFile, "upstreams", upstreamSet.Addrs())
+	}
+
+	dns := NewDNSServer(store, nil)
+	dns.upstreams = upstreamSet
+	dns.applyProfile(profile)
+	dns.authoritativeOnly = *authoritativeOnly
+	dns.zones = NewZones(zones)
+	web := NewWebServer(store, tokens)
+	web.raft = cluster
+	activated, err := ActivatedSockets()
+	if err != nil {
+		slog.Error("failed to use sockets from systemd", "error", err)
+		os.Exit(1)
+	}
+	dns.activated, web.activated = activated, activated
+	if *oidcIssuer != "" {
+		if *oidcClientID == "" {
+			slog.Error("-oidc-issuer needs -oidc-client-id")
+			os.Exit(1)
+		}
+		oidc := NewOIDC(*oidcIssuer, *oidcClientID)
+		oidc.RedirectURL, oidc.Scopes, oidc.GroupsClaim = *oidcRedirect, *oidcScopes, *oidcGroupsClaim
+		if *oidcSecretFile != "" {
+			secret, err := os.ReadFile(*oidcSecretFile)
+			if err != nil {
+				slog.Error("failed to read oidc client secret", "error", err)
+				os.Exit(1)
+			}
+			oidc.ClientSecret = strings.TrimSpace(string(secret))
+		}
+		oidc.Roles = make(map[string]string)
+		for _, v := range oidcRoles {
+			group, scope, err := ParseOIDCRole(v)
+			if err != nil {
+				slog.Error("invalid -oidc-role", "error", err)
+				os.Exit(1)
+			}
+			oidc.Roles[group] = scope
+		}
+		web.oidc = oidc
+		slog.Info("oidc sign-in enabled", "issuer", oidc.Issuer, "roles", len(oidc.Roles))
+	}
+	if web.ui, err = LoadUIConfig(*uiTitle, *uiLogo, *kiosk); err != nil {
+		slog.Error("failed to load ui logo", "error", err)
+		os.Exit(1)
+	}
+	web.upstreams = dns.upstreams
+	web.dns = dns
+	web.zones = NewZones(zones)
+	dns.metrics = NewMetrics()
+	web.metrics = dns.metrics
+	web.pprof = *pprofOn
+	web.accessLog = *accessLog
+	if *queryLogSize > 0 {
+		dns.querylog = NewQueryLog(*queryLogSize)
+		dns.querylog.sample, dns.querylog.sampleAbove = *queryLogSample, *queryLogSampleAbove
+		web.querylog = dns.querylog
+	}
+	dns.anonymize = *anonymizeClients
+	if *ddnsHosts != "" {
+		if web.ddns, err = LoadDDNSHosts(*ddnsHosts); err != nil {
+			slog.Error("failed to load ddns hosts", "error", err)
+			os.Exit(1)
+		}
+	}
+	if *httpRateLimit > 0 || *httpTokenRateLimit > 0 {
+		web.limiter = NewHTTPRateLimiter(*httpRateLimit, *httpTokenRateLimit, *httpRateBurst)
+	}
+	var certs *CertReloader
+	if *httpCert != "" || *httpKey != "" {
+		if *httpCert == "" || *httpKey == "" {
+			slog.Error("-http-cert and -http-key must be given together")
+			os.Exit(1)
+		}
+		if certs, err = LoadCertReloader(*httpCert, *httpKey); err != nil {
+			slog.Error("failed to load http certificate", "error", err)
+			os.Exit(1)
+		}
+		web.tls = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+		slog.Info("http certificate loaded", "path", *httpCert, "expires", certs.NotAfter())
+	}
+	var acme *ACME
+	if len(acmeDomains) > 0 {
+		if certs != nil {
+			slog.Error("-acme-domain and -http-cert are mutually exclusive")
+			os.Exit(1)
+		}
+		if *acmeDir == "" {
+			*acmeDir = filepath.Join(filepath.Dir(*dataPath), "acme")
+		}
+		if acme, err = NewACME(*acmeDirectory, *acmeEmail, acmeDomains, *acmeDir, store); err != nil {
+			slog.Error("failed to set up acme", "error", err)
+			os.Exit(1)
+		}
+		certs = acme.certs
+		web.tls = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+	}
+	if *pprofOn && tokens == nil && web.oidc == nil {
+		slog.Warn("profiler enabled without -token, anyone who can reach the HTTP port can use it")
+	}
+
+	sched := NewScheduler()
+	web.jobs = sched
+
+	if *answerCacheSize > 0 {
+		dns.answers = NewAnswerCache(*answerCacheSize)
+	}
+	if *cacheSize > 0 {
+		dns.cache = NewCache(*cacheSize)
+		dns.cache.stale = *serveStale
+		web.cache = dns.cache
+	}
+
+	keys := newStaticTSIGKeyring(TSIGKeys{})
+	if *tsigKeysPath != "" {
+		if keys, err = LoadTSIGKeyring(*tsigKeysPath); err != nil {
+			slog.Error("failed to load tsig keys", "error", err)
+			os.Exit(1)
+		}
+		web.tsig = keys
+	}
+	if len(peers) > 0 {
+		if len(zones) == 0 {
+			slog.Error("-peer needs at least one -zone")
+			os.Exit(1)
+		}
+		dns.peers = NewPeers(peers, NewZones(zones))
+	}
+	if (len(updateAllow) > 0 || len(transferAllow) > 0 || *tsigKeysPath != "") && len(zones) == 0 {
+		slog.Error("dns updates and zone transfers need at least one -zone")
+		os.Exit(1)
+	}
+	if len(updateAllow) > 0 || *tsigKeysPath != "" {
+		allow, err := parsePrefixes(updateAllow)
+		if err != nil {
+			slog.Error("invalid -allow-update", "error", err)
+			os.Exit(1)
+		}
+		dns.updater = NewUpdater(store, NewZones(zones), allow, keys)
+		slog.Info("dns updates enabled", "zones", []string(NewZones(zones)), "networks", len(allow), "keys", len(keys.Keys()))
+	}
+	if len(transferAllow) > 0 || *tsigKeysPath != "" {
+		allow, err := parsePrefixes(transferAllow)
+		if err != nil {
+			slog.Error("invalid -allow-transfer", "error", err)
+			os.Exit(1)
+		}
+		dns.transfers = NewTransfers(store, NewZones(zones), allow, keys, *soaMName)
+		slog.Info("zone transfers enabled", "zones", []string(NewZones(zones)), "networks", len(allow), "keys", len(keys.Keys()), "mname", dns.transfers.mname)
+	}
+
+	if *rateLimit > 0 {
+		dns.limiter = NewRateLimiter(*rateLimit, *rateBurst, *rateTruncate)
+		dns.limiter.anonymize = *anonymizeClients
+	}
+
+	if *rrlRate > 0 {
+		dns.rrl = NewRRL(*rrlRate, *rrlSlip)
+	}
+	dns.maxUDPResponse = *maxUDPResponse
+	if *udpSockets >= 0 {
+		dns.udpSockets = *udpSockets
 	}
 
-	upstreams := parseResolvConf()
+	if *chaos {
+		dns.chaos = NewChaos()
+		web.chaos = dns.chaos
+		slog.Warn("chaos mode enabled, queries may be delayed or failed on purpose")
+	}
 
-	dns := NewDNSServer(store, upstreams)
-	web := NewWebServer(store, token)
+	if *standbyOf != "" {
+		var peerToken string
+		if *standbyToken != "" {
+			if peerToken, err = readPeerToken(*standbyToken); err != nil {
+				slog.Error("failed to read standby token", "error", err)
+				os.Exit(1)
+			}
+		}
+		dns.standby = NewStandby(*standbyOf, peerToken, *standbyInterval, store)
+		web.standby = dns.standby
+		slog.Info("standby mode, passive while primary is healthy", "primary", *standbyOf)
+	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	errc := make(chan error, 2)
-	go func() { errc <- dns.ListenAndServe(*dnsAddr) }()
+	if tokens != nil {
+		if err := sched.Add("token-reload", defaultReloadSchedule, 0, tokens.Reload); err != nil {
+			slog.Error("failed to schedule token reload", "error", err)
+			os.Exit(1)
+		}
+	}
+	if web.tsig != nil {
+		if err := sched.Add("tsig-reload", defaultReloadSchedule, 0, web.tsig.Reload); err != nil {
+			slog.Error("failed to schedule tsig key reload", "error", err)
+			os.Exit(1)
+		}
+	}
+	if tokens != nil && *tokenTTL > 0 {
+		sched.Add("token-prune", "@hourly", 5*time.Minute, func(context.Context) error {
+			return tokens.Prune()
+		})
+		sched.Trigger("token-prune")
+	}
+
+	sched.Add("record-expiry", "@every 1m", 0, func(ctx context.Context) error {
+		n, err := store.Expire(time.Now())
+		if n > 0 {
+			slog.InfoContext(ctx, "expired records removed", "records", n)
+		}
+		return err
+	})
+
+	if *blocklistFile == "" {
+		*blocklistFile = filepath.Join(filepath.Dir(*dataPath), "blocklists.txt")
+	}
+	blocklist, err := NewBlocklist(*blocklistFile, blocklists, *blocklistZero)
+	if err != nil {
+		slog.Error("failed to load blocklists", "path", *blocklistFile, "error", err)
+		os.Exit(1)
+	}
+	dns.blocklist = blocklist
+	web.blocklist = blocklist
+	if err := sched.Add("blocklist-refresh", *blocklistSchedule, 10*time.Minute, blocklist.Refresh); err != nil {
+		slog.Error("invalid blocklist schedule", "error", err)
+		os.Exit(1)
+	}
+	if len(blocklist.Sources()) > 0 {
+		sched.Trigger("blocklist-refresh")
+	}
+
+	if len(secondaries) > 0 {
+		secondary, err := NewSecondary(store, secondaries, *secondaryKey, keys)
+		if err != nil {
+			slog.Error("invalid secondary configuration", "error", err)
+			os.Exit(1)
+		}
+		if err := sched.Add("secondary-refresh", *secondarySchedule, 30*time.Second, secondary.Refresh); err != nil {
+			slog.Error("invalid secondary schedule", "error", err)
+			os.Exit(1)
+		}
+		secondary.trigger = func() { sched.Trigger("secondary-refresh") }
+		dns.secondary = secondary
+		sched.Trigger("secondary-refresh")
+	}
+
+	// With etcd or raft the records file is only a local copy of the shared set
+	if *reloadSchedule != "" && shared == nil && cluster == nil {
+		if err := sched.Add("data-reload", *reloadSchedule, 0, store.Reload); err != nil {
+			slog.Error("invalid reload schedule", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if *backupDir == "" {
+		*backupDir = filepath.Join(filepath.Dir(*dataPath), "backups")
+	}
+	backups := NewBackups(*backupDir, *backupKeep, store)
+	web.backups = backups
+	if *backupSchedule != "" {
+		if err := sched.Add("records-backup", *backupSchedule, 0, backups.Run); err != nil {
+			slog.Error("invalid backup schedule", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if *staleSchedule != "" {
+		stale := NewStaleReport(store, dns.zones, dns.stats)
+		if err := sched.AddReport("stale-records", *staleSchedule, time.Hour, stale.Run); err != nil {
+			slog.Error("invalid stale report schedule", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if acme != nil {
+		if err := sched.Add("acme-renew", acmeSchedule, time.Hour, acme.Run); err != nil {
+			slog.Error("invalid acme schedule", "error", err)
+			os.Exit(1)
+		}
+		sched.Trigger("acme-renew")
+	}
+
+	if len(hostsFiles) > 0 {
+		hosts := NewHostsSync(store, hostsFiles)
+		if err := sched.Add("hosts-sync", *hostsSchedule, 0, hosts.Run); err != nil {
+			slog.Error("invalid hosts schedule", "error", err)
+			os.Exit(1)
+		}
+		sched.Trigger("hosts-sync")
+	}
+
+	if *ldapURL != "" {
+		sync := &LDAPSync{
+			URL:          *ldapURL,
+			BindDN:       *ldapBindDN,
+			BaseDN:       *ldapBaseDN,
+			Filter:       *ldapFilter,
+			AddressAttrs: ldapAddrAttrs,
+			Zone:         *ldapZone,
+			store:        store,
+		}
+		if len(sync.AddressAttrs) == 0 {
+			sync.AddressAttrs = []string{"ipHostNumber"}
+		}
+		if *ldapPasswordFile != "" {
+			pw, err := os.ReadFile(*ldapPasswordFile)
+			if err != nil {
+				slog.Error("failed to read ldap password", "error", err)
+				os.Exit(1)
+			}
+			sync.Password = strings.TrimSpace(string(pw))
+		}
+		if err := sched.Add("ldap-sync", *ldapSchedule, time.Minute, sync.Run); err != nil {
+			slog.Error("invalid ldap schedule", "error", err)
+			os.Exit(1)
+		}
+		sched.Trigger("ldap-sync")
+	}
+
+	if *tailscale {
+		sync := NewTailscaleSync(store, *tailscaleSocket, *tailscaleZone, *tailscaleView)
+		if err := sched.Add("tailscale-sync", *tailscaleSchedule, 0, sync.Run); err != nil {
+			slog.Error("invalid tailscale schedule", "error", err)
+			os.Exit(1)
+		}
+		sched.Trigger("tailscale-sync")
+	}
+
+	if *consulURL != "" {
+		sync := NewConsulSync(store, *consulURL, *consulDomain, consulDCs, consulTags)
+		if *consulTokenFile != "" {
+			token, err := os.ReadFile(*consulTokenFile)
+			if err != nil {
+				slog.Error("failed to read consul token", "error", err)
+				os.Exit(1)
+			}
+			sync.Token = strings.TrimSpace(string(token))
+		}
+		if err := sched.Add("consul-sync", *consulSchedule, 0, sync.Run); err != nil {
+			slog.Error("invalid consul schedule", "error", err)
+			os.Exit(1)
+		}
+		sched.Trigger("consul-sync")
+	}
+
+	if len(publicSyncs) > 0 {
+		cloudflareToken := os.Getenv("CLOUDFLARE_API_TOKEN")
+		if *cloudflareTokenFile != "" {
+			token, err := os.ReadFile(*cloudflareTokenFile)
+			if err != nil {
+				slog.Error("failed to read cloudflare token", "error", err)
+				os.Exit(1)
+			}
+			cloudflareToken = strings.TrimSpace(string(token))
+		}
+		var providers []publicProvider
+		for _, spec := range publicSyncs {
+			prov, err := ParsePublicProvider(spec, cloudflareToken)
+			if err != nil {
+				slog.Error("invalid public sync", "error", err)
+				os.Exit(1)
+			}
+			providers = append(providers, prov)
+		}
+		sync := NewPublicSync(store, providers, *publicSyncTag, *publicSyncTTL)
+		if err := sched.Add("public-sync", *publicSyncSchedule, 0, sync.Run); err != nil {
+			slog.Error("invalid public sync schedule", "error", err)
+			os.Exit(1)
+		}
+		store.Subscribe(func(c Change) {
+			if sync.Tagged(c) {
+				sched.Trigger("public-sync")
+			}
+		})
+		sched.Trigger("public-sync")
+	}
+
+	if *mqttURL != "" {
+		mqtt := NewMQTTPublisher(*mqttURL, *mqttTopic, dns.stats)
+		if err := sched.Add("mqtt-stats", *mqttStatsSchedule, 0, mqtt.PublishStats); err != nil {
+			slog.Error("invalid mqtt stats schedule", "error", err)
+			os.Exit(1)
+		}
+		store.Subscribe(mqtt.Record)
+		go mqtt.Run(ctx)
+	}
+
+	// The store is loaded by now, so systemd hears we're ready once every
+	// listener is bound
+	ready := readiness(len(dnsAddrs) + len(dnsIfaces) + 1)
+	for _, spec := range dnsIfaces {
+		l, err := ParseInterfaceListener(dns, spec)
+		if err != nil {
+			slog.Error("invalid dns interface", "error", err)
+			os.Exit(1)
+		}
+		l.onListen = ready
+		job := "dns-interface-" + l.name
+		if err := sched.Add(job, defaultInterfaceSchedule, 0, l.Run); err != nil {
+			slog.Error("invalid dns interface", "error", err)
+			os.Exit(1)
+		}
+		sched.Trigger(job)
+	}
+
+	go sched.Run(ctx)
+	if *useJournal {
+		go store.RunCompaction(ctx, *compactInterval)
+	}
+	if dns.standby != nil {
+		go dns.standby.Run(ctx)
+	}
+	if shared != nil {
+		go shared.Run(ctx)
+	}
+	if cluster != nil {
+		go cluster.Run(ctx)
+	}
+	if *healthInterval > 0 && !*authoritativeOnly {
+		go dns.RunHealthChecks(ctx, *healthInterval)
+	}
+
+	// SIGHUP re-reads the HTTP certificate; without one it is ignored
+	// rather than ending the process
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if certs == nil {
+				continue
+			}
+			if err := certs.Reload(); err != nil {
+				slog.Error("failed to reload http certificate, keeping the old one", "error", err)
+				continue
+			}
+			slog.Info("http certificate reloaded", "path", certs.certPath, "expires", certs.NotAfter())
+		}
+	}()
+
+	if *mdns {
+		responder, err := NewMDNS(store, *mdnsIface)
+		if err != nil {
+			slog.Error("invalid mdns interface", "error", err)
+			os.Exit(1)
+		}
+		go func() {
+			if err := responder.ListenAndServe(); err != nil {
+				slog.Error("mdns responder stopped", "error", err)
+			}
+		}()
+	}
+
+	dns.onListen, web.onListen = ready, ready
+	errc := make(chan error, len(dnsAddrs)+2)
+	if cluster != nil {
+		go func() { errc <- cluster.ListenAndServe(*raftListen) }()
+	}
+	for _, listen := range dnsAddrs {
+		addr, view, _ := strings.Cut(listen, "=")
+		go func() { errc <- dns.ListenAndServeView(addr, view) }()
+	}
 	go func() { errc <- web.ListenAndServe(*httpAddr) }()
 
 	select {
@@ -64,9 +796,13 @@ func main() {
 		os.Exit(1)
 	case <-ctx.Done():
 		slog.Info("shutting down")
+		sdNotify("STOPPING=1")
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		web.Shutdown(shutdownCtx)
 		dns.Close()
+		if err := store.Compact(); err != nil {
+			slog.Error("journal compaction failed", "error", err)
+		}
 	}
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// mdnsTTL is what RFC 6762 recommends for address records.
+const mdnsTTL = 120
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// MDNS answers multicast DNS queries for A and AAAA records under .local
+// from the Store, and announces changes to them, so devices that only speak
+// mDNS can resolve managed names. It shares port 5353 with any other
+// responder on the host, such as Avahi, and only speaks IPv4.
+type MDNS struct {
+	store    *Store
+	iface    *net.Interface // nil lets the system choose
+	conn     *net.UDPConn
+	announce chan Change
+}
+
+func NewMDNS(store *Store, ifaceName string) (*MDNS, error) {
+	m := &MDNS{store: store, announce: make(chan Change, 64)}
+	if ifaceName != "" {
+		iface, err := net.InterfaceByName(ifaceName)
+		if err != nil {
+			return nil, err
+		}
+		m.iface = iface
+	}
+	return m, nil
+}
+
+func (m *MDNS) ListenAndServe() error {
+	conn, err := net.ListenMulticastUDP("udp4", m.iface, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	m.conn = conn
+	slog.Info("mdns responder listening", "group", mdnsGroup)
+
+	m.store.Subscribe(func(c Change) {
+		// Listeners run under the store lock, so never block here
+		select {
+		case m.announce <- c:
+		default:
+		}
+	})
+	go m.announceChanges()
+
+	buf := make([]byte, udpBufSize)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		resp, unicast := m.respond(buf[:n], from)
+		if resp == nil {
+			continue
+		}
+		dst := mdnsGroup
+		if unicast {
+			dst = from
+		}
+		conn.WriteToUDP(resp, dst)
+	}
+}
+
+// announceChanges multicasts added and updated records and sends goodbyes
+// (TTL 0) for removed ones, so caches on the link don't wait out the TTL.
+func (m *MDNS) announceChanges() {
+	for c := range m.announce {
+		var rrs []byte
+		var count uint16
+		if c.Old != nil && (c.New == nil || *c.Old != *c.New) {
+			if rr := mdnsRR(*c.Old, 0); rr != nil {
+				rrs = append(rrs, rr...)
+				count++
+			}
+		}
+		if c.New != nil {
+			if rr := mdnsRR(*c.New, mdnsTTL); rr != nil {
+				rrs = append(rrs, rr...)
+				count++
+			}
+		}
+		if count > 0 {
+			m.conn.WriteToUDP(mdnsMessage(count, rrs), mdnsGroup)
+		}
+	}
+}
+
+// respond builds the answer to an mDNS query, and whether it goes straight
+// back to the sender: either the question asked for a unicast reply (QU) or
+// the sender is a plain resolver not using port 5353, which gets a regular
+// DNS response with its ID and question echoed.
+func (m *MDNS) respond(query []byte, from *net.UDPAddr) ([]byte, bool) {
+	if len(query) < 12 || query[2]&0x80 != 0 || query[2]&0x78 != 0 {
+		return nil, false
+	}
+	legacy := from.Port != mdnsGroup.Port
+	qdcount := int(binary.BigEndian.Uint16(query[4:6]))
+
+	var rrs []byte
+	var count uint16
+	unicast := legacy
+	offset := 12
+	for range qdcount {
+		name, end := parseDNSName(query, offset)
+		if end < 0 || end+4 > len(query) {
+			return nil, false
+		}
+		qtype := binary.BigEndian.Uint16(query[end:])
+		qclass := binary.BigEndian.Uint16(query[end+2:])
+		if qclass&0x8000 != 0 {
+			unicast = true
+		}
+		name = strings.ToLower(name)
+		if !strings.HasSuffix(name, ".local") {
+			offset = end + 4
+			continue
+		}
+		records, ok := m.store.Resolve(name, qtype)
+		if ok && legacy {
+			// Legacy resolvers get one answer to their first question
+			if resp := buildDNSResponse(query[:end+4], end+4, mdnsAddresses(records, name)); binary.BigEndian.Uint16(resp[6:8]) > 0 {
+				return resp, true
+			}
+			return nil, false
+		}
+		for _, r := range mdnsAddresses(records, name) {
+			if rr := mdnsRR(r, mdnsTTL); rr != nil {
+				rrs = append(rrs, rr...)
+				count++
+			}
+		}
+		offset = end + 4
+	}
+	if count == 0 {
+		return nil, false
+	}
+	return mdnsMessage(count, rrs), unicast
+}
+
+// mdnsAddresses keeps the A and AAAA records owned by name; mDNS clients
+// don't expect to chase CNAMEs.
+func mdnsAddresses(records []Record, name string) []Record {
+	var out []Record
+	for _, r := range records {
+		if (r.Type == "A" || r.Type == "AAAA") && strings.EqualFold(r.Domain, name) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// mdnsRR encodes r as an answer with the cache-flush bit set, or nil if it is
+// not an address under .local.
+func mdnsRR(r Record, ttl uint32) []byte {
+	if !strings.HasSuffix(strings.ToLower(r.Domain), ".local") {
+		return nil
+	}
+	ip := net.ParseIP(r.Value)
+	var rtype uint16
+	var rdata []byte
+	switch {
+	case ip == nil:
+		return nil
+	case r.Type == "A" && ip.To4() != nil:
+		rtype, rdata = 1, ip.To4()
+	case r.Type == "AAAA" && ip.To4() == nil:
+		rtype, rdata = 28, ip.To16()
+	default:
+		return nil
+	}
+	rr := encodeDNSName(r.Domain)
+	rr = binary.BigEndian.AppendUint16(rr, rtype)
+	rr = binary.BigEndian.AppendUint16(rr, 0x8001) // cache-flush, class IN
+	rr = binary.BigEndian.AppendUint32(rr, ttl)
+	rr = binary.BigEndian.AppendUint16(rr, uint16(len(rdata)))
+	return append(rr, rdata...)
+}
+
+// mdnsMessage wraps answers in an unsolicited-style response: ID 0, QR and
+// AA set, no questions.
+func mdnsMessage(ancount uint16, answers []byte) []byte {
+	msg := []byte{0, 0, 0x84, 0, 0, 0, byte(ancount >> 8), byte(ancount), 0, 0, 0, 0}
+	return append(msg, answers...)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestMDNSRespond(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Record{Domain: "printer.local", Type: "A", Value: "192.168.1.20"})
+	store.Add(Record{Domain: "printer.local", Type: "AAAA", Value: "fd00::20"})
+	store.Add(Record{Domain: "app.my.lan", Type: "A", Value: "192.168.1.30"})
+	m, err := NewMDNS(store, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 50), Port: 5353}
+
+	resp, unicast := m.respond(buildTestQuery("Printer.local", 255, 1), peer)
+	if resp == nil || unicast {
+		t.Fatalf("ANY query: resp=%v unicast=%v, want a multicast answer", resp, unicast)
+	}
+	msg, err := parseMessage(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 0 || !msg.AA || len(msg.Questions) != 0 || len(msg.Answers) != 2 {
+		t.Fatalf("response = %+v", msg)
+	}
+	if a := msg.Answers[0]; a.Class != 0x8001 || a.TTL != mdnsTTL || a.Data != "192.168.1.20" {
+		t.Errorf("answer = %+v, want cache-flush IN A with TTL %d", a, mdnsTTL)
+	}
+
+	// QU questions are answered straight to the sender
+	if _, unicast := m.respond(buildTestQuery("printer.local", 1, 0x8001), peer); !unicast {
+		t.Error("QU question was not answered by unicast")
+	}
+
+	// Names outside .local and unknown names are left to other responders
+	if resp, _ := m.respond(buildTestQuery("app.my.lan", 1, 1), peer); resp != nil {
+		t.Error("answered a name outside .local")
+	}
+	if resp, _ := m.respond(buildTestQuery("scanner.local", 1, 1), peer); resp != nil {
+		t.Error("answered an unknown name")
+	}
+
+	// A plain resolver querying from another port gets a normal reply
+	legacy := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 50), Port: 40000}
+	query := buildTestQuery("printer.local", 1, 1)
+	resp, unicast = m.respond(query, legacy)
+	if !unicast || resp == nil {
+		t.Fatal("legacy query was not answered by unicast")
+	}
+	if msg, _ := parseMessage(resp); msg.ID != 0xABCD || len(msg.Questions) != 1 || len(msg.Answers) != 1 {
+		t.Errorf("legacy response = %+v", msg)
+	}
+}
+
+func TestMDNSGoodbye(t *testing.T) {
+	rr := mdnsRR(Record{Domain: "printer.local", Type: "A", Value: "192.168.1.20"}, 0)
+	msg, err := parseMessage(mdnsMessage(1, rr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answers) != 1 || msg.Answers[0].TTL != 0 {
+		t.Errorf("goodbye = %+v", msg.Answers)
+	}
+	if mdnsRR(Record{Domain: "app.my.lan", Type: "A", Value: "10.0.0.1"}, mdnsTTL) != nil {
+		t.Error("encoded a record outside .local")
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics counts what the DNS and HTTP servers do since startup, for
+// scraping in the Prometheus text format at /metrics. Counters only ever
+// grow; rates and ratios are left to the queries on the Prometheus side.
+type Metrics struct {
+	start time.Time
+
+	mu        sync.Mutex
+	queries   map[queryLabels]uint64
+	outcomes  [numOutcomes]histogram
+	upstreams map[string]*upstreamMetrics
+	requests  map[httpLabels]uint64
+	durations map[string]*histogram // by HTTP route
+
+	droppedCapacity  atomic.Uint64
+	droppedRateLimit atomic.Uint64
+	readErrors       atomic.Uint64
+	coalesced        atomic.Uint64
+}
+
+type queryLabels struct{ qtype, rcode string }
+
+type httpLabels struct {
+	method, route string
+	code          int
+}
+
+type upstreamMetrics struct {
+	latency  histogram
+	failures uint64
+}
+
+// histogram counts durations in the latencyBounds buckets, plus one for
+// everything slower, and their sum.
+type histogram struct {
+	counts [len(latencyBounds) + 1]uint64
+	sum    time.Duration
+}
+
+func (h *histogram) observe(d time.Duration) {
+	b := len(latencyBounds)
+	for i, bound := range latencyBounds {
+		if d <= bound {
+			b = i
+			break
+		}
+	}
+	h.counts[b]++
+	h.sum += d
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		start:     time.Now(),
+		queries:   make(map[queryLabels]uint64),
+		upstreams: make(map[string]*upstreamMetrics),
+		requests:  make(map[httpLabels]uint64),
+		durations: make(map[string]*histogram),
+	}
+}
+
+// Query records one answered query. Types we don't know by name are counted
+// together, which keeps the number of series bounded.
+func (m *Metrics) Query(query, resp []byte, o outcome, d time.Duration) {
+	qtype := "other"
+	if end := skipDNSName(query, 12); end >= 0 && end+2 <= len(query) {
+		if name := typeString(binary.BigEndian.Uint16(query[end : end+2])); !strings.HasPrefix(name, "TYPE") {
+			qtype = name
+		}
+	}
+	rcode := rcodeString(int(resp[3] & 0x0F))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queries[queryLabels{qtype, rcode}]++
+	m.outcomes[o].observe(d)
+}
+
+// Upstream records one exchange with an upstream resolver.
+func (m *Metrics) Upstream(addr string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.upstreams[addr]
+	if u == nil {
+		u = &upstreamMetrics{}
+		m.upstreams[addr] = u
+	}
+	u.latency.observe(d)
+	if err != nil {
+		u.failures++
+	}
+}
+
+// Middleware counts HTTP requests by method, route pattern and status code.
+// Requests that matched no route, and methods we don't serve, are counted
+// under "other", so clients can't create series at will.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		route := r.Pattern
+		if route == "" {
+			route = "other"
+		} else if _, path, ok := strings.Cut(route, " "); ok {
+			route = path
+		}
+		method := r.Method
+		if !slices.Contains(httpMethods, method) {
+			method = "other"
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.requests[httpLabels{method, route, sw.code}]++
+		h := m.durations[route]
+		if h == nil {
+			h = &histogram{}
+			m.durations[route] = h
+		}
+		h.observe(time.Since(start))
+	})
+}
+
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// statusWriter remembers the status code a handler sent.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// metricsGauges are values read from the rest of the server at scrape time.
+type metricsGauges struct {
+	localRecords  int
+	sourceRecords map[string]int
+	cacheEntries  int
+	cacheEnabled  bool
+	queueDepth    int
+	queueSize     int
+	dnsEnabled    bool
+}
+
+// Write renders every metric in the Prometheus text exposition format.
+func (m *Metrics) Write(w io.Writer, g metricsGauges) error {
+	bw := bufio.NewWriter(w)
+	p := func(format string, args ...any) { fmt.Fprintf(bw, format, args...) }
+	header := func(name, kind, help string) {
+		p("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	header("regieleki_dns_queries_total", "counter", "DNS queries answered, by query type and response code.")
+	for _, k := range sortedKeys(m.queries, func(k queryLabels) string { return k.qtype + " " + k.rcode }) {
+		p("regieleki_dns_queries_total{type=%q,rcode=%q} %d\n", k.qtype, k.rcode, m.queries[k])
+	}
+	header("regieleki_dns_query_duration_seconds", "histogram", "Time to answer a DNS query, by how it was answered.")
+	for o, h := range m.outcomes {
+		writeHistogram(bw, "regieleki_dns_query_duration_seconds", fmt.Sprintf("outcome=%q", outcomeNames[o]), &h)
+	}
+	header("regieleki_dns_dropped_total", "counter", "UDP queries turned away, by reason: a full worker queue or the rate limit; with -rate-limit-truncate rate-limited ones get an empty truncated answer.")
+	p("regieleki_dns_dropped_total{reason=\"capacity\"} %d\n", m.droppedCapacity.Load())
+	p("regieleki_dns_dropped_total{reason=\"rate_limit\"} %d\n", m.droppedRateLimit.Load())
+	header("regieleki_dns_read_errors_total", "counter", "Failed reads on UDP listeners; the listener keeps serving.")
+	p("regieleki_dns_read_errors_total %d\n", m.readErrors.Load())
+
+	header("regieleki_upstream_coalesced_total", "counter", "Queries answered with the upstream reply to an identical query already in flight, instead of forwarding their own.")
+	p("regieleki_upstream_coalesced_total %d\n", m.coalesced.Load())
+
+	upstreams := sortedKeys(m.upstreams, func(k string) string { return k })
+	header("regieleki_upstream_duration_seconds", "histogram", "Time of exchanges with upstream resolvers, failed ones included.")
+	for _, addr := range upstreams {
+		writeHistogram(bw, "regieleki_upstream_duration_seconds", labelPair("upstream", addr), &m.upstreams[addr].latency)
+	}
+	header("regieleki_upstream_failures_total", "counter", "Failed exchanges with upstream resolvers.")
+	for _, addr := range upstreams {
+		p("regieleki_upstream_failures_total{%s} %d\n", labelPair("upstream", addr), m.upstreams[addr].failures)
+	}
+
+	if g.dnsEnabled {
+		header("regieleki_dns_queue_depth", "gauge", "UDP queries waiting for a worker; at regieleki_dns_queue_size new ones are dropped for capacity.")
+		p("regieleki_dns_queue_depth %d\n", g.queueDepth)
+		header("regieleki_dns_queue_size", "gauge", "UDP queries that may wait for a worker.")
+		p("regieleki_dns_queue_size %d\n", g.queueSize)
+	}
+	if g.cacheEnabled {
+		header("regieleki_cache_entries", "gauge", "Upstream responses in the cache.")
+		p("regieleki_cache_entries %d\n", g.cacheEntries)
+	}
+	header("regieleki_records", "gauge", "Records in the store, by source; local ones are managed through the API.")
+	p("regieleki_records{source=\"local\"} %d\n", g.localRecords)
+	for _, name := range sortedKeys(g.sourceRecords, func(k string) string { return k }) {
+		p("regieleki_records{%s} %d\n", labelPair("source", name), g.sourceRecords[name])
+	}
+
+	header("regieleki_http_requests_total", "counter", "HTTP requests, by method, route and status code.")
+	for _, k := range sortedKeys(m.requests, func(k httpLabels) string { return fmt.Sprintf("%s %s %d", k.route, k.method, k.code) }) {
+		p("regieleki_http_requests_total{method=%q,%s,code=\"%d\"} %d\n", k.method, labelPair("route", k.route), k.code, m.requests[k])
+	}
+	header("regieleki_http_request_duration_seconds", "histogram", "Time to serve HTTP requests, by route.")
+	for _, route := range sortedKeys(m.durations, func(k string) string { return k }) {
+		writeHistogram(bw, "regieleki_http_request_duration_seconds", labelPair("route", route), m.durations[route])
+	}
+
+	header("process_start_time_seconds", "gauge", "Start time of the process since the Unix epoch in seconds.")
+	p("process_start_time_seconds %d\n", m.start.Unix())
+	return bw.Flush()
+}
+
+func writeHistogram(w io.Writer, name, labels string, h *histogram) {
+	var total uint64
+	for i, bound := range latencyBounds {
+		total += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound.Seconds(), total)
+	}
+	total += h.counts[len(latencyBounds)]
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, total)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum.Seconds())
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, total)
+}
+
+// labelPair renders name="value" with the escaping the text format wants,
+// for values that come from configuration or clients.
+func labelPair(name, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return name + `="` + value + `"`
+}
+
+// sortedKeys returns the keys of m ordered by key, so scrapes list series
+// in a stable order.
+func sortedKeys[K comparable, V any](m map[K]V, key func(K) string) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b K) int { return strings.Compare(key(a), key(b)) })
+	return keys
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	ws, store := testWebServer(t)
+	ws.metrics = NewMetrics()
+	ws.cache = NewCache(10)
+	ws.dns = NewDNSServer(store, nil)
+	store.Add(Record{Domain: "app.local", Type: "A", Value: "10.0.0.1"})
+	store.SetSource("hosts:/etc/hosts", []Record{{Domain: "nas.lan", Type: "A", Value: "10.0.0.9"}})
+
+	query := buildTestQuery("app.local", 1, 1)
+	resp := append([]byte(nil), query...)
+	resp[2], resp[3] = 0x84, 0x03 // NXDOMAIN
+	ws.metrics.Query(query, resp, outcomeLocal, 3*time.Millisecond)
+	ws.metrics.Upstream("1.1.1.1:53", 30*time.Millisecond, nil)
+	ws.metrics.Upstream("1.1.1.1:53", time.Second, errors.New("timeout"))
+	ws.metrics.droppedCapacity.Add(2)
+
+	h := ws.Handler()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PATCH", "/api/records/7", strings.NewReader("{}")))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/nope", nil))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	for _, want := range []string{
+		`regieleki_dns_queries_total{type="A",rcode="NXDOMAIN"} 1`,
+		`regieleki_dns_query_duration_seconds_bucket{outcome="local",le="0.002"} 0`,
+		`regieleki_dns_query_duration_seconds_bucket{outcome="local",le="0.005"} 1`,
+		`regieleki_dns_query_duration_seconds_count{outcome="cached"} 0`,
+		`regieleki_dns_dropped_total{reason="capacity"} 2`,
+		`regieleki_dns_read_errors_total 0`,
+		`regieleki_dns_queue_depth 0`,
+		`regieleki_dns_queue_size 1000`,
+		`regieleki_upstream_duration_seconds_count{upstream="1.1.1.1:53"} 2`,
+		`regieleki_upstream_failures_total{upstream="1.1.1.1:53"} 1`,
+		`regieleki_cache_entries 0`,
+		`regieleki_records{source="local"} 1`,
+		`regieleki_records{source="hosts:/etc/hosts"} 1`,
+		`regieleki_http_requests_total{method="PATCH",route="/api/records/{id}",code="404"} 1`,
+		`regieleki_http_requests_total{method="other",route="other",code="405"} 1`,
+		`# TYPE regieleki_http_request_duration_seconds histogram`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
+
+func TestMetricsAndProfilesNeedToken(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := LoadTokenSet(filepath.Join(t.TempDir(), "token"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWebServer(store, tokens)
+	ws.metrics = NewMetrics()
+	ws.pprof = true
+	for _, path := range []string{"/metrics", "/debug/pprof/", "/debug/pprof/heap"} {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 401 {
+			t.Errorf("%s: status %d without a token, want 401", path, w.Code)
+		}
+	}
+
+	token, _ := tokens.Create(defaultTokenName, tokenScopeWrite, 0)
+	req := httptest.NewRequest("GET", "/debug/pprof/heap", nil)
+	req.Header.Set("Authorization", "Bearer "+token.Value)
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	if w.Code != 200 || w.Body.Len() == 0 {
+		t.Errorf("heap profile with a token: status %d", w.Code)
+	}
+}
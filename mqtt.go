@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// A minimal MQTT 3.1.1 client: connect, QoS 0 publish and keepalive pings.
+// That is all event publishing needs, and it keeps the binary free of
+// third-party dependencies.
+
+const (
+	defaultMQTTTopic         = "regieleki"
+	defaultMQTTStatsSchedule = "@every 1m"
+	mqttTimeout              = 10 * time.Second
+	mqttKeepAlive            = 60 * time.Second
+	mqttRetry                = 5 * time.Second
+	mqttQueue                = 256 // events waiting for the broker; more are dropped
+
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPingreq    = 0xC0
+	mqttDisconnect = 0xE0
+)
+
+// mqttMessage is one PUBLISH.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// appendMQTTString appends s with its two-byte length prefix.
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttPacket frames body under a fixed header with the remaining length
+// encoded seven bits at a time.
+func mqttPacket(header byte, body []byte) []byte {
+	out := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(out, body...)
+}
+
+func buildMQTTConnect(clientID, user, password string, keepAlive time.Duration) []byte {
+	var flags byte = 0x02 // clean session
+	if user != "" {
+		flags |= 0x80
+		if password != "" {
+			flags |= 0x40
+		}
+	}
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags) // protocol level 4 is 3.1.1
+	body = binary.BigEndian.AppendUint16(body, uint16(keepAlive/time.Second))
+	body = appendMQTTString(body, clientID)
+	if user != "" {
+		body = appendMQTTString(body, user)
+		if password != "" {
+			body = appendMQTTString(body, password)
+		}
+	}
+	return mqttPacket(mqttConnect, body)
+}
+
+func buildMQTTPublish(m mqttMessage) []byte {
+	header := byte(mqttPublish)
+	if m.retain {
+		header |= 0x01
+	}
+	return mqttPacket(header, append(appendMQTTString(nil, m.topic), m.payload...))
+}
+
+// readMQTTPacket reads one packet and returns its fixed header byte and body.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7F) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// MQTTPublisher publishes store changes and query statistics to an MQTT
+// broker, for home automation to react to: every change as JSON to
+// topic/records/<op>, and a statistics summary to topic/stats, retained so
+// new subscribers see the latest one. Events are queued and published by
+// Run, so a slow or missing broker never holds up DNS or the store; while
+// it is unreachable, events beyond the queue are dropped.
+type MQTTPublisher struct {
+	URL      string // mqtt://[user:password@]host[:port] or mqtts://
+	Topic    string
+	ClientID string
+	stats    *Stats
+	queue    chan mqttMessage
+}
+
+func NewMQTTPublisher(rawURL, topic string, stats *Stats) *MQTTPublisher {
+	if topic == "" {
+		topic = defaultMQTTTopic
+	}
+	host, _ := os.Hostname()
+	return &MQTTPublisher{
+		URL:      rawURL,
+		Topic:    topic,
+		ClientID: "regieleki-" + host,
+		stats:    stats,
+		queue:    make(chan mqttMessage, mqttQueue),
+	}
+}
+
+func (p *MQTTPublisher) enqueue(m mqttMessage) {
+	select {
+	case p.queue <- m:
+	default:
+		slog.Debug("mqtt queue full, dropping event", "topic", m.topic)
+	}
+}
+
+// Record queues a change event; it is registered as a Store listener.
+func (p *MQTTPublisher) Record(c Change) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return
+	}
+	p.enqueue(mqttMessage{topic: p.Topic + "/records/" + c.Op, payload: payload})
+}
+
+// PublishStats queues a summary of the last statistics slot with its top
+// domains, blocked domains and clients. It runs as a scheduled job.
+func (p *MQTTPublisher) PublishStats(ctx context.Context) error {
+	payload, err := json.Marshal(p.stats.Report(statsSlotLength, 10))
+	if err != nil {
+		return err
+	}
+	p.enqueue(mqttMessage{topic: p.Topic + "/stats", payload: payload, retain: true})
+	return nil
+}
+
+// Run publishes queued events until ctx is done, reconnecting after
+// failures.
+func (p *MQTTPublisher) Run(ctx context.Context) {
+	for {
+		err := p.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("mqtt connection failed, retrying", "broker", redactURL(p.URL), "error", err, "in", mqttRetry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(mqttRetry):
+		}
+	}
+}
+
+func (p *MQTTPublisher) dial(ctx context.Context) (net.Conn, *url.URL, error) {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	d := &net.Dialer{Timeout: mqttTimeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		conn, err = d.DialContext(ctx, "tcp", hostPortDefault(u.Host, "1883"))
+	case "mqtts", "ssl":
+		td := &tls.Dialer{NetDialer: d, Config: &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}}
+		conn, err = td.DialContext(ctx, "tcp", hostPortDefault(u.Host, "8883"))
+	default:
+		return nil, nil, fmt.Errorf("mqtt: unsupported scheme %q (want mqtt:// or mqtts://)", u.Scheme)
+	}
+	return conn, u, err
+}
+
+// session connects, then writes queued events and keepalive pings until
+// the connection fails or ctx is done.
+func (p *MQTTPublisher) session(ctx context.Context) error {
+	conn, u, err := p.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	password, _ := u.User.Password()
+	conn.SetDeadline(time.Now().Add(mqttTimeout))
+	if _, err := conn.Write(buildMQTTConnect(p.ClientID, u.User.Username(), password, mqttKeepAlive)); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	header, body, err := readMQTTPacket(r)
+	if err != nil {
+		return err
+	}
+	if header != mqttConnack || len(body) != 2 {
+		return fmt.Errorf("mqtt: unexpected packet 0x%02x instead of CONNACK", header)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("mqtt: connection refused, code %d", body[1])
+	}
+	conn.SetDeadline(time.Time{})
+	slog.Info("mqtt connected", "broker", u.Host, "topic", p.Topic)
+
+	// The broker only ever sends PINGRESP to a publish-only client; reading
+	// is just how a dropped connection is noticed
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+			if _, _, err := readMQTTPacket(r); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+	for {
+		var packet []byte
+		select {
+		case <-ctx.Done():
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			conn.Write([]byte{mqttDisconnect, 0})
+			return ctx.Err()
+		case err := <-closed:
+			return err
+		case m := <-p.queue:
+			packet = buildMQTTPublish(m)
+		case <-ping.C:
+			packet = []byte{mqttPingreq, 0}
+		}
+		conn.SetWriteDeadline(time.Now().Add(mqttTimeout))
+		if _, err := conn.Write(packet); err != nil {
+			return err
+		}
+	}
+}
+
+// redactURL hides a password in rawURL, for logging.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
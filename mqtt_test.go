@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMQTTPacketLength(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384} {
+		packet := mqttPacket(mqttPublish, make([]byte, n))
+		header, body, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(packet)))
+		if err != nil || header != mqttPublish || len(body) != n {
+			t.Errorf("%d bytes: header 0x%02x, %d bytes, %v", n, header, len(body), err)
+		}
+	}
+}
+
+// fakeBroker accepts one client, checks its CONNECT and sends every
+// PUBLISH it receives, as topic and payload, to the returned channel.
+func fakeBroker(t *testing.T) (string, <-chan [2]string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	published := make(chan [2]string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		header, body, err := readMQTTPacket(r)
+		if err != nil || header != mqttConnect {
+			t.Errorf("CONNECT: 0x%02x %v", header, err)
+			return
+		}
+		if !bytes.Contains(body, []byte("user")) || !bytes.Contains(body, []byte("pass")) {
+			t.Errorf("CONNECT without credentials: %q", body)
+		}
+		conn.Write([]byte{mqttConnack, 2, 0, 0})
+		for {
+			header, body, err := readMQTTPacket(r)
+			if err != nil {
+				return
+			}
+			if header&0xF0 != mqttPublish {
+				continue
+			}
+			n := int(binary.BigEndian.Uint16(body))
+			published <- [2]string{string(body[2 : 2+n]), string(body[2+n:])}
+		}
+	}()
+	return ln.Addr().String(), published
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	addr, published := fakeBroker(t)
+	stats := NewStats()
+	stats.Record(buildTestQuery("nas.my.lan", 1, 1), netip.MustParseAddr("10.0.0.9"), outcomeLocal)
+	p := NewMQTTPublisher("mqtt://user:pass@"+addr, "home/dns", stats)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+
+	p.Record(Change{Op: "add", New: &Record{Domain: "phone.my.lan", Type: "A", Value: "10.0.0.20"}, Serial: 7})
+	p.PublishStats(ctx)
+
+	next := func() [2]string {
+		t.Helper()
+		select {
+		case m := <-published:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing published")
+			return [2]string{}
+		}
+	}
+	m := next()
+	var c Change
+	if m[0] != "home/dns/records/add" || json.Unmarshal([]byte(m[1]), &c) != nil || c.New.Domain != "phone.my.lan" {
+		t.Errorf("change event = %v", m)
+	}
+	m = next()
+	if m[0] != "home/dns/stats" || !strings.Contains(m[1], `"queries":1`) {
+		t.Errorf("stats event = %v", m)
+	}
+}
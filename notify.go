@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNotifyDebounce = 2 * time.Second
+	webhookTimeout        = 5 * time.Second
+	notifyTimeout         = 2 * time.Second // doubles with every retransmission
+	notifyAttempts        = 5
+)
+
+// ZoneEvent summarises every change made to one zone within a debounce
+// window. It is the JSON body POSTed to webhooks.
+type ZoneEvent struct {
+	Zone    string   `json:"zone"`
+	Serial  uint32   `json:"serial"`
+	Added   int      `json:"added"`
+	Updated int      `json:"updated"`
+	Deleted int      `json:"deleted"`
+	Changes []Change `json:"changes"`
+}
+
+// Notifier collects store changes and, once the store has been quiet for the
+// debounce interval, emits a single event per affected zone to webhooks and
+// a DNS NOTIFY to secondaries. Bulk imports therefore produce one
+// notification instead of one per record.
+type Notifier struct {
+	zones    Zones
+	webhooks []string
+	targets  []string
+	debounce time.Duration
+	client   *http.Client
+	retry    time.Duration // first NOTIFY retransmission timeout
+
+	mu      sync.Mutex
+	pending map[string][]Change
+	timer   *time.Timer
+}
+
+func NewNotifier(zones Zones, webhooks, targets []string, debounce time.Duration) *Notifier {
+	return &Notifier{
+		zones:    zones,
+		webhooks: webhooks,
+		targets:  targets,
+		debounce: debounce,
+		client:   &http.Client{Timeout: webhookTimeout},
+		retry:    notifyTimeout,
+		pending:  make(map[string][]Change),
+	}
+}
+
+// Record queues a change; it is registered as a Store listener.
+func (n *Notifier) Record(c Change) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, zone := range n.changeZones(c) {
+		n.pending[zone] = append(n.pending[zone], c)
+	}
+	if n.timer == nil {
+		n.timer = time.AfterFunc(n.debounce, n.flush)
+	} else {
+		n.timer.Reset(n.debounce)
+	}
+}
+
+func (n *Notifier) changeZones(c Change) []string {
+	var zones []string
+	for _, r := range []*Record{c.Old, c.New} {
+		if r == nil {
+			continue
+		}
+		if z := n.zones.ZoneOf(r.Domain); !slices.Contains(zones, z) {
+			zones = append(zones, z)
+		}
+	}
+	return zones
+}
+
+// Events drains the pending changes into one event per zone.
+func (n *Notifier) Events() []ZoneEvent {
+	n.mu.Lock()
+	pending := n.pending
+	n.pending = make(map[string][]Change)
+	n.timer = nil
+	n.mu.Unlock()
+
+	events := make([]ZoneEvent, 0, len(pending))
+	for zone, changes := range pending {
+		ev := ZoneEvent{Zone: zone, Changes: changes}
+		for _, c := range changes {
+			ev.Serial = max(ev.Serial, c.Serial)
+			switch c.Op {
+			case "add":
+				ev.Added++
+			case "update":
+				ev.Updated++
+			case "delete":
+				ev.Deleted++
+			}
+		}
+		events = append(events, ev)
+	}
+	slices.SortFunc(events, func(a, b ZoneEvent) int { return cmp.Compare(a.Serial, b.Serial) })
+	return events
+}
+
+func (n *Notifier) flush() {
+	for _, ev := range n.Events() {
+		slog.Info("zone changed", "zone", ev.Zone, "serial", ev.Serial,
+			"added", ev.Added, "updated", ev.Updated, "deleted", ev.Deleted)
+		for _, url := range n.webhooks {
+			if err := n.postWebhook(url, ev); err != nil {
+				slog.Warn("webhook failed", "url", url, "zone", ev.Zone, "error", err)
+			}
+		}
+		// Secondaries only hold the zones we configured
+		if len(n.zones) > 0 && !slices.Contains(n.zones, ev.Zone) {
+			continue
+		}
+		var wg sync.WaitGroup
+		for _, target := range n.targets {
+			wg.Go(func() {
+				if err := sendNotify(target, ev.Zone, ev.Serial, n.retry); err != nil {
+					slog.Warn("notify failed", "target", target, "zone", ev.Zone, "error", err)
+					return
+				}
+				slog.Debug("notify acknowledged", "target", target, "zone", ev.Zone, "serial", ev.Serial)
+			})
+		}
+		wg.Wait()
+	}
+}
+
+func (n *Notifier) postWebhook(url string, ev ZoneEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// buildNotify builds a NOTIFY (opcode 4) message for the zone's SOA, with
+// the new serial as a hint in the answer section (RFC 1996 §3.7).
+func buildNotify(zone string, serial uint32) []byte {
+	msg := make([]byte, 12, 12+2*len(zone)+32)
+	rand.Read(msg[0:2])
+	msg[2] = opcodeNotify<<3 | 0x04 // OPCODE=NOTIFY AA=1
+	msg[5] = 1                      // QDCOUNT
+	msg[7] = 1                      // ANCOUNT
+	msg = append(msg, encodeDNSName(zone)...)
+	msg = append(msg, 0, 6, 0, 1) // SOA IN
+	// Secondaries only read the serial, so the rest of the SOA is left empty
+	rdata := append(encodeDNSName(""), encodeDNSName("")...)
+	rdata = binary.BigEndian.AppendUint32(rdata, serial)
+	rdata = append(rdata, make([]byte, 16)...)
+	return appendRR(msg, zone, 6, 0, rdata)
+}
+
+// sendNotify sends a NOTIFY to target and retransmits it, doubling the
+// timeout from retry each time, until it is acknowledged or notifyAttempts
+// sends have gone unanswered (RFC 1996 §3.6).
+func sendNotify(target, zone string, serial uint32, retry time.Duration) error {
+	conn, err := net.DialTimeout("udp", target, notifyTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	msg := buildNotify(zone, serial)
+	buf := make([]byte, 512)
+	timeout := retry
+	for range notifyAttempts {
+		deadline := time.Now().Add(timeout)
+		timeout *= 2
+		conn.SetDeadline(deadline)
+		if _, err = conn.Write(msg); err != nil {
+			time.Sleep(time.Until(deadline))
+			continue
+		}
+		for {
+			var n int
+			n, err = conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if n < 12 || buf[0] != msg[0] || buf[1] != msg[1] || buf[2]&0x80 == 0 {
+				continue // not our acknowledgement
+			}
+			if rcode := buf[3] & 0x0F; rcode != 0 {
+				return fmt.Errorf("rcode %s", rcodeString(int(rcode)))
+			}
+			return nil
+		}
+		// A refused port fails fast; still wait out the interval
+		time.Sleep(time.Until(deadline))
+	}
+	return fmt.Errorf("no acknowledgement after %d attempts: %w", notifyAttempts, err)
+}
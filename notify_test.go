@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNotifierDebouncesPerZone(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewNotifier(NewZones([]string{"my.local"}), nil, nil, time.Hour)
+	store.Subscribe(n.Record)
+
+	a, _ := store.Add(Record{Domain: "a.my.local", Type: "A", Value: "10.0.0.1"})
+	store.Add(Record{Domain: "b.my.local", Type: "A", Value: "10.0.0.2"})
+	store.Update(a.ID, Record{Domain: "a.my.local", Type: "A", Value: "10.0.0.3"})
+	store.Add(Record{Domain: "x.other.local", Type: "A", Value: "10.0.0.4"})
+
+	events := n.Events()
+	if len(events) != 2 {
+		t.Fatalf("expected 2 zone events, got %d: %+v", len(events), events)
+	}
+	ev := events[0]
+	if ev.Zone != "my.local" || ev.Added != 2 || ev.Updated != 1 {
+		t.Errorf("my.local event = %+v", ev)
+	}
+	if events[1].Zone != "other.local" || events[1].Serial <= ev.Serial {
+		t.Errorf("other.local event = %+v", events[1])
+	}
+
+	if len(n.Events()) != 0 {
+		t.Error("expected pending changes drained")
+	}
+}
+
+func TestNotifierFlushWebhookAndNotify(t *testing.T) {
+	got := make(chan ZoneEvent, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev ZoneEvent
+		json.NewDecoder(r.Body).Decode(&ev)
+		got <- ev
+	}))
+	defer hook.Close()
+
+	secondary, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secondary.Close()
+	notified := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := secondary.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		zone, _ := parseDNSName(buf[:n], 12)
+		notified <- zone
+		ack := append([]byte(nil), buf[:n]...)
+		ack[2] |= 0x80
+		secondary.WriteToUDP(ack, addr)
+	}()
+
+	n := NewNotifier(nil, []string{hook.URL}, []string{secondary.LocalAddr().String()}, 10*time.Millisecond)
+	n.Record(Change{Op: "add", New: &Record{Domain: "app.my.local", Type: "A", Value: "10.0.0.1"}, Serial: 7})
+
+	select {
+	case ev := <-got:
+		if ev.Zone != "my.local" || ev.Serial != 7 || ev.Added != 1 {
+			t.Errorf("webhook event = %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook not called")
+	}
+	select {
+	case zone := <-notified:
+		if zone != "my.local" {
+			t.Errorf("NOTIFY zone = %q, want my.local", zone)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("NOTIFY not sent")
+	}
+}
+
+func TestBuildNotify(t *testing.T) {
+	msg := buildNotify("my.local", 42)
+	if opcode := (msg[2] >> 3) & 0x0F; opcode != 4 {
+		t.Errorf("opcode = %d, want 4", opcode)
+	}
+	name, off := parseDNSName(msg, 12)
+	if name != "my.local" {
+		t.Errorf("zone = %q", name)
+	}
+	if qtype := int(msg[off])<<8 | int(msg[off+1]); qtype != 6 {
+		t.Errorf("qtype = %d, want SOA", qtype)
+	}
+	m, err := parseMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answers) != 1 || m.Answers[0].Data != ". . 42 0 0 0 0" {
+		t.Errorf("answers = %v, want the SOA serial", m.Answers)
+	}
+}
+
+func TestSendNotifyRetransmits(t *testing.T) {
+	secondary, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secondary.Close()
+	go func() {
+		buf := make([]byte, 512)
+		// Lose the first NOTIFY, acknowledge the retransmission
+		for i := 0; ; i++ {
+			n, addr, err := secondary.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if i > 0 {
+				ack := append([]byte(nil), buf[:n]...)
+				ack[2] |= 0x80
+				secondary.WriteToUDP(ack, addr)
+			}
+		}
+	}()
+	if err := sendNotify(secondary.LocalAddr().String(), "my.local", 1, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing listening: every attempt fails
+	dead := secondary.LocalAddr().String()
+	secondary.Close()
+	if err := sendNotify(dead, "my.local", 1, time.Millisecond); err == nil {
+		t.Error("notify to a closed port succeeded")
+	}
+}
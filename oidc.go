@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenID Connect sign-in: the API accepts JWTs issued by an identity
+// provider such as Keycloak or Authelia as bearer tokens, besides the API
+// tokens, and the web UI can sign in through the provider with the
+// authorization code flow. Group membership maps to the token scopes.
+
+const (
+	defaultOIDCScopes      = "openid profile email groups"
+	defaultOIDCGroupsClaim = "groups"
+	oidcTimeout            = 10 * time.Second
+	oidcLeeway             = time.Minute      // clock skew allowed on exp and nbf
+	oidcKeysMinAge         = time.Minute      // unknown key IDs refetch the keys at most this often
+	oidcLoginCookie        = "regieleki_oidc" // state and PKCE verifier between login and callback
+)
+
+// OIDC validates ID and access tokens from one issuer. Roles maps group
+// names to tokenScopeRead or tokenScopeWrite; with no roles, every signed-in
+// user may make changes.
+type OIDC struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string // callback URL registered with the provider; derived from the request if empty
+	Scopes       string
+	GroupsClaim  string
+	Roles        map[string]string
+
+	client *http.Client
+	now    func() time.Time
+
+	mu      sync.Mutex
+	config  oidcConfig
+	keys    map[string]crypto.PublicKey
+	fetched time.Time // when keys were last fetched
+}
+
+// oidcConfig is the part of the provider's discovery document we use.
+type oidcConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func NewOIDC(issuer, clientID string) *OIDC {
+	return &OIDC{
+		Issuer:      strings.TrimRight(issuer, "/"),
+		ClientID:    clientID,
+		Scopes:      defaultOIDCScopes,
+		GroupsClaim: defaultOIDCGroupsClaim,
+		client:      &http.Client{Timeout: oidcTimeout},
+		now:         time.Now,
+	}
+}
+
+// ParseOIDCRole parses a -oidc-role value, group=read or group=write.
+func ParseOIDCRole(v string) (group, scope string, err error) {
+	group, scope, ok := strings.Cut(v, "=")
+	if !ok || group == "" || (scope != tokenScopeRead && scope != tokenScopeWrite) {
+		return "", "", fmt.Errorf("invalid role %q, want group=read or group=write", v)
+	}
+	return group, scope, nil
+}
+
+// discover fetches the provider's discovery document once it is first
+// needed, so a provider that is down at startup doesn't keep us down.
+// Caller must hold o.mu.
+func (o *OIDC) discover(ctx context.Context) error {
+	if o.config.JWKSURI != "" {
+		return nil
+	}
+	var config oidcConfig
+	if err := o.getJSON(ctx, o.Issuer+"/.well-known/openid-configuration", &config); err != nil {
+		return fmt.Errorf("oidc discovery: %w", err)
+	}
+	if strings.TrimRight(config.Issuer, "/") != o.Issuer {
+		return fmt.Errorf("oidc discovery: issuer is %q, want %q", config.Issuer, o.Issuer)
+	}
+	o.config = config
+	return nil
+}
+
+func (o *OIDC) getJSON(ctx context.Context, url string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// key returns the signing key with the given ID, fetching the provider's
+// keys when it is unknown, as it will be after the provider rotates them.
+func (o *OIDC) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+	if o.now().Sub(o.fetched) < oidcKeysMinAge {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if err := o.discover(ctx); err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := o.getJSON(ctx, o.config.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc keys: %w", err)
+	}
+	o.fetched = o.now()
+	o.keys = make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.publicKey(); err == nil {
+			o.keys[k.Kid] = pub
+		}
+	}
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// jsonWebKey is an RSA or P-256 public key in JWK form (RFC 7517).
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	dec := base64.RawURLEncoding.DecodeString
+	switch {
+	case k.Kty == "RSA":
+		n, err1 := dec(k.N)
+		e, err2 := dec(k.E)
+		if err := errors.Join(err1, err2); err != nil {
+			return nil, err
+		}
+		if len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("bad RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err1 := dec(k.X)
+		y, err2 := dec(k.Y)
+		if err := errors.Join(err1, err2); err != nil {
+			return nil, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("bad P-256 point")
+		}
+		return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+	}
+	return nil, fmt.Errorf("unsupported key type %s %s", k.Kty, k.Crv)
+}
+
+// oidcClaims are the claims we check. Audience may be a string or a list,
+// and so may the groups claim, which is looked up by name in Extra.
+type oidcClaims struct {
+	Issuer    string                     `json:"iss"`
+	Subject   string                     `json:"sub"`
+	Audience  json.RawMessage            `json:"aud"`
+	AZP       string                     `json:"azp"`
+	Expires   int64                      `json:"exp"`
+	NotBefore int64                      `json:"nbf"`
+	Extra     map[string]json.RawMessage `json:"-"`
+}
+
+// stringOrList decodes a JSON string or array of strings.
+func stringOrList(raw json.RawMessage) []string {
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return list
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return []string{s}
+	}
+	return nil
+}
+
+// Verify checks a JWT's signature, issuer, audience and lifetime and
+// returns its claims.
+func (o *OIDC) Verify(ctx context.Context, jwt string) (*oidcClaims, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil {
+		return nil, errors.New("malformed JWT header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed JWT signature")
+	}
+	key, err := o.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("bad JWT signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("bad JWT signature")
+		}
+	default:
+		return nil, errors.New("unsupported signing key")
+	}
+
+	var claims oidcClaims
+	if data, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, errors.New("malformed JWT claims")
+	}
+	if json.Unmarshal(data, &claims) != nil || json.Unmarshal(data, &claims.Extra) != nil {
+		return nil, errors.New("malformed JWT claims")
+	}
+	now := o.now()
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != o.Issuer:
+		return nil, fmt.Errorf("JWT issued by %q", claims.Issuer)
+	case !slices.Contains(stringOrList(claims.Audience), o.ClientID) && claims.AZP != o.ClientID:
+		return nil, errors.New("JWT is for another audience")
+	case claims.Expires == 0 || now.After(time.Unix(claims.Expires, 0).Add(oidcLeeway)):
+		return nil, errors.New("JWT expired")
+	case claims.NotBefore != 0 && now.Add(oidcLeeway).Before(time.Unix(claims.NotBefore, 0)):
+		return nil, errors.New("JWT not valid yet")
+	}
+	return &claims, nil
+}
+
+// Scope maps the groups in the claims to a token scope, the broadest any of
+// them grants, or "" if none does.
+func (o *OIDC) Scope(claims *oidcClaims) string {
+	if len(o.Roles) == 0 {
+		return tokenScopeWrite
+	}
+	scope := ""
+	for _, g := range stringOrList(claims.Extra[o.GroupsClaim]) {
+		switch o.Roles[strings.TrimPrefix(g, "/")] { // Keycloak writes group paths
+		case tokenScopeWrite:
+			return tokenScopeWrite
+		case tokenScopeRead:
+			scope = tokenScopeRead
+		}
+	}
+	return scope
+}
+
+// Authenticate accepts JWTs from the provider as bearer credentials. Users
+// are known by their email or user name if the token carries one, and by
+// their subject otherwise.
+func (o *OIDC) Authenticate(bearer string) (string, string, bool) {
+	if strings.Count(bearer, ".") != 2 {
+		return "", "", false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), oidcTimeout)
+	defer cancel()
+	claims, err := o.Verify(ctx, bearer)
+	if err != nil {
+		slog.Debug("oidc token rejected", "error", err)
+		return "", "", false
+	}
+	who := claims.Subject
+	for _, claim := range []string{"email", "preferred_username"} {
+		if names := stringOrList(claims.Extra[claim]); len(names) > 0 && names[0] != "" {
+			who = names[0]
+			break
+		}
+	}
+	return who, o.Scope(claims), true
+}
+
+func (o *OIDC) redirectURL(r *http.Request) string {
+	if o.RedirectURL != "" {
+		return o.RedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/auth/callback"
+}
+
+// handleLogin sends the browser to the provider, remembering a random state
+// and PKCE verifier (RFC 7636) in a short-lived cookie for the callback.
+func (o *OIDC) handleLogin(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	err := o.discover(r.Context())
+	authURL := o.config.AuthorizationEndpoint
+	o.mu.Unlock()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "oidc login failed", "error", err)
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	b := make([]byte, 48)
+	rand.Read(b)
+	state, verifier := hex.EncodeToString(b[:16]), base64.RawURLEncoding.EncodeToString(b[16:])
+	challenge := sha256.Sum256([]byte(verifier))
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcLoginCookie,
+		Value:    state + "." + verifier,
+		Path:     "/auth/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.ClientID},
+		"redirect_uri":          {o.redirectURL(r)},
+		"scope":                 {o.Scopes},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(authURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, authURL+sep+q.Encode(), http.StatusFound)
+}
+
+// oidcCallbackPage hands the ID token to the web UI, which keeps it where it
+// keeps a pasted API token.
+var oidcCallbackPage = template.Must(template.New("callback").Parse(`<!DOCTYPE html>
+<meta charset="utf-8"><title>Signing in</title>
+<script>localStorage.setItem('regieleki_token', {{.}}); location.replace('/');</script>
+`))
+
+// handleCallback exchanges the authorization code for tokens and checks the
+// ID token before handing it to the UI.
+func (o *OIDC) handleCallback(w http.ResponseWriter, r *http.Request) {
+	fail := func(msg string, code int, err error) {
+		slog.WarnContext(r.Context(), "oidc sign-in failed", "reason", msg, "error", err)
+		http.Error(w, msg, code)
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		fail("sign-in refused by the identity provider: "+e, http.StatusForbidden, nil)
+		return
+	}
+	var state, verifier string
+	cookie, err := r.Cookie(oidcLoginCookie)
+	if err == nil {
+		state, verifier, _ = strings.Cut(cookie.Value, ".")
+	}
+	if state == "" || r.URL.Query().Get("state") != state {
+		fail("sign-in expired, try again", http.StatusBadRequest, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcLoginCookie, Path: "/auth/", MaxAge: -1})
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {r.URL.Query().Get("code")},
+		"redirect_uri":  {o.redirectURL(r)},
+		"client_id":     {o.ClientID},
+		"code_verifier": {verifier},
+	}
+	if o.ClientSecret != "" {
+		form.Set("client_secret", o.ClientSecret)
+	}
+	o.mu.Lock()
+	tokenURL := o.config.TokenEndpoint
+	o.mu.Unlock()
+	req, err := http.NewRequestWithContext(r.Context(), "POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		fail("identity provider unavailable", http.StatusBadGateway, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		fail("identity provider unavailable", http.StatusBadGateway, err)
+		return
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&tokens)
+	if resp.StatusCode != 200 || tokens.IDToken == "" {
+		fail("code exchange failed", http.StatusBadGateway, fmt.Errorf("%s %s", resp.Status, tokens.Error))
+		return
+	}
+	claims, err := o.Verify(r.Context(), tokens.IDToken)
+	if err != nil {
+		fail("invalid ID token", http.StatusBadGateway, err)
+		return
+	}
+	if o.Scope(claims) == "" {
+		fail("none of your groups has access", http.StatusForbidden, nil)
+		return
+	}
+	slog.InfoContext(r.Context(), "oidc sign-in", "subject", claims.Subject)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	oidcCallbackPage.Execute(w, tokens.IDToken)
+}
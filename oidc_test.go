@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeIdP is an OpenID provider with one RSA and one P-256 signing key,
+// whose token endpoint hands out idToken for any code with the right PKCE
+// verifier.
+type fakeIdP struct {
+	srv       *httptest.Server
+	rsaKey    *rsa.PrivateKey
+	ecKey     *ecdsa.PrivateKey
+	idToken   string
+	challenge string // from the last authorization request
+	jwksHits  int
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	f := &fakeIdP{}
+	f.rsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	f.ecKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	b64 := base64.RawURLEncoding.EncodeToString
+	f.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 f.srv.URL,
+				"authorization_endpoint": f.srv.URL + "/authorize",
+				"token_endpoint":         f.srv.URL + "/token",
+				"jwks_uri":               f.srv.URL + "/jwks",
+			})
+		case "/jwks":
+			f.jwksHits++
+			point, _ := f.ecKey.PublicKey.Bytes()
+			json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+				{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(f.rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(f.rsaKey.E)).Bytes())},
+				{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(point[1:33]), "y": b64(point[33:])},
+			}})
+		case "/token":
+			r.ParseForm()
+			sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+			if r.Form.Get("code") != "the-code" || b64(sum[:]) != f.challenge {
+				w.WriteHeader(400)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"id_token": f.idToken, "token_type": "Bearer"})
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+// sign makes a JWT with the given claims, signed with the named key.
+func (f *fakeIdP) sign(t *testing.T, kid string, claims map[string]any) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding.EncodeToString
+	alg := map[string]string{"rsa": "RS256", "ec": "ES256"}[kid]
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(input))
+	var sig []byte
+	if kid == "ec" {
+		r, s, err := ecdsa.Sign(rand.Reader, f.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	} else {
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, f.rsaKey, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return input + "." + b64(sig)
+}
+
+func (f *fakeIdP) claims(groups ...string) map[string]any {
+	return map[string]any{
+		"iss":    f.srv.URL,
+		"sub":    "alice",
+		"aud":    "regieleki",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"groups": groups,
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	idp := newFakeIdP(t)
+	o := NewOIDC(idp.srv.URL, "regieleki")
+	o.Roles = map[string]string{"dns-admins": tokenScopeWrite, "staff": tokenScopeRead}
+
+	for _, kid := range []string{"rsa", "ec"} {
+		if _, scope, ok := o.Authenticate(idp.sign(t, kid, idp.claims("staff"))); !ok || scope != tokenScopeRead {
+			t.Errorf("%s token: %q, %v", kid, scope, ok)
+		}
+	}
+	if who, scope, _ := o.Authenticate(idp.sign(t, "rsa", idp.claims("staff", "/dns-admins"))); scope != tokenScopeWrite || who != "alice" {
+		t.Errorf("admin: %q with scope %q", who, scope)
+	}
+	if _, scope, ok := o.Authenticate(idp.sign(t, "rsa", idp.claims("others"))); !ok || scope != "" {
+		t.Errorf("unmapped group: %q, %v", scope, ok)
+	}
+
+	bad := map[string]func(map[string]any){
+		"expired":        func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"other audience": func(c map[string]any) { c["aud"] = []string{"grafana"} },
+		"other issuer":   func(c map[string]any) { c["iss"] = "https://evil.example" },
+		"not yet valid":  func(c map[string]any) { c["nbf"] = time.Now().Add(time.Hour).Unix() },
+	}
+	for name, mutate := range bad {
+		c := idp.claims("dns-admins")
+		mutate(c)
+		if _, _, ok := o.Authenticate(idp.sign(t, "rsa", c)); ok {
+			t.Errorf("%s token accepted", name)
+		}
+	}
+	jwt := idp.sign(t, "rsa", idp.claims("dns-admins"))
+	if _, _, ok := o.Authenticate(jwt[:len(jwt)-4] + "AAAA"); ok {
+		t.Error("tampered token accepted")
+	}
+	if _, _, ok := o.Authenticate("0123abcd"); ok {
+		t.Error("API token taken for a JWT")
+	}
+
+	// Tokens signed with unknown keys don't make us hammer the provider
+	hits := idp.jwksHits
+	forged := strings.Replace(jwt, jwt[:strings.Index(jwt, ".")], base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"nope"}`)), 1)
+	for range 3 {
+		o.Authenticate(forged)
+	}
+	if idp.jwksHits != hits {
+		t.Errorf("unknown key refetched the keys %d times", idp.jwksHits-hits)
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newFakeIdP(t)
+	ws, _ := testWebServer(t)
+	ws.tokens = newStaticTokenSet("api-token")
+	ws.oidc = NewOIDC(idp.srv.URL, "regieleki")
+	ws.oidc.Roles = map[string]string{"staff": tokenScopeRead}
+	idp.idToken = idp.sign(t, "rsa", idp.claims("staff"))
+
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/auth/login", nil))
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != 302 || err != nil || loc.Path != "/authorize" {
+		t.Fatalf("login: %d %q", w.Code, w.Header().Get("Location"))
+	}
+	q := loc.Query()
+	if q.Get("client_id") != "regieleki" || q.Get("redirect_uri") != "http://example.com/auth/callback" || q.Get("code_challenge_method") != "S256" {
+		t.Errorf("authorize query: %v", q)
+	}
+	idp.challenge = q.Get("code_challenge")
+	cookies := w.Result().Cookies()
+
+	callback := func(state string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/auth/callback?code=the-code&state="+state, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, req)
+		return w
+	}
+	if w := callback("forged"); w.Code != 400 {
+		t.Errorf("callback with a forged state: %d", w.Code)
+	}
+	w = callback(q.Get("state"))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), idp.idToken) {
+		t.Fatalf("callback: %d %s", w.Code, w.Body)
+	}
+
+	// The ID token now works as a bearer token, within its group's scope,
+	// and API tokens keep working next to it
+	do := func(method, bearer string) int {
+		req := httptest.NewRequest(method, "/api/records", strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := do("GET", idp.idToken); code != 200 {
+		t.Errorf("GET with the ID token: %d", code)
+	}
+	if code := do("POST", idp.idToken); code != 403 {
+		t.Errorf("POST with a read-only group: %d, want 403", code)
+	}
+	if code := do("GET", idp.sign(t, "rsa", idp.claims("others"))); code != 403 {
+		t.Errorf("GET with no mapped group: %d, want 403", code)
+	}
+	if code := do("GET", "api-token"); code != 200 {
+		t.Errorf("GET with the API token: %d", code)
+	}
+}
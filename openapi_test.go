@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestOpenAPI checks that the served spec is valid JSON and describes every
+// records route the server has.
+func TestOpenAPI(t *testing.T) {
+	ws, _ := testWebServer(t)
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	var spec struct {
+		OpenAPI string                    `json:"openapi"`
+		Paths   map[string]map[string]any `json:"paths"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&spec); err != nil || w.Code != 200 {
+		t.Fatalf("status %d: %v", w.Code, err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("openapi = %q", spec.OpenAPI)
+	}
+
+	src, err := os.ReadFile("web.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := regexp.MustCompile(`HandleFunc\("([A-Z]+) (/api/records[^"]*)"`).FindAllStringSubmatch(string(src), -1)
+	if len(routes) == 0 {
+		t.Fatal("no records routes found in web.go")
+	}
+	for _, route := range routes {
+		if _, ok := spec.Paths[route[2]][strings.ToLower(route[1])]; !ok {
+			t.Errorf("%s %s is missing from openapi.json", route[1], route[2])
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// peerBackoff is how long a peer that failed to answer is skipped, so a
+// dead peer delays one query rather than every one.
+const peerBackoff = 30 * time.Second
+
+// Peers are other regieleki instances, each managing records of its own,
+// that are asked for names in our zones we have no records for, before the
+// upstreams are. Two independently run boxes listing each other so cover
+// for each other's names without replicating anything.
+//
+// Peers are asked without recursion desired, and only an authoritative
+// NOERROR answer is taken, which a peer gives from its own records alone.
+// A peer never asks its peers on behalf of such a query, so peers listing
+// each other can't loop.
+type Peers struct {
+	addrs []string
+	zones Zones
+
+	mu   sync.Mutex
+	down map[string]time.Time // skipped until then
+}
+
+func NewPeers(addrs []string, zones Zones) *Peers {
+	p := &Peers{zones: zones, down: make(map[string]time.Time)}
+	for _, a := range addrs {
+		p.addrs = append(p.addrs, hostPortDefault(a, "53"))
+	}
+	return p
+}
+
+// Covers reports whether peers are asked for name.
+func (p *Peers) Covers(name string) bool {
+	for _, zone := range p.zones {
+		if inZone(name, zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// available returns the peers not backing off after a failure.
+func (p *Peers) available(now time.Time) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []string
+	for _, a := range p.addrs {
+		if now.After(p.down[a]) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func (p *Peers) report(addr string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.down[addr] = time.Now().Add(peerBackoff)
+	} else {
+		delete(p.down, addr)
+	}
+}
+
+// askPeers asks each available peer in turn for query's name and returns
+// the first authoritative answer, or nil if no peer has the name.
+func (s *DNSServer) askPeers(ctx context.Context, query []byte) []byte {
+	tr := traceFrom(ctx)
+	q := append([]byte(nil), query...)
+	q[2] &^= 0x01 // RD=0: answer from your own records only
+	for _, peer := range s.peers.available(time.Now()) {
+		start := time.Now()
+		resp, err := s.forwardTo(q, peer)
+		s.peers.report(peer, err)
+		if err != nil {
+			tr.step("peer", "error", "%s: %v", peer, err)
+			continue
+		}
+		if resp[2]&0x04 == 0 || resp[3]&0x0F != 0 {
+			tr.step("peer", "miss", "%s answered %s, not from records of its own", peer, rcodeString(int(resp[3]&0x0F)))
+			continue
+		}
+		tr.step("peer", "ok", "%s answered in %s", peer, time.Since(start).Round(time.Microsecond))
+		resp[2] = resp[2]&^0x01 | query[2]&0x01
+		return resp
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDNSPeers(t *testing.T) {
+	zones := NewZones([]string{"home.lan"})
+
+	// b is the peer: it has b.home.lan, and a peer of its own that must
+	// never be asked on a's behalf
+	storeB, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeB.Add(Record{Domain: "b.home.lan", Type: "A", Value: "10.0.0.2"})
+	upstreamB := startFakeUpstream(t, "")
+	peerOfB := startFakeUpstream(t, "")
+	b := NewDNSServer(storeB, []string{upstreamB.Addr()})
+	b.zones = zones
+	b.peers = NewPeers([]string{peerOfB.Addr()}, zones)
+	addrB := startDNSServer(t, b)
+
+	// A closed port stands in for a peer that is down
+	dead, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.LocalAddr().String()
+	dead.Close()
+
+	storeA, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeA.Add(Record{Domain: "a.home.lan", Type: "A", Value: "10.0.0.1"})
+	upstreamA := startFakeUpstream(t, "example.com A answer 93.184.216.34")
+	a := NewDNSServer(storeA, []string{upstreamA.Addr()})
+	a.zones = zones
+	a.peers = NewPeers([]string{deadAddr, addrB}, zones)
+	addrA := startDNSServer(t, a)
+
+	tests := []struct {
+		domain  string
+		rcode   int
+		answers []string
+	}{
+		{"a.home.lan", 0, []string{"10.0.0.1"}},
+		{"B.home.lan", 0, []string{"10.0.0.2"}},  // from the peer
+		{"missing.home.lan", rcodeNXDomain, nil}, // from the upstream, after the peer had nothing
+		{"example.com", 0, []string{"93.184.216.34"}},
+	}
+	for _, tt := range tests {
+		m, err := parseMessage(exchange(t, addrA, buildTestQuery(tt.domain, 1, 1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, rr := range m.Answers {
+			got = append(got, rr.Data)
+		}
+		if m.RCode != tt.rcode || !slices.Equal(got, tt.answers) || !m.RD {
+			t.Errorf("%s: rcode %s, answers %q, RD %v", tt.domain, rcodeString(m.RCode), got, m.RD)
+		}
+		if len(m.Questions) != 1 || m.Questions[0].Name != tt.domain {
+			t.Errorf("%s: question %+v", tt.domain, m.Questions)
+		}
+	}
+	if n := upstreamA.Queries(); n != 2 {
+		t.Errorf("a's upstream got %d queries, want 2 (missing.home.lan and example.com)", n)
+	}
+	if n := peerOfB.Queries(); n != 0 {
+		t.Errorf("b passed %d queries from its peer on to its own peer", n)
+	}
+	if got := a.peers.available(time.Now()); !slices.Equal(got, []string{addrB}) {
+		t.Errorf("available peers = %q, want the dead one backing off", got)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+)
+
+// Prefix lengths client addresses are cut to when anonymized: a household
+// or small office, rather than one device in it.
+const (
+	anonymizeIPv4Bits = 24
+	anonymizeIPv6Bits = 56
+)
+
+// anonymizeAddr zeroes the host part of a client address, keeping the
+// first 24 bits of IPv4 and 56 of IPv6, so the query log, statistics and
+// log lines still tell networks apart without naming a device.
+func anonymizeAddr(a netip.Addr) netip.Addr {
+	a = a.Unmap()
+	bits := anonymizeIPv6Bits
+	if a.Is4() {
+		bits = anonymizeIPv4Bits
+	}
+	p, err := a.Prefix(bits)
+	if err != nil {
+		return a
+	}
+	return p.Addr()
+}
+
+// logRemote is a query's source as written to log lines: the address and
+// port, or only the truncated address when clients are anonymized.
+func (s *DNSServer) logRemote(addr *net.UDPAddr) any {
+	if s.anonymize {
+		return anonymizeAddr(addr.AddrPort().Addr())
+	}
+	return addr
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAnonymizeAddr(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"192.168.1.20", "192.168.1.0"},
+		{"::ffff:10.0.0.7", "10.0.0.0"},
+		{"2001:db8:aa:bbcc:1:2:3:4", "2001:db8:aa:bb00::"},
+	}
+	for _, tt := range tests {
+		if got := anonymizeAddr(netip.MustParseAddr(tt.in)); got.String() != tt.want {
+			t.Errorf("anonymizeAddr(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDNSAnonymize(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Record{Domain: "app.test", Type: "A", Value: "10.0.0.1"})
+	s := NewDNSServer(store, nil)
+	s.querylog = NewQueryLog(10)
+	s.anonymize = true
+	addr := startDNSServer(t, s)
+	exchange(t, addr, buildTestQuery("app.test", 1, 1))
+
+	if got := s.querylog.Recent(queryLogFilter{}, 10); len(got) != 1 || got[0].Client != netip.MustParseAddr("127.0.0.0") {
+		t.Errorf("query log = %+v", got)
+	}
+	if top := s.stats.Report(time.Hour, 10).TopClients; len(top) != 1 || top[0].Name != "127.0.0.0" {
+		t.Errorf("top clients = %+v", top)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// A problem is what is wrong with a request: a stable code for programs to
+// branch on and a detail for people.
+type problem struct {
+	Code   string
+	Detail string
+}
+
+func newProblem(code, format string, args ...any) *problem {
+	return &problem{Code: code, Detail: fmt.Sprintf(format, args...)}
+}
+
+func (p *problem) Error() string { return p.Detail }
+
+// Problems that many handlers report.
+var (
+	errInvalidJSON = &problem{"invalid_json", "invalid JSON"}
+	errSaveFailed  = &problem{"save_failed", "failed to save"}
+	errInvalidID   = &problem{"invalid_id", "invalid id"}
+	errNoRecord    = &problem{"record_not_found", "record not found"}
+	errRecordDup   = &problem{"duplicate_record", "record already exists"}
+)
+
+// statusCodes are the codes of problems reported with jsonError, which
+// only knows the HTTP status.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:          "bad_request",
+	http.StatusUnauthorized:        "unauthorized",
+	http.StatusForbidden:           "forbidden",
+	http.StatusNotFound:            "not_found",
+	http.StatusConflict:            "conflict",
+	http.StatusTooManyRequests:     "rate_limited",
+	http.StatusInternalServerError: "internal_error",
+	http.StatusBadGateway:          "upstream_error",
+	http.StatusServiceUnavailable:  "unavailable",
+}
+
+// jsonError reports msg with a generic code for the status.
+func jsonError(w http.ResponseWriter, msg string, status int) {
+	jsonProblemWith(w, status, &problem{statusCodes[status], msg}, nil)
+}
+
+func jsonProblem(w http.ResponseWriter, status int, p *problem) {
+	jsonProblemWith(w, status, p, nil)
+}
+
+// jsonProblemWith writes p as an RFC 9457 problem+json body, with extra
+// members such as the record a conflict was with. The detail is repeated
+// as error, which is all that bodies had before codes.
+func jsonProblemWith(w http.ResponseWriter, status int, p *problem, extra map[string]any) {
+	body := map[string]any{
+		"title":  http.StatusText(status),
+		"status": status,
+		"code":   p.Code,
+		"detail": p.Detail,
+		"error":  p.Detail,
+	}
+	for k, v := range extra {
+		body[k] = v
+	}
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		body["request_id"] = id
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProblemJSON(t *testing.T) {
+	ws, store := testWebServer(t)
+	ws.tokens = newStaticTokenSet("api-token")
+	ws.tokens.tokens[0].Scope = tokenScopeRead
+
+	do := func(method, path, body string) (int, map[string]any) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer api-token")
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, req)
+		if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("%s %s: content type %q", method, path, ct)
+		}
+		var p map[string]any
+		json.NewDecoder(w.Body).Decode(&p)
+		if p["status"] != float64(w.Code) || p["detail"] != p["error"] || p["request_id"] != w.Header().Get(requestIDHeader) {
+			t.Errorf("%s %s: %v", method, path, p)
+		}
+		return w.Code, p
+	}
+
+	if code, p := do("POST", "/api/records", `{}`); code != 403 || p["code"] != "read_only_token" {
+		t.Errorf("write with a read token: %d %v", code, p)
+	}
+	ws.tokens.tokens[0].Scope = tokenScopeWrite
+	for body, want := range map[string]string{
+		`{"domain":"app.test","type":"A","value":"fd00::1"}`: "invalid_ipv4",
+		`{"domain":"app.test","type":"MX","value":"mail"}`:   "invalid_type",
+		`{"type":"A","value":"10.0.0.1"}`:                    "domain_required",
+		`not json`:                                           "invalid_json",
+	} {
+		if code, p := do("POST", "/api/records", body); code != 400 || p["code"] != want {
+			t.Errorf("%s: %d %v, want %s", body, code, p, want)
+		}
+	}
+	store.Add(Record{Domain: "app.test", Type: "A", Value: "10.0.0.1"})
+	if code, p := do("POST", "/api/records", `{"domain":"app.test","type":"A","value":"10.0.0.1"}`); code != 409 || p["code"] != "duplicate_record" || p["record"] == nil {
+		t.Errorf("duplicate: %d %v", code, p)
+	}
+	if code, p := do("DELETE", "/api/records/99", ""); code != 404 || p["code"] != "record_not_found" {
+		t.Errorf("missing record: %d %v", code, p)
+	}
+	if code, p := do("GET", "/api/backups", ""); code != 503 || p["code"] != "unavailable" {
+		t.Errorf("generic code: %d %v", code, p)
+	}
+}
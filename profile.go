@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+)
+
+// Profile groups the resource knobs that depend on the host: a 256MB router
+// wants small buffers and an aggressive GC, a multi-core server wants wide
+// concurrency and a large cache.
+type Profile struct {
+	Name        string
+	UDPBufSize  int   // receive buffer per in-flight datagram
+	MaxQueries  int   // workers answering UDP queries
+	QueueSize   int   // UDP queries waiting for a worker before dropping
+	UDPSockets  int   // UDP sockets per listen address, 0 for GOMAXPROCS
+	CacheSize   int   // default max cached upstream responses
+	GCPercent   int   // GOGC
+	MemoryLimit int64 // soft heap limit in bytes, 0 for none
+}
+
+var profiles = map[string]Profile{
+	"small": {
+		Name:        "small",
+		UDPBufSize:  1232,
+		MaxQueries:  128,
+		QueueSize:   256,
+		UDPSockets:  1,
+		CacheSize:   1000,
+		GCPercent:   50,
+		MemoryLimit: 64 << 20,
+	},
+	"default": {
+		Name:       "default",
+		UDPBufSize: udpBufSize,
+		MaxQueries: maxConcurrentQueries,
+		QueueSize:  maxQueuedQueries,
+		CacheSize:  defaultCacheSize,
+		GCPercent:  100,
+	},
+	"server": {
+		Name:       "server",
+		UDPBufSize: udpBufSize,
+		MaxQueries: 250 * runtime.NumCPU(),
+		QueueSize:  250 * runtime.NumCPU(),
+		CacheSize:  100000,
+		GCPercent:  200,
+	},
+}
+
+func lookupProfile(name string) (Profile, error) {
+	p, ok := profiles[strings.ToLower(name)]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for n := range profiles {
+			names = append(names, n)
+		}
+		slices.Sort(names)
+		return Profile{}, fmt.Errorf("unknown profile %q (want one of %s)", name, strings.Join(names, ", "))
+	}
+	return p, nil
+}
+
+// applyRuntime tunes the garbage collector for the profile. Explicit GOGC and
+// GOMEMLIMIT environment variables take precedence.
+func (p Profile) applyRuntime() {
+	if os.Getenv("GOGC") == "" {
+		debug.SetGCPercent(p.GCPercent)
+	}
+	if p.MemoryLimit > 0 && os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(p.MemoryLimit)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLookupProfile(t *testing.T) {
+	for _, name := range []string{"small", "default", "SERVER"} {
+		p, err := lookupProfile(name)
+		if err != nil {
+			t.Errorf("lookupProfile(%q): %v", name, err)
+			continue
+		}
+		if p.MaxQueries <= 0 || p.QueueSize <= 0 || p.UDPBufSize < 512 || p.CacheSize <= 0 {
+			t.Errorf("profile %s has invalid limits: %+v", name, p)
+		}
+	}
+
+	if _, err := lookupProfile("huge"); err == nil {
+		t.Error("expected error for unknown profile")
+	}
+}
+
+func TestDNSServerApplyProfile(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dns := NewDNSServer(store, nil)
+	if dns.workers != maxConcurrentQueries || cap(dns.queue) != maxQueuedQueries {
+		t.Errorf("default workers = %d, queue = %d, want %d and %d", dns.workers, cap(dns.queue), maxConcurrentQueries, maxQueuedQueries)
+	}
+
+	small := profiles["small"]
+	dns.applyProfile(small)
+	if dns.workers != small.MaxQueries || cap(dns.queue) != small.QueueSize {
+		t.Errorf("workers = %d, queue = %d, want %d and %d", dns.workers, cap(dns.queue), small.MaxQueries, small.QueueSize)
+	}
+	buf := dns.pool.Get().(*[]byte)
+	if len(*buf) != small.UDPBufSize {
+		t.Errorf("buffer size = %d, want %d", len(*buf), small.UDPBufSize)
+	}
+}
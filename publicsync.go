@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPublicSyncTag      = "public"
+	defaultPublicSyncSchedule = "@every 5m"
+	defaultPublicSyncTTL      = 5 * time.Minute
+	publicSyncTimeout         = 30 * time.Second
+
+	// publicSyncOwner marks what this server put in a provider's zone, so
+	// records managed there by hand or by other tools are never touched.
+	publicSyncOwner = "heritage=regieleki"
+)
+
+// publicSyncTypes are the record types every provider takes as they are.
+var publicSyncTypes = []string{"A", "AAAA", "CNAME", "TXT"}
+
+// publicRecord is one record as a public DNS provider holds it. ID is the
+// provider's, where it has one.
+type publicRecord struct {
+	Name  string
+	Type  string
+	Value string
+	ID    string
+}
+
+func (r publicRecord) key() string { return r.Name + "\t" + r.Type + "\t" + r.Value }
+
+// diffPublic returns the records of want missing from have, and those of
+// have no longer in want.
+func diffPublic(have, want []publicRecord) (add, remove []publicRecord) {
+	inHave := make(map[string]bool, len(have))
+	for _, r := range have {
+		inHave[r.key()] = true
+	}
+	inWant := make(map[string]bool, len(want))
+	for _, r := range want {
+		inWant[r.key()] = true
+		if !inHave[r.key()] {
+			add = append(add, r)
+		}
+	}
+	for _, r := range have {
+		if !inWant[r.key()] {
+			remove = append(remove, r)
+		}
+	}
+	return add, remove
+}
+
+// publicProvider is a public DNS service records are pushed to. Sync makes
+// the records this server owns in the zone exactly want, and says how many
+// it added and removed.
+type publicProvider interface {
+	String() string
+	Zone(ctx context.Context) (string, error)
+	Sync(ctx context.Context, want []publicRecord, ttl time.Duration) (added, removed int, err error)
+}
+
+// ParsePublicProvider reads a -public-sync spec, provider:zone-id.
+// Cloudflare takes an API token allowed to edit the zone's DNS, from
+// cloudflareToken; Route53 takes AWS keys from the environment.
+func ParsePublicProvider(spec, cloudflareToken string) (publicProvider, error) {
+	kind, zoneID, ok := strings.Cut(spec, ":")
+	if !ok || zoneID == "" {
+		return nil, fmt.Errorf("public sync %q: want provider:zone-id", spec)
+	}
+	switch kind {
+	case "cloudflare":
+		if cloudflareToken == "" {
+			return nil, errors.New("public sync to cloudflare needs -cloudflare-token-file or CLOUDFLARE_API_TOKEN")
+		}
+		return NewCloudflare(zoneID, cloudflareToken), nil
+	case "route53":
+		creds, err := awsCredentialsFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return NewRoute53(zoneID, creds), nil
+	}
+	return nil, fmt.Errorf("public sync %q: unknown provider %q (want cloudflare or route53)", spec, kind)
+}
+
+// PublicSync mirrors the records carrying Tag to public DNS providers, so
+// the records here stay the source of truth while chosen names are
+// published to the internet. Only enabled records outside views, in a
+// type every provider takes, and under the provider's zone are pushed.
+type PublicSync struct {
+	Tag       string
+	TTL       time.Duration
+	store     *Store
+	providers []publicProvider
+	zones     map[publicProvider]string // looked up once per provider
+}
+
+func NewPublicSync(store *Store, providers []publicProvider, tag string, ttl time.Duration) *PublicSync {
+	return &PublicSync{
+		Tag:       cmp.Or(tag, defaultPublicSyncTag),
+		TTL:       cmp.Or(ttl, defaultPublicSyncTTL),
+		store:     store,
+		providers: providers,
+		zones:     make(map[publicProvider]string),
+	}
+}
+
+// Tagged reports whether c touches a tagged record, which makes it worth
+// syncing now rather than at the next scheduled run.
+func (p *PublicSync) Tagged(c Change) bool {
+	return c.Old != nil && c.Old.hasTag(p.Tag) || c.New != nil && c.New.hasTag(p.Tag)
+}
+
+// records lists the tagged records that belong in zone.
+func (p *PublicSync) records(zone string) []publicRecord {
+	now := time.Now()
+	var out []publicRecord
+	for _, r := range p.store.List() {
+		if !r.hasTag(p.Tag) || r.Disabled || r.View != "" || r.expired(now) || !slices.Contains(publicSyncTypes, r.Type) {
+			continue
+		}
+		if r.Domain != zone && !strings.HasSuffix(r.Domain, "."+zone) {
+			continue
+		}
+		out = append(out, publicRecord{Name: r.Domain, Type: r.Type, Value: r.Value})
+	}
+	return out
+}
+
+// Run syncs every provider. A failed provider doesn't stop the others; it
+// is retried in full on the next run.
+func (p *PublicSync) Run(ctx context.Context) error {
+	var errs []error
+	for _, prov := range p.providers {
+		zone, ok := p.zones[prov]
+		if !ok {
+			var err error
+			if zone, err = prov.Zone(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", prov, err))
+				continue
+			}
+			zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+			p.zones[prov] = zone
+		}
+		want := p.records(zone)
+		added, removed, err := prov.Sync(ctx, want, p.TTL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", prov, err))
+			continue
+		}
+		if added > 0 || removed > 0 {
+			slog.InfoContext(ctx, "public records synced", "provider", prov.String(), "zone", zone,
+				"records", len(want), "added", added, "removed", removed)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Cloudflare pushes records through the v4 API. Records it creates carry
+// publicSyncOwner as their comment, and only those are listed and removed.
+type Cloudflare struct {
+	zoneID   string
+	token    string
+	endpoint string
+	client   *http.Client
+}
+
+func NewCloudflare(zoneID, token string) *Cloudflare {
+	return &Cloudflare{
+		zoneID:   zoneID,
+		token:    token,
+		endpoint: "https://api.cloudflare.com/client/v4",
+		client:   &http.Client{Timeout: publicSyncTimeout},
+	}
+}
+
+func (c *Cloudflare) String() string { return "cloudflare:" + c.zoneID }
+
+// call sends a request to the API and decodes the result of its envelope.
+func (c *Cloudflare) call(ctx context.Context, method, path string, body, result any) (cloudflareResultInfo, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return cloudflareResultInfo{}, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, reqBody)
+	if err != nil {
+		return cloudflareResultInfo{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.client.Do(req)
+	if err != nil {
+		return cloudflareResultInfo{}, err
+	}
+	defer res.Body.Close()
+	var env struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result     json.RawMessage      `json:"result"`
+		ResultInfo cloudflareResultInfo `json:"result_info"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 16<<20)).Decode(&env); err != nil {
+		return cloudflareResultInfo{}, fmt.Errorf("cloudflare %s %s: %s", method, path, res.Status)
+	}
+	if !env.Success {
+		if len(env.Errors) > 0 {
+			return cloudflareResultInfo{}, fmt.Errorf("cloudflare %s %s: %s (code %d)", method, path, env.Errors[0].Message, env.Errors[0].Code)
+		}
+		return cloudflareResultInfo{}, fmt.Errorf("cloudflare %s %s: %s", method, path, res.Status)
+	}
+	if result != nil {
+		if err := json.Unmarshal(env.Result, result); err != nil {
+			return cloudflareResultInfo{}, err
+		}
+	}
+	return env.ResultInfo, nil
+}
+
+type cloudflareResultInfo struct {
+	Page       int `json:"page"`
+	TotalPages int `json:"total_pages"`
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	Proxied bool   `json:"proxied"`
+	Comment string `json:"comment,omitempty"`
+}
+
+func (c *Cloudflare) Zone(ctx context.Context) (string, error) {
+	var zone struct {
+		Name string `json:"name"`
+	}
+	_, err := c.call(ctx, "GET", "/zones/"+url.PathEscape(c.zoneID), nil, &zone)
+	return zone.Name, err
+}
+
+// list returns the records we created in the zone.
+func (c *Cloudflare) list(ctx context.Context) ([]publicRecord, error) {
+	var out []publicRecord
+	for page := 1; ; page++ {
+		query := url.Values{"comment.exact": {publicSyncOwner}, "per_page": {"500"}, "page": {fmt.Sprint(page)}}
+		var records []cloudflareRecord
+		info, err := c.call(ctx, "GET", "/zones/"+url.PathEscape(c.zoneID)+"/dns_records?"+query.Encode(), nil, &records)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			// Filtering by comment is a paid feature on some plans, so
+			// check it here too
+			if r.Comment == publicSyncOwner {
+				out = append(out, publicRecord{Name: strings.ToLower(r.Name), Type: r.Type, Value: r.Content, ID: r.ID})
+			}
+		}
+		if page >= info.TotalPages {
+			return out, nil
+		}
+	}
+}
+
+func (c *Cloudflare) Sync(ctx context.Context, want []publicRecord, ttl time.Duration) (int, int, error) {
+	have, err := c.list(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	add, remove := diffPublic(have, want)
+	path := "/zones/" + url.PathEscape(c.zoneID) + "/dns_records"
+	removed := 0
+	for _, r := range remove {
+		if _, err := c.call(ctx, "DELETE", path+"/"+url.PathEscape(r.ID), nil, nil); err != nil {
+			return 0, removed, err
+		}
+		removed++
+	}
+	for i, r := range add {
+		rec := cloudflareRecord{Type: r.Type, Name: r.Name, Content: r.Value, TTL: int(ttl.Seconds()), Comment: publicSyncOwner}
+		if _, err := c.call(ctx, "POST", path, rec, nil); err != nil {
+			return i, removed, err
+		}
+	}
+	return len(add), removed, nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiffPublic(t *testing.T) {
+	have := []publicRecord{
+		{Name: "www.example.com", Type: "A", Value: "192.0.2.1", ID: "1"},
+		{Name: "www.example.com", Type: "A", Value: "192.0.2.2", ID: "2"},
+	}
+	want := []publicRecord{
+		{Name: "www.example.com", Type: "A", Value: "192.0.2.2"},
+		{Name: "www.example.com", Type: "AAAA", Value: "2001:db8::1"},
+	}
+	add, remove := diffPublic(have, want)
+	if len(add) != 1 || add[0].Type != "AAAA" {
+		t.Errorf("add = %+v", add)
+	}
+	if len(remove) != 1 || remove[0].ID != "1" {
+		t.Errorf("remove = %+v", remove)
+	}
+}
+
+func TestParsePublicProvider(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	for _, spec := range []string{"cloudflare", "cloudflare:", "gandi:abc", "route53:Z123"} {
+		if _, err := ParsePublicProvider(spec, "token"); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+	if _, err := ParsePublicProvider("cloudflare:abc", ""); err == nil {
+		t.Error("cloudflare without a token: no error")
+	}
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	p, err := ParsePublicProvider("route53:/hostedzone/Z123", "")
+	if err != nil || p.String() != "route53:Z123" {
+		t.Errorf("route53: %v, %v", p, err)
+	}
+}
+
+func publicSyncStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []Record{
+		{Domain: "www.example.com", Type: "A", Value: "192.0.2.10", Tags: "public"},
+		{Domain: "www.example.com", Type: "TXT", Value: `v=spf1 "-all"`, Tags: "public,web"},
+		{Domain: "nas.example.com", Type: "A", Value: "10.0.0.2"},
+		{Domain: "off.example.com", Type: "A", Value: "192.0.2.11", Tags: "public", Disabled: true},
+		{Domain: "www.example.org", Type: "A", Value: "192.0.2.12", Tags: "public"},
+	} {
+		if _, err := store.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestPublicSyncRecords(t *testing.T) {
+	sync := NewPublicSync(publicSyncStore(t), nil, "", 0)
+	got := sync.records("example.com")
+	if len(got) != 2 || got[0].Name != "www.example.com" || got[1].Name != "www.example.com" {
+		t.Errorf("records = %+v", got)
+	}
+	if !sync.Tagged(Change{New: &Record{Tags: "web,public"}}) || sync.Tagged(Change{New: &Record{Tags: "publicity"}}) {
+		t.Error("Tagged")
+	}
+}
+
+// fakeCloudflare serves the parts of the v4 API the sync uses.
+type fakeCloudflare struct {
+	mu      sync.Mutex
+	records map[string]cloudflareRecord
+	nextID  int
+}
+
+func (f *fakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reply := func(result any) {
+		json.NewEncoder(w).Encode(map[string]any{"success": true, "result": result, "result_info": map[string]int{"page": 1, "total_pages": 1}})
+	}
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"success": false, "errors": [{"code": 10000, "message": "Authentication error"}]}`))
+		return
+	}
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/zones/zone1":
+		reply(map[string]string{"name": "example.com"})
+	case r.Method == "GET" && r.URL.Path == "/zones/zone1/dns_records":
+		var out []cloudflareRecord
+		for _, rec := range f.records {
+			if rec.Comment == r.URL.Query().Get("comment.exact") {
+				out = append(out, rec)
+			}
+		}
+		reply(out)
+	case r.Method == "POST" && r.URL.Path == "/zones/zone1/dns_records":
+		var rec cloudflareRecord
+		json.NewDecoder(r.Body).Decode(&rec)
+		f.nextID++
+		rec.ID = strings.Repeat("x", f.nextID)
+		f.records[rec.ID] = rec
+		reply(rec)
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/zones/zone1/dns_records/"):
+		delete(f.records, strings.TrimPrefix(r.URL.Path, "/zones/zone1/dns_records/"))
+		reply(nil)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestPublicSyncCloudflare(t *testing.T) {
+	fake := &fakeCloudflare{records: map[string]cloudflareRecord{
+		"manual": {ID: "manual", Type: "A", Name: "www.example.com", Content: "192.0.2.99"},
+		"stale":  {ID: "stale", Type: "A", Name: "old.example.com", Content: "192.0.2.1", Comment: publicSyncOwner},
+	}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	store := publicSyncStore(t)
+	cf := NewCloudflare("zone1", "token")
+	cf.endpoint = srv.URL
+	sync := NewPublicSync(store, []publicProvider{cf}, "", time.Minute)
+	if err := sync.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	values := func() []string {
+		var out []string
+		for _, rec := range fake.records {
+			out = append(out, rec.Name+" "+rec.Type+" "+rec.Content)
+		}
+		slices.Sort(out)
+		return out
+	}
+	want := []string{"www.example.com A 192.0.2.10", "www.example.com A 192.0.2.99", `www.example.com TXT v=spf1 "-all"`}
+	if got := values(); !slices.Equal(got, want) {
+		t.Errorf("after first sync: %q", got)
+	}
+
+	// Running again changes nothing; untagging removes only our record
+	if err := sync.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	recs := store.List()
+	i := slices.IndexFunc(recs, func(r Record) bool { return r.Type == "TXT" })
+	if _, err := store.Patch(recs[i].ID, func(r Record) (Record, error) {
+		r.Tags = "web"
+		return r, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sync.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"www.example.com A 192.0.2.10", "www.example.com A 192.0.2.99"}
+	if got := values(); !slices.Equal(got, want) {
+		t.Errorf("after untagging: %q", got)
+	}
+
+	cf.token = "wrong"
+	if err := sync.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "Authentication error") {
+		t.Errorf("bad token: %v", err)
+	}
+}
+
+func TestSignAWSv4(t *testing.T) {
+	// Cases from the AWS Signature Version 4 test suite
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	for _, tc := range []struct {
+		name, method, url, contentType, body, signed, signature string
+	}{
+		{"get-vanilla", "GET", "/", "", "", "host;x-amz-date", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"get-vanilla-query-order-key-case", "GET", "/?Param2=value2&Param1=value1", "", "", "host;x-amz-date", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+		{"post-vanilla", "POST", "/", "", "", "host;x-amz-date", "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+		{"post-x-www-form-urlencoded", "POST", "/", "application/x-www-form-urlencoded", "Param1=value1", "content-type;host;x-amz-date", "ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a"},
+	} {
+		req := httptest.NewRequest(tc.method, "https://example.amazonaws.com"+tc.url, strings.NewReader(tc.body))
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		signAWSv4(req, []byte(tc.body), creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+		want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=" + tc.signed + ", Signature=" + tc.signature
+		if got := req.Header.Get("Authorization"); got != want {
+			t.Errorf("%s: Authorization = %s", tc.name, got)
+		}
+	}
+}
+
+func TestRoute53Values(t *testing.T) {
+	if got := route53Name(`\052.Example.com.`); got != "*.example.com" {
+		t.Errorf("route53Name = %q", got)
+	}
+	v := `say "hi" \ bye`
+	if q := route53Value("TXT", v); route53Unquote(q) != v {
+		t.Errorf("round trip of %q: %q", v, q)
+	}
+	if got := route53Unquote(`"abc" "def"`); got != "abcdef" {
+		t.Errorf("route53Unquote = %q", got)
+	}
+}
+
+func TestPublicSyncRoute53(t *testing.T) {
+	var batch string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			t.Errorf("unsigned request: %q", r.Header.Get("Authorization"))
+		}
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/2013-04-01/hostedzone/Z1":
+			w.Write([]byte(`<GetHostedZoneResponse><HostedZone><Name>example.com.</Name></HostedZone></GetHostedZoneResponse>`))
+		case r.Method == "GET" && r.URL.Path == "/2013-04-01/hostedzone/Z1/rrset":
+			w.Write([]byte(`<ListResourceRecordSetsResponse><ResourceRecordSets>
+				<ResourceRecordSet><Name>example.com.</Name><Type>NS</Type><TTL>172800</TTL><ResourceRecords><ResourceRecord><Value>ns-1.awsdns-01.org.</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>
+				<ResourceRecordSet><Name>_regieleki.old.example.com.</Name><Type>TXT</Type><TTL>60</TTL><ResourceRecords><ResourceRecord><Value>"heritage=regieleki"</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>
+				<ResourceRecordSet><Name>old.example.com.</Name><Type>A</Type><TTL>60</TTL><ResourceRecords><ResourceRecord><Value>192.0.2.1</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>
+				<ResourceRecordSet><Name>www.example.com.</Name><Type>TXT</Type><TTL>60</TTL><ResourceRecords><ResourceRecord><Value>"someone else's"</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>
+			</ResourceRecordSets><IsTruncated>false</IsTruncated></ListResourceRecordSetsResponse>`))
+		case r.Method == "POST" && r.URL.Path == "/2013-04-01/hostedzone/Z1/rrset":
+			body, _ := io.ReadAll(r.Body)
+			batch = string(body)
+			w.Write([]byte(`<ChangeResourceRecordSetsResponse><ChangeInfo><Status>PENDING</Status></ChangeInfo></ChangeResourceRecordSetsResponse>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	store := publicSyncStore(t)
+	if _, err := store.Add(Record{Domain: "api.example.com", Type: "A", Value: "192.0.2.20", Tags: "public"}); err != nil {
+		t.Fatal(err)
+	}
+	r53 := NewRoute53("Z1", awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"})
+	r53.endpoint = srv.URL
+	sync := NewPublicSync(store, []publicProvider{r53}, "", time.Minute)
+	if err := sync.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// www.example.com holds someone else's TXT set, so it is left alone;
+	// api.example.com is claimed and old.example.com given up
+	for _, want := range []string{
+		`<Change><Action>CREATE</Action><ResourceRecordSet><Name>_regieleki.api.example.com.</Name><Type>TXT</Type><TTL>60</TTL>`,
+		`<Change><Action>UPSERT</Action><ResourceRecordSet><Name>api.example.com.</Name><Type>A</Type><TTL>60</TTL><ResourceRecords><ResourceRecord><Value>192.0.2.20</Value>`,
+		`<Change><Action>DELETE</Action><ResourceRecordSet><Name>old.example.com.</Name><Type>A</Type>`,
+		`<Change><Action>DELETE</Action><ResourceRecordSet><Name>_regieleki.old.example.com.</Name>`,
+	} {
+		if !strings.Contains(batch, want) {
+			t.Errorf("batch lacks %s:\n%s", want, batch)
+		}
+	}
+	if strings.Contains(batch, "www.example.com") {
+		t.Errorf("batch touches a name that is not ours:\n%s", batch)
+	}
+}
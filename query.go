@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+var opcodeNames = map[int]string{0: "QUERY", opcodeNotify: "NOTIFY", opcodeUpdate: "UPDATE"}
+
+// handleQuery is a small dig: it sends one question and prints the response
+// section by section, using the server's own wire code.
+func handleQuery(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	tcp := fs.Bool("tcp", false, "Query over TCP instead of UDP")
+	short := fs.Bool("short", false, "Print only the answer data")
+	norec := fs.Bool("norec", false, "Clear the recursion desired flag")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: regieleki query [flags] <name> [type] [@server[:port]]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	// Like dig, the server, type and name may come in any order
+	server, qtype, name := "127.0.0.1:53", uint16(1), ""
+	for _, arg := range fs.Args() {
+		if s, ok := strings.CutPrefix(arg, "@"); ok {
+			u, err := normalizeUpstream(s)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(2)
+			}
+			server = u
+		} else if t, ok := parseType(arg); ok && name != "" {
+			qtype = t
+		} else if name == "" {
+			name = arg
+		} else {
+			fs.Usage()
+			os.Exit(2)
+		}
+	}
+	if name == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	name, err := toASCII(strings.TrimSuffix(name, "."))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: invalid name: %v\n", err)
+		os.Exit(2)
+	}
+
+	query := buildQuery(name, qtype)
+	if *norec {
+		query[2] &^= 0x01
+	}
+	transport := "udp"
+	if isDoTUpstream(server) {
+		transport = "tls"
+	} else if *tcp {
+		transport = "tcp"
+	}
+	start := time.Now()
+	var resp []byte
+	if transport == "tcp" {
+		resp, err = forwardTCP(query, server)
+	} else {
+		resp, err = (&DNSServer{}).forwardTo(query, server)
+	}
+	elapsed := time.Since(start)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, ";; no answer from %s: %v\n", server, err)
+		os.Exit(1)
+	}
+	msg, err := parseMessage(resp)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, ";; bad response from %s: %v\n", server, err)
+		os.Exit(1)
+	}
+
+	if *short {
+		for _, rr := range msg.Answers {
+			fmt.Println(rr.Data)
+		}
+		return
+	}
+	printMessage(os.Stdout, msg)
+	fmt.Printf("\n;; Query time: %.1f ms\n", float64(elapsed.Microseconds())/1000)
+	fmt.Printf(";; SERVER: %s (%s)\n", server, transport)
+	fmt.Printf(";; MSG SIZE  rcvd: %d\n", len(resp))
+}
+
+// printMessage writes msg in the layout dig uses: the header, then each
+// non-empty section with one record per line.
+func printMessage(w io.Writer, msg *Message) {
+	opcode, ok := opcodeNames[msg.Opcode]
+	if !ok {
+		opcode = fmt.Sprintf("OPCODE%d", msg.Opcode)
+	}
+	fmt.Fprintf(w, ";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n", opcode, rcodeString(msg.RCode), msg.ID)
+	var flags []string
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{{"qr", msg.Response}, {"aa", msg.AA}, {"tc", msg.TC}, {"rd", msg.RD}, {"ra", msg.RA}} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	fmt.Fprintf(w, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(flags, " "), len(msg.Questions), len(msg.Answers), len(msg.Authority), len(msg.Additional))
+
+	if len(msg.Questions) > 0 {
+		fmt.Fprintln(w, "\n;; QUESTION SECTION:")
+		for _, q := range msg.Questions {
+			fmt.Fprintf(w, ";%s\t\t%s\t%s\n", fqdn(q.Name), classString(q.Class), typeString(q.Type))
+		}
+	}
+	for _, section := range []struct {
+		name string
+		rrs  []RR
+	}{{"ANSWER", msg.Answers}, {"AUTHORITY", msg.Authority}, {"ADDITIONAL", msg.Additional}} {
+		if len(section.rrs) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n;; %s SECTION:\n", section.name)
+		for _, rr := range section.rrs {
+			if rr.Type == 41 {
+				// The OPT pseudo-record's class and TTL hold EDNS fields
+				fmt.Fprintf(w, "; EDNS: udp: %d\n", rr.Class)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", fqdn(rr.Name), rr.TTL, classString(rr.Class), typeString(rr.Type), rr.Data)
+		}
+	}
+}
+
+func classString(class uint16) string {
+	switch class {
+	case 1:
+		return "IN"
+	case 3:
+		return "CH"
+	case 255:
+		return "ANY"
+	}
+	return fmt.Sprintf("CLASS%d", class)
+}
+
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrintMessage(t *testing.T) {
+	fake := startFakeUpstream(t, `app.test A answer 10.0.0.1`)
+	resp, err := (&DNSServer{}).forwardTo(buildQuery("app.test", 1), fake.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := parseMessage(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	printMessage(&out, msg)
+	for _, want := range []string{
+		"opcode: QUERY, status: NOERROR",
+		"flags: qr rd ra; QUERY: 1, ANSWER: 1, AUTHORITY: 0",
+		";; QUESTION SECTION:\n;app.test.\t\tIN\tA\n",
+		";; ANSWER SECTION:\napp.test.\t",
+		"\tIN\tA\t10.0.0.1\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output is missing %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "AUTHORITY SECTION") {
+		t.Errorf("empty section printed:\n%s", out.String())
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueryLogSize = 1000
+	// queryLogBacklog is how many entries a live tail may fall behind before
+	// it starts missing some; a stalled client must not slow down queries.
+	queryLogBacklog = 256
+	// queryLogKeepalive is how often an idle live tail gets a comment line,
+	// so proxies don't time the connection out.
+	queryLogKeepalive = 30 * time.Second
+)
+
+// QueryLogEntry is one answered query.
+type QueryLogEntry struct {
+	Time     time.Time  `json:"time"`
+	Client   netip.Addr `json:"client"`
+	View     string     `json:"view,omitempty"`
+	Name     string     `json:"name"`
+	Type     string     `json:"type"`
+	Source   string     `json:"source"` // how it was answered, as in /api/slo
+	Rcode    string     `json:"rcode"`
+	Answers  int        `json:"answers"`
+	Duration float64    `json:"duration_ms"`
+}
+
+// QueryLog keeps the most recent queries in a fixed-size ring and hands new
+// ones to live subscribers.
+type QueryLog struct {
+	mu      sync.Mutex
+	entries []QueryLogEntry
+	next    int  // where the next entry goes
+	full    bool // entries has wrapped around
+	subs    map[chan QueryLogEntry]struct{}
+	closed  bool
+	now     func() time.Time
+
+	// Past sampleAbove queries a second (0 is always), only one query in
+	// every sample is kept.
+	sample      int
+	sampleAbove int
+	second      int64 // the second rate counts queries in
+	rate        int
+	seen        int // queries since sampling last kept one
+}
+
+func NewQueryLog(size int) *QueryLog {
+	return &QueryLog{
+		entries: make([]QueryLogEntry, size),
+		subs:    make(map[chan QueryLogEntry]struct{}),
+		now:     time.Now,
+	}
+}
+
+// sampled reports whether a query arriving now is kept. l.mu must be held.
+func (l *QueryLog) sampled(now time.Time) bool {
+	if l.sample < 2 {
+		return true
+	}
+	if sec := now.Unix(); sec != l.second {
+		l.second, l.rate = sec, 0
+	}
+	l.rate++
+	if l.rate <= l.sampleAbove {
+		return true
+	}
+	l.seen++
+	if l.seen < l.sample {
+		return false
+	}
+	l.seen = 0
+	return true
+}
+
+// Record logs a query and the response sent for it.
+func (l *QueryLog) Record(query, resp []byte, client netip.Addr, view string, o outcome, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if !l.sampled(now) {
+		return
+	}
+	e := QueryLogEntry{
+		Time:     now,
+		Client:   client.Unmap(),
+		View:     view,
+		Source:   outcomeNames[o],
+		Rcode:    rcodeString(int(resp[3] & 0x0F)),
+		Duration: float64(d.Microseconds()) / 1000,
+	}
+	if name, end := parseDNSName(query, 12); end >= 0 && end+2 <= len(query) {
+		e.Name = name
+		e.Type = typeString(binary.BigEndian.Uint16(query[end : end+2]))
+	}
+	if len(resp) >= 8 {
+		e.Answers = int(binary.BigEndian.Uint16(resp[6:8]))
+	}
+	l.entries[l.next] = e
+	l.next++
+	if l.next == len(l.entries) {
+		l.next, l.full = 0, true
+	}
+	for ch := range l.subs {
+		select {
+		case ch <- e:
+		default: // the subscriber is behind; it misses this one
+		}
+	}
+}
+
+// Recent returns up to limit entries matching f, newest first.
+func (l *QueryLog) Recent(f queryLogFilter, limit int) []QueryLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.entries)
+	}
+	out := []QueryLogEntry{}
+	for i := range n {
+		e := &l.entries[(l.next-1-i+len(l.entries))%len(l.entries)]
+		if !f.match(e) {
+			continue
+		}
+		out = append(out, *e)
+		if len(out) == limit {
+			break
+		}
+	}
+	return out
+}
+
+// Subscribe returns a channel receiving every entry recorded from now on,
+// and a function to stop. The channel is closed by either, or by Close.
+func (l *QueryLog) Subscribe() (<-chan QueryLogEntry, func()) {
+	ch := make(chan QueryLogEntry, queryLogBacklog)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	l.subs[ch] = struct{}{}
+	return ch, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if _, ok := l.subs[ch]; ok {
+			delete(l.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Close ends all live subscriptions, so the HTTP server can shut down
+// without waiting on open tails. Queries are still recorded.
+func (l *QueryLog) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	for ch := range l.subs {
+		delete(l.subs, ch)
+		close(ch)
+	}
+}
+
+// queryLogFilter selects entries; zero fields match anything.
+type queryLogFilter struct {
+	client netip.Addr
+	name   string // substring, case-insensitive
+	qtype  string
+	source string
+	rcode  string
+}
+
+func (f queryLogFilter) match(e *QueryLogEntry) bool {
+	return (!f.client.IsValid() || e.Client == f.client) &&
+		(f.name == "" || strings.Contains(strings.ToLower(e.Name), f.name)) &&
+		(f.qtype == "" || e.Type == f.qtype) &&
+		(f.source == "" || e.Source == f.source) &&
+		(f.rcode == "" || e.Rcode == f.rcode)
+}
+
+// parseQueryLogFilter reads the filter from the query string, returning a
+// message if a parameter is invalid.
+func parseQueryLogFilter(r *http.Request) (queryLogFilter, string) {
+	q := r.URL.Query()
+	f := queryLogFilter{
+		name:   strings.ToLower(strings.TrimSuffix(q.Get("name"), ".")),
+		qtype:  strings.ToUpper(q.Get("type")),
+		source: strings.ToLower(q.Get("source")),
+		rcode:  strings.ToUpper(q.Get("rcode")),
+	}
+	if v := q.Get("client"); v != "" {
+		ip, err := netip.ParseAddr(v)
+		if err != nil {
+			return f, fmt.Sprintf("invalid client %q", v)
+		}
+		f.client = ip.Unmap()
+	}
+	if f.source != "" && !slices.Contains(outcomeNames[:], f.source) {
+		return f, fmt.Sprintf("invalid source %q", f.source)
+	}
+	return f, ""
+}
+
+func (s *WebServer) handleQueryLog(w http.ResponseWriter, r *http.Request) {
+	if s.querylog == nil {
+		jsonError(w, "query log disabled", http.StatusNotFound)
+		return
+	}
+	f, msg := parseQueryLogFilter(r)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			jsonError(w, fmt.Sprintf("invalid limit %q", v), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.querylog.Recent(f, limit))
+}
+
+// handleQueryLogStream tails the query log as server-sent events, one JSON
+// entry per event, until the client goes away.
+func (s *WebServer) handleQueryLogStream(w http.ResponseWriter, r *http.Request) {
+	if s.querylog == nil {
+		jsonError(w, "query log disabled", http.StatusNotFound)
+		return
+	}
+	f, msg := parseQueryLogFilter(r)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+	entries, stop := s.querylog.Subscribe()
+	defer stop()
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	keepalive := time.NewTicker(queryLogKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case e, ok := <-entries:
+			if !ok {
+				return
+			}
+			if !f.match(&e) {
+				continue
+			}
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
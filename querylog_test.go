@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryLog(t *testing.T) {
+	l := NewQueryLog(3)
+	resp := make([]byte, 12)
+	resp[7] = 1 // one answer
+	for _, name := range []string{"a.test", "b.test", "c.test", "d.test"} {
+		l.Record(buildTestQuery(name, 1, 1), resp, netip.MustParseAddr("::ffff:10.0.0.1"), "", outcomeLocal, time.Millisecond)
+	}
+	l.Record(buildTestQuery("app.example", 28, 1), resp, netip.MustParseAddr("10.0.0.2"), "lan", outcomeForwarded, 0)
+
+	names := func(entries []QueryLogEntry) string {
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.Name)
+		}
+		return strings.Join(out, ",")
+	}
+	if got := names(l.Recent(queryLogFilter{}, 10)); got != "app.example,d.test,c.test" {
+		t.Errorf("recent = %s, want the newest three, newest first", got)
+	}
+	if got := l.Recent(queryLogFilter{client: netip.MustParseAddr("10.0.0.1")}, 1); names(got) != "d.test" || got[0].Type != "A" || got[0].Answers != 1 || got[0].Duration != 1 {
+		t.Errorf("by client = %+v", got)
+	}
+	if got := names(l.Recent(queryLogFilter{name: "app", qtype: "AAAA", source: "forwarded"}, 10)); got != "app.example" {
+		t.Errorf("by name, type and source = %s", got)
+	}
+}
+
+func TestWebQueryLog(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Record{Domain: "app.test", Type: "A", Value: "10.0.0.1"})
+	ws := NewWebServer(store, nil)
+	ws.dns = NewDNSServer(store, nil)
+	ws.querylog = NewQueryLog(10)
+	ws.dns.querylog = ws.querylog
+	addr := startDNSServer(t, ws.dns)
+	exchange(t, addr, buildTestQuery("app.test", 1, 1))
+	srv := httptest.NewServer(ws.Handler())
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL + "/api/querylog?name=APP.test&source=local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []QueryLogEntry
+	json.NewDecoder(resp.Body).Decode(&entries)
+	resp.Body.Close()
+	if len(entries) != 1 || entries[0].Name != "app.test" || entries[0].Rcode != "NOERROR" || !entries[0].Client.IsLoopback() {
+		t.Errorf("entries = %+v", entries)
+	}
+	for _, q := range []string{"client=nope", "source=magic", "limit=0"} {
+		if resp, _ := http.Get(srv.URL + "/api/querylog?" + q); resp.StatusCode != 400 {
+			t.Errorf("%s: status = %d, want 400", q, resp.StatusCode)
+		}
+	}
+
+	// The live tail only sends new queries that match the filter
+	stream, err := http.Get(srv.URL + "/api/querylog/stream?type=AAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	if ct := stream.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("content type = %q", ct)
+	}
+	exchange(t, addr, buildTestQuery("app.test", 1, 1))
+	exchange(t, addr, buildTestQuery("app.test", 28, 1))
+	lines := bufio.NewScanner(stream.Body)
+	for lines.Scan() && lines.Text() == "" {
+	}
+	data, ok := strings.CutPrefix(lines.Text(), "data: ")
+	var e QueryLogEntry
+	if !ok || json.Unmarshal([]byte(data), &e) != nil || e.Type != "AAAA" {
+		t.Errorf("event = %q", lines.Text())
+	}
+
+	// Shutting down ends open tails
+	ws.querylog.Close()
+	for lines.Scan() {
+	}
+}
+
+func TestQueryLogSampling(t *testing.T) {
+	l := NewQueryLog(100)
+	l.sample, l.sampleAbove = 4, 3
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+	resp := make([]byte, 12)
+	record := func(n int) {
+		for range n {
+			l.Record(buildTestQuery("a.test", 1, 1), resp, netip.MustParseAddr("10.0.0.1"), "", outcomeLocal, 0)
+		}
+	}
+
+	// The first 3 in a second are all kept, then one in every 4 of the next 12
+	record(15)
+	if n := len(l.Recent(queryLogFilter{}, 100)); n != 6 {
+		t.Errorf("kept %d of 15 queries, want 6", n)
+	}
+	// A quiet second is logged in full again
+	now = now.Add(time.Second)
+	record(2)
+	if n := len(l.Recent(queryLogFilter{}, 100)); n != 8 {
+		t.Errorf("kept %d after a quiet second, want 8", n)
+	}
+}
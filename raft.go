@@ -0,0 +1,961 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	raftHeartbeat      = 200 * time.Millisecond
+	raftElection       = 1500 * time.Millisecond // randomized up to twice this
+	raftProposeTimeout = 5 * time.Second
+	raftMaxEntries     = 256  // per AppendEntries request
+	raftSnapshotAfter  = 1000 // applied entries kept in the log before it is compacted
+)
+
+var (
+	errRaftNoLeader = errors.New("raft: no leader elected, try again")
+	errRaftLostLead = errors.New("raft: leadership lost before the change was committed, try again")
+)
+
+// raftEntry is one log entry. It holds the changes of one store mutation,
+// applied all or none, the full record set a new cluster is seeded with, or
+// neither: the no-op a leader commits when elected.
+type raftEntry struct {
+	Term    uint64   `json:"term"`
+	Index   uint64   `json:"index"`
+	Changes []Change `json:"changes,omitempty"`
+	Seed    []Record `json:"seed,omitempty"`
+}
+
+// raftDisk is the state a node keeps across restarts apart from its log:
+// its term and vote, and the record set as of the last snapshot. It is
+// rewritten only when those change, on elections and compaction; entries
+// are appended to the log file beside it one fsync at a time.
+type raftDisk struct {
+	Term      uint64   `json:"term"`
+	Vote      string   `json:"vote,omitempty"`
+	SnapIndex uint64   `json:"snapshot_index"`
+	SnapTerm  uint64   `json:"snapshot_term"`
+	Snapshot  []Record `json:"snapshot"`
+}
+
+type raftVoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+type raftVoteReply struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type raftAppendRequest struct {
+	Term      uint64      `json:"term"`
+	Leader    string      `json:"leader"`
+	PrevIndex uint64      `json:"prev_index"`
+	PrevTerm  uint64      `json:"prev_term"`
+	Entries   []raftEntry `json:"entries,omitempty"`
+	Commit    uint64      `json:"commit"`
+}
+
+type raftAppendReply struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	LastIndex uint64 `json:"last_index"` // where a lagging follower's log ends
+}
+
+type raftSnapshotRequest struct {
+	Term     uint64   `json:"term"`
+	Leader   string   `json:"leader"`
+	Index    uint64   `json:"index"`
+	SnapTerm uint64   `json:"snapshot_term"`
+	Records  []Record `json:"records"`
+}
+
+type raftProposeReply struct {
+	Index uint64 `json:"index"`
+	Error string `json:"error,omitempty"`
+}
+
+// RaftStatus is the externally visible state of a cluster node.
+type RaftStatus struct {
+	ID      string           `json:"id"`
+	Role    string           `json:"role"`
+	Term    uint64           `json:"term"`
+	Leader  string           `json:"leader,omitempty"`
+	Commit  uint64           `json:"commit"`
+	Applied uint64           `json:"applied"`
+	Peers   []RaftPeerStatus `json:"peers"`
+}
+
+type RaftPeerStatus struct {
+	URL         string    `json:"url"`
+	Match       uint64    `json:"match,omitempty"` // last entry known replicated there; leader only
+	LastContact time.Time `json:"last_contact,omitzero"`
+}
+
+// Raft replicates the record set between two or more nodes with the Raft
+// consensus algorithm, so every node answers queries from its own copy and
+// edits survive the loss of any minority of them. Changes made on any node
+// are written through to the leader, which forwards them; they are
+// acknowledged once a majority has them in its log, and every node then
+// applies them to its store. Nodes talk over HTTP with a shared secret, on
+// a listener of their own.
+type Raft struct {
+	id     string // the URL peers reach this node at
+	peers  []string
+	secret string
+	path   string // where raftDisk is kept; the log is in path+".log"
+	store  *Store
+	client *http.Client
+
+	heartbeat time.Duration
+	election  time.Duration
+
+	mu        sync.Mutex
+	role      string // "follower", "candidate" or "leader"
+	term      uint64
+	vote      string
+	leader    string
+	log       []raftEntry
+	snapIndex uint64
+	snapTerm  uint64
+	snapshot  []Record
+	commit    uint64
+	applied   uint64
+	state     map[int]Record // the record set as of applied
+	seed      []Record       // local records to start a new cluster with
+	timeout   time.Time      // when to start an election if no leader is heard
+	next      map[string]uint64
+	match     map[string]uint64
+	busy      map[string]bool // peers with a request in flight
+	contact   map[string]time.Time
+	waiters   map[uint64]chan error // proposals made on this leader
+	appliedc  chan struct{}         // closed and replaced whenever applied advances
+	resync    chan struct{}         // asks the applier to bring the store in line
+	kick      chan struct{}         // asks for replication now
+}
+
+func NewRaft(id string, peers []string, secret, path string, store *Store) *Raft {
+	r := &Raft{
+		id:        strings.TrimRight(id, "/"),
+		secret:    secret,
+		path:      path,
+		store:     store,
+		client:    &http.Client{Timeout: raftProposeTimeout},
+		heartbeat: raftHeartbeat,
+		election:  raftElection,
+		role:      "follower",
+		state:     make(map[int]Record),
+		next:      make(map[string]uint64),
+		match:     make(map[string]uint64),
+		busy:      make(map[string]bool),
+		contact:   make(map[string]time.Time),
+		waiters:   make(map[uint64]chan error),
+		appliedc:  make(chan struct{}),
+		resync:    make(chan struct{}, 1),
+		kick:      make(chan struct{}, 1),
+	}
+	for _, p := range peers {
+		if p = strings.TrimRight(p, "/"); p != r.id && !slices.Contains(r.peers, p) {
+			r.peers = append(r.peers, p)
+		}
+	}
+	return r
+}
+
+// Start loads the node's raft state and log and hooks the store up to write
+// changes through the cluster. A node without any state yet keeps its
+// local records to seed the cluster with, should it be the first leader;
+// any other takes the replicated record set once a leader is heard.
+func (r *Raft) Start() error {
+	data, err := os.ReadFile(r.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var disk raftDisk
+	if err == nil {
+		if err := json.Unmarshal(data, &disk); err != nil {
+			return fmt.Errorf("%s: %w", r.path, err)
+		}
+	}
+	entries, err := readRaftLog(r.path+".log", disk.SnapIndex)
+	if err != nil {
+		return err
+	}
+	_, local := r.store.Snapshot()
+
+	r.mu.Lock()
+	r.term, r.vote = disk.Term, disk.Vote
+	r.snapIndex, r.snapTerm, r.snapshot = disk.SnapIndex, disk.SnapTerm, disk.Snapshot
+	r.log = entries
+	r.applied, r.commit = r.snapIndex, r.snapIndex
+	for _, rec := range r.snapshot {
+		r.state[rec.ID] = rec
+	}
+	if r.lastIndex() == 0 {
+		r.seed = local
+	}
+	r.resetTimeout()
+	r.mu.Unlock()
+	r.store.SetRemote(r.write)
+	return nil
+}
+
+func (r *Raft) lastIndex() uint64 { return r.snapIndex + uint64(len(r.log)) }
+
+// termAt returns the term of the entry at index i, or 0 if the log doesn't
+// hold it.
+func (r *Raft) termAt(i uint64) uint64 {
+	switch {
+	case i == r.snapIndex:
+		return r.snapTerm
+	case i > r.snapIndex && i <= r.lastIndex():
+		return r.log[i-r.snapIndex-1].Term
+	}
+	return 0
+}
+
+func (r *Raft) quorum() int { return (len(r.peers)+1)/2 + 1 }
+
+func (r *Raft) resetTimeout() {
+	r.timeout = time.Now().Add(r.election + rand.N(r.election))
+}
+
+// readRaftLog reads the entries after snapIndex from the log file. Entries
+// at or before it are left over from a compaction interrupted before the
+// log was rewritten, and a torn last line from a crash mid-append was never
+// acknowledged, so both are skipped.
+func readRaftLog(path string, snapIndex uint64) ([]raftEntry, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []raftEntry
+	for line := range bytes.Lines(data) {
+		var e raftEntry
+		if json.Unmarshal(line, &e) != nil || !bytes.HasSuffix(line, []byte("\n")) {
+			break
+		}
+		if e.Index <= snapIndex {
+			continue
+		}
+		if e.Index != snapIndex+uint64(len(entries))+1 {
+			return nil, fmt.Errorf("%s: entry %d out of order", path, e.Index)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// saveState writes the term, vote and snapshot to disk. Caller must hold
+// r.mu; nothing it promised a peer counts until this returns.
+func (r *Raft) saveState() error {
+	data, err := json.Marshal(raftDisk{
+		Term: r.term, Vote: r.vote,
+		SnapIndex: r.snapIndex, SnapTerm: r.snapTerm, Snapshot: r.snapshot,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.path, data, true)
+}
+
+// appendLog adds entries, already appended to r.log, to the end of the log
+// file and syncs it. Caller must hold r.mu.
+func (r *Raft) appendLog(entries []raftEntry) error {
+	var buf []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	f, err := os.OpenFile(r.path+".log", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// saveSnapshot saves a new snapshot and then the log after it. In this
+// order a crash in between leaves entries the snapshot covers in the log,
+// which Start skips, rather than a gap. Caller must hold r.mu.
+func (r *Raft) saveSnapshot() error {
+	if err := r.saveState(); err != nil {
+		return err
+	}
+	return r.rewriteLog()
+}
+
+// rewriteLog replaces the log file with r.log, after a compaction or when a
+// follower's conflicting entries are cut off. Caller must hold r.mu.
+func (r *Raft) rewriteLog() error {
+	var buf []byte
+	for _, e := range r.log {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	return writeFileAtomic(r.path+".log", buf, true)
+}
+
+// stepDown makes this node a follower in term. Proposals still waiting on
+// it as leader can no longer be vouched for. Caller must hold r.mu.
+func (r *Raft) stepDown(term uint64) {
+	if term > r.term {
+		r.term, r.vote = term, ""
+		if err := r.saveState(); err != nil {
+			slog.Error("failed to save raft state", "error", err)
+		}
+	}
+	if r.role == "leader" {
+		slog.Info("raft leadership lost", "term", r.term)
+		for index, w := range r.waiters {
+			w <- errRaftLostLead
+			delete(r.waiters, index)
+		}
+	}
+	r.role = "follower"
+	r.resetTimeout()
+}
+
+// Run drives elections and replication until ctx is done, and returns once
+// the store is no longer being written to.
+func (r *Raft) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Go(func() { r.runApplier(ctx) })
+	ticker := time.NewTicker(r.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.kick:
+		}
+		r.mu.Lock()
+		switch {
+		case r.role == "leader":
+			r.replicateAll(ctx)
+		case time.Now().After(r.timeout):
+			r.campaign(ctx)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// runApplier replaces the store's records with the replicated set whenever
+// it changes. It runs apart from the raft lock, since a proposal waits for
+// its commit while holding the store's.
+func (r *Raft) runApplier(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.resync:
+		}
+		r.mu.Lock()
+		records := slices.SortedFunc(maps.Values(r.state), func(a, b Record) int { return a.ID - b.ID })
+		r.mu.Unlock()
+		if err := r.store.Replace(records); err != nil {
+			slog.Error("failed to apply replicated records", "error", err)
+		}
+	}
+}
+
+func (r *Raft) requestResync() {
+	select {
+	case r.resync <- struct{}{}:
+	default:
+	}
+}
+
+// campaign starts an election for the next term. Caller must hold r.mu.
+func (r *Raft) campaign(ctx context.Context) {
+	r.role = "candidate"
+	r.term++
+	r.vote = r.id
+	r.leader = ""
+	r.resetTimeout()
+	if err := r.saveState(); err != nil {
+		slog.Error("failed to save raft state", "error", err)
+		return
+	}
+	term, votes := r.term, 1
+	if votes >= r.quorum() {
+		r.becomeLeader()
+		return
+	}
+	req := raftVoteRequest{Term: term, Candidate: r.id, LastIndex: r.lastIndex(), LastTerm: r.termAt(r.lastIndex())}
+	for _, peer := range r.peers {
+		go func() {
+			var reply raftVoteReply
+			if err := r.call(ctx, peer, "/raft/vote", req, &reply); err != nil {
+				return
+			}
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.contact[peer] = time.Now()
+			if reply.Term > r.term {
+				r.stepDown(reply.Term)
+				return
+			}
+			if r.role != "candidate" || r.term != term || !reply.Granted {
+				return
+			}
+			if votes++; votes >= r.quorum() {
+				r.becomeLeader()
+			}
+		}()
+	}
+}
+
+// becomeLeader takes over as leader and appends the entry that commits
+// everything before it: the seed records if the cluster has none yet, a
+// no-op otherwise. Caller must hold r.mu.
+func (r *Raft) becomeLeader() {
+	r.role, r.leader = "leader", r.id
+	for _, peer := range r.peers {
+		r.next[peer] = r.lastIndex() + 1
+		r.match[peer] = 0
+	}
+	entry := raftEntry{Term: r.term, Index: r.lastIndex() + 1}
+	if entry.Index == 1 && len(r.seed) > 0 {
+		entry.Seed = r.seed
+		slog.Info("seeding raft cluster with local records", "records", len(r.seed))
+	}
+	r.seed = nil
+	r.log = append(r.log, entry)
+	if err := r.appendLog([]raftEntry{entry}); err != nil {
+		slog.Error("failed to save raft state", "error", err)
+	}
+	slog.Info("raft leader elected", "id", r.id, "term", r.term)
+	r.advanceCommit()
+	r.kickNow()
+}
+
+func (r *Raft) kickNow() {
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+// replicateAll sends every idle peer what it is missing, or a heartbeat.
+// Caller must hold r.mu.
+func (r *Raft) replicateAll(ctx context.Context) {
+	for _, peer := range r.peers {
+		if !r.busy[peer] {
+			r.busy[peer] = true
+			go r.replicate(ctx, peer)
+		}
+	}
+}
+
+// replicate brings one peer's log up to date, with a snapshot if the
+// entries it needs were compacted away.
+func (r *Raft) replicate(ctx context.Context, peer string) {
+	defer func() {
+		r.mu.Lock()
+		r.busy[peer] = false
+		r.mu.Unlock()
+	}()
+	r.mu.Lock()
+	if r.role != "leader" {
+		r.mu.Unlock()
+		return
+	}
+	term, next := r.term, r.next[peer]
+	if next <= r.snapIndex {
+		req := raftSnapshotRequest{Term: term, Leader: r.id, Index: r.snapIndex, SnapTerm: r.snapTerm, Records: r.snapshot}
+		r.mu.Unlock()
+		var reply raftAppendReply
+		if err := r.call(ctx, peer, "/raft/snapshot", req, &reply); err != nil {
+			return
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.contact[peer] = time.Now()
+		if reply.Term > r.term {
+			r.stepDown(reply.Term)
+		} else if r.role == "leader" && r.term == term {
+			r.match[peer] = max(r.match[peer], req.Index)
+			r.next[peer] = r.match[peer] + 1
+		}
+		return
+	}
+	req := raftAppendRequest{Term: term, Leader: r.id, PrevIndex: next - 1, PrevTerm: r.termAt(next - 1), Commit: r.commit}
+	end := min(r.lastIndex(), next-1+raftMaxEntries)
+	req.Entries = slices.Clone(r.log[next-r.snapIndex-1 : end-r.snapIndex])
+	r.mu.Unlock()
+
+	var reply raftAppendReply
+	if err := r.call(ctx, peer, "/raft/append", req, &reply); err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.contact[peer] = time.Now()
+	switch {
+	case reply.Term > r.term:
+		r.stepDown(reply.Term)
+	case r.role != "leader" || r.term != term:
+	case reply.Success:
+		r.match[peer] = max(r.match[peer], end)
+		r.next[peer] = r.match[peer] + 1
+		r.advanceCommit()
+		if end < r.lastIndex() {
+			r.kickNow()
+		}
+	default:
+		// Back off to where the peer's log ends, or one entry at a time
+		r.next[peer] = max(1, min(next-1, reply.LastIndex+1))
+		r.kickNow()
+	}
+}
+
+// advanceCommit commits the newest entry of this term a majority holds,
+// and everything before it. Caller must hold r.mu.
+func (r *Raft) advanceCommit() {
+	for n := r.lastIndex(); n > r.commit && r.termAt(n) == r.term; n-- {
+		count := 1
+		for _, peer := range r.peers {
+			if r.match[peer] >= n {
+				count++
+			}
+		}
+		if count >= r.quorum() {
+			r.commit = n
+			r.applyCommitted()
+			r.kickNow()
+			return
+		}
+	}
+}
+
+// applyCommitted applies committed entries to the replicated record set,
+// answers the proposals waiting on them, and compacts the log once it has
+// grown long. Caller must hold r.mu.
+func (r *Raft) applyCommitted() {
+	if r.applied >= r.commit {
+		return
+	}
+	for r.applied < r.commit {
+		r.applied++
+		entry := r.log[r.applied-r.snapIndex-1]
+		err := r.apply(entry)
+		if w, ok := r.waiters[r.applied]; ok {
+			w <- err
+			delete(r.waiters, r.applied)
+		}
+	}
+	close(r.appliedc)
+	r.appliedc = make(chan struct{})
+	r.requestResync()
+
+	if r.applied-r.snapIndex >= raftSnapshotAfter {
+		r.snapTerm = r.termAt(r.applied)
+		r.log = slices.Clone(r.log[r.applied-r.snapIndex:])
+		r.snapIndex = r.applied
+		r.snapshot = slices.SortedFunc(maps.Values(r.state), func(a, b Record) int { return a.ID - b.ID })
+		if err := r.saveSnapshot(); err != nil {
+			slog.Error("failed to save raft state", "error", err)
+		}
+	}
+}
+
+// apply makes one entry's changes to the record set, all of them or, if one
+// fails, none. Every node applies the same entries in the same order, so a
+// change that fails here, such as an add whose ID another node took first,
+// fails everywhere.
+func (r *Raft) apply(e raftEntry) error {
+	if e.Seed != nil {
+		clear(r.state)
+		for _, rec := range e.Seed {
+			r.state[rec.ID] = rec
+		}
+		return nil
+	}
+	undo := map[int]*Record{} // each touched record as it was, nil if absent
+	for _, c := range e.Changes {
+		rec := c.Old
+		if c.New != nil {
+			rec = c.New
+		}
+		if _, ok := undo[rec.ID]; !ok {
+			undo[rec.ID] = nil
+			if prev, ok := r.state[rec.ID]; ok {
+				undo[rec.ID] = &prev
+			}
+		}
+		if err := r.applyChange(c); err != nil {
+			for id, prev := range undo {
+				if prev == nil {
+					delete(r.state, id)
+				} else {
+					r.state[id] = *prev
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Raft) applyChange(c Change) error {
+	switch c.Op {
+	case "add":
+		if existing, ok := r.state[c.New.ID]; ok && existing != *c.New {
+			return fmt.Errorf("raft: record id %d is taken, try again", c.New.ID)
+		}
+		r.state[c.New.ID] = *c.New
+	case "update":
+		if _, ok := r.state[c.New.ID]; !ok {
+			return fmt.Errorf("raft: record %d: %w", c.New.ID, os.ErrNotExist)
+		}
+		r.state[c.New.ID] = *c.New
+	case "delete":
+		delete(r.state, c.Old.ID)
+	}
+	return nil
+}
+
+// write is the Store's write-through hook, so it runs with the store lock
+// held: edits and reloads on this node wait, for up to raftProposeTimeout,
+// until the cluster has committed the changes, though queries don't. It
+// proposes the changes as one entry and returns once they are committed
+// and applied here. If it fails, the store may already hold the changes, so
+// it is brought back in line with the replicated set.
+func (r *Raft) write(changes []Change) error {
+	ctx, cancel := context.WithTimeout(context.Background(), raftProposeTimeout)
+	defer cancel()
+	changes = slices.Clone(changes)
+	for i := range changes {
+		changes[i].Serial = 0
+	}
+	index, err := r.propose(ctx, changes)
+	if err == nil {
+		err = r.waitApplied(ctx, index)
+	}
+	if err != nil {
+		r.requestResync()
+	}
+	return err
+}
+
+// propose hands changes to the leader, which is this node or is asked over
+// HTTP, and returns the index they were committed at.
+func (r *Raft) propose(ctx context.Context, changes []Change) (uint64, error) {
+	r.mu.Lock()
+	if r.role != "leader" {
+		leader := r.leader
+		r.mu.Unlock()
+		if leader == "" {
+			return 0, errRaftNoLeader
+		}
+		var reply raftProposeReply
+		if err := r.call(ctx, leader, "/raft/propose", changes, &reply); err != nil {
+			return 0, fmt.Errorf("raft: forwarding to leader: %w", err)
+		}
+		if reply.Error != "" {
+			return 0, errors.New(reply.Error)
+		}
+		return reply.Index, nil
+	}
+	entry := raftEntry{Term: r.term, Index: r.lastIndex() + 1, Changes: changes}
+	r.log = append(r.log, entry)
+	if err := r.appendLog([]raftEntry{entry}); err != nil {
+		r.log = r.log[:len(r.log)-1]
+		r.mu.Unlock()
+		return 0, err
+	}
+	done := make(chan error, 1)
+	r.waiters[entry.Index] = done
+	r.advanceCommit()
+	r.kickNow()
+	r.mu.Unlock()
+
+	select {
+	case err := <-done:
+		return entry.Index, err
+	case <-ctx.Done():
+		r.mu.Lock()
+		delete(r.waiters, entry.Index)
+		r.mu.Unlock()
+		return 0, fmt.Errorf("raft: change not committed: %w", ctx.Err())
+	}
+}
+
+// waitApplied waits until this node has applied the entry at index.
+func (r *Raft) waitApplied(ctx context.Context, index uint64) error {
+	for {
+		r.mu.Lock()
+		applied, ch := r.applied, r.appliedc
+		r.mu.Unlock()
+		if applied >= index {
+			return nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return fmt.Errorf("raft: change not applied here: %w", ctx.Err())
+		}
+	}
+}
+
+// call posts a JSON request to a peer and decodes its reply.
+func (r *Raft) call(ctx context.Context, peer, path string, req, reply any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	timeout := r.heartbeat * 5
+	if path == "/raft/propose" {
+		timeout = raftProposeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	hr, err := http.NewRequestWithContext(ctx, "POST", peer+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hr.Header.Set("Authorization", "Bearer "+r.secret)
+	hr.Header.Set("Content-Type", "application/json")
+	res, err := r.client.Do(hr)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s%s: %s: %s", peer, path, res.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(res.Body).Decode(reply)
+}
+
+// Handler serves the requests peers send this node.
+func (r *Raft) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /raft/vote", raftRPC(r.handleVote))
+	mux.HandleFunc("POST /raft/append", raftRPC(r.handleAppend))
+	mux.HandleFunc("POST /raft/snapshot", raftRPC(r.handleSnapshot))
+	mux.HandleFunc("POST /raft/propose", raftRPC(r.handlePropose))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte(r.secret)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+// raftRPC adapts a typed request handler to HTTP with JSON bodies.
+func raftRPC[Req, Reply any](fn func(context.Context, Req) Reply) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var in Req
+		if err := json.NewDecoder(io.LimitReader(req.Body, 64<<20)).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fn(req.Context(), in))
+	}
+}
+
+func (r *Raft) handleVote(_ context.Context, req raftVoteRequest) raftVoteReply {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.Term > r.term {
+		r.stepDown(req.Term)
+	}
+	upToDate := req.LastTerm > r.termAt(r.lastIndex()) ||
+		req.LastTerm == r.termAt(r.lastIndex()) && req.LastIndex >= r.lastIndex()
+	if req.Term < r.term || r.vote != "" && r.vote != req.Candidate || !upToDate {
+		return raftVoteReply{Term: r.term}
+	}
+	r.vote = req.Candidate
+	if err := r.saveState(); err != nil {
+		slog.Error("failed to save raft state", "error", err)
+		return raftVoteReply{Term: r.term}
+	}
+	r.resetTimeout()
+	return raftVoteReply{Term: r.term, Granted: true}
+}
+
+// follow accepts req's sender as leader of term, if it is current. Caller
+// must hold r.mu.
+func (r *Raft) follow(term uint64, leader string) bool {
+	if term < r.term {
+		return false
+	}
+	if term > r.term || r.role != "follower" {
+		r.stepDown(term)
+	}
+	if r.leader != leader {
+		slog.Info("raft following leader", "leader", leader, "term", term)
+		r.leader = leader
+	}
+	r.contact[leader] = time.Now()
+	r.resetTimeout()
+	return true
+}
+
+func (r *Raft) handleAppend(_ context.Context, req raftAppendRequest) raftAppendReply {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.follow(req.Term, req.Leader) {
+		return raftAppendReply{Term: r.term, LastIndex: r.lastIndex()}
+	}
+	if req.PrevIndex > r.lastIndex() || req.PrevIndex >= r.snapIndex && r.termAt(req.PrevIndex) != req.PrevTerm {
+		return raftAppendReply{Term: r.term, LastIndex: min(r.lastIndex(), req.PrevIndex-1)}
+	}
+	var added []raftEntry
+	truncated := false
+	for _, e := range req.Entries {
+		switch {
+		case e.Index <= r.snapIndex:
+			// Committed and compacted here already
+		case e.Index <= r.lastIndex() && r.termAt(e.Index) == e.Term:
+		default:
+			if e.Index <= r.lastIndex() {
+				r.log = r.log[:e.Index-r.snapIndex-1]
+				truncated = true
+			}
+			r.log = append(r.log, e)
+			added = append(added, e)
+		}
+	}
+	if len(added) > 0 {
+		save := func() error { return r.appendLog(added) }
+		if truncated {
+			save = r.rewriteLog
+		}
+		if err := save(); err != nil {
+			slog.Error("failed to save raft state", "error", err)
+			return raftAppendReply{Term: r.term, LastIndex: r.snapIndex}
+		}
+	}
+	if last := req.PrevIndex + uint64(len(req.Entries)); req.Commit > r.commit {
+		r.commit = max(r.commit, min(req.Commit, last))
+		r.applyCommitted()
+	}
+	return raftAppendReply{Term: r.term, Success: true, LastIndex: r.lastIndex()}
+}
+
+func (r *Raft) handleSnapshot(_ context.Context, req raftSnapshotRequest) raftAppendReply {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.follow(req.Term, req.Leader) || req.Index <= r.snapIndex {
+		return raftAppendReply{Term: r.term, LastIndex: r.lastIndex()}
+	}
+	if r.termAt(req.Index) == req.SnapTerm {
+		r.log = slices.Clone(r.log[req.Index-r.snapIndex:])
+	} else {
+		r.log = nil
+	}
+	r.snapIndex, r.snapTerm, r.snapshot = req.Index, req.SnapTerm, req.Records
+	if err := r.saveSnapshot(); err != nil {
+		slog.Error("failed to save raft state", "error", err)
+	}
+	clear(r.state)
+	for _, rec := range req.Records {
+		r.state[rec.ID] = rec
+	}
+	r.commit, r.applied = max(r.commit, req.Index), req.Index
+	r.applyCommitted()
+	close(r.appliedc)
+	r.appliedc = make(chan struct{})
+	r.requestResync()
+	return raftAppendReply{Term: r.term, Success: true, LastIndex: r.lastIndex()}
+}
+
+func (r *Raft) handlePropose(ctx context.Context, changes []Change) raftProposeReply {
+	r.mu.Lock()
+	leader := r.role == "leader"
+	r.mu.Unlock()
+	if !leader {
+		return raftProposeReply{Error: errRaftNoLeader.Error()}
+	}
+	index, err := r.propose(ctx, changes)
+	if err != nil {
+		return raftProposeReply{Error: err.Error()}
+	}
+	return raftProposeReply{Index: index}
+}
+
+// ListenAndServe serves peers on addr.
+func (r *Raft) ListenAndServe(addr string) error {
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      r.Handler(),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: raftProposeTimeout + time.Second,
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("raft listening", "addr", ln.Addr().String(), "id", r.id, "peers", len(r.peers))
+	return srv.Serve(ln)
+}
+
+// raftListenAddr is the address to serve peers on when no -raft-listen is
+// given: every interface, on the port of this node's own URL.
+func raftListenAddr(id string) (string, error) {
+	u, err := url.Parse(id)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		return "", fmt.Errorf("raft: invalid node URL %q (want http://host:port)", id)
+	}
+	return ":" + cmp.Or(u.Port(), "80"), nil
+}
+
+func (r *Raft) Status() RaftStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := RaftStatus{ID: r.id, Role: r.role, Term: r.term, Leader: r.leader, Commit: r.commit, Applied: r.applied, Peers: []RaftPeerStatus{}}
+	for _, peer := range r.peers {
+		p := RaftPeerStatus{URL: peer, LastContact: r.contact[peer]}
+		if r.role == "leader" {
+			p.Match = r.match[peer]
+		}
+		st.Peers = append(st.Peers, p)
+	}
+	return st
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type raftTestNode struct {
+	raft   *Raft
+	store  *Store
+	srv    *httptest.Server
+	cancel context.CancelFunc
+	done   chan struct{} // closed when Run returns
+	down   bool
+}
+
+func (n *raftTestNode) stop() {
+	if !n.down {
+		n.down = true
+		n.cancel()
+		n.srv.Close()
+		<-n.done
+	}
+}
+
+// startRaftCluster runs size nodes in-process, with the first node's store
+// holding records.
+func startRaftCluster(t *testing.T, size int, records ...Record) []*raftTestNode {
+	t.Helper()
+	nodes := make([]*raftTestNode, size)
+	var urls []string
+	for i := range nodes {
+		srv := httptest.NewUnstartedServer(nil)
+		nodes[i] = &raftTestNode{srv: srv}
+		urls = append(urls, "http://"+srv.Listener.Addr().String())
+	}
+	for i, n := range nodes {
+		dir := t.TempDir()
+		store, err := NewStore(filepath.Join(dir, "records.tsv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			for _, r := range records {
+				if _, err := store.Add(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		n.store = store
+		n.raft = NewRaft(urls[i], urls, "secret", filepath.Join(dir, "records.tsv.raft"), store)
+		n.raft.heartbeat, n.raft.election = 20*time.Millisecond, 150*time.Millisecond
+		if i == 0 {
+			// Make sure the node with the records is the first leader
+			n.raft.election = 20 * time.Millisecond
+		}
+		if err := n.raft.Start(); err != nil {
+			t.Fatal(err)
+		}
+		n.srv.Config.Handler = n.raft.Handler()
+		n.srv.Start()
+		ctx, cancel := context.WithCancel(context.Background())
+		n.cancel, n.done = cancel, make(chan struct{})
+		go func() {
+			n.raft.Run(ctx)
+			close(n.done)
+		}()
+		t.Cleanup(n.stop)
+	}
+	return nodes
+}
+
+// waitFor polls cond until it holds or the test has waited too long.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func raftLeader(nodes []*raftTestNode) *raftTestNode {
+	for _, n := range nodes {
+		if !n.down && n.raft.Status().Role == "leader" {
+			return n
+		}
+	}
+	return nil
+}
+
+func domains(store *Store) []string {
+	var out []string
+	for _, r := range store.List() {
+		out = append(out, r.Domain)
+	}
+	slices.Sort(out)
+	return out
+}
+
+func TestRaftCluster(t *testing.T) {
+	nodes := startRaftCluster(t, 3, Record{Domain: "seed.home.lan", Type: "A", Value: "10.0.0.1"})
+	everywhere := func(want ...string) func() bool {
+		return func() bool {
+			for _, n := range nodes {
+				if !n.down && !slices.Equal(domains(n.store), want) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	waitFor(t, "the seed records to replicate", everywhere("seed.home.lan"))
+
+	// A change made on a follower goes through the leader to every node
+	leader := raftLeader(nodes)
+	if leader == nil {
+		t.Fatal("no leader")
+	}
+	follower := nodes[slices.IndexFunc(nodes, func(n *raftTestNode) bool { return n != leader })]
+	if _, err := follower.store.Add(Record{Domain: "nas.home.lan", Type: "A", Value: "10.0.0.2"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := domains(follower.store); !slices.Equal(got, []string{"nas.home.lan", "seed.home.lan"}) {
+		t.Errorf("follower after its own add: %q", got)
+	}
+	waitFor(t, "the add to replicate", everywhere("nas.home.lan", "seed.home.lan"))
+
+	// Losing the leader leaves a majority that elects another and carries on
+	leader.stop()
+	waitFor(t, "a new leader", func() bool {
+		l := raftLeader(nodes)
+		return l != nil && follower.raft.Status().Leader == l.raft.id
+	})
+	seed := slices.IndexFunc(follower.store.List(), func(r Record) bool { return r.Domain == "seed.home.lan" })
+	if err := follower.store.Delete(follower.store.List()[seed].ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delete to replicate", everywhere("nas.home.lan"))
+}
+
+func TestRaftNoQuorum(t *testing.T) {
+	nodes := startRaftCluster(t, 2)
+	waitFor(t, "a leader", func() bool { return raftLeader(nodes) != nil })
+	for _, n := range nodes[1:] {
+		n.stop()
+	}
+	nodes[0].raft.mu.Lock()
+	nodes[0].raft.role, nodes[0].raft.leader = "leader", nodes[0].raft.id
+	nodes[0].raft.mu.Unlock()
+
+	// Without a majority an edit is never committed
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := nodes[0].raft.propose(ctx, []Change{{Op: "add", New: &Record{ID: 7, Domain: "x.lan", Type: "A", Value: "10.0.0.7"}}}); err == nil {
+		t.Error("change committed without a majority")
+	}
+}
+
+func TestRaftAuth(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRaft("http://127.0.0.1:1", nil, "secret", filepath.Join(t.TempDir(), "raft"), store)
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/raft/vote", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d without the secret", w.Code)
+	}
+}
+
+func TestRaftSingleNode(t *testing.T) {
+	nodes := startRaftCluster(t, 1)
+	waitFor(t, "a leader", func() bool { return raftLeader(nodes) != nil })
+	if _, err := nodes[0].store.Add(Record{Domain: "a.lan", Type: "A", Value: "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	st := nodes[0].raft.Status()
+	if st.Commit != 2 || st.Applied != 2 {
+		t.Errorf("status = %+v", st)
+	}
+}
+
+func TestWebRaftStatus(t *testing.T) {
+	ws, _ := testWebServer(t)
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/raft", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("without raft: status %d", w.Code)
+	}
+
+	nodes := startRaftCluster(t, 1)
+	waitFor(t, "a leader", func() bool { return raftLeader(nodes) != nil })
+	ws.raft = nodes[0].raft
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/raft", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"role":"leader"`) {
+		t.Errorf("status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestRaftApplyIsAllOrNothing(t *testing.T) {
+	r := NewRaft("http://127.0.0.1:1", nil, "secret", filepath.Join(t.TempDir(), "raft"), nil)
+	r.state[1] = Record{ID: 1, Domain: "a.lan", Type: "A", Value: "10.0.0.1"}
+	r.state[2] = Record{ID: 2, Domain: "b.lan", Type: "A", Value: "10.0.0.2"}
+	err := r.apply(raftEntry{Changes: []Change{
+		{Op: "delete", Old: &Record{ID: 1}},
+		{Op: "update", New: &Record{ID: 2, Domain: "b.lan", Type: "A", Value: "10.0.0.9"}},
+		{Op: "add", New: &Record{ID: 3, Domain: "c.lan", Type: "A", Value: "10.0.0.3"}},
+		{Op: "update", New: &Record{ID: 4, Domain: "gone.lan", Type: "A", Value: "10.0.0.4"}},
+	}})
+	if err == nil {
+		t.Fatal("entry updating a missing record applied")
+	}
+	if len(r.state) != 2 || r.state[1].Value != "10.0.0.1" || r.state[2].Value != "10.0.0.2" {
+		t.Errorf("state after a failed entry: %+v", r.state)
+	}
+}
+
+func TestRaftRestart(t *testing.T) {
+	nodes := startRaftCluster(t, 1)
+	waitFor(t, "a leader", func() bool { return raftLeader(nodes) != nil })
+	n := nodes[0]
+	_, err := n.store.Batch([]BatchOp{
+		{Op: "create", Record: Record{Domain: "a.lan", Type: "A", Value: "10.0.0.1"}},
+		{Op: "create", Record: Record{Domain: "b.lan", Type: "A", Value: "10.0.0.2"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := n.raft.Status()
+	n.stop()
+
+	// The log was appended entry by entry and is read back on start
+	r := NewRaft(n.raft.id, nil, "secret", n.raft.path, n.store)
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if r.lastIndex() != before.Commit || r.term != before.Term || len(r.log[len(r.log)-1].Changes) != 2 {
+		t.Errorf("after restart: last index %d, term %d, log %+v; before %+v", r.lastIndex(), r.term, r.log, before)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitSweep is how often buckets of clients that have gone quiet are
+// dropped, keeping the table bounded by the number of recently active clients.
+const rateLimitSweep = time.Minute
+
+type tokenBucket struct {
+	tokens  float64
+	last    time.Time
+	limited bool // already logged; cleared when the bucket is swept
+}
+
+// take refills the bucket for the time since it was last used and spends
+// one token if there is one.
+func (b *tokenBucket) take(now time.Time, rate, burst float64) bool {
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket would be full by now, so dropping it is
+// indistinguishable from keeping it.
+func (b *tokenBucket) full(now time.Time, rate, burst float64) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= burst
+}
+
+// RateLimiter is a token bucket per client IP for UDP queries, so a single
+// noisy client runs out of budget instead of filling the shared concurrency
+// limit. Over-limit queries are dropped, or answered with TC set when
+// truncate is on so well-behaved clients retry over TCP.
+type RateLimiter struct {
+	mu        sync.Mutex
+	qps       float64
+	burst     float64
+	truncate  bool
+	anonymize bool // log over-limit clients by their truncated address
+	clients   map[netip.Addr]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewRateLimiter allows each client qps queries per second on average and
+// up to burst at once. A burst below 1 defaults to qps.
+func NewRateLimiter(qps, burst float64, truncate bool) *RateLimiter {
+	if burst < 1 {
+		burst = max(qps, 1)
+	}
+	return &RateLimiter{
+		qps:      qps,
+		burst:    burst,
+		truncate: truncate,
+		clients:  make(map[netip.Addr]*tokenBucket),
+		now:      time.Now,
+	}
+}
+
+// Allow reports whether a query from ip fits in its budget, and spends one
+// token if so.
+func (l *RateLimiter) Allow(ip netip.Addr) bool {
+	now := l.now()
+	ip = ip.Unmap()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweep {
+		l.sweep(now)
+	}
+	b, ok := l.clients[ip]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.clients[ip] = b
+	}
+	if !b.take(now, l.qps, l.burst) {
+		if !b.limited {
+			b.limited = true
+			logged := ip
+			if l.anonymize {
+				logged = anonymizeAddr(ip)
+			}
+			slog.Warn("client over query rate limit", "client", logged, "qps", l.qps)
+		}
+		return false
+	}
+	return true
+}
+
+// sweep forgets clients whose buckets have refilled, since a new bucket
+// would look the same. Caller must hold l.mu.
+func (l *RateLimiter) sweep(now time.Time) {
+	for ip, b := range l.clients {
+		if b.full(now, l.qps, l.burst) {
+			delete(l.clients, ip)
+		}
+	}
+	l.lastSweep = now
+}
+
+// HTTPRateLimiter is a token bucket per client IP and per bearer credential
+// for the HTTP API, so a runaway script gets 429s instead of queueing up
+// store saves. A request must fit in both of its buckets; either limit may
+// be off. Buckets of credentials are keyed by a hash, since the table
+// outlives the requests and holds tokens that may not even be valid.
+type HTTPRateLimiter struct {
+	mu        sync.Mutex
+	ip        rateLimit
+	token     rateLimit
+	buckets   map[string]*tokenBucket // "ip:" or "token:" and the key
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// rateLimit is a budget of rate requests per second, up to burst at once.
+// A zero rate disables it.
+type rateLimit struct{ rate, burst float64 }
+
+func newRateLimit(rate, burst float64) rateLimit {
+	if burst < 1 {
+		burst = max(rate, 1)
+	}
+	return rateLimit{rate, burst}
+}
+
+// NewHTTPRateLimiter allows each client IP ipRate requests per second and
+// each bearer credential tokenRate, both up to burst at once. A burst below
+// 1 defaults to the rate.
+func NewHTTPRateLimiter(ipRate, tokenRate, burst float64) *HTTPRateLimiter {
+	return &HTTPRateLimiter{
+		ip:      newRateLimit(ipRate, burst),
+		token:   newRateLimit(tokenRate, burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Middleware answers requests to guarded paths and DynDNS updates with 429
+// once their client or credential is out of budget. It runs ahead of
+// authentication, so failed attempts spend budget too.
+func (l *HTTPRateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !needsToken(r.URL.Path) && r.URL.Path != ddnsPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var ip netip.Addr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			ip, _ = netip.ParseAddr(host)
+		}
+		bearer, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if wait, ok := l.Allow(ip.Unmap(), bearer); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			jsonError(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Allow reports whether a request from ip carrying bearer ("" for none)
+// fits in both budgets, spending a token from each if so. Otherwise it
+// returns how long until the request would fit.
+func (l *HTTPRateLimiter) Allow(ip netip.Addr, bearer string) (time.Duration, bool) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweep {
+		l.sweep(now)
+	}
+	var keys []string
+	if l.ip.rate > 0 && ip.IsValid() {
+		keys = append(keys, "ip:"+ip.String())
+	}
+	if l.token.rate > 0 && bearer != "" {
+		sum := sha256.Sum256([]byte(bearer))
+		keys = append(keys, "token:"+hex.EncodeToString(sum[:8]))
+	}
+	// Check every bucket before spending, so a request refused by one
+	// doesn't cost budget in the other
+	var wait time.Duration
+	for _, key := range keys {
+		lim := l.limit(key)
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &tokenBucket{tokens: lim.burst, last: now}
+			l.buckets[key] = b
+		}
+		have := min(lim.burst, b.tokens+now.Sub(b.last).Seconds()*lim.rate)
+		if have >= 1 {
+			continue
+		}
+		wait = max(wait, time.Duration((1-have)/lim.rate*float64(time.Second)))
+		if !b.limited {
+			b.limited = true
+			slog.Warn("HTTP client over rate limit", "client", ip, "bucket", key, "rate", lim.rate)
+		}
+	}
+	if wait > 0 {
+		return wait, false
+	}
+	for _, key := range keys {
+		lim := l.limit(key)
+		l.buckets[key].take(now, lim.rate, lim.burst)
+	}
+	return 0, true
+}
+
+func (l *HTTPRateLimiter) limit(key string) rateLimit {
+	if strings.HasPrefix(key, "token:") {
+		return l.token
+	}
+	return l.ip
+}
+
+// sweep forgets buckets that have refilled. Caller must hold l.mu.
+func (l *HTTPRateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if lim := l.limit(key); b.full(now, lim.rate, lim.burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
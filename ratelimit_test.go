@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	l := NewRateLimiter(2, 3, false)
+	l.now = func() time.Time { return now }
+	noisy := netip.MustParseAddr("10.0.0.1")
+	quiet := netip.MustParseAddr("10.0.0.2")
+
+	for i := range 3 {
+		if !l.Allow(noisy) {
+			t.Fatalf("query %d within burst was limited", i)
+		}
+	}
+	if l.Allow(noisy) {
+		t.Error("query beyond burst was allowed")
+	}
+	if !l.Allow(quiet) {
+		t.Error("other clients must keep their own budget")
+	}
+
+	// Two queries per second refill
+	now = now.Add(time.Second)
+	if !l.Allow(noisy) || !l.Allow(noisy) || l.Allow(noisy) {
+		t.Error("expected exactly two queries after one second")
+	}
+
+	// IPv4-mapped addresses share the IPv4 bucket
+	if l.Allow(netip.MustParseAddr("::ffff:10.0.0.1")) {
+		t.Error("mapped address escaped the limit")
+	}
+
+	now = now.Add(2 * rateLimitSweep)
+	l.Allow(quiet)
+	if _, ok := l.clients[noisy]; ok {
+		t.Error("idle client was not swept")
+	}
+}
+
+func TestDNSRateLimitTruncates(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Record{Domain: "app.test", Type: "A", Value: "10.0.0.1"})
+	dns := NewDNSServer(store, nil)
+	dns.limiter = NewRateLimiter(1, 1, true)
+	addr := startDNSServer(t, dns)
+
+	if resp := exchange(t, addr, buildTestQuery("app.test", 1, 1)); resp[2]&0x02 != 0 || resp[7] != 1 {
+		t.Fatalf("first query: flags=%#x ancount=%d", resp[2], resp[7])
+	}
+	resp := exchange(t, addr, buildTestQuery("app.test", 1, 1))
+	if resp[2]&0x02 == 0 || resp[7] != 0 {
+		t.Fatalf("over-limit query: flags=%#x ancount=%d, want TC and no answers", resp[2], resp[7])
+	}
+
+	// The TCP retry is not limited
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if err := writeTCPMessage(conn, buildTestQuery("app.test", 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = readTCPMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp[7] != 1 {
+		t.Errorf("TCP answer count = %d, want 1", resp[7])
+	}
+}
+
+func TestHTTPRateLimiter(t *testing.T) {
+	ws, _ := testWebServer(t)
+	ws.tokens = newStaticTokenSet("api-token")
+	now := time.Unix(1_700_000_000, 0)
+	ws.limiter = NewHTTPRateLimiter(1, 1, 2)
+	ws.limiter.now = func() time.Time { return now }
+	h := ws.Handler()
+	do := func(path, ip, bearer string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = ip + ":40000"
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := range 2 {
+		if w := do("/api/records", "10.0.0.1", "api-token"); w.Code != 200 {
+			t.Fatalf("request %d within burst: %d", i, w.Code)
+		}
+	}
+	w := do("/api/records", "10.0.0.1", "api-token")
+	if w.Code != 429 || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("request over budget: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	// The token is out of budget from any address, and the address with
+	// any token, while public pages and other clients are unaffected
+	if w := do("/api/records", "10.0.0.2", "api-token"); w.Code != 429 {
+		t.Errorf("same token from another IP: %d", w.Code)
+	}
+	if w := do("/api/records", "10.0.0.1", "guess"); w.Code != 429 {
+		t.Errorf("same IP with another token: %d", w.Code)
+	}
+	if w := do("/api/ui", "10.0.0.1", ""); w.Code != 200 {
+		t.Errorf("public path: %d", w.Code)
+	}
+	if w := do("/api/records", "10.0.0.3", "guess"); w.Code != 401 {
+		t.Errorf("fresh client: %d", w.Code)
+	}
+
+	// A request refused by one bucket doesn't spend the other's budget
+	now = now.Add(time.Second)
+	if w := do("/api/records", "10.0.0.2", "api-token"); w.Code != 200 {
+		t.Errorf("after refill: %d", w.Code)
+	}
+
+	now = now.Add(2 * rateLimitSweep)
+	do("/api/records", "10.0.0.4", "")
+	if len(ws.limiter.buckets) != 1 {
+		t.Errorf("%d buckets left after sweep", len(ws.limiter.buckets))
+	}
+}
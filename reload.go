@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const defaultReloadSchedule = "@every 2s"
+
+// fileStamp identifies one version of a file cheaply.
+type fileStamp struct {
+	mtime time.Time
+	size  int64
+}
+
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{info.ModTime(), info.Size()}, nil
+}
+
+// Reload picks up edits made to the data file by hand or by configuration
+// management. When the file differs from what the store last read or wrote,
+// it is read again, with the journal replayed on top as on startup, and
+// listeners see the difference as ordinary changes. A change is only acted
+// on once the file looks the same on two calls in a row, so a file still
+// being written isn't loaded half-way. A missing file is left alone.
+func (s *Store) Reload(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stamp, err := statFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if stamp == s.stamp {
+		s.pending = fileStamp{}
+		return nil
+	}
+	if stamp != s.pending {
+		s.pending = stamp
+		return nil
+	}
+
+	prev, nextID, prevStamp := s.records, s.nextID, s.stamp
+	// A failed reload leaves the store as it was, stamp included, so the
+	// next call tries again
+	restore := func(err error) error {
+		s.records, s.nextID, s.stamp = prev, nextID, prevStamp
+		s.rebuildIndex()
+		return err
+	}
+	if err := s.load(); err != nil {
+		return restore(err)
+	}
+	if s.journal != nil {
+		if _, err := s.replayJournal(s.journal.path); err != nil {
+			return restore(err)
+		}
+	}
+	if s.journal != nil {
+		s.journal.replaced++
+	}
+	// IDs of records deleted by the edit are not handed out again
+	s.nextID = max(s.nextID, nextID)
+	s.pending = fileStamp{}
+	s.emitDiff(prev, s.records)
+	slog.InfoContext(ctx, "data file changed on disk, records reloaded", "path", s.path, "records", len(s.records))
+	return nil
+}
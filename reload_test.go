@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.tsv")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(Record{Domain: "app.local", Type: "A", Value: "10.0.0.1"})
+	s.Add(Record{Domain: "old.local", Type: "A", Value: "10.0.0.2"})
+	var seen []string
+	s.Subscribe(func(c Change) { seen = append(seen, c.Op) })
+	ctx := context.Background()
+
+	// The store's own writes are not mistaken for edits
+	for range 2 {
+		if err := s.Reload(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(seen) != 0 {
+		t.Fatalf("reload without an edit: %v", seen)
+	}
+
+	edited := "1\tapp.local\tA\t10.0.0.9\n3\tnew.local\tA\t10.0.0.3\n"
+	if err := os.WriteFile(path, []byte(edited), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s.Reload(ctx)
+	if recs, _ := s.Resolve("app.local", 1); recs[0].Value != "10.0.0.1" {
+		t.Error("edit loaded before the file settled")
+	}
+	if err := s.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if recs, _ := s.Resolve("app.local", 1); len(recs) != 1 || recs[0].Value != "10.0.0.9" {
+		t.Errorf("app.local after reload: %+v", recs)
+	}
+	if _, ok := s.Resolve("old.local", 1); ok {
+		t.Error("record removed from the file still resolves")
+	}
+	slices.Sort(seen)
+	if !slices.Equal(seen, []string{"add", "delete", "update"}) {
+		t.Errorf("listeners saw %v", seen)
+	}
+	if r, _ := s.Add(Record{Domain: "next.local", Type: "A", Value: "10.0.0.4"}); r.ID != 4 {
+		t.Errorf("next ID = %d, want 4", r.ID)
+	}
+}
+
+func TestStoreReloadJournalError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.tsv")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.OpenJournal(path + ".journal"); err != nil {
+		t.Fatal(err)
+	}
+	s.Add(Record{Domain: "app.local", Type: "A", Value: "10.0.0.1"})
+	s.Compact()
+	ctx := context.Background()
+
+	// A journal line too long to read fails the replay after the edited
+	// file was loaded; the store keeps what it had
+	if err := os.WriteFile(path, []byte("7\tnew.local\tA\t10.0.0.7\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".journal", []byte(strings.Repeat("x", 2<<20)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s.Reload(ctx)
+	if err := s.Reload(ctx); err == nil {
+		t.Fatal("reload with an unreadable journal succeeded")
+	}
+	if recs, ok := s.Resolve("app.local", 1); !ok || recs[0].Value != "10.0.0.1" {
+		t.Errorf("app.local after a failed reload: %+v", recs)
+	}
+	if _, ok := s.Resolve("new.local", 1); ok {
+		t.Error("half-reloaded record resolves")
+	}
+	if r, _ := s.Add(Record{Domain: "next.local", Type: "A", Value: "10.0.0.2"}); r.ID != 2 {
+		t.Errorf("next ID = %d, want 2", r.ID)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDHeaderAndErrors(t *testing.T) {
+	ws, _ := testWebServer(t)
+
+	req := httptest.NewRequest("DELETE", "/api/records/999", nil)
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	id := w.Header().Get(requestIDHeader)
+	if id == "" {
+		t.Fatal("no request ID in response")
+	}
+	var body map[string]string
+	json.NewDecoder(w.Body).Decode(&body)
+	if body["request_id"] != id {
+		t.Errorf("error body = %v, want request_id %s", body, id)
+	}
+
+	// A caller-supplied ID is kept; a hostile one is replaced
+	for in, keep := range map[string]bool{"lb-1234.abc": true, "bad id\n": false, strings.Repeat("x", 65): false} {
+		req := httptest.NewRequest("GET", "/api/records", nil)
+		req.Header.Set(requestIDHeader, in)
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, req)
+		if got := w.Header().Get(requestIDHeader); (got == in) != keep || got == "" {
+			t.Errorf("%q -> %q", in, got)
+		}
+	}
+}
+
+func TestRequestIDHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(requestIDHandler{slog.NewTextHandler(&buf, nil)}).With("component", "test")
+
+	ctx := withRequestID(context.Background(), "abc-1")
+	logger.InfoContext(ctx, "hello")
+	logger.Info("no context")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !strings.Contains(lines[0], "request_id=abc-1") || !strings.Contains(lines[0], "component=test") {
+		t.Errorf("line = %q", lines[0])
+	}
+	if strings.Contains(lines[1], "request_id") {
+		t.Errorf("unexpected request_id in %q", lines[1])
+	}
+	if a, b := newRequestID(), newRequestID(); a == b {
+		t.Errorf("request IDs repeat: %s", a)
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT on Linux, which the syscall package lacks.
+const soReusePort = 0xf
+
+// canReusePort reports whether listenUDPGroup can bind several sockets.
+const canReusePort = true
+
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// route53OwnerPrefix names the TXT record that marks a name as ours:
+// _regieleki.www.example.com says www.example.com's records were put there
+// by this server. Route53 has no per-record comments, so this registry
+// record, as external-dns keeps one, is what keeps other records safe.
+const route53OwnerPrefix = "_regieleki."
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+func awsCredentialsFromEnv() (awsCredentials, error) {
+	c := awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return c, errors.New("public sync to route53 needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return c, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signAWSv4 adds an AWS Signature Version 4 to req, whose body is body.
+func signAWSv4(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	date, stamp := now.Format("20060102"), now.Format("20060102T150405Z")
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", stamp)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	names := []string{"host"}
+	for k := range req.Header {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-amz-") || k == "content-type" {
+			names = append(names, k)
+		}
+	}
+	slices.Sort(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		v := req.Host
+		if v == "" {
+			v = req.URL.Host
+		}
+		if k != "host" {
+			v = strings.TrimSpace(req.Header.Get(k))
+		}
+		canonHeaders.WriteString(k + ":" + v + "\n")
+	}
+	signed := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	// url.Values.Encode sorts by key and escapes as SigV4 wants, except
+	// for spaces
+	query := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+	canonical := strings.Join([]string{req.Method, path, query, canonHeaders.String(), signed, hex.EncodeToString(payloadHash[:])}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(canonHash[:])
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// Route53 pushes records through the Route53 REST API. Route53 holds record
+// sets rather than records, so every name and type we publish is one set,
+// replaced as a whole, and a name is only touched once a registry record
+// (route53OwnerPrefix) says it is ours. A set that exists at a name we
+// don't own is left alone, with a warning.
+type Route53 struct {
+	zoneID   string
+	creds    awsCredentials
+	endpoint string
+	client   *http.Client
+	now      func() time.Time
+}
+
+func NewRoute53(zoneID string, creds awsCredentials) *Route53 {
+	return &Route53{
+		zoneID:   strings.TrimPrefix(zoneID, "/hostedzone/"),
+		creds:    creds,
+		endpoint: "https://route53.amazonaws.com",
+		client:   &http.Client{Timeout: publicSyncTimeout},
+		now:      time.Now,
+	}
+}
+
+func (r *Route53) String() string { return "route53:" + r.zoneID }
+
+// call sends a signed request and decodes the XML reply into out.
+func (r *Route53) call(ctx context.Context, method, path string, body []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, r.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/xml")
+	}
+	// Route53 is a global service, signed for us-east-1
+	signAWSv4(req, body, r.creds, "us-east-1", "route53", r.now())
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Error struct {
+				Code    string
+				Message string
+			}
+		}
+		if xml.Unmarshal(data, &e) == nil && e.Error.Message != "" {
+			return fmt.Errorf("route53 %s: %s: %s", path, e.Error.Code, e.Error.Message)
+		}
+		return fmt.Errorf("route53 %s: %s", path, res.Status)
+	}
+	return xml.Unmarshal(data, out)
+}
+
+func (r *Route53) Zone(ctx context.Context) (string, error) {
+	var resp struct {
+		HostedZone struct {
+			Name string
+		}
+	}
+	err := r.call(ctx, "GET", "/2013-04-01/hostedzone/"+url.PathEscape(r.zoneID), nil, &resp)
+	return resp.HostedZone.Name, err
+}
+
+type route53RRSet struct {
+	Name            string
+	Type            string
+	TTL             int64    `xml:"TTL,omitempty"`
+	ResourceRecords []string `xml:"ResourceRecords>ResourceRecord>Value"`
+	AliasTarget     *struct{ DNSName string }
+}
+
+// route53Name turns a Route53 name into ours: no trailing dot, lowercase,
+// and the octal escapes it uses for characters such as * decoded.
+func route53Name(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for {
+		i := strings.Index(name, `\`)
+		if i < 0 || i+4 > len(name) {
+			return name
+		}
+		c, err := strconv.ParseUint(name[i+1:i+4], 8, 8)
+		if err != nil {
+			return name
+		}
+		name = name[:i] + string(rune(c)) + name[i+4:]
+	}
+}
+
+// route53Value turns a record value into Route53's form, which quotes TXT
+// strings.
+func route53Value(rtype, value string) string {
+	if rtype != "TXT" {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// route53Unquote is the inverse of route53Value for TXT values, joining
+// the character strings of a long value back together.
+func route53Unquote(value string) string {
+	var out strings.Builder
+	quoted, escaped := false, false
+	for _, c := range value {
+		switch {
+		case escaped:
+			out.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+			out.WriteRune(c)
+		}
+	}
+	return out.String()
+}
+
+// list returns every record set in the zone.
+func (r *Route53) list(ctx context.Context) ([]route53RRSet, error) {
+	var out []route53RRSet
+	query := url.Values{}
+	for {
+		var resp struct {
+			ResourceRecordSets []route53RRSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+			IsTruncated        bool
+			NextRecordName     string
+			NextRecordType     string
+		}
+		path := "/2013-04-01/hostedzone/" + url.PathEscape(r.zoneID) + "/rrset"
+		if len(query) > 0 {
+			path += "?" + query.Encode()
+		}
+		if err := r.call(ctx, "GET", path, nil, &resp); err != nil {
+			return nil, err
+		}
+		out = append(out, resp.ResourceRecordSets...)
+		if !resp.IsTruncated {
+			return out, nil
+		}
+		query = url.Values{"name": {resp.NextRecordName}, "type": {resp.NextRecordType}}
+	}
+}
+
+type route53Change struct {
+	Action            string
+	ResourceRecordSet route53RRSet
+}
+
+func (r *Route53) Sync(ctx context.Context, want []publicRecord, ttl time.Duration) (int, int, error) {
+	sets, err := r.list(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	owner := route53Value("TXT", publicSyncOwner)
+	owned := map[string]route53RRSet{}
+	current := map[string]route53RRSet{} // by name and type
+	for _, set := range sets {
+		name := route53Name(set.Name)
+		if set.Type == "TXT" && strings.HasPrefix(name, route53OwnerPrefix) && slices.Contains(set.ResourceRecords, owner) {
+			owned[strings.TrimPrefix(name, route53OwnerPrefix)] = set
+			continue
+		}
+		if set.AliasTarget == nil && slices.Contains(publicSyncTypes, set.Type) {
+			current[name+"\t"+set.Type] = set
+		}
+	}
+	var have []publicRecord
+	for key, set := range current {
+		name, _, _ := strings.Cut(key, "\t")
+		if _, ok := owned[name]; !ok {
+			continue
+		}
+		for _, v := range set.ResourceRecords {
+			if set.Type == "TXT" {
+				v = route53Unquote(v)
+			}
+			have = append(have, publicRecord{Name: name, Type: set.Type, Value: v})
+		}
+	}
+	// A name we don't own yet is claimed only if nothing of the types we
+	// publish is there, so we never take over sets someone else made
+	claim := map[string]bool{}
+	for _, rec := range want {
+		if _, ok := owned[rec.Name]; ok || claim[rec.Name] {
+			continue
+		}
+		taken := slices.ContainsFunc(publicSyncTypes, func(t string) bool {
+			_, ok := current[rec.Name+"\t"+t]
+			return ok
+		})
+		if !taken {
+			claim[rec.Name] = true
+		} else if _, warned := claim[rec.Name]; !warned {
+			slog.WarnContext(ctx, "route53 name has records that are not ours, not publishing it", "zone", r.zoneID, "name", rec.Name)
+			claim[rec.Name] = false
+		}
+	}
+	want = slices.DeleteFunc(slices.Clone(want), func(rec publicRecord) bool {
+		_, ok := owned[rec.Name]
+		return !ok && !claim[rec.Name]
+	})
+	add, remove := diffPublic(have, want)
+
+	// Sets are replaced as a whole: every one touched gets what we want in
+	// it, or is deleted if that is nothing
+	var changes []route53Change
+	ttlSeconds := int64(ttl.Seconds())
+	for _, name := range slices.Sorted(maps.Keys(claim)) {
+		if claim[name] {
+			changes = append(changes, route53Change{"CREATE", route53RRSet{Name: route53OwnerPrefix + name + ".", Type: "TXT", TTL: ttlSeconds, ResourceRecords: []string{owner}}})
+		}
+	}
+	wanted := map[string][]string{}
+	for _, rec := range want {
+		key := rec.Name + "\t" + rec.Type
+		wanted[key] = append(wanted[key], route53Value(rec.Type, rec.Value))
+	}
+	touched := map[string]bool{}
+	for _, rec := range slices.Concat(add, remove) {
+		touched[rec.Name+"\t"+rec.Type] = true
+	}
+	for _, key := range slices.Sorted(maps.Keys(touched)) {
+		name, rtype, _ := strings.Cut(key, "\t")
+		if values := wanted[key]; len(values) > 0 {
+			slices.Sort(values)
+			changes = append(changes, route53Change{"UPSERT", route53RRSet{Name: name + ".", Type: rtype, TTL: ttlSeconds, ResourceRecords: values}})
+		} else {
+			changes = append(changes, route53Change{"DELETE", current[key]})
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(owned)) {
+		if !slices.ContainsFunc(want, func(rec publicRecord) bool { return rec.Name == name }) {
+			changes = append(changes, route53Change{"DELETE", owned[name]})
+		}
+	}
+	if len(changes) == 0 {
+		return 0, 0, nil
+	}
+
+	var batch struct {
+		XMLName xml.Name        `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+		Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+	}
+	batch.Changes = changes
+	body, err := xml.Marshal(batch)
+	if err != nil {
+		return 0, 0, err
+	}
+	var resp struct{}
+	if err := r.call(ctx, "POST", "/2013-04-01/hostedzone/"+url.PathEscape(r.zoneID)+"/rrset", append([]byte(xml.Header), body...), &resp); err != nil {
+		return 0, 0, err
+	}
+	return len(add), len(remove), nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client networks that share a response budget. Spoofed floods typically
+// vary the low bits of the source, and a victim network is one target.
+const (
+	rrlIPv4Prefix = 24
+	rrlIPv6Prefix = 56
+)
+
+type rrlAction int
+
+const (
+	rrlSend rrlAction = iota
+	rrlDrop
+	rrlSlip // send a truncated answer instead
+)
+
+// rrlKey identifies a stream of identical responses to one client network.
+// Errors are keyed by RCODE alone, so random subdomains cannot each get a
+// fresh budget for NXDOMAIN.
+type rrlKey struct {
+	network netip.Prefix
+	name    string
+	qtype   uint16
+	rcode   byte
+}
+
+// RRL is DNS Response Rate Limiting: it caps how many identical responses
+// each client network receives per second over UDP, which is what makes an
+// open resolver useful for reflection attacks. Over-limit responses are
+// dropped, except every slip-th one is sent truncated so a real client
+// behind a spoofed flood can still get through over TCP.
+type RRL struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	slip      int
+	buckets   map[rrlKey]*rrlBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type rrlBucket struct {
+	tokenBucket
+	dropped int
+}
+
+// NewRRL allows rate identical responses per second to each client
+// network, in bursts of up to one second's worth. The burst is at least
+// one response, so a rate below 1 still lets some through.
+func NewRRL(rate float64, slip int) *RRL {
+	return &RRL{
+		rate:    rate,
+		burst:   max(rate, 1),
+		slip:    slip,
+		buckets: make(map[rrlKey]*rrlBucket),
+		now:     time.Now,
+	}
+}
+
+// Check decides what to do with resp, a response about to be sent to client.
+func (r *RRL) Check(client netip.Addr, resp []byte) rrlAction {
+	key, ok := rrlKeyFor(client, resp)
+	if !ok {
+		return rrlSend
+	}
+	now := r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.Sub(r.lastSweep) >= rateLimitSweep {
+		for k, b := range r.buckets {
+			if b.full(now, r.rate, r.burst) {
+				delete(r.buckets, k)
+			}
+		}
+		r.lastSweep = now
+	}
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &rrlBucket{tokenBucket: tokenBucket{tokens: r.burst, last: now}}
+		r.buckets[key] = b
+	}
+	if b.take(now, r.rate, r.burst) {
+		return rrlSend
+	}
+	if !b.limited {
+		b.limited = true
+		slog.Warn("response rate limit engaged", "network", key.network, "name", key.name, "type", typeString(key.qtype), "rcode", rcodeString(int(key.rcode)))
+	}
+	b.dropped++
+	if r.slip > 0 && b.dropped%r.slip == 0 {
+		return rrlSlip
+	}
+	return rrlDrop
+}
+
+func rrlKeyFor(client netip.Addr, resp []byte) (rrlKey, bool) {
+	if len(resp) < 12 {
+		return rrlKey{}, false
+	}
+	client = client.Unmap()
+	bits := rrlIPv4Prefix
+	if client.Is6() {
+		bits = rrlIPv6Prefix
+	}
+	network, err := client.Prefix(bits)
+	if err != nil {
+		return rrlKey{}, false
+	}
+	key := rrlKey{network: network, rcode: resp[3] & 0x0F}
+	if key.rcode != 0 {
+		return key, true
+	}
+	name, offset := parseDNSName(resp, 12)
+	if offset < 0 || offset+4 > len(resp) {
+		return rrlKey{}, false
+	}
+	key.name = strings.ToLower(name)
+	key.qtype = binary.BigEndian.Uint16(resp[offset:])
+	return key, true
+}
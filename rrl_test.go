@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRRL(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	r := NewRRL(2, 2)
+	r.now = func() time.Time { return now }
+
+	answer := func(name string) []byte {
+		q := buildTestQuery(name, 1, 1)
+		return buildDNSResponse(q, len(q), []Record{{Domain: name, Type: "A", Value: "10.0.0.1"}})
+	}
+	nxdomain := func(name string) []byte {
+		q := buildTestQuery(name, 1, 1)
+		return buildNXDomain(q, len(q))
+	}
+	a := netip.MustParseAddr("192.0.2.1")
+	b := netip.MustParseAddr("192.0.2.200") // same /24
+	other := netip.MustParseAddr("198.51.100.1")
+
+	if r.Check(a, answer("x.test")) != rrlSend || r.Check(b, answer("x.test")) != rrlSend {
+		t.Fatal("responses within the rate were limited")
+	}
+	// The /24 has used its budget: drop, slip, drop, slip...
+	want := []rrlAction{rrlDrop, rrlSlip, rrlDrop, rrlSlip}
+	for i, w := range want {
+		if got := r.Check(a, answer("x.test")); got != w {
+			t.Errorf("over-limit response %d = %v, want %v", i, got, w)
+		}
+	}
+	if r.Check(a, answer("y.test")) != rrlSend {
+		t.Error("a different answer must have its own budget")
+	}
+	if r.Check(other, answer("x.test")) != rrlSend {
+		t.Error("a different network must have its own budget")
+	}
+
+	// NXDOMAINs for random names share one budget
+	for i := range 2 {
+		if r.Check(other, nxdomain(fmt.Sprintf("r%d.test", i))) != rrlSend {
+			t.Fatal("NXDOMAIN within the rate was limited")
+		}
+	}
+	if r.Check(other, nxdomain("r9.test")) == rrlSend {
+		t.Error("random-name NXDOMAINs escaped the limit")
+	}
+
+	now = now.Add(time.Second)
+	if r.Check(a, answer("x.test")) != rrlSend {
+		t.Error("budget did not refill")
+	}
+
+	// Below one response per second a burst still holds one
+	slow := NewRRL(0.5, 0)
+	slow.now = r.now
+	if slow.Check(a, answer("x.test")) != rrlSend {
+		t.Error("a rate below 1 limited the first response")
+	}
+	if slow.Check(a, answer("x.test")) != rrlDrop {
+		t.Error("a rate below 1 sent a second response at once")
+	}
+	now = now.Add(2 * time.Second)
+	if slow.Check(a, answer("x.test")) != rrlSend {
+		t.Error("a rate below 1 did not refill")
+	}
+}
+
+func TestDNSMaxUDPResponse(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 40 {
+		store.Add(Record{Domain: "big.test", Type: "A", Value: fmt.Sprintf("10.0.0.%d", i+1)})
+	}
+	store.Add(Record{Domain: "small.test", Type: "A", Value: "10.0.1.1"})
+	dns := NewDNSServer(store, nil)
+	dns.maxUDPResponse = 512
+	addr := startDNSServer(t, dns)
+
+	if resp := exchange(t, addr, buildTestQuery("small.test", 1, 1)); resp[2]&0x02 != 0 || resp[7] != 1 {
+		t.Errorf("small answer: flags=%#x ancount=%d", resp[2], resp[7])
+	}
+	resp := exchange(t, addr, buildTestQuery("big.test", 1, 1))
+	if len(resp) > 512 || resp[2]&0x02 == 0 {
+		t.Errorf("big answer: %d bytes, flags=%#x; want truncated", len(resp), resp[2])
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const jobHistorySize = 10
+
+// Schedule computes the next activation time after a given instant.
+type Schedule interface {
+	Next(time.Time) time.Time
+}
+
+type everySchedule struct {
+	interval time.Duration
+}
+
+func (e everySchedule) Next(t time.Time) time.Time {
+	return t.Add(e.interval)
+}
+
+// cronSchedule is a standard five-field cron expression
+// (minute hour day-of-month month day-of-week) stored as bitsets.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+var cronAliases = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// parseSchedule accepts a five-field cron expression, one of the @hourly style
+// aliases, or "@every <duration>".
+func parseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if rest, ok := strings.CutPrefix(spec, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval %q: %w", rest, err)
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("interval %s is too short", d)
+		}
+		return everySchedule{interval: d}, nil
+	}
+	if alias, ok := cronAliases[spec]; ok {
+		spec = alias
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields in %q, got %d", spec, len(fields))
+	}
+
+	var c cronSchedule
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	// 7 is an alias for Sunday
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar = fields[2] == "*"
+	c.dowStar = fields[4] == "*"
+	return c, nil
+}
+
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if base, s, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", s)
+			}
+			step = n
+			part = base
+		}
+
+		start, end := lo, hi
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			a, b, _ := strings.Cut(part, "-")
+			var err1, err2 error
+			start, err1 = strconv.Atoi(a)
+			end, err2 = strconv.Atoi(b)
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			start, end = n, n
+			if step > 1 {
+				end = hi
+			}
+		}
+		if start < lo || end > hi || start > end {
+			return 0, fmt.Errorf("value out of range %q (%d-%d)", part, lo, hi)
+		}
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func (c cronSchedule) dayMatches(t time.Time) bool {
+	domOk := c.dom&(1<<uint(t.Day())) != 0
+	dowOk := c.dow&(1<<uint(t.Weekday())) != 0
+	// Classic cron: when both day fields are restricted, either may match
+	if !c.domStar && !c.dowStar {
+		return domOk || dowOk
+	}
+	return domOk && dowOk
+}
+
+func (c cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Five years covers every satisfiable expression, including Feb 29
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// JobRun records the outcome of a single job execution.
+type JobRun struct {
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+	Error    string    `json:"error,omitempty"`
+	Result   string    `json:"result,omitempty"` // what a report job found
+}
+
+// JobStatus is the externally visible state of a scheduled job.
+type JobStatus struct {
+	Name     string    `json:"name"`
+	Schedule string    `json:"schedule"`
+	Jitter   string    `json:"jitter,omitempty"`
+	Running  bool      `json:"running"`
+	NextRun  time.Time `json:"next_run"`
+	History  []JobRun  `json:"history"`
+}
+
+type job struct {
+	name     string
+	spec     string
+	schedule Schedule
+	jitter   time.Duration
+	run      func(context.Context) (string, error)
+	trigger  chan struct{}
+
+	running bool
+	nextRun time.Time
+	history []JobRun
+}
+
+// Scheduler runs named background jobs on cron-like schedules, adding a
+// random jitter to each activation so a fleet of instances doesn't hit the
+// same remote source at the same second.
+type Scheduler struct {
+	mu   sync.Mutex
+	jobs []*job
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{}
+}
+
+// Add registers a job. It must be called before Run.
+func (s *Scheduler) Add(name, spec string, jitter time.Duration, run func(context.Context) error) error {
+	return s.AddReport(name, spec, jitter, func(ctx context.Context) (string, error) {
+		return "", run(ctx)
+	})
+}
+
+// AddReport registers a job whose result is kept in its history, for jobs
+// that report on something rather than change it. It must be called before
+// Run.
+func (s *Scheduler) AddReport(name, spec string, jitter time.Duration, run func(context.Context) (string, error)) error {
+	sched, err := parseSchedule(spec)
+	if err != nil {
+		return fmt.Errorf("job %s: %w", name, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.name == name {
+			return fmt.Errorf("job %s already registered", name)
+		}
+	}
+	s.jobs = append(s.jobs, &job{
+		name:     name,
+		spec:     spec,
+		schedule: sched,
+		jitter:   jitter,
+		run:      run,
+		trigger:  make(chan struct{}, 1),
+	})
+	return nil
+}
+
+// Run starts every registered job and blocks until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	jobs := make([]*job, len(s.jobs))
+	copy(jobs, s.jobs)
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Go(func() { s.loop(ctx, j) })
+	}
+	wg.Wait()
+}
+
+// Trigger runs the named job immediately, outside its schedule.
+func (s *Scheduler) Trigger(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.name == name {
+			select {
+			case j.trigger <- struct{}{}:
+			default:
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Scheduler) loop(ctx context.Context, j *job) {
+	for {
+		next := j.schedule.Next(time.Now())
+		if next.IsZero() {
+			slog.Warn("job schedule never fires", "job", j.name, "schedule", j.spec)
+			return
+		}
+		if j.jitter > 0 {
+			next = next.Add(rand.N(j.jitter))
+		}
+		s.mu.Lock()
+		j.nextRun = next
+		s.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-j.trigger:
+			timer.Stop()
+		}
+		s.execute(ctx, j)
+	}
+}
+
+func (s *Scheduler) execute(ctx context.Context, j *job) {
+	s.mu.Lock()
+	j.running = true
+	s.mu.Unlock()
+
+	start := time.Now()
+	result, err := j.run(ctx)
+	elapsed := time.Since(start)
+
+	run := JobRun{Started: start, Duration: elapsed.Round(time.Millisecond).String(), Result: result}
+	if err != nil {
+		run.Error = err.Error()
+		slog.Warn("job failed", "job", j.name, "duration", elapsed, "error", err)
+	} else {
+		slog.Debug("job finished", "job", j.name, "duration", elapsed)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.running = false
+	j.history = append(j.history, run)
+	if len(j.history) > jobHistorySize {
+		j.history = j.history[len(j.history)-jobHistorySize:]
+	}
+}
+
+// Status returns a snapshot of every job, most recent run last.
+func (s *Scheduler) Status() []JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		st := JobStatus{
+			Name:     j.name,
+			Schedule: j.spec,
+			Running:  j.running,
+			NextRun:  j.nextRun,
+			History:  make([]JobRun, len(j.history)),
+		}
+		if j.jitter > 0 {
+			st.Jitter = j.jitter.String()
+		}
+		copy(st.History, j.history)
+		result = append(result, st)
+	}
+	return result
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	base := time.Date(2025, 3, 14, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2025, 3, 14, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, 3, 14, 10, 15, 0, 0, time.UTC)},
+		{"0 */6 * * *", time.Date(2025, 3, 14, 12, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2025, 3, 15, 2, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2025, 3, 17, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2025, 3, 16, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2025, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", base.Add(90 * time.Second)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			sched, err := parseSchedule(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sched.Next(base); !got.Equal(tt.want) {
+				t.Errorf("Next = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "*/0 * * * *", "5-1 * * * *", "@every 10ms", "@every soon"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("parseSchedule(%q) expected error", spec)
+		}
+	}
+}
+
+func TestSchedulerTriggerAndStatus(t *testing.T) {
+	s := NewScheduler()
+	ran := make(chan struct{}, 1)
+	err := s.Add("refresh", "@every 1h", time.Second, func(ctx context.Context) error {
+		ran <- struct{}{}
+		return errors.New("source unreachable")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add("refresh", "@hourly", 0, nil); err == nil {
+		t.Error("expected error registering duplicate job")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	if s.Trigger("missing") {
+		t.Error("Trigger of unknown job should fail")
+	}
+	if !s.Trigger("refresh") {
+		t.Fatal("Trigger of known job failed")
+	}
+	select {
+	case <-ran:
+	case <-time.After(2 * time.Second):
+		t.Fatal("job did not run after trigger")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		st := s.Status()
+		if len(st) == 1 && len(st[0].History) == 1 {
+			if st[0].History[0].Error != "source unreachable" {
+				t.Errorf("history error = %q", st[0].History[0].Error)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("history not recorded: %+v", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSchedulerReportResult(t *testing.T) {
+	s := NewScheduler()
+	if err := s.AddReport("report", "@every 1h", 0, func(context.Context) (string, error) {
+		return "2 stale: disabled a.lan, disabled b.lan", nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	s.Trigger("report")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if st := s.Status(); len(st[0].History) == 1 {
+			if got := st[0].History[0].Result; got != "2 stale: disabled a.lan, disabled b.lan" {
+				t.Errorf("history result = %q", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("history not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebJobs(t *testing.T) {
+	ws, _ := testWebServer(t)
+	ws.jobs = NewScheduler()
+	ws.jobs.Add("backup", "@daily", 0, func(context.Context) error { return nil })
+
+	req := httptest.NewRequest("GET", "/api/jobs", nil)
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+
+	var jobs []JobStatus
+	json.NewDecoder(w.Body).Decode(&jobs)
+	if len(jobs) != 1 || jobs[0].Name != "backup" {
+		t.Fatalf("jobs = %+v, want backup", jobs)
+	}
+
+	req = httptest.NewRequest("POST", "/api/jobs/nope/run", nil)
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Errorf("status = %d, want 404", w.Code)
+	}
+}
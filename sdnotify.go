@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+)
+
+// sdNotify sends state, such as "READY=1", to the service manager when it
+// started us with a notification socket, as systemd does for Type=notify
+// units. Without one it does nothing. Names starting with @ are in the
+// abstract namespace, which the net package handles.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// readiness calls sdNotify with READY=1 once each of n listeners has
+// called the returned function, so dependent units start only when every
+// address answers.
+func readiness(n int) func() {
+	var pending atomic.Int32
+	pending.Store(int32(n))
+	return func() {
+		if pending.Add(-1) != 0 {
+			return
+		}
+		if err := sdNotify("READY=1\nSTATUS=Serving"); err != nil {
+			slog.Warn("failed to notify systemd", "error", err)
+		}
+	}
+}
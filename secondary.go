@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSecondarySchedule = "@every 5m"
+	transferTimeout          = time.Minute
+)
+
+type secondaryZone struct {
+	zone    string
+	primary string // host:port
+	loaded  bool
+	serial  uint32
+	expire  time.Duration // from the primary's SOA
+	lastOK  time.Time     // last time the primary answered
+}
+
+// Secondary mirrors zones from primaries with AXFR and serves them as
+// read-only source records next to our own. The primary's SOA serial is
+// polled on a schedule and a transfer only happens when it moved; a NOTIFY
+// from anywhere triggers an early poll. If the primary stays unreachable for
+// longer than its SOA expire timer, the zone is dropped.
+type Secondary struct {
+	store   *Store
+	zones   []*secondaryZone
+	key     string       // TSIG key to sign requests with ("" sends them unsigned)
+	keys    *TSIGKeyring // looked up on every transfer, so a changed secret applies at once
+	trigger func()       // asks for an immediate Refresh
+	now     func() time.Time
+
+	mu sync.Mutex // serializes refreshes
+}
+
+// NewSecondary parses zone=host[:port] specs. key names the TSIG key in
+// keys, if any, to sign transfer requests with.
+func NewSecondary(store *Store, specs []string, key string, keys *TSIGKeyring) (*Secondary, error) {
+	s := &Secondary{store: store, keys: keys, trigger: func() {}, now: time.Now}
+	if key != "" {
+		s.key = tsigKeyName(key)
+		if keys == nil || keys.Keys()[s.key] == nil {
+			return nil, fmt.Errorf("unknown tsig key %q", key)
+		}
+	}
+	for _, spec := range specs {
+		zone, primary, ok := strings.Cut(spec, "=")
+		zone = strings.ToLower(strings.Trim(strings.TrimSpace(zone), "."))
+		if !ok || zone == "" || primary == "" {
+			return nil, fmt.Errorf("invalid secondary zone %q, want zone=host[:port]", spec)
+		}
+		if _, _, err := net.SplitHostPort(primary); err != nil {
+			primary = net.JoinHostPort(primary, "53")
+		}
+		s.zones = append(s.zones, &secondaryZone{zone: zone, primary: primary})
+	}
+	return s, nil
+}
+
+func (s *Secondary) source(z *secondaryZone) string {
+	return "secondary:" + z.zone
+}
+
+// Refresh brings every zone up to date. It is the scheduled job's entry
+// point; one zone failing does not stop the others.
+func (s *Secondary) Refresh(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, z := range s.zones {
+		if err := s.refreshZone(ctx, z); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", z.zone, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Secondary) refreshZone(ctx context.Context, z *secondaryZone) error {
+	ctx, cancel := context.WithTimeout(ctx, transferTimeout)
+	defer cancel()
+
+	serial, _, err := s.querySOA(ctx, z)
+	if err != nil {
+		if z.loaded && z.expire > 0 && s.now().Sub(z.lastOK) > z.expire {
+			s.store.SetSource(s.source(z), nil)
+			z.loaded = false
+			slog.WarnContext(ctx, "secondary zone expired", "zone", z.zone, "primary", z.primary)
+		}
+		return err
+	}
+	z.lastOK = s.now()
+	if z.loaded && !serialNewer(serial, z.serial) {
+		return nil
+	}
+
+	records, serial, expire, err := s.transfer(ctx, z)
+	if err != nil {
+		return err
+	}
+	s.store.SetSource(s.source(z), records)
+	z.loaded, z.serial, z.expire = true, serial, expire
+	slog.InfoContext(ctx, "secondary zone transferred", "zone", z.zone, "primary", z.primary, "serial", serial, "records", len(records))
+	return nil
+}
+
+// serialNewer compares SOA serials with the wraparound of RFC 1982.
+func serialNewer(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// exchange sends a query to the primary over TCP and passes every response
+// message to each until it reports the response is complete. Transfers are
+// signed when a key is configured; SOA queries are public and go unsigned.
+func (s *Secondary) exchange(ctx context.Context, z *secondaryZone, qtype uint16, each func(msg []byte) (bool, error)) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", z.primary)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	query := buildQuery(z.zone, qtype)
+	query[2] = 0 // no recursion
+	var verify *tsigVerifier
+	if s.key != "" && qtype == 252 {
+		secret := s.keys.Keys()[s.key]
+		if secret == nil {
+			return fmt.Errorf("tsig key %q no longer exists", s.key)
+		}
+		query = signTSIG(query, s.key, secret, s.now())
+		_, sig, _ := splitTSIG(query)
+		verify = &tsigVerifier{secret: secret, prevMAC: sig.mac}
+	}
+	if err := writeTCPMessage(conn, query); err != nil {
+		return err
+	}
+	for {
+		msg, err := readTCPMessage(conn)
+		if err != nil {
+			return err
+		}
+		if len(msg) < 12 || msg[0] != query[0] || msg[1] != query[1] || msg[2]&0x80 == 0 {
+			return errMismatch
+		}
+		if verify != nil {
+			if err := verify.check(msg); err != nil {
+				return err
+			}
+		}
+		if rcode := msg[3] & 0x0F; rcode != 0 {
+			return fmt.Errorf("primary answered %s", rcodeString(int(rcode)))
+		}
+		done, err := each(msg)
+		if err != nil || done {
+			if err == nil && verify != nil {
+				err = verify.done()
+			}
+			return err
+		}
+	}
+}
+
+func (s *Secondary) querySOA(ctx context.Context, z *secondaryZone) (serial uint32, expire time.Duration, err error) {
+	found := false
+	err = s.exchange(ctx, z, 6, func(msg []byte) (bool, error) {
+		return true, eachAnswer(msg, func(rr rawRR) error {
+			if rr.Type == 6 && !found && strings.EqualFold(strings.TrimSuffix(rr.Name, "."), z.zone) {
+				serial, expire, found = soaTimers(msg, rr)
+			}
+			return nil
+		})
+	})
+	if err == nil && !found {
+		err = errors.New("primary has no SOA for the zone")
+	}
+	return serial, expire, err
+}
+
+// transfer runs an AXFR and returns the records of types we store; the rest
+// are counted and skipped.
+func (s *Secondary) transfer(ctx context.Context, z *secondaryZone) (records []Record, serial uint32, expire time.Duration, err error) {
+	soas, skipped := 0, 0
+	err = s.exchange(ctx, z, 252, func(msg []byte) (bool, error) {
+		err := eachAnswer(msg, func(rr rawRR) error {
+			name := strings.ToLower(strings.TrimSuffix(rr.Name, "."))
+			if soas == 2 {
+				return errors.New("records after the closing SOA")
+			}
+			if rr.Type == 6 {
+				if soas++; soas == 1 {
+					serial, expire, _ = soaTimers(msg, rr)
+				}
+				return nil
+			}
+			if soas == 0 {
+				return errors.New("transfer does not start with the SOA")
+			}
+			value, ok := rdataValue(msg, rr)
+			if !ok || !inZone(name, z.zone) {
+				skipped++
+				return nil
+			}
+			records = append(records, Record{Domain: name, Type: typeString(rr.Type), Value: value})
+			return nil
+		})
+		return soas == 2, err
+	})
+	if skipped > 0 {
+		slog.DebugContext(ctx, "secondary zone records skipped", "zone", z.zone, "skipped", skipped)
+	}
+	return records, serial, expire, err
+}
+
+// eachAnswer calls fn for every record in the answer section of msg.
+func eachAnswer(msg []byte, fn func(rawRR) error) error {
+	off := 12
+	for range binary.BigEndian.Uint16(msg[4:6]) {
+		if off = skipDNSName(msg, off); off < 0 || off+4 > len(msg) {
+			return errMalformed
+		}
+		off += 4
+	}
+	for range binary.BigEndian.Uint16(msg[6:8]) {
+		rr, next, err := readRR(msg, off)
+		if err != nil {
+			return err
+		}
+		if err := fn(rr); err != nil {
+			return err
+		}
+		off = next
+	}
+	return nil
+}
+
+// soaTimers reads the serial and expire fields of an SOA record.
+func soaTimers(msg []byte, rr rawRR) (uint32, time.Duration, bool) {
+	off := skipDNSName(msg, rr.RData)
+	if off >= 0 {
+		off = skipDNSName(msg, off)
+	}
+	if off < 0 || off+20 > rr.RData+rr.RDLen {
+		return 0, 0, false
+	}
+	serial := binary.BigEndian.Uint32(msg[off:])
+	expire := time.Duration(binary.BigEndian.Uint32(msg[off+12:])) * time.Second
+	return serial, expire, true
+}
+
+// HandleNotify acknowledges a NOTIFY for one of our zones and triggers a
+// refresh. The sender is not checked: a refresh only asks the configured
+// primary whether anything changed.
+func (s *Secondary) HandleNotify(msg []byte, client netip.Addr) []byte {
+	name, off := parseDNSName(msg, 12)
+	if binary.BigEndian.Uint16(msg[4:6]) != 1 || off < 0 || off+4 > len(msg) {
+		return nil
+	}
+	zone := strings.ToLower(strings.TrimSuffix(name, "."))
+	resp := make([]byte, 12, off+4)
+	copy(resp, msg[:4])
+	resp[2] = 0x80 | opcodeNotify<<3 | 0x04 // QR=1 AA=1
+	resp[3] = rcodeNotAuth
+	resp[5] = 1
+	resp = append(resp, msg[12:off+4]...)
+	for _, z := range s.zones {
+		if z.zone == zone {
+			resp[3] = 0
+			slog.Info("notify received", "zone", zone, "client", client)
+			s.trigger()
+			break
+		}
+	}
+	return resp
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecondaryRefresh(t *testing.T) {
+	x, primaryStore := newTestTransfers(t)
+	x.allow = nil // TSIG only
+	primary := NewDNSServer(primaryStore, nil)
+	primary.transfers = x
+	addr := startDNSServer(t, primary)
+
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Record{Domain: "nas.home.lan", Type: "A", Value: "192.168.1.5"})
+	s, err := NewSecondary(store, []string{"my.lan=" + addr}, "xfr", x.keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := s.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	recs, ok := store.Resolve("www.my.lan", 1)
+	if !ok || len(recs) != 2 || recs[1].Value != "10.0.0.2" || recs[0].Source != "secondary:my.lan" {
+		t.Fatalf("www.my.lan after transfer = %+v", recs)
+	}
+	if recs, _ := store.Resolve("nas.home.lan", 1); len(recs) != 1 {
+		t.Error("own records lost after transfer")
+	}
+
+	// A new serial on the primary is picked up by the next refresh
+	primaryStore.Add(Record{Domain: "db.my.lan", Type: "AAAA", Value: "fd00::5"})
+	if err := s.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if recs, _ := store.Resolve("db.my.lan", 28); len(recs) != 1 {
+		t.Errorf("db.my.lan after second transfer = %+v", recs)
+	}
+	if s.zones[0].serial != primaryStore.Serial() {
+		t.Errorf("serial = %d, want %d", s.zones[0].serial, primaryStore.Serial())
+	}
+
+	// Without the key the primary refuses
+	unsigned, _ := NewSecondary(store, []string{"my.lan=" + addr}, "", nil)
+	if err := unsigned.Refresh(ctx); err == nil {
+		t.Error("unsigned transfer succeeded")
+	}
+	wrong, _ := NewSecondary(store, []string{"my.lan=" + addr}, "xfr", newStaticTSIGKeyring(TSIGKeys{"xfr": []byte("wrong")}))
+	if err := wrong.Refresh(ctx); err == nil {
+		t.Error("transfer with the wrong secret succeeded")
+	}
+
+	// Replacing the secret through the keyring applies without a restart
+	wrong.keys.Delete("xfr")
+	if _, err := wrong.keys.Create("xfr", x.keys.Keys()["xfr"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := wrong.Refresh(ctx); err != nil {
+		t.Errorf("transfer after replacing the secret: %v", err)
+	}
+}
+
+func TestSecondaryNotify(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSecondary(store, []string{"my.lan=10.0.0.53"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.zones[0].primary != "10.0.0.53:53" {
+		t.Errorf("primary = %q", s.zones[0].primary)
+	}
+	triggered := 0
+	s.trigger = func() { triggered++ }
+
+	client := netip.MustParseAddr("10.0.0.53")
+	resp := s.HandleNotify(buildNotify("my.lan", 7), client)
+	if resp[2]&0x80 == 0 || resp[3]&0x0F != 0 || triggered != 1 {
+		t.Errorf("notify for our zone: response % x, triggered %d", resp, triggered)
+	}
+	resp = s.HandleNotify(buildNotify("other.lan", 7), client)
+	if resp[3]&0x0F != rcodeNotAuth || triggered != 1 {
+		t.Errorf("notify for another zone: response % x, triggered %d", resp, triggered)
+	}
+
+	if _, err := NewSecondary(store, []string{"my.lan"}, "", nil); err == nil {
+		t.Error("accepted a zone without a primary")
+	}
+	if !serialNewer(1, 0xFFFFFFF0) || serialNewer(5, 5) || serialNewer(4, 5) {
+		t.Error("serialNewer does not follow RFC 1982")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Files setup writes, relative to the filesystem root, and the link it
+// points /etc/resolv.conf at while systemd-resolved's stub is off.
+const (
+	resolvedDropIn   = "etc/systemd/resolved.conf.d/regieleki.conf"
+	nmDropIn         = "etc/NetworkManager/conf.d/regieleki.conf"
+	resolvConfPath   = "etc/resolv.conf"
+	resolvedUplinks  = "/run/systemd/resolve/resolv.conf"
+	setupHeader      = "# Written by regieleki setup; remove with regieleki setup -undo\n"
+	setupLinkComment = "# resolv.conf was "
+)
+
+// resolverSetup points the host's resolver at the local server, through
+// whichever of systemd-resolved and NetworkManager manages it. Everything
+// it writes is a drop-in of its own, so undoing is removing them.
+type resolverSetup struct {
+	root   string // prepended to every path; tests use a temp dir
+	dryRun bool
+	out    io.Writer
+	// run restarts services; tests replace it
+	run func(name string, args ...string) error
+}
+
+func runCommand(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+func (s *resolverSetup) path(rel string) string {
+	return filepath.Join(s.root, "/", rel)
+}
+
+// detect picks the resolver manager in charge: systemd-resolved when it
+// runs, since NetworkManager then hands DNS to it, else NetworkManager.
+func (s *resolverSetup) detect() (string, error) {
+	if _, err := os.Stat(s.path("run/systemd/resolve")); err == nil {
+		return "resolved", nil
+	}
+	if _, err := os.Stat(s.path("run/NetworkManager")); err == nil {
+		return "networkmanager", nil
+	}
+	return "", errors.New("neither systemd-resolved nor NetworkManager is running; put nameserver lines for the server in /etc/resolv.conf by hand")
+}
+
+// apply makes method send the host's lookups to addr.
+func (s *resolverSetup) apply(method string, addr netip.Addr) error {
+	switch method {
+	case "resolved":
+		// The stub listener would hold port 53 on 127.0.0.53, so it is
+		// turned off and resolv.conf lists the servers directly
+		conf := setupHeader
+		link, _ := os.Readlink(s.path(resolvConfPath))
+		relink := strings.HasSuffix(link, "stub-resolv.conf")
+		if relink {
+			conf += setupLinkComment + link + "\n"
+		}
+		conf += "[Resolve]\nDNS=" + addr.String() + "\nDomains=~.\nDNSStubListener=no\n"
+		if err := s.write(resolvedDropIn, conf); err != nil {
+			return err
+		}
+		if relink {
+			if err := s.symlink(resolvedUplinks, resolvConfPath); err != nil {
+				return err
+			}
+		}
+		return s.restart("restart", "systemd-resolved")
+	case "networkmanager":
+		conf := setupHeader + "[global-dns-domain-*]\nservers=" + addr.String() + "\n"
+		if err := s.write(nmDropIn, conf); err != nil {
+			return err
+		}
+		return s.restart("reload", "NetworkManager")
+	}
+	return fmt.Errorf("unknown method %q, want resolved or networkmanager", method)
+}
+
+// undo removes the drop-ins apply wrote and restores resolv.conf. Files
+// without our header are left alone.
+func (s *resolverSetup) undo() error {
+	undone := false
+	if data, ok := s.ours(resolvedDropIn); ok {
+		if err := s.remove(resolvedDropIn); err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if link, ok := strings.CutPrefix(line, setupLinkComment); ok {
+				if cur, _ := os.Readlink(s.path(resolvConfPath)); cur == resolvedUplinks {
+					if err := s.symlink(link, resolvConfPath); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if err := s.restart("restart", "systemd-resolved"); err != nil {
+			return err
+		}
+		undone = true
+	}
+	if _, ok := s.ours(nmDropIn); ok {
+		if err := s.remove(nmDropIn); err != nil {
+			return err
+		}
+		if err := s.restart("reload", "NetworkManager"); err != nil {
+			return err
+		}
+		undone = true
+	}
+	if !undone {
+		fmt.Fprintln(s.out, "nothing to undo")
+	}
+	return nil
+}
+
+func (s *resolverSetup) ours(rel string) ([]byte, bool) {
+	data, err := os.ReadFile(s.path(rel))
+	return data, err == nil && bytes.HasPrefix(data, []byte(setupHeader))
+}
+
+func (s *resolverSetup) write(rel, content string) error {
+	path := s.path(rel)
+	fmt.Fprintf(s.out, "write %s\n", path)
+	if s.dryRun {
+		fmt.Fprint(s.out, indent(content))
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// World-readable, since the resolvers read it as unprivileged users
+	return os.WriteFile(path, []byte(content), 0o644)
+}
+
+func (s *resolverSetup) remove(rel string) error {
+	path := s.path(rel)
+	fmt.Fprintf(s.out, "remove %s\n", path)
+	if s.dryRun {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+func (s *resolverSetup) symlink(target, rel string) error {
+	path := s.path(rel)
+	fmt.Fprintf(s.out, "link %s -> %s\n", path, target)
+	if s.dryRun {
+		return nil
+	}
+	tmp := path + ".regieleki"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *resolverSetup) restart(action, unit string) error {
+	fmt.Fprintf(s.out, "systemctl %s %s\n", action, unit)
+	if s.dryRun {
+		return nil
+	}
+	return s.run("systemctl", action, unit)
+}
+
+func indent(s string) string {
+	return "    " + strings.ReplaceAll(strings.TrimSuffix(s, "\n"), "\n", "\n    ") + "\n"
+}
+
+func handleSetup(args []string) {
+	fs := flag.NewFlagSet("setup", flag.ExitOnError)
+	addrFlag := fs.String("addr", "127.0.0.1", "Address the server answers on, for the host to send its lookups to")
+	method := fs.String("method", "auto", "Resolver manager to configure: auto, resolved or networkmanager")
+	undo := fs.Bool("undo", false, "Remove what setup wrote and restore the previous resolver configuration")
+	dryRun := fs.Bool("dry-run", false, "Print the changes without making them")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: regieleki setup [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	s := &resolverSetup{dryRun: *dryRun, out: os.Stdout, run: runCommand}
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		if errors.Is(err, os.ErrPermission) {
+			fmt.Fprintln(os.Stderr, "setup changes system files; run it as root")
+		}
+		os.Exit(1)
+	}
+	if *undo {
+		if err := s.undo(); err != nil {
+			fail(err)
+		}
+		return
+	}
+
+	addr, err := netip.ParseAddr(*addrFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: invalid -addr: %v\n", err)
+		os.Exit(2)
+	}
+	if *method == "auto" {
+		if *method, err = s.detect(); err != nil {
+			fail(err)
+		}
+	}
+	// Read before the change, while resolv.conf still names the real ones
+	upstreams := s.uplinks()
+	if err := s.apply(*method, addr); err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(s.out, "\nThis host now resolves through %s. resolv.conf no longer names the servers to forward to, so run regieleki with -upstream", addr)
+	if len(upstreams) > 0 {
+		fmt.Fprint(s.out, ", e.g. -upstream "+strings.Join(upstreams, " -upstream "))
+	}
+	fmt.Fprintln(s.out, ".")
+}
+
+// uplinks lists the nameservers the host uses now, behind any local stub:
+// systemd-resolved's uplinks if it runs, else those in resolv.conf.
+func (s *resolverSetup) uplinks() []string {
+	for _, rel := range []string{resolvedUplinks, resolvConfPath} {
+		data, err := os.ReadFile(s.path(rel))
+		if err != nil {
+			continue
+		}
+		var servers []string
+		for _, line := range strings.Split(string(data), "\n") {
+			f := strings.Fields(line)
+			if len(f) < 2 || f[0] != "nameserver" {
+				continue
+			}
+			if addr, err := netip.ParseAddr(f[1]); err == nil && !addr.IsLoopback() {
+				servers = append(servers, f[1])
+			}
+		}
+		if len(servers) > 0 {
+			return servers
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newTestSetup(t *testing.T) (*resolverSetup, *[]string, *strings.Builder) {
+	t.Helper()
+	var ran []string
+	out := &strings.Builder{}
+	s := &resolverSetup{
+		root: t.TempDir(),
+		out:  out,
+		run: func(name string, args ...string) error {
+			ran = append(ran, name+" "+strings.Join(args, " "))
+			return nil
+		},
+	}
+	return s, &ran, out
+}
+
+func TestSetupResolved(t *testing.T) {
+	s, ran, _ := newTestSetup(t)
+	os.MkdirAll(s.path("run/systemd/resolve"), 0o755)
+	os.MkdirAll(s.path("etc"), 0o755)
+	os.WriteFile(s.path(resolvedUplinks), []byte("nameserver 192.168.1.1\nnameserver 127.0.0.1\n"), 0o644)
+	os.Symlink("../run/systemd/resolve/stub-resolv.conf", s.path(resolvConfPath))
+
+	method, err := s.detect()
+	if err != nil || method != "resolved" {
+		t.Fatalf("detect = %q, %v", method, err)
+	}
+	if got := s.uplinks(); !slices.Equal(got, []string{"192.168.1.1"}) {
+		t.Errorf("uplinks = %v", got)
+	}
+	if err := s.apply(method, netip.MustParseAddr("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	conf, _ := os.ReadFile(s.path(resolvedDropIn))
+	for _, want := range []string{"DNS=127.0.0.1\n", "DNSStubListener=no\n", "# resolv.conf was ../run/systemd/resolve/stub-resolv.conf\n"} {
+		if !strings.Contains(string(conf), want) {
+			t.Errorf("drop-in lacks %q:\n%s", want, conf)
+		}
+	}
+	if link, _ := os.Readlink(s.path(resolvConfPath)); link != resolvedUplinks {
+		t.Errorf("resolv.conf links to %q", link)
+	}
+
+	if err := s.undo(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.path(resolvedDropIn)); !os.IsNotExist(err) {
+		t.Error("drop-in not removed")
+	}
+	if link, _ := os.Readlink(s.path(resolvConfPath)); link != "../run/systemd/resolve/stub-resolv.conf" {
+		t.Errorf("resolv.conf links to %q after undo", link)
+	}
+	want := []string{"systemctl restart systemd-resolved", "systemctl restart systemd-resolved"}
+	if !slices.Equal(*ran, want) {
+		t.Errorf("ran %q, want %q", *ran, want)
+	}
+}
+
+func TestSetupNetworkManager(t *testing.T) {
+	s, ran, out := newTestSetup(t)
+	os.MkdirAll(s.path("run/NetworkManager"), 0o755)
+
+	method, err := s.detect()
+	if err != nil || method != "networkmanager" {
+		t.Fatalf("detect = %q, %v", method, err)
+	}
+	if err := s.apply(method, netip.MustParseAddr("::1")); err != nil {
+		t.Fatal(err)
+	}
+	conf, _ := os.ReadFile(s.path(nmDropIn))
+	if !strings.Contains(string(conf), "[global-dns-domain-*]\nservers=::1\n") {
+		t.Errorf("drop-in:\n%s", conf)
+	}
+	if err := s.undo(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.undo(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(out.String(), "nothing to undo\n") {
+		t.Errorf("second undo printed:\n%s", out)
+	}
+	if want := []string{"systemctl reload NetworkManager", "systemctl reload NetworkManager"}; !slices.Equal(*ran, want) {
+		t.Errorf("ran %q, want %q", *ran, want)
+	}
+}
+
+func TestSetupLeavesForeignFiles(t *testing.T) {
+	s, ran, _ := newTestSetup(t)
+	path := s.path(nmDropIn)
+	os.MkdirAll(filepath.Dir(path), 0o755)
+	os.WriteFile(path, []byte("[main]\ndns=none\n"), 0o644)
+	if err := s.undo(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("undo removed a file setup didn't write: %v", err)
+	}
+	if len(*ran) != 0 {
+		t.Errorf("ran %q", *ran)
+	}
+}
+
+func TestSetupDryRun(t *testing.T) {
+	s, ran, out := newTestSetup(t)
+	s.dryRun = true
+	if err := s.apply("networkmanager", netip.MustParseAddr("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.path(nmDropIn)); !os.IsNotExist(err) {
+		t.Error("dry run wrote the drop-in")
+	}
+	if len(*ran) != 0 || !strings.Contains(out.String(), "    servers=127.0.0.1\n") {
+		t.Errorf("ran %q, printed:\n%s", *ran, out)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	defaultStaleSchedule = "@daily"
+	// staleQueryWindow is how long a name may go without queries before it
+	// is reported: all the history Stats keeps.
+	staleQueryWindow = statsSlots * statsSlotLength
+	// staleResultNames caps how many findings the job history lists by name.
+	staleResultNames = 20
+)
+
+// StaleFinding is a name whose records look forgotten.
+type StaleFinding struct {
+	Domain  string `json:"domain"`
+	Check   string `json:"check"`
+	Records []int  `json:"records"`
+}
+
+// StaleReport looks for records that are still kept but no longer do
+// anything useful:
+//
+//   - expired: past their expiry and not yet removed
+//   - disabled: switched off rather than deleted
+//   - dangling-cname: a CNAME whose target in one of our zones has no records
+//   - unqueried: enabled records nobody asked for in the last day
+//
+// It only reports; nothing is changed.
+type StaleReport struct {
+	store *Store
+	zones Zones
+	stats *Stats
+	now   func() time.Time
+}
+
+func NewStaleReport(store *Store, zones Zones, stats *Stats) *StaleReport {
+	return &StaleReport{store: store, zones: zones, stats: stats, now: time.Now}
+}
+
+// Find returns the findings sorted by check and name, and whether the
+// query counts covered the whole window; names are only reported as
+// unqueried when they did.
+func (r *StaleReport) Find() ([]StaleFinding, bool) {
+	_, records := r.store.Snapshot()
+	now := r.now()
+	byKey := map[[2]string][]int{}
+	add := func(domain, check string, ids ...int) {
+		k := [2]string{strings.TrimSuffix(domain, "."), check}
+		byKey[k] = append(byKey[k], ids...)
+	}
+
+	queried, complete := r.stats.Queried(staleQueryWindow)
+	for _, rec := range records {
+		name := strings.TrimSuffix(rec.Domain, ".")
+		switch {
+		case rec.expired(now):
+			add(name, "expired", rec.ID)
+		case rec.Disabled:
+			add(name, "disabled", rec.ID)
+		case complete && !queried[name] && !strings.HasPrefix(name, "*."):
+			add(name, "unqueried", rec.ID)
+		}
+	}
+	for _, f := range checkZones(records, r.zones) {
+		if f.Check == "dangling-cname" {
+			add(f.Domain, f.Check, f.Records...)
+		}
+	}
+
+	findings := make([]StaleFinding, 0, len(byKey))
+	for k, ids := range byKey {
+		slices.Sort(ids)
+		findings = append(findings, StaleFinding{Domain: k[0], Check: k[1], Records: ids})
+	}
+	slices.SortFunc(findings, func(a, b StaleFinding) int {
+		return cmp.Or(strings.Compare(a.Check, b.Check), strings.Compare(a.Domain, b.Domain))
+	})
+	return findings, complete
+}
+
+// Run logs every finding and returns a summary for the job history.
+func (r *StaleReport) Run(ctx context.Context) (string, error) {
+	findings, complete := r.Find()
+	var names []string
+	for _, f := range findings {
+		slog.InfoContext(ctx, "stale record", "domain", f.Domain, "check", f.Check, "records", f.Records)
+		names = append(names, f.Check+" "+f.Domain)
+	}
+	result := "no stale records"
+	if len(names) > 0 {
+		result = fmt.Sprintf("%d stale: %s", len(names), strings.Join(names[:min(len(names), staleResultNames)], ", "))
+		if len(names) > staleResultNames {
+			result += fmt.Sprintf(" and %d more", len(names)-staleResultNames)
+		}
+	}
+	if !complete {
+		result += "; unqueried names not checked, query counts cover less than " + staleQueryWindow.String()
+	}
+	return result, nil
+}
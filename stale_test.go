@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStaleReport(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, r := range []Record{
+		{Domain: "app.my.lan", Type: "A", Value: "10.0.0.1"},
+		{Domain: "idle.my.lan", Type: "A", Value: "10.0.0.2"},
+		{Domain: "off.my.lan", Type: "A", Value: "10.0.0.3", Disabled: true},
+		{Domain: "temp.my.lan", Type: "A", Value: "10.0.0.4", Expires: now.Add(-time.Hour)},
+		{Domain: "www.my.lan", Type: "CNAME", Value: "gone.my.lan"},
+		{Domain: "*.apps.my.lan", Type: "A", Value: "10.0.0.5"},
+	} {
+		if _, err := store.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := NewStats()
+	client := netip.MustParseAddr("10.0.0.50")
+	for _, name := range []string{"app.my.lan", "www.my.lan"} {
+		stats.Record(buildTestQuery(name, 1, 1), client, outcomeLocal)
+	}
+	report := NewStaleReport(store, NewZones([]string{"my.lan"}), stats)
+
+	// Counting only just began, so nothing is called unqueried yet
+	findings, complete := report.Find()
+	if complete || len(findings) != 3 {
+		t.Errorf("fresh stats: complete %v, %+v", complete, findings)
+	}
+
+	stats.started = now.Add(-staleQueryWindow)
+	findings, complete = report.Find()
+	var got []string
+	for _, f := range findings {
+		got = append(got, f.Check+" "+f.Domain)
+	}
+	want := "dangling-cname www.my.lan, disabled off.my.lan, expired temp.my.lan, unqueried idle.my.lan"
+	if !complete || strings.Join(got, ", ") != want {
+		t.Errorf("findings = %v, want %s", got, want)
+	}
+
+	result, err := report.Run(context.Background())
+	if err != nil || result != "4 stale: "+want {
+		t.Errorf("Run = %q, %v", result, err)
+	}
+}
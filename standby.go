@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultStandbyInterval = time.Second
+
+// Replica is the dataset a primary hands to its standby.
+type Replica struct {
+	Serial  uint32   `json:"serial"`
+	Records []Record `json:"records"`
+}
+
+// StandbyStatus is the externally visible state of a standby instance.
+type StandbyStatus struct {
+	Primary   string    `json:"primary"`
+	Active    bool      `json:"active"`
+	Serial    uint32    `json:"serial"`
+	LastSeen  time.Time `json:"last_seen,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Standby mirrors a primary instance over its HTTP API and decides whether
+// this instance should answer queries. Like a VRRP backup it stays passive
+// while the primary keeps responding and takes over once the primary has
+// been silent for three intervals. When the primary comes back it steps
+// down again.
+type Standby struct {
+	primary  string
+	token    string
+	interval time.Duration
+	store    *Store
+	client   *http.Client
+	now      func() time.Time
+
+	mu        sync.Mutex
+	started   time.Time
+	lastSeen  time.Time
+	lastError string
+	serial    uint32
+	active    bool
+}
+
+func NewStandby(primary, token string, interval time.Duration, store *Store) *Standby {
+	return &Standby{
+		primary:  strings.TrimRight(primary, "/"),
+		token:    token,
+		interval: interval,
+		store:    store,
+		client:   &http.Client{Timeout: interval},
+		now:      time.Now,
+	}
+}
+
+// readPeerToken reads the token used to talk to the primary from a token
+// file, ignoring any expiry column.
+func readPeerToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+	token, _, _ := strings.Cut(line, "\t")
+	return strings.TrimSpace(token), nil
+}
+
+// Active reports whether this instance should currently answer queries.
+func (s *Standby) Active() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+func (s *Standby) Status() StandbyStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return StandbyStatus{
+		Primary:   s.primary,
+		Active:    s.active,
+		Serial:    s.serial,
+		LastSeen:  s.lastSeen,
+		LastError: s.lastError,
+	}
+}
+
+// Run polls the primary every interval until ctx is cancelled.
+func (s *Standby) Run(ctx context.Context) {
+	s.mu.Lock()
+	s.started = s.now()
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check contacts the primary once, applies any new dataset, and updates
+// the active/passive state.
+func (s *Standby) check(ctx context.Context) {
+	err := s.sync(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if err == nil {
+		s.lastSeen = now
+		s.lastError = ""
+	} else {
+		s.lastError = err.Error()
+	}
+
+	// Master_Down_Interval in VRRP terms, counted from startup until the
+	// primary has been seen once
+	since := s.lastSeen
+	if since.IsZero() {
+		since = s.started
+	}
+	silent := now.Sub(since) >= 3*s.interval
+
+	switch {
+	case silent && !s.active:
+		s.active = true
+		slog.Warn("primary silent, standby taking over", "primary", s.primary, "last_seen", s.lastSeen, "error", err)
+	case !silent && s.active && err == nil:
+		s.active = false
+		slog.Info("primary is back, standby stepping down", "primary", s.primary)
+	}
+}
+
+func (s *Standby) sync(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.primary+"/api/replica", nil)
+	if err != nil {
+		return err
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	s.mu.Lock()
+	if s.serial != 0 {
+		req.Header.Set("If-None-Match", replicaETag(s.serial))
+	}
+	s.mu.Unlock()
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("primary returned %s", resp.Status)
+	}
+
+	var replica Replica
+	if err := json.NewDecoder(resp.Body).Decode(&replica); err != nil {
+		return fmt.Errorf("decoding replica: %w", err)
+	}
+	if err := s.store.Replace(replica.Records); err != nil {
+		return fmt.Errorf("applying replica: %w", err)
+	}
+	s.mu.Lock()
+	s.serial = replica.Serial
+	s.mu.Unlock()
+	slog.Info("replicated dataset from primary", "serial", replica.Serial, "records", len(replica.Records))
+	return nil
+}
+
+func replicaETag(serial uint32) string {
+	return `"` + strconv.FormatUint(uint64(serial), 10) + `"`
+}
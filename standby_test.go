@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStandbyReplicatesAndTakesOver(t *testing.T) {
+	primaryWeb, primaryStore := testWebServer(t)
+	primaryStore.Add(Record{Domain: "app.test", Type: "A", Value: "10.0.0.1"})
+	primary := httptest.NewServer(primaryWeb.Handler())
+	defer primary.Close()
+
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	sb := NewStandby(primary.URL, "", time.Second, store)
+	sb.now = func() time.Time { return now }
+	sb.started = now
+	ctx := context.Background()
+
+	sb.check(ctx)
+	if sb.Active() {
+		t.Fatal("standby active while primary is healthy")
+	}
+	if recs := store.List(); len(recs) != 1 || recs[0].Value != "10.0.0.1" {
+		t.Fatalf("replicated records = %+v", recs)
+	}
+
+	// Unchanged serial: primary answers 304 and the store is left alone
+	store.Subscribe(func(Change) { t.Error("unexpected store change") })
+	now = now.Add(time.Second)
+	sb.check(ctx)
+	if st := sb.Status(); st.LastError != "" || !st.LastSeen.Equal(now) {
+		t.Errorf("status = %+v", st)
+	}
+
+	primary.Close()
+	now = now.Add(2 * time.Second)
+	sb.check(ctx)
+	if sb.Active() {
+		t.Error("took over before three intervals of silence")
+	}
+	now = now.Add(time.Second)
+	sb.check(ctx)
+	if !sb.Active() {
+		t.Error("standby still passive after primary went silent")
+	}
+}
+
+func TestStandbyStepsDown(t *testing.T) {
+	primaryWeb, _ := testWebServer(t)
+	primary := httptest.NewServer(primaryWeb.Handler())
+	defer primary.Close()
+
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb := NewStandby(primary.URL, "", time.Second, store)
+	sb.active = true
+	sb.check(context.Background())
+	if sb.Active() {
+		t.Error("standby did not step down when the primary returned")
+	}
+}
+
+func TestWebReplicaETag(t *testing.T) {
+	ws, store := testWebServer(t)
+	store.Add(Record{Domain: "app.test", Type: "A", Value: "10.0.0.1"})
+
+	req := httptest.NewRequest("GET", "/api/replica", nil)
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	var replica Replica
+	json.NewDecoder(w.Body).Decode(&replica)
+	if w.Code != http.StatusOK || replica.Serial != store.Serial() || len(replica.Records) != 1 {
+		t.Fatalf("status=%d replica=%+v", w.Code, replica)
+	}
+
+	req = httptest.NewRequest("GET", "/api/replica", nil)
+	req.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("status = %d, want 304", w.Code)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// statsSlotLength is the granularity of report windows.
+	statsSlotLength = 5 * time.Minute
+	// statsSlots is how many slots of history are kept, which bounds the
+	// longest report window.
+	statsSlots = 24 * 12
+	// statsMaxKeys caps the distinct domains, and separately clients, counted
+	// in one slot; the rest are lumped together under statsOther.
+	statsMaxKeys = 10000
+	statsOther   = "(other)"
+)
+
+// StatsCounts are the counters kept per domain and per client.
+type StatsCounts struct {
+	Queries uint64 `json:"queries"`
+	Blocked uint64 `json:"blocked"`
+	Cached  uint64 `json:"cached"`
+}
+
+func (c *StatsCounts) add(o StatsCounts) {
+	c.Queries += o.Queries
+	c.Blocked += o.Blocked
+	c.Cached += o.Cached
+}
+
+type statsSlot struct {
+	index   int64 // time since the epoch in statsSlotLength units
+	total   StatsCounts
+	domains map[string]*StatsCounts
+	clients map[string]*StatsCounts
+}
+
+// Stats counts queries per domain and per client in time slots for the last
+// day, for the top-N breakdowns of /api/stats.
+type Stats struct {
+	mu      sync.Mutex
+	slots   [statsSlots]statsSlot
+	started time.Time // counting began; windows reaching further back are partial
+	now     func() time.Time
+}
+
+func NewStats() *Stats {
+	return &Stats{started: time.Now(), now: time.Now}
+}
+
+// Record counts one answered query.
+func (s *Stats) Record(query []byte, client netip.Addr, o outcome) {
+	name, _ := parseDNSName(query, 12)
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	c := StatsCounts{Queries: 1}
+	switch o {
+	case outcomeBlocked:
+		c.Blocked = 1
+	case outcomeCached:
+		c.Cached = 1
+	}
+
+	index := s.now().UnixNano() / int64(statsSlotLength)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slot := &s.slots[index%statsSlots]
+	if slot.index != index || slot.domains == nil {
+		*slot = statsSlot{index: index, domains: map[string]*StatsCounts{}, clients: map[string]*StatsCounts{}}
+	}
+	slot.total.add(c)
+	countStats(slot.domains, name, c)
+	countStats(slot.clients, client.Unmap().String(), c)
+}
+
+// countStats adds c to key's counters in m, or to statsOther's once m is
+// full.
+func countStats(m map[string]*StatsCounts, key string, c StatsCounts) {
+	p := m[key]
+	if p == nil {
+		if len(m) >= statsMaxKeys {
+			key = statsOther
+			p = m[key]
+		}
+		if p == nil {
+			p = &StatsCounts{}
+			m[key] = p
+		}
+	}
+	p.add(c)
+}
+
+// StatsEntry is one row of a top-N list.
+type StatsEntry struct {
+	Name string `json:"name"`
+	StatsCounts
+}
+
+type StatsReport struct {
+	Window string `json:"window"`
+	StatsCounts
+	TopDomains []StatsEntry `json:"top_domains"`
+	TopBlocked []StatsEntry `json:"top_blocked"`
+	TopClients []StatsEntry `json:"top_clients"`
+}
+
+// Report sums the slots of the last window, rounded up to whole slots, and
+// ranks the top n domains by queries and by blocks, and clients by queries.
+func (s *Stats) Report(window time.Duration, n int) StatsReport {
+	now := s.now().UnixNano() / int64(statsSlotLength)
+	oldest := now - int64((window+statsSlotLength-1)/statsSlotLength) + 1
+
+	report := StatsReport{Window: window.String()}
+	domains, clients := map[string]*StatsCounts{}, map[string]*StatsCounts{}
+	s.mu.Lock()
+	for i := range s.slots {
+		slot := &s.slots[i]
+		if slot.index < oldest || slot.index > now {
+			continue
+		}
+		report.add(slot.total)
+		for k, c := range slot.domains {
+			countStats(domains, k, *c)
+		}
+		for k, c := range slot.clients {
+			countStats(clients, k, *c)
+		}
+	}
+	s.mu.Unlock()
+
+	report.TopDomains = topStats(domains, n, func(c StatsCounts) uint64 { return c.Queries })
+	report.TopBlocked = topStats(domains, n, func(c StatsCounts) uint64 { return c.Blocked })
+	report.TopClients = topStats(clients, n, func(c StatsCounts) uint64 { return c.Queries })
+	return report
+}
+
+// Queried returns the domains queried in the last window, rounded up to
+// whole slots, and whether that covers every query of the window. It
+// doesn't while counting began less than window ago, or once a slot ran
+// out of room for distinct domains and lumped the rest together.
+func (s *Stats) Queried(window time.Duration) (map[string]bool, bool) {
+	now := s.now()
+	current := now.UnixNano() / int64(statsSlotLength)
+	oldest := current - int64((window+statsSlotLength-1)/statsSlotLength) + 1
+	complete := !s.started.After(now.Add(-window))
+	queried := map[string]bool{}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.slots {
+		slot := &s.slots[i]
+		if slot.index < oldest || slot.index > current {
+			continue
+		}
+		for name := range slot.domains {
+			if name == statsOther {
+				complete = false
+				continue
+			}
+			queried[name] = true
+		}
+	}
+	return queried, complete
+}
+
+// topStats returns the n entries of m with the largest nonzero key, ties
+// broken by name so reports are stable.
+func topStats(m map[string]*StatsCounts, n int, key func(StatsCounts) uint64) []StatsEntry {
+	out := []StatsEntry{}
+	for name, c := range m {
+		if key(*c) > 0 {
+			out = append(out, StatsEntry{Name: name, StatsCounts: *c})
+		}
+	}
+	slices.SortFunc(out, func(a, b StatsEntry) int {
+		return cmp.Or(cmp.Compare(key(b.StatsCounts), key(a.StatsCounts)), strings.Compare(a.Name, b.Name))
+	})
+	return out[:min(n, len(out))]
+}
+
+func (s *WebServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if s.dns == nil || s.dns.stats == nil {
+		jsonError(w, "dns server unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	window := 24 * time.Hour
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > statsSlots*statsSlotLength {
+			jsonError(w, fmt.Sprintf("invalid window %q", v), http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	top := 10
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			jsonError(w, fmt.Sprintf("invalid top %q", v), http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.dns.stats.Report(window, top))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	s := NewStats()
+	s.now = func() time.Time { return now }
+	laptop, phone := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("::ffff:10.0.0.2")
+	query := func(name string, client netip.Addr, o outcome, n int) {
+		for range n {
+			s.Record(buildTestQuery(name, 1, 1), client, o)
+		}
+	}
+	query("old.test", laptop, outcomeForwarded, 5)
+	now = now.Add(2 * time.Hour)
+	query("App.Test", laptop, outcomeLocal, 3)
+	query("ads.example", phone, outcomeBlocked, 2)
+	query("news.example", phone, outcomeCached, 1)
+
+	r := s.Report(time.Hour, 2)
+	if r.Queries != 6 || r.Blocked != 2 || r.Cached != 1 {
+		t.Errorf("totals = %+v", r.StatsCounts)
+	}
+	if len(r.TopDomains) != 2 || r.TopDomains[0].Name != "app.test" || r.TopDomains[1].Name != "ads.example" {
+		t.Errorf("top domains = %+v", r.TopDomains)
+	}
+	if len(r.TopBlocked) != 1 || r.TopBlocked[0].Name != "ads.example" {
+		t.Errorf("top blocked = %+v", r.TopBlocked)
+	}
+	if len(r.TopClients) != 2 || r.TopClients[0].Name != "10.0.0.1" || r.TopClients[1].Name != "10.0.0.2" || r.TopClients[1].Blocked != 2 {
+		t.Errorf("top clients = %+v", r.TopClients)
+	}
+	if r := s.Report(24*time.Hour, 10); r.Queries != 11 || r.TopDomains[0].Name != "old.test" {
+		t.Errorf("day report = %+v", r)
+	}
+
+	// Past a day, slots are reused for new queries
+	now = now.Add(24 * time.Hour)
+	query("new.test", laptop, outcomeLocal, 1)
+	if r := s.Report(24*time.Hour, 10); r.Queries != 1 {
+		t.Errorf("after a day: %d queries", r.Queries)
+	}
+}
+
+func TestWebStats(t *testing.T) {
+	ws, store := testWebServer(t)
+	ws.dns = NewDNSServer(store, nil)
+	ws.dns.stats.Record(buildTestQuery("app.test", 1, 1), netip.MustParseAddr("10.0.0.1"), outcomeLocal)
+
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/stats?window=1h&top=5", nil))
+	var r StatsReport
+	json.NewDecoder(w.Body).Decode(&r)
+	if w.Code != 200 || r.Window != "1h0m0s" || r.Queries != 1 || len(r.TopClients) != 1 {
+		t.Errorf("status %d: %+v", w.Code, r)
+	}
+	for _, q := range []string{"window=25h", "window=soon", "top=0"} {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/stats?"+q, nil))
+		if w.Code != 400 {
+			t.Errorf("%s: status = %d, want 400", q, w.Code)
+		}
+	}
+}
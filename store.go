@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
 	"log/slog"
+	"maps"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Record struct {
@@ -14,29 +23,120 @@ type Record struct {
 	Domain string `json:"domain"`
 	Type   string `json:"type"`
 	Value  string `json:"value"`
+	View   string `json:"view,omitempty"`   // only served on listeners bound to this view
+	Source string `json:"source,omitempty"` // set for read-only records synced from elsewhere
+	// Comment is a free-text note for whoever maintains the record; it is
+	// never served over DNS.
+	Comment string `json:"comment,omitempty"`
+	// Disabled records are kept, with their ID, but not resolved.
+	Disabled bool `json:"disabled,omitempty"`
+	// Expires, if set, is when the record stops resolving; Expire removes
+	// it from the store some time after.
+	Expires time.Time `json:"expires,omitzero"`
+	// Tags are comma-separated labels for tooling, such as "public" for
+	// push-sync to a public DNS provider; they are never served over DNS.
+	Tags string `json:"tags,omitempty"`
+}
+
+// hasTag reports whether tag is one of r's tags.
+func (r Record) hasTag(tag string) bool {
+	return slices.Contains(strings.Split(r.Tags, ","), tag)
+}
+
+// expired reports whether r has an expiry time that has passed.
+func (r Record) expired(now time.Time) bool {
+	return !r.Expires.IsZero() && !now.Before(r.Expires)
+}
+
+// ErrDuplicate is returned, with the existing record, when a change would
+// give a second local record the same name, type, value and view.
+var ErrDuplicate = errors.New("record already exists")
+
+// recordTypes are the record types the store holds.
+var recordTypes = []string{"A", "AAAA", "CNAME", "TXT", "SVCB", "HTTPS"}
+
+// Change describes a single successful store mutation. Old is set for
+// updates and deletes, New for adds and updates.
+type Change struct {
+	Op     string  `json:"op"` // "add", "update", or "delete"
+	Old    *Record `json:"old,omitempty"`
+	New    *Record `json:"new,omitempty"`
+	Serial uint32  `json:"serial"`
 }
 
 type Store struct {
-	mu      sync.RWMutex
-	records []Record
-	nextID  int
-	index   map[string][]Record
-	path    string
+	mu        sync.RWMutex
+	records   []Record
+	nextID    int
+	path      string
+	serial    uint32
+	listeners []func(Change)
+	journal   *journal             // nil rewrites the data file on every mutation
+	remote    func([]Change) error // writes changes through to shared storage first, all or none
+	stamp     fileStamp            // the data file as last read or written
+	pending   fileStamp            // a change to it seen by Reload, not yet settled
+	fsync     bool                 // sync the data file to disk on every rewrite
+
+	// sources holds records published by sync jobs (LDAP, hosts files, ...).
+	// They are answered like any other record but never written to the data
+	// file and cannot be edited through the API.
+	sources map[string][]Record
+
+	// index holds the records that resolve, by lowercased name, view and
+	// type. It is rebuilt on every mutation and swapped in whole, never
+	// modified, so lookups read it without taking s.mu and don't wait for
+	// writes or file saves.
+	index atomic.Pointer[recordIndex]
+	// generation counts index rebuilds, so whatever was derived from the
+	// records can tell it is out of date.
+	generation atomic.Uint64
 }
 
 func NewStore(path string) (*Store, error) {
 	s := &Store{
-		path:  path,
-		index: make(map[string][]Record),
+		path:    path,
+		sources: make(map[string][]Record),
 	}
+	s.index.Store(&recordIndex{})
 	if err := s.load(); err != nil {
 		return nil, err
 	}
+	s.serial = uint32(time.Now().Unix())
+	if info, err := os.Stat(path); err == nil {
+		s.serial = uint32(info.ModTime().Unix())
+	}
 	return s, nil
 }
 
+// Subscribe registers fn to be called after every successful mutation.
+// Listeners run with the store lock held, so they must not block or call
+// back into the Store.
+func (s *Store) Subscribe(fn func(Change)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// Serial is the zone serial: a timestamp-based counter bumped on every
+// mutation, so it keeps increasing across restarts.
+func (s *Store) Serial() uint32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.serial
+}
+
+// emit bumps the serial and informs listeners. Caller must hold s.mu.
+func (s *Store) emit(c Change) {
+	s.serial = max(s.serial+1, uint32(time.Now().Unix()))
+	c.Serial = s.serial
+	for _, fn := range s.listeners {
+		fn(c)
+	}
+}
+
 func (s *Store) load() error {
 	data, err := os.ReadFile(s.path)
+	s.stamp, _ = statFile(s.path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			s.records = []Record{}
@@ -45,53 +145,99 @@ func (s *Store) load() error {
 		}
 		return err
 	}
-	if len(data) == 0 {
-		s.records = []Record{}
-		s.nextID = 1
-		return nil
-	}
+	records, maxID := parseRecords(data, s.path)
+	s.records = records
+	s.nextID = maxID + 1
+	s.rebuildIndex()
+	return nil
+}
 
-	var records []Record
+// parseRecords reads the data file format, skipping malformed lines, and
+// returns the records along with the highest ID seen. path is only used in
+// log messages.
+func parseRecords(data []byte, path string) ([]Record, int) {
+	records := []Record{}
 	maxID := 0
-	for i, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
-		line = strings.TrimRight(line, "\r")
+	for i, line := range recordLines(data) {
 		if line == "" {
 			continue
 		}
-		fields := strings.Split(line, "\t")
-		if len(fields) != 4 {
-			slog.Warn("skipping malformed record", "file", s.path, "line", i+1)
-			continue
-		}
-		id, err := strconv.Atoi(fields[0])
+		r, err := parseRecordLine(line)
 		if err != nil {
-			slog.Warn("skipping malformed record", "file", s.path, "line", i+1, "error", err)
+			slog.Warn("skipping malformed record", "file", path, "line", i+1, "error", err)
 			continue
 		}
-		rtype := fields[2]
-		if rtype != "A" && rtype != "AAAA" && rtype != "CNAME" {
-			slog.Warn("skipping malformed record", "file", s.path, "line", i+1, "type", rtype)
-			continue
+		records = append(records, r)
+		if r.ID > maxID {
+			maxID = r.ID
 		}
-		records = append(records, Record{
-			ID:     id,
-			Domain: fields[1],
-			Type:   rtype,
-			Value:  fields[3],
-		})
-		if id > maxID {
-			maxID = id
+	}
+	return records, maxID
+}
+
+// recordLines splits a data file into lines, numbered from 0.
+func recordLines(data []byte) []string {
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, "\r")
+	}
+	return lines
+}
+
+// parseRecordLine reads one line of the data file. Only the columns are
+// checked; the values are not validated.
+func parseRecordLine(line string) (Record, error) {
+	fields := strings.Split(line, "\t")
+	// Optional trailing columns hold the view, the comment, a
+	// "disabled" marker, the expiry time and the tags
+	if len(fields) < 4 || len(fields) > 9 {
+		return Record{}, fmt.Errorf("%d columns, want 4 to 9", len(fields))
+	}
+	id, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return Record{}, fmt.Errorf("invalid id %q", fields[0])
+	}
+	if !slices.Contains(recordTypes, fields[2]) {
+		return Record{}, fmt.Errorf("unknown type %q", fields[2])
+	}
+	r := Record{
+		ID:     id,
+		Domain: fields[1],
+		Type:   fields[2],
+		Value:  fields[3],
+	}
+	if len(fields) > 4 {
+		r.View = fields[4]
+	}
+	if len(fields) > 5 {
+		r.Comment = fields[5]
+	}
+	if len(fields) > 6 {
+		r.Disabled = fields[6] == "disabled"
+	}
+	if len(fields) > 7 && fields[7] != "" {
+		if r.Expires, err = time.Parse(time.RFC3339, fields[7]); err != nil {
+			return Record{}, fmt.Errorf("invalid expiry %q", fields[7])
 		}
 	}
-	s.records = records
-	s.nextID = maxID + 1
-	s.rebuildIndex()
-	return nil
+	if len(fields) > 8 {
+		r.Tags = fields[8]
+	}
+	return r, nil
 }
 
 func (s *Store) save() error {
-	var buf strings.Builder
-	for _, r := range s.records {
+	if err := writeFileAtomic(s.path, formatRecords(s.records), s.fsync); err != nil {
+		return err
+	}
+	s.stamp, _ = statFile(s.path)
+	return nil
+}
+
+// formatRecords writes records in the data file format.
+func formatRecords(records []Record) []byte {
+	var buf bytes.Buffer
+	for _, r := range records {
 		buf.WriteString(strconv.Itoa(r.ID))
 		buf.WriteByte('\t')
 		buf.WriteString(r.Domain)
@@ -99,79 +245,282 @@ func (s *Store) save() error {
 		buf.WriteString(r.Type)
 		buf.WriteByte('\t')
 		buf.WriteString(r.Value)
+		// Trailing columns are written up to the last one in use
+		extra := []string{r.View, r.Comment, "", "", r.Tags}
+		if r.Disabled {
+			extra[2] = "disabled"
+		}
+		if !r.Expires.IsZero() {
+			extra[3] = r.Expires.UTC().Format(time.RFC3339)
+		}
+		for len(extra) > 0 && extra[len(extra)-1] == "" {
+			extra = extra[:len(extra)-1]
+		}
+		for _, f := range extra {
+			buf.WriteByte('\t')
+			buf.WriteString(f)
+		}
 		buf.WriteByte('\n')
 	}
+	return buf.Bytes()
+}
 
-	dir := filepath.Dir(s.path)
-	tmp, err := os.CreateTemp(dir, ".regieleki-*.tmp")
+// writeFileAtomic replaces path with data via a temp file and rename, so
+// readers never see a partial file. With durable, the temp file is synced
+// before the rename and the directory after it, so the new content survives
+// a power loss once this returns; otherwise the rename may reach the disk
+// before the data does, or not at all.
+func writeFileAtomic(path string, data []byte, durable bool) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".regieleki-*.tmp")
 	if err != nil {
 		return err
 	}
 	tmpPath := tmp.Name()
-
-	if _, err := tmp.WriteString(buf.String()); err != nil {
+	if _, err := tmp.Write(data); err != nil {
 		tmp.Close()
 		os.Remove(tmpPath)
 		return err
 	}
+	if durable {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
 	if err := tmp.Close(); err != nil {
 		os.Remove(tmpPath)
 		return err
 	}
-	if err := os.Rename(tmpPath, s.path); err != nil {
+	if err := os.Rename(tmpPath, path); err != nil {
 		os.Remove(tmpPath)
 		return err
 	}
+	if durable {
+		return syncDir(filepath.Dir(path))
+	}
 	return nil
 }
 
+// syncDir flushes a directory's entries, making renames and new files in it
+// durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// rebuildIndex publishes a new index of the current records. Caller must
+// hold s.mu.
 func (s *Store) rebuildIndex() {
-	s.index = make(map[string][]Record, len(s.records))
-	for _, r := range s.records {
-		key := strings.ToLower(r.Domain)
-		s.index[key] = append(s.index[key], r)
+	index := buildIndex(s.all())
+	s.index.Store(&index)
+	s.generation.Add(1)
+}
+
+// Generation changes whenever the records that resolve do. Reading it
+// before resolving, a caller caching the result keeps it only while the
+// generation stays the same.
+func (s *Store) Generation() uint64 {
+	return s.generation.Load()
+}
+
+// all returns local records followed by source records in source name
+// order. Caller must hold s.mu.
+func (s *Store) all() []Record {
+	names := make([]string, 0, len(s.sources))
+	for name := range s.sources {
+		names = append(names, name)
 	}
+	slices.Sort(names)
+	result := slices.Clone(s.records)
+	for _, name := range names {
+		result = append(result, s.sources[name]...)
+	}
+	return result
 }
 
+// List returns every record, including read-only ones from sources.
 func (s *Store) List() []Record {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	result := make([]Record, len(s.records))
-	copy(result, s.records)
+	result := s.all()
+	if result == nil {
+		result = []Record{}
+	}
 	return result
 }
 
+// RecordQuery selects, orders and pages records for Query. Zero fields
+// don't filter.
+type RecordQuery struct {
+	Domain string // exact name, any case
+	Type   string
+	Search string // substring of the name, value or comment, any case
+	Sort   string // "id", "domain", "type" or "value", with a "-" prefix for descending
+	Offset int
+	Limit  int // 0 means no limit
+}
+
+// recordSorts are the fields Query can sort on.
+var recordSorts = map[string]func(a, b Record) int{
+	"id":     func(a, b Record) int { return cmp.Compare(a.ID, b.ID) },
+	"domain": func(a, b Record) int { return strings.Compare(a.Domain, b.Domain) },
+	"type":   func(a, b Record) int { return strings.Compare(a.Type, b.Type) },
+	"value":  compareValues,
+}
+
+// compareValues orders addresses numerically and before any other values,
+// which sort as strings.
+func compareValues(a, b Record) int {
+	ipA, errA := netip.ParseAddr(a.Value)
+	ipB, errB := netip.ParseAddr(b.Value)
+	switch {
+	case errA == nil && errB == nil:
+		return ipA.Compare(ipB)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a.Value, b.Value)
+}
+
+// ValidSort reports whether Query accepts sort.
+func ValidSort(sort string) bool {
+	_, ok := recordSorts[strings.TrimPrefix(sort, "-")]
+	return sort == "" || ok
+}
+
+// Query returns one page of the records List would return that match q,
+// along with how many match in total. Only matching records are copied, so
+// a small page of a large store stays cheap.
+func (s *Store) Query(q RecordQuery) ([]Record, int) {
+	search := strings.ToLower(q.Search)
+	match := func(r *Record) bool {
+		return (q.Domain == "" || strings.EqualFold(r.Domain, q.Domain)) &&
+			(q.Type == "" || strings.EqualFold(r.Type, q.Type)) &&
+			(search == "" || strings.Contains(strings.ToLower(r.Domain), search) ||
+				strings.Contains(strings.ToLower(r.Value), search) ||
+				strings.Contains(strings.ToLower(r.Comment), search))
+	}
+
+	s.mu.RLock()
+	var result []Record
+	for i := range s.records {
+		if match(&s.records[i]) {
+			result = append(result, s.records[i])
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.sources)) {
+		for i := range s.sources[name] {
+			if r := &s.sources[name][i]; match(r) {
+				result = append(result, *r)
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	if by, ok := recordSorts[strings.TrimPrefix(q.Sort, "-")]; ok {
+		if strings.HasPrefix(q.Sort, "-") {
+			slices.SortStableFunc(result, func(a, b Record) int { return by(b, a) })
+		} else {
+			slices.SortStableFunc(result, by)
+		}
+	}
+	total := len(result)
+	result = result[min(q.Offset, total):]
+	if q.Limit > 0 && q.Limit < len(result) {
+		result = result[:q.Limit]
+	}
+	if result == nil {
+		result = []Record{}
+	}
+	return result, total
+}
+
+// SetSource replaces the records published by the named source. Records are
+// matched on name, type and value, so listeners only hear about real
+// additions and removals. An empty slice removes the source.
+func (s *Store) SetSource(name string, records []Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := func(r Record) string { return r.Domain + "\t" + r.Type + "\t" + r.Value }
+	prev := s.sources[name]
+	old := make(map[string]bool, len(prev))
+	for _, r := range prev {
+		old[key(r)] = true
+	}
+
+	next := make([]Record, 0, len(records))
+	seen := make(map[string]bool, len(records))
+	for _, r := range records {
+		r.ID = 0
+		r.Source = name
+		r.Domain = strings.ToLower(strings.TrimSuffix(r.Domain, "."))
+		r.Type = strings.ToUpper(r.Type)
+		if seen[key(r)] {
+			continue
+		}
+		seen[key(r)] = true
+		next = append(next, r)
+	}
+
+	if len(next) == 0 {
+		delete(s.sources, name)
+	} else {
+		s.sources[name] = next
+	}
+	s.rebuildIndex()
+
+	for _, r := range next {
+		if !old[key(r)] {
+			s.emit(Change{Op: "add", New: &r})
+		}
+	}
+	for _, r := range prev {
+		if !seen[key(r)] {
+			s.emit(Change{Op: "delete", Old: &r})
+		}
+	}
+}
+
 // Resolve looks up records for a domain. Returns matching records and whether
 // the domain is managed by us (authoritative).
 func (s *Store) Resolve(domain string, qtype uint16) ([]Record, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	key := strings.ToLower(domain)
-	all := s.index[key]
-	if len(all) == 0 {
+	return s.ResolveView(domain, qtype, "")
+}
+
+// ResolveView is Resolve as seen from a listener bound to view. A name that
+// has records in the view is answered from those alone; otherwise its records
+// without a view are used. Names that only exist in other views are still
+// ours, so they resolve to no records rather than being forwarded.
+func (s *Store) ResolveView(domain string, qtype uint16, view string) ([]Record, bool) {
+	index := *s.index.Load()
+	now := time.Now()
+	set, ok := index.lookup(strings.ToLower(domain), view, now)
+	if !ok {
 		return nil, false
 	}
 
 	// ANY query returns all records
 	if qtype == 255 {
-		result := make([]Record, len(all))
-		copy(result, all)
-		return result, true
+		return slices.Clone(unexpired(set.all, now)), true
 	}
 
-	var result []Record
-	for _, r := range all {
-		if matchType(r.Type, qtype) {
-			result = append(result, r)
-		}
-	}
+	// Copied, since the caller may reorder them
+	result := slices.Clone(unexpired(set.byType[qtype], now))
 
-	// CNAME fallback: if no direct match for A/AAAA, return CNAME if present
+	// CNAME fallback: if no direct match, return CNAME if present
 	if len(result) == 0 {
-		for _, r := range all {
-			if r.Type == "CNAME" {
-				result = append(result, r)
-				break
+		if cnames := unexpired(set.byType[5], now); len(cnames) > 0 {
+			result = []Record{cnames[0]}
+			if qtype != 5 {
+				result = chaseCNAME(index, result, qtype, view, now)
 			}
 		}
 	}
@@ -179,40 +528,121 @@ func (s *Store) Resolve(domain string, qtype uint16) ([]Record, bool) {
 	return result, true
 }
 
-func matchType(rtype string, qtype uint16) bool {
-	switch qtype {
-	case 1:
-		return rtype == "A"
-	case 28:
-		return rtype == "AAAA"
-	case 5:
-		return rtype == "CNAME"
+// maxCNAMEChain bounds how many CNAME hops are followed within the store.
+const maxCNAMEChain = 8
+
+// chaseCNAME follows a CNAME chain through records we manage, appending each
+// hop and finally the target's records of the requested type. The chain stops
+// at the first target we don't manage, at a loop, or after maxCNAMEChain hops.
+func chaseCNAME(index recordIndex, chain []Record, qtype uint16, view string, now time.Time) []Record {
+	seen := map[string]bool{strings.ToLower(chain[0].Domain): true}
+	for range maxCNAMEChain {
+		target := strings.ToLower(strings.TrimSuffix(chain[len(chain)-1].Value, "."))
+		if seen[target] {
+			break
+		}
+		seen[target] = true
+
+		set, ok := index.lookup(target, view, now)
+		if !ok {
+			break
+		}
+		if matched := unexpired(set.byType[qtype], now); len(matched) > 0 {
+			return append(chain, matched...)
+		}
+		cnames := unexpired(set.byType[5], now)
+		if len(cnames) == 0 {
+			break
+		}
+		chain = append(chain, cnames[0])
 	}
-	return false
+	return chain
+}
+
+// unexpired drops the records whose expiry time has passed. Expire removes
+// them from the store eventually; until then they are skipped here.
+func unexpired(records []Record, now time.Time) []Record {
+	if !slices.ContainsFunc(records, func(r Record) bool { return r.expired(now) }) {
+		return records
+	}
+	return slices.DeleteFunc(slices.Clone(records), func(r Record) bool { return r.expired(now) })
+}
+
+// duplicateOf returns the record among records, other than the one with ID
+// skip, that r would duplicate. Values are compared the way DNS compares
+// them, so 10.0.0.1 and 10.000.0.1 are the same address.
+func duplicateOf(records []Record, r Record, skip int) (Record, bool) {
+	i := slices.IndexFunc(records, func(o Record) bool {
+		return o.ID != skip && o.View == r.View && strings.EqualFold(o.Type, r.Type) &&
+			strings.EqualFold(o.Domain, r.Domain) && sameValue(o, r.Value)
+	})
+	if i < 0 {
+		return Record{}, false
+	}
+	return records[i], true
 }
 
 func (s *Store) Add(r Record) (Record, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	r.ID = s.nextID
-	s.nextID++
 	r.Domain = strings.ToLower(r.Domain)
 	r.Type = strings.ToUpper(r.Type)
-	s.records = append(s.records, r)
+	if existing, ok := duplicateOf(s.records, r, 0); ok {
+		return existing, ErrDuplicate
+	}
+	r.ID = s.nextID
+	prev, nextID := s.records, s.nextID
+	s.records, s.nextID = append(s.records, r), s.nextID+1
+	if err := s.persist(Change{Op: "add", New: &r}); err != nil {
+		s.records, s.nextID = prev, nextID
+		return r, err
+	}
 	s.rebuildIndex()
-	return r, s.save()
+	s.emit(Change{Op: "add", New: &r})
+	return r, nil
+}
+
+func (s *Store) Update(id int, rec Record) (Record, error) {
+	return s.Patch(id, func(Record) (Record, error) { return rec, nil })
 }
 
-func (s *Store) Update(id int, domain, rtype, value string) (Record, error) {
+// Patch updates the record with the given ID to what fn makes of its current
+// value. The read and the write happen under one lock, so concurrent patches
+// to different fields can't undo each other. An error from fn, or from
+// persisting the change, is returned as is and leaves the record unchanged.
+func (s *Store) Patch(id int, fn func(Record) (Record, error)) (Record, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	for i, r := range s.records {
 		if r.ID == id {
-			s.records[i].Domain = strings.ToLower(domain)
-			s.records[i].Type = strings.ToUpper(rtype)
-			s.records[i].Value = value
+			rec, err := fn(r)
+			if err != nil {
+				return r, err
+			}
+			rec.Domain = strings.ToLower(rec.Domain)
+			rec.Type = strings.ToUpper(rec.Type)
+			if existing, ok := duplicateOf(s.records, rec, id); ok {
+				return existing, ErrDuplicate
+			}
+			updated := r
+			updated.Domain = rec.Domain
+			updated.Type = rec.Type
+			updated.Value = rec.Value
+			updated.View = rec.View
+			updated.Comment = rec.Comment
+			updated.Disabled = rec.Disabled
+			updated.Expires = rec.Expires
+			updated.Tags = rec.Tags
+			prev := s.records
+			s.records = slices.Clone(s.records)
+			s.records[i] = updated
+			if err := s.persist(Change{Op: "update", Old: &r, New: &updated}); err != nil {
+				s.records = prev
+				return r, err
+			}
 			s.rebuildIndex()
-			return s.records[i], s.save()
+			s.emit(Change{Op: "update", Old: &r, New: &updated})
+			return updated, nil
 		}
 	}
 	return Record{}, os.ErrNotExist
@@ -223,10 +653,282 @@ func (s *Store) Delete(id int) error {
 	defer s.mu.Unlock()
 	for i, r := range s.records {
 		if r.ID == id {
-			s.records = append(s.records[:i], s.records[i+1:]...)
+			prev := s.records
+			s.records = slices.Delete(slices.Clone(s.records), i, i+1)
+			if err := s.persist(Change{Op: "delete", Old: &r}); err != nil {
+				s.records = prev
+				return err
+			}
 			s.rebuildIndex()
-			return s.save()
+			s.emit(Change{Op: "delete", Old: &r})
+			return nil
 		}
 	}
 	return os.ErrNotExist
 }
+
+// BatchOp is one operation of a Batch: "create" adds Record, "update"
+// replaces record ID with Record, and "delete" removes record ID.
+type BatchOp struct {
+	Op     string
+	ID     int
+	Record Record
+}
+
+// Batch applies ops in order as one mutation: either all of them take
+// effect, persisted with a single write, or none do. It returns one change
+// per op. An update or delete of a missing ID fails the whole batch with an
+// error wrapping os.ErrNotExist.
+func (s *Store) Batch(ops []BatchOp) ([]Change, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batch(ops)
+}
+
+// batch is Batch for callers that hold s.mu.
+func (s *Store) batch(ops []BatchOp) ([]Change, error) {
+	records := slices.Clone(s.records)
+	nextID := s.nextID
+	changes := make([]Change, 0, len(ops))
+	for i, op := range ops {
+		r := op.Record
+		r.Domain = strings.ToLower(r.Domain)
+		r.Type = strings.ToUpper(r.Type)
+		if op.Op != "delete" {
+			if existing, ok := duplicateOf(records, r, op.ID); ok {
+				return nil, fmt.Errorf("operation %d: %w: id %d", i+1, ErrDuplicate, existing.ID)
+			}
+		}
+		if op.Op == "create" {
+			r.ID = nextID
+			nextID++
+			records = append(records, r)
+			changes = append(changes, Change{Op: "add", New: &r})
+			continue
+		}
+		j := slices.IndexFunc(records, func(r Record) bool { return r.ID == op.ID })
+		if j < 0 {
+			return nil, fmt.Errorf("operation %d: record %d: %w", i+1, op.ID, os.ErrNotExist)
+		}
+		old := records[j]
+		switch op.Op {
+		case "update":
+			r.ID = op.ID
+			records[j] = r
+			changes = append(changes, Change{Op: "update", Old: &old, New: &r})
+		case "delete":
+			records = slices.Delete(records, j, j+1)
+			changes = append(changes, Change{Op: "delete", Old: &old})
+		default:
+			return nil, fmt.Errorf("operation %d: unknown op %q", i+1, op.Op)
+		}
+	}
+	if len(changes) == 0 {
+		return changes, nil
+	}
+
+	prev, prevNextID := s.records, s.nextID
+	s.records, s.nextID = records, nextID
+	if err := s.persist(changes...); err != nil {
+		s.records, s.nextID = prev, prevNextID
+		return nil, err
+	}
+	s.rebuildIndex()
+	for _, c := range changes {
+		s.emit(c)
+	}
+	return changes, nil
+}
+
+// SetRRSet makes records the whole set of local records named domain with
+// type rtype in view. Records already in the set with one of the new values
+// keep their ID and take that record's other fields; the rest of the set is
+// deleted and the missing values are created, all in one batch. It returns
+// the resulting set and the changes made, none if the set was already as
+// wanted.
+func (s *Store) SetRRSet(domain, rtype, view string, records []Record) ([]Record, []Change, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	domain, rtype = strings.ToLower(domain), strings.ToUpper(rtype)
+	inSet := func(r Record) bool { return r.Domain == domain && r.Type == rtype && r.View == view }
+
+	var current []Record
+	for _, r := range s.records {
+		if inSet(r) {
+			current = append(current, r)
+		}
+	}
+	var deletes, updates, creates []BatchOp
+	kept := make(map[int]bool)
+	var wanted []Record
+	for _, r := range records {
+		r.Domain, r.Type, r.View = domain, rtype, view
+		if slices.ContainsFunc(wanted, func(w Record) bool { return sameValue(w, r.Value) }) {
+			continue
+		}
+		wanted = append(wanted, r)
+		i := slices.IndexFunc(current, func(c Record) bool { return !kept[c.ID] && sameValue(c, r.Value) })
+		if i < 0 {
+			creates = append(creates, BatchOp{Op: "create", Record: r})
+			continue
+		}
+		kept[current[i].ID] = true
+		if r.ID = current[i].ID; r != current[i] {
+			updates = append(updates, BatchOp{Op: "update", ID: r.ID, Record: r})
+		}
+	}
+	for _, c := range current {
+		if !kept[c.ID] {
+			deletes = append(deletes, BatchOp{Op: "delete", ID: c.ID})
+		}
+	}
+
+	changes, err := s.batch(slices.Concat(deletes, updates, creates))
+	if err != nil {
+		return nil, nil, err
+	}
+	result := []Record{}
+	for _, r := range s.records {
+		if inSet(r) {
+			result = append(result, r)
+		}
+	}
+	return result, changes, nil
+}
+
+// DeleteNamed deletes every local record named domain, in any view, in one
+// batch. With rtype set only records of that type go. It returns the
+// deleted records.
+func (s *Store) DeleteNamed(domain, rtype string) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	domain, rtype = strings.ToLower(domain), strings.ToUpper(rtype)
+	var ops []BatchOp
+	for _, r := range s.records {
+		if r.Domain == domain && (rtype == "" || r.Type == rtype) {
+			ops = append(ops, BatchOp{Op: "delete", ID: r.ID})
+		}
+	}
+	changes, err := s.batch(ops)
+	if err != nil {
+		return nil, err
+	}
+	deleted := make([]Record, len(changes))
+	for i, c := range changes {
+		deleted[i] = *c.Old
+	}
+	return deleted, nil
+}
+
+// Expire deletes the local records that expired by now, in one batch, and
+// returns how many it removed.
+func (s *Store) Expire(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ops []BatchOp
+	for _, r := range s.records {
+		if r.expired(now) {
+			ops = append(ops, BatchOp{Op: "delete", ID: r.ID})
+		}
+	}
+	changes, err := s.batch(ops)
+	return len(changes), err
+}
+
+// SetRemote makes every later mutation go through fn before it is persisted
+// locally; if fn fails, the mutation reports the error. The changes of one
+// batch are passed together, and fn must commit all of them or none.
+func (s *Store) SetRemote(fn func([]Change) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remote = fn
+}
+
+// SetFsync makes every later rewrite of the data file wait until it has
+// reached the disk, so an acknowledged change survives a power loss.
+func (s *Store) SetFsync(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fsync = on
+}
+
+// Shared reports whether the records are written through to shared storage,
+// which then holds the authoritative copy.
+func (s *Store) Shared() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.remote != nil
+}
+
+// Counts returns how many local records there are, and how many each sync
+// source publishes.
+func (s *Store) Counts() (int, map[string]int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sources := make(map[string]int, len(s.sources))
+	for name, records := range s.sources {
+		sources[name] = len(records)
+	}
+	return len(s.records), sources
+}
+
+// Snapshot returns the current serial together with a copy of every record,
+// taken under one lock so the two are consistent.
+func (s *Store) Snapshot() (uint32, []Record) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make([]Record, len(s.records))
+	copy(result, s.records)
+	return s.serial, result
+}
+
+// Replace swaps the whole record set for records, keeping their IDs. It is
+// used when another source holds the authoritative copy. Listeners see the
+// difference as individual adds, updates and deletes.
+func (s *Store) Replace(records []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.records
+	next := make([]Record, len(records))
+	maxID := 0
+	for i, r := range records {
+		r.Domain = strings.ToLower(r.Domain)
+		r.Type = strings.ToUpper(r.Type)
+		next[i] = r
+		maxID = max(maxID, r.ID)
+	}
+
+	s.records = next
+	s.nextID = max(s.nextID, maxID+1)
+	s.rebuildIndex()
+	if err := s.compact(); err != nil {
+		return err
+	}
+	s.emitDiff(prev, next)
+	return nil
+}
+
+// emitDiff tells listeners how the record set changed from prev to next,
+// matching records by ID. Caller must hold s.mu.
+func (s *Store) emitDiff(prev, next []Record) {
+	old := make(map[int]Record, len(prev))
+	for _, r := range prev {
+		old[r.ID] = r
+	}
+	for _, r := range next {
+		o, ok := old[r.ID]
+		delete(old, r.ID)
+		switch {
+		case !ok:
+			s.emit(Change{Op: "add", New: &r})
+		case o != r:
+			s.emit(Change{Op: "update", Old: &o, New: &r})
+		}
+	}
+	for _, r := range prev {
+		if _, ok := old[r.ID]; ok {
+			s.emit(Change{Op: "delete", Old: &r})
+		}
+	}
+}
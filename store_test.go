@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
+	"time"
 )
 
 func TestStoreNewEmpty(t *testing.T) {
@@ -44,6 +49,40 @@ func TestStoreAddAndList(t *testing.T) {
 	}
 }
 
+func TestStoreRemoteFailure(t *testing.T) {
+	s, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, _ := s.Add(Record{Domain: "app.my.local", Type: "A", Value: "10.0.0.1"})
+	s.SetRemote(func([]Change) error { return errors.New("etcd unreachable") })
+
+	// A write the remote store refused is not served or kept
+	if _, err := s.Add(Record{Domain: "new.my.local", Type: "A", Value: "10.0.0.2"}); err == nil {
+		t.Error("Add succeeded")
+	}
+	if _, err := s.Update(app.ID, Record{Domain: "app.my.local", Type: "A", Value: "10.0.0.9"}); err == nil {
+		t.Error("Update succeeded")
+	}
+	if err := s.Delete(app.ID); err == nil {
+		t.Error("Delete succeeded")
+	}
+	if _, ok := s.Resolve("new.my.local", 1); ok {
+		t.Error("failed add resolves")
+	}
+	if recs, ok := s.Resolve("app.my.local", 1); !ok || recs[0].Value != "10.0.0.1" {
+		t.Errorf("app.my.local after failed update and delete: %+v", recs)
+	}
+	if list := s.List(); len(list) != 1 || list[0] != app {
+		t.Errorf("List() = %+v", list)
+	}
+
+	s.SetRemote(func([]Change) error { return nil })
+	if r, _ := s.Add(Record{Domain: "new.my.local", Type: "A", Value: "10.0.0.2"}); r.ID != 2 {
+		t.Errorf("next ID = %d, want 2", r.ID)
+	}
+}
+
 func TestStoreUpdate(t *testing.T) {
 	path := filepath.Join(t.TempDir(), "records.tsv")
 	s, err := NewStore(path)
@@ -53,7 +92,7 @@ func TestStoreUpdate(t *testing.T) {
 
 	rec, _ := s.Add(Record{Domain: "app.my.local", Type: "A", Value: "100.70.30.1"})
 
-	updated, err := s.Update(rec.ID, "app.my.local", "A", "100.70.30.2")
+	updated, err := s.Update(rec.ID, Record{Domain: "app.my.local", Type: "A", Value: "100.70.30.2"})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -62,12 +101,79 @@ func TestStoreUpdate(t *testing.T) {
 	}
 
 	// Update non-existent record
-	_, err = s.Update(999, "x", "A", "1.2.3.4")
+	_, err = s.Update(999, Record{Domain: "x", Type: "A", Value: "1.2.3.4"})
 	if err == nil {
 		t.Error("expected error updating non-existent record")
 	}
 }
 
+func TestStoreDuplicates(t *testing.T) {
+	s, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := s.Add(Record{Domain: "app.local", Type: "AAAA", Value: "fd00::1"})
+	s.Add(Record{Domain: "app.local", Type: "AAAA", Value: "fd00::2"})
+
+	existing, err := s.Add(Record{Domain: "APP.local", Type: "aaaa", Value: "fd00:0::1"})
+	if !errors.Is(err, ErrDuplicate) || existing.ID != first.ID {
+		t.Errorf("Add duplicate = %+v, %v; want record %d and ErrDuplicate", existing, err, first.ID)
+	}
+	if _, err := s.Add(Record{Domain: "app.local", Type: "AAAA", Value: "fd00::1", View: "lan"}); err != nil {
+		t.Errorf("same record in another view: %v", err)
+	}
+	if _, err := s.Update(2, Record{Domain: "app.local", Type: "AAAA", Value: "fd00::1"}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Update into a duplicate: %v", err)
+	}
+	if _, err := s.Update(1, Record{Domain: "app.local", Type: "AAAA", Value: "fd00::1", Comment: "same record"}); err != nil {
+		t.Errorf("Update of a record to itself: %v", err)
+	}
+	if len(s.List()) != 3 {
+		t.Errorf("records: %+v", s.List())
+	}
+}
+
+func TestStoreQuery(t *testing.T) {
+	s, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(Record{Domain: "web.local", Type: "A", Value: "10.0.0.3"})
+	s.Add(Record{Domain: "db.local", Type: "A", Value: "10.0.0.2", Comment: "Postgres primary"})
+	s.Add(Record{Domain: "web.local", Type: "AAAA", Value: "fd00::3"})
+	s.Add(Record{Domain: "app.local", Type: "CNAME", Value: "web.local"})
+	s.SetSource("hosts:/etc/hosts", []Record{{Domain: "nas.local", Type: "A", Value: "10.0.0.9"}})
+
+	ids := func(records []Record) []int {
+		var out []int
+		for _, r := range records {
+			out = append(out, r.ID)
+		}
+		return out
+	}
+	tests := []struct {
+		q     RecordQuery
+		want  []int
+		total int
+	}{
+		{RecordQuery{}, []int{1, 2, 3, 4, 0}, 5},
+		{RecordQuery{Domain: "WEB.local"}, []int{1, 3}, 2},
+		{RecordQuery{Type: "a"}, []int{1, 2, 0}, 3},
+		{RecordQuery{Search: "web"}, []int{1, 3, 4}, 3},
+		{RecordQuery{Search: "postgres"}, []int{2}, 1},
+		{RecordQuery{Sort: "domain"}, []int{4, 2, 0, 1, 3}, 5},
+		{RecordQuery{Sort: "-id", Limit: 2}, []int{4, 3}, 5},
+		{RecordQuery{Sort: "value", Offset: 1, Limit: 2}, []int{1, 0}, 5},
+		{RecordQuery{Offset: 10}, nil, 5},
+	}
+	for _, tt := range tests {
+		got, total := s.Query(tt.q)
+		if !slices.Equal(ids(got), tt.want) || total != tt.total {
+			t.Errorf("Query(%+v) = %v, %d; want %v, %d", tt.q, ids(got), total, tt.want, tt.total)
+		}
+	}
+}
+
 func TestStoreDelete(t *testing.T) {
 	path := filepath.Join(t.TempDir(), "records.tsv")
 	s, err := NewStore(path)
@@ -159,6 +265,90 @@ func TestStoreResolveCNAMEFallback(t *testing.T) {
 	}
 }
 
+func TestStoreSetSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.tsv")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(Record{Domain: "app.my.local", Type: "A", Value: "10.0.0.1"})
+
+	var changes []Change
+	s.Subscribe(func(c Change) { changes = append(changes, c) })
+
+	s.SetSource("ldap", []Record{
+		{Domain: "WEB1.hosts.lan.", Type: "a", Value: "10.0.0.5"},
+		{Domain: "web1.hosts.lan", Type: "A", Value: "10.0.0.5"},
+		{Domain: "web2.hosts.lan", Type: "A", Value: "10.0.0.6"},
+	})
+	if len(s.List()) != 3 {
+		t.Fatalf("List() returned %d records, want 3", len(s.List()))
+	}
+	if len(changes) != 2 || changes[0].Op != "add" {
+		t.Errorf("changes = %+v, want two adds", changes)
+	}
+	records, ok := s.Resolve("web1.hosts.lan", 1)
+	if !ok || len(records) != 1 || records[0].Source != "ldap" || records[0].ID != 0 {
+		t.Errorf("Resolve = %+v, %v", records, ok)
+	}
+	if err := s.Delete(0); err == nil {
+		t.Error("expected source records to be read-only")
+	}
+
+	// Only local records are persisted
+	s2, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s2.List()) != 1 {
+		t.Errorf("reloaded store has %d records, want 1", len(s2.List()))
+	}
+
+	changes = nil
+	s.SetSource("ldap", []Record{{Domain: "web2.hosts.lan", Type: "A", Value: "10.0.0.6"}})
+	if len(changes) != 1 || changes[0].Op != "delete" || changes[0].Old.Domain != "web1.hosts.lan" {
+		t.Errorf("changes = %+v, want web1 deleted", changes)
+	}
+	s.SetSource("ldap", nil)
+	if len(s.List()) != 1 {
+		t.Errorf("List() returned %d records after clearing the source, want 1", len(s.List()))
+	}
+}
+
+func TestStoreResolveView(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.tsv")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(Record{Domain: "nas.local", Type: "A", Value: "100.64.0.5", View: "tailnet"})
+	s.Add(Record{Domain: "nas.local", Type: "A", Value: "192.168.1.5"})
+	s.Add(Record{Domain: "www.local", Type: "CNAME", Value: "nas.local"})
+
+	recs, _ := s.ResolveView("nas.local", 1, "tailnet")
+	if len(recs) != 1 || recs[0].Value != "100.64.0.5" {
+		t.Errorf("tailnet view = %+v, want the tailnet address", recs)
+	}
+	recs, _ = s.ResolveView("nas.local", 1, "lan")
+	if len(recs) != 1 || recs[0].Value != "192.168.1.5" {
+		t.Errorf("lan view = %+v, want the shared address", recs)
+	}
+	// CNAME targets are looked up in the same view
+	recs, _ = s.ResolveView("www.local", 1, "tailnet")
+	if len(recs) != 2 || recs[1].Value != "100.64.0.5" {
+		t.Errorf("tailnet CNAME chain = %+v", recs)
+	}
+
+	// The view survives a reload
+	s2, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := s2.List(); len(list) != 3 || list[0].View != "tailnet" || list[1].View != "" {
+		t.Errorf("reloaded records = %+v", list)
+	}
+}
+
 func TestStorePersistence(t *testing.T) {
 	path := filepath.Join(t.TempDir(), "records.tsv")
 
@@ -273,6 +463,210 @@ func TestStoreSaveFormat(t *testing.T) {
 	}
 }
 
+func TestStoreFsync(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "records.tsv")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetFsync(true)
+	if _, err := s.Add(Record{Domain: "app.local", Type: "A", Value: "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "1\tapp.local\tA\t10.0.0.1\n" {
+		t.Errorf("file contents = %q", data)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temp files left behind: %v", entries)
+	}
+}
+
+func TestStoreComment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.tsv")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(Record{Domain: "legacy-db.local", Type: "A", Value: "10.0.0.7", Comment: "old rack, until the migration"})
+	s.Add(Record{Domain: "nas.local", Type: "A", Value: "10.0.0.8", View: "lan"})
+
+	data, _ := os.ReadFile(path)
+	want := "1\tlegacy-db.local\tA\t10.0.0.7\t\told rack, until the migration\n2\tnas.local\tA\t10.0.0.8\tlan\n"
+	if string(data) != want {
+		t.Errorf("file contents = %q, want %q", data, want)
+	}
+
+	s.Update(2, Record{Domain: "nas.local", Type: "A", Value: "10.0.0.8", View: "lan", Comment: "synology", Tags: "public"})
+	data, _ = os.ReadFile(path)
+	if want := "2\tnas.local\tA\t10.0.0.8\tlan\tsynology\t\t\tpublic\n"; !bytes.HasSuffix(data, []byte(want)) {
+		t.Errorf("file contents = %q, want tags in the last column", data)
+	}
+	s2, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := s2.List()
+	if len(list) != 2 || list[0].Comment != "old rack, until the migration" || list[0].View != "" ||
+		list[1].Comment != "synology" || list[1].View != "lan" || list[1].Tags != "public" {
+		t.Errorf("after reload: %+v", list)
+	}
+}
+
+func TestStoreDisabled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.tsv")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(Record{Domain: "app.local", Type: "A", Value: "10.0.0.1", Disabled: true})
+	s.Add(Record{Domain: "app.local", Type: "A", Value: "10.0.0.2"})
+
+	recs, ok := s.Resolve("app.local", 1)
+	if !ok || len(recs) != 1 || recs[0].Value != "10.0.0.2" {
+		t.Errorf("Resolve = %+v, %v; want only the enabled record", recs, ok)
+	}
+	s.Update(2, Record{Domain: "app.local", Type: "A", Value: "10.0.0.2", Disabled: true})
+	if _, ok := s.Resolve("app.local", 1); ok {
+		t.Error("a name with only disabled records is still managed")
+	}
+
+	s2, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := s2.List(); len(list) != 2 || !list[0].Disabled || !list[1].Disabled {
+		t.Errorf("after reload: %+v", list)
+	}
+	s2.Update(1, Record{Domain: "app.local", Type: "A", Value: "10.0.0.1"})
+	if recs, _ := s2.Resolve("app.local", 1); len(recs) != 1 || recs[0].ID != 1 {
+		t.Errorf("re-enabled record: %+v", recs)
+	}
+}
+
+func TestStoreExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.tsv")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Second)
+	s.Add(Record{Domain: "pr-41.preview.local", Type: "A", Value: "10.0.0.41", Expires: now.Add(-time.Minute)})
+	s.Add(Record{Domain: "pr-42.preview.local", Type: "A", Value: "10.0.0.42", Expires: now.Add(time.Hour)})
+	s.Add(Record{Domain: "app.local", Type: "CNAME", Value: "pr-41.preview.local"})
+
+	if _, ok := s.Resolve("pr-41.preview.local", 1); ok {
+		t.Error("expired record still resolves")
+	}
+	if recs, _ := s.Resolve("app.local", 1); len(recs) != 1 {
+		t.Errorf("CNAME chase reached an expired record: %+v", recs)
+	}
+	if recs, _ := s.Resolve("pr-42.preview.local", 1); len(recs) != 1 {
+		t.Errorf("unexpired record: %+v", recs)
+	}
+
+	s2, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := s2.List(); len(list) != 3 || !list[1].Expires.Equal(now.Add(time.Hour)) {
+		t.Fatalf("after reload: %+v", list)
+	}
+	n, err := s2.Expire(now)
+	if err != nil || n != 1 {
+		t.Fatalf("Expire = %d, %v; want 1", n, err)
+	}
+	if n, _ := s2.Expire(now.Add(2 * time.Hour)); n != 1 || len(s2.List()) != 1 {
+		t.Errorf("second Expire removed %d, left %+v", n, s2.List())
+	}
+}
+
+func TestStoreBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.tsv")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(Record{Domain: "api.local", Type: "A", Value: "10.0.0.1"})
+	s.Add(Record{Domain: "api.local", Type: "A", Value: "10.0.0.2"})
+	var seen []string
+	s.Subscribe(func(c Change) { seen = append(seen, c.Op) })
+
+	// A missing ID anywhere leaves everything as it was
+	_, err = s.Batch([]BatchOp{
+		{Op: "delete", ID: 1},
+		{Op: "create", Record: Record{Domain: "api.local", Type: "A", Value: "10.0.0.3"}},
+		{Op: "update", ID: 9, Record: Record{Domain: "api.local", Type: "A", Value: "10.0.0.4"}},
+	})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("err = %v, want ErrNotExist", err)
+	}
+	if len(s.List()) != 2 || len(seen) != 0 {
+		t.Fatalf("failed batch changed the store: %+v, changes %v", s.List(), seen)
+	}
+
+	changes, err := s.Batch([]BatchOp{
+		{Op: "delete", ID: 1},
+		{Op: "update", ID: 2, Record: Record{Domain: "API.local", Type: "a", Value: "10.0.0.5"}},
+		{Op: "create", Record: Record{Domain: "api.local", Type: "A", Value: "10.0.0.6"}},
+	})
+	if err != nil || len(changes) != 3 || changes[2].New.ID != 3 {
+		t.Fatalf("Batch = %+v, %v", changes, err)
+	}
+	if !slices.Equal(seen, []string{"delete", "update", "add"}) {
+		t.Errorf("listeners saw %v", seen)
+	}
+	recs, _ := s.Resolve("api.local", 1)
+	if len(recs) != 2 || recs[0].Value != "10.0.0.5" || recs[1].Value != "10.0.0.6" {
+		t.Errorf("Resolve after batch: %+v", recs)
+	}
+	data, _ := os.ReadFile(path)
+	if want := "2\tapi.local\tA\t10.0.0.5\n3\tapi.local\tA\t10.0.0.6\n"; string(data) != want {
+		t.Errorf("file contents = %q, want %q", data, want)
+	}
+}
+
+func TestStoreSetRRSet(t *testing.T) {
+	s, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(Record{Domain: "app.local", Type: "A", Value: "10.0.0.1"})
+	s.Add(Record{Domain: "app.local", Type: "A", Value: "10.0.0.2"})
+	s.Add(Record{Domain: "app.local", Type: "A", Value: "10.0.0.2", View: "lan"})
+	s.Add(Record{Domain: "app.local", Type: "AAAA", Value: "fd00::1"})
+
+	set, changes, err := s.SetRRSet("App.local", "a", "", []Record{
+		{Value: "10.0.0.2", Comment: "kept"},
+		{Value: "10.0.0.3"},
+		{Value: "10.0.0.3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 {
+		t.Errorf("changes = %+v, want a delete, an update and an add", changes)
+	}
+	want := []Record{
+		{ID: 2, Domain: "app.local", Type: "A", Value: "10.0.0.2", Comment: "kept"},
+		{ID: 5, Domain: "app.local", Type: "A", Value: "10.0.0.3"},
+	}
+	if !slices.Equal(set, want) {
+		t.Errorf("set = %+v, want %+v", set, want)
+	}
+	if len(s.List()) != 4 {
+		t.Errorf("records outside the set changed: %+v", s.List())
+	}
+
+	// The same request again changes nothing
+	if _, changes, _ := s.SetRRSet("app.local", "A", "", set); len(changes) != 0 {
+		t.Errorf("repeated request made changes: %+v", changes)
+	}
+	if set, _, _ := s.SetRRSet("app.local", "A", "", nil); len(set) != 0 || len(s.List()) != 2 {
+		t.Errorf("emptying the set left %+v", s.List())
+	}
+}
+
 func TestStoreLoadNextIDAfterSkippedLines(t *testing.T) {
 	path := filepath.Join(t.TempDir(), "records.tsv")
 	data := "1\tapp.local\tA\t10.0.0.1\nbad line\n5\tdb.local\tA\t10.0.0.2\n"
@@ -294,3 +688,177 @@ func TestStoreLoadNextIDAfterSkippedLines(t *testing.T) {
 		t.Errorf("next ID = %d, want 6", rec.ID)
 	}
 }
+
+func TestStoreResolveDuringWrite(t *testing.T) {
+	s, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(Record{Domain: "app.local", Type: "A", Value: "10.0.0.1"})
+
+	// A writer holding the lock, e.g. while saving, doesn't hold up lookups
+	s.mu.Lock()
+	done := make(chan []Record, 1)
+	go func() {
+		recs, _ := s.Resolve("app.local", 1)
+		done <- recs
+	}()
+	select {
+	case recs := <-done:
+		if len(recs) != 1 {
+			t.Errorf("Resolve = %+v", recs)
+		}
+	case <-time.After(time.Second):
+		t.Error("Resolve blocked on the store lock")
+	}
+	s.mu.Unlock()
+}
+
+func TestStoreResolveCNAMEChase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.tsv")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Add(Record{Domain: "www.local", Type: "CNAME", Value: "alias.local"})
+	s.Add(Record{Domain: "alias.local", Type: "CNAME", Value: "target.local."})
+	s.Add(Record{Domain: "target.local", Type: "A", Value: "10.0.0.1"})
+	s.Add(Record{Domain: "target.local", Type: "A", Value: "10.0.0.2"})
+
+	recs, auth := s.Resolve("www.local", 1)
+	if !auth {
+		t.Error("expected authoritative")
+	}
+	want := []string{"CNAME", "CNAME", "A", "A"}
+	if len(recs) != len(want) {
+		t.Fatalf("expected %d records, got %d: %+v", len(want), len(recs), recs)
+	}
+	for i, typ := range want {
+		if recs[i].Type != typ {
+			t.Errorf("recs[%d].Type = %s, want %s", i, recs[i].Type, typ)
+		}
+	}
+
+	// CNAME query returns only the CNAME itself
+	recs, _ = s.Resolve("www.local", 5)
+	if len(recs) != 1 {
+		t.Errorf("expected 1 record for CNAME query, got %d", len(recs))
+	}
+
+	// Target outside the store ends the chain at the CNAME
+	s.Add(Record{Domain: "ext.local", Type: "CNAME", Value: "example.com"})
+	recs, _ = s.Resolve("ext.local", 1)
+	if len(recs) != 1 {
+		t.Errorf("expected 1 record for external target, got %d", len(recs))
+	}
+}
+
+func TestStoreResolveCNAMELoop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.tsv")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Add(Record{Domain: "a.local", Type: "CNAME", Value: "b.local"})
+	s.Add(Record{Domain: "b.local", Type: "CNAME", Value: "a.local"})
+
+	recs, auth := s.Resolve("a.local", 1)
+	if !auth {
+		t.Error("expected authoritative")
+	}
+	if len(recs) != 2 {
+		t.Errorf("expected loop to stop after 2 records, got %d", len(recs))
+	}
+}
+
+func TestStoreSerialAndSubscribe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.tsv")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var changes []Change
+	s.Subscribe(func(c Change) { changes = append(changes, c) })
+
+	before := s.Serial()
+	rec, _ := s.Add(Record{Domain: "app.local", Type: "A", Value: "10.0.0.1"})
+	s.Update(rec.ID, Record{Domain: "app.local", Type: "A", Value: "10.0.0.2"})
+	s.Delete(rec.ID)
+	s.Delete(rec.ID) // not found, no change
+
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes, got %d", len(changes))
+	}
+	ops := []string{"add", "update", "delete"}
+	for i, op := range ops {
+		if changes[i].Op != op {
+			t.Errorf("changes[%d].Op = %s, want %s", i, changes[i].Op, op)
+		}
+	}
+	if changes[1].Old.Value != "10.0.0.1" || changes[1].New.Value != "10.0.0.2" {
+		t.Errorf("update change = %+v / %+v", changes[1].Old, changes[1].New)
+	}
+	if changes[0].Serial <= before || changes[2].Serial <= changes[1].Serial {
+		t.Errorf("serials not increasing: %d, %d, %d, %d", before, changes[0].Serial, changes[1].Serial, changes[2].Serial)
+	}
+	if s.Serial() != changes[2].Serial {
+		t.Errorf("Serial() = %d, want %d", s.Serial(), changes[2].Serial)
+	}
+}
+
+func TestStoreReplace(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := store.Add(Record{Domain: "a.test", Type: "A", Value: "10.0.0.1"})
+	store.Add(Record{Domain: "b.test", Type: "A", Value: "10.0.0.2"})
+
+	var ops []string
+	store.Subscribe(func(c Change) { ops = append(ops, c.Op) })
+	err = store.Replace([]Record{
+		{ID: a.ID, Domain: "a.test", Type: "A", Value: "10.0.0.9"},
+		{ID: 7, Domain: "C.test", Type: "aaaa", Value: "fd00::1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 3 || ops[0] != "update" || ops[1] != "add" || ops[2] != "delete" {
+		t.Errorf("ops = %v", ops)
+	}
+	if recs, ok := store.Resolve("c.test", 28); !ok || len(recs) != 1 {
+		t.Errorf("resolve c.test = %+v", recs)
+	}
+	if r, _ := store.Add(Record{Domain: "d.test", Type: "A", Value: "10.0.0.4"}); r.ID != 8 {
+		t.Errorf("next id = %d, want 8", r.ID)
+	}
+}
+
+func BenchmarkResolve(b *testing.B) {
+	store, err := NewStore(filepath.Join(b.TempDir(), "records.tsv"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	// A name with many records of other types, as an apex with its TXT
+	// verifications tends to have, and a CNAME pointing at it
+	for i := range 20 {
+		store.Add(Record{Domain: "example.com", Type: "TXT", Value: fmt.Sprintf("verification=%d", i)})
+	}
+	store.Add(Record{Domain: "example.com", Type: "A", Value: "10.0.0.1"})
+	store.Add(Record{Domain: "example.com", Type: "AAAA", Value: "fd00::1"})
+	store.Add(Record{Domain: "www.example.com", Type: "CNAME", Value: "example.com"})
+
+	for _, name := range []string{"example.com", "www.example.com"} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if recs, _ := store.Resolve(name, 1); len(recs) == 0 {
+					b.Fatal("no records")
+				}
+			}
+		})
+	}
+}
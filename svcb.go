@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// svcParamKeys are the SvcParams we accept in SVCB and HTTPS records
+// (RFC 9460 §14.3.2), in wire order.
+var svcParamKeys = []svcParamKey{
+	{"alpn", 1}, {"no-default-alpn", 2}, {"port", 3}, {"ipv4hint", 4}, {"ipv6hint", 6},
+}
+
+type svcParamKey struct {
+	name string
+	key  uint16
+}
+
+func svcParamName(key uint16) string {
+	for _, p := range svcParamKeys {
+		if p.key == key {
+			return p.name
+		}
+	}
+	return "key" + strconv.Itoa(int(key))
+}
+
+// parseSVCB parses the value of an SVCB or HTTPS record in presentation form,
+// "priority target [key=value ...]", e.g. "1 . alpn=h2,h3 port=8443", and
+// returns its RDATA. Priority 0 is alias mode, which takes no parameters.
+func parseSVCB(value string) ([]byte, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 2 {
+		return nil, errors.New("want priority, target and optional key=value parameters")
+	}
+	priority, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid priority %q", fields[0])
+	}
+	if priority == 0 && len(fields) > 2 {
+		return nil, errors.New("alias mode (priority 0) takes no parameters")
+	}
+	target := fields[1]
+	if target != "." && (strings.Contains(target, "..") || strings.HasPrefix(target, ".")) {
+		return nil, fmt.Errorf("invalid target %q", target)
+	}
+
+	params := map[uint16][]byte{}
+	for _, f := range fields[2:] {
+		name, v, hasValue := strings.Cut(strings.ToLower(f), "=")
+		i := slices.IndexFunc(svcParamKeys, func(p svcParamKey) bool { return p.name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("unsupported parameter %q", name)
+		}
+		key := svcParamKeys[i].key
+		if _, dup := params[key]; dup {
+			return nil, fmt.Errorf("duplicate parameter %q", name)
+		}
+		if hasValue == (key == 2) {
+			if key == 2 {
+				return nil, errors.New("no-default-alpn takes no value")
+			}
+			return nil, fmt.Errorf("parameter %q needs a value", name)
+		}
+		var data []byte
+		switch key {
+		case 1:
+			for _, id := range strings.Split(v, ",") {
+				if id == "" || len(id) > 255 {
+					return nil, fmt.Errorf("invalid alpn %q", v)
+				}
+				data = append(data, byte(len(id)))
+				data = append(data, id...)
+			}
+		case 3:
+			port, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %q", v)
+			}
+			data = binary.BigEndian.AppendUint16(nil, uint16(port))
+		case 4, 6:
+			for _, a := range strings.Split(v, ",") {
+				addr, err := netip.ParseAddr(a)
+				if err != nil || addr.Is4() != (key == 4) {
+					return nil, fmt.Errorf("invalid %s %q", name, a)
+				}
+				data = append(data, addr.AsSlice()...)
+			}
+		}
+		params[key] = data
+	}
+	if _, ok := params[2]; ok && params[1] == nil {
+		return nil, errors.New("no-default-alpn requires alpn")
+	}
+
+	rdata := binary.BigEndian.AppendUint16(nil, uint16(priority))
+	rdata = append(rdata, encodeDNSName(target)...)
+	for _, p := range svcParamKeys {
+		if data, ok := params[p.key]; ok {
+			rdata = binary.BigEndian.AppendUint16(rdata, p.key)
+			rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(data)))
+			rdata = append(rdata, data...)
+		}
+	}
+	return rdata, nil
+}
+
+// formatSVCB renders SVCB or HTTPS RDATA in the presentation form parseSVCB
+// reads. The target is never compressed, so rdata stands alone.
+func formatSVCB(rdata []byte) (string, bool) {
+	if len(rdata) < 3 {
+		return "", false
+	}
+	target, off := parseDNSName(rdata, 2)
+	if off < 0 {
+		return "", false
+	}
+	if target == "" {
+		target = "."
+	}
+	parts := []string{strconv.Itoa(int(binary.BigEndian.Uint16(rdata))), strings.ToLower(target)}
+	for off < len(rdata) {
+		if off+4 > len(rdata) {
+			return "", false
+		}
+		key := binary.BigEndian.Uint16(rdata[off:])
+		data := rdata[off+4:]
+		n := int(binary.BigEndian.Uint16(rdata[off+2:]))
+		if n > len(data) {
+			return "", false
+		}
+		data, off = data[:n], off+4+n
+
+		var values []string
+		switch key {
+		case 1:
+			for i := 0; i < len(data); {
+				l := int(data[i])
+				if i+1+l > len(data) {
+					return "", false
+				}
+				values = append(values, string(data[i+1:i+1+l]))
+				i += 1 + l
+			}
+		case 2:
+			parts = append(parts, "no-default-alpn")
+			continue
+		case 3:
+			if len(data) != 2 {
+				return "", false
+			}
+			values = append(values, strconv.Itoa(int(binary.BigEndian.Uint16(data))))
+		case 4, 6:
+			size := 4
+			if key == 6 {
+				size = 16
+			}
+			if len(data)%size != 0 {
+				return "", false
+			}
+			for i := 0; i < len(data); i += size {
+				values = append(values, net.IP(data[i:i+size]).String())
+			}
+		default:
+			values = append(values, fmt.Sprintf("%q", data))
+		}
+		parts = append(parts, svcParamName(key)+"="+strings.Join(values, ","))
+	}
+	return strings.Join(parts, " "), true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSVCBRoundTrip(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string // canonical form; empty means unchanged
+	}{
+		{value: "1 ."},
+		{value: "0 cdn.example.com"},
+		{value: "1 . alpn=h2,h3 port=8443 ipv4hint=10.0.0.1,10.0.0.2"},
+		{value: "2 svc.my.lan alpn=h3 no-default-alpn ipv6hint=fd00::1"},
+		{value: "1 Svc.My.Lan. IPv4Hint=10.0.0.1 ALPN=h2", want: "1 svc.my.lan alpn=h2 ipv4hint=10.0.0.1"},
+	}
+	for _, tt := range tests {
+		rdata, err := parseSVCB(tt.value)
+		if err != nil {
+			t.Errorf("parseSVCB(%q): %v", tt.value, err)
+			continue
+		}
+		want := tt.want
+		if want == "" {
+			want = tt.value
+		}
+		if got, ok := formatSVCB(rdata); !ok || got != want {
+			t.Errorf("formatSVCB(parseSVCB(%q)) = %q, want %q", tt.value, got, want)
+		}
+	}
+
+	for _, bad := range []string{
+		"x .",
+		"0 . alpn=h2",
+		"1 . port=99999",
+		"1 . ipv4hint=fd00::1",
+		"1 . alpn=h2 alpn=h3",
+		"1 . no-default-alpn",
+		"1 . port",
+		"1 ..bad",
+	} {
+		if _, err := parseSVCB(bad); err == nil {
+			t.Errorf("parseSVCB(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestDNSHTTPSRecord(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Record{Domain: "app.my.lan", Type: "HTTPS", Value: "1 . alpn=h2 ipv4hint=10.0.0.2"})
+	store.Add(Record{Domain: "app.my.lan", Type: "A", Value: "10.0.0.2"})
+	store.Add(Record{Domain: "www.my.lan", Type: "CNAME", Value: "app.my.lan"})
+	addr := startDNSServer(t, NewDNSServer(store, nil))
+
+	m, err := parseMessage(exchange(t, addr, buildTestQuery("www.my.lan", 65, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answers) != 2 || m.Answers[1].Type != 65 || m.Answers[1].Data != "1 . alpn=h2 ipv4hint=10.0.0.2" {
+		t.Errorf("HTTPS answers through CNAME = %+v", m.Answers)
+	}
+
+	// A local name without an SVCB record answers NODATA rather than forwarding
+	m, err = parseMessage(exchange(t, addr, buildTestQuery("app.my.lan", 64, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.RCode != 0 || len(m.Answers) != 0 {
+		t.Errorf("SVCB query = rcode %s, answers %+v", rcodeString(m.RCode), m.Answers)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSyslogTag = "regieleki"
+	syslogFacility   = 3 // daemon
+	syslogTimeout    = 5 * time.Second
+)
+
+// syslogSockets are where the local syslog daemon listens, by platform.
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// SyslogWriter sends each log line written to it as one RFC 5424 message,
+// to the local syslog socket or to a remote collector over UDP, or over TCP
+// with octet-counted framing (RFC 6587). Lines come from a slog text
+// handler without the time attribute, so the leading level=... picks the
+// severity and the syslog header carries the time.
+type SyslogWriter struct {
+	network string // "unixgram", "udp" or "tcp"
+	addr    string
+	tag     string
+	host    string
+	pid     string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslogWriter parses addr: empty for the local daemon, or
+// udp://host[:port] or tcp://host[:port] for a remote one. The connection
+// is opened on the first write, and again after a failed one.
+func NewSyslogWriter(addr, tag string) (*SyslogWriter, error) {
+	if tag == "" {
+		tag = defaultSyslogTag
+	}
+	host, _ := os.Hostname()
+	w := &SyslogWriter{tag: tag, host: syslogNil(host), pid: strconv.Itoa(os.Getpid())}
+	if addr == "" {
+		w.network = "unixgram"
+		return w, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		w.network, w.addr = u.Scheme, hostPortDefault(u.Host, "514")
+	default:
+		return nil, fmt.Errorf("syslog: unsupported address %q (want udp://host[:port] or tcp://host[:port])", addr)
+	}
+	return w, nil
+}
+
+// syslogNil returns s, or the RFC 5424 NILVALUE if it is empty.
+func syslogNil(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (w *SyslogWriter) dial() (net.Conn, error) {
+	if w.network != "unixgram" {
+		return net.DialTimeout(w.network, w.addr, syslogTimeout)
+	}
+	var errs []error
+	for _, path := range syslogSockets {
+		conn, err := net.Dial("unixgram", path)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("no local syslog: %w", errors.Join(errs...))
+}
+
+// syslogSeverity maps the level a text handler line starts with to a
+// syslog severity, and returns the rest of the line.
+func syslogSeverity(line []byte) (int, []byte) {
+	level, rest, ok := bytes.Cut(line, []byte(" "))
+	if !ok || !bytes.HasPrefix(level, []byte("level=")) {
+		return 6, line
+	}
+	switch l := string(level[len("level="):]); {
+	case strings.HasPrefix(l, "ERROR"):
+		return 3, rest
+	case strings.HasPrefix(l, "WARN"):
+		return 4, rest
+	case strings.HasPrefix(l, "DEBUG"):
+		return 7, rest
+	}
+	return 6, rest
+}
+
+// format builds the RFC 5424 message for one log line.
+func (w *SyslogWriter) format(line []byte, now time.Time) []byte {
+	severity, msg := syslogSeverity(bytes.TrimRight(line, "\n"))
+	header := fmt.Sprintf("<%d>1 %s %s %s %s - - ", syslogFacility*8+severity,
+		now.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), w.host, w.tag, w.pid)
+	out := append([]byte(header), msg...)
+	if w.network == "tcp" {
+		out = append([]byte(strconv.Itoa(len(out))+" "), out...)
+	}
+	return out
+}
+
+// Write sends p as one message. A send that fails is retried once on a new
+// connection, so a restarted collector is picked up again.
+func (w *SyslogWriter) Write(p []byte) (int, error) {
+	msg := w.format(p, time.Now())
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var err error
+	for range 2 {
+		if w.conn == nil {
+			if w.conn, err = w.dial(); err != nil {
+				return 0, err
+			}
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err = w.conn.Write(msg); err == nil {
+			return len(p), nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return 0, err
+}
+
+func (w *SyslogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// newSyslogHandler logs as a text handler would, minus the time, to w.
+func newSyslogHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	return slog.NewTextHandler(w, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+}
+
+// teeHandler hands each record to every one of its handlers that is
+// enabled for it, so logs can go to stderr and syslog at once.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+// logHandler builds the handler for -log, a comma-separated list of
+// outputs: stderr and syslog.
+func logHandler(outputs, syslogAddr, syslogTag string, level slog.Level) (slog.Handler, error) {
+	var handlers teeHandler
+	for _, out := range strings.Split(outputs, ",") {
+		switch strings.TrimSpace(out) {
+		case "stderr":
+			handlers = append(handlers, slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+		case "syslog":
+			w, err := NewSyslogWriter(syslogAddr, syslogTag)
+			if err != nil {
+				return nil, err
+			}
+			handlers = append(handlers, newSyslogHandler(w, level))
+		default:
+			return nil, fmt.Errorf("unknown log output %q (want stderr or syslog)", out)
+		}
+	}
+	if len(handlers) == 1 {
+		return handlers[0], nil
+	}
+	return handlers, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogFormat(t *testing.T) {
+	w := &SyslogWriter{network: "udp", tag: "regieleki", host: "gw", pid: "42"}
+	now := time.Date(2026, 10, 16, 8, 30, 0, 0, time.UTC)
+	got := string(w.format([]byte("level=WARN msg=\"upstream down\" upstream=1.1.1.1:53\n"), now))
+	want := `<28>1 2026-10-16T08:30:00.000000Z gw regieleki 42 - - msg="upstream down" upstream=1.1.1.1:53`
+	if got != want {
+		t.Errorf("udp message:\n%s\nwant:\n%s", got, want)
+	}
+
+	w.network = "tcp"
+	got = string(w.format([]byte("level=ERROR msg=x\n"), now))
+	if body := `<27>1 2026-10-16T08:30:00.000000Z gw regieleki 42 - - msg=x`; got != "59 "+body {
+		t.Errorf("tcp message = %q", got)
+	}
+}
+
+func TestSyslogHandlerUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	h, err := logHandler("syslog", "udp://"+pc.LocalAddr().String(), "dns", slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	logger.Debug("not sent")
+	logger.Info("zone changed", "zone", "my.lan")
+
+	buf := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<30>1 ") || !strings.Contains(msg, " dns ") || !strings.HasSuffix(msg, " - - msg=\"zone changed\" zone=my.lan") {
+		t.Errorf("message = %q", msg)
+	}
+}
+
+func TestSyslogHandlerTCPReconnects(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lines := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// Read one message per connection, then hang up
+			line, _ := bufio.NewReader(conn).ReadString('>')
+			if line != "" {
+				lines <- line
+			}
+			conn.Close()
+		}
+	}()
+	w, err := NewSyslogWriter("tcp://"+ln.Addr().String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	// A write into the hung-up connection can still succeed locally and be
+	// lost; the failure it provokes makes a later one reconnect
+	deadline := time.After(5 * time.Second)
+	for received := 0; received < 2; {
+		w.Write([]byte("level=INFO msg=hello\n"))
+		select {
+		case <-lines:
+			received++
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("%d messages received, want 2", received)
+		}
+	}
+}
+
+func TestLogHandlerOutputs(t *testing.T) {
+	h, err := logHandler("stderr,syslog", "udp://127.0.0.1:9", "", slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tee, ok := h.(teeHandler); !ok || len(tee) != 2 {
+		t.Errorf("handler = %T, want both outputs", h)
+	}
+	if _, err := logHandler("file", "", "", slog.LevelInfo); err == nil {
+		t.Error("unknown output accepted")
+	}
+	if _, err := logHandler("syslog", "http://collector", "", slog.LevelInfo); err == nil {
+		t.Error("unsupported syslog address accepted")
+	}
+}
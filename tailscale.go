@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTailscaleSocket   = "/var/run/tailscale/tailscaled.sock"
+	defaultTailscaleSchedule = "@every 30s"
+	tailscaleTimeout         = 5 * time.Second
+)
+
+// TailscaleSync publishes the nodes of a Tailscale network as read-only
+// records, read from the local tailscaled's status over its LocalAPI
+// socket. tsnet would pull Tailscale's client into a stdlib-only binary, so
+// instead the host has to be on the tailnet, and no auth key is needed. Each node gets an A and AAAA record per Tailscale
+// address, under its MagicDNS name or, with Zone set, its first label under
+// Zone.
+type TailscaleSync struct {
+	Socket string
+	Zone   string
+	View   string // the records are only served to this view, if set
+	store  *Store
+	client *http.Client
+}
+
+func NewTailscaleSync(store *Store, socket, zone, view string) *TailscaleSync {
+	return &TailscaleSync{
+		Socket: socket,
+		Zone:   strings.ToLower(strings.Trim(zone, ".")),
+		View:   view,
+		store:  store,
+		client: &http.Client{
+			Timeout: tailscaleTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// tailscaleStatus is the part of tailscaled's status we use.
+type tailscaleStatus struct {
+	Self *tailscaleNode
+	Peer map[string]*tailscaleNode
+}
+
+type tailscaleNode struct {
+	HostName     string
+	DNSName      string // the MagicDNS name, with a trailing dot
+	TailscaleIPs []netip.Addr
+}
+
+// Run replaces the published nodes with the current ones. A failed read
+// keeps the previous set.
+func (t *TailscaleSync) Run(ctx context.Context) error {
+	// The LocalAPI only answers requests addressed to this host name
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/status", nil)
+	if err != nil {
+		return err
+	}
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("tailscaled status: %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	var status tailscaleStatus
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		return fmt.Errorf("tailscaled status: %w", err)
+	}
+
+	records := tailscaleRecords(status, t.Zone, t.View)
+	t.store.SetSource("tailscale", records)
+	slog.InfoContext(ctx, "tailscale sync finished", "nodes", len(status.Peer)+1, "records", len(records))
+	return nil
+}
+
+func tailscaleRecords(status tailscaleStatus, zone, view string) []Record {
+	nodes := make([]*tailscaleNode, 0, len(status.Peer)+1)
+	if status.Self != nil {
+		nodes = append(nodes, status.Self)
+	}
+	for _, n := range status.Peer {
+		nodes = append(nodes, n)
+	}
+	var records []Record
+	for _, n := range nodes {
+		name := strings.ToLower(strings.TrimSuffix(n.DNSName, "."))
+		if name == "" {
+			// Without MagicDNS the host name is all there is
+			name = strings.ToLower(n.HostName)
+		}
+		if zone != "" {
+			label, _, _ := strings.Cut(name, ".")
+			name = label + "." + zone
+		}
+		if name == "" || strings.HasPrefix(name, ".") {
+			continue
+		}
+		for _, addr := range n.TailscaleIPs {
+			rtype := "A"
+			if addr.Is6() {
+				rtype = "AAAA"
+			}
+			records = append(records, Record{Domain: name, Type: rtype, Value: addr.String(), View: view})
+		}
+	}
+	return records
+}
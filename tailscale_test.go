@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"path/filepath"
+	"testing"
+)
+
+const tailscaleStatusJSON = `{
+  "Self": {"HostName": "gw", "DNSName": "gw.tail1234.ts.net.", "TailscaleIPs": ["100.64.0.1", "fd7a:115c:a1e0::1"]},
+  "Peer": {
+    "nodekey:1": {"HostName": "NAS", "DNSName": "nas.tail1234.ts.net.", "TailscaleIPs": ["100.64.0.2"]},
+    "nodekey:2": {"HostName": "phone", "DNSName": "", "TailscaleIPs": ["100.64.0.3"]}
+  }
+}`
+
+func TestTailscaleSync(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "tailscaled.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/localapi/v0/status" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(tailscaleStatusJSON))
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	store, err := NewStore(filepath.Join(dir, "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync := NewTailscaleSync(store, socket, "", "tailnet")
+	if err := sync.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	recs, ok := store.ResolveView("nas.tail1234.ts.net", 1, "tailnet")
+	if !ok || len(recs) != 1 || recs[0].Value != "100.64.0.2" || recs[0].Source != "tailscale" {
+		t.Fatalf("nas: %+v", recs)
+	}
+	if recs, _ := store.ResolveView("gw.tail1234.ts.net", 28, "tailnet"); len(recs) != 1 || recs[0].Value != "fd7a:115c:a1e0::1" {
+		t.Errorf("gw AAAA: %+v", recs)
+	}
+	if recs, _ := store.ResolveView("phone", 1, "tailnet"); len(recs) != 1 {
+		t.Errorf("phone without MagicDNS: %+v", recs)
+	}
+	// Other views don't see the tailnet
+	if recs, _ := store.ResolveView("nas.tail1234.ts.net", 1, "lan"); len(recs) != 0 {
+		t.Errorf("lan view: %+v", recs)
+	}
+}
+
+func TestTailscaleRecordsZone(t *testing.T) {
+	status := tailscaleStatus{Peer: map[string]*tailscaleNode{
+		"a": {HostName: "nas", DNSName: "nas.tail1234.ts.net.", TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.2")}},
+	}}
+	records := tailscaleRecords(status, "ts.home.lan", "")
+	if len(records) != 1 || records[0].Domain != "nas.ts.home.lan" || records[0].Type != "A" {
+		t.Errorf("records = %+v", records)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// CertReloader serves a certificate and key from files, re-reading them on
+// Reload, so a renewed certificate is picked up without a restart. A failed
+// reload keeps the previous certificate in use.
+type CertReloader struct {
+	certPath, keyPath string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+// LoadCertReloader reads the certificate and key, failing if they don't
+// form a usable pair.
+func LoadCertReloader(certPath, keyPath string) (*CertReloader, error) {
+	c := &CertReloader{certPath: certPath, keyPath: keyPath}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+// GetCertificate is for tls.Config.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := c.cert.Load()
+	if cert == nil {
+		return nil, errors.New("no certificate yet")
+	}
+	return cert, nil
+}
+
+// NotAfter is when the current certificate expires, or the zero time if
+// there is none.
+func (c *CertReloader) NotAfter() time.Time {
+	cert := c.cert.Load()
+	if cert == nil {
+		return time.Time{}
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return time.Time{}
+	}
+	return leaf.NotAfter
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a fresh self-signed certificate and key to PEM files
+// and returns when it expires.
+func writeTestCert(t *testing.T, certPath, keyPath string, lifetime time.Duration) time.Time {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		DNSNames:     []string{"dns.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(lifetime).Truncate(time.Second),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return tmpl.NotAfter
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if _, err := LoadCertReloader(certPath, keyPath); err == nil {
+		t.Error("loaded missing files")
+	}
+
+	first := writeTestCert(t, certPath, keyPath, time.Hour)
+	c, err := LoadCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.NotAfter().Equal(first) {
+		t.Errorf("NotAfter = %v, want %v", c.NotAfter(), first)
+	}
+
+	renewed := writeTestCert(t, certPath, keyPath, 48*time.Hour)
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.NotAfter().Equal(renewed) {
+		t.Errorf("NotAfter after reload = %v, want %v", c.NotAfter(), renewed)
+	}
+
+	// A broken file, e.g. one caught mid-write, keeps the certificate
+	os.WriteFile(keyPath, []byte("garbage"), 0o600)
+	if err := c.Reload(); err == nil {
+		t.Error("reloaded a broken key")
+	}
+	if cert, _ := c.GetCertificate(nil); cert == nil || !c.NotAfter().Equal(renewed) {
+		t.Error("failed reload dropped the certificate")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TraceStep is one decision made while resolving a query.
+type TraceStep struct {
+	Stage     string  `json:"stage"`  // chaos, zone, records, blocklist, cache, upstream, stale
+	Result    string  `json:"result"` // what the stage decided, e.g. hit or miss
+	Detail    string  `json:"detail,omitempty"`
+	ElapsedMS float64 `json:"elapsed_ms"` // since resolution started
+}
+
+// resolveTrace collects the steps of one traced resolution. Methods are
+// no-ops on a nil trace, which is what untraced queries carry.
+type resolveTrace struct {
+	start time.Time
+	steps []TraceStep
+}
+
+type traceKey struct{}
+
+func withTrace(ctx context.Context, t *resolveTrace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+func traceFrom(ctx context.Context) *resolveTrace {
+	t, _ := ctx.Value(traceKey{}).(*resolveTrace)
+	return t
+}
+
+func (t *resolveTrace) step(stage, result, format string, args ...any) {
+	if t == nil {
+		return
+	}
+	t.steps = append(t.steps, TraceStep{
+		Stage:     stage,
+		Result:    result,
+		Detail:    fmt.Sprintf(format, args...),
+		ElapsedMS: float64(time.Since(t.start).Microseconds()) / 1000,
+	})
+}
+
+// ResolveResult is the outcome of a traced resolution.
+type ResolveResult struct {
+	Name       string      `json:"name"`
+	Type       string      `json:"type"`
+	View       string      `json:"view,omitempty"`
+	Source     string      `json:"source"`
+	RCode      string      `json:"rcode"`
+	Answers    []string    `json:"answers"`
+	DurationMS float64     `json:"duration_ms"`
+	Trace      []TraceStep `json:"trace"`
+}
+
+// Trace resolves name through the same pipeline as a client query from view,
+// recording why each stage answered or passed. Side effects are real: a
+// forwarded answer is cached, and blocklist and chaos counters move.
+func (s *DNSServer) Trace(ctx context.Context, name string, qtype uint16, view string) (ResolveResult, error) {
+	t := &resolveTrace{start: time.Now()}
+	resp, o := s.resolve(withTrace(ctx, t), buildQuery(name, qtype), view, nil)
+	result := ResolveResult{
+		Name:       name,
+		Type:       typeString(qtype),
+		View:       view,
+		Source:     outcomeNames[o],
+		Answers:    []string{},
+		DurationMS: float64(time.Since(t.start).Microseconds()) / 1000,
+		Trace:      t.steps,
+	}
+	msg, err := parseMessage(resp)
+	if err != nil {
+		return result, err
+	}
+	result.RCode = rcodeString(msg.RCode)
+	for _, rr := range msg.Answers {
+		result.Answers = append(result.Answers, fmt.Sprintf("%s %d %s %s", strings.ToLower(rr.Name), rr.TTL, typeString(rr.Type), rr.Data))
+	}
+	return result, nil
+}
+
+func (s *WebServer) handleResolve(w http.ResponseWriter, r *http.Request) {
+	if s.dns == nil {
+		jsonError(w, "dns server unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	q := r.URL.Query()
+	name := strings.TrimSuffix(strings.TrimSpace(q.Get("name")), ".")
+	if name == "" {
+		jsonError(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	name, err := toASCII(name)
+	if err != nil {
+		jsonError(w, fmt.Sprintf("invalid name: %v", err), http.StatusBadRequest)
+		return
+	}
+	qtype := uint16(1)
+	if t := q.Get("type"); t != "" {
+		var ok bool
+		if qtype, ok = parseType(t); !ok {
+			jsonError(w, "unknown type", http.StatusBadRequest)
+			return
+		}
+	}
+	result, err := s.dns.Trace(r.Context(), name, qtype, q.Get("view"))
+	if err != nil {
+		jsonError(w, "resolving: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// recordsResult names what the local records gave: answers or NODATA.
+func recordsResult(records []Record) string {
+	if len(records) == 0 {
+		return "nodata"
+	}
+	return "match"
+}
+
+func describeRecords(records []Record, view string) string {
+	if len(records) == 0 {
+		if view != "" {
+			return "the name has records, but none of this type in view " + view
+		}
+		return "the name has records, but none of this type"
+	}
+	var parts []string
+	for _, r := range records {
+		s := r.Domain + " " + r.Type + " " + r.Value
+		if r.Source != "" {
+			s += " (via " + r.Source + ")"
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, ", ")
+}
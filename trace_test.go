@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWebResolve(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(filepath.Join(dir, "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Record{Domain: "app.test", Type: "A", Value: "10.0.0.1"})
+	store.Add(Record{Domain: "www.test", Type: "CNAME", Value: "app.test"})
+	fake := startFakeUpstream(t, `example.com A answer 93.184.216.34`)
+	list := filepath.Join(dir, "blocklist.txt")
+	os.WriteFile(list, []byte("ads.test\n"), 0o644)
+
+	ws := NewWebServer(store, nil)
+	ws.dns = NewDNSServer(store, []string{fake.Addr()})
+	ws.dns.cache = NewCache(100)
+	ws.dns.blocklist, _ = NewBlocklist("", []string{list}, false)
+	ws.dns.blocklist.Refresh(context.Background())
+
+	resolve := func(query string) ResolveResult {
+		t.Helper()
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/resolve?"+query, nil))
+		if w.Code != 200 {
+			t.Fatalf("%s: status = %d: %s", query, w.Code, w.Body)
+		}
+		var r ResolveResult
+		json.NewDecoder(w.Body).Decode(&r)
+		return r
+	}
+	stages := func(r ResolveResult) string {
+		var out []string
+		for _, s := range r.Trace {
+			out = append(out, s.Stage+":"+s.Result)
+		}
+		return strings.Join(out, " ")
+	}
+
+	r := resolve("name=www.test")
+	if r.Source != "local" || len(r.Answers) != 2 || stages(r) != "records:match" || !strings.Contains(r.Trace[0].Detail, "www.test CNAME app.test") {
+		t.Errorf("local CNAME: %+v", r)
+	}
+	if r := resolve("name=app.test&type=AAAA"); r.RCode != "NOERROR" || stages(r) != "records:nodata" {
+		t.Errorf("NODATA: %+v", r)
+	}
+	if r := resolve("name=www.ads.test"); r.RCode != "NXDOMAIN" || stages(r) != "records:miss blocklist:blocked" || !strings.Contains(r.Trace[1].Detail, "ads.test is listed by "+list) {
+		t.Errorf("blocked: %+v", r)
+	}
+	if r := resolve("name=example.com&type=A"); r.Source != "forwarded" || stages(r) != "records:miss blocklist:pass cache:miss upstream:ok" || len(r.Answers) != 1 || !strings.HasSuffix(r.Answers[0], " A 93.184.216.34") {
+		t.Errorf("forwarded: %+v", r)
+	}
+	if r := resolve("name=example.com"); r.Source != "cached" || stages(r) != "records:miss blocklist:pass cache:hit" {
+		t.Errorf("cached: %+v", r)
+	}
+
+	for _, q := range []string{"", "name=app.test&type=BOGUS"} {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/resolve?"+q, nil))
+		if w.Code != 400 {
+			t.Errorf("%q: status = %d, want 400", q, w.Code)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tsigAlgorithm is the only TSIG algorithm we sign or verify with.
+const tsigAlgorithm = "hmac-sha256"
+
+// tsigFudge is the clock skew allowed between signer and verifier, in
+// seconds, as recommended by RFC 8945.
+const tsigFudge = 300
+
+// TSIG error codes, carried in the TSIG record rather than the header.
+const (
+	tsigBadSig  = 16
+	tsigBadKey  = 17
+	tsigBadTime = 18
+)
+
+// TSIGKeys maps lowercase key names to their shared secrets.
+type TSIGKeys map[string][]byte
+
+// LoadTSIGKeys reads one "name secret" pair per line, with the secret base64
+// encoded as printed by tsig-keygen. Blank lines and # comments are skipped.
+func LoadTSIGKeys(path string) (TSIGKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := TSIGKeys{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"name secret\"", path, i+1)
+		}
+		secret, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: secret: %w", path, i+1, err)
+		}
+		keys[tsigKeyName(fields[0])] = secret
+	}
+	return keys, nil
+}
+
+func tsigKeyName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// TSIGKeyring holds the keys DNS UPDATEs and zone transfers are checked
+// against. Keys added or deleted through /api/tsig-keys are written back to
+// the keys file, and edits to the file are picked up by Reload, so neither
+// needs a restart. The map Keys returns is never changed afterwards; every
+// change swaps in a new one.
+type TSIGKeyring struct {
+	mu    sync.RWMutex
+	path  string
+	stamp fileStamp
+	keys  TSIGKeys
+}
+
+// LoadTSIGKeyring reads the keys file. A missing file is an empty keyring,
+// to be filled through the API.
+func LoadTSIGKeyring(path string) (*TSIGKeyring, error) {
+	kr := &TSIGKeyring{path: path, keys: TSIGKeys{}}
+	kr.stamp, _ = statFile(path)
+	keys, err := LoadTSIGKeys(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if keys != nil {
+		kr.keys = keys
+	}
+	return kr, nil
+}
+
+// newStaticTSIGKeyring builds an in-memory keyring that is never saved.
+func newStaticTSIGKeyring(keys TSIGKeys) *TSIGKeyring {
+	return &TSIGKeyring{keys: keys}
+}
+
+// Keys returns the current keys.
+func (kr *TSIGKeyring) Keys() TSIGKeys {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.keys
+}
+
+// TSIGKeyInfo describes a key for /api/tsig-keys. The secret is only ever
+// shown when the key is created.
+type TSIGKeyInfo struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"`
+	Secret    string `json:"secret,omitempty"`
+}
+
+// List returns every key without its secret, ordered by name.
+func (kr *TSIGKeyring) List() []TSIGKeyInfo {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	list := []TSIGKeyInfo{}
+	for _, name := range slices.Sorted(maps.Keys(kr.keys)) {
+		list = append(list, TSIGKeyInfo{Name: name, Algorithm: tsigAlgorithm})
+	}
+	return list
+}
+
+// validTSIGKeyName checks a name for Create; it returns "" if it is fine.
+func validTSIGKeyName(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return "name must be 1 to 253 characters"
+	}
+	for label := range strings.SplitSeq(name, ".") {
+		if label == "" || len(label) > 63 {
+			return "name must be a domain name, each label 1 to 63 characters"
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return "name may only contain letters, digits, '-', '_' and '.'"
+			}
+		}
+	}
+	return ""
+}
+
+// errTSIGKeyExists is returned by Create for a name that is taken.
+var errTSIGKeyExists = errors.New("a tsig key with that name already exists")
+
+// Create adds a key with the given secret, or a random 32-byte one if secret
+// is nil, and returns it with the secret base64 encoded.
+func (kr *TSIGKeyring) Create(name string, secret []byte) (TSIGKeyInfo, error) {
+	if msg := validTSIGKeyName(name); msg != "" {
+		return TSIGKeyInfo{}, errors.New(msg)
+	}
+	name = tsigKeyName(name)
+	if secret == nil {
+		secret = make([]byte, sha256.Size)
+		if _, err := rand.Read(secret); err != nil {
+			return TSIGKeyInfo{}, fmt.Errorf("generating tsig key: %w", err)
+		}
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if _, ok := kr.keys[name]; ok {
+		return TSIGKeyInfo{}, errTSIGKeyExists
+	}
+	keys := maps.Clone(kr.keys)
+	keys[name] = secret
+	if err := kr.save(keys); err != nil {
+		return TSIGKeyInfo{}, err
+	}
+	return TSIGKeyInfo{Name: name, Algorithm: tsigAlgorithm, Secret: base64.StdEncoding.EncodeToString(secret)}, nil
+}
+
+// Delete removes a key; requests signed with it are refused from then on.
+func (kr *TSIGKeyring) Delete(name string) error {
+	name = tsigKeyName(name)
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if _, ok := kr.keys[name]; !ok {
+		return fmt.Errorf("tsig key %q: %w", name, os.ErrNotExist)
+	}
+	keys := maps.Clone(kr.keys)
+	delete(keys, name)
+	return kr.save(keys)
+}
+
+// save writes keys to the keys file and makes them current. kr.mu must be
+// held. Comments in the file are not kept.
+func (kr *TSIGKeyring) save(keys TSIGKeys) error {
+	if kr.path != "" {
+		var buf strings.Builder
+		for _, name := range slices.Sorted(maps.Keys(keys)) {
+			fmt.Fprintf(&buf, "%s %s\n", name, base64.StdEncoding.EncodeToString(keys[name]))
+		}
+		if err := writeFileAtomic(kr.path, []byte(buf.String()), false); err != nil {
+			return fmt.Errorf("writing tsig keys file: %w", err)
+		}
+		kr.stamp, _ = statFile(kr.path)
+	}
+	kr.keys = keys
+	return nil
+}
+
+// Reload picks up edits made to the keys file outside the server. A file
+// that fails to parse leaves the current keys in place.
+func (kr *TSIGKeyring) Reload(ctx context.Context) error {
+	stamp, err := statFile(kr.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if stamp == kr.stamp {
+		return nil
+	}
+	kr.stamp = stamp // don't report the same broken file every time
+	keys, err := LoadTSIGKeys(kr.path)
+	if err != nil {
+		return err
+	}
+	kr.keys = keys
+	slog.InfoContext(ctx, "tsig keys file changed on disk, keys reloaded", "path", kr.path, "keys", len(keys))
+	return nil
+}
+
+// tsig is a decoded TSIG record (RFC 8945).
+type tsig struct {
+	key       string
+	algorithm string
+	signed    uint64 // seconds since the epoch, 48 bits on the wire
+	fudge     uint16
+	mac       []byte
+	origID    uint16
+	err       uint16
+	other     []byte
+}
+
+// splitTSIG finds the TSIG record that ends a signed message. It returns the
+// message as it was before signing (record removed, ARCOUNT decremented,
+// original ID restored) along with the record, or msg and nil when the
+// message is unsigned.
+func splitTSIG(msg []byte) ([]byte, *tsig, error) {
+	if len(msg) < 12 {
+		return nil, nil, errMalformed
+	}
+	off := 12
+	for range binary.BigEndian.Uint16(msg[4:6]) {
+		if off = skipDNSName(msg, off); off < 0 || off+4 > len(msg) {
+			return nil, nil, errMalformed
+		}
+		off += 4
+	}
+	total := 0
+	for i := range 3 {
+		total += int(binary.BigEndian.Uint16(msg[6+2*i:]))
+	}
+	var last rawRR
+	for i := range total {
+		rr, next, err := readRR(msg, off)
+		if err != nil {
+			return nil, nil, err
+		}
+		if rr.Type == 250 && i != total-1 {
+			return nil, nil, errMalformed // TSIG must be the last record
+		}
+		last, off = rr, next
+	}
+	if total == 0 || last.Type != 250 || binary.BigEndian.Uint16(msg[10:12]) == 0 {
+		return msg, nil, nil
+	}
+
+	t := &tsig{key: last.Name}
+	end := last.RData + last.RDLen
+	alg, p := parseDNSName(msg, last.RData)
+	if p < 0 || p+10 > end {
+		return nil, nil, errMalformed
+	}
+	t.algorithm = alg
+	t.signed = uint64(binary.BigEndian.Uint16(msg[p:]))<<32 | uint64(binary.BigEndian.Uint32(msg[p+2:]))
+	t.fudge = binary.BigEndian.Uint16(msg[p+6:])
+	macLen := int(binary.BigEndian.Uint16(msg[p+8:]))
+	p += 10
+	if p+macLen+6 > end {
+		return nil, nil, errMalformed
+	}
+	t.mac = msg[p : p+macLen]
+	p += macLen
+	t.origID = binary.BigEndian.Uint16(msg[p:])
+	t.err = binary.BigEndian.Uint16(msg[p+2:])
+	otherLen := int(binary.BigEndian.Uint16(msg[p+4:]))
+	p += 6
+	if p+otherLen != end {
+		return nil, nil, errMalformed
+	}
+	t.other = msg[p:end]
+
+	unsigned := append([]byte(nil), msg[:last.Start]...)
+	binary.BigEndian.PutUint16(unsigned[0:2], t.origID)
+	binary.BigEndian.PutUint16(unsigned[10:12], binary.BigEndian.Uint16(msg[10:12])-1)
+	return unsigned, t, nil
+}
+
+// verify checks a request signed with t and returns the TSIG error to answer
+// with, or 0 if the signature is good.
+func (k TSIGKeys) verify(unsigned []byte, t *tsig, now time.Time) uint16 {
+	secret, ok := k[tsigKeyName(t.key)]
+	if !ok || !strings.EqualFold(strings.TrimSuffix(t.algorithm, "."), tsigAlgorithm) {
+		return tsigBadKey
+	}
+	if !hmac.Equal(t.mac, t.sign(secret, nil, unsigned)) {
+		return tsigBadSig
+	}
+	// The clock is checked after the MAC so unsigned probes can't learn it
+	diff := int64(t.signed) - now.Unix()
+	if diff < -int64(t.fudge) || diff > int64(t.fudge) {
+		return tsigBadTime
+	}
+	return 0
+}
+
+// sign computes the MAC of msg under t's variables. Responses chain the MAC
+// of the request they answer.
+func (t *tsig) sign(secret, requestMAC, msg []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	if requestMAC != nil {
+		h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(requestMAC))))
+		h.Write(requestMAC)
+	}
+	h.Write(msg)
+
+	vars := encodeDNSName(strings.ToLower(t.key))
+	vars = binary.BigEndian.AppendUint16(vars, 255) // class ANY
+	vars = binary.BigEndian.AppendUint32(vars, 0)   // TTL
+	vars = append(vars, encodeDNSName(strings.ToLower(t.algorithm))...)
+	vars = appendUint48(vars, t.signed)
+	vars = binary.BigEndian.AppendUint16(vars, t.fudge)
+	vars = binary.BigEndian.AppendUint16(vars, t.err)
+	vars = binary.BigEndian.AppendUint16(vars, uint16(len(t.other)))
+	vars = append(vars, t.other...)
+	h.Write(vars)
+	return h.Sum(nil)
+}
+
+// signNext computes the MAC of a later message in a multi-message response
+// such as a zone transfer, which chains the previous MAC and covers only the
+// timers of t (RFC 8945 §5.3.1).
+func (t *tsig) signNext(secret, prevMAC, msg []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(prevMAC))))
+	h.Write(prevMAC)
+	h.Write(msg)
+	h.Write(binary.BigEndian.AppendUint16(appendUint48(nil, t.signed), t.fudge))
+	return h.Sum(nil)
+}
+
+// appendTo adds t to the additional section of msg.
+func (t *tsig) appendTo(msg []byte) []byte {
+	rdata := encodeDNSName(t.algorithm)
+	rdata = appendUint48(rdata, t.signed)
+	rdata = binary.BigEndian.AppendUint16(rdata, t.fudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(t.mac)))
+	rdata = append(rdata, t.mac...)
+	rdata = binary.BigEndian.AppendUint16(rdata, t.origID)
+	rdata = binary.BigEndian.AppendUint16(rdata, t.err)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(t.other)))
+	rdata = append(rdata, t.other...)
+
+	msg = append(msg, encodeDNSName(t.key)...)
+	msg = binary.BigEndian.AppendUint16(msg, 250) // TSIG
+	msg = binary.BigEndian.AppendUint16(msg, 255) // class ANY
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+	msg = append(msg, rdata...)
+	binary.BigEndian.PutUint16(msg[10:12], binary.BigEndian.Uint16(msg[10:12])+1)
+	return msg
+}
+
+// signTSIG signs a request with the named key.
+func signTSIG(msg []byte, key string, secret []byte, now time.Time) []byte {
+	t := &tsig{
+		key:       key,
+		algorithm: tsigAlgorithm,
+		signed:    uint64(now.Unix()),
+		fudge:     tsigFudge,
+		origID:    binary.BigEndian.Uint16(msg[0:2]),
+	}
+	t.mac = t.sign(secret, nil, msg)
+	return t.appendTo(msg)
+}
+
+// signResponse appends the TSIG record answering a request signed with req.
+// code is the TSIG error; BADKEY and BADSIG responses go unsigned since the
+// request's key could not be used.
+func signResponse(resp []byte, req *tsig, secret []byte, code uint16, now time.Time) []byte {
+	t := &tsig{
+		key:       req.key,
+		algorithm: req.algorithm,
+		signed:    uint64(now.Unix()),
+		fudge:     tsigFudge,
+		origID:    binary.BigEndian.Uint16(resp[0:2]),
+		err:       code,
+	}
+	if code == tsigBadTime {
+		// Echo the request's time and report ours so the client can see the skew
+		t.signed = req.signed
+		t.other = appendUint48(nil, uint64(now.Unix()))
+	}
+	if code != tsigBadKey && code != tsigBadSig {
+		t.mac = t.sign(secret, req.mac, resp)
+	}
+	return t.appendTo(resp)
+}
+
+// tsigVerifier checks the signatures on a response, possibly spanning several
+// messages, to a request we signed. Since every MAC chains back to our
+// request's, the response's clock is not checked.
+type tsigVerifier struct {
+	secret  []byte
+	prevMAC []byte   // the request's MAC, then the last verified one
+	signed  bool     // a first signature has been verified
+	pending [][]byte // unsigned messages since the last signature
+}
+
+func (v *tsigVerifier) check(msg []byte) error {
+	unsigned, t, err := splitTSIG(msg)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		// RFC 8945 lets all but the first and last messages go unsigned
+		if !v.signed || len(v.pending) >= 99 {
+			return errors.New("response is not signed")
+		}
+		v.pending = append(v.pending, msg)
+		return nil
+	}
+	if t.err != 0 {
+		return fmt.Errorf("tsig error %d", t.err)
+	}
+	data := append(slices.Concat(v.pending...), unsigned...)
+	want := t.signNext(v.secret, v.prevMAC, data)
+	if !v.signed {
+		want = t.sign(v.secret, v.prevMAC, data)
+	}
+	if !hmac.Equal(t.mac, want) {
+		return errors.New("bad response signature")
+	}
+	v.prevMAC, v.signed, v.pending = t.mac, true, nil
+	return nil
+}
+
+// done reports whether the response so far ended with a signed message.
+func (v *tsigVerifier) done() error {
+	if !v.signed || len(v.pending) > 0 {
+		return errors.New("response is not signed")
+	}
+	return nil
+}
+
+func appendUint48(b []byte, v uint64) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(v>>32))
+	return binary.BigEndian.AppendUint32(b, uint32(v))
+}
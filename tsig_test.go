@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTSIGKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tsig.keys")
+	kr, err := LoadTSIGKeyring(path)
+	if err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := NewUpdater(store, NewZones([]string{"my.lan"}), nil, kr)
+	update := func(key string, secret []byte) int {
+		add := testRR("printer.my.lan", 1, 1, 300, []byte{10, 0, 0, 20})
+		req := signTSIG(buildTestUpdate("my.lan", nil, [][]byte{add}), key, secret, time.Now())
+		return int(u.Handle(req, netip.MustParseAddr("203.0.113.7"))[3] & 0x0F)
+	}
+
+	// A key created at runtime signs updates at once and is saved
+	key, err := kr.Create("DHCP.my.lan.", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := base64.StdEncoding.DecodeString(key.Secret)
+	if key.Name != "dhcp.my.lan" || len(secret) != 32 {
+		t.Errorf("created %+v", key)
+	}
+	if rcode := update("dhcp.my.lan", secret); rcode != 0 {
+		t.Errorf("update with the new key: rcode %s", rcodeString(rcode))
+	}
+	if _, err := kr.Create("dhcp.my.lan", nil); !errors.Is(err, errTSIGKeyExists) {
+		t.Errorf("creating it again: %v", err)
+	}
+	if saved, err := LoadTSIGKeys(path); err != nil || string(saved["dhcp.my.lan"]) != string(secret) {
+		t.Errorf("saved keys = %v, %v", saved, err)
+	}
+
+	// Edits to the file are picked up by Reload
+	if err := os.WriteFile(path, []byte("# hand edited\ncertbot c2VjcmV0LXNlY3JldC1zZWNyZXQ=\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	kr.stamp = fileStamp{} // the rewrite may land within the same mtime tick
+	if err := kr.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := kr.List(); len(got) != 1 || got[0].Name != "certbot" || got[0].Secret != "" {
+		t.Errorf("after reload: %+v", got)
+	}
+	if rcode := update("dhcp.my.lan", secret); rcode != rcodeNotAuth {
+		t.Errorf("update with the removed key: rcode %s", rcodeString(rcode))
+	}
+
+	if err := kr.Delete("certbot"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.Delete("certbot"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("deleting it again: %v", err)
+	}
+	if data, _ := os.ReadFile(path); len(data) != 0 {
+		t.Errorf("file after delete: %q", data)
+	}
+}
+
+func TestWebTSIGKeys(t *testing.T) {
+	ws, _ := testWebServer(t)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	if w := do("GET", "/api/tsig-keys", ""); w.Code != 404 {
+		t.Errorf("without -tsig-keys: status %d", w.Code)
+	}
+
+	var err error
+	if ws.tsig, err = LoadTSIGKeyring(filepath.Join(t.TempDir(), "tsig.keys")); err != nil {
+		t.Fatal(err)
+	}
+	w := do("POST", "/api/tsig-keys", `{"name":"certbot","secret":"MDEyMzQ1Njc4OWFiY2RlZg=="}`)
+	var key TSIGKeyInfo
+	json.NewDecoder(w.Body).Decode(&key)
+	if w.Code != 201 || key.Name != "certbot" || key.Algorithm != "hmac-sha256" || key.Secret != "MDEyMzQ1Njc4OWFiY2RlZg==" {
+		t.Errorf("create: status %d, %+v", w.Code, key)
+	}
+	for body, want := range map[string]int{
+		`{"name":"certbot"}`:                   409,
+		`{"name":"bad name"}`:                  400,
+		`{"name":"short","secret":"c2hvcnQ="}`: 400,
+	} {
+		if w := do("POST", "/api/tsig-keys", body); w.Code != want {
+			t.Errorf("%s: status %d, want %d", body, w.Code, want)
+		}
+	}
+	if w := do("GET", "/api/tsig-keys", ""); w.Code != 200 || strings.TrimSpace(w.Body.String()) != `[{"name":"certbot","algorithm":"hmac-sha256"}]` {
+		t.Errorf("list: status %d, %s", w.Code, w.Body)
+	}
+	if w := do("DELETE", "/api/tsig-keys/certbot", ""); w.Code != 204 {
+		t.Errorf("delete: status %d", w.Code)
+	}
+	if w := do("DELETE", "/api/tsig-keys/certbot", ""); w.Code != 404 {
+		t.Errorf("delete again: status %d", w.Code)
+	}
+}
@@ -0,0 +1,249 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// udpBatchSize is how many datagrams one recvmmsg or sendmmsg call moves at
+// most.
+const udpBatchSize = 32
+
+// mmsghdr is struct mmsghdr from sendmmsg(2).
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+	_   [4]byte
+}
+
+// udpBatch reads and writes a UDP socket several datagrams per system call.
+// Reads take whatever has arrived, up to udpBatchSize, without waiting for
+// more; replies go to a writer that sends whatever has piled up since its
+// last call, so under load the syscall count drops while a lone reply still
+// goes out at once.
+type udpBatch struct {
+	conn  *net.UDPConn
+	rc    syscall.RawConn
+	pool  *sync.Pool
+	inet6 bool // the socket is AF_INET6, so IPv4 peers are v4-mapped
+
+	// used by the reading goroutine only
+	rmsgs  [udpBatchSize]mmsghdr
+	riovs  [udpBatchSize]syscall.Iovec
+	rnames [udpBatchSize]syscall.RawSockaddrAny
+
+	replies chan udpReply
+	done    chan struct{}
+}
+
+func newUDPBatch(conn *net.UDPConn, pool *sync.Pool) (*udpBatch, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	b := &udpBatch{
+		conn:    conn,
+		rc:      rc,
+		pool:    pool,
+		replies: make(chan udpReply, 2*udpBatchSize),
+		done:    make(chan struct{}),
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		var sa syscall.Sockaddr
+		sa, serr = syscall.Getsockname(int(fd))
+		_, b.inet6 = sa.(*syscall.SockaddrInet6)
+	}); err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, os.NewSyscallError("getsockname", serr)
+	}
+	go b.writeLoop()
+	return b, nil
+}
+
+// read fills bufs with the datagrams waiting, blocking until there is at
+// least one, and returns how many it read.
+func (b *udpBatch) read(bufs []*[]byte, sizes []int, addrs []*net.UDPAddr) (int, error) {
+	for i, buf := range bufs {
+		b.riovs[i] = syscall.Iovec{Base: &(*buf)[0]}
+		b.riovs[i].SetLen(len(*buf))
+		b.rmsgs[i] = mmsghdr{hdr: syscall.Msghdr{
+			Name:    (*byte)(unsafe.Pointer(&b.rnames[i])),
+			Namelen: syscall.SizeofSockaddrAny,
+			Iov:     &b.riovs[i],
+			Iovlen:  1,
+		}}
+	}
+	var n int
+	var errno syscall.Errno
+	err := b.rc.Read(func(fd uintptr) bool {
+		r, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&b.rmsgs[0])), uintptr(len(bufs)), syscall.MSG_DONTWAIT, 0, 0)
+		n, errno = int(r), e
+		return errno != syscall.EAGAIN
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, os.NewSyscallError("recvmmsg", errno)
+	}
+	for i := range n {
+		sizes[i] = int(b.rmsgs[i].len)
+		addrs[i] = sockaddrToUDP(&b.rnames[i])
+	}
+	return n, nil
+}
+
+// send queues r for the writer, which returns r.out to the pool once it is
+// sent.
+func (b *udpBatch) send(r udpReply) {
+	select {
+	case b.replies <- r:
+	case <-b.done:
+		if r.out != nil {
+			b.pool.Put(r.out)
+		}
+	}
+}
+
+// close stops the writer; replies still queued are dropped.
+func (b *udpBatch) close() {
+	close(b.done)
+}
+
+func (b *udpBatch) writeLoop() {
+	var (
+		msgs  [udpBatchSize]mmsghdr
+		iovs  [udpBatchSize]syscall.Iovec
+		names [udpBatchSize]syscall.RawSockaddrAny
+	)
+	batch := make([]udpReply, 0, udpBatchSize)
+	for {
+		select {
+		case r := <-b.replies:
+			batch = append(batch[:0], r)
+		case <-b.done:
+			return
+		}
+		// Take whatever else is ready, without waiting for more
+	fill:
+		for len(batch) < udpBatchSize {
+			select {
+			case r := <-b.replies:
+				batch = append(batch, r)
+			default:
+				break fill
+			}
+		}
+
+		for i, r := range batch {
+			iovs[i] = syscall.Iovec{Base: &r.resp[0]}
+			iovs[i].SetLen(len(r.resp))
+			msgs[i] = mmsghdr{hdr: syscall.Msghdr{
+				Name:    (*byte)(unsafe.Pointer(&names[i])),
+				Namelen: udpToSockaddr(r.addr, b.inet6, &names[i]),
+				Iov:     &iovs[i],
+				Iovlen:  1,
+			}}
+		}
+		b.sendmmsg(msgs[:len(batch)])
+		for i, r := range batch {
+			if r.out != nil {
+				b.pool.Put(r.out)
+			}
+			batch[i] = udpReply{}
+		}
+	}
+}
+
+func (b *udpBatch) sendmmsg(msgs []mmsghdr) {
+	for len(msgs) > 0 {
+		var n int
+		var errno syscall.Errno
+		err := b.rc.Write(func(fd uintptr) bool {
+			r, _, e := syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), 0, 0, 0)
+			n, errno = int(r), e
+			return errno != syscall.EAGAIN
+		})
+		if err != nil {
+			return
+		}
+		if errno != 0 {
+			// The first reply couldn't be sent, to an unreachable client
+			// say; the rest still go
+			slog.Debug("dns write failed", "addr", b.conn.LocalAddr().String(), "error", errno)
+			n = 1
+		}
+		msgs = msgs[n:]
+	}
+}
+
+// udpAddrBuf holds an address and its IP in one allocation.
+type udpAddrBuf struct {
+	addr net.UDPAddr
+	ip   [16]byte
+}
+
+func sockaddrToUDP(sa *syscall.RawSockaddrAny) *net.UDPAddr {
+	a := new(udpAddrBuf)
+	switch sa.Addr.Family {
+	case syscall.AF_INET:
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		copy(a.ip[:], sa4.Addr[:])
+		a.addr.IP = a.ip[:4]
+		a.addr.Port = portFromNetwork(&sa4.Port)
+	case syscall.AF_INET6:
+		sa6 := (*syscall.RawSockaddrInet6)(unsafe.Pointer(sa))
+		copy(a.ip[:], sa6.Addr[:])
+		a.addr.IP = a.ip[:]
+		a.addr.Port = portFromNetwork(&sa6.Port)
+		if sa6.Scope_id != 0 {
+			a.addr.Zone = strconv.Itoa(int(sa6.Scope_id))
+		}
+	}
+	return &a.addr
+}
+
+// udpToSockaddr writes addr to sa in the socket's family and returns its
+// length.
+func udpToSockaddr(addr *net.UDPAddr, inet6 bool, sa *syscall.RawSockaddrAny) uint32 {
+	if !inet6 {
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		*sa4 = syscall.RawSockaddrInet4{Family: syscall.AF_INET}
+		copy(sa4.Addr[:], addr.IP.To4())
+		portToNetwork(&sa4.Port, addr.Port)
+		return syscall.SizeofSockaddrInet4
+	}
+	sa6 := (*syscall.RawSockaddrInet6)(unsafe.Pointer(sa))
+	*sa6 = syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+	copy(sa6.Addr[:], addr.IP.To16())
+	portToNetwork(&sa6.Port, addr.Port)
+	if addr.Zone != "" {
+		if id, err := strconv.Atoi(addr.Zone); err == nil {
+			sa6.Scope_id = uint32(id)
+		} else if iface, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa6.Scope_id = uint32(iface.Index)
+		}
+	}
+	return syscall.SizeofSockaddrInet6
+}
+
+// Ports in socket addresses are in network byte order.
+func portFromNetwork(p *uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(p))
+	return int(b[0])<<8 | int(b[1])
+}
+
+func portToNetwork(p *uint16, port int) {
+	b := (*[2]byte)(unsafe.Pointer(p))
+	b[0], b[1] = byte(port>>8), byte(port)
+}
@@ -0,0 +1,5 @@
+package main
+
+// sysSendmmsg is sendmmsg's syscall number, which package syscall leaves
+// out on amd64.
+const sysSendmmsg = 307
@@ -0,0 +1,40 @@
+//go:build !(linux && (amd64 || arm64))
+
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// udpBatchSize is 1 where there is no recvmmsg and sendmmsg to batch with.
+const udpBatchSize = 1
+
+// udpBatch reads and writes a UDP socket one datagram at a time.
+type udpBatch struct {
+	conn *net.UDPConn
+	pool *sync.Pool
+}
+
+func newUDPBatch(conn *net.UDPConn, pool *sync.Pool) (*udpBatch, error) {
+	return &udpBatch{conn: conn, pool: pool}, nil
+}
+
+func (b *udpBatch) read(bufs []*[]byte, sizes []int, addrs []*net.UDPAddr) (int, error) {
+	n, addr, err := b.conn.ReadFromUDP(*bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0], addrs[0] = n, addr
+	return 1, nil
+}
+
+// send writes r at once and returns r.out to the pool.
+func (b *udpBatch) send(r udpReply) {
+	b.conn.WriteToUDP(r.resp, r.addr)
+	if r.out != nil {
+		b.pool.Put(r.out)
+	}
+}
+
+func (b *udpBatch) close() {}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startDNSServerOn is startDNSServer for a given address, skipping the test
+// when this host can't bind it.
+func startDNSServerOn(t *testing.T, dns *DNSServer, addr string) {
+	t.Helper()
+	failed := make(chan error, 1)
+	go func() { failed <- dns.ListenAndServe(addr) }()
+	select {
+	case <-dns.ready:
+		t.Cleanup(dns.Close)
+	case err := <-failed:
+		t.Skipf("listen %s: %v", addr, err)
+	}
+}
+
+func TestDNSUDPBurst(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Add(Record{Domain: "app.example.com", Type: "A", Value: "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	dns := NewDNSServer(store, nil)
+	addr := startDNSServer(t, dns)
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// More than one batch goes out before any answer is read
+	const queries = 3 * udpBatchSize
+	for i := range queries {
+		query := buildTestQuery("app.example.com", 1, 1)
+		query[0], query[1] = byte(i>>8), byte(i)
+		if _, err := conn.Write(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := make(map[int]bool)
+	buf := make([]byte, udpBufSize)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(seen) < queries {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("after %d answers: %v", len(seen), err)
+		}
+		if n < 12 || buf[3]&0x0F != 0 || buf[7] != 1 {
+			t.Fatalf("bad answer %x", buf[:n])
+		}
+		seen[int(buf[0])<<8|int(buf[1])] = true
+	}
+}
+
+// A dual-stack socket sees IPv4 clients as v4-mapped addresses and must
+// answer them at those.
+func TestDNSUDPDualStack(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dns := NewDNSServer(store, nil)
+	dns.authoritativeOnly = true
+	startDNSServerOn(t, dns, "[::]:0")
+	_, port, _ := net.SplitHostPort(dns.conn.LocalAddr().String())
+
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		resp := exchange(t, net.JoinHostPort(host, port), buildTestQuery("example.com", 1, 1))
+		if resp[3]&0x0F != rcodeRefused {
+			t.Errorf("%s: rcode = %d, want REFUSED", host, resp[3]&0x0F)
+		}
+	}
+}
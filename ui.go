@@ -0,0 +1,111 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const (
+	defaultUITitle = "Regieleki"
+	maxLogoSize    = 512 << 10
+)
+
+//go:embed kiosk.html
+var kioskHTML []byte
+
+// UIConfig holds the branding and kiosk options for the embedded web UI.
+type UIConfig struct {
+	Title    string
+	Logo     []byte
+	LogoType string
+	Kiosk    bool // serve a token-less, read-only status page at /kiosk
+}
+
+// LoadUIConfig reads the logo file, if any, so a missing or oversized file
+// is reported at startup rather than as a broken image.
+func LoadUIConfig(title, logoPath string, kiosk bool) (UIConfig, error) {
+	cfg := UIConfig{Title: title, Kiosk: kiosk}
+	if cfg.Title == "" {
+		cfg.Title = defaultUITitle
+	}
+	if logoPath == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(logoPath)
+	if err != nil {
+		return cfg, err
+	}
+	if len(data) > maxLogoSize {
+		return cfg, fmt.Errorf("logo %s is larger than %d KiB", logoPath, maxLogoSize>>10)
+	}
+	cfg.Logo = data
+	cfg.LogoType = mime.TypeByExtension(filepath.Ext(logoPath))
+	if cfg.LogoType == "" {
+		cfg.LogoType = http.DetectContentType(data)
+	}
+	return cfg, nil
+}
+
+// KioskStatus is the read-only summary shown on the kiosk page. It carries
+// counts and health only, never record contents.
+type KioskStatus struct {
+	Title        string           `json:"title"`
+	Records      int              `json:"records"`
+	Serial       uint32           `json:"serial"`
+	Upstreams    []UpstreamStatus `json:"upstreams"`
+	CacheEntries int              `json:"cache_entries"`
+	Standby      *StandbyStatus   `json:"standby,omitempty"`
+}
+
+func (s *WebServer) handleUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"title":    s.ui.Title,
+		"logo":     len(s.ui.Logo) > 0,
+		"kiosk":    s.ui.Kiosk,
+		"sso":      s.oidc != nil,
+		"querylog": s.querylog != nil,
+	})
+}
+
+func (s *WebServer) handleLogo(w http.ResponseWriter, r *http.Request) {
+	if len(s.ui.Logo) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", s.ui.LogoType)
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(s.ui.Logo)
+}
+
+func (s *WebServer) handleKioskPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(kioskHTML)
+}
+
+func (s *WebServer) handleKiosk(w http.ResponseWriter, r *http.Request) {
+	serial, records := s.store.Snapshot()
+	status := KioskStatus{
+		Title:     s.ui.Title,
+		Records:   len(records),
+		Serial:    serial,
+		Upstreams: []UpstreamStatus{},
+	}
+	if s.upstreams != nil {
+		status.Upstreams = s.upstreams.Status()
+	}
+	if s.cache != nil {
+		status.CacheEntries = s.cache.Len()
+	}
+	if s.standby != nil {
+		st := s.standby.Status()
+		status.Standby = &st
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadUIConfig(t *testing.T) {
+	cfg, err := LoadUIConfig("", "", false)
+	if err != nil || cfg.Title != defaultUITitle {
+		t.Errorf("default = %+v, %v", cfg, err)
+	}
+
+	logo := filepath.Join(t.TempDir(), "logo.svg")
+	os.WriteFile(logo, []byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`), 0644)
+	cfg, err = LoadUIConfig("Office LAN", logo, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Title != "Office LAN" || cfg.LogoType != "image/svg+xml" || !cfg.Kiosk {
+		t.Errorf("cfg = %+v", cfg)
+	}
+
+	if _, err := LoadUIConfig("", filepath.Join(t.TempDir(), "missing.png"), false); err == nil {
+		t.Error("expected error for missing logo")
+	}
+}
+
+func TestKioskIsPublicAndReadOnly(t *testing.T) {
+	ws, store := testWebServer(t)
+	ws.tokens = newStaticTokenSet("secret")
+	ws.ui = UIConfig{Title: "Office LAN", Kiosk: true, Logo: []byte("png"), LogoType: "image/png"}
+	ws.upstreams = NewUpstreams([]string{"10.0.0.1:53"})
+	store.Add(Record{Domain: "app.test", Type: "A", Value: "10.0.0.1"})
+	h := ws.Handler()
+
+	for _, path := range []string{"/kiosk", "/api/kiosk", "/api/ui", "/logo"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 200 {
+			t.Errorf("GET %s = %d without a token", path, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/kiosk", nil))
+	var status KioskStatus
+	json.NewDecoder(w.Body).Decode(&status)
+	if status.Title != "Office LAN" || status.Records != 1 || len(status.Upstreams) != 1 {
+		t.Errorf("status = %+v", status)
+	}
+
+	for _, req := range []struct{ method, path string }{
+		{"GET", "/api/records"},
+		{"POST", "/api/records"},
+		{"DELETE", "/api/records/1"},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(req.method, req.path, nil))
+		if w.Code != 401 {
+			t.Errorf("%s %s = %d, want 401", req.method, req.path, w.Code)
+		}
+	}
+}
+
+func TestKioskDisabledByDefault(t *testing.T) {
+	ws, _ := testWebServer(t)
+	ws.tokens = newStaticTokenSet("secret")
+	h := ws.Handler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/kiosk", nil))
+	if w.Code != 404 {
+		t.Errorf("GET /api/kiosk = %d, want 404", w.Code)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/logo", nil))
+	if w.Code != 404 {
+		t.Errorf("GET /logo = %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+)
+
+// unixPrefix marks an -http address as the path of a Unix domain socket.
+const unixPrefix = "unix:"
+
+// unixSocketMode lets the owner and group of the socket use the API; who
+// may connect is decided by the file's ownership rather than by tokens.
+const unixSocketMode = 0o660
+
+type unixConnKey struct{}
+
+// fromUnixSocket reports whether the request came in on the Unix socket,
+// whose clients passed the filesystem's permission check to connect.
+func fromUnixSocket(ctx context.Context) bool {
+	ok, _ := ctx.Value(unixConnKey{}).(bool)
+	return ok
+}
+
+// listenUnix listens on a Unix domain socket at path. A socket left behind
+// by a server that didn't shut down cleanly is replaced, but one that is
+// still accepting connections is not.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, unixSocketMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// cutUnix returns the socket path of an -http address, if it is one.
+func cutUnix(addr string) (string, bool) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	return path, ok && path != ""
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWebUnixSocket(t *testing.T) {
+	// t.TempDir can be longer than a socket path may be
+	dir, err := os.MkdirTemp("", "regieleki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "api.sock")
+
+	// A stale socket is replaced; anything else at the path is left alone
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0o600)
+	if _, err := listenUnix(file); err == nil {
+		t.Error("listened over a regular file")
+	}
+
+	ws, _ := testWebServer(t)
+	ws.tokens = newStaticTokenSet("api-token")
+	errc := make(chan error, 1)
+	go func() { errc <- ws.ListenAndServe(unixPrefix + path) }()
+	t.Cleanup(func() { ws.Shutdown(context.Background()) })
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	var resp *http.Response
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if resp, err = client.Get("http://regieleki/api/records"); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status without a token = %d, want 200", resp.StatusCode)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != unixSocketMode {
+		t.Errorf("socket mode = %v, %v", fi.Mode(), err)
+	}
+	if _, err := listenUnix(path); err == nil {
+		t.Error("listened over a socket in use")
+	}
+	select {
+	case err := <-errc:
+		t.Fatalf("server stopped: %v", err)
+	default:
+	}
+}
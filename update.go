@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Updater applies RFC 2136 dynamic updates to the Store, so DHCP servers and
+// ACME clients can register names without the HTTP API. Updates are only
+// accepted for configured zones, from clients in an allowed network or signed
+// with a known TSIG key. They act on records without a view; synced records
+// are never touched.
+type Updater struct {
+	store *Store
+	zones Zones
+	allow []netip.Prefix
+	keys  *TSIGKeyring
+	now   func() time.Time
+
+	// mu serializes updates so prerequisites still hold when changes apply.
+	// Edits through the API can still interleave.
+	mu sync.Mutex
+}
+
+func NewUpdater(store *Store, zones Zones, allow []netip.Prefix, keys *TSIGKeyring) *Updater {
+	return &Updater{store: store, zones: zones, allow: allow, keys: keys, now: time.Now}
+}
+
+// updateRR is one record of the prerequisite or update section, with its
+// RDATA decoded to a Record value when the type is one we store.
+type updateRR struct {
+	rawRR
+	name  string // lowercase, no trailing dot
+	rtype string
+	value string
+}
+
+// Handle processes an UPDATE message from client and returns the response.
+func (u *Updater) Handle(msg []byte, client netip.Addr) []byte {
+	// Zone section: exactly one SOA question naming the zone
+	zoneEnd := 0
+	var zone string
+	if binary.BigEndian.Uint16(msg[4:6]) == 1 {
+		name, off := parseDNSName(msg, 12)
+		if off >= 0 && off+4 <= len(msg) {
+			zoneEnd = off + 4
+			zone = strings.ToLower(strings.TrimSuffix(name, "."))
+			if binary.BigEndian.Uint16(msg[off:]) != 6 || binary.BigEndian.Uint16(msg[off+2:]) != 1 {
+				zone = ""
+			}
+		}
+	}
+	if zone == "" {
+		return updateResponse(msg, zoneEnd, rcodeFormErr)
+	}
+
+	unsigned, sig, err := splitTSIG(msg)
+	if err != nil {
+		return updateResponse(msg, zoneEnd, rcodeFormErr)
+	}
+	now := u.now()
+	var secret []byte
+	if sig != nil {
+		keys := u.keys.Keys()
+		secret = keys[tsigKeyName(sig.key)]
+		if code := keys.verify(unsigned, sig, now); code != 0 {
+			slog.Warn("dns update rejected", "zone", zone, "client", client, "key", sig.key, "tsig_error", code)
+			return signResponse(updateResponse(msg, zoneEnd, rcodeNotAuth), sig, secret, code, now)
+		}
+	}
+	reply := func(rcode int) []byte {
+		resp := updateResponse(msg, zoneEnd, rcode)
+		if sig != nil {
+			resp = signResponse(resp, sig, secret, 0, now)
+		}
+		return resp
+	}
+
+	if !slices.Contains(u.zones, zone) {
+		return reply(rcodeNotAuth)
+	}
+	if sig == nil && !slices.ContainsFunc(u.allow, func(p netip.Prefix) bool { return p.Contains(client.Unmap()) }) {
+		slog.Warn("dns update refused", "zone", zone, "client", client)
+		return reply(rcodeRefused)
+	}
+
+	prereqs, updates, rcode := parseUpdate(unsigned, zoneEnd, zone)
+	if rcode != 0 {
+		return reply(rcode)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if rcode := u.checkPrereqs(prereqs); rcode != 0 {
+		return reply(rcode)
+	}
+	added, deleted, err := u.apply(updates)
+	if err != nil {
+		slog.Error("dns update failed", "zone", zone, "client", client, "error", err)
+		return reply(rcodeServFail)
+	}
+	keyName := ""
+	if sig != nil {
+		keyName = sig.key
+	}
+	slog.Info("dns update applied", "zone", zone, "client", client, "key", keyName, "added", added, "deleted", deleted)
+	return reply(0)
+}
+
+// parseUpdate reads the prerequisite and update sections and runs the
+// checks of RFC 2136 §3.2 and §3.4.1 that need no store access.
+func parseUpdate(msg []byte, off int, zone string) (prereqs, updates []updateRR, rcode int) {
+	counts := [2]int{int(binary.BigEndian.Uint16(msg[6:8])), int(binary.BigEndian.Uint16(msg[8:10]))}
+	for section, count := range counts {
+		for range count {
+			raw, next, err := readRR(msg, off)
+			if err != nil {
+				return nil, nil, rcodeFormErr
+			}
+			off = next
+			rr := updateRR{rawRR: raw, name: strings.ToLower(strings.TrimSuffix(raw.Name, ".")), rtype: typeString(raw.Type)}
+			if !inZone(rr.name, zone) {
+				return nil, nil, rcodeNotZone
+			}
+			if raw.Type >= 250 && raw.Type != 255 || section == 1 && raw.Type == 255 && raw.Class != 255 {
+				return nil, nil, rcodeFormErr // meta types never appear here
+			}
+			switch raw.Class {
+			case 255, 254: // ANY, NONE
+				if raw.TTL != 0 || raw.Class == 255 && raw.RDLen != 0 || section == 0 && raw.RDLen != 0 {
+					return nil, nil, rcodeFormErr
+				}
+			case 1:
+				if section == 0 && raw.TTL != 0 {
+					return nil, nil, rcodeFormErr
+				}
+			default:
+				return nil, nil, rcodeFormErr
+			}
+			if raw.RDLen > 0 {
+				value, ok := rdataValue(msg, raw)
+				if !ok {
+					slog.Warn("dns update refused", "zone", zone, "name", rr.name, "type", rr.rtype, "reason", "unsupported record type")
+					return nil, nil, rcodeRefused
+				}
+				rr.value = value
+			}
+			if section == 0 {
+				prereqs = append(prereqs, rr)
+			} else {
+				updates = append(updates, rr)
+			}
+		}
+	}
+	for _, rr := range updates {
+		if rr.Class != 1 {
+			continue
+		}
+		rec := Record{Domain: rr.name, Type: rr.rtype, Value: rr.value}
+		if p := validateRecord(&rec); p != nil {
+			slog.Warn("dns update refused", "zone", zone, "name", rr.name, "type", rr.rtype, "reason", p.Detail)
+			return nil, nil, rcodeRefused
+		}
+	}
+	return prereqs, updates, 0
+}
+
+// rdataValue decodes RDATA into the value a Record of that type holds.
+func rdataValue(msg []byte, rr rawRR) (string, bool) {
+	rdata := msg[rr.RData : rr.RData+rr.RDLen]
+	switch rr.Type {
+	case 1:
+		if len(rdata) == 4 {
+			return net.IP(rdata).String(), true
+		}
+	case 28:
+		if len(rdata) == 16 {
+			return net.IP(rdata).String(), true
+		}
+	case 5:
+		if name, next := parseDNSName(msg, rr.RData); next >= 0 {
+			return strings.ToLower(name), true
+		}
+	case 16:
+		// Character-strings are joined, as encodeTXT splits them again
+		var value []byte
+		for i := 0; i < len(rdata); {
+			l := int(rdata[i])
+			if i+1+l > len(rdata) {
+				return "", false
+			}
+			value = append(value, rdata[i+1:i+1+l]...)
+			i += 1 + l
+		}
+		return string(value), true
+	case 64, 65:
+		return formatSVCB(rdata)
+	}
+	return "", false
+}
+
+// local returns the records at name an update may see or change: live ones
+// without a view, synced ones included.
+func (u *Updater) local(name string) []Record {
+	var result []Record
+	now := time.Now()
+	for _, r := range u.store.List() {
+		if r.View == "" && !r.Disabled && !r.expired(now) && strings.EqualFold(r.Domain, name) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// sameValue compares record values the way DNS compares RDATA.
+func sameValue(r Record, value string) bool {
+	switch r.Type {
+	case "TXT":
+		return r.Value == value
+	case "A", "AAAA":
+		return net.ParseIP(r.Value).Equal(net.ParseIP(value))
+	}
+	return strings.EqualFold(strings.TrimSuffix(r.Value, "."), strings.TrimSuffix(value, "."))
+}
+
+// checkPrereqs evaluates the prerequisite section (RFC 2136 §3.2.5).
+func (u *Updater) checkPrereqs(prereqs []updateRR) int {
+	type rrset struct{ name, rtype string }
+	want := map[rrset][]string{}
+	for _, rr := range prereqs {
+		records := u.local(rr.name)
+		hasType := slices.ContainsFunc(records, func(r Record) bool { return r.Type == rr.rtype })
+		switch {
+		case rr.Class == 255 && rr.Type == 255:
+			if len(records) == 0 {
+				return rcodeNXDomain
+			}
+		case rr.Class == 255:
+			if !hasType {
+				return rcodeNXRRSet
+			}
+		case rr.Class == 254 && rr.Type == 255:
+			if len(records) > 0 {
+				return rcodeYXDomain
+			}
+		case rr.Class == 254:
+			if hasType {
+				return rcodeYXRRSet
+			}
+		default:
+			key := rrset{rr.name, rr.rtype}
+			want[key] = append(want[key], rr.value)
+		}
+	}
+	// Value-dependent prerequisites must match the whole RRset
+	for key, values := range want {
+		var have []Record
+		for _, r := range u.local(key.name) {
+			if r.Type == key.rtype {
+				have = append(have, r)
+			}
+		}
+		for _, v := range values {
+			if !slices.ContainsFunc(have, func(r Record) bool { return sameValue(r, v) }) {
+				return rcodeNXRRSet
+			}
+		}
+		for _, r := range have {
+			if !slices.ContainsFunc(values, func(v string) bool { return sameValue(r, v) }) {
+				return rcodeNXRRSet
+			}
+		}
+	}
+	return 0
+}
+
+// apply performs the update section in order (RFC 2136 §3.4.2). A CNAME
+// never joins other records at a name, and other records never join a CNAME;
+// such additions are silently ignored as the RFC prescribes. A store error
+// part way leaves the earlier changes in place.
+func (u *Updater) apply(updates []updateRR) (added, deleted int, err error) {
+	for _, rr := range updates {
+		records := u.local(rr.name)
+		switch rr.Class {
+		case 1:
+			cname := slices.IndexFunc(records, func(r Record) bool { return r.Type == "CNAME" })
+			switch {
+			case rr.rtype == "CNAME" && cname >= 0:
+				if r := records[cname]; r.Source == "" && !sameValue(r, rr.value) {
+					r.Value = rr.value
+					if _, err := u.store.Update(r.ID, r); err != nil {
+						return added, deleted, err
+					}
+				}
+				continue
+			case rr.rtype == "CNAME" && len(records) > 0, rr.rtype != "CNAME" && cname >= 0:
+				continue
+			}
+			if slices.ContainsFunc(records, func(r Record) bool { return r.Type == rr.rtype && sameValue(r, rr.value) }) {
+				continue
+			}
+			if _, err := u.store.Add(Record{Domain: rr.name, Type: rr.rtype, Value: rr.value}); errors.Is(err, ErrDuplicate) {
+				continue // matches a disabled or expired record
+			} else if err != nil {
+				return added, deleted, err
+			}
+			added++
+		case 255, 254:
+			for _, r := range records {
+				match := r.Source == "" && (rr.Type == 255 || r.Type == rr.rtype)
+				if rr.Class == 254 {
+					match = match && sameValue(r, rr.value)
+				}
+				if !match {
+					continue
+				}
+				if err := u.store.Delete(r.ID); err != nil {
+					return added, deleted, err
+				}
+				deleted++
+			}
+		}
+	}
+	return added, deleted, nil
+}
+
+// updateResponse answers an UPDATE with rcode, echoing the zone section when
+// it could be parsed.
+func updateResponse(msg []byte, zoneEnd, rcode int) []byte {
+	resp := make([]byte, 12, max(zoneEnd, 12))
+	copy(resp, msg[0:2])
+	resp[2] = 0x80 | opcodeUpdate<<3 // QR=1
+	resp[3] = byte(rcode)
+	if zoneEnd > 12 {
+		resp[5] = 1 // ZOCOUNT
+		resp = append(resp, msg[12:zoneEnd]...)
+	}
+	return resp
+}
+
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		p, err := parsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// parsePrefix accepts a CIDR or a single address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return p.Masked(), nil
+}
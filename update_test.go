@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testRR encodes one resource record for an UPDATE message.
+func testRR(name string, rtype, class uint16, ttl uint32, rdata []byte) []byte {
+	rr := encodeDNSName(name)
+	rr = binary.BigEndian.AppendUint16(rr, rtype)
+	rr = binary.BigEndian.AppendUint16(rr, class)
+	rr = binary.BigEndian.AppendUint32(rr, ttl)
+	rr = binary.BigEndian.AppendUint16(rr, uint16(len(rdata)))
+	return append(rr, rdata...)
+}
+
+func buildTestUpdate(zone string, prereqs, updates [][]byte) []byte {
+	msg := []byte{0x12, 0x34, opcodeUpdate << 3, 0, 0, 1, 0, byte(len(prereqs)), 0, byte(len(updates)), 0, 0}
+	msg = append(msg, encodeDNSName(zone)...)
+	msg = append(msg, 0, 6, 0, 1) // SOA IN
+	for _, rr := range append(prereqs, updates...) {
+		msg = append(msg, rr...)
+	}
+	return msg
+}
+
+func newTestUpdater(t *testing.T) (*Updater, *Store) {
+	t.Helper()
+	store, err := NewStore(filepath.Join(t.TempDir(), "records.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	allow := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}
+	keys := newStaticTSIGKeyring(TSIGKeys{"acme": []byte("0123456789abcdef0123456789abcdef")})
+	return NewUpdater(store, NewZones([]string{"my.lan"}), allow, keys), store
+}
+
+func TestUpdate(t *testing.T) {
+	u, store := newTestUpdater(t)
+	dhcp := netip.MustParseAddr("10.0.0.5")
+	rcode := func(resp []byte) int { return int(resp[3] & 0x0F) }
+
+	add := testRR("printer.my.lan", 1, 1, 300, []byte{10, 0, 0, 20})
+	resp := u.Handle(buildTestUpdate("my.lan", nil, [][]byte{add}), dhcp)
+	if rcode(resp) != 0 || resp[2]&0x80 == 0 || binary.BigEndian.Uint16(resp[0:2]) != 0x1234 {
+		t.Fatalf("add: response % x", resp)
+	}
+	if recs, _ := store.Resolve("printer.my.lan", 1); len(recs) != 1 || recs[0].Value != "10.0.0.20" {
+		t.Fatalf("after add: %+v", recs)
+	}
+	// Adding the same record again is a no-op
+	u.Handle(buildTestUpdate("my.lan", nil, [][]byte{add}), dhcp)
+	if n := len(store.List()); n != 1 {
+		t.Errorf("duplicate add left %d records", n)
+	}
+
+	tests := []struct {
+		name    string
+		zone    string
+		prereqs [][]byte
+		updates [][]byte
+		client  string
+		want    int
+	}{
+		{"client not allowed", "my.lan", nil, [][]byte{add}, "192.168.1.9", rcodeRefused},
+		{"zone not ours", "other.lan", nil, [][]byte{testRR("x.other.lan", 1, 1, 300, []byte{10, 0, 0, 1})}, "10.0.0.5", rcodeNotAuth},
+		{"name outside zone", "my.lan", nil, [][]byte{testRR("x.other.lan", 1, 1, 300, []byte{10, 0, 0, 1})}, "10.0.0.5", rcodeNotZone},
+		{"unsupported type", "my.lan", nil, [][]byte{testRR("my.lan", 15, 1, 300, append([]byte{0, 10}, encodeDNSName("mail.my.lan")...))}, "10.0.0.5", rcodeRefused},
+		{"name must not exist", "my.lan", [][]byte{testRR("printer.my.lan", 255, 254, 0, nil)}, [][]byte{add}, "10.0.0.5", rcodeYXDomain},
+		{"rrset must exist", "my.lan", [][]byte{testRR("printer.my.lan", 28, 255, 0, nil)}, nil, "10.0.0.5", rcodeNXRRSet},
+		{"rrset must match", "my.lan", [][]byte{testRR("printer.my.lan", 1, 1, 0, []byte{10, 0, 0, 21})}, nil, "10.0.0.5", rcodeNXRRSet},
+		{"prereq with ttl", "my.lan", [][]byte{testRR("printer.my.lan", 1, 255, 60, nil)}, nil, "10.0.0.5", rcodeFormErr},
+	}
+	for _, tt := range tests {
+		resp := u.Handle(buildTestUpdate(tt.zone, tt.prereqs, tt.updates), netip.MustParseAddr(tt.client))
+		if got := rcode(resp); got != tt.want {
+			t.Errorf("%s: rcode = %s, want %s", tt.name, rcodeString(got), rcodeString(tt.want))
+		}
+	}
+
+	// Replace the address if it is still the one we expect
+	prereq := testRR("printer.my.lan", 1, 1, 0, []byte{10, 0, 0, 20})
+	del := testRR("printer.my.lan", 1, 255, 0, nil)
+	replace := testRR("printer.my.lan", 1, 1, 300, []byte{10, 0, 0, 21})
+	if resp := u.Handle(buildTestUpdate("my.lan", [][]byte{prereq}, [][]byte{del, replace}), dhcp); rcode(resp) != 0 {
+		t.Fatalf("replace: rcode %s", rcodeString(rcode(resp)))
+	}
+	if recs, _ := store.Resolve("printer.my.lan", 1); len(recs) != 1 || recs[0].Value != "10.0.0.21" {
+		t.Fatalf("after replace: %+v", recs)
+	}
+
+	// Deleting the name removes everything at it
+	if resp := u.Handle(buildTestUpdate("my.lan", nil, [][]byte{testRR("printer.my.lan", 255, 255, 0, nil)}), dhcp); rcode(resp) != 0 {
+		t.Fatalf("delete: rcode %s", rcodeString(rcode(resp)))
+	}
+	if n := len(store.List()); n != 0 {
+		t.Errorf("%d records left after delete", n)
+	}
+}
+
+func TestUpdateTSIG(t *testing.T) {
+	u, store := newTestUpdater(t)
+	now := time.Unix(1_700_000_000, 0)
+	u.now = func() time.Time { return now }
+	outsider := netip.MustParseAddr("203.0.113.7")
+	secret := u.keys.Keys()["acme"]
+
+	txt := testRR("_acme-challenge.www.my.lan", 16, 1, 60, encodeTXT("token-value"))
+	req := signTSIG(buildTestUpdate("my.lan", nil, [][]byte{txt}), "acme", secret, now)
+	resp := u.Handle(req, outsider)
+	if rcode := resp[3] & 0x0F; rcode != 0 {
+		t.Fatalf("signed update: rcode %s", rcodeString(int(rcode)))
+	}
+	if recs, _ := store.Resolve("_acme-challenge.www.my.lan", 16); len(recs) != 1 || recs[0].Value != "token-value" {
+		t.Fatalf("after signed update: %+v", recs)
+	}
+
+	// The response is signed over the request's MAC
+	_, reqSig, _ := splitTSIG(req)
+	unsigned, respSig, err := splitTSIG(resp)
+	if err != nil || respSig == nil {
+		t.Fatalf("response not signed: %v", err)
+	}
+	if want := respSig.sign(secret, reqSig.mac, unsigned); string(respSig.mac) != string(want) {
+		t.Error("response MAC does not verify")
+	}
+
+	tests := []struct {
+		name   string
+		key    string
+		secret []byte
+		at     time.Time
+		want   uint16
+	}{
+		{"wrong secret", "acme", []byte("not the secret"), now, tsigBadSig},
+		{"unknown key", "other", secret, now, tsigBadKey},
+		{"clock skew", "acme", secret, now.Add(10 * time.Minute), tsigBadTime},
+	}
+	for _, tt := range tests {
+		req := signTSIG(buildTestUpdate("my.lan", nil, [][]byte{txt}), tt.key, tt.secret, tt.at)
+		resp := u.Handle(req, outsider)
+		_, sig, err := splitTSIG(resp)
+		if resp[3]&0x0F != rcodeNotAuth || err != nil || sig == nil || sig.err != tt.want {
+			t.Errorf("%s: rcode %d, tsig %+v, want NOTAUTH with error %d", tt.name, resp[3]&0x0F, sig, tt.want)
+		}
+	}
+}
+
+func TestDNSUpdateThenQuery(t *testing.T) {
+	u, store := newTestUpdater(t)
+	u.allow = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	dns := NewDNSServer(store, nil)
+	dns.updater = u
+	addr := startDNSServer(t, dns)
+
+	txt := testRR("_acme-challenge.my.lan", 16, 1, 60, encodeTXT("abc"))
+	if resp := exchange(t, addr, buildTestUpdate("my.lan", nil, [][]byte{txt})); resp[3]&0x0F != 0 {
+		t.Fatalf("update: rcode %d", resp[3]&0x0F)
+	}
+	msg, err := parseMessage(exchange(t, addr, buildTestQuery("_acme-challenge.my.lan", 16, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answers) != 1 || msg.Answers[0].Data != `"abc"` {
+		t.Errorf("TXT answers = %v", msg.Answers)
+	}
+}
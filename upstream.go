@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	// unhealthyAfter consecutive failures moves an upstream to the back of the line.
+	unhealthyAfter = 3
+)
+
+type upstreamState struct {
+	addr      string
+	healthy   bool
+	failures  int
+	latency   time.Duration // exponentially weighted moving average
+	lastCheck time.Time
+	lastError string
+	queries   int64
+	errors    int64
+}
+
+// UpstreamStatus is the externally visible health of one upstream.
+type UpstreamStatus struct {
+	Addr      string    `json:"addr"`
+	Healthy   bool      `json:"healthy"`
+	LatencyMS float64   `json:"latency_ms"`
+	Failures  int       `json:"consecutive_failures"`
+	Queries   int64     `json:"queries"`
+	Errors    int64     `json:"errors"`
+	LastCheck time.Time `json:"last_check,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+	Preferred bool      `json:"preferred"`
+}
+
+// Upstreams tracks the health of each upstream resolver from both live
+// traffic and periodic probes, and hands out the order in which they should
+// be tried: healthy ones first, encrypted before plain, fastest first,
+// unhealthy ones last.
+type Upstreams struct {
+	mu       sync.Mutex
+	list     []*upstreamState
+	path     string   // where runtime changes are persisted ("" keeps them in memory)
+	fallback []string // flags or resolv.conf, used until something is set at runtime
+}
+
+func NewUpstreams(addrs []string) *Upstreams {
+	u := &Upstreams{fallback: addrs}
+	u.replace(addrs)
+	return u
+}
+
+// LoadUpstreams returns the upstream list saved at path by an earlier Set, or
+// fallback if nothing has been saved.
+func LoadUpstreams(path string, fallback []string) (*Upstreams, error) {
+	u := NewUpstreams(fallback)
+	u.path = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addr, err := normalizeUpstream(line)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) > 0 {
+		u.replace(addrs)
+	}
+	return u, nil
+}
+
+// Set replaces the upstream list and persists it. Upstreams that stay in the
+// list keep their health history.
+func (u *Upstreams) Set(addrs []string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.path != "" {
+		if err := writeFileAtomic(u.path, []byte(strings.Join(addrs, "\n")+"\n"), false); err != nil {
+			return err
+		}
+	}
+	u.replace(addrs)
+	return nil
+}
+
+// Reset forgets the runtime list and goes back to the fallback.
+func (u *Upstreams) Reset() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.path != "" {
+		if err := os.Remove(u.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	u.replace(u.fallback)
+	return nil
+}
+
+// replace swaps in addrs, reusing existing state. Caller must hold u.mu
+// unless u is not yet shared.
+func (u *Upstreams) replace(addrs []string) {
+	list := make([]*upstreamState, 0, len(addrs))
+	for _, a := range addrs {
+		i := slices.IndexFunc(u.list, func(st *upstreamState) bool { return st.addr == a })
+		if i >= 0 {
+			list = append(list, u.list[i])
+		} else {
+			list = append(list, &upstreamState{addr: a, healthy: true})
+		}
+	}
+	u.list = list
+}
+
+// Ordered returns upstream addresses in preferred order. The sort is stable,
+// so configuration order breaks ties between equally fast upstreams.
+func (u *Upstreams) Ordered() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	states := slices.Clone(u.list)
+	slices.SortStableFunc(states, compareUpstreams)
+	addrs := make([]string, len(states))
+	for i, st := range states {
+		addrs[i] = st.addr
+	}
+	return addrs
+}
+
+func compareUpstreams(a, b *upstreamState) int {
+	if a.healthy != b.healthy {
+		if a.healthy {
+			return -1
+		}
+		return 1
+	}
+	// Plain UDP upstreams are only a fallback for encrypted ones
+	if da, db := isDoTUpstream(a.addr), isDoTUpstream(b.addr); da != db {
+		if da {
+			return -1
+		}
+		return 1
+	}
+	// Only distinguish latencies that differ meaningfully, so jitter doesn't
+	// flip the order on every probe.
+	const slack = 5 * time.Millisecond
+	switch {
+	case a.latency+slack < b.latency:
+		return -1
+	case b.latency+slack < a.latency:
+		return 1
+	}
+	return 0
+}
+
+// Report records the outcome of one exchange with an upstream.
+func (u *Upstreams) Report(addr string, rtt time.Duration, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, st := range u.list {
+		if st.addr != addr {
+			continue
+		}
+		st.queries++
+		if err != nil {
+			st.errors++
+			st.failures++
+			st.lastError = err.Error()
+			if st.healthy && st.failures >= unhealthyAfter {
+				st.healthy = false
+				slog.Warn("upstream marked unhealthy", "upstream", addr, "error", err)
+			}
+			return
+		}
+		if !st.healthy {
+			slog.Info("upstream recovered", "upstream", addr)
+		}
+		st.healthy = true
+		st.failures = 0
+		if st.latency == 0 {
+			st.latency = rtt
+		} else {
+			st.latency = (st.latency*7 + rtt) / 8
+		}
+		return
+	}
+}
+
+// Addrs returns the configured upstreams in configuration order.
+func (u *Upstreams) Addrs() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	addrs := make([]string, len(u.list))
+	for i, st := range u.list {
+		addrs[i] = st.addr
+	}
+	return addrs
+}
+
+func (u *Upstreams) Status() []UpstreamStatus {
+	preferred := ""
+	if ordered := u.Ordered(); len(ordered) > 0 {
+		preferred = ordered[0]
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	result := make([]UpstreamStatus, len(u.list))
+	for i, st := range u.list {
+		result[i] = UpstreamStatus{
+			Addr:      st.addr,
+			Healthy:   st.healthy,
+			LatencyMS: float64(st.latency.Microseconds()) / 1000,
+			Failures:  st.failures,
+			Queries:   st.queries,
+			Errors:    st.errors,
+			LastCheck: st.lastCheck,
+			LastError: st.lastError,
+			Preferred: st.addr == preferred,
+		}
+	}
+	return result
+}
+
+// probe sends a root NS query to every upstream and reports the result.
+func (u *Upstreams) probe(exchange func(query []byte, upstream string) ([]byte, error)) {
+	var wg sync.WaitGroup
+	for _, addr := range u.Addrs() {
+		wg.Go(func() {
+			start := time.Now()
+			_, err := exchange(buildQuery(".", 2), addr)
+			u.Report(addr, time.Since(start), err)
+			u.mu.Lock()
+			for _, st := range u.list {
+				if st.addr == addr {
+					st.lastCheck = time.Now()
+				}
+			}
+			u.mu.Unlock()
+		})
+	}
+	wg.Wait()
+}
+
+// RunHealthChecks probes all upstreams every interval until ctx is done.
+func (s *DNSServer) RunHealthChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.upstreams.probe(s.forwardTo)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpstreamsOrdering(t *testing.T) {
+	u := NewUpstreams([]string{"a:53", "b:53", "c:53"})
+
+	if got := u.Ordered(); got[0] != "a:53" || got[2] != "c:53" {
+		t.Fatalf("initial order = %v, want configuration order", got)
+	}
+
+	// b is clearly faster than a
+	u.Report("a:53", 80*time.Millisecond, nil)
+	u.Report("b:53", 10*time.Millisecond, nil)
+	u.Report("c:53", 12*time.Millisecond, nil)
+	if got := u.Ordered(); got[0] != "b:53" || got[1] != "c:53" || got[2] != "a:53" {
+		t.Errorf("order by latency = %v", got)
+	}
+
+	// b fails repeatedly and drops to the back
+	for range unhealthyAfter {
+		u.Report("b:53", 0, errors.New("timeout"))
+	}
+	if got := u.Ordered(); got[2] != "b:53" {
+		t.Errorf("unhealthy upstream not last: %v", got)
+	}
+
+	// A single success restores it
+	u.Report("b:53", 10*time.Millisecond, nil)
+	if got := u.Ordered(); got[0] != "b:53" {
+		t.Errorf("recovered upstream not first: %v", got)
+	}
+}
+
+func TestUpstreamsProbe(t *testing.T) {
+	fake := startFakeUpstream(t, "* * refused")
+	u := NewUpstreams([]string{fake.Addr(), "127.0.0.1:1"})
+	dns := &DNSServer{upstreams: u}
+
+	for range unhealthyAfter {
+		u.probe(dns.forwardTo)
+	}
+
+	status := u.Status()
+	if !status[0].Healthy || status[0].LastCheck.IsZero() || !status[0].Preferred {
+		t.Errorf("fake upstream status = %+v", status[0])
+	}
+	if status[1].Healthy || status[1].LastError == "" {
+		t.Errorf("closed port status = %+v", status[1])
+	}
+	if fake.Queries() != unhealthyAfter {
+		t.Errorf("probe queries = %d, want %d", fake.Queries(), unhealthyAfter)
+	}
+}
+
+func TestWebUpstreams(t *testing.T) {
+	ws, _ := testWebServer(t)
+	ws.upstreams = NewUpstreams([]string{"10.0.0.1:53"})
+
+	req := httptest.NewRequest("GET", "/api/upstreams", nil)
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+
+	var status []UpstreamStatus
+	json.NewDecoder(w.Body).Decode(&status)
+	if len(status) != 1 || status[0].Addr != "10.0.0.1:53" || !status[0].Healthy {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestUpstreamsSetPersistsAndReset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upstreams.txt")
+	u, err := LoadUpstreams(path, []string{"10.0.0.1:53"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Report("10.0.0.1:53", 0, errors.New("timeout"))
+
+	if err := u.Set([]string{"10.0.0.1:53", "tls://9.9.9.9"}); err != nil {
+		t.Fatal(err)
+	}
+	if st := u.Status(); len(st) != 2 || st[0].Failures != 1 {
+		t.Errorf("existing upstream lost its state: %+v", st)
+	}
+
+	reloaded, err := LoadUpstreams(path, []string{"10.0.0.1:53"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Addrs(); !slices.Equal(got, []string{"10.0.0.1:53", "tls://9.9.9.9"}) {
+		t.Errorf("reloaded = %v", got)
+	}
+
+	if err := reloaded.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Addrs(); !slices.Equal(got, []string{"10.0.0.1:53"}) {
+		t.Errorf("after reset = %v", got)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("reset left the saved list behind")
+	}
+}
+
+func TestWebUpstreamsSet(t *testing.T) {
+	ws, _ := testWebServer(t)
+	ws.upstreams = NewUpstreams([]string{"10.0.0.1:53"})
+
+	req := httptest.NewRequest("PUT", "/api/upstreams", strings.NewReader(`{"upstreams":["1.1.1.1","tls://1.1.1.1?sni=one.one.one.one"]}`))
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if got := ws.upstreams.Addrs(); !slices.Equal(got, []string{"1.1.1.1:53", "tls://1.1.1.1?sni=one.one.one.one"}) {
+		t.Errorf("upstreams = %v", got)
+	}
+
+	for _, body := range []string{`{"upstreams":[]}`, `{"upstreams":["not an ip"]}`, `nope`} {
+		req = httptest.NewRequest("PUT", "/api/upstreams", strings.NewReader(body))
+		w = httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, req)
+		if w.Code != 400 {
+			t.Errorf("%s: status = %d, want 400", body, w.Code)
+		}
+	}
+
+	req = httptest.NewRequest("DELETE", "/api/upstreams", nil)
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	if got := ws.upstreams.Addrs(); !slices.Equal(got, []string{"10.0.0.1:53"}) {
+		t.Errorf("after reset = %v", got)
+	}
+}
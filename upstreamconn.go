@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// upstreamConnQueries is how many queries one UDP socket carries before
+	// it is replaced. A socket kept forever would leave only the transaction
+	// ID for a spoofer to guess; a fresh one gets a fresh source port.
+	upstreamConnQueries = 1000
+	// upstreamIdleTimeout closes connections nothing has used for a while,
+	// such as those to an upstream since dropped from the list
+	upstreamIdleTimeout = 30 * time.Second
+)
+
+// upstreamConn multiplexes queries to one upstream over one connection: a
+// connected UDP socket, or a TCP or TLS stream pipelining them as RFC 7766
+// allows. Each query goes out under a transaction ID of our own, not in use
+// by another in flight, and a single reader hands every reply to the query
+// waiting on its ID.
+type upstreamConn struct {
+	conn   net.Conn
+	stream bool
+
+	mu      sync.Mutex
+	pending map[uint16]*upstreamCall
+	queries int
+	retired bool  // takes no new queries; closed once the last is answered
+	err     error // why the connection closed, once it has
+}
+
+type upstreamCall struct {
+	query []byte // as sent, with our ID
+	reply chan []byte
+}
+
+func newUpstreamConn(conn net.Conn, stream bool) *upstreamConn {
+	c := &upstreamConn{conn: conn, stream: stream, pending: make(map[uint16]*upstreamCall)}
+	go c.read()
+	return c
+}
+
+// usable reports whether new queries may go over c.
+func (c *upstreamConn) usable() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err == nil && !c.retired && (c.stream || c.queries < upstreamConnQueries)
+}
+
+func (c *upstreamConn) exchange(query []byte) ([]byte, error) {
+	call := &upstreamCall{query: slices.Clone(query), reply: make(chan []byte, 1)}
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	var id uint16
+	for {
+		id = uint16(rand.Uint32())
+		if c.pending[id] == nil {
+			break
+		}
+	}
+	binary.BigEndian.PutUint16(call.query, id)
+	c.pending[id] = call
+	c.queries++
+	// Writes are serialized so frames on a stream don't interleave
+	var err error
+	c.conn.SetWriteDeadline(time.Now().Add(forwardTimeout))
+	if c.stream {
+		err = writeTCPMessage(c.conn, call.query)
+	} else {
+		_, err = c.conn.Write(call.query)
+	}
+	c.mu.Unlock()
+	defer c.done(id)
+	if err != nil {
+		c.close(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(forwardTimeout)
+	defer timer.Stop()
+	select {
+	case resp, ok := <-call.reply:
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return nil, c.err
+		}
+		// The client sees its own ID again
+		copy(resp, query[:2])
+		return resp, nil
+	case <-timer.C:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// done forgets query id, closing a retired connection with nothing left in
+// flight.
+func (c *upstreamConn) done(id uint16) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	last := c.retired && len(c.pending) == 0
+	c.mu.Unlock()
+	if last {
+		c.close(net.ErrClosed)
+	}
+}
+
+// retire stops new queries going over c and closes it once the ones in
+// flight are over.
+func (c *upstreamConn) retire() {
+	c.mu.Lock()
+	c.retired = true
+	idle := len(c.pending) == 0
+	c.mu.Unlock()
+	if idle {
+		c.close(net.ErrClosed)
+	}
+}
+
+// close shuts the connection, failing every query still waiting on it with
+// err.
+func (c *upstreamConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.conn.Close()
+	for _, call := range c.pending {
+		close(call.reply)
+	}
+	clear(c.pending)
+}
+
+// read delivers replies until the connection fails or sits idle. Anything
+// that doesn't answer a pending query is dropped, so a forged reply can't
+// displace the real one.
+func (c *upstreamConn) read() {
+	buf := make([]byte, udpBufSize)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(upstreamIdleTimeout))
+		var msg []byte
+		var err error
+		if c.stream {
+			msg, err = readTCPMessage(c.conn)
+		} else {
+			var n int
+			n, err = c.conn.Read(buf)
+			msg = buf[:n]
+		}
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			c.mu.Lock()
+			idle := len(c.pending) == 0
+			c.mu.Unlock()
+			if !idle {
+				continue
+			}
+			err = net.ErrClosed
+		}
+		if err != nil {
+			// A refused UDP query shows up here; its error goes to every
+			// query waiting, as it would have to each on a socket of its own
+			c.close(err)
+			return
+		}
+		if len(msg) < 12 {
+			continue
+		}
+
+		c.mu.Lock()
+		id := binary.BigEndian.Uint16(msg)
+		call := c.pending[id]
+		if call == nil || !matchesQuery(call.query, msg) {
+			c.mu.Unlock()
+			slog.Debug("dropping mismatched upstream reply", "upstream", c.conn.RemoteAddr())
+			continue
+		}
+		delete(c.pending, id)
+		c.mu.Unlock()
+		call.reply <- slices.Clone(msg)
+	}
+}
+
+// upstreamPool keeps the connection queries to one upstream share, dialing
+// a new one when it closes or is retired.
+type upstreamPool struct {
+	stream bool
+	dial   func() (net.Conn, error)
+
+	mu   sync.Mutex
+	conn *upstreamConn
+}
+
+func (p *upstreamPool) get() (*upstreamConn, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil && p.conn.usable() {
+		return p.conn, false, nil
+	}
+	if p.conn != nil {
+		p.conn.retire()
+	}
+	conn, err := p.dial()
+	if err != nil {
+		return nil, false, err
+	}
+	p.conn = newUpstreamConn(conn, p.stream)
+	return p.conn, true, nil
+}
+
+// exchange sends query over the shared connection. A connection that was
+// already open may have been closed by the upstream in the meantime, so a
+// query failing on one is retried once on a fresh connection.
+func (p *upstreamPool) exchange(query []byte) ([]byte, error) {
+	for {
+		c, fresh, err := p.get()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.exchange(query)
+		var ne net.Error
+		if err == nil || fresh || errors.As(err, &ne) && ne.Timeout() {
+			return resp, err
+		}
+		c.retire()
+	}
+}
+
+// close closes the pool's connection, failing the queries on it.
+func (p *upstreamPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.close(net.ErrClosed)
+		p.conn = nil
+	}
+}
+
+// upstreamPool returns the pool for upstream over network, "udp" or "tcp".
+func (s *DNSServer) upstreamPool(network, upstream string) *upstreamPool {
+	key := network + " " + upstream
+	if v, ok := s.pools.Load(key); ok {
+		return v.(*upstreamPool)
+	}
+	p := &upstreamPool{
+		stream: network == "tcp",
+		dial:   func() (net.Conn, error) { return net.DialTimeout(network, upstream, forwardTimeout) },
+	}
+	v, _ := s.pools.LoadOrStore(key, p)
+	return v.(*upstreamPool)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUpstreamConnMultiplexing(t *testing.T) {
+	fake := startFakeUpstream(t, `
+slow.com A delay 100ms answer 10.0.0.1
+fast.com A answer 10.0.0.2
+`)
+	dns := &DNSServer{}
+	t.Cleanup(dns.Close)
+	pool := dns.upstreamPool("udp", fake.Addr())
+
+	// The slow answer comes back after the fast ones sent behind it, over
+	// the same socket
+	var wg sync.WaitGroup
+	for i := range 10 {
+		name, want := "fast.com", byte(2)
+		if i == 0 {
+			name, want = "slow.com", 1
+		}
+		wg.Go(func() {
+			query := buildTestQuery(name, 1, 1)
+			query[0], query[1] = byte(i), 0x42
+			resp, err := dns.forwardTo(query, fake.Addr())
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				return
+			}
+			if resp[0] != byte(i) || resp[1] != 0x42 {
+				t.Errorf("%s: ID = %x%x, want the client's", name, resp[0], resp[1])
+			}
+			if resp[len(resp)-1] != want {
+				t.Errorf("%s: answer ends in %d, want %d", name, resp[len(resp)-1], want)
+			}
+		})
+	}
+	wg.Wait()
+
+	first := pool.conn
+	if _, err := dns.forwardTo(buildTestQuery("fast.com", 1, 1), fake.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	if pool.conn != first {
+		t.Error("socket replaced between queries")
+	}
+}
+
+func TestUpstreamConnRetired(t *testing.T) {
+	fake := startFakeUpstream(t, "fast.com A answer 10.0.0.2\n")
+	dns := &DNSServer{}
+	t.Cleanup(dns.Close)
+	pool := dns.upstreamPool("udp", fake.Addr())
+
+	query := buildTestQuery("fast.com", 1, 1)
+	for range upstreamConnQueries {
+		if _, err := dns.forwardTo(query, fake.Addr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := pool.conn
+	if _, err := dns.forwardTo(query, fake.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	if pool.conn == first {
+		t.Fatalf("socket kept after %d queries", upstreamConnQueries+1)
+	}
+	if first.err == nil {
+		t.Error("retired socket left open")
+	}
+}
+
+// An upstream closing the stream after each answer costs a reconnect, not
+// a failed query.
+func TestUpstreamConnStreamClosed(t *testing.T) {
+	rules, err := ParseFakeScript(strings.NewReader("fast.com A answer 10.0.0.2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := NewFakeUpstream(rules)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if query, err := readTCPMessage(c); err == nil {
+				writeTCPMessage(c, fake.respond(query, true))
+			}
+			c.Close()
+		}
+	}()
+
+	dns := &DNSServer{}
+	t.Cleanup(dns.Close)
+	pool := dns.upstreamPool("tcp", ln.Addr().String())
+	for range 3 {
+		resp, err := pool.exchange(buildTestQuery("fast.com", 1, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp[7] != 1 {
+			t.Errorf("ancount = %d, want 1", resp[7])
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileFinding is one problem found by validateRecordsFile, on a line of the
+// records file (counted from 1).
+type FileFinding struct {
+	Line     int
+	Severity string // "error" or "warning"
+	Message  string
+}
+
+// validateRecordsFile checks a records file more strictly than loading it
+// does, which skips what it can't read. Every line must parse and hold a
+// record the API would accept, no two records may be duplicates or share
+// an ID, and the records must pass checkZones. Expired records are only
+// warned about, since the server deletes them itself.
+func validateRecordsFile(data []byte, zones Zones) []FileFinding {
+	var findings []FileFinding
+	var records []Record
+	lineOf := map[int]int{} // record ID to line
+	now := time.Now()
+	for i, line := range recordLines(data) {
+		n := i + 1
+		if line == "" {
+			continue
+		}
+		r, err := parseRecordLine(line)
+		if err != nil {
+			findings = append(findings, FileFinding{n, "error", err.Error()})
+			continue
+		}
+		if prev, ok := lineOf[r.ID]; ok {
+			findings = append(findings, FileFinding{n, "error", fmt.Sprintf("id %d is already used on line %d", r.ID, prev)})
+			continue
+		}
+		lineOf[r.ID] = n
+
+		check := r
+		check.Expires = time.Time{}
+		if p := validateRecord(&check); p != nil {
+			findings = append(findings, FileFinding{n, "error", p.Detail})
+			continue
+		}
+		if r.expired(now) {
+			findings = append(findings, FileFinding{n, "warning", "expired " + r.Expires.Format(time.RFC3339)})
+		}
+		check.Expires = r.Expires
+		if dup, ok := duplicateOf(records, check, 0); ok {
+			findings = append(findings, FileFinding{n, "error", fmt.Sprintf("duplicates the record on line %d", lineOf[dup.ID])})
+			continue
+		}
+		records = append(records, check)
+	}
+
+	for _, f := range checkZones(records, zones) {
+		var lines []int
+		for _, id := range f.Records {
+			lines = append(lines, lineOf[id])
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		slices.Sort(lines)
+		msg := f.Domain + ": " + f.Message + " (" + f.Check
+		if len(lines) > 1 {
+			msg += ", lines " + joinInts(lines)
+		}
+		findings = append(findings, FileFinding{lines[0], f.Severity, msg + ")"})
+	}
+	slices.SortStableFunc(findings, func(a, b FileFinding) int { return a.Line - b.Line })
+	return findings
+}
+
+func joinInts(ns []int) string {
+	s := make([]string, len(ns))
+	for i, n := range ns {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ", ")
+}
+
+func handleValidate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	var zones listFlag
+	fs.Var(&zones, "zone", "Zone apex we are authoritative for, for the CNAME checks (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: regieleki validate [flags] <records.tsv>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	path := fs.Arg(0)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	failed := false
+	for _, f := range validateRecordsFile(data, NewZones(zones)) {
+		fmt.Printf("%s:%d: %s: %s\n", path, f.Line, f.Severity, f.Message)
+		failed = failed || f.Severity == "error"
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
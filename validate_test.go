@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestValidateRecordsFile(t *testing.T) {
+	data := strings.Join([]string{
+		"1\tapp.test\tA\t10.0.0.1",
+		"2\tapp.test\tA\t10.0.0.300",
+		"3\tAPP.test\tA\t10.0.0.1",
+		"1\tother.test\tA\t10.0.0.2",
+		"4\twww.test\tCNAME\tapp.test",
+		"5\twww.test\tTXT\thello",
+		"6\told.test\tA\t10.0.0.3\t\t\t\t2020-01-01T00:00:00Z",
+		"7\tapp.test\tMX\tmail.test",
+		"",
+		"8\tshort.test\tA",
+	}, "\n")
+
+	var got []string
+	for _, f := range validateRecordsFile([]byte(data), NewZones([]string{"test"})) {
+		got = append(got, fmt.Sprintf("%d %s %s", f.Line, f.Severity, f.Message))
+	}
+	want := []string{
+		"2 error invalid IPv4 address",
+		"3 error duplicates the record on line 1",
+		"4 error id 1 is already used on line 1",
+		"5 error www.test: CNAME alongside other records at the same name (cname-conflict, lines 5, 6)",
+		"7 warning expired 2020-01-01T00:00:00Z",
+		`8 error unknown type "MX"`,
+		"10 error 3 columns, want 4 to 9",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("findings:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
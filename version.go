@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+// builtinFeatures are the optional subsystems compiled into every binary;
+// which of them a running server uses is up to its flags.
+var builtinFeatures = []string{
+	"acme", "axfr", "blocklists", "cache", "consul", "ddns", "dns-over-tls-upstreams", "dynamic-updates",
+	"etcd", "https", "ldap", "mdns", "mqtt", "oidc", "peers", "public-sync", "querylog", "raft", "secondary", "standby", "tailscale", "tsig",
+}
+
+// VersionInfo describes the build of the running binary.
+type VersionInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit,omitempty"`
+	Time      string   `json:"commit_time,omitempty"`
+	Modified  bool     `json:"modified,omitempty"` // built from a tree with uncommitted changes
+	GoVersion string   `json:"go_version"`
+	Platform  string   `json:"platform"`
+	Features  []string `json:"features"`
+}
+
+// buildVersion reads the version from -ldflags, falling back to the module
+// version go install records, and the commit from the VCS stamp go build
+// embeds in a git checkout.
+func buildVersion() VersionInfo {
+	v := VersionInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	if v.Version == "dev" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		v.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			v.Commit = s.Value
+		case "vcs.time":
+			v.Time = s.Value
+		case "vcs.modified":
+			v.Modified = s.Value == "true"
+		}
+	}
+	return v
+}
+
+func handleVersion(args []string) {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "usage: regieleki version")
+		os.Exit(2)
+	}
+	v := buildVersion()
+	fmt.Println("regieleki", v.Version)
+	if v.Commit != "" {
+		commit := v.Commit
+		if v.Modified {
+			commit += " (modified)"
+		}
+		fmt.Println("commit:  ", commit, v.Time)
+	}
+	fmt.Println("go:      ", v.GoVersion, v.Platform)
+	fmt.Println("features:", strings.Join(builtinFeatures, " "))
+}
+
+// features lists the optional subsystems this server has enabled.
+func (s *WebServer) features() []string {
+	var out []string
+	add := func(name string, on bool) {
+		if on {
+			out = append(out, name)
+		}
+	}
+	add("https", s.tls != nil)
+	add("tokens", s.tokens != nil)
+	add("oidc", s.oidc != nil)
+	add("cache", s.cache != nil)
+	add("blocklists", s.blocklist != nil)
+	add("querylog", s.querylog != nil)
+	add("metrics", s.metrics != nil)
+	add("pprof", s.pprof)
+	add("http-rate-limit", s.limiter != nil)
+	add("standby", s.standby != nil)
+	add("ddns", s.ddns != nil)
+	add("etcd", s.store.Shared() && s.raft == nil)
+	add("raft", s.raft != nil)
+	if d := s.dns; d != nil {
+		add("authoritative-only", d.authoritativeOnly)
+		add("dynamic-updates", d.updater != nil)
+		add("axfr", d.transfers != nil)
+		add("secondary", d.secondary != nil)
+		add("rrl", d.rrl != nil)
+		add("peers", d.peers != nil)
+	}
+	return out
+}
+
+// handleAPIVersion reports the build and the enabled features, for fleet
+// inventory.
+func (s *WebServer) handleAPIVersion(w http.ResponseWriter, r *http.Request) {
+	v := buildVersion()
+	v.Features = s.features()
+	if v.Features == nil {
+		v.Features = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestAPIVersion(t *testing.T) {
+	ws, _ := testWebServer(t)
+	ws.cache = NewCache(10)
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/version", nil))
+	var v VersionInfo
+	if err := json.NewDecoder(w.Body).Decode(&v); err != nil || w.Code != 200 {
+		t.Fatalf("status %d: %v", w.Code, err)
+	}
+	if v.Version == "" || v.GoVersion != runtime.Version() || v.Platform != runtime.GOOS+"/"+runtime.GOARCH {
+		t.Errorf("version = %+v", v)
+	}
+	if !slices.Equal(v.Features, []string{"cache"}) {
+		t.Errorf("features = %v, want just the cache", v.Features)
+	}
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/tls"
 	"embed"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -17,29 +25,136 @@ import (
 //go:embed index.html
 var indexHTML embed.FS
 
+// openAPISpec describes the records API, for generating clients.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
 type WebServer struct {
-	store *Store
-	token string
-	srv   *http.Server
+	store     *Store
+	tokens    *TokenSet
+	oidc      *OIDC // accept JWTs from an identity provider; nil disables
+	jobs      *Scheduler
+	chaos     *Chaos
+	cache     *Cache
+	upstreams *Upstreams
+	dns       *DNSServer
+	standby   *Standby
+	raft      *Raft
+	blocklist *Blocklist
+	backups   *Backups
+	metrics   *Metrics
+	limiter   *HTTPRateLimiter // 429 clients over budget; nil disables
+	querylog  *QueryLog
+	tsig      *TSIGKeyring // keys managed at /api/tsig-keys; nil without -tsig-keys
+	ddns      DDNSHosts    // hosts DynDNS clients may update; nil disables
+	pprof     bool         // serve runtime profiles under /debug/pprof/
+	accessLog bool         // log every request
+	tls       *tls.Config  // serve HTTPS instead of HTTP
+	zones     Zones
+	ui        UIConfig
+	srv       *http.Server
+	onListen  func() // called once the listener is bound
+	activated *Activated
 }
 
-func NewWebServer(store *Store, token string) *WebServer {
-	return &WebServer{store: store, token: token}
+func NewWebServer(store *Store, tokens *TokenSet) *WebServer {
+	return &WebServer{store: store, tokens: tokens, ui: UIConfig{Title: defaultUITitle}}
 }
 
 func (s *WebServer) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /api/records", s.handleList)
 	mux.HandleFunc("POST /api/records", s.handleCreate)
+	mux.HandleFunc("PUT /api/records", s.handleSetRRSet)
+	mux.HandleFunc("DELETE /api/records", s.handleDeleteNamed)
 	mux.HandleFunc("PUT /api/records/{id}", s.handleUpdate)
+	mux.HandleFunc("PATCH /api/records/{id}", s.handlePatch)
 	mux.HandleFunc("DELETE /api/records/{id}", s.handleDelete)
+	mux.HandleFunc("POST /api/records/batch", s.handleBatch)
+	mux.HandleFunc("GET /api/records/export", s.handleExport)
+	mux.HandleFunc("POST /api/records/import", s.handleBulkImport)
+	mux.HandleFunc("GET /api/backups", s.handleBackups)
+	mux.HandleFunc("POST /api/backups", s.handleBackupTake)
+	mux.HandleFunc("POST /api/restore", s.handleRestore)
+	mux.HandleFunc("GET /api/jobs", s.handleJobs)
+	mux.HandleFunc("POST /api/jobs/{name}/run", s.handleJobRun)
+	mux.HandleFunc("GET /api/cache", s.handleCache)
+	mux.HandleFunc("POST /api/cache/flush", s.handleCacheFlush)
+	mux.HandleFunc("GET /api/upstreams", s.handleUpstreams)
+	mux.HandleFunc("PUT /api/upstreams", s.handleUpstreamsSet)
+	mux.HandleFunc("DELETE /api/upstreams", s.handleUpstreamsReset)
+	mux.HandleFunc("GET /api/blocklists", s.handleBlocklists)
+	mux.HandleFunc("PUT /api/blocklists", s.handleBlocklistsSet)
+	mux.HandleFunc("GET /api/compare", s.handleCompare)
+	mux.HandleFunc("GET /api/resolve", s.handleResolve)
+	mux.HandleFunc("GET /api/slo", s.handleSLO)
+	mux.HandleFunc("GET /api/stats", s.handleStats)
+	mux.HandleFunc("GET /api/querylog", s.handleQueryLog)
+	mux.HandleFunc("GET /api/querylog/stream", s.handleQueryLogStream)
+	mux.HandleFunc("GET /api/zones/check", s.handleZoneCheck)
+	mux.HandleFunc("POST /api/import", s.handleImport)
+	mux.HandleFunc("GET /api/replica", s.handleReplica)
+	mux.HandleFunc("GET /api/standby", s.handleStandby)
+	mux.HandleFunc("GET /api/raft", s.handleRaft)
+	mux.HandleFunc("GET /api/tsig-keys", s.handleTSIGKeys)
+	mux.HandleFunc("POST /api/tsig-keys", s.handleTSIGKeyCreate)
+	mux.HandleFunc("DELETE /api/tsig-keys/{name}", s.handleTSIGKeyDelete)
+	mux.HandleFunc("GET /api/chaos", s.handleChaosList)
+	mux.HandleFunc("PUT /api/chaos", s.handleChaosSet)
+	mux.HandleFunc("DELETE /api/chaos/{domain}", s.handleChaosDelete)
+	mux.HandleFunc("GET /api/version", s.handleAPIVersion)
+	mux.HandleFunc("GET /api/openapi.json", s.handleOpenAPI)
+	mux.HandleFunc("GET /api/ui", s.handleUI)
+	mux.HandleFunc("GET /logo", s.handleLogo)
+	if s.ui.Kiosk {
+		mux.HandleFunc("GET /kiosk", s.handleKioskPage)
+		mux.HandleFunc("GET /api/kiosk", s.handleKiosk)
+	}
+	if s.ddns != nil {
+		mux.HandleFunc("GET "+ddnsPath, s.handleDynDNS)
+	}
 	mux.Handle("GET /", http.FileServer(http.FS(indexHTML)))
-	if s.token != "" {
-		return requireAuth(s.token, mux)
+	var handler http.Handler = mux
+	var auth authenticators
+	if s.tokens != nil {
+		mux.HandleFunc("GET /api/token", s.handleToken)
+		mux.HandleFunc("GET /api/tokens", s.handleTokens)
+		mux.HandleFunc("POST /api/tokens", s.handleTokenCreate)
+		mux.HandleFunc("DELETE /api/tokens/{name}", s.handleTokenRevoke)
+		auth = append(auth, s.tokens)
+	}
+	if s.oidc != nil {
+		mux.HandleFunc("GET /auth/login", s.oidc.handleLogin)
+		mux.HandleFunc("GET /auth/callback", s.oidc.handleCallback)
+		auth = append(auth, s.oidc)
+	}
+	if len(auth) > 0 {
+		handler = requireAuth(auth, handler)
+	}
+	if s.limiter != nil {
+		handler = s.limiter.Middleware(handler)
+	}
+	if s.pprof {
+		mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+		mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
 	}
-	return mux
+	if s.metrics != nil {
+		mux.HandleFunc("GET /metrics", s.handleMetrics)
+		handler = s.metrics.Middleware(handler)
+	}
+	if s.accessLog {
+		handler = withAccessLog(handler)
+	}
+	return withRequestIDs(handler)
 }
 
+// ListenAndServe serves the API and UI on addr, a TCP address or "unix:"
+// and a socket path. Requests on a Unix socket need no token and are served
+// over plain HTTP, even with TLS configured.
 func (s *WebServer) ListenAndServe(addr string) error {
 	s.srv = &http.Server{
 		Addr:         addr,
@@ -47,9 +162,47 @@ func (s *WebServer) ListenAndServe(addr string) error {
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  60 * time.Second,
+		TLSConfig:    s.tls,
+	}
+	if s.querylog != nil {
+		s.srv.RegisterOnShutdown(s.querylog.Close)
+	}
+	if path, ok := cutUnix(addr); ok {
+		ln, ok := s.activated.Listener(addr)
+		if !ok {
+			var err error
+			if ln, err = listenUnix(path); err != nil {
+				return err
+			}
+		}
+		s.srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, unixConnKey{}, true)
+		}
+		slog.Info("http server listening", "socket", path)
+		s.listening()
+		return s.srv.Serve(ln)
+	}
+	ln, ok := s.activated.Listener(addr)
+	if !ok {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return err
+		}
+	}
+	if s.tls != nil {
+		slog.Info("https server listening", "addr", addr)
+		s.listening()
+		return s.srv.ServeTLS(ln, "", "")
 	}
 	slog.Info("http server listening", "addr", addr)
-	return s.srv.ListenAndServe()
+	s.listening()
+	return s.srv.Serve(ln)
+}
+
+func (s *WebServer) listening() {
+	if s.onListen != nil {
+		s.onListen()
+	}
 }
 
 func (s *WebServer) Shutdown(ctx context.Context) error {
@@ -59,121 +212,1189 @@ func (s *WebServer) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// apiRecord is a Record as the records API takes and returns it: the
+// disabled flag is spelled enabled, which defaults to true when omitted, and
+// internationalized names are also spelled in Unicode for display.
+type apiRecord struct {
+	Record
+	Enabled       bool   `json:"enabled"`
+	DomainUnicode string `json:"domain_unicode,omitempty"`
+	ValueUnicode  string `json:"value_unicode,omitempty"`
+	// Tags shadows Record's comma-separated tags with a list.
+	Tags []string `json:"tags,omitempty"`
+
+	// HideDisabled shadows Record's own disabled field, so the flag is
+	// only ever read and written as enabled.
+	HideDisabled *struct{} `json:"disabled,omitempty"`
+}
+
+// decodeRecord reads an apiRecord from a request body.
+func decodeRecord(r io.Reader) (Record, error) {
+	in := apiRecord{Enabled: true}
+	if err := json.NewDecoder(r).Decode(&in); err != nil {
+		return Record{}, err
+	}
+	in.Record.Disabled = !in.Enabled
+	in.Record.Tags = strings.Join(in.Tags, ",")
+	return in.Record, nil
+}
+
+func displayRecord(r Record) apiRecord {
+	a := apiRecord{Record: r, Enabled: !r.Disabled}
+	if r.Tags != "" {
+		a.Tags = strings.Split(r.Tags, ",")
+	}
+	if d := toUnicode(r.Domain); d != r.Domain {
+		a.DomainUnicode = d
+	}
+	if v := toUnicode(r.Value); r.Type == "CNAME" && v != r.Value {
+		a.ValueUnicode = v
+	}
+	return a
+}
+
+// handleList returns the records matching ?domain=, ?type= and ?q= (a
+// substring of the name, value or comment), ordered by ?sort= and paged by
+// ?limit= and ?offset=. The number of matches before paging is sent as
+// X-Total-Count.
 func (s *WebServer) handleList(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := RecordQuery{
+		Type:   strings.ToUpper(params.Get("type")),
+		Search: strings.TrimSpace(params.Get("q")),
+		Sort:   params.Get("sort"),
+	}
+	if d := strings.TrimSpace(params.Get("domain")); d != "" {
+		domain, err := toASCII(d)
+		if err != nil {
+			jsonError(w, "invalid domain", http.StatusBadRequest)
+			return
+		}
+		q.Domain = domain
+	}
+	if !ValidSort(q.Sort) {
+		jsonError(w, "sort must be id, domain, type or value, optionally prefixed with -", http.StatusBadRequest)
+		return
+	}
+	for name, dst := range map[string]*int{"limit": &q.Limit, "offset": &q.Offset} {
+		if v := params.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				jsonError(w, name+" must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			*dst = n
+		}
+	}
+
+	records, total := s.store.Query(q)
+	result := make([]apiRecord, len(records))
+	for i, rec := range records {
+		result[i] = displayRecord(rec)
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(s.store.List())
+	json.NewEncoder(w).Encode(result)
 }
 
 func (s *WebServer) handleCreate(w http.ResponseWriter, r *http.Request) {
-	var rec Record
-	if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
-		jsonError(w, "invalid JSON", http.StatusBadRequest)
+	rec, err := decodeRecord(r.Body)
+	if err != nil {
+		jsonProblem(w, http.StatusBadRequest, errInvalidJSON)
 		return
 	}
 
-	if err := validateRecord(&rec); err != "" {
-		jsonError(w, err, http.StatusBadRequest)
+	if p := validateRecord(&rec); p != nil {
+		jsonProblem(w, http.StatusBadRequest, p)
 		return
 	}
 
 	created, saveErr := s.store.Add(rec)
+	if errors.Is(saveErr, ErrDuplicate) {
+		if upsert, _ := strconv.ParseBool(r.URL.Query().Get("upsert")); upsert {
+			s.upsertDuplicate(w, created, rec)
+			return
+		}
+		jsonProblemWith(w, http.StatusConflict, errRecordDup, map[string]any{"record": displayRecord(created)})
+		return
+	}
 	if saveErr != nil {
-		jsonError(w, "failed to save", http.StatusInternalServerError)
+		jsonProblem(w, http.StatusInternalServerError, errSaveFailed)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(created)
+	json.NewEncoder(w).Encode(displayRecord(created))
+}
+
+// upsertDuplicate answers a create with ?upsert=true that matched existing:
+// the request's comment, enabled flag, expiry and tags are applied to it,
+// and it is returned with 200 instead of a conflict.
+func (s *WebServer) upsertDuplicate(w http.ResponseWriter, existing, rec Record) {
+	want := existing
+	want.Comment, want.Disabled, want.Expires, want.Tags = rec.Comment, rec.Disabled, rec.Expires, rec.Tags
+	if want != existing {
+		var err error
+		if existing, err = s.store.Update(existing.ID, want); err != nil {
+			jsonProblem(w, http.StatusInternalServerError, errSaveFailed)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(displayRecord(existing))
+}
+
+// handleSetRRSet makes the body, one record or an array of them, the whole
+// set of records for ?domain= and ?type= (and ?view=), creating, updating
+// and deleting as needed. Repeating a request changes nothing, so update
+// scripts can send their current answer without looking first.
+func (s *WebServer) handleSetRRSet(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	rtype := strings.ToUpper(strings.TrimSpace(params.Get("type")))
+	view := strings.TrimSpace(params.Get("view"))
+	domain, err := toASCII(strings.TrimSpace(params.Get("domain")))
+	if err != nil || domain == "" {
+		jsonProblem(w, http.StatusBadRequest, &problem{"domain_required", "domain is required"})
+		return
+	}
+	domain = strings.ToLower(domain)
+	if !slices.Contains(recordTypes, rtype) {
+		jsonProblem(w, http.StatusBadRequest, newProblem("invalid_type", "type must be one of %s", strings.Join(recordTypes, ", ")))
+		return
+	}
+
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		jsonProblem(w, http.StatusBadRequest, errInvalidJSON)
+		return
+	}
+	items := []json.RawMessage{body}
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		if err := json.Unmarshal(body, &items); err != nil {
+			jsonProblem(w, http.StatusBadRequest, errInvalidJSON)
+			return
+		}
+	}
+	records := make([]Record, 0, len(items))
+	for _, item := range items {
+		rec, err := decodeRecord(bytes.NewReader(item))
+		if err != nil {
+			jsonProblem(w, http.StatusBadRequest, errInvalidJSON)
+			return
+		}
+		rec.Domain, rec.Type, rec.View = cmp.Or(rec.Domain, domain), cmp.Or(rec.Type, rtype), cmp.Or(rec.View, view)
+		if p := validateRecord(&rec); p != nil {
+			jsonProblem(w, http.StatusBadRequest, p)
+			return
+		}
+		if !strings.EqualFold(rec.Domain, domain) || rec.Type != rtype || rec.View != view {
+			jsonProblem(w, http.StatusBadRequest, &problem{"rrset_mismatch", "records must have the domain, type and view of the set"})
+			return
+		}
+		records = append(records, rec)
+	}
+
+	set, changes, err := s.store.SetRRSet(domain, rtype, view, records)
+	if errors.Is(err, ErrDuplicate) {
+		jsonProblem(w, http.StatusConflict, newProblem("duplicate_record", "%v", err))
+		return
+	} else if err != nil {
+		jsonProblem(w, http.StatusInternalServerError, errSaveFailed)
+		return
+	}
+	if len(changes) > 0 {
+		slog.InfoContext(r.Context(), "record set replaced", "domain", domain, "type", rtype, "view", view, "changes", len(changes))
+	}
+	result := make([]apiRecord, len(set))
+	for i, rec := range set {
+		result[i] = displayRecord(rec)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleDeleteNamed deletes every record for ?domain=, in all views, or only
+// those of ?type=, as one change. Names without records are not an error,
+// so teardown scripts can run twice.
+func (s *WebServer) handleDeleteNamed(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	rtype := strings.ToUpper(strings.TrimSpace(params.Get("type")))
+	domain, err := toASCII(strings.TrimSpace(params.Get("domain")))
+	if err != nil || domain == "" {
+		jsonProblem(w, http.StatusBadRequest, &problem{"domain_required", "domain is required"})
+		return
+	}
+	if rtype != "" && !slices.Contains(recordTypes, rtype) {
+		jsonProblem(w, http.StatusBadRequest, newProblem("invalid_type", "type must be one of %s", strings.Join(recordTypes, ", ")))
+		return
+	}
+	deleted, err := s.store.DeleteNamed(domain, rtype)
+	if err != nil {
+		jsonProblem(w, http.StatusInternalServerError, errSaveFailed)
+		return
+	}
+	if len(deleted) > 0 {
+		slog.InfoContext(r.Context(), "records deleted by name", "domain", domain, "type", rtype, "records", len(deleted))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"deleted": len(deleted)})
 }
 
 func (s *WebServer) handleUpdate(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
-		jsonError(w, "invalid id", http.StatusBadRequest)
+		jsonProblem(w, http.StatusBadRequest, errInvalidID)
+		return
+	}
+
+	rec, err := decodeRecord(r.Body)
+	if err != nil {
+		jsonProblem(w, http.StatusBadRequest, errInvalidJSON)
 		return
 	}
 
-	var rec Record
-	if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
-		jsonError(w, "invalid JSON", http.StatusBadRequest)
+	if p := validateRecord(&rec); p != nil {
+		jsonProblem(w, http.StatusBadRequest, p)
+		return
+	}
+
+	updated, saveErr := s.store.Update(id, rec)
+	if saveErr != nil {
+		if errors.Is(saveErr, ErrDuplicate) {
+			jsonProblemWith(w, http.StatusConflict, errRecordDup, map[string]any{"record": displayRecord(updated)})
+		} else if errors.Is(saveErr, os.ErrNotExist) {
+			jsonProblem(w, http.StatusNotFound, errNoRecord)
+		} else {
+			jsonProblem(w, http.StatusInternalServerError, errSaveFailed)
+		}
 		return
 	}
 
-	if err := validateRecord(&rec); err != "" {
-		jsonError(w, err, http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(displayRecord(updated))
+}
+
+// handlePatch applies a JSON merge patch (RFC 7396) to a record: fields in
+// the patch replace the record's, null clears one, and the rest are kept.
+func (s *WebServer) handlePatch(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		jsonProblem(w, http.StatusBadRequest, errInvalidID)
+		return
+	}
+	var patch map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || patch == nil {
+		jsonProblem(w, http.StatusBadRequest, &problem{"invalid_json", "expected a JSON object"})
 		return
 	}
 
-	updated, saveErr := s.store.Update(id, rec.Domain, rec.Type, rec.Value)
+	var invalid *problem
+	updated, saveErr := s.store.Patch(id, func(cur Record) (Record, error) {
+		rec, err := mergePatch(cur, patch)
+		if err != nil {
+			invalid = errInvalidJSON
+		} else {
+			invalid = validateRecord(&rec)
+		}
+		if invalid != nil {
+			return rec, invalid
+		}
+		return rec, nil
+	})
 	if saveErr != nil {
 		if errors.Is(saveErr, os.ErrNotExist) {
-			jsonError(w, "record not found", http.StatusNotFound)
+			jsonProblem(w, http.StatusNotFound, errNoRecord)
+		} else if invalid != nil {
+			jsonProblem(w, http.StatusBadRequest, invalid)
+		} else if errors.Is(saveErr, ErrDuplicate) {
+			jsonProblemWith(w, http.StatusConflict, errRecordDup, map[string]any{"record": displayRecord(updated)})
 		} else {
-			jsonError(w, "failed to save", http.StatusInternalServerError)
+			jsonProblem(w, http.StatusInternalServerError, errSaveFailed)
 		}
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(updated)
+	json.NewEncoder(w).Encode(displayRecord(updated))
+}
+
+// mergePatch applies patch to the API form of r and reads the result back.
+func mergePatch(r Record, patch map[string]json.RawMessage) (Record, error) {
+	var doc map[string]json.RawMessage
+	data, _ := json.Marshal(displayRecord(r))
+	json.Unmarshal(data, &doc)
+	delete(doc, "domain_unicode")
+	delete(doc, "value_unicode")
+	for k, v := range patch {
+		if string(v) == "null" {
+			delete(doc, k)
+		} else {
+			doc[k] = v
+		}
+	}
+	data, _ = json.Marshal(doc)
+	return decodeRecord(bytes.NewReader(data))
 }
 
 func (s *WebServer) handleDelete(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
-		jsonError(w, "invalid id", http.StatusBadRequest)
+		jsonProblem(w, http.StatusBadRequest, errInvalidID)
 		return
 	}
 
 	if err := s.store.Delete(id); err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			jsonError(w, "record not found", http.StatusNotFound)
+			jsonProblem(w, http.StatusNotFound, errNoRecord)
+		} else {
+			jsonProblem(w, http.StatusInternalServerError, errSaveFailed)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleBatch applies a list of create, update and delete operations as one
+// change: all of them or, if any is invalid or names a missing record, none.
+// The response lists the resulting record for each operation, or the
+// removed one for deletes.
+func (s *WebServer) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Operations []struct {
+			Op     string          `json:"op"`
+			ID     int             `json:"id"`
+			Record json.RawMessage `json:"record"`
+		} `json:"operations"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportSize)).Decode(&body); err != nil {
+		jsonProblem(w, http.StatusBadRequest, errInvalidJSON)
+		return
+	}
+	ops := make([]BatchOp, len(body.Operations))
+	for i, in := range body.Operations {
+		fail := func(p *problem) {
+			jsonProblem(w, http.StatusBadRequest, newProblem(p.Code, "operation %d: %s", i+1, p.Detail))
+		}
+		op := BatchOp{Op: in.Op, ID: in.ID}
+		switch in.Op {
+		case "create", "update":
+			rec, err := decodeRecord(bytes.NewReader(in.Record))
+			if err != nil {
+				fail(&problem{"invalid_json", "invalid record"})
+				return
+			}
+			if p := validateRecord(&rec); p != nil {
+				fail(p)
+				return
+			}
+			op.Record = rec
+		case "delete":
+		default:
+			fail(&problem{"invalid_op", "op must be create, update, or delete"})
+			return
+		}
+		if in.Op != "create" && in.ID <= 0 {
+			fail(&problem{"id_required", "id is required"})
+			return
+		}
+		ops[i] = op
+	}
+
+	changes, err := s.store.Batch(ops)
+	if err != nil {
+		if errors.Is(err, ErrDuplicate) {
+			jsonProblem(w, http.StatusConflict, newProblem("duplicate_record", "%v", err))
+		} else if errors.Is(err, os.ErrNotExist) {
+			jsonProblem(w, http.StatusNotFound, newProblem("record_not_found", "%v", err))
 		} else {
-			jsonError(w, "failed to save", http.StatusInternalServerError)
+			jsonProblem(w, http.StatusInternalServerError, errSaveFailed)
+		}
+		return
+	}
+	result := make([]apiRecord, len(changes))
+	for i, c := range changes {
+		rec := c.New
+		if rec == nil {
+			rec = c.Old
+		}
+		result[i] = displayRecord(*rec)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleToken describes the token used for the request and, once it is
+// within the rotation window, its successor, so automation can pick up the
+// new credential during the overlap.
+func (s *WebServer) handleToken(w http.ResponseWriter, r *http.Request) {
+	value := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	presented, _ := s.tokens.Valid(value)
+	resp := struct {
+		Expires   time.Time `json:"expires,omitzero"`
+		Successor *Token    `json:"successor,omitempty"`
+	}{Expires: presented.Expires}
+	successor, ok, err := s.tokens.Successor(value)
+	if err != nil {
+		jsonProblem(w, http.StatusInternalServerError, errSaveFailed)
+		return
+	}
+	if ok {
+		resp.Successor = &successor
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleTokens lists the API tokens by name, scope and expiry; values are
+// only ever shown when a token is created.
+func (s *WebServer) handleTokens(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.tokens.List())
+}
+
+func (s *WebServer) handleTokenCreate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name  string `json:"name"`
+		Scope string `json:"scope"`
+		TTL   string `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonProblem(w, http.StatusBadRequest, errInvalidJSON)
+		return
+	}
+	if req.Scope == "" {
+		req.Scope = tokenScopeWrite
+	}
+	if msg := validTokenName(req.Name); msg != "" {
+		jsonProblem(w, http.StatusBadRequest, &problem{"invalid_token_name", msg})
+		return
+	}
+	if req.Scope != tokenScopeRead && req.Scope != tokenScopeWrite {
+		jsonProblem(w, http.StatusBadRequest, &problem{"invalid_scope", "scope must be read or write"})
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl < 0 {
+			jsonProblem(w, http.StatusBadRequest, &problem{"invalid_ttl", "ttl must be a duration such as 720h"})
+			return
+		}
+	}
+	tok, err := s.tokens.Create(req.Name, req.Scope, ttl)
+	switch {
+	case errors.Is(err, errTokenExists):
+		jsonProblem(w, http.StatusConflict, newProblem("token_exists", "%v", err))
+		return
+	case err != nil:
+		jsonProblem(w, http.StatusInternalServerError, errSaveFailed)
+		return
+	}
+	slog.InfoContext(r.Context(), "api token created", "name", tok.Name, "scope", tok.Scope)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tok)
+}
+
+func (s *WebServer) handleTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	err := s.tokens.Revoke(name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		jsonProblem(w, http.StatusNotFound, &problem{"token_not_found", "token not found"})
+		return
+	case err != nil:
+		jsonProblem(w, http.StatusInternalServerError, errSaveFailed)
+		return
+	}
+	slog.InfoContext(r.Context(), "api token revoked", "name", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *WebServer) handleTSIGKeys(w http.ResponseWriter, r *http.Request) {
+	if s.tsig == nil {
+		jsonError(w, "tsig keys are not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.tsig.List())
+}
+
+func (s *WebServer) handleTSIGKeyCreate(w http.ResponseWriter, r *http.Request) {
+	if s.tsig == nil {
+		jsonError(w, "tsig keys are not enabled", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Name   string `json:"name"`
+		Secret string `json:"secret"` // base64; empty generates one
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonProblem(w, http.StatusBadRequest, errInvalidJSON)
+		return
+	}
+	if msg := validTSIGKeyName(req.Name); msg != "" {
+		jsonProblem(w, http.StatusBadRequest, &problem{"invalid_tsig_key_name", msg})
+		return
+	}
+	var secret []byte
+	if req.Secret != "" {
+		var err error
+		if secret, err = base64.StdEncoding.DecodeString(req.Secret); err != nil || len(secret) < 16 {
+			jsonProblem(w, http.StatusBadRequest, &problem{"invalid_tsig_secret", "secret must be base64, at least 16 bytes"})
+			return
 		}
+	}
+	key, err := s.tsig.Create(req.Name, secret)
+	switch {
+	case errors.Is(err, errTSIGKeyExists):
+		jsonProblem(w, http.StatusConflict, newProblem("tsig_key_exists", "%v", err))
+		return
+	case err != nil:
+		jsonProblem(w, http.StatusInternalServerError, errSaveFailed)
 		return
 	}
+	slog.InfoContext(r.Context(), "tsig key created", "name", key.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(key)
+}
 
+func (s *WebServer) handleTSIGKeyDelete(w http.ResponseWriter, r *http.Request) {
+	if s.tsig == nil {
+		jsonError(w, "tsig keys are not enabled", http.StatusNotFound)
+		return
+	}
+	name := r.PathValue("name")
+	err := s.tsig.Delete(name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		jsonProblem(w, http.StatusNotFound, &problem{"tsig_key_not_found", "tsig key not found"})
+		return
+	case err != nil:
+		jsonProblem(w, http.StatusInternalServerError, errSaveFailed)
+		return
+	}
+	slog.InfoContext(r.Context(), "tsig key deleted", "name", name)
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func validateRecord(r *Record) string {
+func (s *WebServer) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+func (s *WebServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var g metricsGauges
+	g.localRecords, g.sourceRecords = s.store.Counts()
+	if s.cache != nil {
+		g.cacheEnabled, g.cacheEntries = true, s.cache.Len()
+	}
+	if s.dns != nil {
+		g.dnsEnabled, g.queueDepth, g.queueSize = true, len(s.dns.queue), cap(s.dns.queue)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.metrics.Write(w, g)
+}
+
+func (s *WebServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	jobs := []JobStatus{}
+	if s.jobs != nil {
+		jobs = s.jobs.Status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+func (s *WebServer) handleJobRun(w http.ResponseWriter, r *http.Request) {
+	if s.jobs == nil || !s.jobs.Trigger(r.PathValue("name")) {
+		jsonProblem(w, http.StatusNotFound, &problem{"job_not_found", "job not found"})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleCacheFlush empties the cache, or with ?domain= drops just the
+// answers for that name and the names under it.
+func (s *WebServer) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	domain, ok := cacheDomain(w, r)
+	if !ok {
+		return
+	}
+	flushed := 0
+	switch {
+	case s.cache == nil:
+	case domain != "":
+		flushed = s.cache.FlushDomain(domain)
+	default:
+		flushed = s.cache.Flush()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"flushed": flushed})
+}
+
+// handleCache lists cached answers with their remaining TTLs, optionally
+// only those for ?domain= and the names under it, paged by ?limit= (default
+// 100) and ?offset=. The number of entries before paging is sent as
+// X-Total-Count.
+func (s *WebServer) handleCache(w http.ResponseWriter, r *http.Request) {
+	domain, ok := cacheDomain(w, r)
+	if !ok {
+		return
+	}
+	limit, offset := 100, 0
+	for name, dst := range map[string]*int{"limit": &limit, "offset": &offset} {
+		if v := r.URL.Query().Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				jsonError(w, name+" must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			*dst = n
+		}
+	}
+	entries := []CacheEntryInfo{}
+	if s.cache != nil {
+		entries = s.cache.Entries(domain)
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(entries)))
+	entries = entries[min(offset, len(entries)):]
+	entries = entries[:min(limit, len(entries))]
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// cacheDomain reads the ?domain= of the cache endpoints in the form cache
+// keys are in, or reports that it is invalid.
+func cacheDomain(w http.ResponseWriter, r *http.Request) (string, bool) {
+	d := strings.TrimSuffix(strings.TrimSpace(r.URL.Query().Get("domain")), ".")
+	if d == "" {
+		return "", true
+	}
+	domain, err := toASCII(d)
+	if err != nil {
+		jsonProblem(w, http.StatusBadRequest, newProblem("invalid_domain", "invalid domain: %v", err))
+		return "", false
+	}
+	return strings.ToLower(domain), true
+}
+
+func (s *WebServer) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	status := []UpstreamStatus{}
+	if s.upstreams != nil {
+		status = s.upstreams.Status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (s *WebServer) handleUpstreamsSet(w http.ResponseWriter, r *http.Request) {
+	if s.upstreams == nil {
+		jsonError(w, "upstreams unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var body struct {
+		Upstreams []string `json:"upstreams"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		jsonProblem(w, http.StatusBadRequest, errInvalidJSON)
+		return
+	}
+	if len(body.Upstreams) == 0 {
+		jsonError(w, "at least one upstream is required", http.StatusBadRequest)
+		return
+	}
+	addrs := make([]string, 0, len(body.Upstreams))
+	for _, u := range body.Upstreams {
+		addr, err := normalizeUpstream(strings.TrimSpace(u))
+		if err != nil {
+			jsonProblem(w, http.StatusBadRequest, newProblem("invalid_upstream", "%v", err))
+			return
+		}
+		if !slices.Contains(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if err := s.upstreams.Set(addrs); err != nil {
+		jsonError(w, "failed to save upstreams", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "upstreams changed", "upstreams", addrs)
+	s.handleUpstreams(w, r)
+}
+
+func (s *WebServer) handleUpstreamsReset(w http.ResponseWriter, r *http.Request) {
+	if s.upstreams == nil {
+		jsonError(w, "upstreams unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err := s.upstreams.Reset(); err != nil {
+		jsonError(w, "failed to reset upstreams", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "upstreams reset to defaults", "upstreams", s.upstreams.Addrs())
+	s.handleUpstreams(w, r)
+}
+
+func (s *WebServer) handleReplica(w http.ResponseWriter, r *http.Request) {
+	serial, records := s.store.Snapshot()
+	etag := replicaETag(serial)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Replica{Serial: serial, Records: records})
+}
+
+func (s *WebServer) handleStandby(w http.ResponseWriter, r *http.Request) {
+	if s.standby == nil {
+		jsonError(w, "standby mode is not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.standby.Status())
+}
+
+func (s *WebServer) handleRaft(w http.ResponseWriter, r *http.Request) {
+	if s.raft == nil {
+		jsonError(w, "raft is not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.raft.Status())
+}
+
+func (s *WebServer) handleZoneCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(checkZones(s.store.List(), s.zones))
+}
+
+// maxImportSize bounds the uploads the import endpoints accept.
+const maxImportSize = 16 << 20
+
+// handleImport adds the records of a BIND zone file sent as the request
+// body. ?origin= names the zone for relative names and ?dry_run=1 only
+// reports what would be imported.
+func (s *WebServer) handleImport(w http.ResponseWriter, r *http.Request) {
+	zone, err := parseZoneFile(http.MaxBytesReader(w, r.Body, maxImportSize), r.URL.Query().Get("origin"))
+	if err != nil {
+		jsonProblem(w, http.StatusBadRequest, newProblem("invalid_zone_file", "invalid zone file: %v", err))
+		return
+	}
+	plan := planImport(s.store, zone.Records, false)
+	result := plan.result()
+	result.Skipped = zone.Skipped
+	if dry, _ := strconv.ParseBool(r.URL.Query().Get("dry_run")); dry {
+		result.Records = zone.Records
+	} else if err := plan.apply(s.store); err != nil {
+		jsonProblem(w, http.StatusInternalServerError, errSaveFailed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// bulkFormat picks "json" or "csv" from ?format=, falling back to the
+// request's Content-Type, then JSON.
+func bulkFormat(r *http.Request) (string, bool) {
+	switch f := strings.ToLower(r.URL.Query().Get("format")); f {
+	case "json", "csv":
+		return f, true
+	case "":
+		if strings.Contains(r.Header.Get("Content-Type"), "csv") {
+			return "csv", true
+		}
+		return "json", true
+	}
+	return "", false
+}
+
+// handleExport returns the editable records, without those from sync
+// sources, in a form POST /api/records/import takes back.
+func (s *WebServer) handleExport(w http.ResponseWriter, r *http.Request) {
+	format, ok := bulkFormat(r)
+	if !ok {
+		jsonProblem(w, http.StatusBadRequest, &problem{"invalid_format", "format must be json or csv"})
+		return
+	}
+	_, records := s.store.Snapshot()
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="records.`+format+`"`)
+	writeBulk(w, format, records)
+}
+
+// handleBulkImport loads many records in one call. ?mode=merge (the
+// default) adds the records that aren't there yet; ?mode=replace also
+// removes every record missing from the upload. Nothing is changed if any
+// row is invalid; ?dry_run=1 reports the row errors and the counts without
+// changing anything either way.
+func (s *WebServer) handleBulkImport(w http.ResponseWriter, r *http.Request) {
+	format, ok := bulkFormat(r)
+	if !ok {
+		jsonProblem(w, http.StatusBadRequest, &problem{"invalid_format", "format must be json or csv"})
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode != "" && mode != "merge" && mode != "replace" {
+		jsonProblem(w, http.StatusBadRequest, &problem{"invalid_mode", "mode must be merge or replace"})
+		return
+	}
+	records, rowErrs, err := parseBulk(http.MaxBytesReader(w, r.Body, maxImportSize), format)
+	if err != nil {
+		jsonProblem(w, http.StatusBadRequest, newProblem("invalid_"+format, "invalid %s: %v", format, err))
+		return
+	}
+	plan := planImport(s.store, records, mode == "replace")
+	result := plan.result()
+	result.Errors = rowErrs
+
+	w.Header().Set("Content-Type", "application/json")
+	if dry, _ := strconv.ParseBool(r.URL.Query().Get("dry_run")); dry {
+		result.Records = records
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	if len(rowErrs) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	if err := plan.apply(s.store); errors.Is(err, ErrDuplicate) {
+		jsonProblem(w, http.StatusConflict, newProblem("duplicate_record", "%v", err))
+		return
+	} else if err != nil {
+		jsonProblem(w, http.StatusInternalServerError, errSaveFailed)
+		return
+	}
+	slog.InfoContext(r.Context(), "records imported", "mode", cmp.Or(mode, "merge"), "added", result.Added, "removed", result.Removed)
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *WebServer) handleBackups(w http.ResponseWriter, r *http.Request) {
+	if s.backups == nil {
+		jsonError(w, "backups disabled", http.StatusServiceUnavailable)
+		return
+	}
+	backups, err := s.backups.List()
+	if err != nil {
+		jsonError(w, "failed to list backups", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backups)
+}
+
+func (s *WebServer) handleBackupTake(w http.ResponseWriter, r *http.Request) {
+	if s.backups == nil {
+		jsonError(w, "backups disabled", http.StatusServiceUnavailable)
+		return
+	}
+	info, err := s.backups.Take(true)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "backup failed", "error", err)
+		jsonError(w, "failed to write backup", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(info)
+}
+
+// RestoreResult is the POST /api/restore response. Undo names the backup of
+// the records as they were before the restore.
+type RestoreResult struct {
+	Restored string `json:"restored"`
+	Records  int    `json:"records"`
+	Undo     string `json:"undo"`
+}
+
+func (s *WebServer) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if s.backups == nil {
+		jsonError(w, "backups disabled", http.StatusServiceUnavailable)
+		return
+	}
+	var req struct {
+		Backup string `json:"backup"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Backup == "" {
+		jsonError(w, "backup is required", http.StatusBadRequest)
+		return
+	}
+	undo, err := s.backups.Restore(req.Backup)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		jsonProblem(w, http.StatusNotFound, &problem{"backup_not_found", "backup not found"})
+		return
+	case errors.Is(err, ErrShared):
+		jsonProblem(w, http.StatusConflict, newProblem("shared_store", "%v", err))
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "restore failed", "backup", req.Backup, "error", err)
+		jsonError(w, "failed to restore", http.StatusInternalServerError)
+		return
+	}
+	_, records := s.store.Snapshot()
+	slog.InfoContext(r.Context(), "records restored", "backup", req.Backup, "records", len(records), "undo", undo.Name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RestoreResult{Restored: req.Backup, Records: len(records), Undo: undo.Name})
+}
+
+// BlocklistReport is the GET /api/blocklists response.
+type BlocklistReport struct {
+	Mode    string            `json:"mode"` // "nxdomain" or "zero"
+	Domains int               `json:"domains"`
+	Blocked uint64            `json:"blocked"`
+	Lists   []BlocklistStatus `json:"lists"`
+}
+
+func (s *WebServer) handleBlocklists(w http.ResponseWriter, r *http.Request) {
+	if s.blocklist == nil {
+		jsonError(w, "blocklists unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	report := BlocklistReport{Mode: "nxdomain", Lists: s.blocklist.Status()}
+	if s.blocklist.zero {
+		report.Mode = "zero"
+	}
+	report.Domains, report.Blocked = s.blocklist.Counts()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleBlocklistsSet replaces the configured lists and schedules a refresh,
+// since fetching them can take a while.
+func (s *WebServer) handleBlocklistsSet(w http.ResponseWriter, r *http.Request) {
+	if s.blocklist == nil {
+		jsonError(w, "blocklists unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var body struct {
+		Lists []string `json:"lists"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		jsonProblem(w, http.StatusBadRequest, errInvalidJSON)
+		return
+	}
+	sources := make([]string, 0, len(body.Lists))
+	for _, src := range body.Lists {
+		src = strings.TrimSpace(src)
+		if src == "" || strings.ContainsAny(src, "\n\r") {
+			jsonProblem(w, http.StatusBadRequest, &problem{"invalid_blocklist", "invalid blocklist source"})
+			return
+		}
+		if !slices.Contains(sources, src) {
+			sources = append(sources, src)
+		}
+	}
+	if err := s.blocklist.Set(sources); err != nil {
+		jsonError(w, "failed to save blocklists", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "blocklists changed", "lists", sources)
+	if s.jobs != nil && len(sources) > 0 {
+		s.jobs.Trigger("blocklist-refresh")
+	}
+	s.handleBlocklists(w, r)
+}
+
+// handleSLO reports latency percentages for each window in ?window= (default
+// 1h and 24h) against each threshold in ?under= (default 5ms and 50ms).
+func (s *WebServer) handleSLO(w http.ResponseWriter, r *http.Request) {
+	if s.dns == nil || s.dns.latency == nil {
+		jsonError(w, "dns server unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	parse := func(param, def string, limit time.Duration) ([]time.Duration, string) {
+		v := r.URL.Query().Get(param)
+		if v == "" {
+			v = def
+		}
+		var out []time.Duration
+		for _, item := range strings.Split(v, ",") {
+			d, err := time.ParseDuration(strings.TrimSpace(item))
+			if err != nil || d <= 0 || d > limit {
+				return nil, fmt.Sprintf("invalid %s %q", param, item)
+			}
+			out = append(out, d)
+		}
+		return out, ""
+	}
+	windows, msg := parse("window", "1h,24h", latencySlots*time.Minute)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+	thresholds, msg := parse("under", "5ms,50ms", time.Minute)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	report := make([]SLOWindow, len(windows))
+	for i, win := range windows {
+		report[i] = s.dns.latency.Report(win, thresholds)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func (s *WebServer) handleCompare(w http.ResponseWriter, r *http.Request) {
+	if s.dns == nil {
+		jsonError(w, "dns server unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" {
+		jsonError(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	qtype := uint16(1)
+	if t := r.URL.Query().Get("type"); t != "" {
+		var ok bool
+		if qtype, ok = parseType(t); !ok {
+			jsonError(w, "unknown type", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(compareQuery(name, qtype, s.dns.compareSources()))
+}
+
+func (s *WebServer) handleChaosList(w http.ResponseWriter, r *http.Request) {
+	if s.chaos == nil {
+		jsonError(w, "chaos mode disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.chaos.List())
+}
+
+func (s *WebServer) handleChaosSet(w http.ResponseWriter, r *http.Request) {
+	if s.chaos == nil {
+		jsonError(w, "chaos mode disabled", http.StatusNotFound)
+		return
+	}
+
+	var rule ChaosRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		jsonProblem(w, http.StatusBadRequest, errInvalidJSON)
+		return
+	}
+	if err := validateChaosRule(&rule); err != "" {
+		jsonProblem(w, http.StatusBadRequest, &problem{"invalid_chaos_rule", err})
+		return
+	}
+
+	s.chaos.Set(rule)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+func (s *WebServer) handleChaosDelete(w http.ResponseWriter, r *http.Request) {
+	if s.chaos == nil {
+		jsonError(w, "chaos mode disabled", http.StatusNotFound)
+		return
+	}
+	if !s.chaos.Delete(r.PathValue("domain")) {
+		jsonProblem(w, http.StatusNotFound, &problem{"rule_not_found", "rule not found"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// maxCommentLength bounds record comments, which are notes, not documents.
+const maxCommentLength = 1024
+
+func validateRecord(r *Record) *problem {
 	r.Domain = strings.TrimSpace(r.Domain)
 	r.Value = strings.TrimSpace(r.Value)
 	r.Type = strings.ToUpper(strings.TrimSpace(r.Type))
+	r.View = strings.TrimSpace(r.View)
+	r.Comment = strings.TrimSpace(r.Comment)
 
 	if r.Domain == "" {
-		return "domain is required"
+		return &problem{"domain_required", "domain is required"}
 	}
 	if r.Value == "" {
-		return "value is required"
+		return &problem{"value_required", "value is required"}
+	}
+
+	domain, err := toASCII(r.Domain)
+	if err != nil {
+		return newProblem("invalid_domain", "invalid domain: %v", err)
 	}
+	r.Domain = domain
 
 	switch r.Type {
 	case "A":
 		ip := net.ParseIP(r.Value)
 		if ip == nil || ip.To4() == nil {
-			return "invalid IPv4 address"
+			return &problem{"invalid_ipv4", "invalid IPv4 address"}
 		}
+		r.Value = ip.To4().String()
 	case "AAAA":
 		ip := net.ParseIP(r.Value)
 		if ip == nil || ip.To4() != nil {
-			return "invalid IPv6 address"
+			return &problem{"invalid_ipv6", "invalid IPv6 address"}
 		}
+		r.Value = ip.String()
 	case "CNAME":
-		if strings.ContainsAny(r.Value, " \t") {
-			return "invalid CNAME target"
+		target, err := toASCII(r.Value)
+		if err != nil || strings.ContainsAny(target, " \t") {
+			return &problem{"invalid_cname", "invalid CNAME target"}
+		}
+		r.Value = target
+	case "TXT":
+		if strings.ContainsAny(r.Value, "\t\r\n") {
+			return &problem{"invalid_txt", "TXT value may not contain tabs or line breaks"}
 		}
+	case "SVCB", "HTTPS":
+		rdata, err := parseSVCB(r.Value)
+		if err != nil {
+			return newProblem("invalid_svcb", "invalid %s value: %v", r.Type, err)
+		}
+		r.Value, _ = formatSVCB(rdata)
 	default:
-		return "type must be A, AAAA, or CNAME"
+		return &problem{"invalid_type", "type must be A, AAAA, CNAME, TXT, SVCB, or HTTPS"}
 	}
 
-	return ""
-}
+	for _, c := range r.View {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return &problem{"invalid_view", "view may only contain letters, digits, '-' and '_'"}
+		}
+	}
+	if !r.Expires.IsZero() && !r.Expires.After(time.Now()) {
+		return &problem{"invalid_expiry", "expires must be in the future"}
+	}
+	if strings.ContainsAny(r.Comment, "\t\r\n") {
+		return &problem{"invalid_comment", "comment may not contain tabs or line breaks"}
+	}
+	if len(r.Comment) > maxCommentLength {
+		return newProblem("invalid_comment", "comment may be at most %d bytes", maxCommentLength)
+	}
+	var tags []string
+	for _, tag := range strings.Split(r.Tags, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || slices.Contains(tags, tag) {
+			continue
+		}
+		for _, c := range tag {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return &problem{"invalid_tag", "tags may only contain letters, digits, '-' and '_'"}
+			}
+		}
+		tags = append(tags, tag)
+	}
+	r.Tags = strings.Join(tags, ",")
 
-func jsonError(w http.ResponseWriter, msg string, code int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+	return nil
 }
@@ -2,12 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func testWebServer(t *testing.T) (*WebServer, *Store) {
@@ -17,7 +19,7 @@ func testWebServer(t *testing.T) (*WebServer, *Store) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	return NewWebServer(store, ""), store
+	return NewWebServer(store, nil), store
 }
 
 func TestWebList_Empty(t *testing.T) {
@@ -37,6 +39,31 @@ func TestWebList_Empty(t *testing.T) {
 	}
 }
 
+func TestWebList_Query(t *testing.T) {
+	ws, store := testWebServer(t)
+	for i := range 5 {
+		store.Add(Record{Domain: fmt.Sprintf("host%d.local", i), Type: "A", Value: fmt.Sprintf("10.0.0.%d", 10-i)})
+	}
+
+	req := httptest.NewRequest("GET", "/api/records?q=host&sort=-value&limit=2&offset=1", nil)
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	var records []Record
+	json.NewDecoder(w.Body).Decode(&records)
+	if w.Code != 200 || w.Header().Get("X-Total-Count") != "5" || len(records) != 2 ||
+		records[0].Domain != "host1.local" || records[1].Domain != "host2.local" {
+		t.Errorf("page: %d total=%s %+v", w.Code, w.Header().Get("X-Total-Count"), records)
+	}
+
+	for _, query := range []string{"sort=name", "limit=-1", "offset=x"} {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/records?"+query, nil))
+		if w.Code != 400 {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
 func TestWebCreate(t *testing.T) {
 	ws, _ := testWebServer(t)
 	body := `{"domain":"app.my.local","type":"A","value":"10.0.0.1"}`
@@ -132,6 +159,112 @@ func TestWebUpdate_NotFound(t *testing.T) {
 	}
 }
 
+func TestWebTags(t *testing.T) {
+	ws, store := testWebServer(t)
+	w := httptest.NewRecorder()
+	body := `{"domain":"www.example.com","type":"A","value":"203.0.113.5","tags":["Public"," web","public"]}`
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/api/records", strings.NewReader(body)))
+	if w.Code != 201 || !strings.Contains(w.Body.String(), `"tags":["public","web"]`) {
+		t.Fatalf("create: %d %s", w.Code, w.Body.String())
+	}
+	if got := store.List()[0]; got.Tags != "public,web" || !got.hasTag("public") || got.hasTag("pub") {
+		t.Errorf("stored tags = %q", got.Tags)
+	}
+
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("PATCH", "/api/records/1", strings.NewReader(`{"tags":null}`)))
+	if w.Code != 200 || strings.Contains(w.Body.String(), "tags") || store.List()[0].Tags != "" {
+		t.Errorf("clearing tags: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestWebPatch(t *testing.T) {
+	ws, store := testWebServer(t)
+	store.Add(Record{Domain: "app.local", Type: "A", Value: "10.0.0.1", View: "lan", Comment: "web", Disabled: true})
+	store.Add(Record{Domain: "app.local", Type: "A", Value: "10.0.0.3", View: "lan"})
+	patch := func(id, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("PATCH", "/api/records/"+id, strings.NewReader(body)))
+		return w
+	}
+
+	w := patch("1", `{"value":"10.0.0.2","comment":null}`)
+	var rec apiRecord
+	json.NewDecoder(w.Body).Decode(&rec)
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	want := Record{ID: 1, Domain: "app.local", Type: "A", Value: "10.0.0.2", View: "lan", Disabled: true}
+	if got := store.List()[0]; got != want {
+		t.Errorf("patched record = %+v, want %+v", got, want)
+	}
+	if rec.Value != "10.0.0.2" || rec.Enabled {
+		t.Errorf("response = %+v", rec)
+	}
+
+	for _, tc := range []struct {
+		id, body string
+		code     int
+	}{
+		{"1", `{"value":"bad"}`, 400},
+		{"1", `{"enabled":"yes"}`, 400},
+		{"1", `["value"]`, 400},
+		{"1", `{"value":"10.0.0.3"}`, 409},
+		{"9", `{"value":"10.0.0.4"}`, 404},
+	} {
+		if w := patch(tc.id, tc.body); w.Code != tc.code {
+			t.Errorf("PATCH %s %s: status %d, want %d", tc.id, tc.body, w.Code, tc.code)
+		}
+	}
+	if got := store.List()[0]; got != want {
+		t.Errorf("rejected patches changed the record: %+v", got)
+	}
+}
+
+func TestWebSetRRSet(t *testing.T) {
+	ws, store := testWebServer(t)
+	store.Add(Record{Domain: "home.local", Type: "A", Value: "10.0.0.1"})
+	put := func(query, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("PUT", "/api/records?"+query, strings.NewReader(body)))
+		return w
+	}
+
+	for _, tc := range []struct {
+		query, body string
+		code        int
+	}{
+		{"type=A", `{"value":"10.0.0.2"}`, 400},
+		{"domain=home.local&type=MX", `{"value":"10.0.0.2"}`, 400},
+		{"domain=home.local&type=A", `{"value":"bad"}`, 400},
+		{"domain=home.local&type=A", `{"domain":"other.local","value":"10.0.0.2"}`, 400},
+		{"domain=home.local&type=A", ``, 400},
+	} {
+		if w := put(tc.query, tc.body); w.Code != tc.code {
+			t.Errorf("PUT ?%s %s: status %d, want %d", tc.query, tc.body, w.Code, tc.code)
+		}
+	}
+
+	for range 2 {
+		w := put("domain=home.local&type=A", `{"value":"10.0.0.2"}`)
+		var set []apiRecord
+		json.NewDecoder(w.Body).Decode(&set)
+		if w.Code != 200 || len(set) != 1 || set[0].ID != 2 || set[0].Value != "10.0.0.2" {
+			t.Fatalf("upsert: %d %+v", w.Code, set)
+		}
+	}
+	w := put("domain=new.local&type=A", `[{"value":"10.0.0.3"},{"value":"10.0.0.4","view":"lan"}]`)
+	if w.Code != 400 {
+		t.Errorf("record with another view: status %d", w.Code)
+	}
+	w = put("domain=new.local&type=A&view=lan", `[{"value":"10.0.0.3"},{"value":"10.0.0.4"}]`)
+	var set []apiRecord
+	json.NewDecoder(w.Body).Decode(&set)
+	if w.Code != 200 || len(set) != 2 || set[0].View != "lan" {
+		t.Errorf("new set: %d %+v", w.Code, set)
+	}
+}
+
 func TestWebDelete(t *testing.T) {
 	ws, store := testWebServer(t)
 	store.Add(Record{Domain: "app.local", Type: "A", Value: "10.0.0.1"})
@@ -149,6 +282,37 @@ func TestWebDelete(t *testing.T) {
 	}
 }
 
+func TestWebDeleteNamed(t *testing.T) {
+	ws, store := testWebServer(t)
+	store.Add(Record{Domain: "pr-7.local", Type: "A", Value: "10.0.0.1"})
+	store.Add(Record{Domain: "pr-7.local", Type: "A", Value: "10.0.0.1", View: "lan"})
+	store.Add(Record{Domain: "pr-7.local", Type: "TXT", Value: "ci"})
+	store.Add(Record{Domain: "main.local", Type: "A", Value: "10.0.0.2"})
+	del := func(query string) (int, int) {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("DELETE", "/api/records?"+query, nil))
+		var body struct{ Deleted int }
+		json.NewDecoder(w.Body).Decode(&body)
+		return w.Code, body.Deleted
+	}
+
+	if code, _ := del("type=A"); code != 400 {
+		t.Errorf("without a domain: status %d", code)
+	}
+	if code, n := del("domain=PR-7.local&type=txt"); code != 200 || n != 1 {
+		t.Errorf("delete TXT: %d, %d deleted", code, n)
+	}
+	if code, n := del("domain=pr-7.local"); code != 200 || n != 2 {
+		t.Errorf("delete name: %d, %d deleted", code, n)
+	}
+	if code, n := del("domain=pr-7.local"); code != 200 || n != 0 {
+		t.Errorf("delete again: %d, %d deleted", code, n)
+	}
+	if recs := store.List(); len(recs) != 1 || recs[0].Domain != "main.local" {
+		t.Errorf("left %+v", recs)
+	}
+}
+
 func TestWebDelete_NotFound(t *testing.T) {
 	ws, _ := testWebServer(t)
 	req := httptest.NewRequest("DELETE", "/api/records/999", nil)
@@ -220,6 +384,119 @@ func TestWebCreate_CNAME(t *testing.T) {
 	}
 }
 
+func TestWebCreate_IDN(t *testing.T) {
+	ws, store := testWebServer(t)
+	body := `{"domain":"Café.local","type":"CNAME","value":"bücher.local"}`
+	req := httptest.NewRequest("POST", "/api/records", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+
+	if w.Code != 201 {
+		t.Fatalf("status = %d, want 201, body = %s", w.Code, w.Body.String())
+	}
+	var rec apiRecord
+	json.NewDecoder(w.Body).Decode(&rec)
+	if rec.Domain != "xn--caf-dma.local" || rec.DomainUnicode != "café.local" ||
+		rec.Value != "xn--bcher-kva.local" || rec.ValueUnicode != "bücher.local" {
+		t.Errorf("created %+v", rec)
+	}
+	if _, ok := store.Resolve("xn--caf-dma.local", 5); !ok {
+		t.Error("punycode query does not match the record")
+	}
+}
+
+func TestWebCreate_Disabled(t *testing.T) {
+	ws, store := testWebServer(t)
+	body := `{"domain":"app.local","type":"A","value":"10.0.0.1","enabled":false}`
+	req := httptest.NewRequest("POST", "/api/records", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	if w.Code != 201 || !strings.Contains(w.Body.String(), `"enabled":false`) || strings.Contains(w.Body.String(), "disabled") {
+		t.Fatalf("create: %d %s", w.Code, w.Body.String())
+	}
+	if list := store.List(); len(list) != 1 || !list[0].Disabled {
+		t.Fatalf("stored: %+v", list)
+	}
+
+	// Leaving enabled out turns the record back on
+	req = httptest.NewRequest("PUT", "/api/records/1", strings.NewReader(`{"domain":"app.local","type":"A","value":"10.0.0.1"}`))
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"enabled":true`) {
+		t.Errorf("update: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestWebCreate_Duplicate(t *testing.T) {
+	ws, store := testWebServer(t)
+	store.Add(Record{Domain: "app.local", Type: "A", Value: "10.0.0.1"})
+	create := func(query, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/api/records"+query, strings.NewReader(body)))
+		return w
+	}
+
+	w := create("", `{"domain":"App.Local","type":"A","value":"10.0.0.1"}`)
+	var conflict struct {
+		Error  string    `json:"error"`
+		Record apiRecord `json:"record"`
+	}
+	json.NewDecoder(w.Body).Decode(&conflict)
+	if w.Code != http.StatusConflict || conflict.Record.ID != 1 {
+		t.Fatalf("duplicate create: %d %+v", w.Code, conflict)
+	}
+
+	// With upsert the existing record is returned, taking the new comment
+	w = create("?upsert=true", `{"domain":"app.local","type":"A","value":"10.0.0.1","comment":"retried"}`)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"id":1`) || !strings.Contains(w.Body.String(), `"comment":"retried"`) {
+		t.Errorf("upsert: %d %s", w.Code, w.Body.String())
+	}
+	if list := store.List(); len(list) != 1 || list[0].Comment != "retried" {
+		t.Errorf("records after upsert: %+v", list)
+	}
+	if w := create("?upsert=true", `{"domain":"new.local","type":"A","value":"10.0.0.2"}`); w.Code != 201 {
+		t.Errorf("upsert of a new record: %d", w.Code)
+	}
+}
+
+func TestWebBatch(t *testing.T) {
+	ws, store := testWebServer(t)
+	store.Add(Record{Domain: "svc.local", Type: "A", Value: "10.0.0.1"})
+	store.Add(Record{Domain: "svc.local", Type: "A", Value: "10.0.0.2"})
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/api/records/batch", strings.NewReader(body)))
+		return w
+	}
+
+	for body, code := range map[string]int{
+		`{"operations":[{"op":"delete","id":1},{"op":"create","record":{"domain":"svc.local","type":"A","value":"bad"}}]}`: 400,
+		`{"operations":[{"op":"delete","id":1},{"op":"rename","id":2}]}`:                                                   400,
+		`{"operations":[{"op":"delete","id":1},{"op":"delete","id":7}]}`:                                                   404,
+	} {
+		if w := post(body); w.Code != code {
+			t.Errorf("%s: status %d, want %d: %s", body, w.Code, code, w.Body.String())
+		}
+	}
+	if len(store.List()) != 2 {
+		t.Fatalf("rejected batches changed the store: %+v", store.List())
+	}
+
+	w := post(`{"operations":[
+		{"op":"delete","id":1},
+		{"op":"update","id":2,"record":{"domain":"svc.local","type":"A","value":"10.0.0.3"}},
+		{"op":"create","record":{"domain":"svc.local","type":"A","value":"10.0.0.4","enabled":false}}]}`)
+	var results []apiRecord
+	json.NewDecoder(w.Body).Decode(&results)
+	if w.Code != 200 || len(results) != 3 || results[0].ID != 1 || results[1].Value != "10.0.0.3" || results[2].Enabled {
+		t.Fatalf("batch: %d %+v", w.Code, results)
+	}
+	if list := store.List(); len(list) != 2 || list[1].ID != 3 || !list[1].Disabled {
+		t.Errorf("records after batch: %+v", list)
+	}
+}
+
 func TestWebServeHTML_Index(t *testing.T) {
 	ws, _ := testWebServer(t)
 	// /index.html redirects to / with http.FileServer + embed.FS
@@ -248,15 +525,25 @@ func TestValidateRecord(t *testing.T) {
 		{"IPv6 in A", Record{Domain: "app.local", Type: "A", Value: "fd00::1"}, true},
 		{"IPv4 in AAAA", Record{Domain: "app.local", Type: "AAAA", Value: "10.0.0.1"}, true},
 		{"bad CNAME", Record{Domain: "app.local", Type: "CNAME", Value: "has space"}, true},
+		{"valid HTTPS", Record{Domain: "app.local", Type: "HTTPS", Value: "1 . alpn=h2,h3 port=8443"}, false},
+		{"HTTPS alias", Record{Domain: "app.local", Type: "HTTPS", Value: "0 cdn.example.com"}, false},
+		{"HTTPS without target", Record{Domain: "app.local", Type: "HTTPS", Value: "1"}, true},
+		{"bad SVCB param", Record{Domain: "app.local", Type: "SVCB", Value: "1 . ech=abc"}, true},
+		{"with comment", Record{Domain: "app.local", Type: "A", Value: "10.0.0.1", Comment: "points at the old rack"}, false},
+		{"expires later", Record{Domain: "app.local", Type: "A", Value: "10.0.0.1", Expires: time.Now().Add(time.Hour)}, false},
+		{"expired", Record{Domain: "app.local", Type: "A", Value: "10.0.0.1", Expires: time.Now().Add(-time.Second)}, true},
+		{"multi-line comment", Record{Domain: "app.local", Type: "A", Value: "10.0.0.1", Comment: "one\ntwo"}, true},
+		{"with tags", Record{Domain: "app.local", Type: "A", Value: "10.0.0.1", Tags: "public,web"}, false},
+		{"bad tag", Record{Domain: "app.local", Type: "A", Value: "10.0.0.1", Tags: "public,two words"}, true},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			err := validateRecord(&tt.rec)
-			if tt.wantErr && err == "" {
+			if tt.wantErr && err == nil {
 				t.Error("expected validation error")
 			}
-			if !tt.wantErr && err != "" {
+			if !tt.wantErr && err != nil {
 				t.Errorf("unexpected validation error: %s", err)
 			}
 		})
@@ -274,18 +561,10 @@ func TestDNSIntegration(t *testing.T) {
 	store.Add(Record{Domain: "app.my.local", Type: "A", Value: "100.70.30.1"})
 	store.Add(Record{Domain: "v6.my.local", Type: "AAAA", Value: "fd00::1"})
 
-	dns := NewDNSServer(store, []string{"8.8.8.8:53"})
-
-	// Listen on random port
-	go func() {
-		if err := dns.ListenAndServe("127.0.0.1:0"); err != nil {
-			// Will error on close, ignore
-		}
-	}()
-
-	<-dns.ready
-	defer dns.Close()
+	fake := startFakeUpstream(t, "example.com A answer 93.184.216.34")
+	dns := NewDNSServer(store, []string{fake.Addr()})
 
+	startDNSServer(t, dns)
 	addr := dns.conn.LocalAddr().(*net.UDPAddr)
 
 	// Query for custom A record
@@ -317,6 +596,18 @@ func TestDNSIntegration(t *testing.T) {
 	if ancount < 1 {
 		t.Errorf("ANCOUNT = %d, want >= 1", ancount)
 	}
+
+	// Query for a name we don't manage is forwarded to the fake upstream
+	resp = exchange(t, addr.String(), buildTestQuery("example.com", 1, 1))
+	if resp[2]&0x04 != 0 {
+		t.Error("AA bit set on forwarded answer")
+	}
+	if ancount := int(resp[6])<<8 | int(resp[7]); ancount != 1 {
+		t.Errorf("forwarded ANCOUNT = %d, want 1", ancount)
+	}
+	if fake.Queries() != 1 {
+		t.Errorf("upstream queries = %d, want 1", fake.Queries())
+	}
 }
 
 func TestHTTPIntegration(t *testing.T) {
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var errMalformed = errors.New("malformed DNS message")
+
+var typeByName = map[string]uint16{
+	"A": 1, "NS": 2, "CNAME": 5, "SOA": 6, "PTR": 12, "MX": 15, "TXT": 16,
+	"AAAA": 28, "SRV": 33, "OPT": 41, "SVCB": 64, "HTTPS": 65, "TSIG": 250, "AXFR": 252, "ANY": 255,
+}
+
+const (
+	opcodeNotify = 4
+	opcodeUpdate = 5
+)
+
+const (
+	rcodeFormErr  = 1
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeNotImp   = 4
+	rcodeRefused  = 5
+	rcodeYXDomain = 6 // name exists when it should not (RFC 2136)
+	rcodeYXRRSet  = 7
+	rcodeNXRRSet  = 8
+	rcodeNotAuth  = 9
+	rcodeNotZone  = 10
+)
+
+var rcodeNames = []string{"NOERROR", "FORMERR", "SERVFAIL", "NXDOMAIN", "NOTIMP", "REFUSED",
+	"YXDOMAIN", "YXRRSET", "NXRRSET", "NOTAUTH", "NOTZONE"}
+
+func typeString(t uint16) string {
+	for name, v := range typeByName {
+		if v == t {
+			return name
+		}
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// parseType accepts a mnemonic like "AAAA" or the generic "TYPE65" form.
+func parseType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	if t, ok := typeByName[s]; ok {
+		return t, true
+	}
+	if rest, ok := strings.CutPrefix(s, "TYPE"); ok {
+		n, err := strconv.ParseUint(rest, 10, 16)
+		return uint16(n), err == nil
+	}
+	return 0, false
+}
+
+func rcodeString(rcode int) string {
+	if rcode < len(rcodeNames) {
+		return rcodeNames[rcode]
+	}
+	return "RCODE" + strconv.Itoa(rcode)
+}
+
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// RR is a decoded resource record. Data holds the presentation form of the
+// RDATA for the types we understand and hex for the rest.
+type RR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  string
+}
+
+func (rr RR) String() string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s", rr.Name, rr.TTL, typeString(rr.Type), rr.Data)
+}
+
+// Message is a decoded DNS message, used by the diagnostic tooling. The hot
+// query path works on raw bytes instead.
+type Message struct {
+	ID         uint16
+	Response   bool
+	Opcode     int
+	AA, TC     bool
+	RD, RA     bool
+	RCode      int
+	Questions  []Question
+	Answers    []RR
+	Authority  []RR
+	Additional []RR
+}
+
+func parseMessage(buf []byte) (*Message, error) {
+	if len(buf) < 12 {
+		return nil, errMalformed
+	}
+	m := &Message{
+		ID:       binary.BigEndian.Uint16(buf[0:2]),
+		Response: buf[2]&0x80 != 0,
+		Opcode:   int(buf[2]>>3) & 0x0F,
+		AA:       buf[2]&0x04 != 0,
+		TC:       buf[2]&0x02 != 0,
+		RD:       buf[2]&0x01 != 0,
+		RA:       buf[3]&0x80 != 0,
+		RCode:    int(buf[3] & 0x0F),
+	}
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(buf[4+2*i:]))
+	}
+
+	off := 12
+	for range counts[0] {
+		name, next := parseDNSName(buf, off)
+		if next < 0 || next+4 > len(buf) {
+			return nil, errMalformed
+		}
+		m.Questions = append(m.Questions, Question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(buf[next:]),
+			Class: binary.BigEndian.Uint16(buf[next+2:]),
+		})
+		off = next + 4
+	}
+
+	sections := []*[]RR{&m.Answers, &m.Authority, &m.Additional}
+	for i, section := range sections {
+		for range counts[i+1] {
+			rr, next, err := parseRR(buf, off)
+			if err != nil {
+				return nil, err
+			}
+			*section = append(*section, rr)
+			off = next
+		}
+	}
+	return m, nil
+}
+
+// parseRR decodes the resource record at off and returns the offset after it.
+func parseRR(buf []byte, off int) (RR, int, error) {
+	raw, next, err := readRR(buf, off)
+	if err != nil {
+		return RR{}, 0, err
+	}
+	rr := RR{Name: raw.Name, Type: raw.Type, Class: raw.Class, TTL: raw.TTL}
+	rr.Data = rdataString(buf, raw.RData, raw.RDLen, rr.Type)
+	return rr, next, nil
+}
+
+// rawRR is a resource record whose RDATA is left in the message, for callers
+// that need the bytes rather than the presentation form.
+type rawRR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Start int // offset of the owner name
+	RData int // offset of the RDATA
+	RDLen int
+}
+
+// readRR reads the fixed fields of the record at off and returns the offset
+// after it.
+func readRR(buf []byte, off int) (rawRR, int, error) {
+	name, next := parseDNSName(buf, off)
+	if next < 0 || next+10 > len(buf) {
+		return rawRR{}, 0, errMalformed
+	}
+	rr := rawRR{
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(buf[next:]),
+		Class: binary.BigEndian.Uint16(buf[next+2:]),
+		TTL:   binary.BigEndian.Uint32(buf[next+4:]),
+		Start: off,
+		RData: next + 10,
+		RDLen: int(binary.BigEndian.Uint16(buf[next+8:])),
+	}
+	if rr.RData+rr.RDLen > len(buf) {
+		return rawRR{}, 0, errMalformed
+	}
+	return rr, rr.RData + rr.RDLen, nil
+}
+
+// rdataString renders RDATA in zone-file presentation format. Name fields
+// may use compression, so the whole message is needed.
+func rdataString(buf []byte, off, rdlen int, rtype uint16) string {
+	rdata := buf[off : off+rdlen]
+	switch rtype {
+	case 1:
+		if rdlen == 4 {
+			return net.IP(rdata).String()
+		}
+	case 28:
+		if rdlen == 16 {
+			return net.IP(rdata).String()
+		}
+	case 2, 5, 12:
+		if name, next := parseDNSName(buf, off); next >= 0 {
+			return name + "."
+		}
+	case 15:
+		if rdlen > 2 {
+			if name, next := parseDNSName(buf, off+2); next >= 0 {
+				return fmt.Sprintf("%d %s.", binary.BigEndian.Uint16(rdata), name)
+			}
+		}
+	case 16:
+		var parts []string
+		for i := 0; i < len(rdata); {
+			l := int(rdata[i])
+			if i+1+l > len(rdata) {
+				break
+			}
+			parts = append(parts, strconv.Quote(string(rdata[i+1:i+1+l])))
+			i += 1 + l
+		}
+		return strings.Join(parts, " ")
+	case 64, 65:
+		if s, ok := formatSVCB(rdata); ok {
+			return s
+		}
+	case 6:
+		mname, next := parseDNSName(buf, off)
+		if next < 0 {
+			break
+		}
+		rname, next := parseDNSName(buf, next)
+		if next < 0 || next+20 > off+rdlen {
+			break
+		}
+		v := make([]uint32, 5)
+		for i := range v {
+			v[i] = binary.BigEndian.Uint32(buf[next+4*i:])
+		}
+		return fmt.Sprintf("%s. %s. %d %d %d %d %d", mname, rname, v[0], v[1], v[2], v[3], v[4])
+	case 33:
+		if rdlen > 6 {
+			if name, next := parseDNSName(buf, off+6); next >= 0 {
+				return fmt.Sprintf("%d %d %d %s.", binary.BigEndian.Uint16(rdata), binary.BigEndian.Uint16(rdata[2:]),
+					binary.BigEndian.Uint16(rdata[4:]), name)
+			}
+		}
+	}
+	return `\# ` + strconv.Itoa(rdlen) + " " + hex.EncodeToString(rdata)
+}
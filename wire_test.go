@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseType(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint16
+		ok   bool
+	}{
+		{"A", 1, true},
+		{"aaaa", 28, true},
+		{"TYPE99", 99, true},
+		{"https", 65, true},
+		{"TYPEx", 0, false},
+		{"BOGUS", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok := parseType(tt.in)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("parseType(%q) = %d, %v", tt.in, got, ok)
+			}
+		})
+	}
+	if typeString(99) != "TYPE99" || typeString(65) != "HTTPS" || typeString(5) != "CNAME" {
+		t.Errorf("typeString mismatch")
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	query := buildTestQuery("www.example.com", 1, 1)
+	resp := buildDNSResponse(query, len(query), []Record{
+		{Domain: "www.example.com", Type: "CNAME", Value: "web.example.com"},
+		{Domain: "web.example.com", Type: "A", Value: "10.0.0.1"},
+		{Domain: "web.example.com", Type: "AAAA", Value: "fd00::1"},
+	})
+
+	msg, err := parseMessage(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 0xABCD || !msg.Response || !msg.AA || !msg.RD || msg.RCode != 0 {
+		t.Errorf("header = %+v", msg)
+	}
+	if len(msg.Questions) != 1 || msg.Questions[0].Name != "www.example.com" || msg.Questions[0].Type != 1 {
+		t.Errorf("questions = %+v", msg.Questions)
+	}
+	want := []string{"web.example.com.", "10.0.0.1", "fd00::1"}
+	if len(msg.Answers) != len(want) {
+		t.Fatalf("answers = %+v", msg.Answers)
+	}
+	for i, rr := range msg.Answers {
+		if rr.Data != want[i] {
+			t.Errorf("answer %d = %q, want %q", i, rr.Data, want[i])
+		}
+	}
+
+	if _, err := parseMessage(resp[:len(resp)-3]); err == nil {
+		t.Error("expected error for truncated message")
+	}
+}
+
+func TestRdataStringUnknown(t *testing.T) {
+	buf := []byte{0xDE, 0xAD}
+	if got := rdataString(buf, 0, 2, 99); got != `\# 2 dead` {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ZoneFinding is one problem found by checkZones.
+type ZoneFinding struct {
+	Zone     string `json:"zone"`
+	Domain   string `json:"domain"`
+	Check    string `json:"check"`
+	Severity string `json:"severity"` // "error" or "warning"
+	Message  string `json:"message"`
+	Records  []int  `json:"records,omitempty"`
+}
+
+// checkZones looks for mistakes that are valid record by record but break
+// resolution as a whole:
+//
+//   - cname-at-apex: a CNAME on a zone apex hides the zone's other data
+//   - cname-conflict: a CNAME sharing its name with other records
+//   - cname-loop: a chain that comes back to itself
+//   - cname-chain: a chain longer than we follow when answering
+//   - dangling-cname: a target inside one of our zones that has no records
+//
+// There is no missing-glue or TTL-consistency check: the store holds no NS
+// records that could need glue, and records have no TTL of their own. Findings
+// are sorted by zone and name.
+func checkZones(records []Record, zones Zones) []ZoneFinding {
+	byName := make(map[string][]Record)
+	managed := make(map[string]bool)
+	now := time.Now()
+	for _, r := range records {
+		if r.Disabled || r.expired(now) {
+			continue // not resolved, so it can't break anything
+		}
+		name := strings.ToLower(strings.TrimSuffix(r.Domain, "."))
+		byName[name] = append(byName[name], r)
+		managed[zones.ZoneOf(name)] = true
+	}
+
+	findings := []ZoneFinding{}
+	add := func(name, check, severity, msg string, recs ...Record) {
+		f := ZoneFinding{Zone: zones.ZoneOf(name), Domain: name, Check: check, Severity: severity, Message: msg}
+		for _, r := range recs {
+			f.Records = append(f.Records, r.ID)
+		}
+		findings = append(findings, f)
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		recs := byName[name]
+		var cnames, other []Record
+		for _, r := range recs {
+			if r.Type == "CNAME" {
+				cnames = append(cnames, r)
+			} else {
+				other = append(other, r)
+			}
+		}
+		if len(cnames) == 0 {
+			continue
+		}
+
+		if zones.ZoneOf(name) == name {
+			add(name, "cname-at-apex", "error", "CNAME at the zone apex", cnames...)
+		}
+		// Records in different views are never served together, so only
+		// records sharing a view can conflict.
+		var views []string
+		for _, r := range cnames {
+			if !slices.Contains(views, r.View) {
+				views = append(views, r.View)
+			}
+		}
+		for _, view := range views {
+			otherView := func(r Record) bool { return r.View != view }
+			vc := slices.DeleteFunc(slices.Clone(cnames), otherView)
+			vo := slices.DeleteFunc(slices.Clone(other), otherView)
+			if len(vc) > 1 {
+				add(name, "cname-conflict", "error", fmt.Sprintf("%d CNAME records for one name; only the first is served", len(vc)), vc...)
+			}
+			if len(vo) > 0 {
+				add(name, "cname-conflict", "error", "CNAME alongside other records at the same name", append(vc, vo...)...)
+			}
+		}
+
+		target := strings.ToLower(strings.TrimSuffix(cnames[0].Value, "."))
+		if len(byName[target]) == 0 {
+			if managed[zones.ZoneOf(target)] {
+				add(name, "dangling-cname", "warning", fmt.Sprintf("target %s has no records in zone %s", target, zones.ZoneOf(target)), cnames[0])
+			}
+			continue
+		}
+
+		// Walk the chain the way Store.chaseCNAME does
+		seen := map[string]bool{name: true}
+		hops := 1
+		for {
+			if seen[target] {
+				add(name, "cname-loop", "error", fmt.Sprintf("CNAME chain loops back to %s", target), cnames[0])
+				break
+			}
+			seen[target] = true
+			next := slices.IndexFunc(byName[target], func(r Record) bool { return r.Type == "CNAME" })
+			if next < 0 {
+				break
+			}
+			if hops++; hops > maxCNAMEChain {
+				add(name, "cname-chain", "warning", fmt.Sprintf("CNAME chain is longer than %d hops and will be cut short", maxCNAMEChain), cnames[0])
+				break
+			}
+			target = strings.ToLower(strings.TrimSuffix(byName[target][next].Value, "."))
+		}
+	}
+
+	slices.SortStableFunc(findings, func(a, b ZoneFinding) int {
+		return strings.Compare(a.Zone, b.Zone)
+	})
+	return findings
+}
+
+func handleCheckZones(args []string) {
+	fs := flag.NewFlagSet("check-zones", flag.ExitOnError)
+	dataPath := fs.String("data", "records.tsv", "Path to records file")
+	var zones listFlag
+	fs.Var(&zones, "zone", "Zone apex we are authoritative for (repeatable)")
+	fs.Parse(args)
+
+	store, err := NewStore(*dataPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	findings := checkZones(store.List(), NewZones(zones))
+	if len(findings) == 0 {
+		fmt.Println("no problems found")
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SEVERITY\tZONE\tNAME\tCHECK\tMESSAGE")
+	failed := false
+	for _, f := range findings {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", f.Severity, f.Zone, f.Domain, f.Check, f.Message)
+		failed = failed || f.Severity == "error"
+	}
+	tw.Flush()
+	if failed {
+		os.Exit(1)
+	}
+}
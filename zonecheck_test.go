@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckZones(t *testing.T) {
+	records := []Record{
+		{ID: 1, Domain: "example.com", Type: "CNAME", Value: "lb.example.net"},
+		{ID: 2, Domain: "www.example.com", Type: "CNAME", Value: "web.example.com"},
+		{ID: 3, Domain: "www.example.com", Type: "A", Value: "10.0.0.1"},
+		{ID: 4, Domain: "old.example.com", Type: "CNAME", Value: "gone.example.com"},
+		{ID: 5, Domain: "ext.example.com", Type: "CNAME", Value: "cdn.provider.net"},
+		{ID: 6, Domain: "a.loop.test", Type: "CNAME", Value: "b.loop.test"},
+		{ID: 7, Domain: "b.loop.test", Type: "CNAME", Value: "a.loop.test."},
+		{ID: 8, Domain: "web.example.com", Type: "A", Value: "10.0.0.2"},
+		{ID: 9, Domain: "ok.example.com", Type: "CNAME", Value: "web.example.com"},
+	}
+	findings := checkZones(records, NewZones(nil))
+
+	got := map[string]bool{}
+	for _, f := range findings {
+		got[f.Domain+" "+f.Check] = true
+	}
+	want := []string{
+		"example.com cname-at-apex",
+		"www.example.com cname-conflict",
+		"old.example.com dangling-cname",
+		"a.loop.test cname-loop",
+		"b.loop.test cname-loop",
+	}
+	for _, w := range want {
+		if !got[w] {
+			t.Errorf("missing finding %q", w)
+		}
+	}
+	if len(findings) != len(want) {
+		t.Errorf("findings = %+v", findings)
+	}
+	// Targets outside our zones can't be checked
+	if got["ext.example.com dangling-cname"] {
+		t.Error("out-of-zone target reported as dangling")
+	}
+}
+
+func TestCheckZonesLongChain(t *testing.T) {
+	var records []Record
+	for i := range maxCNAMEChain + 1 {
+		records = append(records, Record{ID: i + 1, Domain: fmt.Sprintf("h%d.chain.test", i), Type: "CNAME", Value: fmt.Sprintf("h%d.chain.test", i+1)})
+	}
+	records = append(records, Record{ID: 100, Domain: fmt.Sprintf("h%d.chain.test", maxCNAMEChain+1), Type: "A", Value: "10.0.0.1"})
+
+	findings := checkZones(records, NewZones([]string{"chain.test"}))
+	if len(findings) != 1 || findings[0].Domain != "h0.chain.test" || findings[0].Check != "cname-chain" {
+		t.Errorf("findings = %+v", findings)
+	}
+}
+
+func TestWebZoneCheck(t *testing.T) {
+	ws, store := testWebServer(t)
+	ws.zones = NewZones([]string{"home.lan"})
+	store.Add(Record{Domain: "home.lan", Type: "CNAME", Value: "router.home.lan"})
+	store.Add(Record{Domain: "router.home.lan", Type: "A", Value: "192.168.1.1"})
+
+	req := httptest.NewRequest("GET", "/api/zones/check", nil)
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+
+	var findings []ZoneFinding
+	json.NewDecoder(w.Body).Decode(&findings)
+	if len(findings) != 1 || findings[0].Check != "cname-at-apex" || findings[0].Zone != "home.lan" {
+		t.Errorf("findings = %+v", findings)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ZoneImport is what a BIND zone file yields: the records we can store and
+// a note for every entry that was left out.
+type ZoneImport struct {
+	Records []Record `json:"records"`
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// zoneToken is one field of a zone file entry; quoted fields are kept apart
+// so TXT data isn't mistaken for a name or a TTL.
+type zoneToken struct {
+	text   string
+	quoted bool
+}
+
+// parseZoneFile reads standard BIND zone file syntax (RFC 1035 §5): $ORIGIN
+// and $TTL, @ and relative names, blank owners repeating the previous one,
+// parenthesized multi-line entries, and ; comments. A, AAAA, CNAME, TXT,
+// SVCB and HTTPS records are converted; everything else, including the SOA
+// and NS records we generate ourselves, is reported in Skipped. TTLs are
+// ignored. origin applies until the file sets $ORIGIN.
+func parseZoneFile(r io.Reader, origin string) (ZoneImport, error) {
+	var result ZoneImport
+	origin = strings.ToLower(strings.Trim(origin, "."))
+	owner := ""
+	entries, err := zoneEntries(r)
+	if err != nil {
+		return result, err
+	}
+	for _, e := range entries {
+		fail := func(format string, args ...any) error {
+			return fmt.Errorf("line %d: %s", e.line, fmt.Sprintf(format, args...))
+		}
+		fields := e.fields
+		switch strings.ToUpper(fields[0].text) {
+		case "$ORIGIN":
+			if len(fields) < 2 {
+				return result, fail("$ORIGIN needs a name")
+			}
+			name, err := zoneName(fields[1].text, origin)
+			if err != nil {
+				return result, fail("%v", err)
+			}
+			origin = name
+			continue
+		case "$TTL":
+			continue
+		case "$INCLUDE", "$GENERATE":
+			return result, fail("%s is not supported", fields[0].text)
+		}
+
+		if !e.continued {
+			name, err := zoneName(fields[0].text, origin)
+			if err != nil {
+				return result, fail("%v", err)
+			}
+			owner = name
+			fields = fields[1:]
+		} else if owner == "" {
+			return result, fail("entry without an owner name")
+		}
+		// TTL and class come in either order before the type
+		class := "IN"
+		for len(fields) > 0 && !fields[0].quoted {
+			f := strings.ToUpper(fields[0].text)
+			if f == "IN" || f == "CH" || f == "HS" || f == "CS" {
+				class = f
+			} else if _, err := parseZoneTTL(f); err != nil {
+				break
+			}
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			return result, fail("missing record type")
+		}
+		rtype, rdata := strings.ToUpper(fields[0].text), fields[1:]
+		if class != "IN" {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("line %d: %s %s class %s", e.line, owner, rtype, class))
+			continue
+		}
+
+		rec := Record{Domain: owner, Type: rtype}
+		switch rtype {
+		case "A", "AAAA":
+			if len(rdata) != 1 {
+				return result, fail("%s wants one address", rtype)
+			}
+			rec.Value = rdata[0].text
+		case "CNAME":
+			if len(rdata) != 1 {
+				return result, fail("CNAME wants one target")
+			}
+			target, err := zoneName(rdata[0].text, origin)
+			if err != nil {
+				return result, fail("%v", err)
+			}
+			rec.Value = target
+		case "TXT":
+			var value strings.Builder
+			for _, t := range rdata {
+				value.WriteString(t.text)
+			}
+			rec.Value = value.String()
+		case "SVCB", "HTTPS":
+			if len(rdata) < 2 {
+				return result, fail("%s wants a priority and a target", rtype)
+			}
+			parts := []string{rdata[0].text, "."}
+			if rdata[1].text != "." {
+				target, err := zoneName(rdata[1].text, origin)
+				if err != nil {
+					return result, fail("%v", err)
+				}
+				parts[1] = target
+			}
+			for _, t := range rdata[2:] {
+				parts = append(parts, t.text)
+			}
+			rec.Value = strings.Join(parts, " ")
+		default:
+			result.Skipped = append(result.Skipped, fmt.Sprintf("line %d: %s %s not supported", e.line, owner, rtype))
+			continue
+		}
+		if p := validateRecord(&rec); p != nil {
+			return result, fail("%s %s: %s", owner, rtype, p.Detail)
+		}
+		result.Records = append(result.Records, rec)
+	}
+	return result, nil
+}
+
+type zoneEntry struct {
+	line      int
+	continued bool // starts with whitespace, so the owner is the previous one
+	fields    []zoneToken
+}
+
+// zoneEntries splits a zone file into entries, joining parenthesized lines
+// and dropping comments.
+func zoneEntries(r io.Reader) ([]zoneEntry, error) {
+	var entries []zoneEntry
+	var cur *zoneEntry
+	depth := 0
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if depth == 0 {
+			cur = &zoneEntry{line: n, continued: line != "" && (line[0] == ' ' || line[0] == '\t')}
+		}
+		for i := 0; i < len(line); {
+			c := line[i]
+			switch {
+			case c == ';':
+				i = len(line)
+			case c == ' ' || c == '\t':
+				i++
+			case c == '(':
+				depth++
+				i++
+			case c == ')':
+				if depth--; depth < 0 {
+					return nil, fmt.Errorf("line %d: unbalanced )", n)
+				}
+				i++
+			case c == '"':
+				var b strings.Builder
+				i++
+				for i < len(line) && line[i] != '"' {
+					if line[i] == '\\' && i+1 < len(line) {
+						i++
+					}
+					b.WriteByte(line[i])
+					i++
+				}
+				if i >= len(line) {
+					return nil, fmt.Errorf("line %d: unterminated string", n)
+				}
+				i++
+				cur.fields = append(cur.fields, zoneToken{b.String(), true})
+			default:
+				start := i
+				for i < len(line) && !strings.ContainsRune(" \t;()\"", rune(line[i])) {
+					i++
+				}
+				cur.fields = append(cur.fields, zoneToken{text: line[start:i]})
+			}
+		}
+		if depth == 0 && len(cur.fields) > 0 {
+			entries = append(entries, *cur)
+		}
+	}
+	if depth > 0 {
+		return nil, errors.New("unbalanced ( at end of file")
+	}
+	return entries, sc.Err()
+}
+
+// zoneName makes a zone file name absolute and returns it without the
+// trailing dot.
+func zoneName(name, origin string) (string, error) {
+	switch {
+	case name == "@":
+		if origin == "" {
+			return "", errors.New("@ used without an origin")
+		}
+		return origin, nil
+	case strings.HasSuffix(name, "."):
+		return strings.ToLower(strings.TrimSuffix(name, ".")), nil
+	case origin == "":
+		return "", fmt.Errorf("relative name %q without an origin", name)
+	}
+	return strings.ToLower(name + "." + origin), nil
+}
+
+// parseZoneTTL accepts plain seconds or BIND's unit form, e.g. 1h30m.
+func parseZoneTTL(s string) (uint32, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	var total, n uint64
+	digits := false
+	for _, c := range strings.ToLower(s) {
+		if c >= '0' && c <= '9' {
+			n, digits = n*10+uint64(c-'0'), true
+			continue
+		}
+		var unit uint64
+		switch c {
+		case 's':
+			unit = 1
+		case 'm':
+			unit = 60
+		case 'h':
+			unit = 3600
+		case 'd':
+			unit = 86400
+		case 'w':
+			unit = 604800
+		}
+		if unit == 0 || !digits {
+			return 0, fmt.Errorf("invalid TTL %q", s)
+		}
+		total, n, digits = total+n*unit, 0, false
+	}
+	if digits || total > 1<<31-1 {
+		return 0, fmt.Errorf("invalid TTL %q", s)
+	}
+	return uint32(total), nil
+}
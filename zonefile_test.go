@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testZoneFile = `
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		2024010101 ; serial
+		3600 600 1209600 60 )
+	IN	NS	ns1
+	IN	MX	10 mail
+ns1	IN	A	10.0.0.53
+app	300	IN	A	10.0.0.2
+	IN 1d	AAAA	fd00::2
+www		CNAME	app
+ext		CNAME	example.com.
+txt		TXT	"v=spf1 -all" " extra" ; two strings
+_https	HTTPS	1 . alpn=h2 port=8443
+$ORIGIN sub.my.local.
+host	A	10.0.1.1
+ch	CH	TXT	"ignored"
+`
+
+func TestParseZoneFile(t *testing.T) {
+	zone, err := parseZoneFile(strings.NewReader(testZoneFile), "my.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range zone.Records {
+		got = append(got, r.Domain+" "+r.Type+" "+r.Value)
+	}
+	want := []string{
+		"ns1.my.local A 10.0.0.53",
+		"app.my.local A 10.0.0.2",
+		"app.my.local AAAA fd00::2",
+		"www.my.local CNAME app.my.local",
+		"ext.my.local CNAME example.com",
+		"txt.my.local TXT v=spf1 -all extra",
+		"_https.my.local HTTPS 1 . alpn=h2 port=8443",
+		"host.sub.my.local A 10.0.1.1",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("records:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if len(zone.Skipped) != 4 {
+		t.Errorf("skipped = %q, want SOA, NS, MX and the CH record", zone.Skipped)
+	}
+
+	for _, bad := range []string{
+		"app A 10.0.0.1",            // no origin
+		"app.my.local. A not-an-ip", // invalid value
+		"app.my.local. A ( 10.0.0.1",
+		"$INCLUDE other.zone",
+		"app.my.local. TXT \"open",
+	} {
+		if _, err := parseZoneFile(strings.NewReader(bad), ""); err == nil {
+			t.Errorf("parseZoneFile(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestWebImport(t *testing.T) {
+	ws, store := testWebServer(t)
+	store.Add(Record{Domain: "app.my.local", Type: "A", Value: "10.0.0.2"})
+
+	req := httptest.NewRequest("POST", "/api/import?origin=my.local&dry_run=1", strings.NewReader(testZoneFile))
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	if w.Code != 200 || len(store.List()) != 1 || !strings.Contains(w.Body.String(), `"records":[`) {
+		t.Fatalf("dry run: %d %s, %d records stored", w.Code, w.Body.String(), len(store.List()))
+	}
+
+	req = httptest.NewRequest("POST", "/api/import?origin=my.local", strings.NewReader(testZoneFile))
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"added":7,"existing":1`) {
+		t.Fatalf("import: %d %s", w.Code, w.Body.String())
+	}
+	if len(store.List()) != 8 {
+		t.Errorf("%d records after import, want 8", len(store.List()))
+	}
+
+	req = httptest.NewRequest("POST", "/api/import", strings.NewReader("app A 10.0.0.1"))
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, req)
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "line 1") {
+		t.Errorf("bad zone: %d %s", w.Code, w.Body.String())
+	}
+}
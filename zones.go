@@ -0,0 +1,44 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// Zones is the set of zone apexes we consider ourselves authoritative for.
+// Names outside every configured zone fall back to their last two labels, so
+// "app.my.local" belongs to "my.local" unless a more specific zone exists.
+type Zones []string
+
+func NewZones(names []string) Zones {
+	var z Zones
+	for _, n := range names {
+		n = strings.ToLower(strings.Trim(strings.TrimSpace(n), "."))
+		if n != "" && !slices.Contains(z, n) {
+			z = append(z, n)
+		}
+	}
+	// Longest first so the most specific zone wins
+	slices.SortFunc(z, func(a, b string) int { return len(b) - len(a) })
+	return z
+}
+
+// ZoneOf returns the zone apex that name belongs to.
+func (z Zones) ZoneOf(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, zone := range z {
+		if inZone(name, zone) {
+			return zone
+		}
+	}
+	labels := strings.Split(name, ".")
+	if len(labels) <= 2 {
+		return name
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// inZone reports whether name equals zone or is a subdomain of it.
+func inZone(name, zone string) bool {
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
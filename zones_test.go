@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestZonesZoneOf(t *testing.T) {
+	z := NewZones([]string{"my.local", "lab.my.local.", "MY.LOCAL"})
+	if len(z) != 2 {
+		t.Fatalf("expected duplicates removed, got %v", z)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"app.my.local", "my.local"},
+		{"my.local", "my.local"},
+		{"db.lab.my.local.", "lab.my.local"},
+		{"APP.OTHER.LOCAL", "other.local"},
+		{"localhost", "localhost"},
+		{"notmy.local", "notmy.local"},
+	}
+	for _, tt := range tests {
+		if got := z.ZoneOf(tt.name); got != tt.want {
+			t.Errorf("ZoneOf(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}